@@ -0,0 +1,27 @@
+package api
+
+// Default fills in the fields a minimal spec can omit: each port's starting_port defaults to its
+// node_port, and each consumer's connection_limit to the spec's default_connection_limit. It
+// returns true if it changed the spec.
+func (s *Spec) Default() bool {
+	changed := false
+	for name, p := range s.NodePorts {
+		if p.StartingPort == 0 && p.NodePort != 0 {
+			p.StartingPort = p.NodePort
+			s.NodePorts[name] = p
+			changed = true
+		}
+	}
+	if s.DefaultConnectionLimit != 0 {
+		for i, c := range s.ConsumerAcceptList {
+			if c != nil && c.ConnectionLimit == 0 {
+				// Copied, since consumers can be shared between specs.
+				withLimit := *c
+				withLimit.ConnectionLimit = s.DefaultConnectionLimit
+				s.ConsumerAcceptList[i] = &withLimit
+				changed = true
+			}
+		}
+	}
+	return changed
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"fmt"
+	"maps"
+	"net/netip"
+	"regexp"
+	"slices"
+
+	"go.uber.org/multierr"
+)
+
+// resourceNameRegexp matches the format of a GCP resource name, which network tags share.
+var resourceNameRegexp = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// FirewallOnDelete decides what happens to the firewall rule when the STS or its spec is
+// deleted.
+type FirewallOnDelete string
+
+const (
+	// FirewallDelete deletes the rule. It's the default.
+	FirewallDelete FirewallOnDelete = "delete"
+	// FirewallDisable disables the rule instead, so it stops allowing traffic but is kept for
+	// audits, or to roll the deletion back. It's enabled again if a spec with the same prefix
+	// is applied.
+	FirewallDisable FirewallOnDelete = "disable"
+)
+
+func (p FirewallOnDelete) Validate() error {
+	switch p {
+	case "", FirewallDelete, FirewallDisable:
+		return nil
+	}
+	return fmt.Errorf("invalid firewall_on_delete %q, it must be %q or %q", p, FirewallDelete, FirewallDisable)
+}
+
+// PortFirewallName is the name of the port's firewall if the spec sets firewall_per_port.
+func PortFirewallName(prefix, port string) string {
+	return NameBase(prefix) + "-" + port + "-firewall"
+}
+
+// validateFirewall returns an error for each of the spec's invalid firewall sources or
+// destinations.
+func (s *Spec) validateFirewall() error {
+	var err error
+	for i, r := range s.SourceRanges {
+		_, parseErr := netip.ParsePrefix(r)
+		if parseErr != nil {
+			err = multierr.Append(err, fmt.Errorf("invalid source_ranges[%d]: %w", i, parseErr))
+		}
+	}
+	for i, r := range s.DestinationRanges {
+		_, parseErr := netip.ParsePrefix(r)
+		if parseErr != nil {
+			err = multierr.Append(err, fmt.Errorf("invalid destination_ranges[%d]: %w", i, parseErr))
+		}
+	}
+	err = multierr.Append(err, validateSourceTags("source_tags", s.SourceTags))
+	err = multierr.Append(err, validateFirewallPriority("firewall_priority", s.FirewallPriority))
+	// Sorted so that errors are deterministic.
+	for _, name := range slices.Sorted(maps.Keys(s.NodePorts)) {
+		p := s.NodePorts[name]
+		if !s.FirewallPerPort {
+			if len(p.SourceRanges) > 0 || len(p.SourceTags) > 0 || p.FirewallPriority != nil {
+				err = multierr.Append(err, fmt.Errorf("node_ports[%s] can only set source_ranges, source_tags or firewall_priority if firewall_per_port is set", name))
+			}
+			continue
+		}
+		if fw := PortFirewallName(s.Prefix, name); !resourceNameRegexp.MatchString(fw) {
+			err = multierr.Append(err, fmt.Errorf("node_ports[%s]'s firewall name %q is invalid, the port name must be lowercase and short enough for it to be a valid GCP resource name", name, fw))
+		}
+		for i, r := range p.SourceRanges {
+			_, parseErr := netip.ParsePrefix(r)
+			if parseErr != nil {
+				err = multierr.Append(err, fmt.Errorf("invalid node_ports[%s].source_ranges[%d]: %w", name, i, parseErr))
+			}
+		}
+		err = multierr.Append(err, validateSourceTags(fmt.Sprintf("node_ports[%s].source_tags", name), p.SourceTags))
+		err = multierr.Append(err, validateFirewallPriority(fmt.Sprintf("node_ports[%s].firewall_priority", name), p.FirewallPriority))
+	}
+	return err
+}
+
+func validateSourceTags(field string, tags []string) error {
+	var err error
+	for i, tag := range tags {
+		if !resourceNameRegexp.MatchString(tag) {
+			err = multierr.Append(err, fmt.Errorf("invalid %s[%d] %q, it must be a network tag, e.g. my-tag", field, i, tag))
+		}
+	}
+	return err
+}
+
+func validateFirewallPriority(field string, priority *int32) error {
+	if priority != nil && (*priority < 0 || *priority > 65535) {
+		return fmt.Errorf("%s (%d) must be between 0 and 65535", field, *priority)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package api
+
+import "fmt"
+
+// ScaleToZeroPolicy decides what happens to the forwarding rule and service attachment while the
+// STS is scaled to zero.
+type ScaleToZeroPolicy string
+
+const (
+	// ScaleToZeroKeep keeps them with no endpoints, so the consumers' connections are refused
+	// but their PSC endpoints stay connected. It's the default.
+	ScaleToZeroKeep ScaleToZeroPolicy = "keep"
+	// ScaleToZeroTeardown deletes them, and recreates them once the STS is scaled up. Unless the
+	// spec sets an IP, the forwarding rule gets a new one.
+	ScaleToZeroTeardown ScaleToZeroPolicy = "teardown"
+)
+
+func (p ScaleToZeroPolicy) Validate() error {
+	switch p {
+	case "", ScaleToZeroKeep, ScaleToZeroTeardown:
+		return nil
+	}
+	return fmt.Errorf("invalid scale_to_zero %q, it must be %q or %q", p, ScaleToZeroKeep, ScaleToZeroTeardown)
+}
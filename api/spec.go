@@ -0,0 +1,326 @@
+// Package api defines the spec the controller reads from the StatefulSets it maps, so that other
+// tools, e.g. chart generators or admission webhooks, can build and validate specs without
+// importing the controller.
+package api
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"regexp"
+	"slices"
+
+	"go.uber.org/multierr"
+)
+
+// SpecAnnotation is the StatefulSet annotation holding the spec, as JSON.
+const SpecAnnotation = "psc-portmapper.0x5d.org/spec"
+
+// MaxPort is the highest port consumers can connect to.
+const MaxPort = math.MaxUint16
+
+// Spec is the configuration for the controller, which is loaded from an annotation on the
+// StatefulSet.
+type Spec struct {
+	Prefix             string                `json:"prefix"`
+	IP                 *string               `json:"ip,omitempty"`
+	GlobalAccess       *bool                 `json:"global_access,omitempty"`
+	ConsumerAcceptList []*Consumer           `json:"consumer_accept_list,omitempty"`
+	NatSubnetFQNs      []string              `json:"nat_subnet_fqns,omitempty"`
+	NodePorts          map[string]PortConfig `json:"node_ports"`
+	Credentials        *CredentialsRef       `json:"credentials,omitempty"`
+	// ConsumerAcceptListFrom references a ConfigMap holding more consumers to accept, e.g. a
+	// list of the organization's projects managed centrally.
+	ConsumerAcceptListFrom *ConsumerListRef `json:"consumer_accept_list_from,omitempty"`
+	// DefaultConnectionLimit is the connection limit of the consumers that don't set one.
+	// Without it, they can't connect.
+	DefaultConnectionLimit uint32 `json:"default_connection_limit,omitempty"`
+	// If true, changes to the consumer accept list apply to the existing connections too, e.g.
+	// removing a consumer closes its connections. Defaults to false.
+	ReconcileConnections *bool `json:"reconcile_connections,omitempty"`
+	// NAT subnets to remove from the service attachment, even if they weren't added by the
+	// controller, so that they can be freed.
+	DrainingNatSubnetFQNs []string `json:"draining_nat_subnet_fqns,omitempty"`
+	// If true, the service attachment's NAT subnets are kept in the order of nat_subnet_fqns,
+	// followed by the ones added out of band. Otherwise, their order is only set when they change.
+	EnforceNatSubnetOrder bool `json:"enforce_nat_subnet_order,omitempty"`
+	// Migration moves the service attachment to another subnet without downtime for the
+	// consumers.
+	Migration *Migration `json:"migration,omitempty"`
+	// Labels added to the Kubernetes objects created for the spec, i.e. the NodePort service
+	// and the ports ConfigMap.
+	Labels map[string]string `json:"labels,omitempty"`
+	// If true, the port consumers connect to for each pod is published in a ConfigMap, for
+	// workloads that advertise their address.
+	PortsConfigMap bool `json:"ports_config_map,omitempty"`
+	// The host the advertise webhook injects into the pods, e.g. a DNS name resolving to the
+	// consumers' endpoints. Defaults to the IP.
+	AdvertisedHost string `json:"advertised_host,omitempty"`
+	// The network the spec's resources are created in, if it's not the controller's, e.g. for
+	// producers in another VPC. Subnetwork must be set too.
+	Network string `json:"network,omitempty"`
+	// The subnet the forwarding rule, and the NEG unless NEGSubnetFQN is set, are created in, if
+	// it's not the controller's subnet. It must be in the spec's network.
+	Subnetwork string `json:"subnetwork,omitempty"`
+	// The subnet of the NEG, i.e. of the nodes' primary interface, if it's not the spec's
+	// subnet. NEGs can't be updated, so changing it requires recreating the NEG.
+	NEGSubnetFQN string `json:"neg_subnetwork,omitempty"`
+	// The NEG's default port, used by the endpoints that don't set one. NEGs can't be updated,
+	// so changing it requires recreating the NEG.
+	NEGDefaultPort *int32 `json:"neg_default_port,omitempty"`
+	// ScaleToZero decides what happens to the forwarding rule and service attachment while the
+	// STS is scaled to zero.
+	ScaleToZero ScaleToZeroPolicy `json:"scale_to_zero,omitempty"`
+	// If true, a PSC consumer endpoint is created in the controller's canary subnet to verify
+	// that consumers can connect to the service attachment.
+	Canary bool `json:"canary,omitempty"`
+	// FirewallOnDelete decides whether the firewall rule is deleted or disabled when the STS
+	// or its spec is deleted.
+	FirewallOnDelete FirewallOnDelete `json:"firewall_on_delete,omitempty"`
+	// The CIDR ranges and network tags the firewall rule allows traffic from. If neither is
+	// set, it allows all sources.
+	SourceRanges []string `json:"source_ranges,omitempty"`
+	SourceTags   []string `json:"source_tags,omitempty"`
+	// The CIDR ranges the firewall rule allows traffic to, e.g. the nodes' subnet. If unset,
+	// it allows traffic to all of the network's instances.
+	DestinationRanges []string `json:"destination_ranges,omitempty"`
+	// The firewall rule's priority, 1000 if unset.
+	FirewallPriority *int32 `json:"firewall_priority,omitempty"`
+	// If true, each port gets its own firewall rule, which can override the spec's sources
+	// and priority.
+	FirewallPerPort bool `json:"firewall_per_port,omitempty"`
+	// If true, another firewall rule allows ICMP from the NAT subnets, so that consumers can
+	// ping or traceroute the producer.
+	AllowICMP bool `json:"allow_icmp,omitempty"`
+	// How long to wait before retrying the StatefulSet after a failure, overriding the
+	// controller's requeue delay, e.g. "5s" to converge faster or "10m" to call the GCP API
+	// less often.
+	RequeueDelay *Duration `json:"requeue_delay,omitempty"`
+	// How long each step of reconciling the StatefulSet, i.e. ensuring or deleting one of its
+	// resources, can take before it's failed and retried, overriding the controller's.
+	StepTimeout *Duration `json:"step_timeout,omitempty"`
+	// Annotations added to each of the NEG's endpoints, over the controller's, e.g. to identify
+	// the workload in the GCP API. Endpoints can't be updated, so changing them only affects
+	// the endpoints attached afterwards.
+	EndpointAnnotations map[string]string `json:"endpoint_annotations,omitempty"`
+}
+
+// See https://cloud.google.com/compute/docs/reference/rest/v1/serviceAttachments
+type Consumer struct {
+	NetworkFQN      *string `json:"network_fqn,omitempty"`
+	ConnectionLimit uint32  `json:"connection_limit,omitempty"`
+	ProjectIdOrNum  *string `json:"project_id_or_num,omitempty"`
+}
+
+// CredentialsRef references a Secret in the StatefulSet's namespace holding the GCP credentials
+// to reconcile the spec with.
+type CredentialsRef struct {
+	SecretName string `json:"secret_name"`
+}
+
+// ConsumerListRef references a ConfigMap key holding a JSON list of consumers, in the format
+// of consumer_accept_list.
+type ConsumerListRef struct {
+	// Defaults to the StatefulSet's namespace.
+	Namespace string `json:"namespace,omitempty"`
+	ConfigMap string `json:"config_map"`
+	// Defaults to "consumers".
+	Key string `json:"key,omitempty"`
+}
+
+// Migration configures a second forwarding rule and service attachment, which are created next
+// to the original ones so that consumers can move to them. The original ones are only deleted
+// once the STS' migration ack annotation acknowledges the migration.
+type Migration struct {
+	// The subnet to allocate the forwarding rule's IP from. It must be in the network of the
+	// controller's subnet.
+	SubnetFQN string  `json:"subnet_fqn"`
+	IP        *string `json:"ip,omitempty"`
+	// The NAT subnets of the migration's service attachment.
+	NatSubnetFQNs []string `json:"nat_subnet_fqns"`
+}
+
+type PortConfig struct {
+	NodePort      int32 `json:"node_port"`
+	ContainerPort int32 `json:"container_port"`
+	StartingPort  int32 `json:"starting_port"`
+	// The name of the container port to target instead of its number, e.g. if it changes
+	// between revisions. It's resolved for each pod, so container_port can't be set too.
+	ContainerPortName string `json:"container_port_name,omitempty"`
+	// The container the target port belongs to, in pods with several containers. If unset,
+	// the port mustn't be declared by more than one of them.
+	Container string `json:"container,omitempty"`
+	// Override the spec's firewall sources and priority for the port's rule. They can only be
+	// set if the spec sets firewall_per_port.
+	SourceRanges     []string `json:"source_ranges,omitempty"`
+	SourceTags       []string `json:"source_tags,omitempty"`
+	FirewallPriority *int32   `json:"firewall_priority,omitempty"`
+}
+
+// NameBase returns the name the spec's resources are named after, given its prefix.
+func NameBase(prefix string) string {
+	return prefix + "psc-portmapper"
+}
+
+// networkFQNRegexp matches the format of a network FQN, e.g.
+// projects/my-project-id/global/networks/my-vpc-name
+var networkFQNRegexp = regexp.MustCompile(`^projects\/[^/]+\/global\/networks\/[^/]+$`)
+
+// subnetFQNRegexp matches the format of a subnet FQN, e.g.
+// projects/my-project-id/regions/us-east1/subnetworks/my-subnet-name
+var subnetFQNRegexp = regexp.MustCompile(`^projects\/[^/]+\/regions\/[^/]+\/subnetworks\/[^/]+$`)
+
+// IsSubnetFQN returns true if fqn is a subnet FQN, e.g.
+// projects/my-project-id/regions/us-east1/subnetworks/my-subnet-name
+func IsSubnetFQN(fqn string) bool {
+	return subnetFQNRegexp.MatchString(fqn)
+}
+
+// Validate returns an error for each of the spec's invalid fields. The consumers referenced
+// with consumer_accept_list_from are validated once they're read, see ValidateConsumers.
+func (s *Spec) Validate() error {
+	if s == nil {
+		return fmt.Errorf("spec is nil")
+	}
+
+	err := ValidateConsumers(s.ConsumerAcceptList, "consumer_list")
+	if s.ConsumerAcceptListFrom != nil && s.ConsumerAcceptListFrom.ConfigMap == "" {
+		err = multierr.Append(err, errors.New("consumer_accept_list_from.config_map must be set if consumer_accept_list_from is set"))
+	}
+
+	if len(s.NatSubnetFQNs) == 0 {
+		err = multierr.Append(err, errors.New("nat_subnet_fqns is empty"))
+	}
+	for i, sn := range s.NatSubnetFQNs {
+		matches := subnetFQNRegexp.FindStringSubmatch(sn)
+		if matches == nil {
+			matchErr := fmt.Errorf(
+				"invalid value for nat_subnet_fqns[%d] (%q), expected format: projects/<project-id>/regions/<region-name>/subnetworks/<subnetwork-name>",
+				i,
+				sn,
+			)
+			err = multierr.Append(err, matchErr)
+		}
+	}
+
+	for i, sn := range s.DrainingNatSubnetFQNs {
+		if subnetFQNRegexp.FindStringSubmatch(sn) == nil {
+			matchErr := fmt.Errorf(
+				"invalid value for draining_nat_subnet_fqns[%d] (%q), expected format: projects/<project-id>/regions/<region-name>/subnetworks/<subnetwork-name>",
+				i,
+				sn,
+			)
+			err = multierr.Append(err, matchErr)
+		}
+		if slices.Contains(s.NatSubnetFQNs, sn) {
+			err = multierr.Append(err, fmt.Errorf("draining_nat_subnet_fqns[%d] (%q) is also in nat_subnet_fqns", i, sn))
+		}
+	}
+
+	if s.Network != "" && networkFQNRegexp.FindStringSubmatch(s.Network) == nil {
+		err = multierr.Append(err, fmt.Errorf(
+			"invalid value for network (%q), expected format: projects/<project-id>/global/networks/<network-name>",
+			s.Network,
+		))
+	}
+	if s.Network != "" && s.Subnetwork == "" {
+		err = multierr.Append(err, errors.New("subnetwork must be set if network is set"))
+	}
+	if s.Subnetwork != "" && subnetFQNRegexp.FindStringSubmatch(s.Subnetwork) == nil {
+		err = multierr.Append(err, fmt.Errorf(
+			"invalid value for subnetwork (%q), expected format: projects/<project-id>/regions/<region-name>/subnetworks/<subnetwork-name>",
+			s.Subnetwork,
+		))
+	}
+	if s.NEGSubnetFQN != "" && subnetFQNRegexp.FindStringSubmatch(s.NEGSubnetFQN) == nil {
+		err = multierr.Append(err, fmt.Errorf(
+			"invalid value for neg_subnetwork (%q), expected format: projects/<project-id>/regions/<region-name>/subnetworks/<subnetwork-name>",
+			s.NEGSubnetFQN,
+		))
+	}
+	if p := s.NEGDefaultPort; p != nil && (*p < 1 || *p > MaxPort) {
+		err = multierr.Append(err, fmt.Errorf("neg_default_port (%d) must be between 1 and %d", *p, MaxPort))
+	}
+
+	// Sorted so that errors are deterministic.
+	for _, name := range slices.Sorted(maps.Keys(s.NodePorts)) {
+		if p := s.NodePorts[name]; p.ContainerPort != 0 && p.ContainerPortName != "" {
+			err = multierr.Append(err, fmt.Errorf("node_ports[%s] can't set both container_port and container_port_name", name))
+		}
+	}
+
+	if s.Migration != nil {
+		err = multierr.Append(err, s.Migration.validate())
+	}
+
+	err = multierr.Append(err, s.ScaleToZero.Validate())
+	err = multierr.Append(err, s.FirewallOnDelete.Validate())
+	err = multierr.Append(err, s.validateFirewall())
+	err = multierr.Append(err, s.validateTiming())
+
+	if _, ok := s.EndpointAnnotations[""]; ok {
+		err = multierr.Append(err, errors.New("endpoint_annotations can't have an empty key"))
+	}
+
+	if s.Credentials != nil && s.Credentials.SecretName == "" {
+		err = multierr.Append(err, errors.New("credentials.secret_name must be set if credentials is set"))
+	}
+
+	return err
+}
+
+func (m *Migration) validate() error {
+	var err error
+	if subnetFQNRegexp.FindStringSubmatch(m.SubnetFQN) == nil {
+		err = multierr.Append(err, fmt.Errorf(
+			"invalid value for migration.subnet_fqn (%q), expected format: projects/<project-id>/regions/<region-name>/subnetworks/<subnetwork-name>",
+			m.SubnetFQN,
+		))
+	}
+	if len(m.NatSubnetFQNs) == 0 {
+		err = multierr.Append(err, errors.New("migration.nat_subnet_fqns is empty"))
+	}
+	for i, sn := range m.NatSubnetFQNs {
+		if subnetFQNRegexp.FindStringSubmatch(sn) == nil {
+			err = multierr.Append(err, fmt.Errorf(
+				"invalid value for migration.nat_subnet_fqns[%d] (%q), expected format: projects/<project-id>/regions/<region-name>/subnetworks/<subnetwork-name>",
+				i,
+				sn,
+			))
+		}
+	}
+	return err
+}
+
+// ValidateConsumers validates the consumers of a list, which is named in the errors. Consumers
+// without a connection limit are valid, but can't connect unless the spec sets
+// default_connection_limit.
+func ValidateConsumers(consumers []*Consumer, list string) error {
+	var err error
+	for i, c := range consumers {
+		if c == nil {
+			err = multierr.Append(err, fmt.Errorf("%s[%d] is null", list, i))
+			continue
+		}
+		if c.NetworkFQN == nil && c.ProjectIdOrNum == nil {
+			err = multierr.Append(err, fmt.Errorf("either network_fqn or project_id_or_num must be set in %s[%d]", list, i))
+		}
+		if c.NetworkFQN != nil && c.ProjectIdOrNum != nil {
+			err = multierr.Append(err, fmt.Errorf("network_fqn and project_id_or_num can't both be set in %s[%d]", list, i))
+		}
+		if c.NetworkFQN != nil {
+			matches := networkFQNRegexp.FindStringSubmatch(*c.NetworkFQN)
+			if matches == nil {
+				matchErr := fmt.Errorf(
+					"invalid value for network_fqn (%q) in %s[%d], expected format: projects/<project-id>/global/networks/<network-name>",
+					*c.NetworkFQN,
+					list,
+					i,
+				)
+				err = multierr.Append(err, matchErr)
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/utils/ptr"
+)
+
+func TestSpecValidate(t *testing.T) {
+	subnet := "projects/my-project/regions/us-east1/subnetworks/my-subnet"
+	tests := []struct {
+		name string
+		spec *Spec
+		err  string
+	}{{
+		name: "Valid",
+		spec: &Spec{
+			Prefix:             "p-",
+			NatSubnetFQNs:      []string{subnet},
+			ConsumerAcceptList: []*Consumer{{ProjectIdOrNum: ptr.To("consumer"), ConnectionLimit: 10}},
+			NodePorts:          map[string]PortConfig{"app": {NodePort: 30000, ContainerPort: 8080, StartingPort: 40000}},
+		},
+	}, {
+		name: "Nil",
+		err:  "spec is nil",
+	}, {
+		name: "Accumulates errors",
+		spec: &Spec{
+			ConsumerAcceptList: []*Consumer{nil},
+			NEGDefaultPort:     ptr.To(int32(0)),
+			ScaleToZero:        "never",
+			SourceTags:         []string{"Tag"},
+			Credentials:        &CredentialsRef{},
+		},
+		err: `consumer_list[0] is null; nat_subnet_fqns is empty; neg_default_port (0) must be between 1 and 65535; invalid scale_to_zero "never", it must be "keep" or "teardown"; invalid source_tags[0] "Tag", it must be a network tag, e.g. my-tag; credentials.secret_name must be set if credentials is set`,
+	}, {
+		name: "Validates the ports' firewall names",
+		spec: &Spec{
+			NatSubnetFQNs:   []string{subnet},
+			FirewallPerPort: true,
+			NodePorts:       map[string]PortConfig{"App": {NodePort: 30000}},
+		},
+		err: `node_ports[App]'s firewall name "psc-portmapper-App-firewall" is invalid, the port name must be lowercase and short enough for it to be a valid GCP resource name`,
+	}, {
+		name: "Validates the requeue delay and step timeout",
+		spec: &Spec{
+			NatSubnetFQNs: []string{subnet},
+			RequeueDelay:  &Duration{-time.Second},
+			StepTimeout:   &Duration{},
+		},
+		err: "requeue_delay (-1s) must be positive; step_timeout (0s) must be positive",
+	}, {
+		name: "Validates the endpoint annotations",
+		spec: &Spec{
+			NatSubnetFQNs:       []string{subnet},
+			EndpointAnnotations: map[string]string{"": "kafka"},
+		},
+		err: "endpoint_annotations can't have an empty key",
+	}, {
+		name: "Validates the target ports",
+		spec: &Spec{
+			NatSubnetFQNs: []string{subnet},
+			NodePorts: map[string]PortConfig{
+				"app":   {NodePort: 30000, ContainerPortName: "app"},
+				"admin": {NodePort: 30001, ContainerPort: 9090, ContainerPortName: "admin"},
+			},
+		},
+		err: "node_ports[admin] can't set both container_port and container_port_name",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.spec.Validate()
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestSpecJSON(t *testing.T) {
+	spec := Spec{
+		Prefix:        "p-",
+		NatSubnetFQNs: []string{"projects/my-project/regions/us-east1/subnetworks/my-subnet"},
+		NodePorts:     map[string]PortConfig{"app": {NodePort: 30000, ContainerPort: 8080, StartingPort: 40000}},
+		ScaleToZero:   ScaleToZeroTeardown,
+		RequeueDelay:  &Duration{5 * time.Second},
+		StepTimeout:   &Duration{2 * time.Minute},
+	}
+	data, err := json.Marshal(spec)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"prefix": "p-",
+		"nat_subnet_fqns": ["projects/my-project/regions/us-east1/subnetworks/my-subnet"],
+		"node_ports": {"app": {"node_port": 30000, "container_port": 8080, "starting_port": 40000}},
+		"scale_to_zero": "teardown",
+		"requeue_delay": "5s",
+		"step_timeout": "2m0s"
+	}`, string(data))
+
+	var decoded Spec
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	require.Equal(t, spec, decoded)
+
+	require.ErrorContains(t, json.Unmarshal([]byte(`{"requeue_delay": 5}`), &decoded), `a duration must be a string, e.g. "30s"`)
+	require.ErrorContains(t, json.Unmarshal([]byte(`{"step_timeout": "soon"}`), &decoded), `invalid duration "soon"`)
+}
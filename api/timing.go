@@ -0,0 +1,42 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/multierr"
+)
+
+// Duration is a time.Duration written as a string in the format of time.ParseDuration, e.g.
+// "30s" or "2m".
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return errors.New("a duration must be a string, e.g. \"30s\"")
+	}
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+// validateTiming returns an error if the spec's requeue delay or step timeout isn't positive.
+func (s *Spec) validateTiming() error {
+	var err error
+	if s.RequeueDelay != nil && s.RequeueDelay.Duration <= 0 {
+		err = multierr.Append(err, fmt.Errorf("requeue_delay (%s) must be positive", s.RequeueDelay))
+	}
+	if s.StepTimeout != nil && s.StepTimeout.Duration <= 0 {
+		err = multierr.Append(err, fmt.Errorf("step_timeout (%s) must be positive", s.StepTimeout))
+	}
+	return err
+}
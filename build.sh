@@ -2,4 +2,7 @@
 
 set -e
 
+# Embedded in the binary, see .ko.yaml.
+export VERSION=${TAG:-0.0.0}
+
 ko build --platform linux/amd64 --platform linux/arm64 --local --preserve-import-paths --tag-only github.com/0x5d/psc-portmapper
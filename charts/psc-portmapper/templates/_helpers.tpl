@@ -60,3 +60,21 @@ Create the name of the service account to use
 {{- default "default" .Values.serviceAccount.name }}
 {{- end }}
 {{- end }}
+
+{{/*
+Whether any of the webhooks are enabled
+*/}}
+{{- define "psc-portmapper.webhooksEnabled" -}}
+{{- if or .Values.advertiseWebhook.enabled .Values.defaultingWebhook.enabled .Values.validationWebhook.enabled .Values.deletionGuardWebhook.enabled }}true{{- end }}
+{{- end }}
+
+{{/*
+The name of the TLS secret with the webhooks' serving certificate
+*/}}
+{{- define "psc-portmapper.webhookCertSecretName" -}}
+{{- if .Values.webhook.certManagerIssuer }}
+{{- printf "%s-webhook-cert" (include "psc-portmapper.fullname" .) }}
+{{- else }}
+{{- required "webhook.certSecretName or webhook.certManagerIssuer must be set" .Values.webhook.certSecretName }}
+{{- end }}
+{{- end }}
@@ -0,0 +1,165 @@
+// Package api implements an opt-in, read-only HTTP API serving the desired and actual state of
+// the StatefulSets the controller manages, and their health, for dashboards. It's served over
+// TLS, and requests are authenticated and authorized against the API server like the metrics
+// endpoint's, so callers need RBAC allowing get on the /api/v1/portmaps and
+// /api/v1/portmaps/* non-resource URLs.
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/0x5d/psc-portmapper/internal/controller"
+	"github.com/go-logr/logr"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	certutil "k8s.io/client-go/util/cert"
+	"sigs.k8s.io/controller-runtime/pkg/certwatcher"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+)
+
+// shutdownTimeout bounds how long the server waits for requests in flight when it's stopped.
+const shutdownTimeout = 5 * time.Second
+
+// Source reads the StatefulSets' state. It's implemented by controller.PortmapReconciler.
+type Source interface {
+	ListPortmaps(ctx context.Context) ([]*controller.Portmap, error)
+	// GetPortmap returns a NotFound error if the StatefulSet doesn't exist or isn't managed.
+	GetPortmap(ctx context.Context, name types.NamespacedName) (*controller.Portmap, error)
+}
+
+// Server serves the API. It's a manager.Runnable that runs on every replica, not only on the
+// leader, since the state is read from the StatefulSets.
+type Server struct {
+	log  logr.Logger
+	addr string
+	// The directory with the serving certificate, tls.crt and tls.key, which is reloaded when
+	// it changes. Empty serves a self-signed certificate.
+	certDir string
+	// Authenticates and authorizes the requests. See
+	// sigs.k8s.io/controller-runtime/pkg/metrics/filters.WithAuthenticationAndAuthorization.
+	filter metricsserver.Filter
+	mux    *http.ServeMux
+	src    Source
+}
+
+func NewServer(log logr.Logger, addr, certDir string, filter metricsserver.Filter, src Source) *Server {
+	s := &Server{log: log, addr: addr, certDir: certDir, filter: filter, mux: http.NewServeMux(), src: src}
+	s.mux.HandleFunc("GET /api/v1/portmaps", s.list)
+	s.mux.HandleFunc("GET /api/v1/portmaps/{namespace}/{name}", s.get)
+	return s
+}
+
+// Handler returns the API's handler, without authentication and authorization.
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
+
+// Start serves until ctx is done.
+func (s *Server) Start(ctx context.Context) error {
+	handler, err := s.filter(s.log, s.mux)
+	if err != nil {
+		return fmt.Errorf("failed to add the authentication filter: %w", err)
+	}
+	cfg, err := s.tlsConfig(ctx)
+	if err != nil {
+		return err
+	}
+	l, err := tls.Listen("tcp", s.addr, cfg)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	s.log.Info("Serving the API.", "address", s.addr)
+	err = srv.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		<-done
+		return nil
+	}
+	return err
+}
+
+func (s *Server) NeedLeaderElection() bool {
+	return false
+}
+
+// tlsConfig returns a config serving the certificate in certDir, watching it for changes until
+// ctx is done, or a self-signed one if it's empty.
+func (s *Server) tlsConfig(ctx context.Context) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if s.certDir == "" {
+		certPEM, keyPEM, err := certutil.GenerateSelfSignedCertKey("localhost", []net.IP{{127, 0, 0, 1}}, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate a self-signed certificate: %w", err)
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+		return cfg, nil
+	}
+	watcher, err := certwatcher.New(filepath.Join(s.certDir, "tls.crt"), filepath.Join(s.certDir, "tls.key"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the serving certificate: %w", err)
+	}
+	go func() {
+		err := watcher.Start(ctx)
+		if err != nil {
+			s.log.Error(err, "Failed to watch the serving certificate.")
+		}
+	}()
+	cfg.GetCertificate = watcher.GetCertificate
+	return cfg, nil
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	portmaps, err := s.src.ListPortmaps(r.Context())
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"items": portmaps})
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request) {
+	name := types.NamespacedName{Namespace: r.PathValue("namespace"), Name: r.PathValue("name")}
+	portmap, err := s.src.GetPortmap(r.Context(), name)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, portmap)
+}
+
+func (s *Server) writeError(w http.ResponseWriter, err error) {
+	if apierrors.IsNotFound(err) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	s.log.Error(err, "Failed to read the StatefulSets.")
+	writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
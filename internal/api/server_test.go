@@ -0,0 +1,168 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/0x5d/psc-portmapper/internal/controller"
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+type source struct {
+	portmaps []*controller.Portmap
+	err      error
+}
+
+func (s *source) ListPortmaps(context.Context) ([]*controller.Portmap, error) {
+	return s.portmaps, s.err
+}
+
+func (s *source) GetPortmap(_ context.Context, name types.NamespacedName) (*controller.Portmap, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	for _, p := range s.portmaps {
+		if p.Namespace == name.Namespace && p.Name == name.Name {
+			return p, nil
+		}
+	}
+	return nil, apierrors.NewNotFound(appsv1.Resource("statefulsets"), name.String())
+}
+
+func TestServer(t *testing.T) {
+	portmaps := []*controller.Portmap{{
+		Namespace: "default",
+		Name:      "sts",
+		Status:    &controller.Status{DesiredStateHash: "hash"},
+		Health:    controller.PortmapHealth{Ready: true, Reason: "Reconciled"},
+	}}
+
+	tests := []struct {
+		name     string
+		src      *source
+		method   string
+		path     string
+		status   int
+		expected string
+	}{{
+		name:   "list",
+		src:    &source{portmaps: portmaps},
+		path:   "/api/v1/portmaps",
+		status: http.StatusOK,
+		expected: `{"items": [{
+			"namespace": "default",
+			"name": "sts",
+			"status": {"desired_state_hash": "hash"},
+			"health": {"ready": true, "reason": "Reconciled", "stuck": false}
+		}]}`,
+	}, {
+		name:     "empty list",
+		src:      &source{portmaps: []*controller.Portmap{}},
+		path:     "/api/v1/portmaps",
+		status:   http.StatusOK,
+		expected: `{"items": []}`,
+	}, {
+		name:   "get",
+		src:    &source{portmaps: portmaps},
+		path:   "/api/v1/portmaps/default/sts",
+		status: http.StatusOK,
+		expected: `{
+			"namespace": "default",
+			"name": "sts",
+			"status": {"desired_state_hash": "hash"},
+			"health": {"ready": true, "reason": "Reconciled", "stuck": false}
+		}`,
+	}, {
+		name:     "not found",
+		src:      &source{portmaps: portmaps},
+		path:     "/api/v1/portmaps/default/other",
+		status:   http.StatusNotFound,
+		expected: `{"error": "statefulsets.apps \"default/other\" not found"}`,
+	}, {
+		name:     "error",
+		src:      &source{err: errors.New("cache isn't synced")},
+		path:     "/api/v1/portmaps",
+		status:   http.StatusInternalServerError,
+		expected: `{"error": "cache isn't synced"}`,
+	}, {
+		name:   "read-only",
+		src:    &source{portmaps: portmaps},
+		method: http.MethodDelete,
+		path:   "/api/v1/portmaps/default/sts",
+		status: http.StatusMethodNotAllowed,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(logr.Discard(), "", "", nil, tt.src)
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			rec := httptest.NewRecorder()
+			s.Handler().ServeHTTP(rec, httptest.NewRequest(method, tt.path, nil))
+			require.Equal(t, tt.status, rec.Code)
+			if tt.expected != "" {
+				require.JSONEq(t, tt.expected, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestServerAuthentication(t *testing.T) {
+	// Like the metrics filter, but with a static token.
+	filter := func(_ logr.Logger, h http.Handler) (http.Handler, error) {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer token" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, r)
+		}), nil
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	s := NewServer(logr.Discard(), addr, "", filter, &source{portmaps: []*controller.Portmap{}})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Start(ctx) }()
+	defer func() {
+		cancel()
+		require.NoError(t, <-done)
+	}()
+
+	// The certificate is self-signed.
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	get := func(token string) int {
+		req, err := http.NewRequest(http.MethodGet, "https://"+addr+"/api/v1/portmaps", nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := c.Do(req)
+		if err != nil {
+			return 0
+		}
+		defer res.Body.Close()
+		var body json.RawMessage
+		_ = json.NewDecoder(res.Body).Decode(&body)
+		return res.StatusCode
+	}
+	require.Eventually(t, func() bool { return get("token") == http.StatusOK }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, http.StatusUnauthorized, get(""))
+	require.Equal(t, http.StatusUnauthorized, get("other"))
+}
@@ -1,7 +1,131 @@
 package config
 
-import "github.com/0x5d/psc-portmapper/internal/gcp"
+import (
+	"time"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+)
 
 type Config struct {
-	GCP *gcp.ClientConfig `env:", prefix=GCP_"`
+	GCP        *gcp.ClientConfig `env:", prefix=GCP_"`
+	Controller *ControllerConfig `env:", prefix=CONTROLLER_"`
+	Log        *LogConfig        `env:", prefix=LOG_"`
+	// The namespaces to reconcile StatefulSets in. All namespaces are watched if it's empty.
+	WatchNamespaces []string `env:"WATCH_NAMESPACES"`
+	// If set, only StatefulSets matching this label selector are reconciled, so that several
+	// controller instances can manage disjoint sets of StatefulSets.
+	WatchLabelSelector string `env:"WATCH_LABEL_SELECTOR"`
+	// Controller instances watching disjoint sets of StatefulSets in the same cluster must use
+	// different leader election IDs.
+	LeaderElectionID string `env:"LEADER_ELECTION_ID, default=0f70e84f.0x5d.org"`
+	// The path of a YAML file overriding ControllerConfig's settings, see FileConfig. It's
+	// reloaded when it changes.
+	ConfigFile string `env:"CONFIG_FILE"`
+}
+
+// ControllerConfig configures the reconciler.
+type ControllerConfig struct {
+	// How long to wait before retrying a failed reconcile.
+	RequeueDelay time.Duration `env:"REQUEUE_DELAY, default=1m"`
+	// How often the GCP resources are checked for drift when their desired state doesn't
+	// change. 0 checks them on every reconcile.
+	DriftCheckInterval time.Duration `env:"DRIFT_CHECK_INTERVAL, default=10m"`
+	// How long each step of a reconcile, i.e. ensuring or deleting one of a StatefulSet's GCP
+	// resources, can take before it's failed. 0 doesn't time them out. Specs can override it.
+	StepTimeout time.Duration `env:"STEP_TIMEOUT"`
+	// Only StatefulSets with a matching psc-portmapper.0x5d.org/class annotation are reconciled.
+	// If empty, only StatefulSets without the annotation are.
+	Class     string           `env:"CLASS"`
+	RateLimit *RateLimitConfig `env:", prefix=RATE_LIMIT_"`
+	// How many replicas the StatefulSets are sharded between, by a consistent hash of their
+	// namespace and name, and which of them this one is. Every shard is active at once. A count
+	// of 0 or 1 disables sharding.
+	ShardIndex int `env:"SHARD_INDEX"`
+	ShardCount int `env:"SHARD_COUNT"`
+	// If a StatefulSet has been failing to reconcile for longer than this, the controller's
+	// liveness check fails so that it's restarted. 0 disables the check.
+	StuckThreshold time.Duration `env:"STUCK_THRESHOLD"`
+	// How many times in a row a StatefulSet can fail to reconcile before it's reported as
+	// stuck, with a Warning event and the psc_portmapper_stuck metric. 0 disables reporting.
+	StuckAfterFailures int `env:"STUCK_AFTER_FAILURES, default=10"`
+	// How StatefulSets with an invalid spec are handled: "requeue" retries them with a backoff,
+	// and "park" doesn't until they change. See controller.InvalidSpecMode.
+	InvalidSpecs string `env:"INVALID_SPECS, default=requeue"`
+	// How long a deleted StatefulSet's GCP resources are kept while consumers are still
+	// connected to its service attachment. 0 deletes them right away.
+	DrainTimeout time.Duration `env:"DRAIN_TIMEOUT"`
+	// How much of its connection limit a consumer of a service attachment can use, in percent,
+	// before a Warning event is emitted on the StatefulSet. 0 disables the events.
+	ConnectionLimitAlertPercent int `env:"CONNECTION_LIMIT_ALERT_PERCENT, default=80"`
+	// How many of its NAT subnets' addresses a service attachment can use, in percent, before
+	// a Warning event is emitted on the StatefulSet. 0 disables the events.
+	NatSubnetAlertPercent int `env:"NAT_SUBNET_ALERT_PERCENT, default=80"`
+	// Whether forwarding rules allow global access when neither the spec nor the config file's
+	// spec defaults set global_access.
+	GlobalAccessDefault bool `env:"GLOBAL_ACCESS_DEFAULT"`
+	// How many endpoints a NEG can have, i.e. the project's quota. A Warning event is emitted on
+	// StatefulSets scaled beyond it. 0 disables the check.
+	NEGEndpointLimit int `env:"NEG_ENDPOINT_LIMIT, default=10000"`
+	// How long to wait for each connection when probing the mapped ports through the forwarding
+	// rule after reconciling a StatefulSet. 0 disables probing.
+	ProbeTimeout time.Duration `env:"PROBE_TIMEOUT"`
+	// The subnet specs' canary PSC endpoints are created in, usually in a dedicated test project
+	// and network. Specs can't enable the canary without it.
+	CanarySubnet string `env:"CANARY_SUBNET"`
+	// The minimum time between two writes of a StatefulSet's status annotation that only
+	// refresh it, e.g. its last drift check. 0 doesn't coalesce writes.
+	StatusWriteInterval time.Duration `env:"STATUS_WRITE_INTERVAL"`
+	// Where the instances backing the nodes are read from, tried in order: provider-id,
+	// node-name, label:<key> or annotation:<key>. Defaults to provider-id.
+	InstanceSources []string `env:"INSTANCE_SOURCES"`
+	// The <namespace>/<name> of a ConfigMap the adoption reports of StatefulSets reconciled by
+	// another version of the controller are written to. Empty only reports them with events.
+	AdoptionReportConfigMap string `env:"ADOPTION_REPORT_CONFIG_MAP"`
+	// How often snapshots of the GCP resources managed for each StatefulSet are exported, to
+	// GCP's snapshot bucket if it's set or to a ConfigMap next to the StatefulSet otherwise. 0
+	// disables the export.
+	SnapshotInterval time.Duration `env:"SNAPSHOT_INTERVAL"`
+	// Whether the StatefulSets' port mappings, probe results and the progress of failed attempts
+	// to reconcile them are written to GCP's state bucket if it's set, or to a ConfigMap next to
+	// each StatefulSet otherwise, instead of to their status annotation, for StatefulSets with
+	// thousands of mappings.
+	ExternalState bool `env:"EXTERNAL_STATE"`
+	// The budget of mutating GCP operations per minute shared by every StatefulSet in bulk
+	// mode, which also reconciles them one at a time, e.g. during a cluster migration. 0
+	// disables bulk mode.
+	BulkOperationsPerMinute int `env:"BULK_OPERATIONS_PER_MINUTE"`
+	// How long the node ports of a deleted StatefulSet can't be reused by another one. 0 lets
+	// them be reused right away.
+	NodePortCooldown time.Duration `env:"NODE_PORT_COOLDOWN"`
+	// The <namespace>/<name> of the ConfigMap the released node ports are written to. It must be
+	// set if NodePortCooldown is.
+	ReleasedNodePortsConfigMap string `env:"RELEASED_NODE_PORTS_CONFIG_MAP"`
+	// Whether to serve the webhook injecting the advertised address into the pods of
+	// StatefulSets with a spec. It requires a MutatingWebhookConfiguration and TLS certificates.
+	AdvertiseWebhook bool `env:"ADVERTISE_WEBHOOK"`
+	// Whether to serve the webhook filling in the defaults of the StatefulSets' specs. It
+	// requires a MutatingWebhookConfiguration and TLS certificates.
+	DefaultingWebhook bool `env:"DEFAULTING_WEBHOOK"`
+	// Whether to serve the webhook rejecting StatefulSets whose spec is invalid or violates the
+	// policy. It requires a ValidatingWebhookConfiguration and TLS certificates.
+	ValidationWebhook bool `env:"VALIDATION_WEBHOOK"`
+	// Whether to serve the webhook rejecting the deletion of the NodePort services of the
+	// StatefulSets the controller manages. It requires a ValidatingWebhookConfiguration and TLS
+	// certificates.
+	DeletionGuardWebhook bool `env:"DELETION_GUARD_WEBHOOK"`
+}
+
+// RateLimitConfig configures how fast StatefulSets are requeued. The defaults match
+// controller-runtime's.
+type RateLimitConfig struct {
+	// The per-StatefulSet backoff after its first failure, doubling with each failure.
+	BaseDelay time.Duration `env:"BASE_DELAY, default=5ms"`
+	// The maximum per-StatefulSet backoff.
+	MaxDelay time.Duration `env:"MAX_DELAY, default=1000s"`
+	// The overall requeues per second, and their burst.
+	QPS   float64 `env:"QPS, default=10"`
+	Burst int     `env:"BURST, default=100"`
+	// The requeues per second of each namespace, and their burst. 0 doesn't limit them.
+	NamespaceQPS   float64 `env:"NAMESPACE_QPS"`
+	NamespaceBurst int     `env:"NAMESPACE_BURST"`
 }
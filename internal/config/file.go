@@ -0,0 +1,223 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-logr/logr"
+	"go.uber.org/multierr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// FileConfig is the part of the controller's configuration that can be set in a YAML file,
+// which is reloaded when it changes. Unset fields keep the values set by environment
+// variables.
+type FileConfig struct {
+	RequeueDelay       *metav1.Duration     `json:"requeueDelay,omitempty"`
+	DriftCheckInterval *metav1.Duration     `json:"driftCheckInterval,omitempty"`
+	RateLimit          *FileRateLimitConfig `json:"rateLimit,omitempty"`
+	StuckAfterFailures *int                 `json:"stuckAfterFailures,omitempty"`
+	// See ControllerConfig.BulkOperationsPerMinute.
+	BulkOperationsPerMinute *int `json:"bulkOperationsPerMinute,omitempty"`
+	// Merged into every spec. They use the same format as the spec annotation, and are decoded
+	// by the controller, see controller.ParseSpecDefaults.
+	SpecDefaults json.RawMessage `json:"specDefaults,omitempty"`
+	// Restricts what specs can configure. See controller.ParsePolicy.
+	Policy json.RawMessage `json:"policy,omitempty"`
+}
+
+// FileRateLimitConfig overrides RateLimitConfig.
+type FileRateLimitConfig struct {
+	BaseDelay *metav1.Duration `json:"baseDelay,omitempty"`
+	MaxDelay  *metav1.Duration `json:"maxDelay,omitempty"`
+	QPS       *float64         `json:"qps,omitempty"`
+	Burst     *int             `json:"burst,omitempty"`
+	// See RateLimitConfig.NamespaceQPS.
+	NamespaceQPS   *float64 `json:"namespaceQPS,omitempty"`
+	NamespaceBurst *int     `json:"namespaceBurst,omitempty"`
+}
+
+// LoadFile reads and decodes the config file at path. Unknown fields are rejected, so that
+// typos don't go unnoticed.
+func LoadFile(path string) (*FileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseFile(data)
+}
+
+func parseFile(data []byte) (*FileConfig, error) {
+	f := &FileConfig{}
+	err := yaml.UnmarshalStrict(data, f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file: %w", err)
+	}
+	err = f.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file: %w", err)
+	}
+	return f, nil
+}
+
+// validate returns an error if a value set in the file is out of range, e.g. a rate limit that
+// would never let a StatefulSet be requeued.
+func (f *FileConfig) validate() error {
+	var err error
+	nonNegative := func(name string, d *metav1.Duration) {
+		if d != nil && d.Duration < 0 {
+			err = multierr.Append(err, fmt.Errorf("%s can't be negative, got %s", name, d.Duration))
+		}
+	}
+	nonNegative("requeueDelay", f.RequeueDelay)
+	nonNegative("driftCheckInterval", f.DriftCheckInterval)
+	if f.StuckAfterFailures != nil && *f.StuckAfterFailures < 0 {
+		err = multierr.Append(err, fmt.Errorf("stuckAfterFailures can't be negative, got %d", *f.StuckAfterFailures))
+	}
+	if f.BulkOperationsPerMinute != nil && *f.BulkOperationsPerMinute < 0 {
+		err = multierr.Append(err, fmt.Errorf("bulkOperationsPerMinute can't be negative, got %d", *f.BulkOperationsPerMinute))
+	}
+	if rl := f.RateLimit; rl != nil {
+		nonNegative("rateLimit.baseDelay", rl.BaseDelay)
+		nonNegative("rateLimit.maxDelay", rl.MaxDelay)
+		if rl.QPS != nil && *rl.QPS <= 0 {
+			err = multierr.Append(err, fmt.Errorf("rateLimit.qps must be positive, got %v", *rl.QPS))
+		}
+		if rl.Burst != nil && *rl.Burst <= 0 {
+			err = multierr.Append(err, fmt.Errorf("rateLimit.burst must be positive, got %d", *rl.Burst))
+		}
+		// A namespace QPS of 0 disables the per-namespace limit.
+		if rl.NamespaceQPS != nil && *rl.NamespaceQPS < 0 {
+			err = multierr.Append(err, fmt.Errorf("rateLimit.namespaceQPS can't be negative, got %v", *rl.NamespaceQPS))
+		}
+		if rl.NamespaceBurst != nil && *rl.NamespaceBurst <= 0 {
+			err = multierr.Append(err, fmt.Errorf("rateLimit.namespaceBurst must be positive, got %d", *rl.NamespaceBurst))
+		}
+	}
+	return err
+}
+
+// Apply returns c with the fields set in the file overridden.
+func (f *FileConfig) Apply(c ControllerConfig) ControllerConfig {
+	if f.RequeueDelay != nil {
+		c.RequeueDelay = f.RequeueDelay.Duration
+	}
+	if f.DriftCheckInterval != nil {
+		c.DriftCheckInterval = f.DriftCheckInterval.Duration
+	}
+	if f.StuckAfterFailures != nil {
+		c.StuckAfterFailures = *f.StuckAfterFailures
+	}
+	if f.BulkOperationsPerMinute != nil {
+		c.BulkOperationsPerMinute = *f.BulkOperationsPerMinute
+	}
+	if f.RateLimit == nil {
+		return c
+	}
+	rl := *c.RateLimit
+	if f.RateLimit.BaseDelay != nil {
+		rl.BaseDelay = f.RateLimit.BaseDelay.Duration
+	}
+	if f.RateLimit.MaxDelay != nil {
+		rl.MaxDelay = f.RateLimit.MaxDelay.Duration
+	}
+	if f.RateLimit.QPS != nil {
+		rl.QPS = *f.RateLimit.QPS
+	}
+	if f.RateLimit.Burst != nil {
+		rl.Burst = *f.RateLimit.Burst
+	}
+	if f.RateLimit.NamespaceQPS != nil {
+		rl.NamespaceQPS = *f.RateLimit.NamespaceQPS
+	}
+	if f.RateLimit.NamespaceBurst != nil {
+		rl.NamespaceBurst = *f.RateLimit.NamespaceBurst
+	}
+	c.RateLimit = &rl
+	return c
+}
+
+// FileWatcher calls a function with the config file's contents whenever it changes. It's a
+// manager.Runnable that runs on every replica, not only on the leader.
+type FileWatcher struct {
+	log      logr.Logger
+	path     string
+	onChange func(*FileConfig) error
+	watcher  *fsnotify.Watcher
+	last     []byte
+}
+
+// WatchFile starts watching the config file at path. Its directory is watched rather than
+// the file itself, because mounted ConfigMaps are updated by swapping a symlink. If onChange
+// returns an error, e.g. because the spec defaults or policy are invalid, the file is ignored
+// like an invalid one.
+func WatchFile(log logr.Logger, path string, onChange func(*FileConfig) error) (*FileWatcher, error) {
+	last, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	err = w.Add(filepath.Dir(path))
+	if err != nil {
+		_ = w.Close()
+		return nil, fmt.Errorf("failed to watch the config file's directory: %w", err)
+	}
+	return &FileWatcher{log: log, path: path, onChange: onChange, watcher: w, last: last}, nil
+}
+
+// Start reloads the file when it changes, until ctx is done. Invalid files are logged and
+// ignored, keeping the last valid configuration.
+func (w *FileWatcher) Start(ctx context.Context) error {
+	defer w.watcher.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return nil
+			}
+			w.log.Error(err, "Got an error watching the config file.", "path", w.path)
+		case _, ok := <-w.watcher.Events:
+			if !ok {
+				return nil
+			}
+			w.reload()
+		}
+	}
+}
+
+func (w *FileWatcher) NeedLeaderElection() bool {
+	return false
+}
+
+func (w *FileWatcher) reload() {
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		// It might be mid-update, in which case there'll be another event once it's done.
+		w.log.Error(err, "Failed to read the config file.", "path", w.path)
+		return
+	}
+	if bytes.Equal(data, w.last) {
+		return
+	}
+	f, err := parseFile(data)
+	if err == nil {
+		err = w.onChange(f)
+	}
+	if err != nil {
+		w.log.Error(err, "Ignoring the invalid config file.", "path", w.path)
+		return
+	}
+	w.last = data
+	w.log.Info("Reloaded the config file.", "path", w.path)
+}
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApply(t *testing.T) {
+	base := ControllerConfig{
+		RequeueDelay:       time.Minute,
+		DriftCheckInterval: 10 * time.Minute,
+		RateLimit:          &RateLimitConfig{BaseDelay: 5 * time.Millisecond, MaxDelay: time.Second, QPS: 10, Burst: 100},
+	}
+
+	tests := []struct {
+		name     string
+		file     string
+		expected ControllerConfig
+		err      string
+	}{{
+		name:     "empty",
+		expected: base,
+	}, {
+		name: "overrides",
+		file: `
+requeueDelay: 30s
+rateLimit:
+  qps: 2.5
+  namespaceQPS: 1
+  namespaceBurst: 5
+`,
+		expected: ControllerConfig{
+			RequeueDelay:       30 * time.Second,
+			DriftCheckInterval: 10 * time.Minute,
+			RateLimit:          &RateLimitConfig{BaseDelay: 5 * time.Millisecond, MaxDelay: time.Second, QPS: 2.5, Burst: 100, NamespaceQPS: 1, NamespaceBurst: 5},
+		},
+	}, {
+		name: "bulk mode",
+		file: "bulkOperationsPerMinute: 60",
+		expected: ControllerConfig{
+			RequeueDelay:            time.Minute,
+			DriftCheckInterval:      10 * time.Minute,
+			RateLimit:               base.RateLimit,
+			BulkOperationsPerMinute: 60,
+		},
+	}, {
+		name: "unknown field",
+		file: "requeueDelai: 30s",
+		err:  "invalid config file",
+	}, {
+		name: "invalid duration",
+		file: "requeueDelay: soon",
+		err:  "invalid config file",
+	}, {
+		name: "negative duration",
+		file: "driftCheckInterval: -1m",
+		err:  "driftCheckInterval can't be negative, got -1m0s",
+	}, {
+		name: "rate limit that never requeues",
+		file: `
+rateLimit:
+  qps: 0
+  burst: 0
+`,
+		err: "rateLimit.qps must be positive, got 0; rateLimit.burst must be positive, got 0",
+	}, {
+		name: "negative namespace rate limit",
+		file: `
+rateLimit:
+  baseDelay: -1s
+  namespaceQPS: -1
+`,
+		err: "rateLimit.baseDelay can't be negative, got -1s; rateLimit.namespaceQPS can't be negative, got -1",
+	}, {
+		name: "spec defaults and policy are kept for the controller to decode",
+		file: `
+specDefaults:
+  global_access: true
+policy:
+  require_connection_limit: true
+`,
+		expected: base,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := parseFile([]byte(tt.file))
+			if tt.err != "" {
+				require.ErrorContains(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, f.Apply(base))
+			// The base config isn't modified.
+			require.Equal(t, 10.0, base.RateLimit.QPS)
+		})
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("requeueDelay: 1s"), 0o600))
+	changes := make(chan *FileConfig, 10)
+	w, err := WatchFile(logr.Discard(), path, func(f *FileConfig) error {
+		if f.RequeueDelay.Duration == 3*time.Second {
+			return errors.New("rejected")
+		}
+		changes <- f
+		return nil
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- w.Start(ctx) }()
+	defer func() {
+		cancel()
+		require.NoError(t, <-done)
+	}()
+
+	// Invalid files are ignored, as are the ones onChange rejects.
+	writeAtomically(t, path, "requeueDelay: soon")
+	writeAtomically(t, path, "rateLimit: {qps: 0}")
+	writeAtomically(t, path, "requeueDelay: 3s")
+	// Valid ones are reloaded.
+	writeAtomically(t, path, "requeueDelay: 2s")
+	select {
+	case f := <-changes:
+		require.Equal(t, 2*time.Second, f.RequeueDelay.Duration)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "expected the config file to be reloaded")
+	}
+}
+
+// writeAtomically replaces the file at path, like the kubelet does with mounted ConfigMaps,
+// so that it's never read half-written.
+func writeAtomically(t *testing.T, path, content string) {
+	t.Helper()
+	tmp := path + ".tmp"
+	require.NoError(t, os.WriteFile(tmp, []byte(content), 0o600))
+	require.NoError(t, os.Rename(tmp, path))
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+
+	"go.uber.org/zap/zapcore"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+// LogConfig configures the controller's logs. Unset fields keep the values set by the --zap-*
+// flags, which default to debug logs in the console format.
+type LogConfig struct {
+	// debug, info, error, or an integer for more verbose logs, e.g. 2.
+	Level string `env:"LEVEL"`
+	// json or console.
+	Format string `env:"FORMAT"`
+}
+
+// ZapOpts returns the options overriding the flags' to apply the config.
+func (c *LogConfig) ZapOpts() ([]zap.Opts, error) {
+	var opts []zap.Opts
+	switch c.Format {
+	case "":
+	case "json":
+		opts = append(opts, zap.JSONEncoder())
+	case "console":
+		opts = append(opts, zap.ConsoleEncoder())
+	default:
+		return nil, fmt.Errorf("invalid log format %q, expected json or console", c.Format)
+	}
+	if c.Level == "" {
+		return opts, nil
+	}
+	var lvl zapcore.Level
+	err := lvl.UnmarshalText([]byte(c.Level))
+	if err != nil {
+		// Higher verbosity levels are negative in zap.
+		v, convErr := strconv.Atoi(c.Level)
+		if convErr != nil || v < 0 {
+			return nil, fmt.Errorf("invalid log level %q, expected debug, info, error or a positive integer", c.Level)
+		}
+		lvl = zapcore.Level(-v)
+	}
+	return append(opts, zap.Level(lvl)), nil
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogConfigZapOpts(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         LogConfig
+		expectedLen int
+		expectedErr string
+	}{{
+		name: "Keeps the flags' values if unset",
+	}, {
+		name:        "Sets the format and a named level",
+		cfg:         LogConfig{Level: "info", Format: "json"},
+		expectedLen: 2,
+	}, {
+		name:        "Sets a verbosity level",
+		cfg:         LogConfig{Level: "3", Format: "console"},
+		expectedLen: 2,
+	}, {
+		name:        "Fails on an invalid format",
+		cfg:         LogConfig{Format: "xml"},
+		expectedErr: `invalid log format "xml", expected json or console`,
+	}, {
+		name:        "Fails on an invalid level",
+		cfg:         LogConfig{Level: "loud"},
+		expectedErr: `invalid log level "loud", expected debug, info, error or a positive integer`,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := tt.cfg.ZapOpts()
+			if tt.expectedErr != "" {
+				require.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, opts, tt.expectedLen)
+		})
+	}
+}
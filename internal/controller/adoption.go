@@ -0,0 +1,253 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/0x5d/psc-portmapper/internal/version"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// reasonAdoptionReport is the reason of the event summarizing the adoption report.
+const reasonAdoptionReport = "AdoptionReport"
+
+// The states of the resources in an adoption report.
+const (
+	// adoptionManaged resources were created by the controller.
+	adoptionManaged = "managed"
+	// adoptionUnmarked resources have no description, since they were created by a controller
+	// that didn't set one. They're managed as the controller's own.
+	adoptionUnmarked = "unmarked"
+	// adoptionNotOwned resources weren't created by the controller, which won't modify them.
+	adoptionNotOwned = "not_owned"
+	// adoptionMissing resources will be created.
+	adoptionMissing = "missing"
+	// adoptionUnknown resources couldn't be read.
+	adoptionUnknown = "unknown"
+)
+
+// AdoptionReport lists the GCP resources of a StatefulSet reconciled by another version of
+// the controller, and what the running one is about to change, so that upgrades that change how
+// resources are named or marked can be reviewed.
+type AdoptionReport struct {
+	StatefulSet string `json:"stateful_set"`
+	// The version that last reconciled the StatefulSet, empty if it didn't record it, and the
+	// running one.
+	FromVersion string `json:"from_version"`
+	ToVersion   string `json:"to_version"`
+	// Sorted by kind and name.
+	Resources []AdoptedResource `json:"resources"`
+	// The migrations, recreations and teardowns that are pending, in plain words.
+	Scheduled []string `json:"scheduled,omitempty"`
+}
+
+// AdoptedResource is one of the resources the StatefulSet's spec derives.
+type AdoptedResource struct {
+	Kind  string `json:"kind"`
+	Name  string `json:"name"`
+	State string `json:"state"`
+	// Why its state is unknown.
+	Error string `json:"error,omitempty"`
+}
+
+// adoptionReports remembers the StatefulSets reported by the running controller, so that a
+// failing reconcile, which might not update their status, doesn't report them again.
+type adoptionReports struct {
+	mu       sync.Mutex
+	reported map[types.NamespacedName]struct{}
+}
+
+// first returns true the first time it's called for the StatefulSet.
+func (a *adoptionReports) first(name types.NamespacedName) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.reported == nil {
+		a.reported = map[types.NamespacedName]struct{}{}
+	}
+	if _, ok := a.reported[name]; ok {
+		return false
+	}
+	a.reported[name] = struct{}{}
+	return true
+}
+
+// upgraded returns the version that last reconciled the STS and true if it isn't the running
+// one. StatefulSets that were never reconciled successfully have nothing to adopt.
+func upgraded(sts *appsv1.StatefulSet) (string, bool) {
+	status := parseStatus(sts)
+	return status.ControllerVersion, status.LastDriftCheck != nil && status.ControllerVersion != version.Get().Version
+}
+
+// ValidateAdoptionReportConfigMap returns an error if the ConfigMap isn't empty or
+// <namespace>/<name>.
+func ValidateAdoptionReportConfigMap(cm string) error {
+	if cm == "" {
+		return nil
+	}
+	if _, _, err := parseNamespacedName(cm); err != nil {
+		return fmt.Errorf("invalid adoption report ConfigMap: %w", err)
+	}
+	return nil
+}
+
+func parseNamespacedName(s string) (string, string, error) {
+	namespace, name, ok := strings.Cut(s, "/")
+	if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+		return "", "", fmt.Errorf("%q must be <namespace>/<name>", s)
+	}
+	return namespace, name, nil
+}
+
+// reportAdoption reports the STS' resources once if it was reconciled by another version of
+// the controller, before it changes them: with an event, a log line, and the settings'
+// adoption report ConfigMap if it's set. Reporting is best effort, so failures are only logged.
+func (r *PortmapReconciler) reportAdoption(ctx context.Context, log logr.Logger, gc gcp.Client, spec *Spec, sts *appsv1.StatefulSet) {
+	from, ok := upgraded(sts)
+	name := types.NamespacedName{Namespace: sts.Namespace, Name: sts.Name}
+	if !ok || !r.adoptionReports.first(name) {
+		return
+	}
+	report := adoptionReport(ctx, gc, spec, sts, from)
+
+	counts := map[string]int{}
+	for _, res := range report.Resources {
+		counts[res.State]++
+	}
+	var summary []string
+	for _, state := range []string{adoptionManaged, adoptionUnmarked, adoptionNotOwned, adoptionMissing, adoptionUnknown} {
+		if counts[state] > 0 {
+			summary = append(summary, fmt.Sprintf("%d %s", counts[state], strings.ReplaceAll(state, "_", " ")))
+		}
+	}
+	msg := fmt.Sprintf("Upgraded from version %q to %q. Resources: %s.", report.FromVersion, report.ToVersion, strings.Join(summary, ", "))
+	if len(report.Scheduled) > 0 {
+		msg += " Scheduled: " + strings.Join(report.Scheduled, "; ") + "."
+	}
+	r.event(sts, corev1.EventTypeNormal, reasonAdoptionReport, "%s", msg)
+	log.Info("Adoption report.", "from", report.FromVersion, "to", report.ToVersion, "resources", report.Resources, "scheduled", report.Scheduled)
+
+	cm := r.currentSettings().AdoptionReportConfigMap
+	if cm == "" {
+		return
+	}
+	err := r.publishAdoptionReport(ctx, cm, report)
+	if err != nil {
+		log.Error(err, "Failed to publish the adoption report.", "configmap", cm)
+	}
+}
+
+// adoptionReport reads the GCP resources derived from the spec and returns their states.
+func adoptionReport(ctx context.Context, gc gcp.Client, spec *Spec, sts *appsv1.StatefulSet, from string) *AdoptionReport {
+	report := &AdoptionReport{
+		StatefulSet: types.NamespacedName{Namespace: sts.Namespace, Name: sts.Name}.String(),
+		FromVersion: from,
+		ToVersion:   version.Get().Version,
+	}
+	own := ownershipFor(sts)
+	add := func(kind, name string, res described, err error) {
+		r := AdoptedResource{Kind: kind, Name: name}
+		switch {
+		case errors.Is(err, gcp.ErrNotFound):
+			r.State = adoptionMissing
+		case err != nil:
+			r.State, r.Error = adoptionUnknown, err.Error()
+		case res.GetDescription() == gcp.ManagedDescription:
+			r.State = adoptionManaged
+		case own.check(kind, name, res) == nil:
+			r.State = adoptionUnmarked
+		default:
+			r.State = adoptionNotOwned
+		}
+		report.Resources = append(report.Resources, r)
+	}
+
+	ports := map[int32]struct{}{}
+	for _, p := range spec.NodePorts {
+		ports[p.NodePort] = struct{}{}
+	}
+	firewalls := slices.Collect(maps.Keys(firewallRules(spec, ports)))
+	if spec.AllowICMP {
+		firewalls = append(firewalls, icmpFirewallName(spec.Prefix))
+	}
+	for _, name := range firewalls {
+		fw, err := gc.GetFirewall(ctx, name)
+		add("firewall", name, fw, err)
+	}
+	neg, err := gc.GetNEG(ctx, negName(spec.Prefix))
+	add("NEG", negName(spec.Prefix), neg, err)
+	backend, err := gc.GetBackendService(ctx, backendName(spec.Prefix))
+	add("backend service", backendName(spec.Prefix), backend, err)
+	// The original ones are reported even if they're obsolete, since they can still exist.
+	fwdRules, svcAtts := []string{fwdRuleName(spec.Prefix)}, []string{svcAttName(spec.Prefix)}
+	if spec.Migration != nil {
+		fwdRules = append(fwdRules, migrationFwdRuleName(spec.Prefix))
+		svcAtts = append(svcAtts, migrationSvcAttName(spec.Prefix))
+	}
+	for _, name := range fwdRules {
+		rule, err := gc.GetForwardingRule(ctx, name)
+		add("forwarding rule", name, rule, err)
+	}
+	for _, name := range svcAtts {
+		att, err := gc.GetServiceAttachment(ctx, name)
+		add("service attachment", name, att, err)
+	}
+	slices.SortFunc(report.Resources, func(a, b AdoptedResource) int {
+		return strings.Compare(a.Kind+"/"+a.Name, b.Kind+"/"+b.Name)
+	})
+
+	if m := spec.Migration; m != nil && spec.migrationAcknowledged {
+		report.Scheduled = append(report.Scheduled, fmt.Sprintf("the migration to %s is acknowledged, so the original forwarding rule and service attachment will be deleted", m.SubnetFQN))
+	} else if m != nil {
+		report.Scheduled = append(report.Scheduled, fmt.Sprintf("the migration to %s will be created next to the original forwarding rule and service attachment", m.SubnetFQN))
+	}
+	if v, ok := sts.Annotations[recreateAnnotation]; ok {
+		report.Scheduled = append(report.Scheduled, fmt.Sprintf("the resources requested by the %s annotation (%s) will be recreated", recreateAnnotation, v))
+	}
+	if spec.tornDown {
+		report.Scheduled = append(report.Scheduled, "the forwarding rule and service attachment will be torn down while the StatefulSet is scaled to zero")
+	}
+	return report
+}
+
+// publishAdoptionReport writes the report to the ConfigMap, under the <namespace>.<name> key of
+// its StatefulSet, creating it if it doesn't exist.
+func (r *PortmapReconciler) publishAdoptionReport(ctx context.Context, cmName string, report *AdoptionReport) error {
+	namespace, name, err := parseNamespacedName(cmName)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	key := strings.Replace(report.StatefulSet, "/", ".", 1)
+	cm := &corev1.ConfigMap{}
+	err = r.reader.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, cm)
+	if apierrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: map[string]string{managedByLabel: portmapperApp}},
+			Data:       map[string]string{key: string(data)},
+		}
+		return r.Create(ctx, cm)
+	}
+	if err != nil {
+		return err
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[key] = string(data)
+	return r.Update(ctx, cm)
+}
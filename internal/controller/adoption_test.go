@@ -0,0 +1,82 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/0x5d/psc-portmapper/internal/version"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestReportAdoption(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	rec := record.NewFakeRecorder(10)
+	settings := DefaultSettings()
+	settings.AdoptionReportConfigMap = "psc-portmapper/adoption-report"
+	r := New(c, gcpClient, WithEventRecorder(rec), WithSettings(settings))
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+
+	// StatefulSets reconciled for the first time have nothing to adopt.
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Empty(t, rec.Events)
+
+	// The StatefulSet was last reconciled by an older controller.
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	status := parseStatus(sts)
+	status.ControllerVersion = "v0.1.0"
+	jsonStatus, err := json.Marshal(status)
+	require.NoError(t, err)
+	sts.Annotations[statusAnnotation] = string(jsonStatus)
+	require.NoError(t, c.Update(ctx, sts))
+	require.NoError(t, gcpClient.DeleteServiceAttachment(ctx, svcAttName(s.spec.Prefix)))
+
+	r = New(c, gcpClient, WithEventRecorder(rec), WithSettings(settings))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Len(t, rec.Events, 1)
+	require.Equal(t, fmt.Sprintf(`Normal AdoptionReport Upgraded from version "v0.1.0" to %q. Resources: 4 managed, 1 missing.`, version.Get().Version), <-rec.Events)
+
+	cm := &corev1.ConfigMap{}
+	require.NoError(t, c.Get(ctx, types.NamespacedName{Namespace: "psc-portmapper", Name: "adoption-report"}, cm))
+	report := &AdoptionReport{}
+	require.NoError(t, json.Unmarshal([]byte(cm.Data[s.sts.Namespace+"."+s.sts.Name]), report))
+	require.Equal(t, req.String(), report.StatefulSet)
+	require.Equal(t, []AdoptedResource{
+		{Kind: "NEG", Name: "prefix-psc-portmapper-neg", State: adoptionManaged},
+		{Kind: "backend service", Name: "prefix-psc-portmapper-backend", State: adoptionManaged},
+		{Kind: "firewall", Name: "prefix-psc-portmapper-firewall", State: adoptionManaged},
+		{Kind: "forwarding rule", Name: "prefix-psc-portmapper-fwdrule", State: adoptionManaged},
+		{Kind: "service attachment", Name: "prefix-psc-portmapper-svcatt", State: adoptionMissing},
+	}, report.Resources)
+
+	// It's only reported once.
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Empty(t, rec.Events)
+}
+
+func TestValidateAdoptionReportConfigMap(t *testing.T) {
+	require.NoError(t, ValidateAdoptionReportConfigMap(""))
+	require.NoError(t, ValidateAdoptionReportConfigMap("psc-portmapper/adoption-report"))
+	for _, cm := range []string{"adoption-report", "/adoption-report", "psc-portmapper/", "a/b/c"} {
+		require.Error(t, ValidateAdoptionReportConfigMap(cm), cm)
+	}
+}
@@ -0,0 +1,146 @@
+package controller
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const (
+	// AdvertisePath is the path the advertise webhook is served at.
+	AdvertisePath = "/mutate-v1-pod-advertise"
+	// advertiseLabel opts a StatefulSet's pods into the advertise webhook. It's set on the pod
+	// template, so that the webhook's object selector only sends it the pods that need it.
+	advertiseLabel = "psc-portmapper.0x5d.org/advertise"
+
+	advertisedHostEnv = "PSC_ADVERTISED_HOST"
+	advertisedPortEnv = "PSC_ADVERTISED_PORT"
+)
+
+// AdvertiseHandler returns the handler of the advertise webhook, which injects the address
+// consumers connect to into the containers of the pods created by StatefulSets with a spec, so
+// that brokers and databases can advertise it without any wiring. Since each pod's ports depend
+// on its ordinal, they're injected into the pods as they're created rather than into the
+// StatefulSets' pod template. Pods are always admitted, even if they can't be mutated.
+func (r *PortmapReconciler) AdvertiseHandler() admission.Handler {
+	return admission.HandlerFunc(r.handleAdvertise)
+}
+
+func (r *PortmapReconciler) handleAdvertise(ctx context.Context, req admission.Request) admission.Response {
+	pod := &corev1.Pod{}
+	err := json.Unmarshal(req.Object.Raw, pod)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if pod.Name == "" {
+		// The StatefulSet controller names its pods, but the request might not.
+		pod.Name = req.Name
+	}
+	if !r.injectAdvertisedAddress(ctx, req.Namespace, pod) {
+		return admission.Allowed("")
+	}
+	mutated, err := json.Marshal(pod)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, mutated)
+}
+
+// injectAdvertisedAddress injects the advertised address into the pod's containers, if it
+// opted in and it'll be mapped. It returns false if it didn't.
+func (r *PortmapReconciler) injectAdvertisedAddress(ctx context.Context, namespace string, pod *corev1.Pod) bool {
+	log := log.FromContext(ctx).WithValues("namespace", namespace, "name", pod.Name)
+	if pod.Labels[advertiseLabel] != "true" {
+		return false
+	}
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil || owner.Kind != "StatefulSet" {
+		log.Info("Not injecting the advertised address into a pod that doesn't belong to a StatefulSet.")
+		return false
+	}
+	sts := &appsv1.StatefulSet{}
+	err := r.Get(ctx, types.NamespacedName{Namespace: namespace, Name: owner.Name}, sts)
+	if err != nil {
+		log.Error(err, "Failed to get the pod's StatefulSet. Not injecting its advertised address.")
+		return false
+	}
+	jsonSpec, ok := sts.Annotations[annotation]
+	if !ok {
+		log.Info("Not injecting the advertised address into a pod whose StatefulSet doesn't have a spec.")
+		return false
+	}
+	spec := &Spec{}
+	err = json.Unmarshal([]byte(jsonSpec), spec)
+	if err != nil {
+		log.Error(err, "Failed to decode the StatefulSet's spec. Not injecting its advertised address.")
+		return false
+	}
+	env, ok := r.advertisedEnv(spec, sts, pod)
+	if !ok {
+		log.Info("Not injecting the advertised address into a pod that won't be mapped.")
+		return false
+	}
+	injectEnv(pod.Spec.InitContainers, env)
+	injectEnv(pod.Spec.Containers, env)
+	return true
+}
+
+// advertisedEnv returns the environment variables advertising the pod's address: the spec's
+// advertised_host, or its IP, and the pod's ports, as per getPortMappings. It returns false if
+// the pod won't be mapped.
+func (r *PortmapReconciler) advertisedEnv(spec *Spec, sts *appsv1.StatefulSet, pod *corev1.Pod) ([]corev1.EnvVar, bool) {
+	index, ok := podIndex(sts, pod)
+	capacity, _ := portCapacity(spec, r.currentSettings().NEGEndpointLimit)
+	if !ok || index >= capacity {
+		return nil, false
+	}
+	var env []corev1.EnvVar
+	if host := cmp.Or(spec.AdvertisedHost, ptr.Deref(spec.IP, "")); host != "" {
+		env = append(env, corev1.EnvVar{Name: advertisedHostEnv, Value: host})
+	}
+	for _, name := range slices.Sorted(maps.Keys(spec.NodePorts)) {
+		p := spec.NodePorts[name]
+		envName := advertisedPortEnv
+		if len(spec.NodePorts) > 1 {
+			envName += "_" + envSuffix(name)
+		}
+		env = append(env, corev1.EnvVar{Name: envName, Value: strconv.Itoa(int(p.StartingPort + index))})
+	}
+	return env, true
+}
+
+// envSuffix turns a port name into an environment variable suffix, e.g. client-tls into
+// CLIENT_TLS.
+func envSuffix(portName string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(portName))
+}
+
+// injectEnv adds env to each container, unless it already sets a variable with the same name.
+func injectEnv(containers []corev1.Container, env []corev1.EnvVar) {
+	for i := range containers {
+		c := &containers[i]
+		for _, e := range env {
+			if !slices.ContainsFunc(c.Env, func(existing corev1.EnvVar) bool { return existing.Name == e.Name }) {
+				c.Env = append(c.Env, e)
+			}
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/0x5d/psc-portmapper/api"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestAdvertisedEnv(t *testing.T) {
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "sts"},
+		Spec:       appsv1.StatefulSetSpec{Replicas: ptr.To(int32(3))},
+	}
+	tests := []struct {
+		name     string
+		spec     *Spec
+		pod      string
+		expected []corev1.EnvVar
+	}{{
+		name: "Advertises the IP and the pod's port",
+		spec: &Spec{Spec: api.Spec{IP: ptr.To("10.0.0.1"), NodePorts: map[string]PortConfig{"app": {StartingPort: 30000}}}},
+		pod:  "sts-2",
+		expected: []corev1.EnvVar{
+			{Name: "PSC_ADVERTISED_HOST", Value: "10.0.0.1"},
+			{Name: "PSC_ADVERTISED_PORT", Value: "30002"},
+		},
+	}, {
+		name: "Prefers the advertised host, and suffixes each port with its name",
+		spec: &Spec{Spec: api.Spec{
+			IP:             ptr.To("10.0.0.1"),
+			AdvertisedHost: "kafka.example.com",
+			NodePorts: map[string]PortConfig{
+				"client-tls": {StartingPort: 30000},
+				"admin":      {StartingPort: 31000},
+			},
+		}},
+		pod: "sts-1",
+		expected: []corev1.EnvVar{
+			{Name: "PSC_ADVERTISED_HOST", Value: "kafka.example.com"},
+			{Name: "PSC_ADVERTISED_PORT_ADMIN", Value: "31001"},
+			{Name: "PSC_ADVERTISED_PORT_CLIENT_TLS", Value: "30001"},
+		},
+	}, {
+		name:     "Only advertises the port without a host",
+		spec:     &Spec{Spec: api.Spec{NodePorts: map[string]PortConfig{"app": {StartingPort: 30000}}}},
+		pod:      "sts-0",
+		expected: []corev1.EnvVar{{Name: "PSC_ADVERTISED_PORT", Value: "30000"}},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := New(nil, nil)
+			env, ok := r.advertisedEnv(tt.spec, sts, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: tt.pod}})
+			require.True(t, ok)
+			require.Equal(t, tt.expected, env)
+		})
+	}
+}
+
+func TestHandleAdvertise(t *testing.T) {
+	s := initialState()
+	s.spec.IP = ptr.To("10.0.0.1")
+	specStr, err := json.Marshal(s.spec)
+	require.NoError(t, err)
+	s.sts.Annotations[annotation] = string(specStr)
+	other := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Namespace: s.sts.Namespace, Name: "other"}}
+	r := New(fake.NewClientBuilder().WithObjects(s.sts, other).Build(), nil)
+
+	pod := func(name, owner string, labels map[string]string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:       s.sts.Namespace,
+				Name:            name,
+				Labels:          labels,
+				OwnerReferences: []metav1.OwnerReference{{Kind: "StatefulSet", Name: owner, Controller: ptr.To(true)}},
+			},
+			Spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Name: "init"}},
+				Containers: []corev1.Container{{
+					Name: "app",
+					Env:  []corev1.EnvVar{{Name: "PSC_ADVERTISED_HOST", Value: "overridden"}},
+				}},
+			},
+		}
+	}
+	optIn := map[string]string{advertiseLabel: "true"}
+	tests := []struct {
+		name         string
+		pod          *corev1.Pod
+		expectedInit []corev1.EnvVar
+		expectedApp  []corev1.EnvVar
+	}{{
+		name: "Injects the advertised address, without overriding the containers' env",
+		pod:  pod("sts-1", "sts", optIn),
+		expectedInit: []corev1.EnvVar{
+			{Name: "PSC_ADVERTISED_HOST", Value: "10.0.0.1"},
+			{Name: "PSC_ADVERTISED_PORT", Value: "30001"},
+		},
+		expectedApp: []corev1.EnvVar{
+			{Name: "PSC_ADVERTISED_HOST", Value: "overridden"},
+			{Name: "PSC_ADVERTISED_PORT", Value: "30001"},
+		},
+	}, {
+		name: "Ignores pods that didn't opt in",
+		pod:  pod("sts-1", "sts", nil),
+	}, {
+		name: "Ignores pods of StatefulSets without a spec",
+		pod:  pod("other-0", "other", optIn),
+	}, {
+		name: "Ignores pods that won't be mapped",
+		pod:  pod("sts-5", "sts", optIn),
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := json.Marshal(tt.pod)
+			require.NoError(t, err)
+			req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				Namespace: tt.pod.Namespace,
+				Name:      tt.pod.Name,
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: raw},
+			}}
+			resp := r.AdvertiseHandler().Handle(context.Background(), req)
+			require.True(t, resp.Allowed)
+			require.Equal(t, tt.expectedInit != nil, len(resp.Patches) > 0)
+
+			injected := tt.pod.DeepCopy()
+			ok := r.injectAdvertisedAddress(context.Background(), tt.pod.Namespace, injected)
+			require.Equal(t, tt.expectedInit != nil, ok)
+			if !ok {
+				require.Equal(t, tt.pod, injected)
+				return
+			}
+			require.Equal(t, tt.expectedInit, injected.Spec.InitContainers[0].Env)
+			require.Equal(t, tt.expectedApp, injected.Spec.Containers[0].Env)
+		})
+	}
+}
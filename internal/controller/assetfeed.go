@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// driftSuspects are the StatefulSets whose GCP resources changed out of band, so that their
+// next reconcile checks for drift even if they were checked recently.
+type driftSuspects struct {
+	mu     sync.Mutex
+	byName map[types.NamespacedName]struct{}
+}
+
+func (d *driftSuspects) add(name types.NamespacedName) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.byName == nil {
+		d.byName = map[types.NamespacedName]struct{}{}
+	}
+	d.byName[name] = struct{}{}
+}
+
+// take returns true if the StatefulSet is suspected of drifting, and clears the suspicion.
+func (d *driftSuspects) take(name types.NamespacedName) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.byName[name]
+	delete(d.byName, name)
+	return ok
+}
+
+// ResourceChanged enqueues the StatefulSets owning the named GCP resource, e.g. because it was
+// deleted out of band, and makes them check for drift. It's meant to be called by a
+// gcp.AssetFeed, and blocks until the controller is started or ctx is done.
+func (r *PortmapReconciler) ResourceChanged(ctx context.Context, resource string) {
+	select {
+	case r.gcpChanges <- event.TypedGenericEvent[string]{Object: resource}:
+	case <-ctx.Done():
+	}
+}
+
+// statefulSetsOwning returns a request for each StatefulSet of the controller's class and
+// shard that owns the named GCP resource. The controller's own changes are notified too, in
+// which case the StatefulSet is checked for drift once more without changing anything.
+func (r *PortmapReconciler) statefulSetsOwning(ctx context.Context, resource string) []reconcile.Request {
+	stss := &appsv1.StatefulSetList{}
+	err := r.List(ctx, stss)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list the StatefulSets.", "resource", resource)
+		return nil
+	}
+	var reqs []reconcile.Request
+	for i := range stss.Items {
+		sts := &stss.Items[i]
+		jsonSpec, ok := sts.Annotations[annotation]
+		if !ok || !r.manages(sts) {
+			continue
+		}
+		spec := &Spec{}
+		if json.Unmarshal([]byte(jsonSpec), spec) != nil {
+			// It'll be reported when it's reconciled.
+			continue
+		}
+		if !slices.Contains(resourceNames(spec.Prefix), resource) {
+			continue
+		}
+		name := client.ObjectKeyFromObject(sts)
+		r.driftSuspects.add(name)
+		reqs = append(reqs, reconcile.Request{NamespacedName: name})
+	}
+	return reqs
+}
+
+// resourceNames returns the names of the GCP resources managed for a spec with the prefix.
+func resourceNames(prefix string) []string {
+	return []string{
+		firewallName(prefix),
+		negName(prefix),
+		backendName(prefix),
+		fwdRuleName(prefix),
+		svcAttName(prefix),
+	}
+}
@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestResourceChanged(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	// A StatefulSet of another class with the same prefix isn't enqueued.
+	other := s.sts.DeepCopy()
+	other.Name = "other"
+	other.Annotations[classAnnotation] = "other"
+	// Neither are StatefulSets without a spec.
+	unannotated := &appsv1.StatefulSet{}
+	unannotated.Namespace, unannotated.Name = s.sts.Namespace, "unannotated"
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts, other, unannotated).
+		Build()
+	gcpClient := gcpfake.NewFaulty(gcpfake.New(s.project, s.region), gcpfake.Faults{})
+	r := New(c, gcpClient)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+
+	require.Empty(t, r.statefulSetsOwning(ctx, "unrelated"))
+
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	// Every GCP call fails from now on, so reconciles only succeed if they're skipped.
+	gcpClient.SetFaults(gcpfake.Faults{ErrorRate: 1})
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	// A change to one of its resources makes the next reconcile check for drift.
+	require.Equal(t, []reconcile.Request{req}, r.statefulSetsOwning(ctx, svcAttName("prefix-")))
+	_, err = r.Reconcile(ctx, req)
+	require.ErrorContains(t, err, "injected fault")
+}
@@ -0,0 +1,292 @@
+package controller
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"golang.org/x/time/rate"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// bulk paces the GCP operations of every StatefulSet with a global budget while bulk mode is
+// enabled, e.g. while hundreds of StatefulSets are migrated to a new cluster at once, so that
+// they don't exhaust the project's API quota. See Settings.BulkOperationsPerMinute.
+type bulk struct {
+	// Held by each reconcile while bulk mode is enabled, so that StatefulSets are reconciled
+	// one at a time.
+	reconcile sync.Mutex
+
+	mu        sync.Mutex
+	perMinute int
+	limiter   *rate.Limiter
+	// When bulk mode was enabled, and what was done since.
+	since      time.Time
+	operations int
+	throttled  time.Duration
+}
+
+// set enables bulk mode with a budget of perMinute operations, or disables it if it's 0. The
+// progress is kept if the budget changes while it's enabled.
+func (b *bulk) set(perMinute int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if perMinute == b.perMinute {
+		return
+	}
+	if perMinute <= 0 {
+		b.perMinute, b.limiter = 0, nil
+		return
+	}
+	limit := rate.Limit(float64(perMinute) / time.Minute.Seconds())
+	if b.limiter != nil {
+		b.perMinute = perMinute
+		b.limiter.SetLimit(limit)
+		return
+	}
+	b.perMinute, b.limiter = perMinute, rate.NewLimiter(limit, 1)
+	b.since, b.operations, b.throttled = time.Now(), 0, 0
+}
+
+func (b *bulk) enabled() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limiter != nil
+}
+
+// serialize blocks until no other StatefulSet is being reconciled, if bulk mode is enabled,
+// and returns the function to call once the reconcile is done.
+func (b *bulk) serialize() func() {
+	if !b.enabled() {
+		return func() {}
+	}
+	b.reconcile.Lock()
+	return b.reconcile.Unlock
+}
+
+// wait blocks until the budget allows another operation, if bulk mode is enabled.
+func (b *bulk) wait(ctx context.Context) error {
+	b.mu.Lock()
+	limiter := b.limiter
+	b.mu.Unlock()
+	if limiter == nil {
+		return nil
+	}
+	start := time.Now()
+	err := limiter.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.operations++
+	b.throttled += time.Since(start)
+	return nil
+}
+
+// BulkProgress is the progress of the StatefulSets reconciled since bulk mode was enabled.
+type BulkProgress struct {
+	Enabled             bool      `json:"enabled"`
+	OperationsPerMinute int       `json:"operations_per_minute,omitempty"`
+	Since               time.Time `json:"since,omitempty"`
+	// The GCP operations done since, and how long they waited for the budget in total.
+	Operations int    `json:"operations"`
+	Throttled  string `json:"throttled"`
+	// The StatefulSets the controller manages, how many of them were reconciled successfully
+	// since, and how many weren't reconciled yet.
+	StatefulSets int `json:"stateful_sets"`
+	Reconciled   int `json:"reconciled"`
+	Pending      int `json:"pending"`
+	// The last error of the StatefulSets whose last reconcile since failed, by namespace/name.
+	Failing map[string]string `json:"failing,omitempty"`
+}
+
+// BulkProgress reports the progress of bulk mode. Only the leader reconciles, so other replicas
+// report every StatefulSet as pending.
+func (r *PortmapReconciler) BulkProgress(ctx context.Context) (*BulkProgress, error) {
+	r.bulk.mu.Lock()
+	p := &BulkProgress{
+		Enabled:             r.bulk.limiter != nil,
+		OperationsPerMinute: r.bulk.perMinute,
+		Since:               r.bulk.since,
+		Operations:          r.bulk.operations,
+		Throttled:           r.bulk.throttled.Round(time.Second).String(),
+	}
+	r.bulk.mu.Unlock()
+	if !p.Enabled {
+		return p, nil
+	}
+
+	stss := &appsv1.StatefulSetList{}
+	err := r.List(ctx, stss)
+	if err != nil {
+		return nil, err
+	}
+	results := r.LastResults()
+	for i := range stss.Items {
+		sts := &stss.Items[i]
+		if _, ok := sts.Annotations[annotation]; !ok || !r.manages(sts) {
+			continue
+		}
+		p.StatefulSets++
+		name := types.NamespacedName{Namespace: sts.Namespace, Name: sts.Name}.String()
+		res, ok := results[name]
+		switch {
+		case !ok || res.Time.Before(p.Since):
+			p.Pending++
+		case res.Error != "":
+			if p.Failing == nil {
+				p.Failing = map[string]string{}
+			}
+			p.Failing[name] = res.Error
+		default:
+			p.Reconciled++
+		}
+	}
+	return p, nil
+}
+
+// pacedClient waits for the bulk budget before each of the wrapped client's mutating calls.
+// Reads aren't paced, since they're much cheaper and don't count towards the operations quota.
+type pacedClient struct {
+	gcp.Client
+	bulk *bulk
+}
+
+// pacedGCPClient returns gc paced by the bulk budget if bulk mode is enabled, and gc otherwise.
+// It must be called last, since the paced client hides gc's optional interfaces.
+func (r *PortmapReconciler) pacedGCPClient(gc gcp.Client) gcp.Client {
+	if !r.bulk.enabled() {
+		return gc
+	}
+	return &pacedClient{Client: gc, bulk: &r.bulk}
+}
+
+func (c *pacedClient) CreatePortmapNEG(ctx context.Context, name, subnetFQN string, defaultPort *int32) error {
+	if err := c.bulk.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.CreatePortmapNEG(ctx, name, subnetFQN, defaultPort)
+}
+
+func (c *pacedClient) DeletePortmapNEG(ctx context.Context, name string) error {
+	if err := c.bulk.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.DeletePortmapNEG(ctx, name)
+}
+
+func (c *pacedClient) AttachEndpoints(ctx context.Context, neg string, mappings []*gcp.PortMapping) error {
+	if err := c.bulk.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.AttachEndpoints(ctx, neg, mappings)
+}
+
+func (c *pacedClient) DetachEndpoints(ctx context.Context, neg string, mappings []*gcp.PortMapping) error {
+	if err := c.bulk.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.DetachEndpoints(ctx, neg, mappings)
+}
+
+func (c *pacedClient) CreateFirewall(ctx context.Context, name string, rule gcp.FirewallRule) error {
+	if err := c.bulk.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.CreateFirewall(ctx, name, rule)
+}
+
+func (c *pacedClient) UpdateFirewall(ctx context.Context, name string, rule gcp.FirewallRule) error {
+	if err := c.bulk.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.UpdateFirewall(ctx, name, rule)
+}
+
+func (c *pacedClient) DisableFirewall(ctx context.Context, name string) error {
+	if err := c.bulk.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.DisableFirewall(ctx, name)
+}
+
+func (c *pacedClient) DeleteFirewall(ctx context.Context, name string) error {
+	if err := c.bulk.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.DeleteFirewall(ctx, name)
+}
+
+func (c *pacedClient) CreateBackendService(ctx context.Context, name string, neg string) error {
+	if err := c.bulk.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.CreateBackendService(ctx, name, neg)
+}
+
+func (c *pacedClient) DeleteBackendService(ctx context.Context, name string) error {
+	if err := c.bulk.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.DeleteBackendService(ctx, name)
+}
+
+func (c *pacedClient) CreateForwardingRule(ctx context.Context, name, backendSvc, subnetFQN string, ip *string, globalAccess *bool) error {
+	if err := c.bulk.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.CreateForwardingRule(ctx, name, backendSvc, subnetFQN, ip, globalAccess)
+}
+
+func (c *pacedClient) SetForwardingRuleGlobalAccess(ctx context.Context, name string, globalAccess bool) error {
+	if err := c.bulk.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.SetForwardingRuleGlobalAccess(ctx, name, globalAccess)
+}
+
+func (c *pacedClient) DeleteForwardingRule(ctx context.Context, name string) error {
+	if err := c.bulk.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.DeleteForwardingRule(ctx, name)
+}
+
+func (c *pacedClient) CreateServiceAttachment(ctx context.Context, name, fwdRuleFQN string, consumers []*computepb.ServiceAttachmentConsumerProjectLimit, natSubnetFQNs []string, reconcileConnections *bool) error {
+	if err := c.bulk.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.CreateServiceAttachment(ctx, name, fwdRuleFQN, consumers, natSubnetFQNs, reconcileConnections)
+}
+
+func (c *pacedClient) UpdateServiceAttachment(ctx context.Context, name string, consumers []*computepb.ServiceAttachmentConsumerProjectLimit, natSubnetFQNs []string, reconcileConnections *bool) error {
+	if err := c.bulk.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.UpdateServiceAttachment(ctx, name, consumers, natSubnetFQNs, reconcileConnections)
+}
+
+func (c *pacedClient) DeleteServiceAttachment(ctx context.Context, name string) error {
+	if err := c.bulk.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.DeleteServiceAttachment(ctx, name)
+}
+
+func (c *pacedClient) CreateConsumerEndpoint(ctx context.Context, subnetFQN, name, svcAttFQN string) error {
+	if err := c.bulk.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.CreateConsumerEndpoint(ctx, subnetFQN, name, svcAttFQN)
+}
+
+func (c *pacedClient) DeleteConsumerEndpoint(ctx context.Context, subnetFQN, name string) error {
+	if err := c.bulk.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.DeleteConsumerEndpoint(ctx, subnetFQN, name)
+}
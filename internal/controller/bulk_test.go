@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestBulkMode(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gc := gcpfake.New(s.project, s.region)
+	settings := DefaultSettings()
+	settings.DriftCheckInterval = 0
+	r := New(c, gc, WithSettings(settings))
+	require.Same(t, gc, r.pacedGCPClient(gc))
+	p, err := r.BulkProgress(ctx)
+	require.NoError(t, err)
+	require.Equal(t, &BulkProgress{Enabled: false, Throttled: "0s"}, p)
+
+	settings.BulkOperationsPerMinute = 6000
+	r.SetSettings(settings)
+	p, err = r.BulkProgress(ctx)
+	require.NoError(t, err)
+	require.True(t, p.Enabled)
+	require.Equal(t, 6000, p.OperationsPerMinute)
+	require.Equal(t, 1, p.StatefulSets)
+	require.Equal(t, 1, p.Pending)
+
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	p, err = r.BulkProgress(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, p.Reconciled)
+	require.Zero(t, p.Pending)
+	require.Empty(t, p.Failing)
+	// The firewall, NEG, endpoints, backend service, forwarding rule and service attachment.
+	require.GreaterOrEqual(t, p.Operations, 6)
+
+	// Changing the budget keeps the progress.
+	settings.BulkOperationsPerMinute = 3000
+	r.SetSettings(settings)
+	p2, err := r.BulkProgress(ctx)
+	require.NoError(t, err)
+	require.Equal(t, p.Since, p2.Since)
+	require.Equal(t, p.Operations, p2.Operations)
+
+	// Disabling it doesn't pace the client anymore.
+	settings.BulkOperationsPerMinute = 0
+	r.SetSettings(settings)
+	require.Same(t, gc, r.pacedGCPClient(gc))
+}
+
+func TestBulkWait(t *testing.T) {
+	ctx := context.Background()
+	b := &bulk{}
+	// One operation every 50ms.
+	b.set(1200)
+	start := time.Now()
+	for range 3 {
+		require.NoError(t, b.wait(ctx))
+	}
+	require.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+	require.Equal(t, 3, b.operations)
+	require.Positive(t, b.throttled)
+
+	// Waits are canceled with their context.
+	b = &bulk{}
+	b.set(1)
+	require.NoError(t, b.wait(ctx))
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	require.Error(t, b.wait(ctx))
+}
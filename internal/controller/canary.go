@@ -0,0 +1,165 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/0x5d/psc-portmapper/api"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/go-logr/logr"
+	"k8s.io/utils/ptr"
+)
+
+// errCanaryUnconfigured is returned when a spec enables the canary, but the controller has no
+// subnet to create it in.
+var errCanaryUnconfigured = errors.New("the spec enables the canary, but the controller's canary subnet isn't set")
+
+// ValidateCanarySubnet returns an error if the canary subnet isn't empty or a subnet FQN.
+func ValidateCanarySubnet(fqn string) error {
+	if fqn != "" && !api.IsSubnetFQN(gcp.RelativeName(fqn)) {
+		return fmt.Errorf("invalid canary subnet %q, it must be a subnet FQN, e.g. projects/my-project/regions/us-east1/subnetworks/my-subnet", fqn)
+	}
+	return nil
+}
+
+func canaryName(prefix string) string {
+	return nameBase(prefix) + "-canary"
+}
+
+// resolveCanary records the canary subnet from the settings on the spec, and accepts the
+// canary's project as a consumer if the spec enables it, so that the canary can connect. The
+// subnet is recorded even if the spec doesn't enable the canary, so that a canary created
+// before can be deleted.
+func resolveCanary(spec *Spec, subnetFQN string) {
+	spec.canarySubnet = subnetFQN
+	if !spec.Canary || subnetFQN == "" || ValidateCanarySubnet(subnetFQN) != nil {
+		return
+	}
+	// projects/<project>/regions/<region>/subnetworks/<subnet>
+	project := strings.Split(gcp.RelativeName(subnetFQN), "/")[1]
+	for _, c := range spec.ConsumerAcceptList {
+		if ptr.Deref(c.ProjectIdOrNum, "") == project {
+			return
+		}
+	}
+	spec.ConsumerAcceptList = append(spec.ConsumerAcceptList, &Consumer{ProjectIdOrNum: &project, ConnectionLimit: 1})
+}
+
+// withCanary adds the canary to the spec's sub-reconcilers if it enables it. The canary is a
+// PSC consumer endpoint in the controller's canary subnet, usually in a dedicated test project,
+// targeting the service attachment serving the consumers, i.e. the migration's once it's
+// acknowledged. Its ConsumerReachable condition is true once the attachment accepted it, which
+// verifies the whole path consumers take, including the accept list and NAT subnets. It's
+// deleted once the spec disables it, as per lastApplied.
+func withCanary(subs []subReconciler, gc gcp.Client, spec, lastApplied *Spec, own ownership) []subReconciler {
+	if !spec.Canary {
+		if lastApplied == nil || !lastApplied.Canary {
+			return subs
+		}
+		return append(subs, obsolete(newCanaryReconciler(gc, spec, own, "canary", svcAttName(spec.Prefix)), "ConsumerCanaryDeleted"))
+	}
+	if spec.Migration != nil && spec.migrationAcknowledged {
+		return append(subs, newCanaryReconciler(gc, spec, own, "migration canary", migrationSvcAttName(spec.Prefix)))
+	}
+	return append(subs, newCanaryReconciler(gc, spec, own, "canary", svcAttName(spec.Prefix)))
+}
+
+func newCanaryReconciler(gc gcp.Client, spec *Spec, own ownership, kind, svcAtt string) *canaryReconciler {
+	return &canaryReconciler{
+		condition: condition{condType: "ConsumerReachable"},
+		kind:      kind,
+		gc:        gc,
+		own:       own,
+		name:      canaryName(spec.Prefix),
+		subnetFQN: spec.canarySubnet,
+		svcAttFQN: gcp.ServiceAttachmentFQN(gc.Project(), gc.Region(), svcAtt),
+	}
+}
+
+type canaryReconciler struct {
+	condition
+	// kind names the sub-reconciler, since it depends on the migration's attachment once it's
+	// acknowledged.
+	kind string
+	gc   gcp.ConsumerEndpoints
+	own  ownership
+	name string
+	// subnetFQN is the canary subnet. It's empty if the controller doesn't set one.
+	subnetFQN string
+	svcAttFQN string
+}
+
+func (c *canaryReconciler) Name() string {
+	return c.kind
+}
+
+func (c *canaryReconciler) Ensure(ctx context.Context, log logr.Logger) error {
+	if c.subnetFQN == "" {
+		return c.record(errCanaryUnconfigured)
+	}
+	e := &ensurer[*computepb.ForwardingRule]{
+		kind: c.Name(),
+		name: c.name,
+		own:  c.own,
+		get:  c.get,
+		// PSC endpoints can't be retargeted, e.g. after a migration, so they're recreated.
+		needsUpdate: func(ep *computepb.ForwardingRule) bool {
+			return gcp.RelativeName(ep.GetTarget()) != c.svcAttFQN
+		},
+		create: func(ctx context.Context) error {
+			return c.gc.CreateConsumerEndpoint(ctx, c.subnetFQN, c.name, c.svcAttFQN)
+		},
+		update: func(ctx context.Context) error {
+			err := c.gc.DeleteConsumerEndpoint(ctx, c.subnetFQN, c.name)
+			if err != nil && !errors.Is(err, gcp.ErrNotFound) {
+				return err
+			}
+			return c.gc.CreateConsumerEndpoint(ctx, c.subnetFQN, c.name, c.svcAttFQN)
+		},
+	}
+	_, err := e.ensure(ctx, log)
+	if err != nil {
+		return c.record(err)
+	}
+	ep, err := c.get(ctx)
+	if err != nil {
+		log.Error(err, "Failed to get the canary to check its connection.", "name", c.name)
+		return c.record(err)
+	}
+	if status := ep.GetPscConnectionStatus(); status != computepb.ForwardingRule_ACCEPTED.String() {
+		err = fmt.Errorf("the canary's connection to %s is %s", c.svcAttFQN, status)
+		log.Info("The canary can't reach the service attachment.", "name", c.name, "status", status)
+		return c.record(err)
+	}
+	return c.record(nil)
+}
+
+func (c *canaryReconciler) Delete(ctx context.Context, _ logr.Logger) error {
+	if c.subnetFQN == "" {
+		// There's nowhere to find it.
+		return gcp.ErrNotFound
+	}
+	return deleteOwned(ctx, c.own, c.Name(), c.name, c.getByName, c.deleteByName)
+}
+
+func (c *canaryReconciler) Exists(ctx context.Context) (bool, error) {
+	if c.subnetFQN == "" {
+		return false, nil
+	}
+	return exists(ctx, c.getByName, c.name)
+}
+
+func (c *canaryReconciler) get(ctx context.Context) (*computepb.ForwardingRule, error) {
+	return c.getByName(ctx, c.name)
+}
+
+func (c *canaryReconciler) getByName(ctx context.Context, name string) (*computepb.ForwardingRule, error) {
+	return c.gc.GetConsumerEndpoint(ctx, c.subnetFQN, name)
+}
+
+func (c *canaryReconciler) deleteByName(ctx context.Context, name string) error {
+	return c.gc.DeleteConsumerEndpoint(ctx, c.subnetFQN, name)
+}
@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/0x5d/psc-portmapper/api"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestResolveCanary(t *testing.T) {
+	subnet := "projects/canary-project/regions/us-east1/subnetworks/canary"
+	tests := []struct {
+		name      string
+		spec      *Spec
+		subnetFQN string
+		expected  []*Consumer
+	}{{
+		name:      "Accepts the canary's project",
+		spec:      &Spec{Spec: api.Spec{Canary: true, ConsumerAcceptList: []*Consumer{{ProjectIdOrNum: ptr.To("consumer"), ConnectionLimit: 10}}}},
+		subnetFQN: subnet,
+		expected: []*Consumer{
+			{ProjectIdOrNum: ptr.To("consumer"), ConnectionLimit: 10},
+			{ProjectIdOrNum: ptr.To("canary-project"), ConnectionLimit: 1},
+		},
+	}, {
+		name:      "Doesn't accept the canary's project twice",
+		spec:      &Spec{Spec: api.Spec{Canary: true, ConsumerAcceptList: []*Consumer{{ProjectIdOrNum: ptr.To("canary-project"), ConnectionLimit: 10}}}},
+		subnetFQN: subnet,
+		expected:  []*Consumer{{ProjectIdOrNum: ptr.To("canary-project"), ConnectionLimit: 10}},
+	}, {
+		name:      "Doesn't accept the canary's project if the canary is disabled",
+		spec:      &Spec{},
+		subnetFQN: subnet,
+	}, {
+		name: "Doesn't accept anything without a canary subnet",
+		spec: &Spec{Spec: api.Spec{Canary: true}},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolveCanary(tt.spec, tt.subnetFQN)
+			require.Equal(t, tt.subnetFQN, tt.spec.canarySubnet)
+			require.Equal(t, tt.expected, tt.spec.ConsumerAcceptList)
+		})
+	}
+}
+
+func TestCanary(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	s.spec.Canary = true
+	specStr, err := json.Marshal(s.spec)
+	require.NoError(t, err)
+	s.sts.Annotations[annotation] = string(specStr)
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	subnet := gcp.SubnetFQN("canary-project", s.region, "canary")
+	gcpClient.AddPrivateSubnetwork(gcp.NetworkFQN("canary-project", "canary"), subnet, "10.1.0.0/24")
+	settings := DefaultSettings()
+	settings.DriftCheckInterval = 0
+	r := New(c, gcpClient, WithSettings(settings))
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	condition := func(condType string) *metav1.Condition {
+		sts := &appsv1.StatefulSet{}
+		require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+		return meta.FindStatusCondition(parseStatus(sts).Conditions, condType)
+	}
+
+	// The canary can't be created without a subnet.
+	_, err = r.Reconcile(ctx, req)
+	require.Error(t, err)
+	cond := condition("ConsumerReachable")
+	require.NotNil(t, cond)
+	require.Equal(t, metav1.ConditionFalse, cond.Status)
+	require.Equal(t, errCanaryUnconfigured.Error(), cond.Message)
+
+	settings.CanarySubnet = subnet
+	r.SetSettings(settings)
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, metav1.ConditionTrue, condition("ConsumerReachable").Status)
+	ep, err := gcpClient.GetConsumerEndpoint(ctx, subnet, canaryName(s.spec.Prefix))
+	require.NoError(t, err)
+	require.Equal(t, gcp.ServiceAttachmentFQN(s.project, s.region, svcAttName(s.spec.Prefix)), ep.GetTarget())
+	projects := func() []string {
+		svcAtt, err := gcpClient.GetServiceAttachment(ctx, svcAttName(s.spec.Prefix))
+		require.NoError(t, err)
+		projects := make([]string, 0, len(svcAtt.ConsumerAcceptLists))
+		for _, c := range svcAtt.ConsumerAcceptLists {
+			projects = append(projects, c.GetProjectIdOrNum())
+		}
+		return projects
+	}
+	require.Contains(t, projects(), "canary-project")
+
+	// The canary is deleted once it's disabled.
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	s.spec.Canary = false
+	specStr, err = json.Marshal(s.spec)
+	require.NoError(t, err)
+	sts.Annotations[annotation] = string(specStr)
+	require.NoError(t, c.Update(ctx, sts))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, metav1.ConditionTrue, condition("ConsumerCanaryDeleted").Status)
+	_, err = gcpClient.GetConsumerEndpoint(ctx, subnet, canaryName(s.spec.Prefix))
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+	require.NotContains(t, projects(), "canary-project")
+}
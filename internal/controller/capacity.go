@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+
+	"github.com/0x5d/psc-portmapper/api"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/ptr"
+)
+
+// reasonExceedsCapacity is the reason of the event emitted when the STS has more replicas than
+// its spec can map.
+const reasonExceedsCapacity = "ScaleExceedsCapacity"
+
+// maxPort is the highest port consumers can connect to.
+const maxPort = api.MaxPort
+
+// portCapacity returns how many replicas the spec can map, and what limits it: each node port's
+// range of ports, which starts at its starting_port and has a port per replica, must end by
+// maxPort and not overlap the others, and the NEG can't have more than negEndpointLimit
+// endpoints, one per port per replica. A negEndpointLimit of 0 doesn't limit it.
+func portCapacity(spec *Spec, negEndpointLimit int) (int32, string) {
+	capacity, limit := int32(math.MaxInt32), ""
+	restrict := func(c int32, format string, args ...any) {
+		if c < capacity {
+			capacity, limit = max(c, 0), fmt.Sprintf(format, args...)
+		}
+	}
+	names := slices.SortedFunc(maps.Keys(spec.NodePorts), func(a, b string) int {
+		return cmp.Or(cmp.Compare(spec.NodePorts[a].StartingPort, spec.NodePorts[b].StartingPort), cmp.Compare(a, b))
+	})
+	for i, name := range names {
+		start := spec.NodePorts[name].StartingPort
+		restrict(maxPort-start+1, "the ports of node port %q can't exceed %d", name, maxPort)
+		if i > 0 {
+			prev := names[i-1]
+			restrict(start-spec.NodePorts[prev].StartingPort, "the ports of node ports %q and %q can't overlap", prev, name)
+		}
+	}
+	if negEndpointLimit > 0 && len(names) > 0 {
+		restrict(int32(negEndpointLimit/len(names)), "the NEG can't have more than %d endpoints", negEndpointLimit)
+	}
+	return capacity, limit
+}
+
+// checkCapacity emits a Warning event if the STS has more replicas than its spec can map, as
+// soon as it's scaled up, rather than failing to attach the extra pods' endpoints once they're
+// scheduled. The replicas that fit are still mapped, see getPortMappings.
+func (r *PortmapReconciler) checkCapacity(log logr.Logger, sts *appsv1.StatefulSet, spec *Spec) {
+	replicas := ptr.Deref(sts.Spec.Replicas, 1)
+	capacity, limit := portCapacity(spec, r.currentSettings().NEGEndpointLimit)
+	if replicas <= capacity {
+		return
+	}
+	log.Info("The STS has more replicas than the spec can map.", "replicas", replicas, "capacity", capacity, "limit", limit)
+	r.event(sts, corev1.EventTypeWarning, reasonExceedsCapacity, "Only %d of the %d replicas can be mapped, since %s", capacity, replicas, limit)
+}
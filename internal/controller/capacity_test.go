@@ -0,0 +1,95 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/0x5d/psc-portmapper/api"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+)
+
+func TestPortCapacity(t *testing.T) {
+	tests := []struct {
+		name             string
+		ports            map[string]PortConfig
+		negEndpointLimit int
+		expected         int32
+		expectedLimit    string
+	}{{
+		name:             "Is limited by the highest port",
+		ports:            map[string]PortConfig{"app": {StartingPort: 65530}},
+		negEndpointLimit: 10000,
+		expected:         6,
+		expectedLimit:    `the ports of node port "app" can't exceed 65535`,
+	}, {
+		name: "Is limited by the next node port's range",
+		ports: map[string]PortConfig{
+			"admin": {StartingPort: 30100},
+			"app":   {StartingPort: 30000},
+		},
+		negEndpointLimit: 10000,
+		expected:         100,
+		expectedLimit:    `the ports of node ports "app" and "admin" can't overlap`,
+	}, {
+		name: "Is limited by the NEG's endpoints, one per port per replica",
+		ports: map[string]PortConfig{
+			"admin": {StartingPort: 40000},
+			"app":   {StartingPort: 30000},
+		},
+		negEndpointLimit: 1000,
+		expected:         500,
+		expectedLimit:    "the NEG can't have more than 1000 endpoints",
+	}, {
+		name:          "Isn't limited by the NEG's endpoints if there's no limit",
+		ports:         map[string]PortConfig{"app": {StartingPort: 30000}},
+		expected:      35536,
+		expectedLimit: `the ports of node port "app" can't exceed 65535`,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			capacity, limit := portCapacity(&Spec{Spec: api.Spec{NodePorts: tt.ports}}, tt.negEndpointLimit)
+			require.Equal(t, tt.expected, capacity)
+			require.Equal(t, tt.expectedLimit, limit)
+		})
+	}
+}
+
+func TestCheckCapacity(t *testing.T) {
+	spec := &Spec{Spec: api.Spec{NodePorts: map[string]PortConfig{"app": {StartingPort: 65530}}}}
+	tests := []struct {
+		name           string
+		replicas       int32
+		expectedEvents []string
+	}{{
+		name:     "Doesn't alert if the replicas fit",
+		replicas: 6,
+	}, {
+		name:           "Alerts if the replicas don't fit",
+		replicas:       8,
+		expectedEvents: []string{`Warning ScaleExceedsCapacity Only 6 of the 8 replicas can be mapped, since the ports of node port "app" can't exceed 65535`},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sts := &appsv1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{Name: "sts"},
+				Spec:       appsv1.StatefulSetSpec{Replicas: ptr.To(tt.replicas)},
+			}
+			rec := record.NewFakeRecorder(10)
+			r := New(nil, nil, WithEventRecorder(rec))
+
+			r.checkCapacity(testr.New(t), sts, spec)
+			close(rec.Events)
+			var events []string
+			for e := range rec.Events {
+				events = append(events, e)
+			}
+			require.Equal(t, tt.expectedEvents, events)
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package controller
+
+import (
+	"context"
+	"maps"
+	"strconv"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"go.uber.org/multierr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// clientPortAnnotation is set on each mapped pod to the port consumers connect to, if the spec
+// has a single node port. Otherwise, clientPortAnnotation-<port name> is set for each of them.
+const clientPortAnnotation = "psc-portmapper.0x5d.org/client-port"
+
+// clientPortAnnotations returns the client port annotations of the pod with the given index.
+func clientPortAnnotations(spec *Spec, index int32) map[string]string {
+	annotations := make(map[string]string, len(spec.NodePorts))
+	for name, p := range spec.NodePorts {
+		port := strconv.Itoa(int(p.StartingPort + index))
+		if len(spec.NodePorts) == 1 {
+			annotations[clientPortAnnotation] = port
+			break
+		}
+		annotations[clientPortAnnotation+"-"+name] = port
+	}
+	return annotations
+}
+
+// annotateClientPorts sets the client port annotations on each of the pods whose endpoints were
+// attached, as per getPortMappings, so that they can read their ports through the downward API.
+// Annotations of ports that aren't in the spec anymore are removed.
+func (r *PortmapReconciler) annotateClientPorts(ctx context.Context, log logr.Logger, spec *Spec, sts *appsv1.StatefulSet, pods []corev1.Pod) error {
+	capacity, _ := portCapacity(spec, r.currentSettings().NEGEndpointLimit)
+	var err error
+	for i := range pods {
+		pod := &pods[i]
+		index, ok := podIndex(sts, pod)
+		if !ok || index >= capacity || pod.Spec.NodeName == "" {
+			continue
+		}
+		desired := clientPortAnnotations(spec, index)
+		annotations := maps.Clone(pod.Annotations)
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		maps.DeleteFunc(annotations, func(k, _ string) bool {
+			_, ok := desired[k]
+			return strings.HasPrefix(k, clientPortAnnotation) && !ok
+		})
+		maps.Copy(annotations, desired)
+		if maps.Equal(annotations, pod.Annotations) {
+			continue
+		}
+		patch := client.MergeFrom(pod.DeepCopy())
+		pod.Annotations = annotations
+		patchErr := r.Patch(ctx, pod, patch)
+		if patchErr != nil {
+			log.Error(patchErr, "Failed to annotate the pod with its client ports.", "namespace", pod.Namespace, "name", pod.Name)
+			err = multierr.Append(err, patchErr)
+		}
+	}
+	return err
+}
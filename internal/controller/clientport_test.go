@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/0x5d/psc-portmapper/api"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestClientPortAnnotations(t *testing.T) {
+	tests := []struct {
+		name     string
+		ports    map[string]PortConfig
+		expected map[string]string
+	}{{
+		name:     "Sets the client port if there's a single node port",
+		ports:    map[string]PortConfig{"app": {StartingPort: 30000}},
+		expected: map[string]string{clientPortAnnotation: "30002"},
+	}, {
+		name: "Sets a client port per node port",
+		ports: map[string]PortConfig{
+			"app":   {StartingPort: 30000},
+			"admin": {StartingPort: 31000},
+		},
+		expected: map[string]string{
+			clientPortAnnotation + "-app":   "30002",
+			clientPortAnnotation + "-admin": "31002",
+		},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, clientPortAnnotations(&Spec{Spec: api.Spec{NodePorts: tt.ports}}, 2))
+		})
+	}
+}
+
+func TestAnnotateClientPorts(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	// A port removed from the spec.
+	s.pods.Items[0].Annotations = map[string]string{clientPortAnnotation + "-old": "31000", "other": "value"}
+	// A pod being removed after a scale down.
+	s.sts.Spec.Replicas = ptr.To(int32(2))
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	r := New(c, gcpfake.New(s.project, s.region))
+	_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)})
+	require.NoError(t, err)
+
+	expected := []map[string]string{
+		{clientPortAnnotation: "30000", "other": "value"},
+		{clientPortAnnotation: "30001"},
+		nil,
+	}
+	for i, p := range s.pods.Items {
+		pod := &corev1.Pod{}
+		require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(&p), pod))
+		require.Equal(t, expected[i], pod.Annotations, pod.Name)
+	}
+
+	// Up-to-date pods aren't patched.
+	pods := &corev1.PodList{}
+	require.NoError(t, c.List(ctx, pods))
+	c = fake.NewClientBuilder().WithLists(pods).Build()
+	r = New(c, nil)
+	require.NoError(t, r.annotateClientPorts(ctx, testr.New(t), s.spec, s.sts, pods.Items))
+	for _, p := range pods.Items {
+		pod := &corev1.Pod{}
+		require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(&p), pod))
+		require.Equal(t, p.ResourceVersion, pod.ResourceVersion)
+	}
+}
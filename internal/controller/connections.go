@@ -0,0 +1,68 @@
+package controller
+
+import (
+	"strings"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// reasonConnectionLimit is the reason of the event emitted when a consumer's accepted
+// connections are close to its connection limit.
+const reasonConnectionLimit = "ConnectionLimitNearlyReached"
+
+// checkConnectionLimits exports how many of its connection limit each consumer of the service
+// attachment uses, and emits a Warning event for those above
+// Settings.ConnectionLimitAlertPercent, so that the limits can be raised before consumers'
+// connections are rejected.
+func (r *PortmapReconciler) checkConnectionLimits(log logr.Logger, sts *appsv1.StatefulSet, svcAtt *computepb.ServiceAttachment) {
+	sName := types.NamespacedName{Namespace: sts.Namespace, Name: sts.Name}.String()
+	// Consumers removed from the accept list are dropped.
+	deleteConnectionMetrics(sName)
+	alertPercent := r.currentSettings().ConnectionLimitAlertPercent
+	connections := connectionsByConsumer(svcAtt)
+	for key, c := range consumersByKey(svcAtt.GetConsumerAcceptLists()) {
+		accepted := connections[key]
+		consumerConnections.WithLabelValues(sName, key).Set(float64(accepted))
+		limit := c.GetConnectionLimit()
+		if limit == 0 {
+			continue
+		}
+		utilization := float64(accepted) / float64(limit)
+		connectionLimitUtilization.WithLabelValues(sName, key).Set(utilization)
+		if alertPercent > 0 && utilization*100 >= float64(alertPercent) {
+			log.Info("A consumer's connections are close to its connection limit.", "consumer", key, "connections", accepted, "limit", limit)
+			r.event(sts, corev1.EventTypeWarning, reasonConnectionLimit, "Consumer %s has %d accepted connections out of its limit of %d", key, accepted, limit)
+		}
+	}
+}
+
+// connectionsByConsumer counts the attachment's accepted connections by the keys of the
+// consumers they count against, see consumersByKey: their network's, and their network's
+// project's. Consumers accepted by project number can't be matched, since the connections
+// only reference their network by project ID.
+func connectionsByConsumer(svcAtt *computepb.ServiceAttachment) map[string]int {
+	counts := map[string]int{}
+	for _, ep := range svcAtt.GetConnectedEndpoints() {
+		if ep.GetStatus() != computepb.ServiceAttachmentConnectedEndpoint_ACCEPTED.String() {
+			continue
+		}
+		network := gcp.RelativeName(ep.GetConsumerNetwork())
+		counts["network:"+network]++
+		// projects/<project>/global/networks/<network>
+		if parts := strings.Split(network, "/"); len(parts) > 1 && parts[0] == "projects" {
+			counts["project:"+parts[1]]++
+		}
+	}
+	return counts
+}
+
+func deleteConnectionMetrics(sts string) {
+	consumerConnections.DeletePartialMatch(prometheus.Labels{"sts": sts})
+	connectionLimitUtilization.DeletePartialMatch(prometheus.Labels{"sts": sts})
+}
@@ -0,0 +1,77 @@
+package controller
+
+import (
+	"testing"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/go-logr/logr/testr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestCheckConnectionLimits(t *testing.T) {
+	accepted := computepb.ServiceAttachmentConnectedEndpoint_ACCEPTED.String()
+	pending := computepb.ServiceAttachmentConnectedEndpoint_PENDING.String()
+	endpoint := func(network, status string) *computepb.ServiceAttachmentConnectedEndpoint {
+		return &computepb.ServiceAttachmentConnectedEndpoint{ConsumerNetwork: proto.String(network), Status: proto.String(status)}
+	}
+	svcAtt := &computepb.ServiceAttachment{
+		ConsumerAcceptLists: []*computepb.ServiceAttachmentConsumerProjectLimit{{
+			ProjectIdOrNum:  proto.String("busy"),
+			ConnectionLimit: proto.Uint32(5),
+		}, {
+			NetworkUrl:      proto.String("https://www.googleapis.com/compute/v1/projects/quiet/global/networks/vpc"),
+			ConnectionLimit: proto.Uint32(10),
+		}},
+		ConnectedEndpoints: []*computepb.ServiceAttachmentConnectedEndpoint{
+			endpoint("https://www.googleapis.com/compute/v1/projects/busy/global/networks/a", accepted),
+			endpoint("https://www.googleapis.com/compute/v1/projects/busy/global/networks/b", accepted),
+			endpoint("https://www.googleapis.com/compute/v1/projects/busy/global/networks/b", accepted),
+			endpoint("https://www.googleapis.com/compute/v1/projects/busy/global/networks/b", accepted),
+			endpoint("https://www.googleapis.com/compute/v1/projects/quiet/global/networks/vpc", accepted),
+			endpoint("https://www.googleapis.com/compute/v1/projects/quiet/global/networks/vpc", pending),
+		},
+	}
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "connection-limits"}}
+
+	tests := []struct {
+		name           string
+		alertPercent   int
+		expectedEvents []string
+	}{{
+		name:           "Alerts about the consumers above the threshold",
+		alertPercent:   80,
+		expectedEvents: []string{"Warning ConnectionLimitNearlyReached Consumer project:busy has 4 accepted connections out of its limit of 5"},
+	}, {
+		name:         "Doesn't alert below the threshold",
+		alertPercent: 90,
+	}, {
+		name:         "Doesn't alert if disabled",
+		alertPercent: 0,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := DefaultSettings()
+			settings.ConnectionLimitAlertPercent = tt.alertPercent
+			rec := record.NewFakeRecorder(10)
+			r := New(nil, nil, WithSettings(settings), WithEventRecorder(rec))
+
+			r.checkConnectionLimits(testr.New(t), sts, svcAtt)
+			close(rec.Events)
+			var events []string
+			for e := range rec.Events {
+				events = append(events, e)
+			}
+			require.Equal(t, tt.expectedEvents, events)
+			require.Equal(t, 4.0, testutil.ToFloat64(consumerConnections.WithLabelValues("ns/connection-limits", "project:busy")))
+			require.Equal(t, 0.8, testutil.ToFloat64(connectionLimitUtilization.WithLabelValues("ns/connection-limits", "project:busy")))
+			require.Equal(t, 1.0, testutil.ToFloat64(consumerConnections.WithLabelValues("ns/connection-limits", "network:projects/quiet/global/networks/vpc")))
+			require.Equal(t, 0.1, testutil.ToFloat64(connectionLimitUtilization.WithLabelValues("ns/connection-limits", "network:projects/quiet/global/networks/vpc")))
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// defaultConsumersKey is the ConfigMap key holding the consumers, unless the spec sets another.
+const defaultConsumersKey = "consumers"
+
+// errConsumersUnavailable is returned when the referenced consumers couldn't be read, as
+// opposed to being invalid, so that it's retried even if invalid specs aren't.
+var errConsumersUnavailable = errors.New("failed to read the referenced consumers")
+
+// resolveConsumers appends the consumers in the ConfigMap referenced by the spec to its
+// consumer accept list, and validates the result, including against the policy. The spec's
+// hash covers them, so changing the ConfigMap updates the service attachment.
+func (r *PortmapReconciler) resolveConsumers(ctx context.Context, log logr.Logger, namespace string, spec *Spec, policy *Policy) error {
+	ref := spec.ConsumerAcceptListFrom
+	if ref == nil {
+		return nil
+	}
+	name := consumersConfigMapName(namespace, ref)
+	cm := &corev1.ConfigMap{}
+	err := r.reader.Get(ctx, name, cm)
+	if apierrors.IsNotFound(err) {
+		return fmt.Errorf("invalid spec: consumer_accept_list_from references ConfigMap %s, which doesn't exist", name)
+	}
+	if err != nil {
+		return fmt.Errorf("%w from ConfigMap %s: %w", errConsumersUnavailable, name, err)
+	}
+	key := consumersKey(ref)
+	data, ok := cm.Data[key]
+	if !ok {
+		return fmt.Errorf("invalid spec: ConfigMap %s referenced by consumer_accept_list_from doesn't have key %q", name, key)
+	}
+	var consumers []*Consumer
+	err = json.Unmarshal([]byte(data), &consumers)
+	if err != nil {
+		return fmt.Errorf("invalid spec: couldn't decode the consumers in ConfigMap %s, key %q: %w", name, key, err)
+	}
+	consumers = spec.withDefaultConnectionLimit(consumers)
+	err = validateConsumers(log, consumers, fmt.Sprintf("configmap %s[%s]", name, key))
+	if err != nil {
+		return fmt.Errorf("invalid spec: %w", err)
+	}
+	log.V(1).Info("Accepting the consumers in ConfigMap.", "configmap", name, "key", key, "consumers", len(consumers))
+	spec.ConsumerAcceptList = append(spec.ConsumerAcceptList, consumers...)
+	err = policy.validate(spec)
+	if err != nil {
+		return fmt.Errorf("the spec violates the policy: %w", err)
+	}
+	return nil
+}
+
+func consumersConfigMapName(namespace string, ref *ConsumerListRef) types.NamespacedName {
+	if ref.Namespace != "" {
+		namespace = ref.Namespace
+	}
+	return types.NamespacedName{Namespace: namespace, Name: ref.ConfigMap}
+}
+
+func consumersKey(ref *ConsumerListRef) string {
+	if ref.Key != "" {
+		return ref.Key
+	}
+	return defaultConsumersKey
+}
+
+// statefulSetsReferencing returns a request for each StatefulSet of the controller's class
+// and shard whose spec references the ConfigMap's consumers.
+func (r *PortmapReconciler) statefulSetsReferencing(ctx context.Context, cm client.Object) []reconcile.Request {
+	stss := &appsv1.StatefulSetList{}
+	err := r.List(ctx, stss)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list the StatefulSets.", "configmap", client.ObjectKeyFromObject(cm))
+		return nil
+	}
+	var reqs []reconcile.Request
+	for i := range stss.Items {
+		sts := &stss.Items[i]
+		jsonSpec, ok := sts.Annotations[annotation]
+		if !ok || !r.manages(sts) {
+			continue
+		}
+		spec := &Spec{}
+		if json.Unmarshal([]byte(jsonSpec), spec) != nil || spec.ConsumerAcceptListFrom == nil {
+			continue
+		}
+		if consumersConfigMapName(sts.Namespace, spec.ConsumerAcceptListFrom) != client.ObjectKeyFromObject(cm) {
+			continue
+		}
+		reqs = append(reqs, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(sts)})
+	}
+	return reqs
+}
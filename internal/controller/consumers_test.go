@@ -0,0 +1,150 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/0x5d/psc-portmapper/api"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestResolveConsumers(t *testing.T) {
+	configMap := func(namespace string, data map[string]string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "consumers"},
+			Data:       data,
+		}
+	}
+	own := &Consumer{ProjectIdOrNum: proto.String("own"), ConnectionLimit: 1}
+
+	tests := []struct {
+		name        string
+		objects     []client.Object
+		ref         *ConsumerListRef
+		policy      *Policy
+		expected    []*Consumer
+		expectedErr string
+	}{{
+		name:     "Does nothing if the spec doesn't reference a ConfigMap",
+		expected: []*Consumer{own},
+	}, {
+		name:    "Appends the ConfigMap's consumers",
+		objects: []client.Object{configMap("default", map[string]string{"consumers": `[{"project_id_or_num": "central", "connection_limit": 10}]`})},
+		ref:     &ConsumerListRef{ConfigMap: "consumers"},
+		expected: []*Consumer{own, {
+			ProjectIdOrNum:  proto.String("central"),
+			ConnectionLimit: 10,
+		}},
+	}, {
+		name:    "Reads the ConfigMap from another namespace and key",
+		objects: []client.Object{configMap("platform", map[string]string{"prod": `[{"network_fqn": "projects/p/global/networks/n"}]`})},
+		ref:     &ConsumerListRef{Namespace: "platform", ConfigMap: "consumers", Key: "prod"},
+		expected: []*Consumer{own, {
+			NetworkFQN: proto.String("projects/p/global/networks/n"),
+		}},
+	}, {
+		name:        "Fails if the ConfigMap doesn't exist",
+		ref:         &ConsumerListRef{ConfigMap: "consumers"},
+		expectedErr: "invalid spec: consumer_accept_list_from references ConfigMap default/consumers, which doesn't exist",
+	}, {
+		name:        "Fails if the key doesn't exist",
+		objects:     []client.Object{configMap("default", nil)},
+		ref:         &ConsumerListRef{ConfigMap: "consumers"},
+		expectedErr: `invalid spec: ConfigMap default/consumers referenced by consumer_accept_list_from doesn't have key "consumers"`,
+	}, {
+		name:        "Fails if the consumers are invalid",
+		objects:     []client.Object{configMap("default", map[string]string{"consumers": `[{"connection_limit": 10}]`})},
+		ref:         &ConsumerListRef{ConfigMap: "consumers"},
+		expectedErr: "invalid spec: either network_fqn or project_id_or_num must be set in configmap default/consumers[consumers][0]",
+	}, {
+		name:        "Fails if the consumers violate the policy",
+		objects:     []client.Object{configMap("default", map[string]string{"consumers": `[{"project_id_or_num": "central"}]`})},
+		ref:         &ConsumerListRef{ConfigMap: "consumers"},
+		policy:      &Policy{AllowedConsumerProjects: []string{"own"}},
+		expectedErr: `the spec violates the policy: consumer_list[1]'s project ("central") isn't allowed`,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := fake.NewClientBuilder().WithObjects(tt.objects...).Build()
+			r := New(c, nil)
+			spec := &Spec{Spec: api.Spec{ConsumerAcceptList: []*Consumer{own}, ConsumerAcceptListFrom: tt.ref}}
+
+			err := r.resolveConsumers(context.Background(), testr.New(t), "default", spec, tt.policy)
+			if tt.expectedErr != "" {
+				require.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, spec.ConsumerAcceptList)
+		})
+	}
+}
+
+func TestStatefulSetsReferencing(t *testing.T) {
+	sts := func(namespace, name, spec string) *appsv1.StatefulSet {
+		return &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+			Namespace:   namespace,
+			Name:        name,
+			Annotations: map[string]string{annotation: spec},
+		}}
+	}
+	c := fake.NewClientBuilder().WithObjects(
+		sts("default", "same-namespace", `{"consumer_accept_list_from": {"config_map": "consumers"}}`),
+		sts("app", "other-namespace", `{"consumer_accept_list_from": {"namespace": "default", "config_map": "consumers"}}`),
+		sts("app", "wrong-namespace", `{"consumer_accept_list_from": {"config_map": "consumers"}}`),
+		sts("default", "no-reference", `{}`),
+	).Build()
+	r := New(c, nil)
+
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "consumers"}}
+	reqs := r.statefulSetsReferencing(context.Background(), cm)
+	require.ElementsMatch(t, []reconcile.Request{
+		{NamespacedName: client.ObjectKey{Namespace: "default", Name: "same-namespace"}},
+		{NamespacedName: client.ObjectKey{Namespace: "app", Name: "other-namespace"}},
+	}, reqs)
+}
+
+func TestDeleteWithoutConsumersConfigMap(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	s.spec.ConsumerAcceptListFrom = &ConsumerListRef{ConfigMap: "consumers"}
+	specStr, err := json.Marshal(s.spec)
+	require.NoError(t, err)
+	s.sts.Annotations[annotation] = string(specStr)
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: s.sts.Namespace, Name: "consumers"},
+		Data:       map[string]string{"consumers": `[{"project_id_or_num": "central", "connection_limit": 10}]`},
+	}
+	c := fake.NewClientBuilder().WithLists(s.nodes, s.pods).WithObjects(s.sts, cm).Build()
+	gc := gcpfake.New(s.project, s.region)
+	r := New(c, gc)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	_, err = gc.GetServiceAttachment(ctx, svcAttName(s.spec.Prefix))
+	require.NoError(t, err)
+
+	// The ConfigMap is deleted first, e.g. along with the namespace.
+	require.NoError(t, c.Delete(ctx, cm))
+	require.NoError(t, c.Delete(ctx, s.sts))
+	require.Eventually(t, func() bool {
+		_, _ = r.Reconcile(ctx, req)
+		return apierrors.IsNotFound(c.Get(ctx, req.NamespacedName, &appsv1.StatefulSet{}))
+	}, 5*time.Second, time.Millisecond)
+	_, err = gc.GetServiceAttachment(ctx, svcAttName(s.spec.Prefix))
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+}
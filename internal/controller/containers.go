@@ -0,0 +1,91 @@
+package controller
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"go.uber.org/multierr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// validateTargetPorts returns an error for each of the spec's node ports whose target port
+// doesn't resolve to a single container of the pod template: the container it sets must exist
+// and declare the port, a named port must be declared by exactly one container, and a port
+// declared by several containers must set which one it targets. Ports that aren't declared by
+// any container are only allowed by number, as before containers could be set.
+func validateTargetPorts(spec *Spec, pod *corev1.PodSpec) error {
+	containers := servingContainers(pod)
+	var err error
+	// Sorted so that errors are deterministic.
+	for _, name := range slices.Sorted(maps.Keys(spec.NodePorts)) {
+		p := spec.NodePorts[name]
+		candidates := containers
+		if p.Container != "" {
+			candidates = slices.DeleteFunc(slices.Clone(containers), func(c corev1.Container) bool { return c.Name != p.Container })
+			if len(candidates) == 0 {
+				err = multierr.Append(err, fmt.Errorf("node_ports[%s].container %q isn't a container of the StatefulSet's pods", name, p.Container))
+				continue
+			}
+		}
+		var target string
+		var declaredBy []string
+		switch {
+		case p.ContainerPortName != "":
+			target = fmt.Sprintf("container_port_name %q", p.ContainerPortName)
+			declaredBy = declaringContainers(candidates, func(cp corev1.ContainerPort) bool { return cp.Name == p.ContainerPortName })
+		case p.ContainerPort != 0:
+			target = fmt.Sprintf("container_port %d", p.ContainerPort)
+			declaredBy = declaringContainers(candidates, func(cp corev1.ContainerPort) bool { return cp.ContainerPort == p.ContainerPort })
+		default:
+			if p.Container != "" {
+				err = multierr.Append(err, fmt.Errorf("node_ports[%s] sets container but neither container_port nor container_port_name", name))
+			}
+			continue
+		}
+		switch {
+		case len(declaredBy) > 1:
+			err = multierr.Append(err, fmt.Errorf("node_ports[%s]'s %s is declared by several containers (%s), container must be set", name, target, strings.Join(declaredBy, ", ")))
+		case len(declaredBy) == 1:
+		case p.Container != "":
+			err = multierr.Append(err, fmt.Errorf("node_ports[%s]'s %s isn't declared by container %q", name, target, p.Container))
+		case p.ContainerPortName != "":
+			err = multierr.Append(err, fmt.Errorf("node_ports[%s]'s %s isn't declared by any container", name, target))
+		}
+	}
+	return err
+}
+
+// servingContainers returns the pod's containers that can serve traffic for its lifetime,
+// i.e. its containers and its sidecars, which are init containers that keep running.
+func servingContainers(pod *corev1.PodSpec) []corev1.Container {
+	containers := slices.Clone(pod.Containers)
+	for _, c := range pod.InitContainers {
+		if c.RestartPolicy != nil && *c.RestartPolicy == corev1.ContainerRestartPolicyAlways {
+			containers = append(containers, c)
+		}
+	}
+	return containers
+}
+
+// declaringContainers returns the names of the containers declaring a port that matches.
+func declaringContainers(containers []corev1.Container, matches func(corev1.ContainerPort) bool) []string {
+	var names []string
+	for _, c := range containers {
+		if slices.ContainsFunc(c.Ports, matches) {
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
+
+// targetPort returns the NodePort service's target port for the node port, by name if it
+// sets container_port_name, so that it's resolved in each pod.
+func targetPort(p PortConfig) intstr.IntOrString {
+	if p.ContainerPortName != "" {
+		return intstr.FromString(p.ContainerPortName)
+	}
+	return intstr.FromInt32(p.ContainerPort)
+}
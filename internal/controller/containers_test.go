@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/0x5d/psc-portmapper/api"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/ptr"
+)
+
+func TestValidateTargetPorts(t *testing.T) {
+	pod := &corev1.PodSpec{
+		Containers: []corev1.Container{{
+			Name:  "kafka",
+			Ports: []corev1.ContainerPort{{Name: "broker", ContainerPort: 9092}, {Name: "metrics", ContainerPort: 9404}},
+		}, {
+			Name:  "exporter",
+			Ports: []corev1.ContainerPort{{Name: "exporter", ContainerPort: 9308}, {Name: "metrics", ContainerPort: 9404}},
+		}},
+		InitContainers: []corev1.Container{{
+			Name:          "proxy",
+			RestartPolicy: ptr.To(corev1.ContainerRestartPolicyAlways),
+			Ports:         []corev1.ContainerPort{{Name: "proxy", ContainerPort: 15001}},
+		}, {
+			Name:  "init",
+			Ports: []corev1.ContainerPort{{Name: "init", ContainerPort: 8000}},
+		}},
+	}
+	tests := []struct {
+		name  string
+		ports map[string]PortConfig
+		err   string
+	}{{
+		name: "Ports in different containers",
+		ports: map[string]PortConfig{
+			"broker":   {NodePort: 30000, ContainerPortName: "broker"},
+			"exporter": {NodePort: 30001, ContainerPort: 9308, Container: "exporter"},
+			"proxy":    {NodePort: 30002, ContainerPortName: "proxy"},
+		},
+	}, {
+		name: "Undeclared port numbers",
+		ports: map[string]PortConfig{
+			"app":  {NodePort: 30000, ContainerPort: 8080},
+			"none": {NodePort: 30001},
+		},
+	}, {
+		name:  "Ambiguous port",
+		ports: map[string]PortConfig{"metrics": {NodePort: 30000, ContainerPortName: "metrics"}},
+		err:   `node_ports[metrics]'s container_port_name "metrics" is declared by several containers (kafka, exporter), container must be set`,
+	}, {
+		name: "Ambiguous port resolved by container",
+		ports: map[string]PortConfig{
+			"kafka-metrics":    {NodePort: 30000, ContainerPort: 9404, Container: "kafka"},
+			"exporter-metrics": {NodePort: 30001, ContainerPortName: "metrics", Container: "exporter"},
+		},
+	}, {
+		name: "Unresolvable ports",
+		ports: map[string]PortConfig{
+			"a": {NodePort: 30000, ContainerPortName: "broker", Container: "missing"},
+			"b": {NodePort: 30001, ContainerPortName: "missing"},
+			"c": {NodePort: 30002, ContainerPort: 9308, Container: "kafka"},
+			"d": {NodePort: 30003, ContainerPortName: "init"},
+			"e": {NodePort: 30004, Container: "kafka"},
+		},
+		err: `node_ports[a].container "missing" isn't a container of the StatefulSet's pods; ` +
+			`node_ports[b]'s container_port_name "missing" isn't declared by any container; ` +
+			`node_ports[c]'s container_port 9308 isn't declared by container "kafka"; ` +
+			`node_ports[d]'s container_port_name "init" isn't declared by any container; ` +
+			`node_ports[e] sets container but neither container_port nor container_port_name`,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTargetPorts(&Spec{Spec: api.Spec{NodePorts: tt.ports}}, pod)
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestTargetPort(t *testing.T) {
+	require.Equal(t, intstr.FromInt32(8080), targetPort(PortConfig{ContainerPort: 8080}))
+	require.Equal(t, intstr.FromString("broker"), targetPort(PortConfig{ContainerPortName: "broker", Container: "kafka"}))
+}
@@ -0,0 +1,214 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// reasonNodePortCoolingDown is the reason of the Ready condition of a StatefulSet whose
+	// spec reuses node ports released less than Settings.NodePortCooldown ago.
+	reasonNodePortCoolingDown = "NodePortCoolingDown"
+	// reasonNodePortReleaseFailed is the reason of the events of StatefulSets torn down without
+	// recording their node ports as released.
+	reasonNodePortReleaseFailed = "NodePortReleaseFailed"
+)
+
+// errNodePortCoolingDown is returned when a spec reuses node ports that are cooling down.
+var errNodePortCoolingDown = errors.New("reuses node ports released by another StatefulSet")
+
+// releasedNodePort is a node port released by a StatefulSet's teardown, in the released node
+// ports ConfigMap, under the port's number.
+type releasedNodePort struct {
+	StatefulSet string      `json:"stateful_set"`
+	ReleasedAt  metav1.Time `json:"released_at"`
+	Until       metav1.Time `json:"until"`
+}
+
+// ValidateReleasedNodePorts returns an error if the cool-down is set but the ConfigMap
+// the released node ports are written to isn't <namespace>/<name>.
+func ValidateReleasedNodePorts(cooldown time.Duration, cm string) error {
+	if cooldown <= 0 {
+		return nil
+	}
+	if _, _, err := parseNamespacedName(cm); err != nil {
+		return fmt.Errorf("invalid released node ports ConfigMap: %w", err)
+	}
+	return nil
+}
+
+// specNodePorts returns the node ports of the spec and of the one last applied, if any.
+func specNodePorts(specs ...*Spec) []int32 {
+	ports := map[int32]struct{}{}
+	for _, spec := range specs {
+		if spec == nil {
+			continue
+		}
+		for _, p := range spec.NodePorts {
+			ports[p.NodePort] = struct{}{}
+		}
+	}
+	return slices.Sorted(maps.Keys(ports))
+}
+
+// releaseNodePorts records the STS' node ports in the released node ports ConfigMap, once its
+// resources are deleted, so that other StatefulSets can't reuse them until the cool-down
+// passes. Expired entries are removed at the same time. Failing to record them is reported
+// with a Warning event rather than blocking the STS' deletion, since its resources are gone.
+func (r *PortmapReconciler) releaseNodePorts(ctx context.Context, log logr.Logger, spec *Spec, sts *appsv1.StatefulSet) {
+	settings := r.currentSettings()
+	if settings.NodePortCooldown <= 0 {
+		return
+	}
+	ports := specNodePorts(spec, lastAppliedSpec(sts))
+	if len(ports) == 0 {
+		return
+	}
+	now := metav1.Now()
+	released := releasedNodePort{
+		StatefulSet: types.NamespacedName{Namespace: sts.Namespace, Name: sts.Name}.String(),
+		ReleasedAt:  now,
+		Until:       metav1.NewTime(now.Add(settings.NodePortCooldown)),
+	}
+	// It can't fail, since it only has strings and times.
+	data, _ := json.Marshal(released)
+	// Other StatefulSets' teardowns can update or create the ConfigMap concurrently.
+	concurrent := func(err error) bool { return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) }
+	err := retry.OnError(retry.DefaultRetry, concurrent, func() error {
+		return r.updateReleasedNodePorts(ctx, settings.ReleasedNodePortsConfigMap, func(entries map[string]string) {
+			for _, p := range ports {
+				entries[strconv.Itoa(int(p))] = string(data)
+			}
+		})
+	})
+	if err != nil {
+		log.Error(err, "Failed to record the released node ports.", "configMap", settings.ReleasedNodePortsConfigMap, "ports", ports)
+		r.event(sts, corev1.EventTypeWarning, reasonNodePortReleaseFailed,
+			"Failed to record the released node ports %v, so other StatefulSets can reuse them right away: %v", ports, err)
+		return
+	}
+	log.Info("Released the node ports.", "ports", ports, "until", released.Until.Time)
+}
+
+// updateReleasedNodePorts applies update to the ConfigMap's entries, without the expired ones,
+// creating it if it doesn't exist.
+func (r *PortmapReconciler) updateReleasedNodePorts(ctx context.Context, cmName string, update func(map[string]string)) error {
+	namespace, name, err := parseNamespacedName(cmName)
+	if err != nil {
+		return err
+	}
+	cm := &corev1.ConfigMap{}
+	err = r.reader.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, cm)
+	if apierrors.IsNotFound(err) {
+		entries := map[string]string{}
+		update(entries)
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: map[string]string{managedByLabel: portmapperApp}},
+			Data:       entries,
+		}
+		return r.Create(ctx, cm)
+	}
+	if err != nil {
+		return err
+	}
+	if !isManaged(cm) {
+		return fmt.Errorf("ConfigMap %s %w, as it's missing the %s=%s label", cmName, errNotOwned, managedByLabel, portmapperApp)
+	}
+	entries := map[string]string{}
+	for port, value := range cm.Data {
+		released := &releasedNodePort{}
+		if json.Unmarshal([]byte(value), released) == nil && time.Now().Before(released.Until.Time) {
+			entries[port] = value
+		}
+	}
+	update(entries)
+	cm.Data = entries
+	return r.Update(ctx, cm)
+}
+
+// checkNodePortCooldown returns an error wrapping errNodePortCoolingDown, and how long until
+// the last of the ports can be reused, if the spec adds node ports released by another
+// StatefulSet less than the cool-down ago. The StatefulSet that released them can reuse them,
+// e.g. if it's recreated. The ports of the last applied spec were checked when they were added,
+// so the ConfigMap is only read when the spec adds some.
+func (r *PortmapReconciler) checkNodePortCooldown(ctx context.Context, sts *appsv1.StatefulSet, spec *Spec) (time.Duration, error) {
+	settings := r.currentSettings()
+	if settings.NodePortCooldown <= 0 {
+		return 0, nil
+	}
+	applied := specNodePorts(lastAppliedSpec(sts))
+	added := slices.DeleteFunc(specNodePorts(spec), func(p int32) bool {
+		_, ok := slices.BinarySearch(applied, p)
+		return ok
+	})
+	if len(added) == 0 {
+		return 0, nil
+	}
+	namespace, name, err := parseNamespacedName(settings.ReleasedNodePortsConfigMap)
+	if err != nil {
+		return 0, err
+	}
+	cm := &corev1.ConfigMap{}
+	err = r.reader.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, cm)
+	if apierrors.IsNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the released node ports: %w", err)
+	}
+	self := types.NamespacedName{Namespace: sts.Namespace, Name: sts.Name}.String()
+	var coolingDown []string
+	var until time.Time
+	for _, p := range added {
+		released := &releasedNodePort{}
+		value, ok := cm.Data[strconv.Itoa(int(p))]
+		if !ok || json.Unmarshal([]byte(value), released) != nil {
+			continue
+		}
+		if released.StatefulSet == self || !time.Now().Before(released.Until.Time) {
+			continue
+		}
+		coolingDown = append(coolingDown, fmt.Sprintf("%d (released by %s)", p, released.StatefulSet))
+		if released.Until.After(until) {
+			until = released.Until.Time
+		}
+	}
+	if len(coolingDown) == 0 {
+		return 0, nil
+	}
+	return time.Until(until), fmt.Errorf("the spec %w less than %s ago, which can be reused after %s: %v",
+		errNodePortCoolingDown, settings.NodePortCooldown, until.UTC().Format(time.RFC3339), coolingDown)
+}
+
+// reportNodePortCooldown reports why the STS isn't reconciled with a Warning event and its Ready
+// condition. Reconciles until the ports can be reused don't report it again.
+func (r *PortmapReconciler) reportNodePortCooldown(ctx context.Context, log logr.Logger, sts *appsv1.StatefulSet, cooldownErr error) error {
+	cond := metav1.Condition{
+		Type:    readyCondition,
+		Status:  metav1.ConditionFalse,
+		Reason:  reasonNodePortCoolingDown,
+		Message: cooldownErr.Error(),
+	}
+	current := meta.FindStatusCondition(parseStatus(sts).Conditions, readyCondition)
+	if current != nil && current.Reason == cond.Reason && current.Message == cond.Message {
+		return nil
+	}
+	log.Info("Not reconciling the spec until its node ports can be reused.", "error", cooldownErr.Error())
+	r.event(sts, corev1.EventTypeWarning, reasonNodePortCoolingDown, "Not reconciling until the node ports can be reused: %v", cooldownErr)
+	return r.updateStatus(ctx, log, sts, statusUpdate{conds: []metav1.Condition{cond}})
+}
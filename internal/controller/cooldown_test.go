@@ -0,0 +1,180 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestNodePortCooldown(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	expired, err := json.Marshal(releasedNodePort{StatefulSet: "default/older", Until: metav1.NewTime(time.Now().Add(-time.Minute))})
+	require.NoError(t, err)
+	cmName := types.NamespacedName{Namespace: "psc-portmapper", Name: "released-node-ports"}
+	// The first write of the ConfigMap conflicts, as if another teardown had just updated it.
+	conflict := true
+	cmGets := 0
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: cmName.Namespace, Name: cmName.Name, Labels: map[string]string{managedByLabel: portmapperApp}},
+			Data:       map[string]string{"31000": string(expired)},
+		}).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+				if _, ok := obj.(*corev1.ConfigMap); ok && key == cmName {
+					cmGets++
+				}
+				return c.Get(ctx, key, obj, opts...)
+			},
+			Update: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.UpdateOption) error {
+				if _, ok := obj.(*corev1.ConfigMap); ok && conflict {
+					conflict = false
+					return apierrors.NewConflict(corev1.Resource("configmaps"), obj.GetName(), errors.New("modified"))
+				}
+				return c.Update(ctx, obj, opts...)
+			},
+		}).
+		Build()
+	settings := DefaultSettings()
+	settings.DriftCheckInterval = 0
+	settings.NodePortCooldown = time.Hour
+	settings.ReleasedNodePortsConfigMap = cmName.String()
+	r := New(c, gcpfake.New(s.project, s.region), WithSettings(settings))
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	// The ports applied aren't checked again.
+	cmGets = 0
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Zero(t, cmGets)
+
+	// Tearing the StatefulSet down releases its node ports, and drops the expired ones.
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	require.NoError(t, c.Delete(ctx, sts))
+	require.Eventually(t, func() bool {
+		_, _ = r.Reconcile(ctx, req)
+		return apierrors.IsNotFound(c.Get(ctx, req.NamespacedName, &appsv1.StatefulSet{}))
+	}, 5*time.Second, time.Millisecond)
+	require.False(t, conflict)
+	cm := &corev1.ConfigMap{}
+	require.NoError(t, c.Get(ctx, cmName, cm))
+	ports := specNodePorts(lastAppliedSpec(sts))
+	require.NotEmpty(t, ports)
+	require.Len(t, cm.Data, len(ports))
+	for _, p := range ports {
+		released := &releasedNodePort{}
+		require.NoError(t, json.Unmarshal([]byte(cm.Data[strconv.Itoa(int(p))]), released))
+		require.Equal(t, req.String(), released.StatefulSet)
+		require.WithinDuration(t, time.Now().Add(time.Hour), released.Until.Time, time.Minute)
+	}
+
+	// Another StatefulSet can't reuse them until the cool-down passes.
+	other := s.sts.DeepCopy()
+	other.Name, other.ResourceVersion, other.Finalizers = "other", "", nil
+	require.NoError(t, c.Create(ctx, other))
+	otherReq := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(other)}
+	res, err := r.Reconcile(ctx, otherReq)
+	require.NoError(t, err)
+	require.InDelta(t, time.Hour, res.RequeueAfter, float64(time.Minute))
+	require.NoError(t, c.Get(ctx, otherReq.NamespacedName, other))
+	require.False(t, controllerutil.ContainsFinalizer(other, finalizer))
+	ready := meta.FindStatusCondition(parseStatus(other).Conditions, readyCondition)
+	require.NotNil(t, ready)
+	require.Equal(t, reasonNodePortCoolingDown, ready.Reason)
+	require.Contains(t, ready.Message, "released by default/sts")
+
+	// The validation webhook rejects them too.
+	raw, err := json.Marshal(other)
+	require.NoError(t, err)
+	resp := r.ValidationHandler().Handle(ctx, admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Namespace: other.Namespace,
+		Name:      other.Name,
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}})
+	require.False(t, resp.Allowed)
+	require.Contains(t, resp.Result.Message, "reuses node ports released by another StatefulSet")
+
+	// The StatefulSet that released them can reuse them.
+	recreated := s.sts.DeepCopy()
+	recreated.ResourceVersion = ""
+	require.NoError(t, c.Create(ctx, recreated))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.NoError(t, c.Get(ctx, req.NamespacedName, recreated))
+	require.True(t, meta.IsStatusConditionTrue(parseStatus(recreated).Conditions, readyCondition))
+
+	// As can the others once the cool-down passes.
+	require.NoError(t, c.Get(ctx, cmName, cm))
+	for port := range cm.Data {
+		cm.Data[port] = string(expired)
+	}
+	require.NoError(t, c.Update(ctx, cm))
+	wait, err := r.checkNodePortCooldown(ctx, other, lastAppliedSpec(sts))
+	require.NoError(t, err)
+	require.Zero(t, wait)
+}
+
+func TestValidateReleasedNodePorts(t *testing.T) {
+	require.NoError(t, ValidateReleasedNodePorts(0, ""))
+	require.NoError(t, ValidateReleasedNodePorts(time.Hour, "psc-portmapper/released-node-ports"))
+	require.ErrorContains(t, ValidateReleasedNodePorts(time.Hour, ""), "must be <namespace>/<name>")
+}
+
+func TestReleaseNodePortsFailure(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	// The ConfigMap isn't the controller's, so the released node ports can't be recorded in it.
+	cmName := types.NamespacedName{Namespace: "psc-portmapper", Name: "released-node-ports"}
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts, &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: cmName.Namespace, Name: cmName.Name}}).
+		Build()
+	settings := DefaultSettings()
+	settings.NodePortCooldown = time.Hour
+	settings.ReleasedNodePortsConfigMap = cmName.String()
+	rec := record.NewFakeRecorder(100)
+	r := New(c, gcpfake.New(s.project, s.region), WithSettings(settings), WithEventRecorder(rec))
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	// The StatefulSet's deletion isn't blocked, and the failure is reported.
+	require.NoError(t, c.Delete(ctx, s.sts))
+	require.Eventually(t, func() bool {
+		_, _ = r.Reconcile(ctx, req)
+		return apierrors.IsNotFound(c.Get(ctx, req.NamespacedName, &appsv1.StatefulSet{}))
+	}, 5*time.Second, time.Millisecond)
+	close(rec.Events)
+	reported := false
+	for e := range rec.Events {
+		reported = reported || strings.HasPrefix(e, "Warning "+reasonNodePortReleaseFailed)
+	}
+	require.True(t, reported)
+}
@@ -0,0 +1,72 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// credentialsSecretAnnotation can be set on a Namespace to make every spec in it use the
+	// referenced Secret's credentials, unless the spec sets its own.
+	credentialsSecretAnnotation = "psc-portmapper.0x5d.org/credentials-secret"
+
+	// The Secret keys holding a service account key or an external account configuration, and
+	// a service account to impersonate. At least one must be set.
+	credentialsSecretKey = "credentials.json"
+	impersonateSecretKey = "impersonate_service_account"
+)
+
+// gcpClientFor returns the GCP client to reconcile the spec with, and the function to call once
+// it's done with it. That's the controller's client, unless the spec or its namespace reference
+// a credentials Secret.
+func (r *PortmapReconciler) gcpClientFor(ctx context.Context, log logr.Logger, namespace string, spec *Spec) (gcp.Client, func(), error) {
+	secretName, err := r.credentialsSecretName(ctx, namespace, spec)
+	if err != nil {
+		return nil, nil, err
+	}
+	if secretName == "" {
+		return r.gcp, func() {}, nil
+	}
+	if r.clients == nil {
+		return nil, nil, errors.New("credentials were set, but per-spec credentials aren't enabled in the controller")
+	}
+
+	secret := &corev1.Secret{}
+	err = r.reader.Get(ctx, types.NamespacedName{Namespace: namespace, Name: secretName}, secret)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get credentials secret %s/%s: %w", namespace, secretName, err)
+	}
+	creds := &gcp.Credentials{
+		ID:                        namespace + "/" + secretName,
+		Namespace:                 namespace,
+		JSON:                      secret.Data[credentialsSecretKey],
+		ImpersonateServiceAccount: string(secret.Data[impersonateSecretKey]),
+	}
+	if len(creds.JSON) == 0 && creds.ImpersonateServiceAccount == "" {
+		return nil, nil, fmt.Errorf("credentials secret %s/%s must set either %s or %s", namespace, secretName, credentialsSecretKey, impersonateSecretKey)
+	}
+	log.V(1).Info("Using credentials from secret.", "namespace", namespace, "name", secretName)
+	return r.clients.ClientFor(ctx, creds)
+}
+
+func (r *PortmapReconciler) credentialsSecretName(ctx context.Context, namespace string, spec *Spec) (string, error) {
+	if spec.Credentials != nil {
+		return spec.Credentials.SecretName, nil
+	}
+	ns := &corev1.Namespace{}
+	err := r.reader.Get(ctx, types.NamespacedName{Name: namespace}, ns)
+	if err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			return "", fmt.Errorf("failed to get namespace %s: %w", namespace, err)
+		}
+		return "", nil
+	}
+	return ns.Annotations[credentialsSecretAnnotation], nil
+}
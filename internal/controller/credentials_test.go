@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/0x5d/psc-portmapper/api"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/0x5d/psc-portmapper/internal/gcp/mock"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+type fakeProvider struct {
+	client gcp.Client
+	creds  *gcp.Credentials
+}
+
+func (p *fakeProvider) ClientFor(_ context.Context, creds *gcp.Credentials) (gcp.Client, func(), error) {
+	p.creds = creds
+	return p.client, func() {}, nil
+}
+
+func TestGCPClientFor(t *testing.T) {
+	namespace := "default"
+	secret := func(data map[string][]byte) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "creds"},
+			Data:       data,
+		}
+	}
+
+	tests := []struct {
+		name          string
+		objects       []client.Object
+		spec          *Spec
+		noProvider    bool
+		expectedCreds *gcp.Credentials
+		expectedErr   string
+	}{{
+		name: "Uses the controller's client if there are no credentials",
+		spec: &Spec{},
+	}, {
+		name:          "Uses the spec's secret",
+		objects:       []client.Object{secret(map[string][]byte{credentialsSecretKey: []byte("{}")})},
+		spec:          &Spec{Spec: api.Spec{Credentials: &CredentialsRef{SecretName: "creds"}}},
+		expectedCreds: &gcp.Credentials{ID: "default/creds", Namespace: "default", JSON: []byte("{}")},
+	}, {
+		name: "Uses the namespace's secret",
+		objects: []client.Object{
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:        namespace,
+				Annotations: map[string]string{credentialsSecretAnnotation: "creds"},
+			}},
+			secret(map[string][]byte{impersonateSecretKey: []byte("sa@my-project.iam.gserviceaccount.com")}),
+		},
+		spec:          &Spec{},
+		expectedCreds: &gcp.Credentials{ID: "default/creds", Namespace: "default", ImpersonateServiceAccount: "sa@my-project.iam.gserviceaccount.com"},
+	}, {
+		name:        "Fails if the secret doesn't exist",
+		spec:        &Spec{Spec: api.Spec{Credentials: &CredentialsRef{SecretName: "creds"}}},
+		expectedErr: `failed to get credentials secret default/creds: secrets "creds" not found`,
+	}, {
+		name:        "Fails if the secret is empty",
+		objects:     []client.Object{secret(nil)},
+		spec:        &Spec{Spec: api.Spec{Credentials: &CredentialsRef{SecretName: "creds"}}},
+		expectedErr: "credentials secret default/creds must set either credentials.json or impersonate_service_account",
+	}, {
+		name:        "Fails if per-spec credentials aren't enabled",
+		spec:        &Spec{Spec: api.Spec{Credentials: &CredentialsRef{SecretName: "creds"}}},
+		noProvider:  true,
+		expectedErr: "credentials were set, but per-spec credentials aren't enabled in the controller",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := fake.NewClientBuilder().WithObjects(tt.objects...).Build()
+			ctrl := gomock.NewController(t)
+			defaultClient := mock.NewMockClient(ctrl)
+			specClient := mock.NewMockClient(ctrl)
+			provider := &fakeProvider{client: specClient}
+
+			opts := []Option{}
+			if !tt.noProvider {
+				opts = append(opts, WithClientProvider(provider))
+			}
+			r := New(c, defaultClient, opts...)
+
+			gc, release, err := r.gcpClientFor(context.Background(), testr.New(t), namespace, tt.spec)
+			if tt.expectedErr != "" {
+				require.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			defer release()
+			if tt.expectedCreds == nil {
+				require.Same(t, defaultClient, gc)
+				return
+			}
+			require.Same(t, specClient, gc)
+			require.Equal(t, tt.expectedCreds, provider.creds)
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/0x5d/psc-portmapper/api"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// DefaultingPath is the path the defaulting webhook is served at.
+const DefaultingPath = "/mutate-apps-v1-statefulset-defaults"
+
+// DefaultingHandler returns the handler of the defaulting webhook, which fills in the defaults
+// of the specs of the StatefulSets the controller manages as they're applied, so that users can
+// write minimal specs: the prefix defaults to the StatefulSet's name, and the rest as per
+// api.Spec.Default. StatefulSets are always admitted, even if their spec can't be defaulted.
+func (r *PortmapReconciler) DefaultingHandler() admission.Handler {
+	return admission.HandlerFunc(r.handleDefaulting)
+}
+
+func (r *PortmapReconciler) handleDefaulting(ctx context.Context, req admission.Request) admission.Response {
+	sts := &appsv1.StatefulSet{}
+	err := json.Unmarshal(req.Object.Raw, sts)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if sts.Name == "" {
+		sts.Name = req.Name
+	}
+	var old *appsv1.StatefulSet
+	if len(req.OldObject.Raw) > 0 {
+		old = &appsv1.StatefulSet{}
+		err = json.Unmarshal(req.OldObject.Raw, old)
+		if err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+	}
+	log := log.FromContext(ctx).WithValues("namespace", req.Namespace, "name", sts.Name)
+	if !r.defaultSpec(log, sts, old) {
+		return admission.Allowed("")
+	}
+	mutated, err := json.Marshal(sts)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, mutated)
+}
+
+// defaultSpec fills in the defaults of the STS' spec, if it has one and the controller manages
+// it. old is the STS before the update, if it's being updated. It returns false if it didn't
+// change the spec.
+func (r *PortmapReconciler) defaultSpec(log logr.Logger, sts, old *appsv1.StatefulSet) bool {
+	jsonSpec, ok := sts.Annotations[annotation]
+	if !ok || !hasClass(sts, r.class) {
+		return false
+	}
+	spec := &api.Spec{}
+	err := json.Unmarshal([]byte(jsonSpec), spec)
+	if err != nil {
+		// The controller reports it once it reconciles the STS.
+		log.Info("Not defaulting a spec that can't be decoded.", "error", err.Error())
+		return false
+	}
+	changed := spec.Default()
+	if spec.Prefix == "" {
+		if prefix := defaultPrefix(sts, old); prefix != "" {
+			spec.Prefix = prefix
+			changed = true
+		}
+	}
+	if !changed {
+		return false
+	}
+	defaulted, err := json.Marshal(spec)
+	if err != nil {
+		log.Error(err, "Failed to encode the defaulted spec.")
+		return false
+	}
+	sts.Annotations[annotation] = string(defaulted)
+	log.Info("Defaulted the StatefulSet's spec.")
+	return true
+}
+
+// defaultPrefix returns the prefix of a spec that doesn't set one: the STS' name, followed by a
+// dash. Changing the prefix renames the spec's resources, so if the STS already had a spec, its
+// prefix is kept, even if it's empty. That's the last applied spec's if there is one, since
+// the resources were created with it, and the previous spec's otherwise.
+func defaultPrefix(sts, old *appsv1.StatefulSet) string {
+	if lastApplied := lastAppliedSpec(sts); lastApplied != nil {
+		return lastApplied.Prefix
+	}
+	if old != nil {
+		if jsonSpec, ok := old.Annotations[annotation]; ok {
+			var oldSpec api.Spec
+			if json.Unmarshal([]byte(jsonSpec), &oldSpec) != nil {
+				return ""
+			}
+			return oldSpec.Prefix
+		}
+	}
+	if sts.Name == "" {
+		return ""
+	}
+	return sts.Name + "-"
+}
@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestDefaultSpec(t *testing.T) {
+	minimal := `{"nat_subnet_fqns":["projects/p/regions/r/subnetworks/s"],"node_ports":{"app":{"node_port":30000,"container_port":8080}}}`
+	sts := func(annotations map[string]string) *appsv1.StatefulSet {
+		return &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "kafka", Annotations: annotations}}
+	}
+	tests := []struct {
+		name     string
+		sts      *appsv1.StatefulSet
+		old      *appsv1.StatefulSet
+		class    string
+		expected string
+	}{{
+		name:     "Defaults a new spec's prefix and starting ports",
+		sts:      sts(map[string]string{annotation: minimal}),
+		expected: `{"prefix":"kafka-","nat_subnet_fqns":["projects/p/regions/r/subnetworks/s"],"node_ports":{"app":{"node_port":30000,"container_port":8080,"starting_port":30000}}}`,
+	}, {
+		name:     "Keeps the previous spec's prefix",
+		sts:      sts(map[string]string{annotation: minimal}),
+		old:      sts(map[string]string{annotation: `{"prefix":"old-"}`}),
+		expected: `{"prefix":"old-","nat_subnet_fqns":["projects/p/regions/r/subnetworks/s"],"node_ports":{"app":{"node_port":30000,"container_port":8080,"starting_port":30000}}}`,
+	}, {
+		name:     "Keeps the last applied spec's empty prefix",
+		sts:      sts(map[string]string{annotation: minimal, lastAppliedAnnotation: `{"prefix":""}`}),
+		expected: `{"prefix":"","nat_subnet_fqns":["projects/p/regions/r/subnetworks/s"],"node_ports":{"app":{"node_port":30000,"container_port":8080,"starting_port":30000}}}`,
+	}, {
+		name:     "Sets the consumers' connection limits",
+		sts:      sts(map[string]string{annotation: `{"prefix":"p-","default_connection_limit":5,"consumer_accept_list":[{"project_id_or_num":"a"},{"project_id_or_num":"b","connection_limit":1}],"node_ports":{}}`}),
+		expected: `{"prefix":"p-","consumer_accept_list":[{"connection_limit":5,"project_id_or_num":"a"},{"connection_limit":1,"project_id_or_num":"b"}],"node_ports":{},"default_connection_limit":5}`,
+	}, {
+		name: "Doesn't change a complete spec",
+		sts:  sts(map[string]string{annotation: `{"prefix":"p-","node_ports":{"app":{"node_port":30000,"starting_port":40000}}}`}),
+	}, {
+		name:  "Ignores StatefulSets of another class",
+		sts:   sts(map[string]string{annotation: minimal}),
+		class: "other",
+	}, {
+		name: "Ignores specs that can't be decoded",
+		sts:  sts(map[string]string{annotation: "{"}),
+	}, {
+		name: "Ignores StatefulSets without a spec",
+		sts:  sts(map[string]string{}),
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := New(nil, nil, WithClass(tt.class))
+			before := tt.sts.Annotations[annotation]
+			changed := r.defaultSpec(testr.New(t), tt.sts, tt.old)
+			require.Equal(t, tt.expected != "", changed)
+			if !changed {
+				require.Equal(t, before, tt.sts.Annotations[annotation])
+				return
+			}
+			require.JSONEq(t, tt.expected, tt.sts.Annotations[annotation])
+
+			// The defaulted spec is complete.
+			require.False(t, r.defaultSpec(testr.New(t), tt.sts, tt.old))
+		})
+	}
+}
+
+func TestHandleDefaulting(t *testing.T) {
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "default",
+		Name:        "kafka",
+		Annotations: map[string]string{annotation: `{"node_ports":{}}`},
+	}}
+	raw, err := json.Marshal(sts)
+	require.NoError(t, err)
+	req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Namespace: sts.Namespace,
+		Name:      sts.Name,
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}}
+	resp := New(nil, nil).DefaultingHandler().Handle(context.Background(), req)
+	require.True(t, resp.Allowed)
+	require.Len(t, resp.Patches, 1)
+	require.Equal(t, "/metadata/annotations/psc-portmapper.0x5d.org~1spec", resp.Patches[0].Path)
+	require.JSONEq(t, `{"prefix":"kafka-","node_ports":{}}`, resp.Patches[0].Value.(string))
+}
@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const (
+	// DeletionGuardPath is the path the webhook guarding the NodePort services is served at.
+	DeletionGuardPath = "/validate-v1-service-deletion"
+
+	// allowDeletionAnnotation lets a NodePort service be deleted while its StatefulSet still
+	// uses it, e.g. to have the controller recreate it, if it's set to "true".
+	allowDeletionAnnotation = "psc-portmapper.0x5d.org/allow-deletion"
+)
+
+// DeletionGuardHandler returns the handler of the validating webhook rejecting the deletion of
+// the NodePort services the controller manages, since the NEG's endpoints point to their node
+// ports and the PSC data path breaks without them. They can be deleted along with their
+// StatefulSet, once it's not managed anymore, or if they have the
+// psc-portmapper.0x5d.org/allow-deletion=true annotation.
+func (r *PortmapReconciler) DeletionGuardHandler() admission.Handler {
+	return admission.HandlerFunc(r.handleDeletionGuard)
+}
+
+func (r *PortmapReconciler) handleDeletionGuard(ctx context.Context, req admission.Request) admission.Response {
+	// The object being deleted is only in OldObject.
+	svc := &corev1.Service{}
+	err := json.Unmarshal(req.OldObject.Raw, svc)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if !isManaged(svc) || svc.Annotations[allowDeletionAnnotation] == "true" {
+		return admission.Allowed("")
+	}
+	log := log.FromContext(ctx).WithValues("namespace", req.Namespace, "name", req.Name)
+	sts, err := r.nodePortServiceOwner(ctx, svc)
+	if err != nil {
+		log.Error(err, "Failed to find the NodePort service's StatefulSet.")
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if sts == nil || !sts.DeletionTimestamp.IsZero() {
+		return admission.Allowed("")
+	}
+	log.Info("Rejecting the deletion of a NodePort service in use.", "statefulSet", sts.Name)
+	return admission.Denied(fmt.Sprintf(
+		"the PSC endpoints of StatefulSet %s/%s point to the service's node ports. Delete the StatefulSet or remove its %s annotation instead, or set the %s=true annotation on the service to delete it anyway",
+		sts.Namespace, sts.Name, annotation, allowDeletionAnnotation))
+}
+
+// nodePortServiceOwner returns the StatefulSet the controller manages the NodePort service for,
+// i.e. the one whose last applied or current spec's prefix it's named after, or nil if there's
+// none.
+func (r *PortmapReconciler) nodePortServiceOwner(ctx context.Context, svc *corev1.Service) (*appsv1.StatefulSet, error) {
+	stss := &appsv1.StatefulSetList{}
+	err := r.List(ctx, stss, client.InNamespace(svc.Namespace))
+	if err != nil {
+		return nil, err
+	}
+	for i := range stss.Items {
+		sts := &stss.Items[i]
+		jsonSpec, ok := sts.Annotations[annotation]
+		if !ok || !hasClass(sts, r.class) {
+			continue
+		}
+		if applied := lastAppliedSpec(sts); applied != nil && nodeportName(applied.Prefix) == svc.Name {
+			return sts, nil
+		}
+		// It may not have been reconciled yet, or have an invalid spec. Only the prefix matters.
+		spec := &Spec{}
+		if json.Unmarshal([]byte(jsonSpec), spec) == nil && nodeportName(spec.Prefix) == svc.Name {
+			return sts, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestHandleDeletionGuard(t *testing.T) {
+	spec := `{"prefix":"kafka-"}`
+	svc := func(labels, annotations map[string]string) *corev1.Service {
+		return &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "kafka-psc-portmapper",
+			Labels:      labels,
+			Annotations: annotations,
+		}}
+	}
+	sts := func(annotations map[string]string, deleting bool) *appsv1.StatefulSet {
+		s := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "kafka", Annotations: annotations}}
+		if deleting {
+			s.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+			s.Finalizers = []string{finalizer}
+		}
+		return s
+	}
+	managed := map[string]string{managedByLabel: portmapperApp}
+
+	tests := []struct {
+		name        string
+		svc         *corev1.Service
+		sts         *appsv1.StatefulSet
+		expectedErr string
+	}{{
+		name:        "Rejects deleting the service of a StatefulSet with a spec",
+		svc:         svc(managed, nil),
+		sts:         sts(map[string]string{annotation: spec}, false),
+		expectedErr: "the PSC endpoints of StatefulSet default/kafka point to the service's node ports",
+	}, {
+		name:        "Finds the StatefulSet by its last applied spec",
+		svc:         svc(managed, nil),
+		sts:         sts(map[string]string{annotation: `{"prefix":"new-"}`, lastAppliedAnnotation: spec}, false),
+		expectedErr: "StatefulSet default/kafka",
+	}, {
+		name:        "Finds the StatefulSet by an invalid spec's prefix",
+		svc:         svc(managed, nil),
+		sts:         sts(map[string]string{annotation: `{"prefix":"kafka-","node_ports":{}}`}, false),
+		expectedErr: "StatefulSet default/kafka",
+	}, {
+		name: "Admits deleting the service of a StatefulSet being deleted",
+		svc:  svc(managed, nil),
+		sts:  sts(map[string]string{annotation: spec}, true),
+	}, {
+		name: "Admits deleting the service of a StatefulSet without a spec",
+		svc:  svc(managed, nil),
+		sts:  sts(nil, false),
+	}, {
+		name: "Admits deleting the service of a StatefulSet of another class",
+		svc:  svc(managed, nil),
+		sts:  sts(map[string]string{annotation: spec, classAnnotation: "other"}, false),
+	}, {
+		name: "Admits deleting the service of a StatefulSet with another prefix",
+		svc:  svc(managed, nil),
+		sts:  sts(map[string]string{annotation: `{"prefix":"other-"}`}, false),
+	}, {
+		name: "Admits deleting services with the override annotation",
+		svc:  svc(managed, map[string]string{allowDeletionAnnotation: "true"}),
+		sts:  sts(map[string]string{annotation: spec}, false),
+	}, {
+		name: "Admits deleting services the controller doesn't manage",
+		svc:  svc(nil, nil),
+		sts:  sts(map[string]string{annotation: spec}, false),
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := fake.NewClientBuilder().WithObjects(tt.sts).Build()
+			r := New(c, nil)
+			raw, err := json.Marshal(tt.svc)
+			require.NoError(t, err)
+			req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				Namespace: tt.svc.Namespace,
+				Name:      tt.svc.Name,
+				Operation: admissionv1.Delete,
+				OldObject: runtime.RawExtension{Raw: raw},
+			}}
+			resp := r.DeletionGuardHandler().Handle(context.Background(), req)
+			if tt.expectedErr != "" {
+				require.False(t, resp.Allowed)
+				require.Contains(t, resp.Result.Message, tt.expectedErr)
+				return
+			}
+			require.True(t, resp.Allowed, resp.Result)
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// The reasons of the events emitted while waiting for consumers to disconnect.
+	reasonDraining     = "Draining"
+	reasonDrainTimeout = "DrainTimeout"
+
+	// drainPollInterval is how often the service attachment's connections are checked while
+	// waiting for them to be closed.
+	drainPollInterval = 30 * time.Second
+)
+
+// waitForDrain returns how long to wait before deleting the spec's resources, so that the
+// consumers' accepted connections to the service attachment are closed first. It's 0 once
+// they are, or once Settings.DrainTimeout passed since the STS was deleted.
+func (r *PortmapReconciler) waitForDrain(ctx context.Context, log logr.Logger, gc gcp.ServiceAttachments, spec *Spec, sts *appsv1.StatefulSet) (time.Duration, error) {
+	timeout := r.currentSettings().DrainTimeout
+	if timeout <= 0 {
+		return 0, nil
+	}
+	svcAtt, err := gc.GetServiceAttachment(ctx, svcAttName(spec.Prefix))
+	if errors.Is(err, gcp.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		log.Error(err, "Failed to get the service attachment to check its connections.")
+		return 0, err
+	}
+	accepted := acceptedConnections(svcAtt)
+	if accepted == 0 {
+		return 0, nil
+	}
+	remaining := time.Until(sts.DeletionTimestamp.Add(timeout))
+	if remaining <= 0 {
+		log.Info("Timed out waiting for the consumers to disconnect. Deleting the resources anyway.", "connections", accepted)
+		r.event(sts, corev1.EventTypeWarning, reasonDrainTimeout, "%d consumer connections are still accepted after %s, deleting the resources anyway", accepted, timeout)
+		return 0, nil
+	}
+	log.Info("Waiting for the consumers to disconnect before deleting the resources.", "connections", accepted, "remaining", remaining)
+	r.event(sts, corev1.EventTypeNormal, reasonDraining, "Waiting for %d consumer connections to be closed before deleting the resources, for up to %s", accepted, remaining.Round(time.Second))
+	return min(drainPollInterval, remaining), nil
+}
+
+// acceptedConnections returns how many consumer endpoints are connected to the attachment.
+func acceptedConnections(svcAtt *computepb.ServiceAttachment) int {
+	accepted := 0
+	for _, ep := range svcAtt.GetConnectedEndpoints() {
+		if ep.GetStatus() == computepb.ServiceAttachmentConnectedEndpoint_ACCEPTED.String() {
+			accepted++
+		}
+	}
+	return accepted
+}
@@ -0,0 +1,66 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestWaitForDrain(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	rec := record.NewFakeRecorder(10)
+	settings := DefaultSettings()
+	settings.DrainTimeout = time.Hour
+	r := New(c, gcpClient, WithEventRecorder(rec), WithSettings(settings))
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	svcAtt := svcAttName("prefix-")
+
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	accepted := computepb.ServiceAttachmentConnectedEndpoint_ACCEPTED.String()
+	pending := computepb.ServiceAttachmentConnectedEndpoint_PENDING.String()
+	require.NoError(t, gcpClient.SetConnectedEndpoints(svcAtt, []*computepb.ServiceAttachmentConnectedEndpoint{
+		{Status: &accepted},
+		{Status: &pending},
+	}))
+
+	// The resources are kept while consumers are connected.
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	require.NoError(t, c.Delete(ctx, sts))
+	res, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, drainPollInterval, res.RequeueAfter)
+	_, err = gcpClient.GetServiceAttachment(ctx, svcAtt)
+	require.NoError(t, err)
+	require.Len(t, rec.Events, 1)
+	require.True(t, strings.HasPrefix(<-rec.Events, "Normal Draining Waiting for 1 consumer connections to be closed"))
+
+	// Until the timeout.
+	settings.DrainTimeout = time.Nanosecond
+	r.SetSettings(settings)
+	res, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Zero(t, res)
+	_, err = gcpClient.GetServiceAttachment(ctx, svcAtt)
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+	require.Len(t, rec.Events, 1)
+	require.Equal(t, "Warning DrainTimeout 1 consumer connections are still accepted after 1ns, deleting the resources anyway", <-rec.Events)
+}
@@ -0,0 +1,60 @@
+package controller
+
+import (
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// reasonFirewallDrift is the reason of the event emitted when a firewall was modified out of
+	// band.
+	reasonFirewallDrift = "FirewallDrift"
+	// reasonSelectorDrift is the reason of the event emitted when the NodePort service's selector
+	// doesn't match the STS' anymore.
+	reasonSelectorDrift = "SelectorDrift"
+)
+
+// reportFirewallDrift records how the STS' firewall was modified out of band, with a Warning
+// event and the firewallDrift metric, so that the change can be investigated, e.g. in the GCP
+// audit logs.
+func (r *PortmapReconciler) reportFirewallDrift(log logr.Logger, sts *appsv1.StatefulSet, name string, diff gcp.FirewallDiff) {
+	log.Info("The firewall was modified out of band. Reverting it.", "firewall", name, "changes", diff.String())
+	sName := types.NamespacedName{Namespace: sts.Namespace, Name: sts.Name}.String()
+	if len(diff.AddedPorts) > 0 {
+		firewallDrift.WithLabelValues(sName, "ports_added").Inc()
+	}
+	if len(diff.RemovedPorts) > 0 {
+		firewallDrift.WithLabelValues(sName, "ports_removed").Inc()
+	}
+	if diff.Protocols != nil {
+		firewallDrift.WithLabelValues(sName, "protocols_changed").Inc()
+	}
+	if diff.SourceRanges != nil || diff.SourceTags != nil {
+		firewallDrift.WithLabelValues(sName, "sources_changed").Inc()
+	}
+	if diff.DestinationRanges != nil {
+		firewallDrift.WithLabelValues(sName, "destinations_changed").Inc()
+	}
+	if diff.Priority != nil {
+		firewallDrift.WithLabelValues(sName, "priority_changed").Inc()
+	}
+	if diff.Disabled {
+		firewallDrift.WithLabelValues(sName, "disabled").Inc()
+	}
+	r.event(sts, corev1.EventTypeWarning, reasonFirewallDrift, "Firewall %s was modified out of band, reverting it: %s", name, diff)
+}
+
+// reportSelectorDrift reports that the NodePort service selects other pods than the STS, e.g.
+// because the STS was recreated with another selector, with a Warning event describing the
+// change. The service is then updated, and the STS is checked for drift right away, so that
+// the endpoints of the pods it doesn't select anymore are detached.
+func (r *PortmapReconciler) reportSelectorDrift(log logr.Logger, sts *appsv1.StatefulSet, service string, old map[string]string) {
+	oldSelector, selector := labels.SelectorFromSet(old).String(), labels.SelectorFromSet(sts.Spec.Selector.MatchLabels).String()
+	log.Info("The NodePort service's selector doesn't match the STS'. Updating it.", "service", service, "old", oldSelector, "new", selector)
+	r.driftSuspects.add(types.NamespacedName{Namespace: sts.Namespace, Name: sts.Name})
+	r.event(sts, corev1.EventTypeWarning, reasonSelectorDrift, "NodePort service %s selected %q instead of the StatefulSet's %q, updating it", service, oldSelector, selector)
+}
@@ -0,0 +1,98 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestReportFirewallDrift(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	rec := record.NewFakeRecorder(10)
+	settings := DefaultSettings()
+	// Check for drift on every reconcile.
+	settings.DriftCheckInterval = 0
+	r := New(c, gcpClient, WithEventRecorder(rec), WithSettings(settings))
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	fw := firewallName("prefix-")
+
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Empty(t, rec.Events)
+
+	// The firewall is modified out of band.
+	require.NoError(t, gcpClient.UpdateFirewall(ctx, fw, gcp.FirewallRule{Ports: map[int32]struct{}{22: {}}}))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Len(t, rec.Events, 1)
+	require.Equal(t, "Warning FirewallDrift Firewall prefix-psc-portmapper-firewall was modified out of band, reverting it: ports added: 22; ports removed: 30000", <-rec.Events)
+	require.Equal(t, 1.0, testutil.ToFloat64(firewallDrift.WithLabelValues(req.String(), "ports_added")))
+	require.Equal(t, 1.0, testutil.ToFloat64(firewallDrift.WithLabelValues(req.String(), "ports_removed")))
+
+	// It was reverted.
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Empty(t, rec.Events)
+}
+
+func TestReportSelectorDrift(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	rec := record.NewFakeRecorder(10)
+	r := New(c, gcpClient, WithEventRecorder(rec))
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	svcName := types.NamespacedName{Namespace: s.sts.Namespace, Name: nodeportName(s.spec.Prefix)}
+
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Empty(t, rec.Events)
+	eps, err := gcpClient.ListEndpoints(ctx, negName(s.spec.Prefix))
+	require.NoError(t, err)
+	require.Len(t, eps, 3)
+
+	// The STS is recreated with a selector that only matches its first two pods.
+	selector := map[string]string{"app": "my-app", "track": "new"}
+	for _, name := range []string{"sts-0", "sts-1"} {
+		pod := &corev1.Pod{}
+		require.NoError(t, c.Get(ctx, types.NamespacedName{Namespace: s.sts.Namespace, Name: name}, pod))
+		pod.Labels = selector
+		require.NoError(t, c.Update(ctx, pod))
+	}
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	sts.Spec.Selector.MatchLabels = selector
+	require.NoError(t, c.Update(ctx, sts))
+
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, `Warning SelectorDrift NodePort service prefix-psc-portmapper selected "app=my-app" instead of the StatefulSet's "app=my-app,track=new", updating it`, <-rec.Events)
+	svc := &corev1.Service{}
+	require.NoError(t, c.Get(ctx, svcName, svc))
+	require.Equal(t, selector, svc.Spec.Selector)
+	eps, err = gcpClient.ListEndpoints(ctx, negName(s.spec.Prefix))
+	require.NoError(t, err)
+	require.Len(t, eps, 2)
+	require.ElementsMatch(t, []int32{30000, 30001}, []int32{eps[0].Port, eps[1].Port})
+}
@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"context"
+	"errors"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/go-logr/logr"
+)
+
+// action is what ensuring a resource takes, given its current state.
+type action int
+
+const (
+	actionNone action = iota
+	actionCreate
+	actionUpdate
+)
+
+func (a action) String() string {
+	switch a {
+	case actionCreate:
+		return "create"
+	case actionUpdate:
+		return "update"
+	default:
+		return "none"
+	}
+}
+
+// decide returns what ensuring a resource takes, given the result of getting it. needsUpdate
+// is only called if the resource exists, and can be nil if it's never updated.
+func decide[T any](current T, getErr error, needsUpdate func(T) bool) (action, error) {
+	switch {
+	case getErr == nil:
+		if needsUpdate != nil && needsUpdate(current) {
+			return actionUpdate, nil
+		}
+		return actionNone, nil
+	case errors.Is(getErr, gcp.ErrNotFound):
+		return actionCreate, nil
+	default:
+		return actionNone, getErr
+	}
+}
+
+// ensurer creates a resource if it doesn't exist, and updates it if it differs from the spec.
+// It's shared by the sub-reconcilers of resources managed with get, create and update calls.
+// Existing resources the controller didn't create are left alone, see ownership.
+type ensurer[T described] struct {
+	// kind identifies the resource in logs, e.g. "firewall".
+	kind string
+	name string
+	own  ownership
+	get  func(ctx context.Context) (T, error)
+	// needsUpdate returns true if the existing resource differs from the spec. It's nil for
+	// resources that are never updated.
+	needsUpdate func(T) bool
+	create      func(ctx context.Context) error
+	update      func(ctx context.Context) error
+}
+
+// ensure gets the resource, and creates or updates it if needed. It returns the action taken.
+func (e *ensurer[T]) ensure(ctx context.Context, log logr.Logger) (action, error) {
+	current, err := e.get(ctx)
+	if err == nil {
+		err = e.own.check(e.kind, e.name, current)
+		if err != nil {
+			log.Error(err, "Refusing to manage the "+e.kind+", since the controller didn't create it.", "name", e.name)
+			return actionNone, err
+		}
+	}
+	a, err := decide(current, err, e.needsUpdate)
+	if err != nil {
+		log.Error(err, "Got an unexpected error trying to get the "+e.kind+".", "name", e.name)
+		return a, err
+	}
+	switch a {
+	case actionCreate:
+		err = e.create(ctx)
+	case actionUpdate:
+		err = e.update(ctx)
+	}
+	if err != nil {
+		log.Error(err, "Failed to "+a.String()+" the "+e.kind+".", "name", e.name)
+	}
+	return a, err
+}
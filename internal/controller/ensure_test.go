@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/require"
+	"k8s.io/utils/ptr"
+)
+
+func TestEnsure(t *testing.T) {
+	boom := errors.New("boom")
+	upToDate := func(*computepb.Firewall) bool { return false }
+	outdated := func(*computepb.Firewall) bool { return true }
+
+	tests := []struct {
+		name string
+		// description is the existing resource's, gcp.ManagedDescription if it's nil.
+		description    *string
+		own            ownership
+		getErr         error
+		needsUpdate    func(*computepb.Firewall) bool
+		createErr      error
+		updateErr      error
+		expectedAction action
+		expectedCalls  []string
+		expectedErr    error
+	}{{
+		name:           "Does nothing if the resource is up to date",
+		needsUpdate:    upToDate,
+		expectedAction: actionNone,
+	}, {
+		name:           "Does nothing if the resource exists and is never updated",
+		expectedAction: actionNone,
+	}, {
+		name:           "Updates the resource if it's outdated",
+		needsUpdate:    outdated,
+		expectedAction: actionUpdate,
+		expectedCalls:  []string{"update"},
+	}, {
+		name:           "Creates the resource if it doesn't exist",
+		getErr:         gcp.ErrNotFound,
+		needsUpdate:    outdated,
+		expectedAction: actionCreate,
+		expectedCalls:  []string{"create"},
+	}, {
+		name:           "Fails if getting the resource fails",
+		getErr:         boom,
+		needsUpdate:    outdated,
+		expectedAction: actionNone,
+		expectedErr:    boom,
+	}, {
+		name:           "Fails if creating the resource fails",
+		getErr:         gcp.ErrNotFound,
+		createErr:      boom,
+		expectedAction: actionCreate,
+		expectedCalls:  []string{"create"},
+		expectedErr:    boom,
+	}, {
+		name:           "Fails if updating the resource fails",
+		needsUpdate:    outdated,
+		updateErr:      boom,
+		expectedAction: actionUpdate,
+		expectedCalls:  []string{"update"},
+		expectedErr:    boom,
+	}, {
+		name:           "Refuses to manage a resource the controller didn't create",
+		description:    ptr.To("My firewall."),
+		needsUpdate:    outdated,
+		expectedAction: actionNone,
+		expectedErr:    errNotOwned,
+	}, {
+		name:           "Refuses to manage an unmarked resource",
+		description:    ptr.To(""),
+		needsUpdate:    outdated,
+		expectedAction: actionNone,
+		expectedErr:    errNotOwned,
+	}, {
+		name:           "Manages unmarked resources if they're trusted",
+		description:    ptr.To(""),
+		own:            ownership{trustUnmarked: true},
+		needsUpdate:    outdated,
+		expectedAction: actionUpdate,
+		expectedCalls:  []string{"update"},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []string
+			description := ptr.Deref(tt.description, gcp.ManagedDescription)
+			e := &ensurer[*computepb.Firewall]{
+				kind: "resource",
+				name: "name",
+				own:  tt.own,
+				get: func(context.Context) (*computepb.Firewall, error) {
+					return &computepb.Firewall{Description: ptr.To(description)}, tt.getErr
+				},
+				needsUpdate: tt.needsUpdate,
+				create: func(context.Context) error {
+					calls = append(calls, "create")
+					return tt.createErr
+				},
+				update: func(context.Context) error {
+					calls = append(calls, "update")
+					return tt.updateErr
+				},
+			}
+			a, err := e.ensure(context.Background(), testr.New(t))
+			require.ErrorIs(t, err, tt.expectedErr)
+			if tt.expectedErr == nil {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.expectedAction, a)
+			require.Equal(t, tt.expectedCalls, calls)
+		})
+	}
+}
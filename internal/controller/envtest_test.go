@@ -0,0 +1,216 @@
+package controller
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/0x5d/psc-portmapper/internal/gcp/gcpsim"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/config"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+)
+
+const (
+	envtestTimeout  = 30 * time.Second
+	envtestInterval = 100 * time.Millisecond
+)
+
+// envtestState is a running API server with the reconciler running against it, backed by
+// the real GCP client talking to a simulated Compute Engine API.
+type envtestState struct {
+	client.Client
+	sim       *gcpsim.Server
+	namespace string
+}
+
+// startEnvtest starts an API server (see https://book.kubebuilder.io/reference/envtest) and
+// a manager running the reconciler. It skips the test if the envtest binaries aren't
+// available, see the readme.
+func startEnvtest(t *testing.T) *envtestState {
+	t.Helper()
+	if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+		t.Skip("KUBEBUILDER_ASSETS isn't set, skipping envtest-based test")
+	}
+	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+
+	env := &envtest.Environment{}
+	cfg, err := env.Start()
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, env.Stop()) })
+
+	project, region := "my-project", "us-east1"
+	sim := gcpsim.New(project, region)
+	// Make the client poll the operations, like it has to with the real API.
+	sim.SetOperationPolls(1)
+	srv := httptest.NewServer(sim)
+	t.Cleanup(srv.Close)
+	gc, err := gcp.NewClient(context.Background(), gcp.ClientConfig{
+		Project:    project,
+		Region:     region,
+		Network:    "my-network",
+		Subnetwork: "my-subnet",
+	}, gcpsim.ClientOptions(srv.URL)...)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = gc.Close() })
+
+	mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+		Scheme:                 scheme.Scheme,
+		Metrics:                metricsserver.Options{BindAddress: "0"},
+		HealthProbeBindAddress: "0",
+		Controller:             config.Controller{SkipNameValidation: ptr.To(true)},
+	})
+	require.NoError(t, err)
+	r := New(mgr.GetClient(), gc, WithAPIReader(mgr.GetAPIReader()), WithEventRecorder(mgr.GetEventRecorderFor("psc-portmapper")))
+	require.NoError(t, r.SetupWithManager(mgr))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- mgr.Start(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+
+	c, err := client.New(cfg, client.Options{Scheme: scheme.Scheme})
+	require.NoError(t, err)
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "psc-portmapper-"}}
+	require.NoError(t, c.Create(ctx, ns))
+	// There's no controller manager to create the default service account, which pods need.
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: ns.Name, Name: "default"}}
+	require.NoError(t, c.Create(ctx, sa))
+
+	return &envtestState{Client: c, sim: sim, namespace: ns.Name}
+}
+
+// create creates the nodes, pods and STS in s, in the test's namespace. Pods are never
+// scheduled for real, because there's no kubelet, but they're bound to the nodes.
+func (e *envtestState) create(t *testing.T, s *state) {
+	t.Helper()
+	ctx := context.Background()
+	for i := range s.nodes.Items {
+		require.NoError(t, e.Create(ctx, &s.nodes.Items[i]))
+	}
+	for i := range s.pods.Items {
+		s.pods.Items[i].Namespace = e.namespace
+		require.NoError(t, e.Create(ctx, &s.pods.Items[i]))
+	}
+	s.sts.Namespace = e.namespace
+	s.sts.Spec.Template = corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: s.sts.Spec.Selector.MatchLabels},
+		Spec:       corev1.PodSpec{Containers: s.pods.Items[0].Spec.Containers},
+	}
+	require.NoError(t, e.Create(ctx, s.sts))
+}
+
+func (e *envtestState) requireEventually(t *testing.T, condition func() bool, msg string) {
+	t.Helper()
+	require.Eventually(t, condition, envtestTimeout, envtestInterval, msg)
+}
+
+func TestEnvtestLifecycle(t *testing.T) {
+	e := startEnvtest(t)
+	ctx := context.Background()
+	s := initialState()
+	p := s.spec.Prefix
+	e.create(t, s)
+	key := client.ObjectKeyFromObject(s.sts)
+
+	// The finalizer is added and all the resources are created.
+	e.requireEventually(t, func() bool {
+		_, err := e.sim.GetServiceAttachment(ctx, svcAttName(p))
+		return err == nil
+	}, "expected the service attachment to be created")
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, e.Get(ctx, key, sts))
+	require.True(t, controllerutil.ContainsFinalizer(sts, finalizer))
+	eps, err := e.sim.ListEndpoints(ctx, negName(p))
+	require.NoError(t, err)
+	require.ElementsMatch(t, s.portMappings(), eps)
+
+	// The NodePort service is created and labeled as managed by the controller.
+	svc := &corev1.Service{}
+	require.NoError(t, e.Get(ctx, client.ObjectKey{Namespace: e.namespace, Name: nodeportName(p)}, svc))
+	require.Equal(t, corev1.ServiceTypeNodePort, svc.Spec.Type)
+	require.Equal(t, portmapperApp, svc.Labels[managedByLabel])
+	require.Equal(t, s.sts.Spec.Selector.MatchLabels, svc.Spec.Selector)
+
+	// Deleting the STS deletes the resources and the service, and then the STS is gone
+	// once the finalizer is removed.
+	require.NoError(t, e.Delete(ctx, sts))
+	e.requireEventually(t, func() bool {
+		return apierrors.IsNotFound(e.Get(ctx, key, &appsv1.StatefulSet{}))
+	}, "expected the STS to be deleted")
+	for _, get := range []func() error{
+		func() error { _, err := e.sim.GetServiceAttachment(ctx, svcAttName(p)); return err },
+		func() error { _, err := e.sim.GetForwardingRule(ctx, fwdRuleName(p)); return err },
+		func() error { _, err := e.sim.GetBackendService(ctx, backendName(p)); return err },
+		func() error { _, err := e.sim.GetNEG(ctx, negName(p)); return err },
+		func() error { _, err := e.sim.GetFirewall(ctx, firewallName(p)); return err },
+	} {
+		require.ErrorIs(t, get(), gcp.ErrNotFound)
+	}
+	e.requireEventually(t, func() bool {
+		return apierrors.IsNotFound(e.Get(ctx, client.ObjectKeyFromObject(svc), &corev1.Service{}))
+	}, "expected the NodePort service to be deleted")
+}
+
+func TestEnvtestPendingNode(t *testing.T) {
+	e := startEnvtest(t)
+	ctx := context.Background()
+	s := initialState()
+	// The first pod's node just registered, so its provider ID isn't set yet.
+	pending := &s.nodes.Items[0]
+	providerID := pending.Spec.ProviderID
+	pending.Spec.ProviderID = ""
+	e.create(t, s)
+	p := s.spec.Prefix
+
+	// The other pods are mapped, and the pending one is reported with an event.
+	mappings := s.portMappings()
+	e.requireEventually(t, func() bool {
+		eps, err := e.sim.ListEndpoints(ctx, negName(p))
+		return err == nil && len(eps) == len(mappings)-1
+	}, "expected the pods on the other nodes to be mapped")
+	eps, err := e.sim.ListEndpoints(ctx, negName(p))
+	require.NoError(t, err)
+	require.ElementsMatch(t, mappings[1:], eps)
+	e.requireEventually(t, func() bool {
+		events := &corev1.EventList{}
+		if e.List(ctx, events, client.InNamespace(e.namespace)) != nil {
+			return false
+		}
+		for _, ev := range events.Items {
+			if ev.Reason == reasonNodePending && ev.InvolvedObject.Name == s.sts.Name {
+				return true
+			}
+		}
+		return false
+	}, "expected a NodePending event")
+
+	// Its pod is mapped once the provider ID is set.
+	require.NoError(t, e.Get(ctx, client.ObjectKeyFromObject(pending), pending))
+	pending.Spec.ProviderID = providerID
+	require.NoError(t, e.Update(ctx, pending))
+	e.requireEventually(t, func() bool {
+		eps, err := e.sim.ListEndpoints(ctx, negName(p))
+		return err == nil && len(eps) == len(mappings)
+	}, "expected the pod on the node to be mapped once its provider ID was set")
+	eps, err = e.sim.ListEndpoints(ctx, negName(p))
+	require.NoError(t, err)
+	require.ElementsMatch(t, mappings, eps)
+}
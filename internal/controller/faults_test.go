@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// maxReconciles bounds how many times a request is reconciled before giving up on it
+// converging. It's high enough that it's vanishingly unlikely to be hit with the rates below.
+const maxReconciles = 100
+
+func TestReconcileConvergesDespiteFaults(t *testing.T) {
+	faults := gcpfake.Faults{
+		ErrorRate:         0.2,
+		LostResponseRate:  0.2,
+		PartialAttachRate: 0.5,
+		MaxLatency:        time.Millisecond,
+	}
+	for seed := uint64(0); seed < 10; seed++ {
+		t.Run(fmt.Sprintf("seed %d", seed), func(t *testing.T) {
+			ctx := context.Background()
+			p := "prefix-"
+			s := initialState()
+			c := fake.NewClientBuilder().
+				WithLists(s.nodes, s.pods).
+				WithObjects(s.sts).
+				Build()
+			state := gcpfake.New(s.project, s.region)
+			faults.Seed = seed
+			gcpClient := gcpfake.NewFaulty(state, faults)
+			r := New(c, gcpClient)
+			req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+
+			reconcileUntilConverged(t, r, req)
+			eps, err := state.ListEndpoints(ctx, negName(p))
+			require.NoError(t, err)
+			require.ElementsMatch(t, s.portMappings(), eps)
+			_, err = state.GetServiceAttachment(ctx, svcAttName(p))
+			require.NoError(t, err)
+
+			// Once converged, reconciling without faults is a no-op.
+			gcpClient.SetFaults(gcpfake.Faults{})
+			_, err = r.Reconcile(ctx, req)
+			require.NoError(t, err)
+			gcpClient.SetFaults(faults)
+
+			// Detaches the endpoints of removed pods.
+			removed := s.pods.Items[len(s.pods.Items)-1]
+			require.NoError(t, c.Delete(ctx, &removed))
+			s.pods.Items = s.pods.Items[:len(s.pods.Items)-1]
+			reconcileUntilConverged(t, r, req)
+			eps, err = state.ListEndpoints(ctx, negName(p))
+			require.NoError(t, err)
+			require.ElementsMatch(t, s.portMappings(), eps)
+
+			// Deletes everything.
+			sts := &appsv1.StatefulSet{}
+			require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+			require.NoError(t, c.Delete(ctx, sts))
+			reconcileUntilConverged(t, r, req)
+			_, err = state.GetNEG(ctx, negName(p))
+			require.ErrorIs(t, err, gcp.ErrNotFound)
+			_, err = state.GetFirewall(ctx, firewallName(p))
+			require.ErrorIs(t, err, gcp.ErrNotFound)
+			err = c.Get(ctx, req.NamespacedName, sts)
+			require.True(t, apierrors.IsNotFound(err), "expected the STS to be gone once its finalizer was removed")
+		})
+	}
+}
+
+// reconcileUntilConverged reconciles req until it succeeds, like the controller does when
+// reconciling returns an error.
+func reconcileUntilConverged(t *testing.T, r *PortmapReconciler, req reconcile.Request) {
+	t.Helper()
+	var err error
+	for i := 0; i < maxReconciles; i++ {
+		_, err = r.Reconcile(context.Background(), req)
+		if err == nil {
+			return
+		}
+	}
+	require.NoError(t, err, "didn't converge after %d reconciles", maxReconciles)
+}
@@ -0,0 +1,159 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/0x5d/psc-portmapper/api"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+)
+
+// FirewallOnDelete decides what happens to the firewall rule when the STS or its spec is
+// deleted.
+type FirewallOnDelete = api.FirewallOnDelete
+
+const (
+	FirewallDelete  = api.FirewallDelete
+	FirewallDisable = api.FirewallDisable
+)
+
+// enabledFirewallExists returns true if the firewall exists and isn't disabled, which is what
+// deleting it means if it's disabled on delete.
+func enabledFirewallExists(ctx context.Context, gc gcp.Firewalls, name string) (bool, error) {
+	fw, err := gc.GetFirewall(ctx, name)
+	if errors.Is(err, gcp.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !fw.GetDisabled(), nil
+}
+
+func newFirewallReconciler(gc firewallClient, spec, lastApplied *Spec, own ownership, ports map[int32]struct{}, h hooks) *firewallReconciler {
+	f := &firewallReconciler{
+		condition: condition{condType: "FirewallReady"},
+		gc:        gc,
+		own:       own,
+		rules:     firewallRules(spec, ports),
+		obsolete:  obsoleteFirewalls(spec, lastApplied),
+		onDelete:  spec.FirewallOnDelete,
+		onDrift:   h.firewallDrift,
+	}
+	if spec.AllowICMP {
+		f.icmp = &icmpFirewall{
+			name: icmpFirewallName(spec.Prefix),
+			rule: gcp.FirewallRule{
+				ICMP:              true,
+				DestinationRanges: spec.DestinationRanges,
+				Priority:          spec.FirewallPriority,
+			},
+			natSubnets: natSubnetFQNs(spec),
+		}
+	}
+	return f
+}
+
+// firewallClient is what the firewall sub-reconciler needs from the GCP client. It reads the
+// NAT subnets' ranges for the ICMP rule.
+type firewallClient interface {
+	gcp.Firewalls
+	gcp.Subnetworks
+}
+
+// icmpFirewall is the rule allowing ICMP from the NAT subnets, so that consumers can ping or
+// traceroute the path to the producer while troubleshooting. The consumers' traffic reaches
+// the producer from the NAT subnets' addresses, so its sources are their ranges, which are
+// only known once they're read from GCP.
+type icmpFirewall struct {
+	name string
+	// rule is the rule without its sources.
+	rule       gcp.FirewallRule
+	natSubnets []string
+}
+
+func icmpFirewallName(prefix string) string {
+	return firewallName(prefix) + "-icmp"
+}
+
+// natSubnetFQNs returns all of the NAT subnets the spec's service attachments use, including
+// the draining ones and the migration's.
+func natSubnetFQNs(spec *Spec) []string {
+	fqns := slices.Concat(spec.NatSubnetFQNs, spec.DrainingNatSubnetFQNs)
+	if spec.Migration != nil {
+		fqns = append(fqns, spec.Migration.NatSubnetFQNs...)
+	}
+	slices.Sort(fqns)
+	return slices.Compact(fqns)
+}
+
+// natSubnetRanges returns the primary ranges of the subnets, sorted.
+func natSubnetRanges(ctx context.Context, gc gcp.Subnetworks, fqns []string) ([]string, error) {
+	ranges := make([]string, 0, len(fqns))
+	for _, fqn := range fqns {
+		subnet, err := gc.GetSubnetwork(ctx, fqn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get NAT subnet %s: %w", fqn, err)
+		}
+		ranges = append(ranges, subnet.GetIpCidrRange())
+	}
+	slices.Sort(ranges)
+	return slices.Compact(ranges), nil
+}
+
+// firewallRules returns the spec's firewall rules, by name: one allowing all of the ports, or
+// one per port if the spec sets firewall_per_port. The ports' sources and priority override
+// the spec's.
+func firewallRules(spec *Spec, ports map[int32]struct{}) map[string]gcp.FirewallRule {
+	rule := gcp.FirewallRule{
+		Ports:             ports,
+		SourceRanges:      spec.SourceRanges,
+		SourceTags:        spec.SourceTags,
+		DestinationRanges: spec.DestinationRanges,
+		Priority:          spec.FirewallPriority,
+	}
+	if !spec.FirewallPerPort {
+		return map[string]gcp.FirewallRule{firewallName(spec.Prefix): rule}
+	}
+	rules := make(map[string]gcp.FirewallRule, len(spec.NodePorts))
+	for name, p := range spec.NodePorts {
+		r := rule
+		r.Ports = map[int32]struct{}{p.NodePort: {}}
+		if len(p.SourceRanges) > 0 || len(p.SourceTags) > 0 {
+			r.SourceRanges, r.SourceTags = p.SourceRanges, p.SourceTags
+		}
+		if p.FirewallPriority != nil {
+			r.Priority = p.FirewallPriority
+		}
+		rules[portFirewallName(spec.Prefix, name)] = r
+	}
+	return rules
+}
+
+// obsoleteFirewalls returns the names of the rules created for lastApplied that spec doesn't
+// have anymore, i.e. the single rule once firewall_per_port is set, the ports' rules once it's
+// unset, the rules of the ports removed from the spec, and the ICMP rule once allow_icmp is
+// unset. The single rule is assumed to exist
+// if there's no last applied spec, e.g. if the previous reconcile failed.
+func obsoleteFirewalls(spec, lastApplied *Spec) []string {
+	var obsolete []string
+	if !spec.AllowICMP && lastApplied != nil && lastApplied.AllowICMP {
+		obsolete = append(obsolete, icmpFirewallName(spec.Prefix))
+	}
+	lastPerPort := lastApplied != nil && lastApplied.FirewallPerPort
+	if spec.FirewallPerPort && !lastPerPort {
+		return append(obsolete, firewallName(spec.Prefix))
+	}
+	if !lastPerPort {
+		return obsolete
+	}
+	for _, name := range slices.Sorted(maps.Keys(lastApplied.NodePorts)) {
+		if _, ok := spec.NodePorts[name]; !spec.FirewallPerPort || !ok {
+			obsolete = append(obsolete, portFirewallName(spec.Prefix, name))
+		}
+	}
+	return obsolete
+}
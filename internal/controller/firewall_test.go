@@ -0,0 +1,310 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/0x5d/psc-portmapper/api"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestFirewallOnDelete(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	s.spec.FirewallOnDelete = FirewallDisable
+	specStr, err := json.Marshal(s.spec)
+	require.NoError(t, err)
+	s.sts.Annotations[annotation] = string(specStr)
+	initial := s.sts.DeepCopy()
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	r := New(c, gcpClient)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	name := firewallName(s.spec.Prefix)
+
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	fw, err := gcpClient.GetFirewall(ctx, name)
+	require.NoError(t, err)
+	require.False(t, fw.GetDisabled())
+
+	// The firewall is disabled instead of deleted, and the finalizer is removed anyway.
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	require.NoError(t, c.Delete(ctx, sts))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.True(t, apierrors.IsNotFound(c.Get(ctx, req.NamespacedName, sts)))
+	fw, err = gcpClient.GetFirewall(ctx, name)
+	require.NoError(t, err)
+	require.True(t, fw.GetDisabled())
+	require.Equal(t, []string{"30000"}, fw.Allowed[0].Ports)
+	_, err = gcpClient.GetNEG(ctx, negName(s.spec.Prefix))
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+
+	// It's enabled again once the STS is recreated.
+	initial.ResourceVersion = ""
+	require.NoError(t, c.Create(ctx, initial))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	fw, err = gcpClient.GetFirewall(ctx, name)
+	require.NoError(t, err)
+	require.False(t, fw.GetDisabled())
+}
+
+func TestFirewallSources(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	s.spec.SourceRanges = []string{"10.0.0.0/8"}
+	s.spec.DestinationRanges = []string{"10.1.0.0/16"}
+	specStr, err := json.Marshal(s.spec)
+	require.NoError(t, err)
+	s.sts.Annotations[annotation] = string(specStr)
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	r := New(c, gcpClient)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	name := firewallName(s.spec.Prefix)
+
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	fw, err := gcpClient.GetFirewall(ctx, name)
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.0/8"}, fw.SourceRanges)
+	require.Empty(t, fw.SourceTags)
+	require.Equal(t, []string{"10.1.0.0/16"}, fw.DestinationRanges)
+
+	// The ranges are replaced, rather than merged.
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	s.spec.SourceRanges = nil
+	s.spec.SourceTags = []string{"bastion"}
+	s.spec.DestinationRanges = nil
+	specStr, err = json.Marshal(s.spec)
+	require.NoError(t, err)
+	sts.Annotations[annotation] = string(specStr)
+	require.NoError(t, c.Update(ctx, sts))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	fw, err = gcpClient.GetFirewall(ctx, name)
+	require.NoError(t, err)
+	require.Empty(t, fw.SourceRanges)
+	require.Equal(t, []string{"bastion"}, fw.SourceTags)
+	require.Empty(t, fw.DestinationRanges)
+}
+
+func TestFirewallRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     *Spec
+		expected map[string]gcp.FirewallRule
+	}{{
+		name: "Allows all the ports with a single rule",
+		spec: &Spec{Spec: api.Spec{
+			Prefix:       "p-",
+			SourceRanges: []string{"10.0.0.0/8"},
+			NodePorts:    map[string]PortConfig{"app": {NodePort: 30000}, "admin": {NodePort: 30001}},
+		}},
+		expected: map[string]gcp.FirewallRule{
+			"p-psc-portmapper-firewall": {Ports: map[int32]struct{}{30000: {}, 30001: {}}, SourceRanges: []string{"10.0.0.0/8"}},
+		},
+	}, {
+		name: "Allows each port with its own rule, overriding the spec's sources and priority",
+		spec: &Spec{Spec: api.Spec{
+			Prefix:            "p-",
+			FirewallPerPort:   true,
+			SourceRanges:      []string{"10.0.0.0/8"},
+			DestinationRanges: []string{"10.1.0.0/16"},
+			FirewallPriority:  ptr.To(int32(900)),
+			NodePorts: map[string]PortConfig{
+				"app":   {NodePort: 30000},
+				"admin": {NodePort: 30001, SourceTags: []string{"bastion"}, FirewallPriority: ptr.To(int32(100))},
+			},
+		}},
+		expected: map[string]gcp.FirewallRule{
+			"p-psc-portmapper-app-firewall": {
+				Ports:             map[int32]struct{}{30000: {}},
+				SourceRanges:      []string{"10.0.0.0/8"},
+				DestinationRanges: []string{"10.1.0.0/16"},
+				Priority:          ptr.To(int32(900)),
+			},
+			"p-psc-portmapper-admin-firewall": {
+				Ports:             map[int32]struct{}{30001: {}},
+				SourceTags:        []string{"bastion"},
+				DestinationRanges: []string{"10.1.0.0/16"},
+				Priority:          ptr.To(int32(100)),
+			},
+		},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ports := map[int32]struct{}{}
+			for _, p := range tt.spec.NodePorts {
+				ports[p.NodePort] = struct{}{}
+			}
+			require.Equal(t, tt.expected, firewallRules(tt.spec, ports))
+		})
+	}
+}
+
+func TestObsoleteFirewalls(t *testing.T) {
+	ports := map[string]PortConfig{"app": {NodePort: 30000}, "admin": {NodePort: 30001}}
+	tests := []struct {
+		name        string
+		spec        *Spec
+		lastApplied *Spec
+		expected    []string
+	}{{
+		name:        "Nothing is obsolete with a single rule",
+		spec:        &Spec{Spec: api.Spec{Prefix: "p-", NodePorts: ports}},
+		lastApplied: &Spec{Spec: api.Spec{Prefix: "p-", NodePorts: ports}},
+	}, {
+		name:     "The single rule is obsolete once there's a rule per port",
+		spec:     &Spec{Spec: api.Spec{Prefix: "p-", NodePorts: ports, FirewallPerPort: true}},
+		expected: []string{"p-psc-portmapper-firewall"},
+	}, {
+		name:        "The rules of the removed ports are obsolete",
+		spec:        &Spec{Spec: api.Spec{Prefix: "p-", NodePorts: map[string]PortConfig{"app": {NodePort: 30000}}, FirewallPerPort: true}},
+		lastApplied: &Spec{Spec: api.Spec{Prefix: "p-", NodePorts: ports, FirewallPerPort: true}},
+		expected:    []string{"p-psc-portmapper-admin-firewall"},
+	}, {
+		name:        "The ports' rules are obsolete once there's a single rule",
+		spec:        &Spec{Spec: api.Spec{Prefix: "p-", NodePorts: ports}},
+		lastApplied: &Spec{Spec: api.Spec{Prefix: "p-", NodePorts: ports, FirewallPerPort: true}},
+		expected:    []string{"p-psc-portmapper-admin-firewall", "p-psc-portmapper-app-firewall"},
+	}, {
+		name:        "The ICMP rule is obsolete once it's disabled",
+		spec:        &Spec{Spec: api.Spec{Prefix: "p-", NodePorts: ports}},
+		lastApplied: &Spec{Spec: api.Spec{Prefix: "p-", NodePorts: ports, AllowICMP: true}},
+		expected:    []string{"p-psc-portmapper-firewall-icmp"},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, obsoleteFirewalls(tt.spec, tt.lastApplied))
+		})
+	}
+}
+
+func TestFirewallPerPort(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	specStr, err := json.Marshal(s.spec)
+	require.NoError(t, err)
+	s.sts.Annotations[annotation] = string(specStr)
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	r := New(c, gcpClient)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	single := firewallName(s.spec.Prefix)
+	perPort := portFirewallName(s.spec.Prefix, "app")
+	apply := func(perPort bool) {
+		sts := &appsv1.StatefulSet{}
+		require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+		s.spec.FirewallPerPort = perPort
+		app := s.spec.NodePorts["app"]
+		app.FirewallPriority = nil
+		if perPort {
+			app.FirewallPriority = ptr.To(int32(100))
+		}
+		s.spec.NodePorts["app"] = app
+		specStr, err := json.Marshal(s.spec)
+		require.NoError(t, err)
+		sts.Annotations[annotation] = string(specStr)
+		require.NoError(t, c.Update(ctx, sts))
+		_, err = r.Reconcile(ctx, req)
+		require.NoError(t, err)
+	}
+
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	_, err = gcpClient.GetFirewall(ctx, single)
+	require.NoError(t, err)
+
+	// The single rule is replaced by the port's.
+	apply(true)
+	_, err = gcpClient.GetFirewall(ctx, single)
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+	fw, err := gcpClient.GetFirewall(ctx, perPort)
+	require.NoError(t, err)
+	require.Equal(t, int32(100), fw.GetPriority())
+	require.Equal(t, []string{"30000"}, fw.Allowed[0].Ports)
+
+	// And back.
+	apply(false)
+	_, err = gcpClient.GetFirewall(ctx, perPort)
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+	fw, err = gcpClient.GetFirewall(ctx, single)
+	require.NoError(t, err)
+	require.Equal(t, gcp.DefaultFirewallPriority, fw.GetPriority())
+}
+
+func TestAllowICMP(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	s.spec.AllowICMP = true
+	specStr, err := json.Marshal(s.spec)
+	require.NoError(t, err)
+	s.sts.Annotations[annotation] = string(specStr)
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	r := New(c, gcpClient)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	name := icmpFirewallName(s.spec.Prefix)
+
+	// The rule can't be created until the NAT subnet's range is known.
+	_, err = r.Reconcile(ctx, req)
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	cond := meta.FindStatusCondition(parseStatus(sts).Conditions, "FirewallReady")
+	require.Equal(t, metav1.ConditionFalse, cond.Status)
+
+	gcpClient.AddSubnetwork(s.spec.NatSubnetFQNs[0], "10.2.0.0/24")
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	fw, err := gcpClient.GetFirewall(ctx, name)
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.2.0.0/24"}, fw.SourceRanges)
+	require.Equal(t, "icmp", fw.Allowed[0].GetIPProtocol())
+	// The TCP rule is kept as it is.
+	fw, err = gcpClient.GetFirewall(ctx, firewallName(s.spec.Prefix))
+	require.NoError(t, err)
+	require.Equal(t, "tcp", fw.Allowed[0].GetIPProtocol())
+
+	// It's deleted once it's disabled.
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	s.spec.AllowICMP = false
+	specStr, err = json.Marshal(s.spec)
+	require.NoError(t, err)
+	sts.Annotations[annotation] = string(specStr)
+	require.NoError(t, c.Update(ctx, sts))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	_, err = gcpClient.GetFirewall(ctx, name)
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+}
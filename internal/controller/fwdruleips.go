@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// The keys of the forwarding rules' IPs in the ports ConfigMap. Unlike the ports' keys, they
+// don't have a dot, so they can't clash.
+const (
+	ipKey          = "ip"
+	migrationIPKey = "migration-ip"
+)
+
+// fwdRuleIPsData returns the ports ConfigMap's entries for the forwarding rules' IPs in the
+// STS' status.
+func fwdRuleIPsData(spec *Spec, sts *appsv1.StatefulSet) map[string]string {
+	ips := parseStatus(sts).ForwardingRuleIPs
+	data := map[string]string{}
+	if ip, ok := ips[fwdRuleName(spec.Prefix)]; ok {
+		data[ipKey] = ip
+	}
+	if ip, ok := ips[migrationFwdRuleName(spec.Prefix)]; ok {
+		data[migrationIPKey] = ip
+	}
+	return data
+}
+
+// fwdRuleIPs publishes the IPs of a spec's forwarding rules in the STS' status, and its ports
+// ConfigMap, as soon as they exist, so that automation depending on them, e.g. DNS records or
+// clients' config, can proceed while the service attachments are still being created.
+type fwdRuleIPs struct {
+	r    *PortmapReconciler
+	log  logr.Logger
+	spec *Spec
+	// current are the IPs in the STS' status when the reconcile started.
+	current map[string]string
+
+	mu sync.Mutex
+	// sts is a copy of the STS the IPs are patched into, since the reconcile reads the original
+	// concurrently.
+	sts *appsv1.StatefulSet
+	// found are the IPs reported during the reconcile, by forwarding rule name.
+	found map[string]string
+}
+
+func (r *PortmapReconciler) newFwdRuleIPs(log logr.Logger, sts *appsv1.StatefulSet, spec *Spec) *fwdRuleIPs {
+	return &fwdRuleIPs{
+		r:       r,
+		log:     log,
+		spec:    spec,
+		current: parseStatus(sts).ForwardingRuleIPs,
+		sts:     sts.DeepCopy(),
+		found:   map[string]string{},
+	}
+}
+
+// publish records the forwarding rule's IP and, unless the status already has it, patches it
+// into the status and the ports ConfigMap right away. Failures are only logged, since the IP
+// is written along with the rest of the status at the end of the reconcile anyway.
+func (p *fwdRuleIPs) publish(ctx context.Context, name, ip string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.found[name] = ip
+	status := parseStatus(p.sts)
+	if status.ForwardingRuleIPs[name] == ip {
+		return
+	}
+	if status.ForwardingRuleIPs == nil {
+		status.ForwardingRuleIPs = map[string]string{}
+	}
+	status.ForwardingRuleIPs[name] = ip
+	jsonStatus, err := json.Marshal(status)
+	if err != nil {
+		p.log.Error(err, "Failed to encode the status with the forwarding rule's IP.", "name", name)
+		return
+	}
+	patch := client.MergeFrom(p.sts.DeepCopy())
+	p.sts.Annotations[statusAnnotation] = string(jsonStatus)
+	err = p.r.Patch(ctx, p.sts, patch)
+	if err != nil {
+		p.log.Error(err, "Failed to publish the forwarding rule's IP in the status.", "name", name)
+		return
+	}
+	p.log.Info("Published the forwarding rule's IP.", "name", name, "ip", ip)
+	if p.spec.PortsConfigMap {
+		// It logs its errors, and it's reconciled again on the next reconcile.
+		_ = p.r.reconcilePortsConfigMap(ctx, p.log, p.spec, p.sts)
+	}
+}
+
+// status returns the IPs to write along with the rest of the status: the ones it had, updated
+// with the ones found. If reconciling succeeded, those of the forwarding rules that aren't
+// managed anymore, e.g. after a migration, are dropped.
+func (p *fwdRuleIPs) status(succeeded bool) map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ips := map[string]string{}
+	maps.Copy(ips, p.current)
+	maps.Copy(ips, p.found)
+	if succeeded {
+		names := forwardingRuleNames(p.spec)
+		maps.DeleteFunc(ips, func(name, _ string) bool { return !slices.Contains(names, name) })
+	}
+	return ips
+}
@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// slowAttachment fails to create the service attachment, like when it's still being created,
+// and records the forwarding rule IPs published by then.
+type slowAttachment struct {
+	gcp.Client
+	c   client.Client
+	sts types.NamespacedName
+	ips map[string]string
+}
+
+func (s *slowAttachment) CreateServiceAttachment(ctx context.Context, _, _ string, _ []*computepb.ServiceAttachmentConsumerProjectLimit, _ []string, _ *bool) error {
+	sts := &appsv1.StatefulSet{}
+	err := s.c.Get(ctx, s.sts, sts)
+	if err != nil {
+		return err
+	}
+	s.ips = parseStatus(sts).ForwardingRuleIPs
+	return errors.New("timed out waiting for the operation")
+}
+
+func TestPublishForwardingRuleIP(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	s.spec.PortsConfigMap = true
+	specStr, err := json.Marshal(s.spec)
+	require.NoError(t, err)
+	s.sts.Annotations[annotation] = string(specStr)
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	gcpClient := &slowAttachment{Client: gcpfake.New(s.project, s.region), c: c, sts: req.NamespacedName}
+	r := New(c, gcpClient)
+
+	_, err = r.Reconcile(ctx, req)
+	require.Error(t, err)
+	rule, err := gcpClient.GetForwardingRule(ctx, fwdRuleName(s.spec.Prefix))
+	require.NoError(t, err)
+	expected := map[string]string{fwdRuleName(s.spec.Prefix): rule.GetIPAddress()}
+	// It was published before the service attachment was created, and kept once it failed.
+	require.Equal(t, expected, gcpClient.ips)
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	require.Equal(t, expected, parseStatus(sts).ForwardingRuleIPs)
+	cm := &corev1.ConfigMap{}
+	require.NoError(t, c.Get(ctx, types.NamespacedName{Namespace: s.sts.Namespace, Name: portsConfigMapName(s.spec.Prefix)}, cm))
+	require.Equal(t, rule.GetIPAddress(), cm.Data[ipKey])
+}
+
+func TestFwdRuleIPsStatus(t *testing.T) {
+	spec := &Spec{}
+	spec.Prefix = "p-"
+	tests := []struct {
+		name      string
+		current   map[string]string
+		found     map[string]string
+		succeeded bool
+		expected  map[string]string
+	}{{
+		name:      "Adds the IPs found",
+		found:     map[string]string{fwdRuleName("p-"): "10.0.0.2"},
+		succeeded: true,
+		expected:  map[string]string{fwdRuleName("p-"): "10.0.0.2"},
+	}, {
+		name:     "Keeps the current IPs if reconciling failed",
+		current:  map[string]string{fwdRuleName("p-"): "10.0.0.2", "other": "10.0.0.3"},
+		expected: map[string]string{fwdRuleName("p-"): "10.0.0.2", "other": "10.0.0.3"},
+	}, {
+		name:      "Drops the IPs of the rules that aren't managed anymore",
+		current:   map[string]string{fwdRuleName("p-"): "10.0.0.2", "other": "10.0.0.3"},
+		succeeded: true,
+		expected:  map[string]string{fwdRuleName("p-"): "10.0.0.2"},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ips := &fwdRuleIPs{spec: spec, current: tt.current, found: tt.found}
+			require.Equal(t, tt.expected, ips.status(tt.succeeded))
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/ptr"
+)
+
+// reasonGlobalAccessDisabled is the reason of the event emitted when consumers connect from
+// other regions than the service attachment's, but the spec doesn't enable global access.
+const reasonGlobalAccessDisabled = "GlobalAccessDisabled"
+
+// checkRegion verifies that the subnets the spec sets are in the region its resources are
+// created in, since GCP only accepts subnets of the resources' region. Unlike checkNetwork, it
+// doesn't call GCP, since the region is part of the subnets' FQNs.
+func checkRegion(gc gcp.Scope, spec *Spec) error {
+	type field struct{ name, subnetFQN string }
+	fields := []field{{"subnetwork", spec.Subnetwork}, {"neg_subnetwork", spec.NEGSubnetFQN}}
+	for i, fqn := range spec.NatSubnetFQNs {
+		fields = append(fields, field{fmt.Sprintf("nat_subnet_fqns[%d]", i), fqn})
+	}
+	for i, fqn := range spec.DrainingNatSubnetFQNs {
+		fields = append(fields, field{fmt.Sprintf("draining_nat_subnet_fqns[%d]", i), fqn})
+	}
+	if spec.Migration != nil {
+		fields = append(fields, field{"migration.subnet_fqn", spec.Migration.SubnetFQN})
+		for i, fqn := range spec.Migration.NatSubnetFQNs {
+			fields = append(fields, field{fmt.Sprintf("migration.nat_subnet_fqns[%d]", i), fqn})
+		}
+	}
+	for _, f := range fields {
+		if f.subnetFQN == "" {
+			continue
+		}
+		if region := regionOf(f.subnetFQN); region != gc.Region() {
+			return fmt.Errorf("%s (%q) is in region %q, not %q", f.name, f.subnetFQN, region, gc.Region())
+		}
+	}
+	return nil
+}
+
+// checkConsumerRegions emits a Warning event for each region the service attachment's
+// consumers connect from other than the controller's, unless the spec enables global access,
+// so that producers find out why those consumers' clients can't reach the workload.
+func (r *PortmapReconciler) checkConsumerRegions(log logr.Logger, sts *appsv1.StatefulSet, spec *Spec, region string, svcAtt *computepb.ServiceAttachment) {
+	if ptr.Deref(spec.GlobalAccess, false) {
+		return
+	}
+	for _, other := range consumerRegions(svcAtt, region) {
+		log.Info("Consumers connect from another region, but the spec doesn't enable global access.", "region", other)
+		r.event(sts, corev1.EventTypeWarning, reasonGlobalAccessDisabled, "Consumers connect from region %s, but the spec doesn't enable global_access", other)
+	}
+}
+
+// consumerRegions returns the regions of the attachment's connected endpoints other than
+// region, sorted. Rejected and closed connections are ignored.
+func consumerRegions(svcAtt *computepb.ServiceAttachment, region string) []string {
+	var regions []string
+	for _, ep := range svcAtt.GetConnectedEndpoints() {
+		switch ep.GetStatus() {
+		case computepb.ServiceAttachmentConnectedEndpoint_REJECTED.String(), computepb.ServiceAttachmentConnectedEndpoint_CLOSED.String():
+			continue
+		}
+		// projects/<project>/regions/<region>/forwardingRules/<name>
+		if r := regionOf(ep.GetEndpoint()); r != "" && r != region && !slices.Contains(regions, r) {
+			regions = append(regions, r)
+		}
+	}
+	slices.Sort(regions)
+	return regions
+}
+
+// regionOf returns the region of a regional resource's URL or FQN, or "" if it isn't regional.
+func regionOf(url string) string {
+	parts := strings.Split(gcp.RelativeName(url), "/")
+	i := slices.Index(parts, "regions")
+	if i < 0 || i+1 >= len(parts) {
+		return ""
+	}
+	return parts[i+1]
+}
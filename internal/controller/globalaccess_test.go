@@ -0,0 +1,111 @@
+package controller
+
+import (
+	"testing"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/0x5d/psc-portmapper/api"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+)
+
+func TestCheckRegion(t *testing.T) {
+	subnet := "projects/my-project/regions/us-east1/subnetworks/my-subnet"
+	other := "projects/my-project/regions/europe-west1/subnetworks/my-subnet"
+	tests := []struct {
+		name string
+		spec api.Spec
+		err  string
+	}{{
+		name: "Accepts the subnets in the controller's region",
+		spec: api.Spec{
+			Subnetwork:    subnet,
+			NEGSubnetFQN:  subnet,
+			NatSubnetFQNs: []string{subnet},
+			Migration:     &Migration{SubnetFQN: subnet, NatSubnetFQNs: []string{subnet}},
+		},
+	}, {
+		name: "Rejects a subnetwork in another region",
+		spec: api.Spec{NatSubnetFQNs: []string{subnet}, Subnetwork: other},
+		err:  `subnetwork ("projects/my-project/regions/europe-west1/subnetworks/my-subnet") is in region "europe-west1", not "us-east1"`,
+	}, {
+		name: "Rejects a NAT subnet in another region",
+		spec: api.Spec{NatSubnetFQNs: []string{subnet, other}},
+		err:  `nat_subnet_fqns[1] ("projects/my-project/regions/europe-west1/subnetworks/my-subnet") is in region "europe-west1", not "us-east1"`,
+	}, {
+		name: "Rejects a migration NAT subnet in another region",
+		spec: api.Spec{
+			NatSubnetFQNs: []string{subnet},
+			Migration:     &Migration{SubnetFQN: subnet, NatSubnetFQNs: []string{other}},
+		},
+		err: `migration.nat_subnet_fqns[0] ("projects/my-project/regions/europe-west1/subnetworks/my-subnet") is in region "europe-west1", not "us-east1"`,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkRegion(gcpfake.New("my-project", "us-east1"), &Spec{Spec: tt.spec})
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestCheckConsumerRegions(t *testing.T) {
+	endpoint := func(region, status string) *computepb.ServiceAttachmentConnectedEndpoint {
+		return &computepb.ServiceAttachmentConnectedEndpoint{
+			Endpoint: proto.String("https://www.googleapis.com/compute/v1/projects/consumer/regions/" + region + "/forwardingRules/ep"),
+			Status:   proto.String(status),
+		}
+	}
+	accepted := computepb.ServiceAttachmentConnectedEndpoint_ACCEPTED.String()
+	svcAtt := &computepb.ServiceAttachment{
+		ConnectedEndpoints: []*computepb.ServiceAttachmentConnectedEndpoint{
+			endpoint("us-east1", accepted),
+			endpoint("us-west1", accepted),
+			endpoint("europe-west1", computepb.ServiceAttachmentConnectedEndpoint_PENDING.String()),
+			endpoint("us-west1", accepted),
+			endpoint("asia-east1", computepb.ServiceAttachmentConnectedEndpoint_REJECTED.String()),
+		},
+	}
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "global-access"}}
+
+	tests := []struct {
+		name           string
+		globalAccess   *bool
+		expectedEvents []string
+	}{{
+		name: "Warns about the consumers in other regions",
+		expectedEvents: []string{
+			"Warning GlobalAccessDisabled Consumers connect from region europe-west1, but the spec doesn't enable global_access",
+			"Warning GlobalAccessDisabled Consumers connect from region us-west1, but the spec doesn't enable global_access",
+		},
+	}, {
+		name:         "Doesn't warn if global access is enabled",
+		globalAccess: ptr.To(true),
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := record.NewFakeRecorder(10)
+			r := New(nil, nil, WithEventRecorder(rec))
+			spec := &Spec{Spec: api.Spec{GlobalAccess: tt.globalAccess}}
+
+			r.checkConsumerRegions(testr.New(t), sts, spec, "us-east1", svcAtt)
+			close(rec.Events)
+			var events []string
+			for e := range rec.Events {
+				events = append(events, e)
+			}
+			require.Equal(t, tt.expectedEvents, events)
+		})
+	}
+}
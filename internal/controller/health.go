@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+)
+
+// reasonStuck is the reason of the event emitted when a StatefulSet is stuck.
+const reasonStuck = "Stuck"
+
+// failures tracks each StatefulSet's consecutive failures to reconcile.
+type failures struct {
+	mu     sync.Mutex
+	byName map[types.NamespacedName]*failure
+}
+
+type failure struct {
+	since time.Time
+	count int
+}
+
+// ReconcileResult is the result of a StatefulSet's last reconcile, for diagnostics.
+type ReconcileResult struct {
+	Time                time.Time `json:"time"`
+	Duration            string    `json:"duration"`
+	Error               string    `json:"error,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures,omitempty"`
+}
+
+// lastResults tracks each StatefulSet's last reconcile result.
+type lastResults struct {
+	mu     sync.Mutex
+	byName map[types.NamespacedName]ReconcileResult
+}
+
+func (l *lastResults) record(name types.NamespacedName, start time.Time, err error, failures int) {
+	res := ReconcileResult{
+		Time:                start,
+		Duration:            time.Since(start).String(),
+		ConsecutiveFailures: failures,
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.byName == nil {
+		l.byName = map[types.NamespacedName]ReconcileResult{}
+	}
+	l.byName[name] = res
+}
+
+// LastResults returns each StatefulSet's last reconcile result, keyed by namespace/name. Only
+// the leader reconciles, so it's empty on other replicas.
+func (r *PortmapReconciler) LastResults() map[string]ReconcileResult {
+	r.lastResults.mu.Lock()
+	defer r.lastResults.mu.Unlock()
+	results := make(map[string]ReconcileResult, len(r.lastResults.byName))
+	for name, res := range r.lastResults.byName {
+		results[name.String()] = res
+	}
+	return results
+}
+
+// record records the result of reconciling the StatefulSet, and returns how many times in a
+// row it failed.
+func (f *failures) record(name types.NamespacedName, err error) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		delete(f.byName, name)
+		return 0
+	}
+	if f.byName == nil {
+		f.byName = map[types.NamespacedName]*failure{}
+	}
+	fl, ok := f.byName[name]
+	if !ok {
+		fl = &failure{since: time.Now()}
+		f.byName[name] = fl
+	}
+	fl.count++
+	return fl.count
+}
+
+// failingLongerThan returns the StatefulSets that have been failing for longer than d, sorted.
+func (f *failures) failingLongerThan(d time.Duration) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for name, fl := range f.byName {
+		if time.Since(fl.since) > d {
+			names = append(names, name.String())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// StuckCheck returns a health check that fails if any StatefulSet has been failing to
+// reconcile for longer than threshold, meaning that the controller is effectively broken.
+// Only the leader reconciles, so it always passes on other replicas.
+func (r *PortmapReconciler) StuckCheck(threshold time.Duration) healthz.Checker {
+	return func(*http.Request) error {
+		stuck := r.failures.failingLongerThan(threshold)
+		if len(stuck) > 0 {
+			return fmt.Errorf("%d StatefulSets have been failing to reconcile for longer than %s: %s", len(stuck), threshold, strings.Join(stuck, ", "))
+		}
+		return nil
+	}
+}
+
+// reportStuck flags the StatefulSet as stuck with a metric and a Warning event once it failed
+// to reconcile Settings.StuckAfterFailures times in a row, and unflags it once it's reconciled.
+// The event is only emitted once per streak of failures.
+func (r *PortmapReconciler) reportStuck(ctx context.Context, name types.NamespacedName, failures int, err error) {
+	if failures == 0 {
+		stuckStatefulSets.DeleteLabelValues(name.String())
+		return
+	}
+	threshold := r.currentSettings().StuckAfterFailures
+	if threshold <= 0 || failures < threshold {
+		return
+	}
+	stuckStatefulSets.WithLabelValues(name.String()).Set(1)
+	if failures != threshold || r.recorder == nil {
+		return
+	}
+	sts := &appsv1.StatefulSet{}
+	if r.Get(ctx, name, sts) != nil {
+		// It's gone, or it'll be reported again if it keeps failing after a restart.
+		return
+	}
+	r.recorder.Eventf(sts, corev1.EventTypeWarning, reasonStuck, "Failed to reconcile %d times in a row, the last error was: %v", failures, err)
+}
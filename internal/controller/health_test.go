@@ -0,0 +1,82 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestStuckCheck(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.NewFaulty(gcpfake.New(s.project, s.region), gcpfake.Faults{ErrorRate: 1})
+	r := New(c, gcpClient)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+
+	require.NoError(t, r.StuckCheck(0)(nil))
+	_, err := r.Reconcile(ctx, req)
+	require.Error(t, err)
+	require.EqualError(t, r.StuckCheck(0)(nil), "1 StatefulSets have been failing to reconcile for longer than 0s: "+req.String())
+	require.NoError(t, r.StuckCheck(time.Hour)(nil))
+
+	// Failing again doesn't reset since when it's been failing.
+	time.Sleep(10 * time.Millisecond)
+	_, err = r.Reconcile(ctx, req)
+	require.Error(t, err)
+	require.Error(t, r.StuckCheck(5*time.Millisecond)(nil))
+
+	// Succeeding does.
+	gcpClient.SetFaults(gcpfake.Faults{})
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.NoError(t, r.StuckCheck(0)(nil))
+}
+
+func TestReportStuck(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.NewFaulty(gcpfake.New(s.project, s.region), gcpfake.Faults{ErrorRate: 1})
+	rec := record.NewFakeRecorder(10)
+	settings := DefaultSettings()
+	settings.StuckAfterFailures = 2
+	r := New(c, gcpClient, WithEventRecorder(rec), WithSettings(settings))
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	stuck := stuckStatefulSets.WithLabelValues(req.String())
+
+	_, err := r.Reconcile(ctx, req)
+	require.Error(t, err)
+	require.Empty(t, rec.Events)
+	require.Zero(t, testutil.ToFloat64(stuck))
+
+	// It's reported once it fails StuckAfterFailures times in a row, and the event is only
+	// emitted once.
+	for range 2 {
+		_, err = r.Reconcile(ctx, req)
+		require.Error(t, err)
+		require.Equal(t, 1.0, testutil.ToFloat64(stuck))
+	}
+	require.Len(t, rec.Events, 1)
+	require.Contains(t, <-rec.Events, "Warning Stuck Failed to reconcile 2 times in a row")
+
+	// It's unflagged once it's reconciled.
+	gcpClient.SetFaults(gcpfake.Faults{})
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Zero(t, testutil.CollectAndCount(stuckStatefulSets))
+}
@@ -0,0 +1,174 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/go-logr/logr"
+	"go.uber.org/multierr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// InstanceSource is where the name of the GCE instance backing a node is read from: its
+// provider ID, its name, or one of its labels or annotations, e.g. label:kubernetes.io/hostname.
+// Clusters that aren't GKE, e.g. kops or kubeadm on GCE, don't always set a provider ID the
+// controller can parse, or name their nodes after their instances.
+type InstanceSource string
+
+const (
+	// InstanceFromProviderID reads the project, zone and instance from the node's provider ID,
+	// i.e. gce://<project>/<zone>/<instance>. It's the default.
+	InstanceFromProviderID InstanceSource = "provider-id"
+	// InstanceFromNodeName reads the instance from the node's name.
+	InstanceFromNodeName InstanceSource = "node-name"
+
+	instanceLabelPrefix      = "label:"
+	instanceAnnotationPrefix = "annotation:"
+)
+
+const (
+	// reasonNodePending is the reason of the event emitted when a pod isn't mapped because its
+	// node's provider ID isn't set yet.
+	reasonNodePending = "NodeProviderIDPending"
+
+	// pendingNodeRequeueDelay is how long to wait before mapping the pods on nodes whose provider
+	// ID isn't set yet. The cloud controller sets it shortly after they register, which also
+	// triggers a reconcile, so this is only a fallback.
+	pendingNodeRequeueDelay = 10 * time.Second
+)
+
+// instanceIDAnnotation is set by GKE on each node to the ID of the instance backing it. The ID
+// changes when the node's managed instance group recreates the instance, even though it keeps
+// its name, and so does the node object.
+const instanceIDAnnotation = "container.googleapis.com/instance_id"
+
+// errProviderIDPending is returned for the nodes whose provider ID isn't set yet, and which
+// don't set any of the other instance sources.
+var errProviderIDPending = errors.New("node is missing spec.providerID")
+
+// zoneLabels are the labels the zone of a node whose instance isn't read from its provider ID
+// is read from, in order.
+var zoneLabels = []string{corev1.LabelTopologyZone, corev1.LabelFailureDomainBetaZone}
+
+// ParseInstanceSources parses the sources of the nodes' instances, which are tried in order
+// until one of them is set. No sources defaults to the provider ID.
+func ParseInstanceSources(values []string) ([]InstanceSource, error) {
+	sources := make([]InstanceSource, 0, len(values))
+	for _, v := range values {
+		s := InstanceSource(strings.TrimSpace(v))
+		key, isKey := s.key()
+		if s != InstanceFromProviderID && s != InstanceFromNodeName && (!isKey || key == "") {
+			return nil, fmt.Errorf("invalid instance source %q, it must be %s, %s, %s<key> or %s<key>", v, InstanceFromProviderID, InstanceFromNodeName, instanceLabelPrefix, instanceAnnotationPrefix)
+		}
+		sources = append(sources, s)
+	}
+	return sources, nil
+}
+
+// key returns the label or annotation key of the source, if it reads one.
+func (s InstanceSource) key() (string, bool) {
+	if key, ok := strings.CutPrefix(string(s), instanceLabelPrefix); ok {
+		return key, true
+	}
+	return strings.CutPrefix(string(s), instanceAnnotationPrefix)
+}
+
+// nodeInstance returns the FQN of the instance backing the node, as read from the first of the
+// sources that's set on it. The instances read from anything other than the provider ID are
+// assumed to be in project, and in the zone in the node's topology label. Hostnames are cut at
+// the first dot, e.g. my-instance.c.my-project.internal is instance my-instance.
+func nodeInstance(node *corev1.Node, sources []InstanceSource, project string) (string, error) {
+	if len(sources) == 0 {
+		sources = []InstanceSource{InstanceFromProviderID}
+	}
+	var errs error
+	for _, s := range sources {
+		instance, err := s.instance(node, project)
+		if err == nil {
+			return instance, nil
+		}
+		errs = multierr.Append(errs, err)
+	}
+	return "", fmt.Errorf("failed to get the instance of node %s: %w", node.Name, errs)
+}
+
+func (s InstanceSource) instance(node *corev1.Node, project string) (string, error) {
+	var name string
+	switch {
+	case s == InstanceFromProviderID:
+		if node.Spec.ProviderID == "" {
+			return "", errProviderIDPending
+		}
+		return fqInstaceName(node.Spec.ProviderID)
+	case s == InstanceFromNodeName:
+		name = node.Name
+	case strings.HasPrefix(string(s), instanceLabelPrefix):
+		key, _ := s.key()
+		name = node.Labels[key]
+	default:
+		key, _ := s.key()
+		name = node.Annotations[key]
+	}
+	name, _, _ = strings.Cut(strings.ToLower(name), ".")
+	if name == "" {
+		return "", fmt.Errorf("node doesn't set the %s instance source", s)
+	}
+	var zone string
+	for _, l := range zoneLabels {
+		if zone = node.Labels[l]; zone != "" {
+			break
+		}
+	}
+	if zone == "" {
+		return "", fmt.Errorf("node is missing the %s label, which is needed to use the %s instance source", corev1.LabelTopologyZone, s)
+	}
+	return gcp.InstanceFQN(project, zone, name), nil
+}
+
+// nodeInstances returns the FQNs of the instances backing the nodes, by node name, and the
+// names of the nodes whose provider ID isn't set yet, e.g. because they just registered. The
+// pods on those aren't mapped until it's set, see reportPendingNodes.
+func nodeInstances(log logr.Logger, nodes map[string]*corev1.Node, sources []InstanceSource, project string) (map[string]string, map[string]bool, error) {
+	instances := make(map[string]string, len(nodes))
+	pending := map[string]bool{}
+	for _, n := range nodes {
+		instance, err := nodeInstance(n, sources, project)
+		if errors.Is(err, errProviderIDPending) {
+			log.Info("Not mapping the pods on a node whose provider ID isn't set yet.", "node", n.Name)
+			pending[n.Name] = true
+			continue
+		}
+		if err != nil {
+			log.Error(err, "Failed to get the fully qualified instance name for the node.", "node", n.Name)
+			return nil, nil, err
+		}
+		instances[n.Name] = instance
+	}
+	return instances, pending, nil
+}
+
+// reportPendingNodes emits an event for each of the pods that aren't mapped because their
+// node's provider ID isn't set yet.
+func (r *PortmapReconciler) reportPendingNodes(sts *appsv1.StatefulSet, pods []corev1.Pod, pending map[string]bool) {
+	for _, p := range pods {
+		if pending[p.Spec.NodeName] {
+			r.event(sts, corev1.EventTypeNormal, reasonNodePending, "Not mapping pod %s until node %s has a provider ID", p.Name, p.Spec.NodeName)
+		}
+	}
+}
+
+// instanceIDs returns the IDs of the instances backing the nodes, by instance FQN, for the nodes
+// that report them. See instanceIDAnnotation.
+func instanceIDs(nodes map[string]*corev1.Node, instances map[string]string) map[string]string {
+	ids := map[string]string{}
+	for name, instance := range instances {
+		if id := nodes[name].Annotations[instanceIDAnnotation]; id != "" {
+			ids[instance] = id
+		}
+	}
+	return ids
+}
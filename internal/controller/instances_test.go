@@ -0,0 +1,204 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestParseInstanceSources(t *testing.T) {
+	sources, err := ParseInstanceSources([]string{"provider-id", " label:kubernetes.io/hostname", "annotation:example.com/instance", "node-name"})
+	require.NoError(t, err)
+	require.Equal(t, []InstanceSource{"provider-id", "label:kubernetes.io/hostname", "annotation:example.com/instance", "node-name"}, sources)
+
+	_, err = ParseInstanceSources([]string{"label:"})
+	require.EqualError(t, err, `invalid instance source "label:", it must be provider-id, node-name, label:<key> or annotation:<key>`)
+	_, err = ParseInstanceSources([]string{"hostname"})
+	require.Error(t, err)
+}
+
+func TestNodeInstance(t *testing.T) {
+	node := func(providerID string, labels, annotations map[string]string) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-0.example.com", Labels: labels, Annotations: annotations},
+			Spec:       corev1.NodeSpec{ProviderID: providerID},
+		}
+	}
+	zone := map[string]string{corev1.LabelTopologyZone: "us-east1-b"}
+
+	tests := []struct {
+		name        string
+		node        *corev1.Node
+		sources     []InstanceSource
+		expected    string
+		expectedErr string
+	}{{
+		name:     "Defaults to the provider ID",
+		node:     node("gce://other-project/us-east1-a/instance-0", nil, nil),
+		expected: "projects/other-project/zones/us-east1-a/instances/instance-0",
+	}, {
+		name:     "Falls back to the next source",
+		node:     node("", map[string]string{corev1.LabelHostname: "Instance-0.c.my-project.internal", corev1.LabelTopologyZone: "us-east1-b"}, nil),
+		sources:  []InstanceSource{InstanceFromProviderID, "label:" + corev1.LabelHostname},
+		expected: "projects/my-project/zones/us-east1-b/instances/instance-0",
+	}, {
+		name:     "Reads the instance from an annotation",
+		node:     node("", zone, map[string]string{"example.com/instance": "instance-1"}),
+		sources:  []InstanceSource{"annotation:example.com/instance"},
+		expected: "projects/my-project/zones/us-east1-b/instances/instance-1",
+	}, {
+		name:     "Reads the instance from the node's name, and the zone from the beta label",
+		node:     node("", map[string]string{corev1.LabelFailureDomainBetaZone: "us-east1-c"}, nil),
+		sources:  []InstanceSource{InstanceFromNodeName},
+		expected: "projects/my-project/zones/us-east1-c/instances/node-0",
+	}, {
+		name:        "Fails if none of the sources is set",
+		node:        node("", nil, nil),
+		sources:     []InstanceSource{InstanceFromProviderID, InstanceFromNodeName},
+		expectedErr: "failed to get the instance of node node-0.example.com: node is missing spec.providerID; node is missing the topology.kubernetes.io/zone label, which is needed to use the node-name instance source",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance, err := nodeInstance(tt.node, tt.sources, "my-project")
+			if tt.expectedErr != "" {
+				require.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, instance)
+		})
+	}
+}
+
+func TestReconcileWithPendingNode(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	providerID := s.nodes.Items[1].Spec.ProviderID
+	s.nodes.Items[1].Spec.ProviderID = ""
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	rec := record.NewFakeRecorder(10)
+	r := New(c, gcpClient, WithEventRecorder(rec))
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	ports := func() []int32 {
+		eps, err := gcpClient.ListEndpoints(ctx, negName(s.spec.Prefix))
+		require.NoError(t, err)
+		var ports []int32
+		for _, ep := range eps {
+			ports = append(ports, ep.Port)
+		}
+		return ports
+	}
+
+	// The other pods are mapped, and the reconcile is retried shortly.
+	res, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, pendingNodeRequeueDelay, res.RequeueAfter)
+	require.ElementsMatch(t, []int32{30000, 30002}, ports())
+	require.Equal(t, "Normal NodeProviderIDPending Not mapping pod sts-1 until node node-1 has a provider ID", <-rec.Events)
+
+	node := &s.nodes.Items[1]
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(node), node))
+	node.Spec.ProviderID = providerID
+	require.NoError(t, c.Update(ctx, node))
+	res, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Zero(t, res.RequeueAfter)
+	require.ElementsMatch(t, []int32{30000, 30001, 30002}, ports())
+}
+
+func TestReconcileRecreatedInstance(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	for i := range s.nodes.Items {
+		s.nodes.Items[i].Annotations[instanceIDAnnotation] = "100"
+	}
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	r := New(c, gcpClient)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	// The MIG recreates node-1's instance, and GCP detaches its endpoint.
+	eps, err := gcpClient.ListEndpoints(ctx, negName(s.spec.Prefix))
+	require.NoError(t, err)
+	instance, err := fqInstaceName(s.nodes.Items[1].Spec.ProviderID)
+	require.NoError(t, err)
+	for _, ep := range eps {
+		if ep.Instance == instance {
+			require.NoError(t, gcpClient.DetachEndpoints(ctx, negName(s.spec.Prefix), []*gcp.PortMapping{ep}))
+		}
+	}
+	old := &corev1.Node{}
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(&s.nodes.Items[1]), old))
+	node := old.DeepCopy()
+	node.Annotations[instanceIDAnnotation] = "101"
+	require.NoError(t, c.Update(ctx, node))
+	require.True(t, r.instanceChanged().Update(event.UpdateEvent{ObjectOld: old, ObjectNew: node}))
+
+	// The endpoint is attached again, even though the drift check isn't due.
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	eps, err = gcpClient.ListEndpoints(ctx, negName(s.spec.Prefix))
+	require.NoError(t, err)
+	require.Len(t, eps, 3)
+}
+
+func TestInstanceChanged(t *testing.T) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "node-0",
+			Labels:      map[string]string{corev1.LabelHostname: "instance-0", corev1.LabelTopologyZone: "us-east1-b"},
+			Annotations: map[string]string{instanceIDAnnotation: "100"},
+		},
+		Spec: corev1.NodeSpec{ProviderID: "gce://my-project/us-east1-b/instance-0"},
+	}
+	settings := DefaultSettings()
+	settings.InstanceSources = []InstanceSource{"label:" + corev1.LabelHostname}
+	tests := []struct {
+		name     string
+		update   func(*corev1.Node)
+		expected bool
+	}{{
+		name:   "Ignores changes to anything else",
+		update: func(n *corev1.Node) { n.Spec.Unschedulable = true },
+	}, {
+		name:   "Ignores changes to sources that aren't used",
+		update: func(n *corev1.Node) { n.Spec.ProviderID = "gce://my-project/us-east1-b/instance-1" },
+	}, {
+		name:     "Lets changes to the instance through",
+		update:   func(n *corev1.Node) { n.Labels[corev1.LabelHostname] = "instance-1" },
+		expected: true,
+	}, {
+		name:     "Lets recreations of the instance through",
+		update:   func(n *corev1.Node) { n.Annotations[instanceIDAnnotation] = "101" },
+		expected: true,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := New(nil, nil, WithSettings(settings))
+			updated := node.DeepCopy()
+			tt.update(updated)
+			require.Equal(t, tt.expected, r.instanceChanged().Update(event.UpdateEvent{ObjectOld: node, ObjectNew: updated}))
+		})
+	}
+}
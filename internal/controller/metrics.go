@@ -0,0 +1,168 @@
+package controller
+
+import (
+	"errors"
+	"time"
+
+	"github.com/0x5d/psc-portmapper/internal/version"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// stuckStatefulSets is 1 for each StatefulSet that failed to reconcile too many times in a row,
+// see Settings.StuckAfterFailures. StatefulSets are removed once they're reconciled.
+var stuckStatefulSets = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "psc_portmapper_stuck",
+	Help: "Whether a StatefulSet failed to reconcile too many times in a row.",
+}, []string{"sts"})
+
+// firewallDrift counts the out-of-band changes found in each StatefulSet's firewall, by kind of
+// change: ports_added, ports_removed, protocols_changed, sources_changed,
+// destinations_changed, priority_changed or disabled.
+var firewallDrift = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "psc_portmapper_firewall_drift_total",
+	Help: "How many times a StatefulSet's firewall was found modified out of band, by kind of change.",
+}, []string{"sts", "change"})
+
+// buildInfo is always 1, with the controller's build info as labels.
+var buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "psc_portmapper_build_info",
+	Help: "The controller's version, commit and Go version.",
+}, []string{"version", "commit", "go_version"})
+
+// Endpoint coverage per NEG, as of its last reconcile: how many endpoints it should have, how
+// many of those are attached, and how many attached ones are obsolete.
+var (
+	endpointsDesired = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "psc_portmapper_endpoints_desired",
+		Help: "How many endpoints a NEG should have.",
+	}, []string{"neg"})
+	endpointsAttached = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "psc_portmapper_endpoints_attached",
+		Help: "How many of the endpoints a NEG should have are attached to it.",
+	}, []string{"neg"})
+	endpointsObsolete = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "psc_portmapper_endpoints_obsolete",
+		Help: "How many endpoints attached to a NEG shouldn't be.",
+	}, []string{"neg"})
+)
+
+// setEndpointMetrics sets the NEG's endpoint coverage gauges.
+func setEndpointMetrics(neg string, desired, attached, obsolete int) {
+	endpointsDesired.WithLabelValues(neg).Set(float64(desired))
+	endpointsAttached.WithLabelValues(neg).Set(float64(attached))
+	endpointsObsolete.WithLabelValues(neg).Set(float64(obsolete))
+}
+
+// deleteEndpointMetrics removes the NEG's endpoint coverage gauges, once it's deleted.
+func deleteEndpointMetrics(neg string) {
+	endpointsDesired.DeleteLabelValues(neg)
+	endpointsAttached.DeleteLabelValues(neg)
+	endpointsObsolete.DeleteLabelValues(neg)
+}
+
+// The accepted connections of each consumer of a StatefulSet's service attachment, and the
+// fraction of its connection limit they use, as of its last drift check. Consumers are
+// identified by project or network, e.g. project:my-project.
+var (
+	consumerConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "psc_portmapper_consumer_connections",
+		Help: "How many connections to a service attachment are accepted for a consumer.",
+	}, []string{"sts", "consumer"})
+	connectionLimitUtilization = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "psc_portmapper_connection_limit_utilization",
+		Help: "The fraction of its connection limit a service attachment's consumer uses.",
+	}, []string{"sts", "consumer"})
+)
+
+// The NAT addresses of a StatefulSet's service attachment, i.e. of its NAT subnets but the
+// draining ones, and how many of them its connections use, as of its last drift check.
+var (
+	natAddresses = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "psc_portmapper_nat_addresses",
+		Help: "How many addresses a service attachment's NAT subnets have.",
+	}, []string{"sts"})
+	natAddressesUsed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "psc_portmapper_nat_addresses_used",
+		Help: "How many of its NAT subnets' addresses a service attachment's connections use.",
+	}, []string{"sts"})
+)
+
+// probeReachable is 1 for each of a StatefulSet's mapped ports that could be connected to
+// through its forwarding rule on its last probe, and 0 for the others. See Settings.ProbeTimeout.
+var probeReachable = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "psc_portmapper_probe_reachable",
+	Help: "Whether a StatefulSet's mapped port was reachable through its forwarding rule on its last probe.",
+}, []string{"sts", "port"})
+
+// How long StatefulSets are kept in Terminating by the controller's finalizer, and how long
+// deleting each of their resources takes, so that stuck deletions can be alerted on.
+var (
+	terminatingSince = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "psc_portmapper_terminating_since_seconds",
+		Help: "When a StatefulSet held by the finalizer was deleted, as a Unix timestamp.",
+	}, []string{"sts"})
+	deletionDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "psc_portmapper_deletion_duration_seconds",
+		Help:    "How long it took from a StatefulSet's deletion until its finalizer was removed.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 13),
+	})
+	deletionStepDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "psc_portmapper_deletion_step_duration_seconds",
+		Help:    "How long an attempt to delete a resource took, by type of resource and result.",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 12),
+	}, []string{"type", "result"})
+)
+
+// The results of the attempts to delete a resource: it's gone, it's still being deleted or in
+// use, or deleting it failed.
+const (
+	deletionResultDeleted = "deleted"
+	deletionResultPending = "pending"
+	deletionResultFailed  = "failed"
+)
+
+// observeDeletionStep records how long the attempt to delete a resource of the type took.
+func observeDeletionStep(typ string, start time.Time, err error) {
+	result := deletionResultDeleted
+	switch {
+	case errors.Is(err, errDeletionPending):
+		result = deletionResultPending
+	case err != nil:
+		result = deletionResultFailed
+	}
+	deletionStepDuration.WithLabelValues(typ, result).Observe(time.Since(start).Seconds())
+}
+
+// setTerminatingMetric records since when the StatefulSet is terminating.
+func setTerminatingMetric(sts string, deleted time.Time) {
+	terminatingSince.WithLabelValues(sts).Set(float64(deleted.Unix()))
+}
+
+// deleteTerminatingMetric removes the StatefulSet's terminating gauge once its finalizer was
+// removed, and records how long its deletion took.
+func deleteTerminatingMetric(sts string, deleted time.Time) {
+	terminatingSince.DeleteLabelValues(sts)
+	deletionDuration.Observe(time.Since(deleted).Seconds())
+}
+
+func init() {
+	metrics.Registry.MustRegister(
+		stuckStatefulSets,
+		firewallDrift,
+		buildInfo,
+		endpointsDesired,
+		endpointsAttached,
+		endpointsObsolete,
+		consumerConnections,
+		connectionLimitUtilization,
+		natAddresses,
+		natAddressesUsed,
+		probeReachable,
+		terminatingSince,
+		deletionDuration,
+		deletionStepDuration,
+	)
+	v := version.Get()
+	buildInfo.WithLabelValues(v.Version, v.Commit, v.GoVersion).Set(1)
+}
@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/go-logr/logr/testr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestEndpointMetrics(t *testing.T) {
+	ctx := context.Background()
+	log := testr.New(t)
+	neg := "endpoint-metrics-neg"
+	gc := gcpfake.New("my-project", "us-east1")
+	require.NoError(t, gc.CreatePortmapNEG(ctx, neg, "", nil))
+	obsolete := &gcp.PortMapping{Port: 30002, Instance: "projects/p/zones/z/instances/old", InstancePort: 30000}
+	kept := &gcp.PortMapping{Port: 30000, Instance: "projects/p/zones/z/instances/a", InstancePort: 30000}
+	added := &gcp.PortMapping{Port: 30001, Instance: "projects/p/zones/z/instances/b", InstancePort: 30000}
+	require.NoError(t, gc.AttachEndpoints(ctx, neg, []*gcp.PortMapping{obsolete, kept}))
+
+	expect := func(desired, attached, obsolete float64) {
+		t.Helper()
+		require.Equal(t, desired, testutil.ToFloat64(endpointsDesired.WithLabelValues(neg)))
+		require.Equal(t, attached, testutil.ToFloat64(endpointsAttached.WithLabelValues(neg)))
+		require.Equal(t, obsolete, testutil.ToFloat64(endpointsObsolete.WithLabelValues(neg)))
+	}
+
+	// Attaching fails after the obsolete endpoint was detached.
+	e := &endpointsReconciler{gc: failingAttach{NEGs: gc}, neg: neg, mappings: []*gcp.PortMapping{kept, added}}
+	require.Error(t, e.Ensure(ctx, log))
+	expect(2, 1, 0)
+
+	e.gc = gc
+	require.NoError(t, e.Ensure(ctx, log))
+	expect(2, 2, 0)
+
+	require.NoError(t, e.Delete(ctx, log))
+	require.False(t, endpointsDesired.DeleteLabelValues(neg), "expected the metrics to be deleted with the NEG")
+}
+
+func TestDeletionMetrics(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.NewFaulty(gcpfake.New(s.project, s.region), gcpfake.Faults{})
+	r := New(c, gcpClient)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	deletions := sampleCount(t, deletionDuration)
+	failedSteps := sampleCount(t, deletionStepDuration.WithLabelValues("firewall", deletionResultFailed))
+	deletedSteps := sampleCount(t, deletionStepDuration.WithLabelValues("firewall", deletionResultDeleted))
+
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	require.NoError(t, c.Delete(ctx, sts))
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+
+	// The StatefulSet is terminating while its resources fail to be deleted.
+	gcpClient.SetFaults(gcpfake.Faults{ErrorRate: 1})
+	_, err = r.Reconcile(ctx, req)
+	require.Error(t, err)
+	require.Equal(t, float64(sts.DeletionTimestamp.Unix()), testutil.ToFloat64(terminatingSince.WithLabelValues(req.String())))
+	require.Equal(t, failedSteps+1, sampleCount(t, deletionStepDuration.WithLabelValues("firewall", deletionResultFailed)))
+	require.Equal(t, deletions, sampleCount(t, deletionDuration))
+
+	gcpClient.SetFaults(gcpfake.Faults{})
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.False(t, terminatingSince.DeleteLabelValues(req.String()), "expected the gauge to be deleted with the finalizer")
+	require.Equal(t, deletedSteps+1, sampleCount(t, deletionStepDuration.WithLabelValues("firewall", deletionResultDeleted)))
+	require.Equal(t, deletions+1, sampleCount(t, deletionDuration))
+}
+
+func sampleCount(t *testing.T, o prometheus.Observer) uint64 {
+	t.Helper()
+	m := &dto.Metric{}
+	require.NoError(t, o.(prometheus.Metric).Write(m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+// failingAttach fails to attach endpoints.
+type failingAttach struct {
+	gcp.NEGs
+}
+
+func (failingAttach) AttachEndpoints(context.Context, string, []*gcp.PortMapping) error {
+	return errors.New("boom")
+}
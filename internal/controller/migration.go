@@ -0,0 +1,195 @@
+package controller
+
+import (
+	"context"
+	"errors"
+
+	"github.com/0x5d/psc-portmapper/api"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// migrationAckAnnotation acknowledges that the consumers moved to the migration's service
+// attachment, so that the original forwarding rule and service attachment can be deleted. Its
+// value must be the migration's subnet_fqn, so that an acknowledgement can't apply to a later
+// migration by mistake.
+const migrationAckAnnotation = "psc-portmapper.0x5d.org/migration-ack"
+
+const reasonDeleted = "Deleted"
+
+func migrationFwdRuleName(prefix string) string {
+	return nameBase(prefix) + "-migration-fwdrule"
+}
+
+func migrationSvcAttName(prefix string) string {
+	return nameBase(prefix) + "-migration-svcatt"
+}
+
+// resolveMigration records on the spec whether its migration was acknowledged by the STS'
+// migration ack annotation.
+func resolveMigration(log logr.Logger, sts *appsv1.StatefulSet, spec *Spec) {
+	ack, ok := sts.Annotations[migrationAckAnnotation]
+	if !ok {
+		return
+	}
+	if spec.Migration == nil || ack != spec.Migration.SubnetFQN {
+		log.Info("Ignoring the migration ack annotation, since it doesn't match the spec's migration.", "ack", ack)
+		return
+	}
+	spec.migrationAcknowledged = true
+}
+
+// withMigration adapts the spec's sub-reconcilers to its migration. While it's in progress,
+// a second forwarding rule and service attachment are reconciled in the migration's subnet,
+// next to the original ones. Once it's acknowledged, the original ones are deleted. If the
+// migration is removed from the spec, its resources are deleted instead, as per lastApplied.
+// The hooks are called for the service attachment serving the consumers, except for
+// forwardingRuleIP, which is called for both forwarding rules.
+func withMigration(subs []subReconciler, gc gcp.Client, spec, lastApplied *Spec, own ownership, h hooks) []subReconciler {
+	migration := spec.Migration
+	if migration == nil {
+		if lastApplied == nil || lastApplied.Migration == nil {
+			return subs
+		}
+		// The migration was aborted, or rolled back after being acknowledged.
+		fwdRule, svcAtt := migrationSubReconcilers(gc, spec, lastApplied.Migration, lastApplied, own, hooks{})
+		return append(subs,
+			obsolete(fwdRule, "MigrationForwardingRuleDeleted"),
+			obsolete(svcAtt, "MigrationAttachmentDeleted"),
+		)
+	}
+	if !spec.migrationAcknowledged {
+		fwdRule, svcAtt := migrationSubReconcilers(gc, spec, migration, lastApplied, own, hooks{forwardingRuleIP: h.forwardingRuleIP})
+		return append(subs, fwdRule, svcAtt)
+	}
+	fwdRule, svcAtt := migrationSubReconcilers(gc, spec, migration, lastApplied, own, h)
+	migrated := make([]subReconciler, 0, len(subs)+2)
+	for _, s := range subs {
+		switch s.Name() {
+		case "forwarding rule":
+			migrated = append(migrated, obsolete(s, "ForwardingRuleDeleted"))
+		case "service attachment":
+			migrated = append(migrated, obsolete(s, "AttachmentDeleted"))
+		default:
+			migrated = append(migrated, s)
+		}
+	}
+	return append(migrated, fwdRule, svcAtt)
+}
+
+func migrationSubReconcilers(gc gcp.Client, spec *Spec, migration *Migration, lastApplied *Spec, own ownership, h hooks) (subReconciler, subReconciler) {
+	var lastAppliedMigration *Spec
+	if lastApplied != nil && lastApplied.Migration != nil {
+		// The attachment is merged with what the migration applied, not the original one.
+		lastAppliedMigration = &Spec{Spec: api.Spec{
+			ConsumerAcceptList:   lastApplied.ConsumerAcceptList,
+			NatSubnetFQNs:        lastApplied.Migration.NatSubnetFQNs,
+			ReconcileConnections: lastApplied.ReconcileConnections,
+		}}
+	}
+	fwdRule := &forwardingRuleReconciler{
+		condition:    condition{condType: "MigrationForwardingRuleReady"},
+		kind:         "migration forwarding rule",
+		gc:           gc,
+		own:          own,
+		name:         migrationFwdRuleName(spec.Prefix),
+		backend:      backendName(spec.Prefix),
+		subnetFQN:    migration.SubnetFQN,
+		ip:           migration.IP,
+		globalAccess: spec.GlobalAccess,
+		onIP:         h.forwardingRuleIP,
+	}
+	svcAtt := &serviceAttachmentReconciler{
+		condition:            condition{condType: "MigrationAttachmentReady"},
+		kind:                 "migration service attachment",
+		gc:                   gc,
+		own:                  own,
+		name:                 migrationSvcAttName(spec.Prefix),
+		fwdRule:              migrationFwdRuleName(spec.Prefix),
+		consumers:            spec.ConsumerAcceptList,
+		natSubnetFQNs:        migration.NatSubnetFQNs,
+		enforceSubnetOrder:   spec.EnforceNatSubnetOrder,
+		lastApplied:          lastAppliedMigration,
+		onGet:                h.serviceAttachment,
+		onSubnetsRemoved:     h.natSubnetsRemoved,
+		reconcileConnections: spec.ReconcileConnections,
+	}
+	return fwdRule, svcAtt
+}
+
+// serviceAttachmentFQNs returns the FQNs of the service attachments consumers can connect to
+// for the spec. There are none while they're torn down.
+func serviceAttachmentFQNs(gc gcp.Scope, spec *Spec) []string {
+	var fqns []string
+	if spec.tornDown {
+		return fqns
+	}
+	if spec.Migration == nil || !spec.migrationAcknowledged {
+		fqns = append(fqns, gcp.ServiceAttachmentFQN(gc.Project(), gc.Region(), svcAttName(spec.Prefix)))
+	}
+	if spec.Migration != nil {
+		fqns = append(fqns, gcp.ServiceAttachmentFQN(gc.Project(), gc.Region(), migrationSvcAttName(spec.Prefix)))
+	}
+	return fqns
+}
+
+// forwardingRuleNames returns the names of the forwarding rules of the service attachments
+// returned by serviceAttachmentFQNs.
+func forwardingRuleNames(spec *Spec) []string {
+	var names []string
+	if spec.tornDown {
+		return names
+	}
+	if spec.Migration == nil || !spec.migrationAcknowledged {
+		names = append(names, fwdRuleName(spec.Prefix))
+	}
+	if spec.Migration != nil {
+		names = append(names, migrationFwdRuleName(spec.Prefix))
+	}
+	return names
+}
+
+// obsoleteSubReconciler deletes a sub-reconciler's resource instead of ensuring it.
+type obsoleteSubReconciler struct {
+	condition
+	sub subReconciler
+}
+
+// obsolete returns a sub-reconciler deleting s' resource, reporting it with a condition of the
+// given type.
+func obsolete(s subReconciler, condType string) subReconciler {
+	return &obsoleteSubReconciler{condition: condition{condType: condType}, sub: s}
+}
+
+func (o *obsoleteSubReconciler) Name() string {
+	return "obsolete " + o.sub.Name()
+}
+
+func (o *obsoleteSubReconciler) Ensure(ctx context.Context, log logr.Logger) error {
+	err := o.sub.Delete(ctx, log)
+	if err == nil {
+		log.Info("Deleted an obsolete resource.", "type", o.sub.Name())
+	}
+	if errors.Is(err, gcp.ErrNotFound) {
+		err = nil
+	}
+	return o.record(err)
+}
+
+func (o *obsoleteSubReconciler) Delete(ctx context.Context, log logr.Logger) error {
+	return o.sub.Delete(ctx, log)
+}
+
+func (o *obsoleteSubReconciler) Exists(ctx context.Context) (bool, error) {
+	return o.sub.Exists(ctx)
+}
+
+func (o *obsoleteSubReconciler) Status() metav1.Condition {
+	c := o.condition.Status()
+	if c.Status == metav1.ConditionTrue {
+		c.Reason = reasonDeleted
+	}
+	return c
+}
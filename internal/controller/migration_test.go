@@ -0,0 +1,149 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestMigration(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	r := New(c, gcpClient)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	prefix := s.spec.Prefix
+	original := gcp.ServiceAttachmentFQN(s.project, s.region, svcAttName(prefix))
+	migrated := gcp.ServiceAttachmentFQN(s.project, s.region, migrationSvcAttName(prefix))
+	migrationSubnet := "projects/my-project/regions/us-east1/subnetworks/new-subnet"
+
+	// update sets the spec and the migration ack annotation, unless it's empty, and reconciles.
+	update := func(spec *Spec, ack string) *Status {
+		t.Helper()
+		sts := &appsv1.StatefulSet{}
+		require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+		specStr, err := json.Marshal(spec)
+		require.NoError(t, err)
+		sts.Annotations[annotation] = string(specStr)
+		delete(sts.Annotations, migrationAckAnnotation)
+		if ack != "" {
+			sts.Annotations[migrationAckAnnotation] = ack
+		}
+		require.NoError(t, c.Update(ctx, sts))
+		_, err = r.Reconcile(ctx, req)
+		require.NoError(t, err)
+		require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+		return parseStatus(sts)
+	}
+	exists := func(get func(context.Context, string) error, name string) bool {
+		t.Helper()
+		err := get(ctx, name)
+		if err != nil {
+			require.ErrorIs(t, err, gcp.ErrNotFound)
+		}
+		return err == nil
+	}
+	getRule := func(ctx context.Context, name string) error {
+		_, err := gcpClient.GetForwardingRule(ctx, name)
+		return err
+	}
+	getAtt := func(ctx context.Context, name string) error {
+		_, err := gcpClient.GetServiceAttachment(ctx, name)
+		return err
+	}
+
+	status := update(s.spec, "")
+	require.Equal(t, []string{original}, status.ServiceAttachments)
+
+	// The migration's resources are created next to the original ones.
+	s.spec.Migration = &Migration{
+		SubnetFQN:     migrationSubnet,
+		NatSubnetFQNs: []string{"projects/my-project/regions/us-east1/subnetworks/new-nat"},
+	}
+	status = update(s.spec, "")
+	require.Equal(t, []string{original, migrated}, status.ServiceAttachments)
+	require.True(t, meta.IsStatusConditionTrue(status.Conditions, "MigrationAttachmentReady"))
+	rule, err := gcpClient.GetForwardingRule(ctx, migrationFwdRuleName(prefix))
+	require.NoError(t, err)
+	require.Equal(t, migrationSubnet, rule.GetSubnetwork())
+	require.Equal(t, rule.GetIPAddress(), status.ForwardingRuleIPs[migrationFwdRuleName(prefix)])
+	require.Len(t, status.ForwardingRuleIPs, 2)
+	svcAtt, err := gcpClient.GetServiceAttachment(ctx, migrationSvcAttName(prefix))
+	require.NoError(t, err)
+	require.Equal(t, s.spec.Migration.NatSubnetFQNs, svcAtt.GetNatSubnets())
+	require.True(t, exists(getAtt, svcAttName(prefix)))
+
+	// An acknowledgement of another migration is ignored.
+	status = update(s.spec, "projects/my-project/regions/us-east1/subnetworks/other")
+	require.Equal(t, []string{original, migrated}, status.ServiceAttachments)
+	require.True(t, exists(getAtt, svcAttName(prefix)))
+
+	// Once acknowledged, the original resources are deleted.
+	status = update(s.spec, migrationSubnet)
+	require.Equal(t, []string{migrated}, status.ServiceAttachments)
+	require.True(t, meta.IsStatusConditionTrue(status.Conditions, readyCondition))
+	require.Equal(t, reasonDeleted, meta.FindStatusCondition(status.Conditions, "AttachmentDeleted").Reason)
+	require.Nil(t, meta.FindStatusCondition(status.Conditions, "AttachmentReady"))
+	require.False(t, exists(getAtt, svcAttName(prefix)))
+	require.False(t, exists(getRule, fwdRuleName(prefix)))
+	require.True(t, exists(getAtt, migrationSvcAttName(prefix)))
+	require.Equal(t, map[string]string{migrationFwdRuleName(prefix): rule.GetIPAddress()}, status.ForwardingRuleIPs)
+}
+
+func TestAbortMigration(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	s.spec.Migration = &Migration{
+		SubnetFQN:     "projects/my-project/regions/us-east1/subnetworks/new-subnet",
+		NatSubnetFQNs: []string{"projects/my-project/regions/us-east1/subnetworks/new-nat"},
+	}
+	specStr, err := json.Marshal(s.spec)
+	require.NoError(t, err)
+	s.sts.Annotations[annotation] = string(specStr)
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	r := New(c, gcpClient)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	_, err = gcpClient.GetServiceAttachment(ctx, migrationSvcAttName(s.spec.Prefix))
+	require.NoError(t, err)
+
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	s.spec.Migration = nil
+	specStr, err = json.Marshal(s.spec)
+	require.NoError(t, err)
+	sts.Annotations[annotation] = string(specStr)
+	require.NoError(t, c.Update(ctx, sts))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	_, err = gcpClient.GetServiceAttachment(ctx, migrationSvcAttName(s.spec.Prefix))
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+	_, err = gcpClient.GetForwardingRule(ctx, migrationFwdRuleName(s.spec.Prefix))
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+	_, err = gcpClient.GetServiceAttachment(ctx, svcAttName(s.spec.Prefix))
+	require.NoError(t, err)
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	status := parseStatus(sts)
+	require.Nil(t, meta.FindStatusCondition(status.Conditions, "MigrationAttachmentReady"))
+	require.True(t, meta.IsStatusConditionTrue(status.Conditions, readyCondition))
+}
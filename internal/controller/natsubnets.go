@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// reasonNatSubnetsNearlyFull is the reason of the event emitted when most of the service
+	// attachment's NAT addresses are in use.
+	reasonNatSubnetsNearlyFull = "NatSubnetsNearlyFull"
+	// reasonNatSubnetRemoved is the reason of the event emitted when a NAT subnet is removed
+	// from the service attachment, e.g. because it was drained.
+	reasonNatSubnetRemoved = "NatSubnetRemoved"
+)
+
+// GCP reserves 4 addresses in each subnet's primary range.
+const reservedSubnetAddresses = 4
+
+// checkNatSubnets exports how many addresses the service attachment's NAT subnets have and how
+// many of them its connections use, and emits a Warning event above
+// Settings.NatSubnetAlertPercent, so that another subnet can be added to nat_subnet_fqns before
+// new connections are rejected. Draining subnets don't count, since they're being removed.
+func (r *PortmapReconciler) checkNatSubnets(ctx context.Context, log logr.Logger, gc gcp.Subnetworks, sts *appsv1.StatefulSet, spec *Spec, svcAtt *computepb.ServiceAttachment) {
+	sName := types.NamespacedName{Namespace: sts.Namespace, Name: sts.Name}.String()
+	capacity := 0
+	for _, sn := range svcAtt.GetNatSubnets() {
+		if slices.Contains(spec.DrainingNatSubnetFQNs, gcp.RelativeName(sn)) {
+			continue
+		}
+		subnet, err := gc.GetSubnetwork(ctx, sn)
+		if err != nil {
+			// The metrics are best effort, so they don't fail the reconcile.
+			log.Error(err, "Failed to get the NAT subnet.", "subnet", sn)
+			return
+		}
+		addresses, err := subnetAddresses(subnet)
+		if err != nil {
+			log.Error(err, "Failed to get the NAT subnet's size.", "subnet", sn)
+			return
+		}
+		capacity += addresses
+	}
+	used := natAddressesInUse(svcAtt)
+	natAddresses.WithLabelValues(sName).Set(float64(capacity))
+	natAddressesUsed.WithLabelValues(sName).Set(float64(used))
+	if capacity == 0 {
+		return
+	}
+	alertPercent := r.currentSettings().NatSubnetAlertPercent
+	if alertPercent > 0 && float64(used)*100/float64(capacity) >= float64(alertPercent) {
+		log.Info("The service attachment's NAT subnets are nearly full.", "used", used, "addresses", capacity)
+		r.event(sts, corev1.EventTypeWarning, reasonNatSubnetsNearlyFull, "%d of the %d addresses in the NAT subnets are in use, add a subnet to nat_subnet_fqns", used, capacity)
+	}
+}
+
+// reportRemovedNatSubnets emits an event for each NAT subnet removed from the service
+// attachment, since they can only be deleted or resized once they aren't attached.
+func (r *PortmapReconciler) reportRemovedNatSubnets(log logr.Logger, sts *appsv1.StatefulSet, subnets []string) {
+	for _, sn := range subnets {
+		log.Info("Removed a NAT subnet from the service attachment.", "subnet", sn)
+		r.event(sts, corev1.EventTypeNormal, reasonNatSubnetRemoved, "NAT subnet %s was removed from the service attachment and can be freed", sn)
+	}
+}
+
+// subnetAddresses returns how many addresses of the subnet's primary range can be assigned.
+func subnetAddresses(subnet *computepb.Subnetwork) (int, error) {
+	prefix, err := netip.ParsePrefix(subnet.GetIpCidrRange())
+	if err != nil {
+		return 0, fmt.Errorf("invalid IP range for subnet %s: %w", subnet.GetSelfLink(), err)
+	}
+	if !prefix.Addr().Is4() {
+		return 0, fmt.Errorf("subnet %s's primary range (%s) isn't IPv4", subnet.GetSelfLink(), prefix)
+	}
+	size := 1 << (32 - prefix.Bits())
+	return max(size-reservedSubnetAddresses, 0), nil
+}
+
+// natAddressesInUse returns how many NAT addresses the attachment's connections use: one per
+// accepted endpoint, and one per connection propagated from it, e.g. by Network Connectivity
+// Center.
+func natAddressesInUse(svcAtt *computepb.ServiceAttachment) int {
+	used := 0
+	for _, ep := range svcAtt.GetConnectedEndpoints() {
+		if ep.GetStatus() != computepb.ServiceAttachmentConnectedEndpoint_ACCEPTED.String() {
+			continue
+		}
+		used += 1 + int(ep.GetPropagatedConnectionCount())
+	}
+	return used
+}
+
+// removedNatSubnets returns the FQNs of the actual NAT subnets that aren't in merged.
+func removedNatSubnets(actual, merged []string) []string {
+	kept := subnetsByKey(merged)
+	var removed []string
+	for fqn := range subnetsByKey(actual) {
+		if _, ok := kept[fqn]; !ok {
+			removed = append(removed, fqn)
+		}
+	}
+	slices.Sort(removed)
+	return removed
+}
+
+func deleteNatSubnetMetrics(sts string) {
+	natAddresses.DeleteLabelValues(sts)
+	natAddressesUsed.DeleteLabelValues(sts)
+}
@@ -0,0 +1,164 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/0x5d/psc-portmapper/api"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/go-logr/logr/testr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestCheckNatSubnets(t *testing.T) {
+	a := "projects/p/regions/us-east1/subnetworks/a"
+	b := "projects/p/regions/us-east1/subnetworks/b"
+	draining := "projects/p/regions/us-east1/subnetworks/draining"
+	gc := gcpfake.New("p", "us-east1")
+	gc.AddSubnetwork(a, "10.0.0.0/28")
+	gc.AddSubnetwork(b, "10.0.1.0/28")
+	gc.AddSubnetwork(draining, "10.0.2.0/24")
+
+	accepted := computepb.ServiceAttachmentConnectedEndpoint_ACCEPTED.String()
+	var endpoints []*computepb.ServiceAttachmentConnectedEndpoint
+	for range 8 {
+		endpoints = append(endpoints, &computepb.ServiceAttachmentConnectedEndpoint{Status: proto.String(accepted)})
+	}
+	endpoints = append(endpoints,
+		&computepb.ServiceAttachmentConnectedEndpoint{Status: proto.String(accepted), PropagatedConnectionCount: proto.Uint32(2)},
+		&computepb.ServiceAttachmentConnectedEndpoint{Status: proto.String(computepb.ServiceAttachmentConnectedEndpoint_PENDING.String())},
+	)
+	svcAtt := &computepb.ServiceAttachment{
+		NatSubnets:         []string{"https://www.googleapis.com/compute/v1/" + a, b, draining},
+		ConnectedEndpoints: endpoints,
+	}
+	spec := &Spec{Spec: api.Spec{NatSubnetFQNs: []string{a, b}, DrainingNatSubnetFQNs: []string{draining}}}
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "nat-subnets"}}
+
+	tests := []struct {
+		name           string
+		alertPercent   int
+		expectedEvents []string
+	}{{
+		name:           "Alerts above the threshold",
+		alertPercent:   40,
+		expectedEvents: []string{"Warning NatSubnetsNearlyFull 11 of the 24 addresses in the NAT subnets are in use, add a subnet to nat_subnet_fqns"},
+	}, {
+		name:         "Doesn't alert below the threshold",
+		alertPercent: 50,
+	}, {
+		name:         "Doesn't alert if disabled",
+		alertPercent: 0,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := DefaultSettings()
+			settings.NatSubnetAlertPercent = tt.alertPercent
+			rec := record.NewFakeRecorder(10)
+			r := New(nil, nil, WithSettings(settings), WithEventRecorder(rec))
+
+			r.checkNatSubnets(context.Background(), testr.New(t), gc, sts, spec, svcAtt)
+			close(rec.Events)
+			var events []string
+			for e := range rec.Events {
+				events = append(events, e)
+			}
+			require.Equal(t, tt.expectedEvents, events)
+			require.Equal(t, 24.0, testutil.ToFloat64(natAddresses.WithLabelValues("ns/nat-subnets")))
+			require.Equal(t, 11.0, testutil.ToFloat64(natAddressesUsed.WithLabelValues("ns/nat-subnets")))
+		})
+	}
+}
+
+func TestSubnetAddresses(t *testing.T) {
+	tests := []struct {
+		name        string
+		cidr        string
+		expected    int
+		expectedErr string
+	}{{
+		name:     "Excludes the reserved addresses",
+		cidr:     "10.0.0.0/24",
+		expected: 252,
+	}, {
+		name:     "Handles ranges smaller than the reserved addresses",
+		cidr:     "10.0.0.0/31",
+		expected: 0,
+	}, {
+		name:        "Fails for IPv6 ranges",
+		cidr:        "fd20::/64",
+		expectedErr: "subnet s's primary range (fd20::/64) isn't IPv4",
+	}, {
+		name:        "Fails for invalid ranges",
+		cidr:        "nope",
+		expectedErr: `invalid IP range for subnet s: netip.ParsePrefix("nope"): no '/'`,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addresses, err := subnetAddresses(&computepb.Subnetwork{SelfLink: proto.String("s"), IpCidrRange: &tt.cidr})
+			if tt.expectedErr != "" {
+				require.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, addresses)
+		})
+	}
+}
+
+func TestDrainNatSubnet(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	specStr, err := json.Marshal(s.spec)
+	require.NoError(t, err)
+	s.sts.Annotations[annotation] = string(specStr)
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	rec := record.NewFakeRecorder(100)
+	r := New(c, gcpClient, WithEventRecorder(rec))
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	// A NAT subnet is added out of band, so the controller wouldn't remove it on its own.
+	old := "projects/my-project/regions/us-east1/subnetworks/old"
+	svcAtt, err := gcpClient.GetServiceAttachment(ctx, svcAttName("prefix-"))
+	require.NoError(t, err)
+	require.NoError(t, gcpClient.UpdateServiceAttachment(ctx, svcAttName("prefix-"), svcAtt.ConsumerAcceptLists, append(svcAtt.NatSubnets, old), nil))
+
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	s.spec.DrainingNatSubnetFQNs = []string{old}
+	specStr, err = json.Marshal(s.spec)
+	require.NoError(t, err)
+	sts.Annotations[annotation] = string(specStr)
+	require.NoError(t, c.Update(ctx, sts))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	svcAtt, err = gcpClient.GetServiceAttachment(ctx, svcAttName("prefix-"))
+	require.NoError(t, err)
+	require.Equal(t, s.spec.NatSubnetFQNs, svcAtt.NatSubnets)
+	close(rec.Events)
+	var events []string
+	for e := range rec.Events {
+		events = append(events, e)
+	}
+	require.Contains(t, events, "Normal NatSubnetRemoved NAT subnet "+old+" was removed from the service attachment and can be freed")
+}
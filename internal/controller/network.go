@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+)
+
+// gcpClientInNetwork returns the client creating the spec's resources in its network and
+// subnet, if it sets them, so that a single controller can serve producers in several VPCs.
+// Otherwise, it returns gc.
+func gcpClientInNetwork(gc gcp.Client, spec *Spec) (gcp.Client, error) {
+	if spec.Network == "" && spec.Subnetwork == "" {
+		return gc, nil
+	}
+	scoper, ok := gc.(gcp.NetworkScoper)
+	if !ok {
+		return nil, errors.New("the spec sets a network or subnetwork, but the GCP client can't create resources in other networks")
+	}
+	network := spec.Network
+	if network == "" {
+		network = gc.Network()
+	}
+	return scoper.InNetwork(network, spec.Subnetwork), nil
+}
+
+// gcpClientWithEndpointAnnotations returns the client attaching the spec's endpoints with its
+// endpoint_annotations, if it sets any. Otherwise, it returns gc.
+func gcpClientWithEndpointAnnotations(gc gcp.Client, spec *Spec) (gcp.Client, error) {
+	if len(spec.EndpointAnnotations) == 0 {
+		return gc, nil
+	}
+	annotator, ok := gc.(gcp.EndpointAnnotator)
+	if !ok {
+		return nil, errors.New("the spec sets endpoint_annotations, but the GCP client can't annotate endpoints")
+	}
+	return annotator.WithEndpointAnnotations(spec.EndpointAnnotations), nil
+}
+
+// checkNetwork verifies that the subnets the spec sets, which the forwarding rules and the NEG
+// are created in, belong to the network its resources, including the firewall, are created in.
+// Otherwise, GCP would only reject some of them, leaving the others behind. It's only checked
+// if the spec overrides the controller's network or subnets, since they're consistent
+// otherwise.
+func checkNetwork(ctx context.Context, gc gcp.Client, spec *Spec) error {
+	if spec.Network == "" && spec.Subnetwork == "" && spec.NEGSubnetFQN == "" {
+		return nil
+	}
+	type field struct{ name, subnetFQN string }
+	fields := []field{{"subnetwork", spec.Subnetwork}, {"neg_subnetwork", spec.NEGSubnetFQN}}
+	if spec.Migration != nil {
+		fields = append(fields, field{"migration.subnet_fqn", spec.Migration.SubnetFQN})
+	}
+	for _, f := range fields {
+		if f.subnetFQN == "" {
+			continue
+		}
+		subnet, err := gc.GetSubnetwork(ctx, f.subnetFQN)
+		if err != nil {
+			return fmt.Errorf("failed to get the %s %s: %w", f.name, f.subnetFQN, err)
+		}
+		if network := gcp.RelativeName(subnet.GetNetwork()); network != gc.Network() {
+			return fmt.Errorf("%s (%q) is in network %q, not %q", f.name, f.subnetFQN, network, gc.Network())
+		}
+	}
+	return nil
+}
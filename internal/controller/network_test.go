@@ -0,0 +1,143 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/0x5d/psc-portmapper/api"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestCheckNetwork(t *testing.T) {
+	gc := gcpfake.New("my-project", "us-east1")
+	other := gcp.NetworkFQN("my-project", "other")
+	subnet := gcp.SubnetFQN("my-project", "us-east1", "subnet")
+	nodes := gcp.SubnetFQN("my-project", "us-east1", "nodes")
+	elsewhere := gcp.SubnetFQN("my-project", "us-east1", "elsewhere")
+	gc.AddPrivateSubnetwork(other, subnet, "10.1.0.0/24")
+	gc.AddPrivateSubnetwork(other, nodes, "10.2.0.0/24")
+	gc.AddPrivateSubnetwork(gc.Network(), elsewhere, "10.3.0.0/24")
+
+	tests := []struct {
+		name        string
+		spec        *Spec
+		expectedErr string
+	}{{
+		name: "Passes if the spec doesn't override the network or subnets",
+		spec: &Spec{Spec: api.Spec{Migration: &Migration{SubnetFQN: gcp.SubnetFQN("my-project", "us-east1", "missing")}}},
+	}, {
+		name: "Passes if the subnets are in the spec's network",
+		spec: &Spec{Spec: api.Spec{Network: other, Subnetwork: subnet, NEGSubnetFQN: nodes, Migration: &Migration{SubnetFQN: nodes}}},
+	}, {
+		name:        "Fails if the NEG's subnet is in another network",
+		spec:        &Spec{Spec: api.Spec{Network: other, Subnetwork: subnet, NEGSubnetFQN: elsewhere}},
+		expectedErr: `neg_subnetwork ("projects/my-project/regions/us-east1/subnetworks/elsewhere") is in network "projects/my-project/global/networks/default", not "projects/my-project/global/networks/other"`,
+	}, {
+		name:        "Fails if the migration's subnet is in another network",
+		spec:        &Spec{Spec: api.Spec{Network: other, Subnetwork: subnet, Migration: &Migration{SubnetFQN: elsewhere}}},
+		expectedErr: `migration.subnet_fqn ("projects/my-project/regions/us-east1/subnetworks/elsewhere") is in network "projects/my-project/global/networks/default", not "projects/my-project/global/networks/other"`,
+	}, {
+		name:        "Fails if the subnet is in another network than the controller's",
+		spec:        &Spec{Spec: api.Spec{Subnetwork: subnet}},
+		expectedErr: `subnetwork ("projects/my-project/regions/us-east1/subnetworks/subnet") is in network "projects/my-project/global/networks/other", not "projects/my-project/global/networks/default"`,
+	}, {
+		name:        "Fails if a subnet doesn't exist",
+		spec:        &Spec{Spec: api.Spec{NEGSubnetFQN: gcp.SubnetFQN("my-project", "us-east1", "missing")}},
+		expectedErr: "failed to get the neg_subnetwork projects/my-project/regions/us-east1/subnetworks/missing: not found (status 404)",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scoped, err := gcpClientInNetwork(gc, tt.spec)
+			require.NoError(t, err)
+			err = checkNetwork(context.Background(), scoped, tt.spec)
+			if tt.expectedErr != "" {
+				require.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestReconcileInAnotherNetwork(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	network := gcp.NetworkFQN(s.project, "other")
+	subnet := gcp.SubnetFQN(s.project, s.region, "other")
+	s.spec.Network = network
+	s.spec.Subnetwork = subnet
+	specStr, err := json.Marshal(s.spec)
+	require.NoError(t, err)
+	s.sts.Annotations[annotation] = string(specStr)
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	gcpClient.AddPrivateSubnetwork(network, subnet, "10.1.0.0/24")
+	r := New(c, gcpClient)
+
+	_, err = r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)})
+	require.NoError(t, err)
+	fw, err := gcpClient.GetFirewall(ctx, firewallName(s.spec.Prefix))
+	require.NoError(t, err)
+	require.Equal(t, network, fw.GetNetwork())
+	neg, err := gcpClient.GetNEG(ctx, negName(s.spec.Prefix))
+	require.NoError(t, err)
+	require.Equal(t, network, neg.GetNetwork())
+	require.Equal(t, subnet, neg.GetSubnetwork())
+	be, err := gcpClient.GetBackendService(ctx, backendName(s.spec.Prefix))
+	require.NoError(t, err)
+	require.Equal(t, network, be.GetNetwork())
+	rule, err := gcpClient.GetForwardingRule(ctx, fwdRuleName(s.spec.Prefix))
+	require.NoError(t, err)
+	require.Equal(t, network, rule.GetNetwork())
+	require.Equal(t, subnet, rule.GetSubnetwork())
+}
+
+func TestReconcileWithEndpointAnnotations(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	s.spec.EndpointAnnotations = map[string]string{"workload": "kafka"}
+	specStr, err := json.Marshal(s.spec)
+	require.NoError(t, err)
+	s.sts.Annotations[annotation] = string(specStr)
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	r := New(c, gcpClient)
+
+	_, err = r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)})
+	require.NoError(t, err)
+	eps, err := gcpClient.ListEndpoints(ctx, negName(s.spec.Prefix))
+	require.NoError(t, err)
+	require.Len(t, eps, len(s.pods.Items))
+	for _, ep := range eps {
+		require.Equal(t, s.spec.EndpointAnnotations, gcpClient.EndpointAnnotations(negName(s.spec.Prefix), ep.Port))
+	}
+}
+
+func TestGCPClientWithEndpointAnnotations(t *testing.T) {
+	gc := gcpfake.New("my-project", "us-east1")
+	spec := &Spec{}
+	annotated, err := gcpClientWithEndpointAnnotations(gc, spec)
+	require.NoError(t, err)
+	require.Same(t, gc, annotated)
+
+	spec.EndpointAnnotations = map[string]string{"workload": "kafka"}
+	annotated, err = gcpClientWithEndpointAnnotations(gc, spec)
+	require.NoError(t, err)
+	require.NotSame(t, gc, annotated)
+
+	_, err = gcpClientWithEndpointAnnotations(gcpfake.NewFaulty(gc, gcpfake.Faults{}), spec)
+	require.EqualError(t, err, "the spec sets endpoint_annotations, but the GCP client can't annotate endpoints")
+}
@@ -0,0 +1,68 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"go.uber.org/multierr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// reasonOperationInProgress is the reason of the events emitted while a GCP operation, e.g.
+	// creating a NEG or a service attachment, is taking a while.
+	reasonOperationInProgress = "OperationInProgress"
+	// reasonResourceInUse is the reason of the event emitted when a resource can't be deleted
+	// because another one uses it.
+	reasonResourceInUse = "ResourceInUse"
+	// reasonQuotaExceeded is the reason of the event emitted when the project is out of quota
+	// for a resource.
+	reasonQuotaExceeded = "QuotaExceeded"
+
+	// resourceNotReadyDelay is how long to wait before retrying when a resource another one
+	// depends on isn't ready yet, e.g. because it was just created. It isn't a failure.
+	resourceNotReadyDelay = 10 * time.Second
+)
+
+// withOperationEvents returns a context whose GCP operations emit an event on the STS every
+// gcp.OperationConfig.ProgressInterval while they're running, so that operators can see
+// long-running ones progressing.
+func (r *PortmapReconciler) withOperationEvents(ctx context.Context, sts *appsv1.StatefulSet) context.Context {
+	return gcp.WithOperationProgress(ctx, func(p gcp.OperationProgress) {
+		r.event(sts, corev1.EventTypeNormal, reasonOperationInProgress, "GCP operation %s (%s %s) is %s after %s, %d%% done",
+			p.Name, p.Type, p.TargetLink, p.Status, p.Elapsed.Round(time.Second), p.Progress)
+	})
+}
+
+// reportOperationErrors emits a Warning event on the STS for each of the GCP operation errors
+// operators can act on, naming the resource to deal with.
+func (r *PortmapReconciler) reportOperationErrors(sts *appsv1.StatefulSet, err error) {
+	for _, e := range multierr.Errors(err) {
+		var oe *gcp.OperationError
+		if !errors.As(e, &oe) {
+			continue
+		}
+		switch oe.Kind() {
+		case gcp.ErrorKindResourceInUse:
+			r.event(sts, corev1.EventTypeWarning, reasonResourceInUse, "%s can't be deleted until %s, which uses it, is deleted",
+				gcp.RelativeName(oe.TargetLink), oe.Resource(gcp.ErrorKindResourceInUse))
+		case gcp.ErrorKindQuotaExceeded:
+			r.event(sts, corev1.EventTypeWarning, reasonQuotaExceeded, "The project is out of quota, request an increase: %s", oe)
+		}
+	}
+}
+
+// onlyNotReady returns true if all of the errors are about resources that aren't ready yet,
+// which resolves itself.
+func onlyNotReady(err error) bool {
+	errs := multierr.Errors(err)
+	for _, e := range errs {
+		if gcp.ErrorKindOf(e) != gcp.ErrorKindResourceNotReady {
+			return false
+		}
+	}
+	return len(errs) > 0
+}
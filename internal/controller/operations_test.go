@@ -0,0 +1,119 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// failingBackend fails to create backend services with err.
+type failingBackend struct {
+	gcp.Client
+	err error
+}
+
+func (f *failingBackend) CreateBackendService(context.Context, string, string) error {
+	return f.err
+}
+
+func TestOperationErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		expectErr      bool
+		expectedResult reconcile.Result
+		expectedEvents []string
+	}{{
+		name:           "Resources that aren't ready are waited for",
+		err:            gcp.NewOperationError(http.StatusBadRequest, gcp.ErrorKindResourceNotReady, "", "The resource 'projects/my-project/regions/us-east1/networkEndpointGroups/neg' is not ready"),
+		expectedResult: reconcile.Result{RequeueAfter: resourceNotReadyDelay},
+	}, {
+		name:           "Exceeded quotas are reported",
+		err:            gcp.NewOperationError(http.StatusForbidden, gcp.ErrorKindQuotaExceeded, "", "Quota 'BACKEND_SERVICES' exceeded. Limit: 75.0 in region us-east1."),
+		expectErr:      true,
+		expectedResult: reconcile.Result{RequeueAfter: DefaultSettings().RequeueDelay},
+		expectedEvents: []string{"Warning QuotaExceeded The project is out of quota, request an increase: QUOTA_EXCEEDED: Quota 'BACKEND_SERVICES' exceeded. Limit: 75.0 in region us-east1."},
+	}, {
+		name:           "Other errors fail the reconcile",
+		err:            gcp.NewClientError(http.StatusInternalServerError, "internal error"),
+		expectErr:      true,
+		expectedResult: reconcile.Result{RequeueAfter: DefaultSettings().RequeueDelay},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := initialState()
+			c := fake.NewClientBuilder().
+				WithLists(s.nodes, s.pods).
+				WithObjects(s.sts).
+				Build()
+			gcpClient := &failingBackend{Client: gcpfake.New(s.project, s.region), err: tt.err}
+			rec := record.NewFakeRecorder(10)
+			r := New(c, gcpClient, WithEventRecorder(rec))
+			req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+
+			res, err := r.Reconcile(ctx, req)
+			if tt.expectErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.expectedResult, res)
+			close(rec.Events)
+			var events []string
+			for e := range rec.Events {
+				events = append(events, e)
+			}
+			require.Equal(t, tt.expectedEvents, events)
+		})
+	}
+}
+
+func TestResourceInUse(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	rec := record.NewFakeRecorder(10)
+	r := New(c, gcpClient, WithEventRecorder(rec))
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	// Another forwarding rule points to the backend service.
+	require.NoError(t, gcpClient.CreateForwardingRule(ctx, "other", backendName(s.spec.Prefix), "", nil, nil))
+
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	require.NoError(t, c.Delete(ctx, sts))
+	// The deletion is retried until the backend service isn't used anymore.
+	res, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, DefaultSettings().RequeueDelay, res.RequeueAfter)
+	require.Len(t, rec.Events, 1)
+	require.Equal(t, "Warning ResourceInUse projects/my-project/regions/us-east1/backendServices/prefix-psc-portmapper-backend can't be deleted until projects/my-project/regions/us-east1/forwardingRules/other, which uses it, is deleted", <-rec.Events)
+	_, err = gcpClient.GetNEG(ctx, negName(s.spec.Prefix))
+	require.NoError(t, err)
+
+	require.NoError(t, gcpClient.DeleteForwardingRule(ctx, "other"))
+	res, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Zero(t, res)
+	_, err = gcpClient.GetNEG(ctx, negName(s.spec.Prefix))
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+	require.True(t, apierrors.IsNotFound(c.Get(ctx, req.NamespacedName, sts)))
+}
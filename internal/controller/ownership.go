@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"go.uber.org/multierr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// reasonNotOwned is the reason of the event emitted when the controller refuses to modify a
+// resource it didn't create.
+const reasonNotOwned = "ResourceNotOwned"
+
+// errNotOwned is returned instead of modifying or deleting a resource that has one of the
+// derived names but wasn't created by the controller, e.g. a user's firewall.
+var errNotOwned = errors.New("isn't managed by psc-portmapper")
+
+// described is implemented by all the compute resources the controller manages.
+type described interface {
+	GetDescription() string
+}
+
+// ownership decides whether the resources found by name belong to the controller, which marks
+// the ones it creates with gcp.ManagedDescription.
+type ownership struct {
+	// trustUnmarked is true if resources without a description are the controller's too,
+	// since older controllers didn't set one.
+	trustUnmarked bool
+}
+
+// ownershipFor returns the ownership of the STS' resources. Unmarked resources are only
+// trusted if the STS was reconciled successfully before, or by a controller that predates the
+// status annotation, since they were then created, or at least managed, by an older
+// controller. Otherwise they were already there.
+func ownershipFor(sts *appsv1.StatefulSet) ownership {
+	status := parseStatus(sts)
+	return ownership{trustUnmarked: status.LastDriftCheck != nil || status.LegacyResources || legacyStatefulSet(sts)}
+}
+
+// legacyStatefulSet returns true if the STS was reconciled by a controller that didn't write
+// the status annotation, and so didn't mark the resources it created either: it has the
+// finalizer but no status. The controller writes the status along with the finalizer, see
+// initialStatus.
+func legacyStatefulSet(sts *appsv1.StatefulSet) bool {
+	_, ok := sts.Annotations[statusAnnotation]
+	return !ok && controllerutil.ContainsFinalizer(sts, finalizer)
+}
+
+// check returns errNotOwned if res doesn't belong to the controller.
+func (o ownership) check(kind, name string, res described) error {
+	switch desc := res.GetDescription(); {
+	case desc == gcp.ManagedDescription:
+		return nil
+	case desc == "" && o.trustUnmarked:
+		return nil
+	default:
+		return fmt.Errorf("%s %s %w, as its description is %q. Rename it or change the spec's prefix", kind, name, errNotOwned, desc)
+	}
+}
+
+// deleteOwned gets the resource and deletes it if it belongs to the controller. It returns
+// gcp.ErrNotFound if it doesn't exist.
+func deleteOwned[T described](ctx context.Context, o ownership, kind, name string, get func(context.Context, string) (T, error), del func(context.Context, string) error) error {
+	res, err := get(ctx, name)
+	if err != nil {
+		return err
+	}
+	err = o.check(kind, name, res)
+	if err != nil {
+		return err
+	}
+	return del(ctx, name)
+}
+
+// reportNotOwned emits a Warning event for each resource err says the controller refused to
+// modify.
+func (r *PortmapReconciler) reportNotOwned(sts *appsv1.StatefulSet, err error) {
+	for _, e := range multierr.Errors(err) {
+		if errors.Is(e, errNotOwned) {
+			r.event(sts, corev1.EventTypeWarning, reasonNotOwned, "Refusing to modify a resource: %s", e)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestUnownedFirewall(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	// A user's firewall happens to have the derived name.
+	name := firewallName(s.spec.Prefix)
+	gcpClient.AddFirewall(name, "Allows SSH.", map[int32]struct{}{22: {}})
+	rec := record.NewFakeRecorder(100)
+	r := New(c, gcpClient, WithEventRecorder(rec))
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+
+	_, err := r.Reconcile(ctx, req)
+	require.ErrorIs(t, err, errNotOwned)
+	fw, err := gcpClient.GetFirewall(ctx, name)
+	require.NoError(t, err)
+	require.Equal(t, []string{"22"}, fw.Allowed[0].Ports)
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	require.True(t, meta.IsStatusConditionFalse(parseStatus(sts).Conditions, "FirewallReady"))
+	// The other resources don't depend on the firewall.
+	_, err = gcpClient.GetServiceAttachment(ctx, svcAttName(s.spec.Prefix))
+	require.NoError(t, err)
+
+	// It's left behind when the STS is deleted.
+	require.NoError(t, c.Delete(ctx, sts))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	_, err = gcpClient.GetFirewall(ctx, name)
+	require.NoError(t, err)
+	_, err = gcpClient.GetServiceAttachment(ctx, svcAttName(s.spec.Prefix))
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+
+	close(rec.Events)
+	notOwned := 0
+	for e := range rec.Events {
+		if e == "Warning ResourceNotOwned Refusing to modify a resource: firewall "+name+` isn't managed by psc-portmapper, as its description is "Allows SSH.". Rename it or change the spec's prefix` {
+			notOwned++
+		}
+	}
+	require.Equal(t, 2, notOwned)
+}
+
+func TestOwnershipCheck(t *testing.T) {
+	reconciled := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		statusAnnotation: `{"last_drift_check": "2024-01-01T00:00:00Z"}`,
+	}}}
+	tests := []struct {
+		name        string
+		sts         *appsv1.StatefulSet
+		description string
+		expectedErr error
+	}{{
+		name:        "Owns the resources it created",
+		sts:         &appsv1.StatefulSet{},
+		description: gcp.ManagedDescription,
+	}, {
+		name:        "Doesn't own unmarked resources of new StatefulSets",
+		sts:         &appsv1.StatefulSet{},
+		expectedErr: errNotOwned,
+	}, {
+		name: "Owns unmarked resources of StatefulSets reconciled before",
+		sts:  reconciled,
+	}, {
+		name: "Owns unmarked resources of StatefulSets reconciled by controllers without a status",
+		sts:  &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Finalizers: []string{finalizer}}},
+	}, {
+		name: "Keeps owning the unmarked resources of StatefulSets reconciled by controllers without a status",
+		sts: &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+			statusAnnotation: `{"legacy_resources": true}`,
+		}}},
+	}, {
+		name: "Doesn't own unmarked resources of StatefulSets that failed their first reconcile",
+		sts: &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+			Finalizers:  []string{finalizer},
+			Annotations: map[string]string{statusAnnotation: `{"controller_version": "v1.0.0"}`},
+		}},
+		expectedErr: errNotOwned,
+	}, {
+		name:        "Doesn't own other resources",
+		sts:         reconciled,
+		description: "Allows SSH.",
+		expectedErr: errNotOwned,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fw := firewall(nil)
+			fw.Description = &tt.description
+			err := ownershipFor(tt.sts).check("firewall", "fw", fw)
+			require.ErrorIs(t, err, tt.expectedErr)
+			if tt.expectedErr == nil {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestAdoptLegacyResources(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	r := New(c, gcpClient)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	// The resources and the STS as a controller that didn't mark them left them.
+	gcpClient.ClearDescriptions()
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	delete(sts.Annotations, statusAnnotation)
+	delete(sts.Annotations, lastAppliedAnnotation)
+	require.NoError(t, c.Update(ctx, sts))
+
+	r = New(c, gcpClient)
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	require.True(t, parseStatus(sts).LegacyResources)
+
+	require.NoError(t, c.Delete(ctx, sts))
+	require.Eventually(t, func() bool {
+		_, _ = r.Reconcile(ctx, req)
+		return apierrors.IsNotFound(c.Get(ctx, req.NamespacedName, &appsv1.StatefulSet{}))
+	}, 5*time.Second, time.Millisecond)
+	_, err = gcpClient.GetServiceAttachment(ctx, svcAttName(s.spec.Prefix))
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+	_, err = gcpClient.GetForwardingRule(ctx, fwdRuleName(s.spec.Prefix))
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+	_, err = gcpClient.GetBackendService(ctx, backendName(s.spec.Prefix))
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+	_, err = gcpClient.GetNEG(ctx, negName(s.spec.Prefix))
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+	_, err = gcpClient.GetFirewall(ctx, firewallName(s.spec.Prefix))
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+}
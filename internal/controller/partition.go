@@ -0,0 +1,56 @@
+package controller
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/ptr"
+)
+
+// PartitionStatus reports the port mappings of a StatefulSet whose rolling updates are
+// partitioned: the pods whose ordinal is below the partition keep their revision, and only the
+// others are replaced.
+type PartitionStatus struct {
+	// The STS' spec.updateStrategy.rollingUpdate.partition.
+	Partition int32 `json:"partition"`
+	// How many of the pods below the partition are mapped, out of how many there should be.
+	StableMapped int32 `json:"stable_mapped"`
+	StablePods   int32 `json:"stable_pods"`
+	// How many of the pods at or above the partition are mapped, out of how many there should be.
+	UpdatedMapped int32 `json:"updated_mapped"`
+	UpdatedPods   int32 `json:"updated_pods"`
+}
+
+// stsPartition returns the STS' rolling update partition, or nil if it doesn't set one.
+func stsPartition(sts *appsv1.StatefulSet) *int32 {
+	ru := sts.Spec.UpdateStrategy.RollingUpdate
+	if sts.Spec.UpdateStrategy.Type == appsv1.OnDeleteStatefulSetStrategyType || ru == nil || ptr.Deref(ru.Partition, 0) == 0 {
+		return nil
+	}
+	return ru.Partition
+}
+
+// partitionStatus counts the mapped pods on each side of the STS' partition, as per
+// getPortMappings. It returns nil if the STS doesn't set a partition.
+func partitionStatus(sts *appsv1.StatefulSet, pods []corev1.Pod) *PartitionStatus {
+	partition := stsPartition(sts)
+	if partition == nil {
+		return nil
+	}
+	start := ordinalsStart(sts)
+	replicas := ptr.Deref(sts.Spec.Replicas, 1)
+	stable := min(max(*partition-start, 0), replicas)
+	status := &PartitionStatus{Partition: *partition, StablePods: stable, UpdatedPods: replicas - stable}
+	for i := range pods {
+		pod := &pods[i]
+		index, ok := podIndex(sts, pod)
+		if !ok || pod.Spec.NodeName == "" {
+			continue
+		}
+		if index+start < *partition {
+			status.StableMapped++
+		} else {
+			status.UpdatedMapped++
+		}
+	}
+	return status
+}
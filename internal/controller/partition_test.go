@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+func TestPartitionStatus(t *testing.T) {
+	pods := func(nodeNames ...string) []corev1.Pod {
+		pods := make([]corev1.Pod, 0, len(nodeNames))
+		for i, n := range nodeNames {
+			pods = append(pods, corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("sts-%d", i)},
+				Spec:       corev1.PodSpec{NodeName: n},
+			})
+		}
+		return pods
+	}
+
+	tests := []struct {
+		name     string
+		strategy appsv1.StatefulSetUpdateStrategy
+		ordinals *appsv1.StatefulSetOrdinals
+		pods     []corev1.Pod
+		expected *PartitionStatus
+	}{{
+		name:     "Isn't reported without a partition",
+		strategy: appsv1.StatefulSetUpdateStrategy{Type: appsv1.RollingUpdateStatefulSetStrategyType},
+		pods:     pods("node-0", "node-1", "node-2", "node-3"),
+	}, {
+		name: "Isn't reported if the partition is 0",
+		strategy: appsv1.StatefulSetUpdateStrategy{
+			RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: ptr.To(int32(0))},
+		},
+		pods: pods("node-0", "node-1", "node-2", "node-3"),
+	}, {
+		name: "Counts the mapped pods on each side of the partition",
+		strategy: appsv1.StatefulSetUpdateStrategy{
+			RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: ptr.To(int32(2))},
+		},
+		// The third pod is being replaced, so it isn't scheduled yet.
+		pods:     pods("node-0", "node-1", "", "node-3"),
+		expected: &PartitionStatus{Partition: 2, StableMapped: 2, StablePods: 2, UpdatedMapped: 1, UpdatedPods: 2},
+	}, {
+		name: "Compares the partition with the ordinals",
+		strategy: appsv1.StatefulSetUpdateStrategy{
+			RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: ptr.To(int32(3))},
+		},
+		ordinals: &appsv1.StatefulSetOrdinals{Start: 2},
+		pods:     pods("node-0", "node-1", "node-2", "node-3", "node-4", "node-5"),
+		expected: &PartitionStatus{Partition: 3, StableMapped: 1, StablePods: 1, UpdatedMapped: 3, UpdatedPods: 3},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sts := &appsv1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{Name: "sts"},
+				Spec: appsv1.StatefulSetSpec{
+					Replicas:       ptr.To(int32(4)),
+					UpdateStrategy: tt.strategy,
+					Ordinals:       tt.ordinals,
+				},
+			}
+			require.Equal(t, tt.expected, partitionStatus(sts, tt.pods))
+		})
+	}
+}
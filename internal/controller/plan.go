@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"cmp"
+	"errors"
+	"slices"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// DesiredState is what reconciling a StatefulSet's spec would create, as computed by Plan. See
+// pkg/plan, which exposes it to other tools.
+type DesiredState struct {
+	// Spec is the parsed spec, with the settings' defaults applied.
+	Spec *Spec
+	// The names of the Kubernetes objects created for the spec. PortsConfigMap is empty unless
+	// the spec sets ports_config_map.
+	NodePortService string
+	PortsConfigMap  string
+	// Firewalls are the firewall rules allowing the node ports, by name.
+	Firewalls map[string]gcp.FirewallRule
+	// ICMPFirewall is the name of the rule allowing ICMP, if the spec sets allow_icmp. Its
+	// sources are the NAT subnets' ranges, which are only known to GCP.
+	ICMPFirewall   string
+	NEG            string
+	BackendService string
+	// Attachments are the forwarding rules and service attachments, the original ones first.
+	// There are none while the STS is torn down as per scale_to_zero.
+	Attachments []Attachment
+	// Canary is the name of the canary consumer endpoint, if there's one.
+	Canary string
+	// Mappings are sorted by port.
+	Mappings []*gcp.PortMapping
+	Unmapped []UnmappedPod
+}
+
+// Attachment is a forwarding rule and the service attachment publishing it.
+type Attachment struct {
+	ForwardingRule    string
+	ServiceAttachment string
+	// Set for the ones created in the spec's migration subnet.
+	Migration bool
+}
+
+// Plan computes the desired state of the StatefulSet's spec from its pods and the nodes they're
+// scheduled on, without calling GCP. project is the one the nodes' instances are assumed to be
+// in, if they aren't read from their provider IDs. The consumers referenced with
+// consumer_accept_list_from aren't resolved, since they're read from a ConfigMap.
+func Plan(sts *appsv1.StatefulSet, pods []corev1.Pod, nodes []corev1.Node, project string, settings Settings) (*DesiredState, error) {
+	jsonSpec, ok := sts.Annotations[annotation]
+	if !ok {
+		return nil, errors.New("the STS is missing the " + annotation + " annotation")
+	}
+	log := logr.Discard()
+	spec, err := parseSpec(log, jsonSpec, settings.SpecDefaults, settings.Policy)
+	if err != nil {
+		return nil, err
+	}
+	err = validateTargetPorts(spec, &sts.Spec.Template.Spec)
+	if err != nil {
+		return nil, err
+	}
+	resolveMigration(log, sts, spec)
+	resolveScaleToZero(sts, spec)
+	resolveCanary(spec, settings.CanarySubnet)
+
+	byName := make(map[string]*corev1.Node, len(nodes))
+	for i := range nodes {
+		byName[nodes[i].Name] = &nodes[i]
+	}
+	// The pods on nodes whose provider ID isn't set yet are reported as unmapped.
+	instances, _, err := nodeInstances(log, byName, settings.InstanceSources, project)
+	if err != nil {
+		return nil, err
+	}
+	capacity, _ := portCapacity(spec, settings.NEGEndpointLimit)
+	mappings, unmapped := portMappings(spec, sts, instances, pods, capacity)
+	slices.SortFunc(mappings, func(a, b *gcp.PortMapping) int {
+		return cmp.Or(cmp.Compare(a.Port, b.Port), cmp.Compare(a.InstancePort, b.InstancePort))
+	})
+
+	ports := map[int32]struct{}{}
+	for _, p := range spec.NodePorts {
+		ports[p.NodePort] = struct{}{}
+	}
+	state := &DesiredState{
+		Spec:            spec,
+		NodePortService: nodeportName(spec.Prefix),
+		Firewalls:       firewallRules(spec, ports),
+		NEG:             negName(spec.Prefix),
+		BackendService:  backendName(spec.Prefix),
+		Mappings:        mappings,
+		Unmapped:        unmapped,
+	}
+	if spec.PortsConfigMap {
+		state.PortsConfigMap = portsConfigMapName(spec.Prefix)
+	}
+	if spec.AllowICMP {
+		state.ICMPFirewall = icmpFirewallName(spec.Prefix)
+	}
+	if spec.tornDown {
+		return state, nil
+	}
+	if spec.Migration == nil || !spec.migrationAcknowledged {
+		state.Attachments = append(state.Attachments, Attachment{
+			ForwardingRule:    fwdRuleName(spec.Prefix),
+			ServiceAttachment: svcAttName(spec.Prefix),
+		})
+	}
+	if spec.Migration != nil {
+		state.Attachments = append(state.Attachments, Attachment{
+			ForwardingRule:    migrationFwdRuleName(spec.Prefix),
+			ServiceAttachment: migrationSvcAttName(spec.Prefix),
+			Migration:         true,
+		})
+	}
+	if spec.Canary && spec.canarySubnet != "" {
+		state.Canary = canaryName(spec.Prefix)
+	}
+	return state, nil
+}
@@ -0,0 +1,200 @@
+package controller
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"go.uber.org/multierr"
+)
+
+// Policy restricts what specs can configure, so that a misconfigured spec can't expose the
+// cluster too broadly. Specs violating it are rejected as invalid.
+type Policy struct {
+	// If set, node ports must be in one of these ranges.
+	AllowedNodePortRanges []PortRange `json:"allowed_node_port_ranges,omitempty"`
+	// If set, consumers must be in one of these projects. Consumers set by network_fqn are
+	// checked by the network's project.
+	AllowedConsumerProjects []string `json:"allowed_consumer_projects,omitempty"`
+	// If true, consumers must set a connection_limit.
+	RequireConnectionLimit bool `json:"require_connection_limit,omitempty"`
+	// If set, consumers' connection_limit can't be higher.
+	MaxConnectionLimit uint32 `json:"max_connection_limit,omitempty"`
+	// The firewall's source ranges can't be as broad as any of these, e.g. 0.0.0.0/0.
+	DeniedSourceRanges []string `json:"denied_source_ranges,omitempty"`
+	// CEL expressions that specs must satisfy, for guardrails the fields above can't express.
+	Rules []Rule `json:"rules,omitempty"`
+
+	// The rules' compiled expressions, set by Validate.
+	programs []cel.Program
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Min int32 `json:"min"`
+	Max int32 `json:"max"`
+}
+
+func (r PortRange) contains(port int32) bool {
+	return port >= r.Min && port <= r.Max
+}
+
+// ParsePolicy decodes and validates a policy, e.g. from the controller's config file,
+// rejecting unknown fields. It returns nil if data is empty.
+func ParsePolicy(data []byte) (*Policy, error) {
+	if isEmptyJSON(data) {
+		return nil, nil
+	}
+	p := &Policy{}
+	err := decodeStrict(data, p)
+	if err == nil {
+		err = p.Validate()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	return p, nil
+}
+
+// Validate returns an error if the policy itself is invalid, e.g. if a rule doesn't compile.
+func (p *Policy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	var err error
+	for i, r := range p.AllowedNodePortRanges {
+		if r.Min > r.Max {
+			err = multierr.Append(err, fmt.Errorf("allowed_node_port_ranges[%d]'s min (%d) is higher than its max (%d)", i, r.Min, r.Max))
+		}
+	}
+	for i, r := range p.DeniedSourceRanges {
+		_, parseErr := netip.ParsePrefix(r)
+		if parseErr != nil {
+			err = multierr.Append(err, fmt.Errorf("invalid denied_source_ranges[%d]: %w", i, parseErr))
+		}
+	}
+	programs, compileErr := compileRules(p.Rules)
+	if compileErr != nil {
+		return multierr.Append(err, compileErr)
+	}
+	p.programs = programs
+	return err
+}
+
+// firewallSourceRanges returns the source ranges of the spec's firewall rules. If a rule sets no
+// sources at all, GCP allows all of them.
+func firewallSourceRanges(spec *Spec) []string {
+	var ranges []string
+	for _, rule := range firewallRules(spec, nil) {
+		if len(rule.SourceRanges) == 0 && len(rule.SourceTags) == 0 {
+			rule.SourceRanges = []string{"0.0.0.0/0"}
+		}
+		for _, r := range rule.SourceRanges {
+			if !slices.Contains(ranges, r) {
+				ranges = append(ranges, r)
+			}
+		}
+	}
+	slices.Sort(ranges)
+	return ranges
+}
+
+// validate returns an error for each of the spec's violations of the policy.
+func (p *Policy) validate(spec *Spec) error {
+	if p == nil {
+		return nil
+	}
+	var err error
+	if len(p.AllowedNodePortRanges) > 0 {
+		// Sorted so that errors are deterministic.
+		names := make([]string, 0, len(spec.NodePorts))
+		for name := range spec.NodePorts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			port := spec.NodePorts[name].NodePort
+			if !slices.ContainsFunc(p.AllowedNodePortRanges, func(r PortRange) bool { return r.contains(port) }) {
+				err = multierr.Append(err, fmt.Errorf("node_ports[%q].node_port (%d) isn't in the allowed ranges %v", name, port, p.AllowedNodePortRanges))
+			}
+		}
+	}
+	for i, c := range spec.ConsumerAcceptList {
+		if len(p.AllowedConsumerProjects) > 0 {
+			project := consumerProject(c)
+			if !slices.Contains(p.AllowedConsumerProjects, project) {
+				err = multierr.Append(err, fmt.Errorf("consumer_list[%d]'s project (%q) isn't allowed", i, project))
+			}
+		}
+		if p.RequireConnectionLimit && c.ConnectionLimit == 0 {
+			err = multierr.Append(err, fmt.Errorf("connection_limit must be set in consumer_list[%d]", i))
+		}
+		if p.MaxConnectionLimit > 0 && c.ConnectionLimit > p.MaxConnectionLimit {
+			err = multierr.Append(err, fmt.Errorf("connection_limit (%d) in consumer_list[%d] is higher than the maximum (%d)", c.ConnectionLimit, i, p.MaxConnectionLimit))
+		}
+	}
+	for _, src := range firewallSourceRanges(spec) {
+		for _, denied := range p.DeniedSourceRanges {
+			if covers(src, denied) {
+				err = multierr.Append(err, fmt.Errorf("the firewall's source range %s is denied by the policy (%s)", src, denied))
+			}
+		}
+	}
+	return multierr.Append(err, p.validateRules(spec))
+}
+
+// validateRules returns an error for each rule the spec doesn't satisfy. The rules are compiled
+// if the policy wasn't validated.
+func (p *Policy) validateRules(spec *Spec) error {
+	if len(p.Rules) == 0 {
+		return nil
+	}
+	programs := p.programs
+	if len(programs) != len(p.Rules) {
+		var err error
+		programs, err = compileRules(p.Rules)
+		if err != nil {
+			return err
+		}
+	}
+	input, err := ruleInput(spec)
+	if err != nil {
+		return fmt.Errorf("couldn't encode the spec for the rules: %w", err)
+	}
+	for i, r := range p.Rules {
+		err = multierr.Append(err, evalRule(r, programs[i], input))
+	}
+	return err
+}
+
+// consumerProject returns the consumer's project ID or number.
+func consumerProject(c *Consumer) string {
+	if c.ProjectIdOrNum != nil {
+		return *c.ProjectIdOrNum
+	}
+	if c.NetworkFQN != nil {
+		// projects/<project>/global/networks/<network>
+		parts := strings.Split(*c.NetworkFQN, "/")
+		if len(parts) > 1 {
+			return parts[1]
+		}
+	}
+	return ""
+}
+
+// covers returns true if the CIDR range a is at least as broad as b and contains it. Invalid
+// ranges never cover, so they must be validated beforehand.
+func covers(a, b string) bool {
+	pa, err := netip.ParsePrefix(a)
+	if err != nil {
+		return false
+	}
+	pb, err := netip.ParsePrefix(b)
+	if err != nil {
+		return false
+	}
+	return pa.Bits() <= pb.Bits() && pa.Contains(pb.Addr())
+}
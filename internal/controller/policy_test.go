@@ -0,0 +1,218 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/0x5d/psc-portmapper/api"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestPolicyValidate(t *testing.T) {
+	spec := func() *Spec {
+		return &Spec{Spec: api.Spec{
+			NodePorts: map[string]PortConfig{
+				"kafka": {NodePort: 30000},
+				"admin": {NodePort: 32000},
+			},
+			ConsumerAcceptList: []*Consumer{{
+				ProjectIdOrNum:  stringPtr("project1"),
+				ConnectionLimit: 10,
+			}, {
+				NetworkFQN:      stringPtr("projects/project2/global/networks/my-vpc"),
+				ConnectionLimit: 100,
+			}},
+		}}
+	}
+
+	tests := []struct {
+		name        string
+		policy      *Policy
+		spec        *Spec
+		expectedErr string
+	}{{
+		name: "A nil policy allows everything",
+		spec: spec(),
+	}, {
+		name:   "An empty policy allows everything",
+		policy: &Policy{},
+		spec:   spec(),
+	}, {
+		name:   "Allows node ports in the allowed ranges",
+		policy: &Policy{AllowedNodePortRanges: []PortRange{{Min: 30000, Max: 30999}, {Min: 32000, Max: 32000}}},
+		spec:   spec(),
+	}, {
+		name:        "Rejects node ports outside the allowed ranges",
+		policy:      &Policy{AllowedNodePortRanges: []PortRange{{Min: 30000, Max: 30999}}},
+		spec:        spec(),
+		expectedErr: `node_ports["admin"].node_port (32000) isn't in the allowed ranges [{30000 30999}]`,
+	}, {
+		name:   "Allows consumers in the allowed projects",
+		policy: &Policy{AllowedConsumerProjects: []string{"project1", "project2"}},
+		spec:   spec(),
+	}, {
+		name:        "Rejects consumers in other projects, including by network",
+		policy:      &Policy{AllowedConsumerProjects: []string{"project1"}},
+		spec:        spec(),
+		expectedErr: `consumer_list[1]'s project ("project2") isn't allowed`,
+	}, {
+		name:   "Rejects consumers without a connection limit if it's required",
+		policy: &Policy{RequireConnectionLimit: true},
+		spec: &Spec{Spec: api.Spec{ConsumerAcceptList: []*Consumer{{
+			ProjectIdOrNum: stringPtr("project1"),
+		}}}},
+		expectedErr: "connection_limit must be set in consumer_list[0]",
+	}, {
+		name:        "Rejects connection limits above the maximum",
+		policy:      &Policy{MaxConnectionLimit: 50},
+		spec:        spec(),
+		expectedErr: "connection_limit (100) in consumer_list[1] is higher than the maximum (50)",
+	}, {
+		name:        "Rejects denied firewall source ranges",
+		policy:      &Policy{DeniedSourceRanges: []string{"0.0.0.0/0"}},
+		spec:        spec(),
+		expectedErr: "the firewall's source range 0.0.0.0/0 is denied by the policy (0.0.0.0/0)",
+	}, {
+		name:        "Rejects source ranges broader than denied ones",
+		policy:      &Policy{DeniedSourceRanges: []string{"10.0.0.0/8"}},
+		spec:        spec(),
+		expectedErr: "the firewall's source range 0.0.0.0/0 is denied by the policy (10.0.0.0/8)",
+	}, {
+		name:   "Accepts the spec's source ranges narrower than denied ones",
+		policy: &Policy{DeniedSourceRanges: []string{"10.0.0.0/8"}},
+		spec: func() *Spec {
+			s := spec()
+			s.SourceRanges = []string{"10.1.0.0/16"}
+			return s
+		}(),
+	}, {
+		name:   "Accepts rules that only allow source tags",
+		policy: &Policy{DeniedSourceRanges: []string{"0.0.0.0/0"}},
+		spec: func() *Spec {
+			s := spec()
+			s.SourceTags = []string{"bastion"}
+			return s
+		}(),
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.validate(tt.spec)
+			if tt.expectedErr != "" {
+				require.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestValidatePolicy(t *testing.T) {
+	require.NoError(t, (&Policy{
+		AllowedNodePortRanges: []PortRange{{Min: 30000, Max: 30000}},
+		DeniedSourceRanges:    []string{"0.0.0.0/0", "::/0"},
+	}).Validate())
+	require.EqualError(t, (&Policy{
+		AllowedNodePortRanges: []PortRange{{Min: 31000, Max: 30000}},
+		DeniedSourceRanges:    []string{"everything"},
+	}).Validate(), `allowed_node_port_ranges[0]'s min (31000) is higher than its max (30000); invalid denied_source_ranges[0]: netip.ParsePrefix("everything"): no '/'`)
+}
+
+func TestParsePolicy(t *testing.T) {
+	p, err := ParsePolicy(nil)
+	require.NoError(t, err)
+	require.Nil(t, p)
+	p, err = ParsePolicy([]byte(`{"allowed_node_port_ranges": [{"min": 30000, "max": 30100}]}`))
+	require.NoError(t, err)
+	require.Equal(t, []PortRange{{Min: 30000, Max: 30100}}, p.AllowedNodePortRanges)
+	_, err = ParsePolicy([]byte(`{"allowed_node_port_range": []}`))
+	require.ErrorContains(t, err, `invalid policy: json: unknown field "allowed_node_port_range"`)
+	_, err = ParsePolicy([]byte(`{"allowed_node_port_ranges": [{"min": 30100, "max": 30000}]}`))
+	require.ErrorContains(t, err, "invalid policy: allowed_node_port_ranges[0]'s min (30100) is higher than its max (30000)")
+}
+
+func TestPolicyRules(t *testing.T) {
+	spec := &Spec{Spec: api.Spec{
+		Prefix: "team-kafka-",
+		NodePorts: map[string]PortConfig{
+			"kafka": {NodePort: 30000, ContainerPort: 9092},
+		},
+	}}
+
+	tests := []struct {
+		name        string
+		rules       []Rule
+		expectedErr string
+	}{{
+		name:  "Accepts specs satisfying the rules",
+		rules: []Rule{{Expression: `spec.prefix.startsWith("team-")`}, {Expression: `!has(spec.ip)`}},
+	}, {
+		name:  "Compares ints",
+		rules: []Rule{{Expression: `spec.node_ports.all(n, spec.node_ports[n].node_port >= 30000 && spec.node_ports[n].node_port <= 31000)`}},
+	}, {
+		name:        "Rejects specs with the rule's message",
+		rules:       []Rule{{Expression: `spec.prefix.startsWith("ops-")`, Message: "the prefix must start with the team's code"}},
+		expectedErr: "the prefix must start with the team's code",
+	}, {
+		name:        "Rejects specs with the expression if there's no message",
+		rules:       []Rule{{Expression: `spec.node_ports.size() > 1`}},
+		expectedErr: `the spec doesn't satisfy the rule "spec.node_ports.size() > 1"`,
+	}, {
+		name:        "Rejects specs the rule fails to evaluate against",
+		rules:       []Rule{{Expression: `spec.ip == "10.0.0.1"`}},
+		expectedErr: `failed to evaluate the rule "spec.ip == \"10.0.0.1\"": no such key: ip`,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := &Policy{Rules: tt.rules}
+			require.NoError(t, policy.Validate())
+			err := policy.validate(spec)
+			if tt.expectedErr != "" {
+				require.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestValidatePolicyRules(t *testing.T) {
+	require.ErrorContains(t, (&Policy{Rules: []Rule{{Expression: "spec.prefix.startsWith("}}}).Validate(), "invalid rules[0]")
+	require.EqualError(t, (&Policy{Rules: []Rule{{Expression: `"not a bool"`}}}).Validate(), "rules[0] evaluates to string instead of a bool")
+}
+
+func TestDeleteUnderStricterPolicy(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().WithLists(s.nodes, s.pods).WithObjects(s.sts).Build()
+	gc := gcpfake.New(s.project, s.region)
+	r := New(c, gc)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	// The policy is tightened so that the spec's node port isn't allowed anymore.
+	settings := DefaultSettings()
+	settings.Policy = &Policy{AllowedNodePortRanges: []PortRange{{Min: 31000, Max: 32767}}}
+	r.SetSettings(settings)
+	_, err = r.Reconcile(ctx, req)
+	require.ErrorContains(t, err, "the spec violates the policy")
+
+	// The StatefulSet can still be deleted.
+	require.NoError(t, c.Delete(ctx, s.sts))
+	require.Eventually(t, func() bool {
+		_, _ = r.Reconcile(ctx, req)
+		return apierrors.IsNotFound(c.Get(ctx, req.NamespacedName, &appsv1.StatefulSet{}))
+	}, 5*time.Second, time.Millisecond)
+	_, err = gc.GetServiceAttachment(ctx, svcAttName(s.spec.Prefix))
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+}
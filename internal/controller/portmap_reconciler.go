@@ -4,27 +4,42 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"regexp"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/0x5d/psc-portmapper/api"
 	"github.com/0x5d/psc-portmapper/internal/gcp"
 	"github.com/go-logr/logr"
-	"golang.org/x/sync/errgroup"
+	"github.com/google/uuid"
+	"go.uber.org/multierr"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 const (
-	annotation         = "psc-portmapper.0x5d.org/spec"
+	annotation         = api.SpecAnnotation
+	classAnnotation    = "psc-portmapper.0x5d.org/class"
 	hostnameAnnotation = "kubernetes.io/hostname"
 
 	managedByLabel = "app.kubernetes.io/managed-by"
@@ -32,29 +47,230 @@ const (
 
 	finalizer = "psc-portmapper.0x5d.org/finalizer"
 
-	requeueDelay = time.Minute
+	defaultRequeueDelay = time.Minute
+
+	defaultDriftCheckInterval = 10 * time.Minute
 )
 
+// errDeletionPending is returned by delete when a resource still exists after being deleted.
+// It isn't a failure, the deletion is just checked again later.
+var errDeletionPending = errors.New("waiting for the resources to be deleted")
+
 type PortmapReconciler struct {
 	client.Client
-	gcp gcp.Client
+	// reader is used for objects the manager shouldn't cache, like Secrets.
+	reader  client.Reader
+	gcp     gcp.Client
+	clients gcp.ClientProvider
+	// The settings that can be changed while the reconciler runs. See SetSettings.
+	settingsMu  sync.RWMutex
+	settings    Settings
+	rateLimiter *rateLimiter
+	// Only StatefulSets of this class are reconciled. See WithClass.
+	class string
+	// Only StatefulSets in this shard are reconciled. See WithShard.
+	shard Shard
+	// See StuckCheck and Settings.StuckAfterFailures.
+	failures failures
+	// See LastResults.
+	lastResults lastResults
+	// See Settings.BulkOperationsPerMinute.
+	bulk bulk
+	// Records events on StatefulSets. See WithEventRecorder.
+	recorder record.EventRecorder
+	// The names of GCP resources changed out of band. See ResourceChanged.
+	gcpChanges    chan event.TypedGenericEvent[string]
+	driftSuspects driftSuspects
+	// See Settings.StatusWriteInterval.
+	statusWrites statusWrites
+	// See isUpToDate.
+	appliedStates appliedStates
+	// Resources checked for drift before the controller started are checked again, since they
+	// could have drifted while it was down.
+	startedAt time.Time
+	// See reportAdoption.
+	adoptionReports adoptionReports
+	// See WithStateStore.
+	stateStore gcp.ObjectStore
+	// Opens the connections of the probes. See Settings.ProbeTimeout.
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Option configures optional PortmapReconciler behavior.
+type Option func(*PortmapReconciler)
+
+// WithClientProvider enables per-spec credentials, using p to build the GCP clients for them.
+func WithClientProvider(p gcp.ClientProvider) Option {
+	return func(r *PortmapReconciler) {
+		r.clients = p
+	}
+}
+
+// WithAPIReader sets the reader used to get Secrets and Namespaces. It defaults to the
+// reconciler's client.
+func WithAPIReader(reader client.Reader) Option {
+	return func(r *PortmapReconciler) {
+		r.reader = reader
+	}
+}
+
+// WithDriftCheckInterval sets how often the GCP resources are checked for drift when the
+// desired state doesn't change. Until then, reconciles where the spec, the pods' placement and
+// the replica count didn't change are skipped without calling the GCP API. 0 disables skipping.
+func WithDriftCheckInterval(d time.Duration) Option {
+	return func(r *PortmapReconciler) {
+		r.settings.DriftCheckInterval = d
+	}
+}
+
+// WithClass sets the controller's class. Only StatefulSets whose class annotation matches it
+// are reconciled, like with IngressClasses, so that several controllers can coexist. By
+// default, only StatefulSets without a class annotation are reconciled.
+func WithClass(class string) Option {
+	return func(r *PortmapReconciler) {
+		r.class = class
+	}
+}
+
+// WithShard makes the controller only reconcile the StatefulSets in its shard, so that the
+// shard's replicas and the other shards' can all be active at once. See Shard.
+func WithShard(s Shard) Option {
+	return func(r *PortmapReconciler) {
+		r.shard = s
+	}
+}
+
+// WithEventRecorder sets the recorder used to emit events on StatefulSets. No events are
+// emitted without it.
+func WithEventRecorder(rec record.EventRecorder) Option {
+	return func(r *PortmapReconciler) {
+		r.recorder = rec
+	}
+}
+
+// event records an event on obj, if the reconciler has an event recorder.
+func (r *PortmapReconciler) event(obj runtime.Object, eventType, reason, msgFmt string, args ...any) {
+	if r.recorder != nil {
+		r.recorder.Eventf(obj, eventType, reason, msgFmt, args...)
+	}
 }
 
-func New(c client.Client, gcpClient gcp.Client) *PortmapReconciler {
-	return &PortmapReconciler{
+func New(c client.Client, gcpClient gcp.Client, opts ...Option) *PortmapReconciler {
+	r := &PortmapReconciler{
 		Client: c,
+		reader: c,
 		gcp:    gcpClient,
+
+		settings:    DefaultSettings(),
+		rateLimiter: &rateLimiter{},
+		gcpChanges:  make(chan event.TypedGenericEvent[string]),
+		dial:        (&net.Dialer{}).DialContext,
+		// The status' times are serialized in seconds.
+		startedAt: time.Now().Truncate(time.Second),
 	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.rateLimiter.set(r.settings.RateLimit)
+	r.bulk.set(r.settings.BulkOperationsPerMinute)
+	return r
 }
 
 func (r *PortmapReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	err := mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Pod{}, podNodeNameField, indexPodNodeName)
+	if err != nil {
+		return fmt.Errorf("failed to index pods by node name: %w", err)
+	}
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&appsv1.StatefulSet{}).
-		WithEventFilter(isAnnotated()).
+		For(&appsv1.StatefulSet{}, builder.WithPredicates(isAnnotated(r.class), inShard(r.shard))).
+		// A node's provider ID, or the other instance sources, determine the instance its pods'
+		// endpoints point to.
+		Watches(
+			&corev1.Node{},
+			handler.EnqueueRequestsFromMapFunc(r.statefulSetsOnNode),
+			builder.WithPredicates(r.instanceChanged()),
+		).
+		// The endpoints of deleted pods are detached right away, rather than once the STS'
+		// status catches up.
+		Watches(
+			&corev1.Pod{},
+			handler.EnqueueRequestsFromMapFunc(r.statefulSetOfPod),
+			builder.WithPredicates(podDeleted()),
+		).
+		WatchesRawSource(source.Channel(r.gcpChanges, handler.TypedEnqueueRequestsFromMapFunc(r.statefulSetsOwning))).
+		// Specs can accept the consumers listed in a ConfigMap. Only their metadata is cached,
+		// since there can be many, and they're read when reconciling.
+		Watches(
+			&corev1.ConfigMap{},
+			handler.EnqueueRequestsFromMapFunc(r.statefulSetsReferencing),
+			builder.OnlyMetadata,
+		).
+		WithOptions(controller.Options{RateLimiter: r.rateLimiter}).
 		Complete(r)
 }
 
+// statefulSetsOnNode returns a request for each StatefulSet of the controller's shard with pods
+// on the node.
+func (r *PortmapReconciler) statefulSetsOnNode(ctx context.Context, node client.Object) []reconcile.Request {
+	pods := corev1.PodList{}
+	err := r.List(ctx, &pods, client.MatchingFields{podNodeNameField: node.GetName()})
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list the pods on node.", "node", node.GetName())
+		return nil
+	}
+	var reqs []reconcile.Request
+	seen := map[types.NamespacedName]struct{}{}
+	for _, p := range pods.Items {
+		name, ok := podStatefulSet(&p)
+		if !ok {
+			continue
+		}
+		if _, ok := seen[name]; ok || !r.shard.owns(name) {
+			continue
+		}
+		seen[name] = struct{}{}
+		reqs = append(reqs, reconcile.Request{NamespacedName: name})
+	}
+	return reqs
+}
+
+// statefulSetOfPod returns a request for the StatefulSet owning the pod, if it's in the
+// controller's shard.
+func (r *PortmapReconciler) statefulSetOfPod(_ context.Context, pod client.Object) []reconcile.Request {
+	name, ok := podStatefulSet(pod)
+	if !ok || !r.shard.owns(name) {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: name}}
+}
+
+// podStatefulSet returns the name of the StatefulSet owning the pod, if any.
+func podStatefulSet(pod client.Object) (types.NamespacedName, bool) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil || owner.Kind != "StatefulSet" {
+		return types.NamespacedName{}, false
+	}
+	return types.NamespacedName{Namespace: pod.GetNamespace(), Name: owner.Name}, true
+}
+
 func (r *PortmapReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	defer r.bulk.serialize()()
+	start := time.Now()
+	// Logged with every line and sent as the GCP request ID, to match them to GCP audit logs.
+	correlationID := uuid.New()
+	ctx = gcp.WithCorrelationID(ctx, correlationID)
+	ctx = log.IntoContext(ctx, log.FromContext(ctx).WithValues("correlation_id", correlationID.String()))
+	res, err := r.reconcileStatefulSet(ctx, req)
+	if err != nil {
+		r.appliedStates.forget(req.NamespacedName)
+	}
+	failures := r.failures.record(req.NamespacedName, err)
+	r.lastResults.record(req.NamespacedName, start, err, failures)
+	r.reportStuck(ctx, req.NamespacedName, failures, err)
+	return res, err
+}
+
+func (r *PortmapReconciler) reconcileStatefulSet(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
 	log := log.FromContext(ctx)
 	log.Info("Reconciling PSC resources for STS.", "namespace", req.Namespace, "name", req.Name)
 
@@ -65,8 +281,20 @@ func (r *PortmapReconciler) Reconcile(ctx context.Context, req reconcile.Request
 			log.Error(err, "Failed to get StatefulSet.")
 			return reconcile.Result{}, err
 		}
+		r.appliedStates.forget(req.NamespacedName)
+		return reconcile.Result{}, nil
+	}
+
+	if !hasClass(sts, r.class) {
+		// It's managed by another controller. It can still be enqueued, e.g. by node events.
+		log.Info("The STS belongs to another class, ignoring it.", "class", sts.Annotations[classAnnotation])
+		return reconcile.Result{}, nil
+	}
+	if !r.shard.owns(req.NamespacedName) {
+		log.Info("The STS belongs to another shard, ignoring it.")
 		return reconcile.Result{}, nil
 	}
+	ctx = r.withOperationEvents(ctx, sts)
 
 	jsonSpec, ok := sts.Annotations[annotation]
 	if !ok {
@@ -74,27 +302,42 @@ func (r *PortmapReconciler) Reconcile(ctx context.Context, req reconcile.Request
 		return reconcile.Result{}, r.removeFinalizer(ctx, log, sts)
 	}
 
-	spec, err := parseSpec(log, jsonSpec)
-	if err != nil {
-		log.Error(err, "Failed to parse the spec.")
-		return reconcile.Result{}, err
+	settings := r.currentSettings()
+	spec, specRes, err := r.loadSpec(ctx, log, sts, jsonSpec)
+	if spec == nil {
+		return specRes, err
 	}
+	resolveMigration(log, sts, spec)
+	resolveScaleToZero(sts, spec)
+	resolveCanary(spec, settings.CanarySubnet)
+	requeueDelay := settings.requeueDelay(spec)
 
 	if controllerutil.AddFinalizer(sts, finalizer) {
-		err := r.Update(ctx, sts)
+		err := initialStatus(sts)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		err = r.Update(ctx, sts)
 		if err != nil {
 			log.Error(err, "Failed to add finalizer to the STS.", "namespace", sts.Namespace, "name", sts.Name)
 			return reconcile.Result{}, err
 		}
 	}
 
+	gc, release, err := r.gcpClientFor(ctx, log, sts.Namespace, spec)
+	if err != nil {
+		log.Error(err, "Failed to get a GCP client for the spec's credentials.")
+		return reconcile.Result{RequeueAfter: requeueDelay}, err
+	}
+	defer release()
+	gc, err = r.scopedGCPClient(log, gc, spec)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	r.reportAdoption(ctx, log, gc, spec, sts)
+
 	if !sts.DeletionTimestamp.IsZero() {
-		err := r.delete(ctx, log, spec, sts)
-		if err != nil {
-			log.Error(err, "Failed to delete resources.")
-			return reconcile.Result{RequeueAfter: requeueDelay}, err
-		}
-		return reconcile.Result{}, nil
+		return r.teardown(ctx, log, gc, spec, sts, requeueDelay)
 	}
 
 	ports := map[int32]struct{}{}
@@ -102,64 +345,328 @@ func (r *PortmapReconciler) Reconcile(ctx context.Context, req reconcile.Request
 		ports[p.NodePort] = struct{}{}
 	}
 	nodePortName := types.NamespacedName{Name: nodeportName(spec.Prefix), Namespace: req.Namespace}
-	err = r.reconcileNodePortService(ctx, log, nodePortName, spec.NodePorts, sts.Spec.Selector.MatchLabels)
+	err = r.reconcileNodePortService(ctx, log, nodePortName, spec.NodePorts, sts, spec.Labels)
 	if err != nil {
 		log.Error(err, "Failed to reconcile the NodePort service.")
 		return reconcile.Result{}, err
 	}
+	r.checkCapacity(log, sts, spec)
+	err = r.reconcilePortsConfigMap(ctx, log, spec, sts)
+	if err != nil {
+		r.reportNotOwned(sts, err)
+		return reconcile.Result{}, err
+	}
 
-	pods := corev1.PodList{}
-	err = r.List(ctx, &pods, client.MatchingLabels(sts.Spec.Selector.MatchLabels))
+	pods, err := r.listPods(ctx, log, sts, spec)
 	if err != nil {
-		log.Error(err, "Failed to list pods matching the STS' label.", "matchLabels", sts.Spec.Selector.MatchLabels)
 		return reconcile.Result{RequeueAfter: requeueDelay}, err
 	}
-	numPods := len(pods.Items)
-	if numPods == 0 {
-		log.Info("No pods matched the STS' labels. Are its replicas set to 0?")
-	}
 
-	nodes, err := r.getNodes(ctx, log, pods.Items)
+	nodes, err := r.getNodes(ctx, log, pods)
 	if err != nil {
 		log.Error(err, "Failed to get the nodes the STS pods are scheduled on.")
 		return reconcile.Result{RequeueAfter: requeueDelay}, err
 	}
 
-	hostnames := make([]string, 0, numPods)
-	for _, n := range nodes {
-		if n.Spec.ProviderID == "" {
-			err := errors.New("node is missing spec.providerID")
-			return reconcile.Result{RequeueAfter: requeueDelay}, err
-		}
-		fqin, err := fqInstaceName(n.Spec.ProviderID)
+	instances, pendingNodes, err := nodeInstances(log, nodes, settings.InstanceSources, gc.Project())
+	if err != nil {
+		return reconcile.Result{RequeueAfter: requeueDelay}, err
+	}
+	// The pods on nodes without a provider ID are mapped once it's set.
+	var res reconcile.Result
+	if len(pendingNodes) > 0 {
+		r.reportPendingNodes(sts, pods, pendingNodes)
+		res.RequeueAfter = pendingNodeRequeueDelay
+	}
+
+	mappings := r.getPortMappings(log, spec, sts, instances, pods)
+
+	hash, err := desiredStateHash(spec, sts, mappings, instanceIDs(nodes, instances))
+	if err != nil {
+		log.Error(err, "Failed to hash the desired state.")
+		return reconcile.Result{}, err
+	}
+	recreated, err := r.recreate(ctx, log, gc, spec, sts)
+	if err != nil {
+		return reconcile.Result{RequeueAfter: requeueDelay}, err
+	}
+	// Resources changed out of band are checked for drift right away.
+	suspected := r.driftSuspects.take(req.NamespacedName)
+	if !recreated && !suspected && r.isUpToDate(sts, hash) {
+		log.Info("The desired state didn't change since the last drift check. Skipping reconciliation.")
+		// In case annotating the pods failed after their endpoints were attached.
+		err := r.annotateClientPorts(ctx, log, spec, sts, pods)
 		if err != nil {
-			log.Error(err, "Failed to get the fully qualified instance name for the node.", "node", n.Name)
 			return reconcile.Result{RequeueAfter: requeueDelay}, err
 		}
-		hostnames = append(hostnames, fqin)
+		return res, nil
 	}
 
-	if len(hostnames) != numPods {
-		// TODO: Unit-test this path.
-		err := errors.New("some pods are missing the hostname annotation")
-		log.Error(err, "Failed to get the hostnames of the nodes the STS pods are scheduled on.")
+	err = checkSubnets(ctx, log, gc, spec)
+	if err != nil {
 		return reconcile.Result{RequeueAfter: requeueDelay}, err
 	}
 
-	mappings, err := r.getPortMappings(log, spec, nodes, pods.Items)
+	ips := r.newFwdRuleIPs(log, sts, spec)
+	h := r.reconcileHooks(ctx, log, gc, sts, spec, hash, ips)
+	// Retries after a partial failure skip the resources the previous attempt reconciled,
+	// unless they might have changed since.
+	prev := r.lastProgress(ctx, log, sts)
+	var skip map[string]bool
+	if !recreated && !suspected {
+		skip = r.resumableProgress(prev, hash)
+	}
+	conds, done, err := r.reconcile(ctx, log, gc, spec, lastAppliedSpec(sts), ownershipFor(sts), ports, mappings, h, skip)
+	o := reconcileOutcome{hash: hash, mappings: mappings, pods: pods, ips: ips, conds: conds, prev: prev, done: done, err: err}
+	return r.finishReconcile(ctx, log, gc, spec, sts, o, res, requeueDelay)
+}
+
+// listPods returns the STS' pods.
+func (r *PortmapReconciler) listPods(ctx context.Context, log logr.Logger, sts *appsv1.StatefulSet, spec *Spec) ([]corev1.Pod, error) {
+	pods := corev1.PodList{}
+	err := r.List(ctx, &pods, client.MatchingLabels(sts.Spec.Selector.MatchLabels))
+	if err != nil {
+		log.Error(err, "Failed to list pods matching the STS' label.", "matchLabels", sts.Spec.Selector.MatchLabels)
+		return nil, err
+	}
+	if policy := scaledToZero(sts, spec); policy != "" {
+		log.Info("The STS is scaled to zero.", "policy", policy)
+	} else if len(pods.Items) == 0 {
+		log.Info("No pods matched the STS' labels.")
+	}
+	return pods.Items, nil
+}
+
+// checkSubnets verifies that the spec's subnets are in the controller's region and in the
+// spec's network. See checkRegion and checkNetwork.
+func checkSubnets(ctx context.Context, log logr.Logger, gc gcp.Client, spec *Spec) error {
+	err := checkRegion(gc, spec)
 	if err != nil {
-		log.Error(err, "Failed to get the port mappings.")
-		return reconcile.Result{RequeueAfter: requeueDelay}, err
+		log.Error(err, "The spec's subnets aren't in the controller's region.")
+		return err
+	}
+	err = checkNetwork(ctx, gc, spec)
+	if err != nil {
+		log.Error(err, "The spec's subnets aren't in its network.")
+		return err
+	}
+	return nil
+}
+
+// reconcileHooks returns the hooks reporting what reconciling the resources with the desired
+// state hashed to hash finds.
+func (r *PortmapReconciler) reconcileHooks(
+	ctx context.Context,
+	log logr.Logger,
+	gc gcp.Client,
+	sts *appsv1.StatefulSet,
+	spec *Spec,
+	hash string,
+	ips *fwdRuleIPs,
+) hooks {
+	h := hooks{
+		serviceAttachment: func(svcAtt *computepb.ServiceAttachment) {
+			r.checkConnectionLimits(log, sts, svcAtt)
+			r.checkNatSubnets(ctx, log, gc, sts, spec, svcAtt)
+			r.checkConsumerRegions(log, sts, spec, gc.Region(), svcAtt)
+		},
+		natSubnetsRemoved: func(subnets []string) {
+			r.reportRemovedNatSubnets(log, sts, subnets)
+		},
+		forwardingRuleIP: func(name, ip string) {
+			ips.publish(ctx, name, ip)
+		},
+	}
+	// The firewall can only have been modified out of band if it was already reconciled with
+	// the current desired state.
+	if parseStatus(sts).DesiredStateHash == hash {
+		h.firewallDrift = func(name string, diff gcp.FirewallDiff) {
+			r.reportFirewallDrift(log, sts, name, diff)
+		}
 	}
+	return h
+}
 
-	err = r.reconcile(ctx, log, spec, ports, mappings)
+// loadSpec returns the STS' spec, or nil and the result and error to return if it's invalid or
+// can't be reconciled yet. Invalid specs are parked or reported, see Settings.InvalidSpecs.
+// The consumers aren't resolved for STSs being deleted, since tearing the resources down
+// doesn't need them, and their ConfigMap can be deleted first, e.g. with their namespace. The
+// policy isn't enforced either, so that tightening it doesn't prevent deleting the STSs
+// violating it.
+func (r *PortmapReconciler) loadSpec(ctx context.Context, log logr.Logger, sts *appsv1.StatefulSet, jsonSpec string) (*Spec, reconcile.Result, error) {
+	settings := r.currentSettings()
+	deleting := !sts.DeletionTimestamp.IsZero()
+	policy := settings.Policy
+	if deleting {
+		policy = nil
+	}
+	spec, err := parseSpec(log, jsonSpec, settings.SpecDefaults, policy)
+	if err == nil {
+		err = validateTargetPorts(spec, &sts.Spec.Template.Spec)
+	}
+	if err == nil && !deleting {
+		err = r.resolveConsumers(ctx, log, sts.Namespace, spec, settings.Policy)
+	}
+	if errors.Is(err, errConsumersUnavailable) {
+		log.Error(err, "Failed to resolve the spec's consumers.")
+		return nil, reconcile.Result{RequeueAfter: settings.requeueDelay(spec)}, err
+	}
+	if err != nil {
+		if settings.InvalidSpecs == InvalidSpecPark {
+			return nil, reconcile.Result{}, r.parkInvalidSpec(ctx, log, sts, err)
+		}
+		log.Error(err, "Failed to parse the spec.")
+		r.reportInvalidSpec(ctx, log, sts, err)
+		return nil, reconcile.Result{}, err
+	}
+	if !deleting {
+		wait, err := r.checkNodePortCooldown(ctx, sts, spec)
+		if errors.Is(err, errNodePortCoolingDown) {
+			// It's reconciled again once the ports can be reused.
+			return nil, reconcile.Result{RequeueAfter: wait}, r.reportNodePortCooldown(ctx, log, sts, err)
+		}
+		if err != nil {
+			log.Error(err, "Failed to check whether the spec's node ports are cooling down.")
+			return nil, reconcile.Result{}, err
+		}
+	}
+	return spec, reconcile.Result{}, nil
+}
+
+// scopedGCPClient returns gc scoped to the spec's network and endpoint annotations, and paced
+// by the bulk operations limit.
+func (r *PortmapReconciler) scopedGCPClient(log logr.Logger, gc gcp.Client, spec *Spec) (gcp.Client, error) {
+	gc, err := gcpClientInNetwork(gc, spec)
+	if err != nil {
+		log.Error(err, "Failed to get a GCP client for the spec's network.")
+		return nil, err
+	}
+	gc, err = gcpClientWithEndpointAnnotations(gc, spec)
+	if err != nil {
+		log.Error(err, "Failed to get a GCP client for the spec's endpoint annotations.")
+		return nil, err
+	}
+	return r.pacedGCPClient(gc), nil
+}
+
+// teardown deletes the resources of a StatefulSet being deleted, once its consumers are
+// drained, and removes its finalizer once they're gone.
+func (r *PortmapReconciler) teardown(
+	ctx context.Context,
+	log logr.Logger,
+	gc gcp.Client,
+	spec *Spec,
+	sts *appsv1.StatefulSet,
+	requeueDelay time.Duration,
+) (reconcile.Result, error) {
+	name := types.NamespacedName{Namespace: sts.Namespace, Name: sts.Name}
+	// A StatefulSet recreated with the same name must be reconciled from scratch.
+	r.appliedStates.forget(name)
+	setTerminatingMetric(name.String(), sts.DeletionTimestamp.Time)
+	wait, err := r.waitForDrain(ctx, log, gc, spec, sts)
 	if err != nil {
-		log.Error(err, "Failed to reconcile the resources.")
 		return reconcile.Result{RequeueAfter: requeueDelay}, err
 	}
+	if wait > 0 {
+		return reconcile.Result{RequeueAfter: wait}, nil
+	}
+	err = r.delete(ctx, log, gc, spec, sts)
+	if errors.Is(err, errDeletionPending) {
+		log.Info("Waiting for the resources to be deleted.")
+		return reconcile.Result{RequeueAfter: requeueDelay}, nil
+	}
+	if err != nil {
+		log.Error(err, "Failed to delete resources.")
+		r.reportOperationErrors(sts, err)
+		return reconcile.Result{RequeueAfter: requeueDelay}, err
+	}
+	return reconcile.Result{}, nil
+}
+
+// reconcileOutcome is the outcome of reconciling the resources with a desired state.
+type reconcileOutcome struct {
+	hash     string
+	mappings []*gcp.PortMapping
+	pods     []corev1.Pod
+	ips      *fwdRuleIPs
+	conds    []metav1.Condition
+	// What the previous attempt got done, if it failed.
+	prev *Progress
+	// The resources reconciled, even if reconciling the rest failed.
+	done []string
+	err  error
+}
 
+// finishReconcile annotates the pods, probes the ports and writes the state and the status
+// after reconciling the resources, and returns res if it all succeeded.
+func (r *PortmapReconciler) finishReconcile(
+	ctx context.Context,
+	log logr.Logger,
+	gc gcp.Client,
+	spec *Spec,
+	sts *appsv1.StatefulSet,
+	o reconcileOutcome,
+	res reconcile.Result,
+	requeueDelay time.Duration,
+) (reconcile.Result, error) {
+	var annotateErr error
+	if slices.Contains(o.done, "endpoints") {
+		annotateErr = r.annotateClientPorts(ctx, log, spec, sts, o.pods)
+	}
+	successHash, applied := o.hash, spec
+	var progress *Progress
+	var probe *ProbeStatus
+	if o.err != nil {
+		successHash, applied = "", nil
+		progress = nextProgress(o.prev, o.hash, o.done)
+	} else {
+		probe = r.probe(ctx, log, gc, sts, spec, o.mappings)
+	}
+	state, stateErr := r.writeState(ctx, log, spec, sts, &State{DesiredStateHash: o.hash, Mappings: o.mappings, Probe: probe, Progress: progress})
+	if state != nil {
+		// The per-port results and the progress are in the state, unless writing it failed.
+		if probe != nil {
+			probe = &ProbeStatus{Time: probe.Time, IP: probe.IP}
+		}
+		if stateErr == nil {
+			progress = nil
+		}
+	}
+	statusErr := r.updateStatus(ctx, log, sts, statusUpdate{
+		conds:        o.conds,
+		hash:         successHash,
+		applied:      applied,
+		progress:     progress,
+		svcAtts:      serviceAttachmentFQNs(gc, spec),
+		fwdRuleIPs:   o.ips.status(o.err == nil),
+		partition:    partitionStatus(sts, o.pods),
+		scaledToZero: scaledToZero(sts, spec),
+		probe:        probe,
+		state:        state,
+	})
+	if o.err != nil && statusErr == nil && onlyNotReady(o.err) {
+		log.Info("Waiting for a resource to be ready.", "error", o.err.Error())
+		return reconcile.Result{RequeueAfter: resourceNotReadyDelay}, nil
+	}
+	if o.err != nil {
+		log.Error(o.err, "Failed to reconcile the resources.")
+		r.reportNotOwned(sts, o.err)
+		r.reportOperationErrors(sts, o.err)
+		return reconcile.Result{RequeueAfter: requeueDelay}, o.err
+	}
+	if statusErr != nil {
+		return reconcile.Result{}, statusErr
+	}
+	if annotateErr != nil {
+		return reconcile.Result{RequeueAfter: requeueDelay}, annotateErr
+	}
+	if stateErr != nil {
+		return reconcile.Result{RequeueAfter: requeueDelay}, stateErr
+	}
+
+	r.appliedStates.record(types.NamespacedName{Namespace: sts.Namespace, Name: sts.Name}, o.hash, sts.Generation)
 	log.Info("Reconciliation successful.")
-	return reconcile.Result{}, nil
+	return res, nil
 }
 
 func (r *PortmapReconciler) removeFinalizer(ctx context.Context, log logr.Logger, sts *appsv1.StatefulSet) error {
@@ -173,163 +680,309 @@ func (r *PortmapReconciler) removeFinalizer(ctx context.Context, log logr.Logger
 	return nil
 }
 
-func (r *PortmapReconciler) getPortMappings(log logr.Logger, spec *Spec, nodes map[string]*corev1.Node, pods []corev1.Pod) ([]*gcp.PortMapping, error) {
-	numPods := len(pods)
-	// Reconcile the resources.
-	mappings := make([]*gcp.PortMapping, 0, numPods)
-	for i := 0; i < numPods; i++ {
+// getPortMappings maps each of the spec's ports for each pod, as per portMappings, logging
+// the pods that aren't mapped.
+func (r *PortmapReconciler) getPortMappings(log logr.Logger, spec *Spec, sts *appsv1.StatefulSet, instances map[string]string, pods []corev1.Pod) []*gcp.PortMapping {
+	capacity, _ := portCapacity(spec, r.currentSettings().NEGEndpointLimit)
+	mappings, unmapped := portMappings(spec, sts, instances, pods, capacity)
+	for _, u := range unmapped {
+		log.Info("Skipping port mapping for a pod.", "namespace", u.Pod.Namespace, "name", u.Pod.Name, "reason", u.Reason)
+	}
+	return mappings
+}
+
+// UnmappedPod is a pod whose ports aren't mapped, and why.
+type UnmappedPod struct {
+	Pod    types.NamespacedName
+	Reason string
+}
+
+const (
+	unmappedNotReplica      = "it isn't one of the STS' replicas"
+	unmappedBeyondCapacity  = "it's beyond the spec's capacity"
+	unmappedUnscheduled     = "it isn't scheduled"
+	unmappedInstanceUnknown = "its node's instance isn't known yet"
+)
+
+// portMappings maps each of the spec's ports for each pod. A pod's ports are offset from the
+// starting ports by its index, i.e. its ordinal minus the STS' first ordinal, so that they
+// line up with the pods' names. The pods at or beyond capacity aren't mapped, see
+// checkCapacity. instances are the FQNs of the instances backing the pods' nodes, by node name.
+// The pods on other nodes, e.g. ones whose provider ID isn't set yet, aren't mapped.
+func portMappings(spec *Spec, sts *appsv1.StatefulSet, instances map[string]string, pods []corev1.Pod, capacity int32) ([]*gcp.PortMapping, []UnmappedPod) {
+	mappings := make([]*gcp.PortMapping, 0, len(pods))
+	var unmapped []UnmappedPod
+	for i := range pods {
+		pod := &pods[i]
+		skip := func(reason string) {
+			unmapped = append(unmapped, UnmappedPod{Pod: client.ObjectKeyFromObject(pod), Reason: reason})
+		}
+		index, ok := podIndex(sts, pod)
+		if !ok {
+			// E.g. a pod that's being removed after a scale down.
+			skip(unmappedNotReplica)
+			continue
+		}
+		if index >= capacity {
+			skip(unmappedBeyondCapacity)
+			continue
+		}
+		nodeName := pod.Spec.NodeName
+		if nodeName == "" {
+			skip(unmappedUnscheduled)
+			continue
+		}
+		instance, ok := instances[nodeName]
+		if !ok {
+			skip(unmappedInstanceUnknown)
+			continue
+		}
 		for _, p := range spec.NodePorts {
-			port := p.StartingPort + int32(i)
-			nodeName := pods[i].Spec.NodeName
-			if nodeName == "" {
-				log.Info("Skipping port mapping for unscheduled pod.", "namespace", pods[i].Namespace, "name", pods[i].Name)
-				continue
-			}
-			node := nodes[nodeName]
-			instance, err := fqInstaceName(node.Spec.ProviderID)
-			if err != nil {
-				log.Error(err, "Failed to get the fully qualified instance name for the node.", "node", nodeName)
-				return nil, err
-			}
 			mappings = append(mappings, &gcp.PortMapping{
-				Port:         port,
+				Port:         p.StartingPort + index,
 				Instance:     instance,
 				InstancePort: p.NodePort,
 			})
 		}
 	}
-	return mappings, nil
+	return mappings, unmapped
+}
+
+// ordinalsStart returns the STS' first ordinal, which is 0 unless spec.ordinals.start sets it.
+func ordinalsStart(sts *appsv1.StatefulSet) int32 {
+	if sts.Spec.Ordinals == nil {
+		return 0
+	}
+	return sts.Spec.Ordinals.Start
+}
+
+// podIndex returns the index of one of the STS' replicas, i.e. its ordinal minus the STS'
+// first ordinal. It returns false if the pod isn't named after the STS, or if its ordinal is
+// out of the STS' range.
+func podIndex(sts *appsv1.StatefulSet, pod *corev1.Pod) (int32, bool) {
+	ordinal, ok := podOrdinal(sts, pod)
+	if !ok {
+		return 0, false
+	}
+	index := ordinal - ordinalsStart(sts)
+	if index < 0 || index >= ptr.Deref(sts.Spec.Replicas, 1) {
+		return 0, false
+	}
+	return index, true
 }
 
+// podOrdinal returns the ordinal of one of the STS' pods, parsed from its name, e.g. 2 for
+// my-sts-2. It returns false if the pod isn't named after the STS.
+func podOrdinal(sts *appsv1.StatefulSet, pod *corev1.Pod) (int32, bool) {
+	suffix, ok := strings.CutPrefix(pod.Name, sts.Name+"-")
+	if !ok {
+		return 0, false
+	}
+	ordinal, err := strconv.ParseInt(suffix, 10, 32)
+	if err != nil || ordinal < 0 {
+		return 0, false
+	}
+	return int32(ordinal), true
+}
+
+// getNodes returns the nodes the pods are scheduled on, by name. They're read from the
+// manager's cache, so this doesn't hit the API server.
 func (r *PortmapReconciler) getNodes(ctx context.Context, log logr.Logger, pods []corev1.Pod) (map[string]*corev1.Node, error) {
-	numPods := len(pods)
-	nodesCh := make(chan *corev1.Node, numPods)
-	wg := errgroup.Group{}
+	nodes := make(map[string]*corev1.Node, len(pods))
 	for _, p := range pods {
 		nodeName := p.Spec.NodeName
 		if nodeName == "" {
 			log.Info("Skipping getting node info for unscheduled pod.", "namespace", p.Namespace, "name", p.Name)
 			continue
 		}
-		wg.Go(func() error {
-			node := &corev1.Node{}
-			err := r.Get(ctx, types.NamespacedName{Name: nodeName}, node)
-			if err != nil {
-				return fmt.Errorf("failed to get node %s: %w", nodeName, err)
-			}
-			nodesCh <- node
-			return nil
-		})
-	}
-	err := wg.Wait()
-	close(nodesCh)
-	if err != nil {
-		log.Error(err, "Failed to get the STS' pods' nodes.")
-		return nil, err
-	}
-	nodes := make(map[string]*corev1.Node, numPods)
-
-	for node := range nodesCh {
-		nodes[node.Name] = node
+		if _, ok := nodes[nodeName]; ok {
+			continue
+		}
+		node := &corev1.Node{}
+		err := r.Get(ctx, types.NamespacedName{Name: nodeName}, node)
+		if err != nil {
+			err = fmt.Errorf("failed to get node %s: %w", nodeName, err)
+			log.Error(err, "Failed to get the STS' pods' nodes.")
+			return nil, err
+		}
+		nodes[nodeName] = node
 	}
-
 	return nodes, nil
 }
 
-func (r *PortmapReconciler) reconcile(ctx context.Context, log logr.Logger, spec *Spec, ports map[int32]struct{}, mappings []*gcp.PortMapping) error {
-	reconcilers := []struct {
-		resource      string
-		reconcileFunc func() error
-	}{{
-		"firewall",
-		func() error {
-			return r.reconcileFirewall(ctx, log, firewallName(spec.Prefix), ports)
-		},
-	}, {
-		"NEG",
-		func() error {
-			return r.reconcileNEG(ctx, log, negName(spec.Prefix))
-		},
-	}, {
-		"backend",
-		func() error {
-			return r.reconcileBackend(ctx, log, backendName(spec.Prefix), negName(spec.Prefix))
-		},
-	}, {
-		"endpoints",
-		func() error {
-			return r.reconcileEndpoints(ctx, log, negName(spec.Prefix), mappings)
-		},
-	}, {
-		"forwarding rule",
-		func() error {
-			return r.reconcileForwardingRule(ctx, log, fwdRuleName(spec.Prefix), backendName(spec.Prefix), spec.IP, spec.GlobalAccess)
-		},
-	}, {
-		"service attachment",
-		func() error {
-			return r.reconcileServiceAttachment(ctx, log, svcAttName(spec.Prefix), fwdRuleName(spec.Prefix), spec.ConsumerAcceptList, spec.NatSubnetFQNs)
-		},
-	}}
-	for _, r := range reconcilers {
-		err := r.reconcileFunc()
-		if err != nil {
-			log.Error(err, "Failed to reconcile "+r.resource)
-			return err
+// reconcile ensures all the spec's resources and returns the resulting conditions. Each
+// sub-reconciler runs as soon as the ones it depends on succeed, so independent resources
+// (e.g. the firewall and the NEG) are reconciled concurrently. If one fails, the ones that
+// depend on it are skipped, but the others carry on. The ones named in skip are assumed to
+// be done already. It also returns the names of the ones that succeeded.
+func (r *PortmapReconciler) reconcile(ctx context.Context, log logr.Logger, gc gcp.Client, spec, lastApplied *Spec, own ownership, ports map[int32]struct{}, mappings []*gcp.PortMapping, h hooks, skip map[string]bool) ([]metav1.Condition, []string, error) {
+	subs := subReconcilers(gc, spec, lastApplied, own, ports, mappings, h)
+	timeout := r.currentSettings().stepTimeout(spec)
+	done := make(map[string]chan struct{}, len(subs))
+	for i, s := range subs {
+		done[s.Name()] = make(chan struct{})
+		if skip[s.Name()] {
+			subs[i] = doneSubReconciler{s}
 		}
 	}
-	return nil
+
+	var (
+		mu        sync.Mutex
+		err       error
+		failed    = map[string]bool{}
+		succeeded []string
+	)
+	wg := sync.WaitGroup{}
+	for _, s := range subs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done[s.Name()])
+			for _, dep := range subReconcilerDeps[s.Name()] {
+				<-done[dep]
+				mu.Lock()
+				depFailed := failed[dep]
+				failed[s.Name()] = depFailed
+				mu.Unlock()
+				if depFailed {
+					return
+				}
+			}
+			stepCtx, cancel := withStepTimeout(ctx, timeout)
+			ensureErr := s.Ensure(stepCtx, log)
+			cancel()
+			mu.Lock()
+			defer mu.Unlock()
+			if ensureErr == nil {
+				succeeded = append(succeeded, s.Name())
+				return
+			}
+			log.Error(ensureErr, "Failed to reconcile "+s.Name())
+			failed[s.Name()] = true
+			err = multierr.Append(err, ensureErr)
+		}()
+	}
+	wg.Wait()
+	return aggregateConditions(subs), succeeded, err
 }
 
-func (r *PortmapReconciler) delete(ctx context.Context, log logr.Logger, spec *Spec, sts *appsv1.StatefulSet) error {
+func (r *PortmapReconciler) delete(ctx context.Context, log logr.Logger, gc gcp.Client, spec *Spec, sts *appsv1.StatefulSet) error {
 	np := types.NamespacedName{Name: nodeportName(spec.Prefix), Namespace: sts.Namespace}
 	err := r.Delete(ctx, &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: np.Name, Namespace: np.Namespace}})
-	if err != nil {
+	if client.IgnoreNotFound(err) != nil {
+		// The finalizer is kept, so that the service isn't orphaned.
 		log.Error(err, "Failed to delete the NodePort service.", "namespace", np.Namespace, "name", np.Name)
+		return err
 	}
-	deleters := []struct {
-		resource   string
-		deleteFunc func() error
-	}{{
-		"service attachment",
-		func() error {
-			return r.gcp.DeleteServiceAttachment(ctx, svcAttName(spec.Prefix))
-		},
-	}, {
-		"forwarding rule",
-		func() error {
-			return r.gcp.DeleteForwardingRule(ctx, fwdRuleName(spec.Prefix))
-		},
-	}, {
-		"backend",
-		func() error {
-			return r.gcp.DeleteBackendService(ctx, backendName(spec.Prefix))
-		},
-	}, {
-		"NEG",
-		func() error {
-			return r.gcp.DeletePortmapNEG(ctx, negName(spec.Prefix))
-		},
-	}, {
-		"firewall",
-		func() error {
-			return r.gcp.DeleteFirewall(ctx, firewallName(spec.Prefix))
-		},
-	}}
-	for _, d := range deleters {
-		err = d.deleteFunc()
-		if err == nil {
-			log.Info("Resource deleted.", "type", d.resource)
-			continue
-		}
-		if !errors.Is(err, gcp.ErrNotFound) {
-			log.Error(err, "Failed to delete resource.", "type", d.resource)
+	err = r.deletePortsConfigMap(ctx, log, types.NamespacedName{Name: portsConfigMapName(spec.Prefix), Namespace: sts.Namespace})
+	if err != nil {
+		return err
+	}
+	if parseStatus(sts).State != nil {
+		err = r.deleteState(ctx, log, spec, sts)
+		if err != nil {
 			return err
 		}
-		log.Info("Resource not found, so nothing to delete. Was it removed manually or by another process?", "type", d.resource)
 	}
+	// Deletes the resources of a migration removed from the spec too.
+	subs := subReconcilers(gc, spec, lastAppliedSpec(sts), ownershipFor(sts), nil, nil, hooks{})
+	timeout := r.currentSettings().stepTimeout(spec)
+	// The independent resources are deleted concurrently with the others, which are deleted
+	// dependents first, since their operations can take tens of seconds each.
+	var independent, chain []subReconciler
+	for _, s := range subs {
+		if independentDeletes[s.Name()] {
+			independent = append(independent, s)
+		} else {
+			chain = append(chain, s)
+		}
+	}
+	errs := make([]error, len(independent)+1)
+	wg := sync.WaitGroup{}
+	for i, s := range independent {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = r.deleteSub(ctx, log, sts, s, timeout)
+		}()
+	}
+	for _, s := range slices.Backward(chain) {
+		err = r.deleteSub(ctx, log, sts, s, timeout)
+		if err != nil {
+			break
+		}
+	}
+	errs[len(independent)] = err
+	wg.Wait()
+	// Failures take precedence over pending deletions.
+	pending := false
+	for _, e := range errs {
+		if errors.Is(e, errDeletionPending) {
+			pending = true
+		} else if e != nil {
+			return e
+		}
+	}
+	if pending {
+		return errDeletionPending
+	}
+
+	r.releaseNodePorts(ctx, log, spec, sts)
 
-	return r.removeFinalizer(ctx, log, sts)
+	sName := types.NamespacedName{Namespace: sts.Namespace, Name: sts.Name}.String()
+	deleteConnectionMetrics(sName)
+	deleteNatSubnetMetrics(sName)
+	deleteProbeMetrics(sName)
+	err = r.removeFinalizer(ctx, log, sts)
+	if err != nil {
+		return err
+	}
+	deleteTerminatingMetric(sName, sts.DeletionTimestamp.Time)
+	return nil
+}
+
+// deleteSub deletes the sub-reconciler's resources within the step timeout, and returns
+// errDeletionPending until they're verified to be gone.
+func (r *PortmapReconciler) deleteSub(ctx context.Context, log logr.Logger, sts *appsv1.StatefulSet, s subReconciler, timeout time.Duration) (err error) {
+	ctx, cancel := withStepTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	defer func() { observeDeletionStep(s.Name(), start, err) }()
+	err = s.Delete(ctx, log)
+	switch {
+	case err == nil:
+		log.Info("Resource deleted.", "type", s.Name())
+	// Resources the controller didn't create are left behind, so they don't block the
+	// StatefulSet's deletion.
+	case errors.Is(err, errNotOwned):
+		log.Error(err, "Not deleting a resource the controller didn't create.", "type", s.Name())
+		r.reportNotOwned(sts, err)
+		return nil
+	// It's used by a resource that's still being deleted, or that the controller doesn't
+	// manage, so it's retried later.
+	case gcp.ErrorKindOf(err) == gcp.ErrorKindResourceInUse:
+		log.Info("The resource is still in use.", "type", s.Name(), "error", err.Error())
+		r.reportOperationErrors(sts, err)
+		return errDeletionPending
+	case errors.Is(err, gcp.ErrNotFound):
+		log.Info("Resource not found, so nothing to delete. Was it removed manually or by another process?", "type", s.Name())
+	default:
+		log.Error(err, "Failed to delete resource.", "type", s.Name())
+		return err
+	}
+	// A delete can return before the resource is gone, e.g. if its operation is slow, and the
+	// resources before it can depend on it, e.g. the backend service on the NEG. So the next
+	// one is only deleted, and the finalizer only removed, once it's verified to be gone.
+	exists, err := s.Exists(ctx)
+	if err != nil {
+		log.Error(err, "Failed to verify that the resource was deleted.", "type", s.Name())
+		return err
+	}
+	if exists {
+		log.Info("The resource still exists.", "type", s.Name())
+		return errDeletionPending
+	}
+	return nil
 }
 
 func (r *PortmapReconciler) reconcileNodePortService(
@@ -337,25 +990,24 @@ func (r *PortmapReconciler) reconcileNodePortService(
 	log logr.Logger,
 	name types.NamespacedName,
 	ports map[string]PortConfig,
-	selector map[string]string,
+	sts *appsv1.StatefulSet,
+	labels map[string]string,
 ) error {
+	selector := sts.Spec.Selector.MatchLabels
 	svcPorts := make([]corev1.ServicePort, 0, len(ports))
 	for portName, m := range ports {
 		svcPorts = append(svcPorts, corev1.ServicePort{
-			Name:     portName,
-			Protocol: corev1.ProtocolTCP,
-			Port:     m.NodePort,
-			TargetPort: intstr.IntOrString{
-				Type:   intstr.Int,
-				IntVal: m.ContainerPort,
-			},
+			Name:       portName,
+			Protocol:   corev1.ProtocolTCP,
+			Port:       m.NodePort,
+			TargetPort: targetPort(m),
 		})
 	}
 	nodePort := corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name.Name,
 			Namespace: name.Namespace,
-			Labels:    map[string]string{managedByLabel: portmapperApp},
+			Labels:    nodePortLabels(labels),
 		},
 		Spec: corev1.ServiceSpec{
 			Type:     corev1.ServiceTypeNodePort,
@@ -366,6 +1018,9 @@ func (r *PortmapReconciler) reconcileNodePortService(
 	var np corev1.Service
 	err := r.Get(ctx, name, &np)
 	if err == nil {
+		if !maps.Equal(np.Spec.Selector, selector) {
+			r.reportSelectorDrift(log, sts, name.Name, np.Spec.Selector)
+		}
 		err := r.Update(ctx, &nodePort)
 		if err != nil {
 			log.Error(err, "Failed to update the NodePort service.")
@@ -386,133 +1041,15 @@ func (r *PortmapReconciler) reconcileNodePortService(
 	return nil
 }
 
-func (r *PortmapReconciler) reconcileFirewall(ctx context.Context, log logr.Logger, name string, ports map[int32]struct{}) error {
-	fw, err := r.gcp.GetFirewall(ctx, name)
-	if err == nil {
-		if gcp.FirewallNeedsUpdate(fw, ports) {
-			err = r.gcp.UpdateFirewall(ctx, name, ports)
-			if err != nil {
-				log.Error(err, "Failed to update firewall.", "name", name, "ports", ports)
-				return err
-			}
-		}
-		return nil
-	}
-	if !errors.Is(err, gcp.ErrNotFound) {
-		log.Error(err, "Got an unexpected error trying to get firewall.", "name", name)
-		return err
-	}
-	err = r.gcp.CreateFirewall(ctx, name, ports)
-	if err != nil {
-		log.Error(err, "Failed to create firewall.", "ports", ports)
-		return err
-	}
-	return nil
-}
-
-func (r *PortmapReconciler) reconcileNEG(ctx context.Context, log logr.Logger, name string) error {
-	_, err := r.gcp.GetNEG(ctx, name)
-	if err == nil {
-		return nil
-	}
-	if !errors.Is(err, gcp.ErrNotFound) {
-		log.Error(err, "Got an unexpected error trying to get the NEG.", "name", name)
-		return err
-	}
-	err = r.gcp.CreatePortmapNEG(ctx, name)
-	if err != nil {
-		log.Error(err, "Failed to create the NEG.")
-		return err
-	}
-	return nil
-}
-
-func (r *PortmapReconciler) reconcileBackend(ctx context.Context, log logr.Logger, name, neg string) error {
-	_, err := r.gcp.GetBackendService(ctx, name)
-	if err == nil {
-		return nil
-	}
-	if !errors.Is(err, gcp.ErrNotFound) {
-		log.Error(err, "Got an unexpected error trying to get the backend.", "name", name)
-		return err
-	}
-	err = r.gcp.CreateBackendService(ctx, name, neg)
-	if err != nil {
-		log.Error(err, "Failed to create the backend.")
-		return err
-	}
-	return nil
-}
-
-func (r *PortmapReconciler) reconcileEndpoints(ctx context.Context, log logr.Logger, neg string, mappings []*gcp.PortMapping) error {
-	eps, err := r.gcp.ListEndpoints(ctx, neg)
-	if err != nil {
-		if errors.Is(err, gcp.ErrNotFound) {
-			log.Error(err, "Couldn't attach the endpoints to the NEG. Was the NEG removed manually or by another process?", "name", neg)
-		} else {
-			log.Error(err, "Got an unexpected error trying to list the NEG's endpoints.", "name", neg)
-		}
-		return err
-	}
-	// Endpoints must be detached first because the API doesn't allow attaching registering
-	// endpoints with the same port twice.
-	obsolete := getObsoletePortMappings(mappings, eps)
-	if len(obsolete) > 0 {
-		err = r.gcp.DetachEndpoints(ctx, neg, obsolete)
-		if err != nil {
-			log.Error(err, "Failed to detach obsolete endpoints from the NEG.", "name", neg)
-			return err
-		}
-	}
-
-	err = r.gcp.AttachEndpoints(ctx, neg, mappings)
-	if err != nil {
-		log.Error(err, "Failed to attach the endpoints to the NEG.", "name", neg)
-		return err
-	}
-	return nil
-}
-
-func (r *PortmapReconciler) reconcileForwardingRule(
-	ctx context.Context,
-	log logr.Logger,
-	name string,
-	backend string,
-	ip *string,
-	globalAccess *bool,
-) error {
-	_, err := r.gcp.GetForwardingRule(ctx, name)
-	if err == nil {
-		return nil
-	}
-	if !errors.Is(err, gcp.ErrNotFound) {
-		log.Error(err, "Got an unexpected error trying to get the backend.", "name", name)
-		return err
+// nodePortLabels returns the spec's labels along with the label marking the service as
+// managed by the controller, which can't be overridden.
+func nodePortLabels(labels map[string]string) map[string]string {
+	l := maps.Clone(labels)
+	if l == nil {
+		l = map[string]string{}
 	}
-	err = r.gcp.CreateForwardingRule(ctx, name, backend, ip, globalAccess)
-	if err != nil {
-		log.Error(err, "Failed to create the forwarding rule.")
-		return err
-	}
-	return nil
-}
-
-func (r *PortmapReconciler) reconcileServiceAttachment(ctx context.Context, log logr.Logger, name string, fwdRule string, consumers []*Consumer, natSubnetFQNs []string) error {
-	_, err := r.gcp.GetServiceAttachment(ctx, name)
-	if err == nil {
-		return nil
-	}
-	if !errors.Is(err, gcp.ErrNotFound) {
-		log.Error(err, "Got an unexpected error trying to get the service attachment.", "name", name)
-		return err
-	}
-	fwdRuleFQN := gcp.ForwardingRuleFQN(r.gcp.Project(), r.gcp.Region(), fwdRule)
-	err = r.gcp.CreateServiceAttachment(ctx, name, fwdRuleFQN, toConsumerProjectLimits(consumers), natSubnetFQNs)
-	if err != nil {
-		log.Error(err, "Failed to create the service attachment.")
-		return err
-	}
-	return nil
+	l[managedByLabel] = portmapperApp
+	return l
 }
 
 func nodeportName(prefix string) string {
@@ -523,6 +1060,11 @@ func firewallName(prefix string) string {
 	return nameBase(prefix) + "-firewall"
 }
 
+// portFirewallName is the name of the port's firewall if the spec sets firewall_per_port.
+func portFirewallName(prefix, port string) string {
+	return api.PortFirewallName(prefix, port)
+}
+
 func negName(prefix string) string {
 	return nameBase(prefix) + "-neg"
 }
@@ -540,10 +1082,11 @@ func svcAttName(prefix string) string {
 }
 
 func nameBase(prefix string) string {
-	return prefix + portmapperApp
+	return api.NameBase(prefix)
 }
 
-// returns the *gcp.PortMapping that are in the second slice but not in the first
+// getObsoletePortMappings returns the actual mappings that aren't expected. With the arguments
+// swapped, it returns the expected mappings that are missing.
 func getObsoletePortMappings(expected, actual []*gcp.PortMapping) []*gcp.PortMapping {
 	// Create a map to store the port mappings from the first slice
 	portMap := make(map[gcp.PortMapping]struct{})
@@ -576,21 +1119,13 @@ func toConsumerProjectLimits(cs []*Consumer) []*computepb.ServiceAttachmentConsu
 	return consumerAcceptList
 }
 
-var providerIDRegexp = regexp.MustCompile(`^gce://([^/]+)/([^/]+)/([^/]+)$`)
-
 func fqInstaceName(nodeProviderID string) (string, error) {
 	// gce://<project-id>/<zone>/<instance-name>
 	// into
 	// projects/<project-id>/zones/<zone>/instances/<instance-name>
-	matches := providerIDRegexp.FindStringSubmatch(nodeProviderID)
-	if len(matches) != 4 {
-		return "", fmt.Errorf("invalid provider ID format, expected 'gce://<project-id>/<zone>/<instance-name>', got: %s", nodeProviderID)
+	projectID, zone, instanceName, err := gcp.ParseProviderID(nodeProviderID)
+	if err != nil {
+		return "", err
 	}
-
-	// matches[0] is the full string, matches[1:] are the capture groups
-	projectID := matches[1]
-	zone := matches[2]
-	instanceName := matches[3]
-
-	return fmt.Sprintf("projects/%s/zones/%s/instances/%s", projectID, zone, instanceName), nil
+	return gcp.InstanceFQN(projectID, zone, instanceName), nil
 }
@@ -5,20 +5,29 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"strconv"
 	"testing"
 
 	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/0x5d/psc-portmapper/api"
 	"github.com/0x5d/psc-portmapper/internal/gcp"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
 	"github.com/0x5d/psc-portmapper/internal/gcp/mock"
+	"github.com/go-logr/logr/testr"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/mock/gomock"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
@@ -56,13 +65,13 @@ func initialState() *state {
 	app := "my-app"
 	n := len(zones)
 
-	spec := &Spec{
+	spec := &Spec{Spec: api.Spec{
 		Prefix:        "prefix-",
 		NatSubnetFQNs: []string{fmt.Sprintf("projects/%s/regions/us-east1/subnetworks/my-subnet", project)},
 		NodePorts: map[string]PortConfig{
 			"app": {NodePort: 30000, ContainerPort: 8080, StartingPort: 30000},
 		},
-	}
+	}}
 	specStr, _ := json.Marshal(spec)
 
 	// Nodes
@@ -106,7 +115,7 @@ func initialState() *state {
 		pods = append(pods, corev1.Pod{
 			ObjectMeta: metav1.ObjectMeta{
 				Namespace: namespace,
-				Name:      fmt.Sprintf("pod-%d", i),
+				Name:      fmt.Sprintf("%s-%d", stsName, i),
 				Labels:    selector.MatchLabels,
 			},
 			Spec: corev1.PodSpec{
@@ -177,6 +186,77 @@ func TestGetObsoletePortMappings(t *testing.T) {
 	}
 }
 
+func TestGetPortMappings(t *testing.T) {
+	node := &corev1.Node{Spec: corev1.NodeSpec{ProviderID: "gce://my-project/us-east1-a/node-0"}}
+	instance, err := fqInstaceName(node.Spec.ProviderID)
+	require.NoError(t, err)
+	instances := map[string]string{"node-0": instance}
+	spec := &Spec{Spec: api.Spec{NodePorts: map[string]PortConfig{"app": {NodePort: 30000, StartingPort: 40000}}}}
+	pod := func(name string) corev1.Pod {
+		return corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       corev1.PodSpec{NodeName: "node-0"},
+		}
+	}
+
+	tests := []struct {
+		name             string
+		ordinals         *appsv1.StatefulSetOrdinals
+		negEndpointLimit int
+		pods             []corev1.Pod
+		expectedPorts    []int32
+	}{{
+		name:          "Maps the ports from the first ordinal",
+		pods:          []corev1.Pod{pod("sts-0"), pod("sts-1"), pod("sts-2")},
+		expectedPorts: []int32{40000, 40001, 40002},
+	}, {
+		name:          "Maps the ports by ordinal, not by position",
+		pods:          []corev1.Pod{pod("sts-2"), pod("sts-0")},
+		expectedPorts: []int32{40002, 40000},
+	}, {
+		name:          "Offsets the ports by ordinals.start",
+		ordinals:      &appsv1.StatefulSetOrdinals{Start: 5},
+		pods:          []corev1.Pod{pod("sts-5"), pod("sts-6"), pod("sts-7")},
+		expectedPorts: []int32{40000, 40001, 40002},
+	}, {
+		name:          "Skips pods outside of the ordinals",
+		ordinals:      &appsv1.StatefulSetOrdinals{Start: 5},
+		pods:          []corev1.Pod{pod("sts-4"), pod("sts-5"), pod("sts-8")},
+		expectedPorts: []int32{40000},
+	}, {
+		name:          "Skips pods that aren't named after the STS",
+		pods:          []corev1.Pod{pod("other-0"), pod("sts-x"), pod("sts-1")},
+		expectedPorts: []int32{40001},
+	}, {
+		name:             "Skips pods beyond the NEG endpoint limit",
+		negEndpointLimit: 2,
+		pods:             []corev1.Pod{pod("sts-0"), pod("sts-1"), pod("sts-2")},
+		expectedPorts:    []int32{40000, 40001},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sts := &appsv1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{Name: "sts"},
+				Spec:       appsv1.StatefulSetSpec{Replicas: ptr.To(int32(3)), Ordinals: tt.ordinals},
+			}
+			settings := DefaultSettings()
+			if tt.negEndpointLimit != 0 {
+				settings.NEGEndpointLimit = tt.negEndpointLimit
+			}
+			r := New(nil, nil, WithSettings(settings))
+			mappings := r.getPortMappings(testr.New(t), spec, sts, instances, tt.pods)
+			var ports []int32
+			for _, m := range mappings {
+				require.Equal(t, instance, m.Instance)
+				require.Equal(t, int32(30000), m.InstancePort)
+				ports = append(ports, m.Port)
+			}
+			require.Equal(t, tt.expectedPorts, ports)
+		})
+	}
+}
+
 func TestReconcile(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -208,10 +288,10 @@ func TestReconcile(t *testing.T) {
 			consumers := toConsumerProjectLimits(s.spec.ConsumerAcceptList)
 
 			notFound(m.GetFirewall(mctx, fw))
-			noErr(m.CreateFirewall(mctx, fw, ports))
+			noErr(m.CreateFirewall(mctx, fw, gcp.FirewallRule{Ports: ports}))
 
 			notFound(m.GetNEG(mctx, neg))
-			noErr(m.CreatePortmapNEG(mctx, neg))
+			noErr(m.CreatePortmapNEG(mctx, neg, "", nil))
 
 			notFound(m.GetBackendService(mctx, be))
 			noErr(m.CreateBackendService(mctx, be, neg))
@@ -220,10 +300,11 @@ func TestReconcile(t *testing.T) {
 			noErr(m.AttachEndpoints(mctx, neg, s.portMappings()))
 
 			notFound(m.GetForwardingRule(mctx, fwdRule))
-			noErr(m.CreateForwardingRule(mctx, fwdRule, be, nil, nil))
+			noErr(m.CreateForwardingRule(mctx, fwdRule, be, "", nil, nil))
+			once(m.GetForwardingRule(mctx, fwdRule)).Return(fwdRuleWithIP(), nil)
 
 			notFound(m.GetServiceAttachment(mctx, svcAtt))
-			noErr(m.CreateServiceAttachment(mctx, svcAtt, fwdRuleFQN, consumers, s.spec.NatSubnetFQNs))
+			noErr(m.CreateServiceAttachment(mctx, svcAtt, fwdRuleFQN, consumers, s.spec.NatSubnetFQNs, nil))
 		},
 		assert: func(t *testing.T, c client.Client, s *state) {
 			// Check that the nodeport was created too.
@@ -251,9 +332,25 @@ func TestReconcile(t *testing.T) {
 	}, {
 		name: "Fails if it can't get the firewall",
 		setup: func(t *testing.T, mock *mock.MockClient, s *state) {
-			getErr(mock.EXPECT().GetFirewall(mctx, fw), errors.New("can't get firewall"))
+			m := mock.EXPECT()
+			fwdRuleFQN := gcp.ForwardingRuleFQN(s.project, s.region, fwdRule)
+			consumers := toConsumerProjectLimits(s.spec.ConsumerAcceptList)
+			getErr(m.GetFirewall(mctx, fw), errors.New("can't get firewall"))
+
+			// The NEG and the resources depending on it don't depend on the firewall.
+			notFound(m.GetNEG(mctx, neg))
+			noErr(m.CreatePortmapNEG(mctx, neg, "", nil))
+			notFound(m.GetBackendService(mctx, be))
+			noErr(m.CreateBackendService(mctx, be, neg))
+			once(m.ListEndpoints(mctx, neg)).Return([]*gcp.PortMapping{}, nil)
+			noErr(m.AttachEndpoints(mctx, neg, s.portMappings()))
+			notFound(m.GetForwardingRule(mctx, fwdRule))
+			noErr(m.CreateForwardingRule(mctx, fwdRule, be, "", nil, nil))
+			once(m.GetForwardingRule(mctx, fwdRule)).Return(fwdRuleWithIP(), nil)
+			notFound(m.GetServiceAttachment(mctx, svcAtt))
+			noErr(m.CreateServiceAttachment(mctx, svcAtt, fwdRuleFQN, consumers, s.spec.NatSubnetFQNs, nil))
 		},
-		expectedRes:    reconcile.Result{RequeueAfter: requeueDelay},
+		expectedRes:    reconcile.Result{RequeueAfter: defaultRequeueDelay},
 		expectedErrMsg: "can't get firewall",
 	}, {
 		name: "Fails if it can't create the firewall",
@@ -263,10 +360,25 @@ func TestReconcile(t *testing.T) {
 			for _, port := range s.spec.NodePorts {
 				ports[port.NodePort] = struct{}{}
 			}
+			fwdRuleFQN := gcp.ForwardingRuleFQN(s.project, s.region, fwdRule)
+			consumers := toConsumerProjectLimits(s.spec.ConsumerAcceptList)
 			notFound(m.GetFirewall(mctx, fw))
-			callErr(m.CreateFirewall(mctx, fw, ports), errors.New("can't create firewall"))
+			callErr(m.CreateFirewall(mctx, fw, gcp.FirewallRule{Ports: ports}), errors.New("can't create firewall"))
+
+			// The NEG and the resources depending on it don't depend on the firewall.
+			notFound(m.GetNEG(mctx, neg))
+			noErr(m.CreatePortmapNEG(mctx, neg, "", nil))
+			notFound(m.GetBackendService(mctx, be))
+			noErr(m.CreateBackendService(mctx, be, neg))
+			once(m.ListEndpoints(mctx, neg)).Return([]*gcp.PortMapping{}, nil)
+			noErr(m.AttachEndpoints(mctx, neg, s.portMappings()))
+			notFound(m.GetForwardingRule(mctx, fwdRule))
+			noErr(m.CreateForwardingRule(mctx, fwdRule, be, "", nil, nil))
+			once(m.GetForwardingRule(mctx, fwdRule)).Return(fwdRuleWithIP(), nil)
+			notFound(m.GetServiceAttachment(mctx, svcAtt))
+			noErr(m.CreateServiceAttachment(mctx, svcAtt, fwdRuleFQN, consumers, s.spec.NatSubnetFQNs, nil))
 		},
-		expectedRes:    reconcile.Result{RequeueAfter: requeueDelay},
+		expectedRes:    reconcile.Result{RequeueAfter: defaultRequeueDelay},
 		expectedErrMsg: "can't create firewall",
 	}, {
 		name: "Fails if it can't get the neg",
@@ -277,10 +389,10 @@ func TestReconcile(t *testing.T) {
 				ports[port.NodePort] = struct{}{}
 			}
 			notFound(m.GetFirewall(mctx, fw))
-			noErr(m.CreateFirewall(mctx, fw, ports))
+			noErr(m.CreateFirewall(mctx, fw, gcp.FirewallRule{Ports: ports}))
 			getErr(m.GetNEG(mctx, neg), errors.New("can't get NEG"))
 		},
-		expectedRes:    reconcile.Result{RequeueAfter: requeueDelay},
+		expectedRes:    reconcile.Result{RequeueAfter: defaultRequeueDelay},
 		expectedErrMsg: "can't get NEG",
 	}, {
 		name: "Fails if it can't create the neg",
@@ -291,11 +403,11 @@ func TestReconcile(t *testing.T) {
 				ports[port.NodePort] = struct{}{}
 			}
 			notFound(m.GetFirewall(mctx, fw))
-			noErr(m.CreateFirewall(mctx, fw, ports))
+			noErr(m.CreateFirewall(mctx, fw, gcp.FirewallRule{Ports: ports}))
 			notFound(m.GetNEG(mctx, neg))
-			once(m.CreatePortmapNEG(mctx, neg)).Return(errors.New("can't create NEG"))
+			once(m.CreatePortmapNEG(mctx, neg, "", nil)).Return(errors.New("can't create NEG"))
 		},
-		expectedRes:    reconcile.Result{RequeueAfter: requeueDelay},
+		expectedRes:    reconcile.Result{RequeueAfter: defaultRequeueDelay},
 		expectedErrMsg: "can't create NEG",
 	}, {
 		name: "Fails if it can't get the backend",
@@ -306,12 +418,16 @@ func TestReconcile(t *testing.T) {
 				ports[port.NodePort] = struct{}{}
 			}
 			notFound(m.GetFirewall(mctx, fw))
-			noErr(m.CreateFirewall(mctx, fw, ports))
+			noErr(m.CreateFirewall(mctx, fw, gcp.FirewallRule{Ports: ports}))
 			notFound(m.GetNEG(mctx, neg))
-			noErr(m.CreatePortmapNEG(mctx, neg))
+			noErr(m.CreatePortmapNEG(mctx, neg, "", nil))
 			getErr(m.GetBackendService(mctx, be), errors.New("can't get backend"))
+
+			// The endpoints don't depend on the backend.
+			once(m.ListEndpoints(mctx, neg)).Return([]*gcp.PortMapping{}, nil)
+			noErr(m.AttachEndpoints(mctx, neg, s.portMappings()))
 		},
-		expectedRes:    reconcile.Result{RequeueAfter: requeueDelay},
+		expectedRes:    reconcile.Result{RequeueAfter: defaultRequeueDelay},
 		expectedErrMsg: "can't get backend",
 	}, {
 		name: "Fails if it can't create the backend",
@@ -322,13 +438,17 @@ func TestReconcile(t *testing.T) {
 				ports[port.NodePort] = struct{}{}
 			}
 			notFound(m.GetFirewall(mctx, fw))
-			noErr(m.CreateFirewall(mctx, fw, ports))
+			noErr(m.CreateFirewall(mctx, fw, gcp.FirewallRule{Ports: ports}))
 			notFound(m.GetNEG(mctx, neg))
-			noErr(m.CreatePortmapNEG(mctx, neg))
+			noErr(m.CreatePortmapNEG(mctx, neg, "", nil))
 			notFound(m.GetBackendService(mctx, be))
 			callErr(m.CreateBackendService(mctx, be, neg), errors.New("can't create backend"))
+
+			// The endpoints don't depend on the backend.
+			once(m.ListEndpoints(mctx, neg)).Return([]*gcp.PortMapping{}, nil)
+			noErr(m.AttachEndpoints(mctx, neg, s.portMappings()))
 		},
-		expectedRes:    reconcile.Result{RequeueAfter: requeueDelay},
+		expectedRes:    reconcile.Result{RequeueAfter: defaultRequeueDelay},
 		expectedErrMsg: "can't create backend",
 	}, {
 		name: "Fails if it can't list the endpoints",
@@ -338,15 +458,25 @@ func TestReconcile(t *testing.T) {
 			for _, port := range s.spec.NodePorts {
 				ports[port.NodePort] = struct{}{}
 			}
+			fwdRuleFQN := gcp.ForwardingRuleFQN(s.project, s.region, fwdRule)
+			consumers := toConsumerProjectLimits(s.spec.ConsumerAcceptList)
+
 			notFound(m.GetFirewall(mctx, fw))
-			noErr(m.CreateFirewall(mctx, fw, ports))
+			noErr(m.CreateFirewall(mctx, fw, gcp.FirewallRule{Ports: ports}))
 			notFound(m.GetNEG(mctx, neg))
-			noErr(m.CreatePortmapNEG(mctx, neg))
+			noErr(m.CreatePortmapNEG(mctx, neg, "", nil))
 			notFound(m.GetBackendService(mctx, be))
 			noErr(m.CreateBackendService(mctx, be, neg))
 			once(m.ListEndpoints(mctx, neg)).Return(nil, errors.New("can't list endpoints"))
+
+			// The forwarding rule and the service attachment don't depend on the endpoints.
+			notFound(m.GetForwardingRule(mctx, fwdRule))
+			noErr(m.CreateForwardingRule(mctx, fwdRule, be, "", nil, nil))
+			once(m.GetForwardingRule(mctx, fwdRule)).Return(fwdRuleWithIP(), nil)
+			notFound(m.GetServiceAttachment(mctx, svcAtt))
+			noErr(m.CreateServiceAttachment(mctx, svcAtt, fwdRuleFQN, consumers, s.spec.NatSubnetFQNs, nil))
 		},
-		expectedRes:    reconcile.Result{RequeueAfter: requeueDelay},
+		expectedRes:    reconcile.Result{RequeueAfter: defaultRequeueDelay},
 		expectedErrMsg: "can't list endpoints",
 	}, {
 		name: "Fails if it can't attach the endpoints",
@@ -356,16 +486,26 @@ func TestReconcile(t *testing.T) {
 			for _, port := range s.spec.NodePorts {
 				ports[port.NodePort] = struct{}{}
 			}
+			fwdRuleFQN := gcp.ForwardingRuleFQN(s.project, s.region, fwdRule)
+			consumers := toConsumerProjectLimits(s.spec.ConsumerAcceptList)
+
 			notFound(m.GetFirewall(mctx, fw))
-			noErr(m.CreateFirewall(mctx, fw, ports))
+			noErr(m.CreateFirewall(mctx, fw, gcp.FirewallRule{Ports: ports}))
 			notFound(m.GetNEG(mctx, neg))
-			noErr(m.CreatePortmapNEG(mctx, neg))
+			noErr(m.CreatePortmapNEG(mctx, neg, "", nil))
 			notFound(m.GetBackendService(mctx, be))
 			noErr(m.CreateBackendService(mctx, be, neg))
 			once(m.ListEndpoints(mctx, neg)).Return([]*gcp.PortMapping{}, nil)
 			callErr(m.AttachEndpoints(mctx, neg, s.portMappings()), errors.New("can't attach endpoints"))
+
+			// The forwarding rule and the service attachment don't depend on the endpoints.
+			notFound(m.GetForwardingRule(mctx, fwdRule))
+			noErr(m.CreateForwardingRule(mctx, fwdRule, be, "", nil, nil))
+			once(m.GetForwardingRule(mctx, fwdRule)).Return(fwdRuleWithIP(), nil)
+			notFound(m.GetServiceAttachment(mctx, svcAtt))
+			noErr(m.CreateServiceAttachment(mctx, svcAtt, fwdRuleFQN, consumers, s.spec.NatSubnetFQNs, nil))
 		},
-		expectedRes:    reconcile.Result{RequeueAfter: requeueDelay},
+		expectedRes:    reconcile.Result{RequeueAfter: defaultRequeueDelay},
 		expectedErrMsg: "can't attach endpoints",
 	}, {
 		name: "Fails if it can't get the forwarding rule",
@@ -376,16 +516,16 @@ func TestReconcile(t *testing.T) {
 				ports[port.NodePort] = struct{}{}
 			}
 			notFound(m.GetFirewall(mctx, fw))
-			noErr(m.CreateFirewall(mctx, fw, ports))
+			noErr(m.CreateFirewall(mctx, fw, gcp.FirewallRule{Ports: ports}))
 			notFound(m.GetNEG(mctx, neg))
-			noErr(m.CreatePortmapNEG(mctx, neg))
+			noErr(m.CreatePortmapNEG(mctx, neg, "", nil))
 			notFound(m.GetBackendService(mctx, be))
 			noErr(m.CreateBackendService(mctx, be, neg))
 			once(m.ListEndpoints(mctx, neg)).Return([]*gcp.PortMapping{}, nil)
 			noErr(m.AttachEndpoints(mctx, neg, s.portMappings()))
 			getErr(m.GetForwardingRule(mctx, fwdRule), errors.New("can't get forwarding rule"))
 		},
-		expectedRes:    reconcile.Result{RequeueAfter: requeueDelay},
+		expectedRes:    reconcile.Result{RequeueAfter: defaultRequeueDelay},
 		expectedErrMsg: "can't get forwarding rule",
 	}, {
 		name: "Fails if it can't create the forwarding rule",
@@ -396,17 +536,17 @@ func TestReconcile(t *testing.T) {
 				ports[port.NodePort] = struct{}{}
 			}
 			notFound(m.GetFirewall(mctx, fw))
-			noErr(m.CreateFirewall(mctx, fw, ports))
+			noErr(m.CreateFirewall(mctx, fw, gcp.FirewallRule{Ports: ports}))
 			notFound(m.GetNEG(mctx, neg))
-			noErr(m.CreatePortmapNEG(mctx, neg))
+			noErr(m.CreatePortmapNEG(mctx, neg, "", nil))
 			notFound(m.GetBackendService(mctx, be))
 			noErr(m.CreateBackendService(mctx, be, neg))
 			once(m.ListEndpoints(mctx, neg)).Return([]*gcp.PortMapping{}, nil)
 			noErr(m.AttachEndpoints(mctx, neg, s.portMappings()))
 			notFound(m.GetForwardingRule(mctx, fwdRule))
-			callErr(m.CreateForwardingRule(mctx, fwdRule, be, nil, nil), errors.New("can't create forwarding rule"))
+			callErr(m.CreateForwardingRule(mctx, fwdRule, be, "", nil, nil), errors.New("can't create forwarding rule"))
 		},
-		expectedRes:    reconcile.Result{RequeueAfter: requeueDelay},
+		expectedRes:    reconcile.Result{RequeueAfter: defaultRequeueDelay},
 		expectedErrMsg: "can't create forwarding rule",
 	}, {
 		name: "Fails if it can't get the service attachment",
@@ -417,18 +557,19 @@ func TestReconcile(t *testing.T) {
 				ports[port.NodePort] = struct{}{}
 			}
 			notFound(m.GetFirewall(mctx, fw))
-			noErr(m.CreateFirewall(mctx, fw, ports))
+			noErr(m.CreateFirewall(mctx, fw, gcp.FirewallRule{Ports: ports}))
 			notFound(m.GetNEG(mctx, neg))
-			noErr(m.CreatePortmapNEG(mctx, neg))
+			noErr(m.CreatePortmapNEG(mctx, neg, "", nil))
 			notFound(m.GetBackendService(mctx, be))
 			noErr(m.CreateBackendService(mctx, be, neg))
 			once(m.ListEndpoints(mctx, neg)).Return([]*gcp.PortMapping{}, nil)
 			noErr(m.AttachEndpoints(mctx, neg, s.portMappings()))
 			notFound(m.GetForwardingRule(mctx, fwdRule))
-			noErr(m.CreateForwardingRule(mctx, fwdRule, be, nil, nil))
+			noErr(m.CreateForwardingRule(mctx, fwdRule, be, "", nil, nil))
+			once(m.GetForwardingRule(mctx, fwdRule)).Return(fwdRuleWithIP(), nil)
 			getErr(m.GetServiceAttachment(mctx, svcAtt), errors.New("can't get service attachment"))
 		},
-		expectedRes:    reconcile.Result{RequeueAfter: requeueDelay},
+		expectedRes:    reconcile.Result{RequeueAfter: defaultRequeueDelay},
 		expectedErrMsg: "can't get service attachment",
 	}, {
 		name: "Fails if it can't create the service attachment",
@@ -442,19 +583,20 @@ func TestReconcile(t *testing.T) {
 			consumers := toConsumerProjectLimits(s.spec.ConsumerAcceptList)
 
 			notFound(m.GetFirewall(mctx, fw))
-			noErr(m.CreateFirewall(mctx, fw, ports))
+			noErr(m.CreateFirewall(mctx, fw, gcp.FirewallRule{Ports: ports}))
 			notFound(m.GetNEG(mctx, neg))
-			noErr(m.CreatePortmapNEG(mctx, neg))
+			noErr(m.CreatePortmapNEG(mctx, neg, "", nil))
 			notFound(m.GetBackendService(mctx, be))
 			noErr(m.CreateBackendService(mctx, be, neg))
 			once(m.ListEndpoints(mctx, neg)).Return([]*gcp.PortMapping{}, nil)
 			noErr(m.AttachEndpoints(mctx, neg, s.portMappings()))
 			notFound(m.GetForwardingRule(mctx, fwdRule))
-			noErr(m.CreateForwardingRule(mctx, fwdRule, be, nil, nil))
+			noErr(m.CreateForwardingRule(mctx, fwdRule, be, "", nil, nil))
+			once(m.GetForwardingRule(mctx, fwdRule)).Return(fwdRuleWithIP(), nil)
 			notFound(m.GetServiceAttachment(mctx, svcAtt))
-			callErr(m.CreateServiceAttachment(mctx, svcAtt, fwdRuleFQN, consumers, s.spec.NatSubnetFQNs), errors.New("can't create service attachment"))
+			callErr(m.CreateServiceAttachment(mctx, svcAtt, fwdRuleFQN, consumers, s.spec.NatSubnetFQNs, nil), errors.New("can't create service attachment"))
 		},
-		expectedRes:    reconcile.Result{RequeueAfter: requeueDelay},
+		expectedRes:    reconcile.Result{RequeueAfter: defaultRequeueDelay},
 		expectedErrMsg: "can't create service attachment",
 	}, {
 		name: "Doesn't create or update the firewall if it already exists and is up to date",
@@ -472,15 +614,16 @@ func TestReconcile(t *testing.T) {
 			once(m.GetFirewall(mctx, fw)).Return(firewall(strPorts), nil)
 
 			notFound(m.GetNEG(mctx, neg))
-			noErr(m.CreatePortmapNEG(mctx, neg))
+			noErr(m.CreatePortmapNEG(mctx, neg, "", nil))
 			notFound(m.GetBackendService(mctx, be))
 			noErr(m.CreateBackendService(mctx, be, neg))
 			once(m.ListEndpoints(mctx, neg)).Return([]*gcp.PortMapping{}, nil)
 			noErr(m.AttachEndpoints(mctx, neg, s.portMappings()))
 			notFound(m.GetForwardingRule(mctx, fwdRule))
-			noErr(m.CreateForwardingRule(mctx, fwdRule, be, nil, nil))
+			noErr(m.CreateForwardingRule(mctx, fwdRule, be, "", nil, nil))
+			once(m.GetForwardingRule(mctx, fwdRule)).Return(fwdRuleWithIP(), nil)
 			notFound(m.GetServiceAttachment(mctx, svcAtt))
-			noErr(m.CreateServiceAttachment(mctx, svcAtt, fwdRuleFQN, consumers, s.spec.NatSubnetFQNs))
+			noErr(m.CreateServiceAttachment(mctx, svcAtt, fwdRuleFQN, consumers, s.spec.NatSubnetFQNs, nil))
 		},
 	}, {
 		name: "Updates the firewall",
@@ -494,18 +637,19 @@ func TestReconcile(t *testing.T) {
 			consumers := toConsumerProjectLimits(s.spec.ConsumerAcceptList)
 
 			once(m.GetFirewall(mctx, fw)).Return(firewall(nil), nil)
-			noErr(m.UpdateFirewall(mctx, fw, ports))
+			noErr(m.UpdateFirewall(mctx, fw, gcp.FirewallRule{Ports: ports}))
 
 			notFound(m.GetNEG(mctx, neg))
-			noErr(m.CreatePortmapNEG(mctx, neg))
+			noErr(m.CreatePortmapNEG(mctx, neg, "", nil))
 			notFound(m.GetBackendService(mctx, be))
 			noErr(m.CreateBackendService(mctx, be, neg))
 			once(m.ListEndpoints(mctx, neg)).Return([]*gcp.PortMapping{}, nil)
 			noErr(m.AttachEndpoints(mctx, neg, s.portMappings()))
 			notFound(m.GetForwardingRule(mctx, fwdRule))
-			noErr(m.CreateForwardingRule(mctx, fwdRule, be, nil, nil))
+			noErr(m.CreateForwardingRule(mctx, fwdRule, be, "", nil, nil))
+			once(m.GetForwardingRule(mctx, fwdRule)).Return(fwdRuleWithIP(), nil)
 			notFound(m.GetServiceAttachment(mctx, svcAtt))
-			noErr(m.CreateServiceAttachment(mctx, svcAtt, fwdRuleFQN, consumers, s.spec.NatSubnetFQNs))
+			noErr(m.CreateServiceAttachment(mctx, svcAtt, fwdRuleFQN, consumers, s.spec.NatSubnetFQNs, nil))
 		},
 	}, {
 		name: "Doesn't create the NEG if it already exists",
@@ -522,16 +666,17 @@ func TestReconcile(t *testing.T) {
 
 			once(m.GetFirewall(mctx, fw)).Return(firewall(strPorts), nil)
 
-			once(m.GetNEG(mctx, neg)).Return(&computepb.NetworkEndpointGroup{}, nil)
+			once(m.GetNEG(mctx, neg)).Return(&computepb.NetworkEndpointGroup{Description: managed}, nil)
 
 			notFound(m.GetBackendService(mctx, be))
 			noErr(m.CreateBackendService(mctx, be, neg))
 			once(m.ListEndpoints(mctx, neg)).Return([]*gcp.PortMapping{}, nil)
 			noErr(m.AttachEndpoints(mctx, neg, s.portMappings()))
 			notFound(m.GetForwardingRule(mctx, fwdRule))
-			noErr(m.CreateForwardingRule(mctx, fwdRule, be, nil, nil))
+			noErr(m.CreateForwardingRule(mctx, fwdRule, be, "", nil, nil))
+			once(m.GetForwardingRule(mctx, fwdRule)).Return(fwdRuleWithIP(), nil)
 			notFound(m.GetServiceAttachment(mctx, svcAtt))
-			noErr(m.CreateServiceAttachment(mctx, svcAtt, fwdRuleFQN, consumers, s.spec.NatSubnetFQNs))
+			noErr(m.CreateServiceAttachment(mctx, svcAtt, fwdRuleFQN, consumers, s.spec.NatSubnetFQNs, nil))
 		},
 	}, {
 		name: "Doesn't create the backend if it already exists",
@@ -547,16 +692,17 @@ func TestReconcile(t *testing.T) {
 			consumers := toConsumerProjectLimits(s.spec.ConsumerAcceptList)
 
 			once(m.GetFirewall(mctx, fw)).Return(firewall(strPorts), nil)
-			once(m.GetNEG(mctx, neg)).Return(&computepb.NetworkEndpointGroup{}, nil)
+			once(m.GetNEG(mctx, neg)).Return(&computepb.NetworkEndpointGroup{Description: managed}, nil)
 
-			once(m.GetBackendService(mctx, be)).Return(&computepb.BackendService{}, nil)
+			once(m.GetBackendService(mctx, be)).Return(&computepb.BackendService{Description: managed}, nil)
 
 			once(m.ListEndpoints(mctx, neg)).Return([]*gcp.PortMapping{}, nil)
 			noErr(m.AttachEndpoints(mctx, neg, s.portMappings()))
 			notFound(m.GetForwardingRule(mctx, fwdRule))
-			noErr(m.CreateForwardingRule(mctx, fwdRule, be, nil, nil))
+			noErr(m.CreateForwardingRule(mctx, fwdRule, be, "", nil, nil))
+			once(m.GetForwardingRule(mctx, fwdRule)).Return(fwdRuleWithIP(), nil)
 			notFound(m.GetServiceAttachment(mctx, svcAtt))
-			noErr(m.CreateServiceAttachment(mctx, svcAtt, fwdRuleFQN, consumers, s.spec.NatSubnetFQNs))
+			noErr(m.CreateServiceAttachment(mctx, svcAtt, fwdRuleFQN, consumers, s.spec.NatSubnetFQNs, nil))
 		},
 	}, {
 		name: "Doesn't create the forwarding rule if it already exists",
@@ -570,15 +716,15 @@ func TestReconcile(t *testing.T) {
 			consumers := toConsumerProjectLimits(s.spec.ConsumerAcceptList)
 
 			once(m.GetFirewall(mctx, fw)).Return(firewall(strPorts), nil)
-			once(m.GetNEG(mctx, neg)).Return(&computepb.NetworkEndpointGroup{}, nil)
-			once(m.GetBackendService(mctx, be)).Return(&computepb.BackendService{}, nil)
+			once(m.GetNEG(mctx, neg)).Return(&computepb.NetworkEndpointGroup{Description: managed}, nil)
+			once(m.GetBackendService(mctx, be)).Return(&computepb.BackendService{Description: managed}, nil)
 			once(m.ListEndpoints(mctx, neg)).Return([]*gcp.PortMapping{}, nil)
 			noErr(m.AttachEndpoints(mctx, neg, s.portMappings()))
 
-			once(m.GetForwardingRule(mctx, fwdRule)).Return(&computepb.ForwardingRule{}, nil)
+			once(m.GetForwardingRule(mctx, fwdRule)).Return(&computepb.ForwardingRule{Description: managed}, nil)
 
 			notFound(m.GetServiceAttachment(mctx, svcAtt))
-			noErr(m.CreateServiceAttachment(mctx, svcAtt, fwdRuleFQN, consumers, s.spec.NatSubnetFQNs))
+			noErr(m.CreateServiceAttachment(mctx, svcAtt, fwdRuleFQN, consumers, s.spec.NatSubnetFQNs, nil))
 		},
 	}, {
 		name: "Doesn't create the service attachment if it already exists",
@@ -590,13 +736,14 @@ func TestReconcile(t *testing.T) {
 			}
 
 			once(m.GetFirewall(mctx, fw)).Return(firewall(strPorts), nil)
-			once(m.GetNEG(mctx, neg)).Return(&computepb.NetworkEndpointGroup{}, nil)
-			once(m.GetBackendService(mctx, be)).Return(&computepb.BackendService{}, nil)
+			once(m.GetNEG(mctx, neg)).Return(&computepb.NetworkEndpointGroup{Description: managed}, nil)
+			once(m.GetBackendService(mctx, be)).Return(&computepb.BackendService{Description: managed}, nil)
 			once(m.ListEndpoints(mctx, neg)).Return([]*gcp.PortMapping{}, nil)
 			noErr(m.AttachEndpoints(mctx, neg, s.portMappings()))
-			once(m.GetForwardingRule(mctx, fwdRule)).Return(&computepb.ForwardingRule{}, nil)
+			once(m.GetForwardingRule(mctx, fwdRule)).Return(&computepb.ForwardingRule{Description: managed}, nil)
 
-			once(m.GetServiceAttachment(mctx, svcAtt)).Return(&computepb.ServiceAttachment{}, nil)
+			once(m.GetServiceAttachment(mctx, svcAtt)).Return(&computepb.ServiceAttachment{Description: managed, NatSubnets: s.spec.NatSubnetFQNs}, nil)
+			once(m.GetSubnetwork(mctx, s.spec.NatSubnetFQNs[0])).Return(&computepb.Subnetwork{IpCidrRange: ptr.To("10.0.0.0/24")}, nil)
 		},
 	}, {
 		name: "Detaches obsolete endpoints",
@@ -613,15 +760,36 @@ func TestReconcile(t *testing.T) {
 			}}
 
 			once(m.GetFirewall(mctx, fw)).Return(firewall(strPorts), nil)
-			once(m.GetNEG(mctx, neg)).Return(&computepb.NetworkEndpointGroup{}, nil)
-			once(m.GetBackendService(mctx, be)).Return(&computepb.BackendService{}, nil)
+			once(m.GetNEG(mctx, neg)).Return(&computepb.NetworkEndpointGroup{Description: managed}, nil)
+			once(m.GetBackendService(mctx, be)).Return(&computepb.BackendService{Description: managed}, nil)
 
 			once(m.ListEndpoints(mctx, neg)).Return(currentMappings, nil)
 			noErr(m.DetachEndpoints(mctx, neg, currentMappings))
 
 			noErr(m.AttachEndpoints(mctx, neg, s.portMappings()))
-			once(m.GetForwardingRule(mctx, fwdRule)).Return(&computepb.ForwardingRule{}, nil)
-			once(m.GetServiceAttachment(mctx, svcAtt)).Return(&computepb.ServiceAttachment{}, nil)
+			once(m.GetForwardingRule(mctx, fwdRule)).Return(&computepb.ForwardingRule{Description: managed}, nil)
+			once(m.GetServiceAttachment(mctx, svcAtt)).Return(&computepb.ServiceAttachment{Description: managed, NatSubnets: s.spec.NatSubnetFQNs}, nil)
+			once(m.GetSubnetwork(mctx, s.spec.NatSubnetFQNs[0])).Return(&computepb.Subnetwork{IpCidrRange: ptr.To("10.0.0.0/24")}, nil)
+		},
+	}, {
+		name: "Only attaches the missing endpoints",
+		setup: func(t *testing.T, mock *mock.MockClient, s *state) {
+			m := mock.EXPECT()
+			strPorts := make([]string, 0, len(s.spec.NodePorts))
+			for _, port := range s.spec.NodePorts {
+				strPorts = append(strPorts, strconv.Itoa(int(port.NodePort)))
+			}
+			mappings := s.portMappings()
+
+			once(m.GetFirewall(mctx, fw)).Return(firewall(strPorts), nil)
+			once(m.GetNEG(mctx, neg)).Return(&computepb.NetworkEndpointGroup{Description: managed}, nil)
+			once(m.GetBackendService(mctx, be)).Return(&computepb.BackendService{Description: managed}, nil)
+
+			once(m.ListEndpoints(mctx, neg)).Return(mappings[:1], nil)
+			noErr(m.AttachEndpoints(mctx, neg, mappings[1:]))
+			once(m.GetForwardingRule(mctx, fwdRule)).Return(&computepb.ForwardingRule{Description: managed}, nil)
+			once(m.GetServiceAttachment(mctx, svcAtt)).Return(&computepb.ServiceAttachment{Description: managed, NatSubnets: s.spec.NatSubnetFQNs}, nil)
+			once(m.GetSubnetwork(mctx, s.spec.NatSubnetFQNs[0])).Return(&computepb.Subnetwork{IpCidrRange: ptr.To("10.0.0.0/24")}, nil)
 		},
 	}}
 
@@ -692,17 +860,62 @@ func TestDelete(t *testing.T) {
 		consumers := toConsumerProjectLimits(s.spec.ConsumerAcceptList)
 
 		notFound(m.GetFirewall(mctx, fw))
-		noErr(m.CreateFirewall(mctx, fw, ports))
+		noErr(m.CreateFirewall(mctx, fw, gcp.FirewallRule{Ports: ports}))
 		notFound(m.GetNEG(mctx, neg))
-		noErr(m.CreatePortmapNEG(mctx, neg))
+		noErr(m.CreatePortmapNEG(mctx, neg, "", nil))
 		notFound(m.GetBackendService(mctx, be))
 		noErr(m.CreateBackendService(mctx, be, neg))
 		once(m.ListEndpoints(mctx, neg)).Return([]*gcp.PortMapping{}, nil)
 		noErr(m.AttachEndpoints(mctx, neg, s.portMappings()))
 		notFound(m.GetForwardingRule(mctx, fwdRule))
-		noErr(m.CreateForwardingRule(mctx, fwdRule, be, nil, nil))
+		noErr(m.CreateForwardingRule(mctx, fwdRule, be, "", nil, nil))
+		once(m.GetForwardingRule(mctx, fwdRule)).Return(fwdRuleWithIP(), nil)
 		notFound(m.GetServiceAttachment(mctx, svcAtt))
-		noErr(m.CreateServiceAttachment(mctx, svcAtt, fwdRuleFQN, consumers, s.spec.NatSubnetFQNs))
+		noErr(m.CreateServiceAttachment(mctx, svcAtt, fwdRuleFQN, consumers, s.spec.NatSubnetFQNs, nil))
+	}
+
+	// expectOwned expects the first n resources of the attachment chain to be deleted,
+	// dependents first, to be checked for ownership.
+	expectOwned := func(m *mock.MockClientMockRecorder, n int) {
+		gets := []func(){
+			func() {
+				once(m.GetServiceAttachment(mctx, svcAtt)).Return(&computepb.ServiceAttachment{Description: managed}, nil)
+			},
+			func() {
+				once(m.GetForwardingRule(mctx, fwdRule)).Return(&computepb.ForwardingRule{Description: managed}, nil)
+			},
+			func() {
+				once(m.GetBackendService(mctx, be)).Return(&computepb.BackendService{Description: managed}, nil)
+			},
+			func() {
+				once(m.GetNEG(mctx, neg)).Return(&computepb.NetworkEndpointGroup{Description: managed}, nil)
+			},
+		}
+		for _, get := range gets[:n] {
+			get()
+		}
+	}
+	// expectGone expects the first n resources of the attachment chain to be deleted,
+	// dependents first, to be verified to be gone once they're deleted.
+	expectGone := func(m *mock.MockClientMockRecorder, n int) {
+		gets := []func(){
+			func() { notFound(m.GetServiceAttachment(mctx, svcAtt)) },
+			func() { notFound(m.GetForwardingRule(mctx, fwdRule)) },
+			func() { notFound(m.GetBackendService(mctx, be)) },
+			func() { notFound(m.GetNEG(mctx, neg)) },
+		}
+		for _, get := range gets[:n] {
+			get()
+		}
+	}
+	// expectFirewall expects the firewall, which is deleted concurrently with the attachment
+	// chain, to be deleted with err, and then verified to be gone.
+	expectFirewall := func(m *mock.MockClientMockRecorder, err error) {
+		once(m.GetFirewall(mctx, fw)).Return(firewall(nil), nil)
+		callErr(m.DeleteFirewall(mctx, fw), err)
+		if err == nil || errors.Is(err, gcp.ErrNotFound) {
+			notFound(m.GetFirewall(mctx, fw))
+		}
 	}
 
 	tests := []struct {
@@ -716,11 +929,13 @@ func TestDelete(t *testing.T) {
 		name: "Deletes everything",
 		setup: func(t *testing.T, mock *mock.MockClient, s *state) {
 			m := mock.EXPECT()
+			expectOwned(m, 4)
 			noErr(m.DeleteServiceAttachment(mctx, svcAtt))
 			noErr(m.DeleteForwardingRule(mctx, fwdRule))
 			noErr(m.DeleteBackendService(mctx, be))
 			noErr(m.DeletePortmapNEG(mctx, neg))
-			noErr(m.DeleteFirewall(mctx, fw))
+			expectFirewall(m, nil)
+			expectGone(m, 4)
 		},
 		assert: func(t *testing.T, c client.Client, s *state) {
 			// Check that the nodeport was deleted too.
@@ -733,63 +948,115 @@ func TestDelete(t *testing.T) {
 		name: "Skips errors if the resources have been deleted",
 		setup: func(t *testing.T, mock *mock.MockClient, s *state) {
 			m := mock.EXPECT()
+			expectOwned(m, 4)
 			callErr(m.DeleteServiceAttachment(mctx, svcAtt), gcp.ErrNotFound)
 			callErr(m.DeleteForwardingRule(mctx, fwdRule), gcp.ErrNotFound)
 			callErr(m.DeleteBackendService(mctx, be), gcp.ErrNotFound)
 			callErr(m.DeletePortmapNEG(mctx, neg), gcp.ErrNotFound)
-			callErr(m.DeleteFirewall(mctx, fw), gcp.ErrNotFound)
+			expectFirewall(m, gcp.ErrNotFound)
+			expectGone(m, 4)
 		},
 		expectedRes: reconcile.Result{},
 	}, {
 		name: "Returns an error if it can't delete the service attachment",
 		setup: func(t *testing.T, mock *mock.MockClient, s *state) {
 			m := mock.EXPECT()
+			expectOwned(m, 1)
+			expectFirewall(m, nil)
 			callErr(m.DeleteServiceAttachment(mctx, svcAtt), errors.New("can't delete service attachment"))
 		},
-		expectedRes:    reconcile.Result{RequeueAfter: requeueDelay},
+		expectedRes:    reconcile.Result{RequeueAfter: defaultRequeueDelay},
 		expectedErrMsg: "can't delete service attachment",
 	}, {
 		name: "Returns an error if it can't delete the forwarding rule",
 		setup: func(t *testing.T, mock *mock.MockClient, s *state) {
 			m := mock.EXPECT()
+			expectOwned(m, 2)
+			expectFirewall(m, nil)
 			noErr(m.DeleteServiceAttachment(mctx, svcAtt))
+			expectGone(m, 1)
 			callErr(m.DeleteForwardingRule(mctx, fwdRule), errors.New("can't delete forwarding rule"))
 		},
-		expectedRes:    reconcile.Result{RequeueAfter: requeueDelay},
+		expectedRes:    reconcile.Result{RequeueAfter: defaultRequeueDelay},
 		expectedErrMsg: "can't delete forwarding rule",
 	}, {
 		name: "Returns an error if it can't delete the backend service",
 		setup: func(t *testing.T, mock *mock.MockClient, s *state) {
 			m := mock.EXPECT()
+			expectOwned(m, 3)
+			expectFirewall(m, nil)
 			noErr(m.DeleteServiceAttachment(mctx, svcAtt))
 			noErr(m.DeleteForwardingRule(mctx, fwdRule))
+			expectGone(m, 2)
 			callErr(m.DeleteBackendService(mctx, be), errors.New("can't delete backend service"))
 		},
-		expectedRes:    reconcile.Result{RequeueAfter: requeueDelay},
+		expectedRes:    reconcile.Result{RequeueAfter: defaultRequeueDelay},
 		expectedErrMsg: "can't delete backend service",
 	}, {
 		name: "Returns an error if it can't delete the NEG",
 		setup: func(t *testing.T, mock *mock.MockClient, s *state) {
 			m := mock.EXPECT()
+			expectOwned(m, 4)
+			expectFirewall(m, nil)
 			noErr(m.DeleteServiceAttachment(mctx, svcAtt))
 			noErr(m.DeleteForwardingRule(mctx, fwdRule))
 			noErr(m.DeleteBackendService(mctx, be))
+			expectGone(m, 3)
 			callErr(m.DeletePortmapNEG(mctx, neg), errors.New("can't delete NEG"))
 		},
-		expectedRes:    reconcile.Result{RequeueAfter: requeueDelay},
+		expectedRes:    reconcile.Result{RequeueAfter: defaultRequeueDelay},
 		expectedErrMsg: "can't delete NEG",
 	}, {
 		name: "Returns an error if it can't delete the firewall policies",
 		setup: func(t *testing.T, mock *mock.MockClient, s *state) {
 			m := mock.EXPECT()
+			expectOwned(m, 4)
 			noErr(m.DeleteServiceAttachment(mctx, svcAtt))
 			noErr(m.DeleteForwardingRule(mctx, fwdRule))
 			noErr(m.DeleteBackendService(mctx, be))
 			noErr(m.DeletePortmapNEG(mctx, neg))
-			callErr(m.DeleteFirewall(mctx, fw), errors.New("can't delete firewall policies"))
+			expectGone(m, 4)
+			expectFirewall(m, errors.New("can't delete firewall policies"))
 		},
-		expectedRes:    reconcile.Result{RequeueAfter: requeueDelay},
+		expectedRes:    reconcile.Result{RequeueAfter: defaultRequeueDelay},
 		expectedErrMsg: "can't delete firewall policies",
+	}, {
+		name: "Keeps the finalizer until the resources are gone",
+		setup: func(t *testing.T, mock *mock.MockClient, s *state) {
+			m := mock.EXPECT()
+			expectOwned(m, 4)
+			noErr(m.DeleteServiceAttachment(mctx, svcAtt))
+			noErr(m.DeleteForwardingRule(mctx, fwdRule))
+			noErr(m.DeleteBackendService(mctx, be))
+			noErr(m.DeletePortmapNEG(mctx, neg))
+			expectFirewall(m, nil)
+			expectGone(m, 3)
+			once(m.GetNEG(mctx, neg)).Return(&computepb.NetworkEndpointGroup{Description: managed}, nil)
+		},
+		assert: func(t *testing.T, c client.Client, s *state) {
+			sts := &appsv1.StatefulSet{}
+			require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(s.sts), sts))
+			require.Contains(t, sts.Finalizers, finalizer)
+		},
+		expectedRes: reconcile.Result{RequeueAfter: defaultRequeueDelay},
+	}, {
+		name: "Waits for the resources using a resource to be deleted",
+		setup: func(t *testing.T, mock *mock.MockClient, s *state) {
+			m := mock.EXPECT()
+			expectOwned(m, 3)
+			expectFirewall(m, nil)
+			noErr(m.DeleteServiceAttachment(mctx, svcAtt))
+			noErr(m.DeleteForwardingRule(mctx, fwdRule))
+			expectGone(m, 2)
+			msg := fmt.Sprintf("The resource '%s' is already being used by '%s'", gcp.BackendServiceFQN(s.project, s.region, be), gcp.ForwardingRuleFQN(s.project, s.region, fwdRule))
+			callErr(m.DeleteBackendService(mctx, be), gcp.NewOperationError(http.StatusBadRequest, gcp.ErrorKindResourceInUse, "", msg))
+		},
+		assert: func(t *testing.T, c client.Client, s *state) {
+			sts := &appsv1.StatefulSet{}
+			require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(s.sts), sts))
+			require.Contains(t, sts.Finalizers, finalizer)
+		},
+		expectedRes: reconcile.Result{RequeueAfter: defaultRequeueDelay},
 	}}
 
 	for _, tt := range tests {
@@ -842,6 +1109,154 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestReconcileWithFakeGCP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p := "prefix-"
+	s := initialState()
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	r := New(c, gcpClient)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+
+	// Creates everything.
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	eps, err := gcpClient.ListEndpoints(ctx, negName(p))
+	require.NoError(t, err)
+	require.ElementsMatch(t, s.portMappings(), eps)
+	_, err = gcpClient.GetServiceAttachment(ctx, svcAttName(p))
+	require.NoError(t, err)
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	status := parseStatus(sts)
+	require.Len(t, status.Conditions, 7)
+	require.True(t, meta.IsStatusConditionTrue(status.Conditions, readyCondition))
+
+	// Reconciling again is a no-op.
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	// Detaches the endpoints of removed pods.
+	removed := s.pods.Items[len(s.pods.Items)-1]
+	require.NoError(t, c.Delete(ctx, &removed))
+	s.pods.Items = s.pods.Items[:len(s.pods.Items)-1]
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	eps, err = gcpClient.ListEndpoints(ctx, negName(p))
+	require.NoError(t, err)
+	require.ElementsMatch(t, s.portMappings(), eps)
+
+	// Deletes everything.
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	require.NoError(t, c.Delete(ctx, sts))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	_, err = gcpClient.GetServiceAttachment(ctx, svcAttName(p))
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+	_, err = gcpClient.GetForwardingRule(ctx, fwdRuleName(p))
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+	_, err = gcpClient.GetBackendService(ctx, backendName(p))
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+	_, err = gcpClient.GetNEG(ctx, negName(p))
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+	_, err = gcpClient.GetFirewall(ctx, firewallName(p))
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+	err = c.Get(ctx, req.NamespacedName, sts)
+	require.True(t, apierrors.IsNotFound(err), "expected the STS to be gone once its finalizer was removed")
+}
+
+func TestReconcileGlobalAccess(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	r := New(c, gcpClient)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	rule, err := gcpClient.GetForwardingRule(ctx, fwdRuleName(s.spec.Prefix))
+	require.NoError(t, err)
+	require.False(t, rule.GetAllowGlobalAccess())
+
+	// Enabling it by default updates the existing rule.
+	settings := DefaultSettings()
+	settings.SpecDefaults = settings.SpecDefaults.WithGlobalAccess(true)
+	r.SetSettings(settings)
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	rule, err = gcpClient.GetForwardingRule(ctx, fwdRuleName(s.spec.Prefix))
+	require.NoError(t, err)
+	require.True(t, rule.GetAllowGlobalAccess())
+
+	// The spec overrides the default.
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	s.spec.GlobalAccess = ptr.To(false)
+	specStr, err := json.Marshal(s.spec)
+	require.NoError(t, err)
+	sts.Annotations[annotation] = string(specStr)
+	require.NoError(t, c.Update(ctx, sts))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	rule, err = gcpClient.GetForwardingRule(ctx, fwdRuleName(s.spec.Prefix))
+	require.NoError(t, err)
+	require.False(t, rule.GetAllowGlobalAccess())
+}
+
+func TestDeleteNodePortServiceFailure(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	failDelete := true
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Delete: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.DeleteOption) error {
+				if _, ok := obj.(*corev1.Service); ok && failDelete {
+					return errors.New("can't delete service")
+				}
+				return c.Delete(ctx, obj, opts...)
+			},
+		}).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	r := New(c, gcpClient)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	require.NoError(t, c.Delete(ctx, sts))
+
+	// The finalizer is kept, so that deleting the service is retried.
+	res, err := r.Reconcile(ctx, req)
+	require.EqualError(t, err, "can't delete service")
+	require.Equal(t, reconcile.Result{RequeueAfter: defaultRequeueDelay}, res)
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	require.Contains(t, sts.Finalizers, finalizer)
+
+	failDelete = false
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	err = c.Get(ctx, types.NamespacedName{Namespace: s.sts.Namespace, Name: nodeportName(s.spec.Prefix)}, &corev1.Service{})
+	require.True(t, apierrors.IsNotFound(err))
+	err = c.Get(ctx, req.NamespacedName, sts)
+	require.True(t, apierrors.IsNotFound(err), "expected the STS to be gone once its finalizer was removed")
+}
+
+// managed is the description of the resources the controller created.
+var managed = ptr.To(gcp.ManagedDescription)
+
 func notFound(c *gomock.Call) *gomock.Call { //nolint:unparam // the *gomock.Call isn't used right now, but it should be chainable.
 	return getErr(c, gcp.ErrNotFound)
 }
@@ -862,11 +1277,107 @@ func once(c *gomock.Call) *gomock.Call {
 	return c.Times(1)
 }
 
+// fwdRuleWithIP is the forwarding rule as it's read again after creating it, for the IP GCP
+// assigned it.
+func fwdRuleWithIP() *computepb.ForwardingRule {
+	return &computepb.ForwardingRule{Description: managed, IPAddress: ptr.To("10.0.0.1")}
+}
+
 func firewall(ports []string) *computepb.Firewall {
 	return &computepb.Firewall{
+		Description: managed,
+		Priority:    ptr.To(gcp.DefaultFirewallPriority),
 		Allowed: []*computepb.Allowed{{
 			IPProtocol: stringPtr("tcp"),
 			Ports:      ports,
 		}},
 	}
 }
+
+func TestStatefulSetsOnNode(t *testing.T) {
+	s := initialState()
+	owner := metav1.OwnerReference{APIVersion: "apps/v1", Kind: "StatefulSet", Name: s.sts.Name, Controller: ptr.To(true)}
+	for i := range s.pods.Items {
+		s.pods.Items[i].OwnerReferences = []metav1.OwnerReference{owner}
+		// All the pods are on the first node.
+		s.pods.Items[i].Spec.NodeName = s.nodes.Items[0].Name
+	}
+	orphan := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "orphan"}}
+	orphan.Spec.NodeName = s.nodes.Items[0].Name
+	s.pods.Items = append(s.pods.Items, orphan)
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithIndex(&corev1.Pod{}, podNodeNameField, indexPodNodeName).
+		Build()
+	r := New(c, nil)
+
+	reqs := r.statefulSetsOnNode(context.Background(), &s.nodes.Items[0])
+	require.Equal(t, []reconcile.Request{{NamespacedName: client.ObjectKeyFromObject(s.sts)}}, reqs)
+	require.Empty(t, r.statefulSetsOnNode(context.Background(), &s.nodes.Items[1]))
+}
+
+func TestStatefulSetOfPod(t *testing.T) {
+	s := initialState()
+	pod := s.pods.Items[0]
+	pod.OwnerReferences = []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "StatefulSet", Name: s.sts.Name, Controller: ptr.To(true)}}
+	r := New(nil, nil)
+
+	require.Equal(t, []reconcile.Request{{NamespacedName: client.ObjectKeyFromObject(s.sts)}}, r.statefulSetOfPod(context.Background(), &pod))
+	require.Empty(t, r.statefulSetOfPod(context.Background(), &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "orphan"}}))
+	require.True(t, podDeleted().Delete(event.DeleteEvent{Object: &pod}))
+	require.False(t, podDeleted().Update(event.UpdateEvent{ObjectOld: &pod, ObjectNew: &pod}))
+}
+
+func TestReconcileClass(t *testing.T) {
+	tests := []struct {
+		name       string
+		class      string
+		annotation *string
+		reconciled bool
+	}{{
+		name:       "no class, unannotated STS",
+		reconciled: true,
+	}, {
+		name:       "no class, annotated STS",
+		annotation: ptr.To("other"),
+	}, {
+		name:  "class, unannotated STS",
+		class: "mine",
+	}, {
+		name:       "class, STS of another class",
+		class:      "mine",
+		annotation: ptr.To("other"),
+	}, {
+		name:       "class, STS of the same class",
+		class:      "mine",
+		annotation: ptr.To("mine"),
+		reconciled: true,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := initialState()
+			if tt.annotation != nil {
+				s.sts.Annotations[classAnnotation] = *tt.annotation
+			}
+			c := fake.NewClientBuilder().
+				WithLists(s.nodes, s.pods).
+				WithObjects(s.sts).
+				Build()
+			gcpClient := gcpfake.New(s.project, s.region)
+			r := New(c, gcpClient, WithClass(tt.class))
+			req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+
+			require.Equal(t, tt.reconciled, isAnnotated(tt.class).Generic(event.GenericEvent{Object: s.sts}))
+			_, err := r.Reconcile(ctx, req)
+			require.NoError(t, err)
+			_, err = gcpClient.GetNEG(ctx, negName(s.spec.Prefix))
+			if tt.reconciled {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, gcp.ErrNotFound)
+			}
+		})
+	}
+}
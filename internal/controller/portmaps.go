@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Portmap is the desired and actual state of a StatefulSet the controller manages, and its
+// health, so that dashboards don't have to parse its annotations.
+type Portmap struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// The spec in the StatefulSet's annotation, with the defaults merged in, unless it's invalid.
+	Desired *Spec `json:"desired,omitempty"`
+	// Why the spec is invalid.
+	SpecError string `json:"spec_error,omitempty"`
+	// The spec the resources were last reconciled with.
+	Applied *Spec `json:"applied,omitempty"`
+	// The StatefulSet's status, and its external state if it's enabled, or why it couldn't be
+	// read. See state.go.
+	Status     *Status       `json:"status"`
+	State      *State        `json:"state,omitempty"`
+	StateError string        `json:"state_error,omitempty"`
+	Health     PortmapHealth `json:"health"`
+}
+
+// PortmapHealth summarizes a StatefulSet's status and last reconciles.
+type PortmapHealth struct {
+	// Whether the Ready condition is true, and its reason and message.
+	Ready   bool   `json:"ready"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+	// The last reconcile's result. Only the leader reconciles, so it's only set on the leader.
+	LastReconcile *ReconcileResult `json:"last_reconcile,omitempty"`
+	// Whether it failed to reconcile enough times in a row to be reported as stuck.
+	Stuck bool `json:"stuck"`
+}
+
+// ListPortmaps returns the state of each StatefulSet the reconciler manages.
+func (r *PortmapReconciler) ListPortmaps(ctx context.Context) ([]*Portmap, error) {
+	stss := &appsv1.StatefulSetList{}
+	err := r.List(ctx, stss)
+	if err != nil {
+		return nil, err
+	}
+	results := r.LastResults()
+	portmaps := []*Portmap{}
+	for i := range stss.Items {
+		sts := &stss.Items[i]
+		if _, ok := sts.Annotations[annotation]; !ok || !r.manages(sts) {
+			continue
+		}
+		portmaps = append(portmaps, r.portmap(ctx, sts, results))
+	}
+	return portmaps, nil
+}
+
+// GetPortmap returns the state of the StatefulSet, or a NotFound error if it doesn't exist or
+// the reconciler doesn't manage it.
+func (r *PortmapReconciler) GetPortmap(ctx context.Context, name types.NamespacedName) (*Portmap, error) {
+	sts := &appsv1.StatefulSet{}
+	err := r.Get(ctx, name, sts)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := sts.Annotations[annotation]; !ok || !r.manages(sts) {
+		return nil, apierrors.NewNotFound(appsv1.Resource("statefulsets"), name.String())
+	}
+	return r.portmap(ctx, sts, r.LastResults()), nil
+}
+
+func (r *PortmapReconciler) portmap(ctx context.Context, sts *appsv1.StatefulSet, results map[string]ReconcileResult) *Portmap {
+	name := types.NamespacedName{Namespace: sts.Namespace, Name: sts.Name}
+	settings := r.currentSettings()
+	p := &Portmap{
+		Namespace: sts.Namespace,
+		Name:      sts.Name,
+		Applied:   lastAppliedSpec(sts),
+		Status:    parseStatus(sts),
+	}
+	spec, err := parseSpec(logr.Discard(), sts.Annotations[annotation], settings.SpecDefaults, settings.Policy)
+	if err != nil {
+		p.SpecError = err.Error()
+	} else {
+		p.Desired = spec
+	}
+	p.State, err = r.readState(ctx, sts)
+	if err != nil {
+		p.StateError = err.Error()
+	}
+	if ready := meta.FindStatusCondition(p.Status.Conditions, readyCondition); ready != nil {
+		p.Health.Ready = ready.Status == metav1.ConditionTrue
+		p.Health.Reason, p.Health.Message = ready.Reason, ready.Message
+	}
+	if res, ok := results[name.String()]; ok {
+		p.Health.LastReconcile = &res
+		stuckAfter := settings.StuckAfterFailures
+		p.Health.Stuck = stuckAfter > 0 && res.ConsecutiveFailures >= stuckAfter
+	}
+	return p
+}
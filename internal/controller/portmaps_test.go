@@ -0,0 +1,72 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestPortmaps(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	invalid := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "default",
+		Name:        "invalid",
+		Annotations: map[string]string{annotation: "{"},
+	}}
+	unmanaged := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "unmanaged"}}
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts, invalid, unmanaged).
+		Build()
+	settings := DefaultSettings()
+	settings.DriftCheckInterval = 0
+	r := New(c, gcpfake.New(s.project, s.region), WithSettings(settings))
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	portmaps, err := r.ListPortmaps(ctx)
+	require.NoError(t, err)
+	require.Len(t, portmaps, 2)
+	byName := map[string]*Portmap{}
+	for _, p := range portmaps {
+		byName[p.Name] = p
+	}
+
+	p := byName["sts"]
+	require.NotNil(t, p.Desired)
+	require.Equal(t, "prefix-", p.Desired.Prefix)
+	require.Equal(t, p.Desired, p.Applied)
+	require.NotEmpty(t, p.Status.DesiredStateHash)
+	require.Equal(t, []string{"projects/my-project/regions/us-east1/serviceAttachments/prefix-psc-portmapper-svcatt"}, p.Status.ServiceAttachments)
+	require.True(t, p.Health.Ready)
+	require.Equal(t, reasonReconciled, p.Health.Reason)
+	require.NotNil(t, p.Health.LastReconcile)
+	require.Empty(t, p.Health.LastReconcile.Error)
+	require.False(t, p.Health.Stuck)
+
+	// Invalid specs are listed with why, before they're ever reconciled.
+	p = byName["invalid"]
+	require.Nil(t, p.Desired)
+	require.Contains(t, p.SpecError, "couldn't decode the spec")
+	require.False(t, p.Health.Ready)
+	require.Nil(t, p.Health.LastReconcile)
+
+	got, err := r.GetPortmap(ctx, req.NamespacedName)
+	require.NoError(t, err)
+	require.Equal(t, byName["sts"], got)
+	_, err = r.GetPortmap(ctx, client.ObjectKeyFromObject(unmanaged))
+	require.True(t, apierrors.IsNotFound(err))
+	_, err = r.GetPortmap(ctx, types.NamespacedName{Namespace: "default", Name: "missing"})
+	require.True(t, apierrors.IsNotFound(err))
+}
@@ -0,0 +1,120 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strconv"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func portsConfigMapName(prefix string) string {
+	return nameBase(prefix) + "-ports"
+}
+
+// portsKey is the key of a pod's port in the ports ConfigMap, e.g. my-sts-0.kafka.
+func portsKey(pod, portName string) string {
+	return pod + "." + portName
+}
+
+// portsConfigMapData maps each port of each of the STS' replicas to the port consumers connect
+// to, as per getPortMappings. It only depends on the replicas' ordinals, so that pods can read
+// their ports before they're scheduled. It also has the forwarding rules' IPs in the STS'
+// status, see fwdRuleIPs.
+func portsConfigMapData(spec *Spec, sts *appsv1.StatefulSet, capacity int32) map[string]string {
+	start := ordinalsStart(sts)
+	replicas := min(ptr.Deref(sts.Spec.Replicas, 1), capacity)
+	data := make(map[string]string, int(replicas)*len(spec.NodePorts))
+	for index := range replicas {
+		pod := fmt.Sprintf("%s-%d", sts.Name, start+index)
+		for name, p := range spec.NodePorts {
+			data[portsKey(pod, name)] = strconv.Itoa(int(p.StartingPort + index))
+		}
+	}
+	maps.Copy(data, fwdRuleIPsData(spec, sts))
+	return data
+}
+
+// reconcilePortsConfigMap publishes the STS' ports in a ConfigMap if the spec's ports_config_map
+// is set, and deletes it once it's unset. A ConfigMap with the same name that the controller
+// didn't create isn't modified.
+func (r *PortmapReconciler) reconcilePortsConfigMap(ctx context.Context, log logr.Logger, spec *Spec, sts *appsv1.StatefulSet) error {
+	name := types.NamespacedName{Namespace: sts.Namespace, Name: portsConfigMapName(spec.Prefix)}
+	if !spec.PortsConfigMap {
+		lastApplied := lastAppliedSpec(sts)
+		if lastApplied == nil || !lastApplied.PortsConfigMap {
+			return nil
+		}
+		return r.deletePortsConfigMap(ctx, log, name)
+	}
+	capacity, _ := portCapacity(spec, r.currentSettings().NEGEndpointLimit)
+	data, labels := portsConfigMapData(spec, sts, capacity), nodePortLabels(spec.Labels)
+	// It's read uncached, since only the metadata of ConfigMaps is cached.
+	cm := &corev1.ConfigMap{}
+	err := r.reader.Get(ctx, name, cm)
+	if apierrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: name.Name, Namespace: name.Namespace, Labels: labels},
+			Data:       data,
+		}
+		err = r.Create(ctx, cm)
+		if err != nil {
+			log.Error(err, "Failed to create the ports ConfigMap.", "name", name.Name)
+		}
+		return err
+	}
+	if err != nil {
+		log.Error(err, "Failed to get the ports ConfigMap.", "name", name.Name)
+		return err
+	}
+	if !isManaged(cm) {
+		err := fmt.Errorf("ConfigMap %s %w, as it's missing the %s=%s label", name, errNotOwned, managedByLabel, portmapperApp)
+		log.Error(err, "Not updating the ports ConfigMap.")
+		return err
+	}
+	if maps.Equal(cm.Data, data) && maps.Equal(cm.Labels, labels) {
+		return nil
+	}
+	cm.Data, cm.Labels = data, labels
+	err = r.Update(ctx, cm)
+	if err != nil {
+		log.Error(err, "Failed to update the ports ConfigMap.", "name", name.Name)
+	}
+	return err
+}
+
+// deletePortsConfigMap deletes the ports ConfigMap, if it exists and the controller created it.
+func (r *PortmapReconciler) deletePortsConfigMap(ctx context.Context, log logr.Logger, name types.NamespacedName) error {
+	cm := &corev1.ConfigMap{}
+	err := r.reader.Get(ctx, name, cm)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		log.Error(err, "Failed to get the ports ConfigMap.", "name", name.Name)
+		return err
+	}
+	if !isManaged(cm) {
+		return nil
+	}
+	err = r.Delete(ctx, cm)
+	if client.IgnoreNotFound(err) != nil {
+		log.Error(err, "Failed to delete the ports ConfigMap.", "name", name.Name)
+		return err
+	}
+	log.Info("Deleted the ports ConfigMap.", "name", name.Name)
+	return nil
+}
+
+// isManaged returns true if the object has the label marking it as managed by the controller.
+func isManaged(obj metav1.Object) bool {
+	return obj.GetLabels()[managedByLabel] == portmapperApp
+}
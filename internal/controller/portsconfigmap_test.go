@@ -0,0 +1,134 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/0x5d/psc-portmapper/api"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestPortsConfigMapData(t *testing.T) {
+	spec := &Spec{Spec: api.Spec{NodePorts: map[string]PortConfig{
+		"kafka": {StartingPort: 30000},
+		"admin": {StartingPort: 31000},
+	}}}
+	tests := []struct {
+		name     string
+		ordinals *appsv1.StatefulSetOrdinals
+		capacity int32
+		expected map[string]string
+	}{{
+		name:     "Maps each port of each replica",
+		capacity: 10,
+		expected: map[string]string{
+			"sts-0.kafka": "30000", "sts-0.admin": "31000",
+			"sts-1.kafka": "30001", "sts-1.admin": "31001",
+		},
+	}, {
+		name:     "Names the pods after the ordinals",
+		ordinals: &appsv1.StatefulSetOrdinals{Start: 3},
+		capacity: 10,
+		expected: map[string]string{
+			"sts-3.kafka": "30000", "sts-3.admin": "31000",
+			"sts-4.kafka": "30001", "sts-4.admin": "31001",
+		},
+	}, {
+		name:     "Skips the replicas beyond the capacity",
+		capacity: 1,
+		expected: map[string]string{"sts-0.kafka": "30000", "sts-0.admin": "31000"},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sts := &appsv1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{Name: "sts"},
+				Spec:       appsv1.StatefulSetSpec{Replicas: ptr.To(int32(2)), Ordinals: tt.ordinals},
+			}
+			require.Equal(t, tt.expected, portsConfigMapData(spec, sts, tt.capacity))
+		})
+	}
+}
+
+func TestPortsConfigMap(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	r := New(c, gcpClient)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	name := types.NamespacedName{Namespace: s.sts.Namespace, Name: portsConfigMapName(s.spec.Prefix)}
+
+	// update sets the spec and replicas, and reconciles.
+	update := func(replicas int32) error {
+		t.Helper()
+		sts := &appsv1.StatefulSet{}
+		require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+		specStr, err := json.Marshal(s.spec)
+		require.NoError(t, err)
+		sts.Annotations[annotation] = string(specStr)
+		sts.Spec.Replicas = ptr.To(replicas)
+		require.NoError(t, c.Update(ctx, sts))
+		_, err = r.Reconcile(ctx, req)
+		return err
+	}
+
+	// It isn't published by default.
+	require.NoError(t, update(3))
+	cm := &corev1.ConfigMap{}
+	require.True(t, apierrors.IsNotFound(c.Get(ctx, name, cm)))
+
+	s.spec.PortsConfigMap = true
+	require.NoError(t, update(3))
+	require.NoError(t, c.Get(ctx, name, cm))
+	rule, err := gcpClient.GetForwardingRule(ctx, fwdRuleName(s.spec.Prefix))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"sts-0.app": "30000", "sts-1.app": "30001", "sts-2.app": "30002", ipKey: rule.GetIPAddress()}, cm.Data)
+	require.Equal(t, portmapperApp, cm.Labels[managedByLabel])
+
+	// It's updated before the new pods exist.
+	require.NoError(t, update(4))
+	require.NoError(t, c.Get(ctx, name, cm))
+	require.Equal(t, "30003", cm.Data["sts-3.app"])
+
+	// It's deleted once the spec doesn't set it anymore.
+	s.spec.PortsConfigMap = false
+	require.NoError(t, update(4))
+	require.True(t, apierrors.IsNotFound(c.Get(ctx, name, cm)))
+
+	// A ConfigMap the controller didn't create isn't modified.
+	user := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: name.Namespace, Name: name.Name},
+		Data:       map[string]string{"key": "value"},
+	}
+	require.NoError(t, c.Create(ctx, user))
+	s.spec.PortsConfigMap = true
+	require.ErrorIs(t, update(4), errNotOwned)
+	require.NoError(t, c.Get(ctx, name, cm))
+	require.Equal(t, user.Data, cm.Data)
+
+	// It's deleted along with the STS.
+	require.NoError(t, c.Delete(ctx, user))
+	require.NoError(t, update(4))
+	require.NoError(t, c.Get(ctx, name, cm))
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	require.NoError(t, c.Delete(ctx, sts))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.True(t, apierrors.IsNotFound(c.Get(ctx, name, cm)))
+}
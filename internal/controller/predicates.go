@@ -2,11 +2,23 @@ package controller
 
 import (
 	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 )
 
-func isAnnotated() predicate.Funcs {
+const podNodeNameField = "spec.nodeName"
+
+func indexPodNodeName(obj client.Object) []string {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok || pod.Spec.NodeName == "" {
+		return nil
+	}
+	return []string{pod.Spec.NodeName}
+}
+
+func isAnnotated(class string) predicate.Funcs {
 	return predicate.NewPredicateFuncs(func(obj client.Object) bool {
 		sts, ok := obj.(*appsv1.StatefulSet)
 		if !ok {
@@ -14,6 +26,52 @@ func isAnnotated() predicate.Funcs {
 		}
 		// Check if the annotation exists
 		_, exists := sts.Annotations[annotation]
-		return exists
+		return exists && hasClass(sts, class)
 	})
 }
+
+// hasClass returns true if the STS' class annotation matches class. StatefulSets without the
+// annotation belong to the controller without a class.
+func hasClass(sts *appsv1.StatefulSet, class string) bool {
+	return sts.Annotations[classAnnotation] == class
+}
+
+// instanceChanged only lets node updates through if the instance backing the node changed, as
+// per the instance sources, e.g. because its provider ID was set after it registered, or if its
+// instance was recreated, see instanceIDAnnotation.
+func (r *PortmapReconciler) instanceChanged() predicate.Funcs {
+	return predicate.Funcs{
+		CreateFunc:  func(event.CreateEvent) bool { return false },
+		DeleteFunc:  func(event.DeleteEvent) bool { return false },
+		GenericFunc: func(event.GenericEvent) bool { return false },
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldNode, ok := e.ObjectOld.(*corev1.Node)
+			if !ok {
+				return false
+			}
+			newNode, ok := e.ObjectNew.(*corev1.Node)
+			if !ok {
+				return false
+			}
+			if oldNode.Annotations[instanceIDAnnotation] != newNode.Annotations[instanceIDAnnotation] {
+				return true
+			}
+			// The project doesn't matter, since it's the same for both.
+			sources := r.currentSettings().InstanceSources
+			oldInstance, oldErr := nodeInstance(oldNode, sources, "")
+			newInstance, newErr := nodeInstance(newNode, sources, "")
+			return oldInstance != newInstance || (oldErr == nil) != (newErr == nil)
+		},
+	}
+}
+
+// podDeleted only lets pod deletions through, so that their StatefulSets detach their
+// endpoints without waiting for another event.
+func podDeleted() predicate.Funcs {
+	return predicate.Funcs{
+		CreateFunc:  func(event.CreateEvent) bool { return false },
+		UpdateFunc:  func(event.UpdateEvent) bool { return false },
+		GenericFunc: func(event.GenericEvent) bool { return false },
+		DeleteFunc:  func(event.DeleteEvent) bool { return true },
+	}
+}
@@ -0,0 +1,119 @@
+package controller
+
+import (
+	"cmp"
+	"context"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const reasonProbeFailed = "ProbeFailed"
+
+// maxConcurrentProbes caps the connections a probe opens at once, so that StatefulSets with
+// many ports don't exhaust the controller's file descriptors.
+const maxConcurrentProbes = 16
+
+// ProbeStatus is the result of the last connectivity probe of the mapped ports.
+type ProbeStatus struct {
+	Time metav1.Time `json:"time"`
+	// The IP of the forwarding rule the ports were probed through.
+	IP string `json:"ip"`
+	// Omitted from the status if the StatefulSet's state is written to the state store.
+	Results []ProbeResult `json:"results,omitempty"`
+}
+
+// ProbeResult is whether a TCP connection to a mapped port could be opened.
+type ProbeResult struct {
+	Port      int32  `json:"port"`
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+// probe opens a TCP connection to each of the mapped ports through the forwarding rule serving
+// the consumers, from inside the VPC, to catch firewall or NEG misconfigurations before the
+// consumers do. The results are exported by the psc_portmapper_probe_reachable metric, and
+// unreachable ports are reported with a Warning event. It returns nil if probing is disabled,
+// or if there's nothing to probe.
+func (r *PortmapReconciler) probe(ctx context.Context, log logr.Logger, gc gcp.ForwardingRules, sts *appsv1.StatefulSet, spec *Spec, mappings []*gcp.PortMapping) *ProbeStatus {
+	timeout := r.currentSettings().ProbeTimeout
+	if timeout <= 0 || spec.tornDown || len(mappings) == 0 {
+		return nil
+	}
+	name := fwdRuleName(spec.Prefix)
+	if spec.Migration != nil && spec.migrationAcknowledged {
+		name = migrationFwdRuleName(spec.Prefix)
+	}
+	rule, err := gc.GetForwardingRule(ctx, name)
+	if err != nil {
+		// Probes are best effort, so they don't fail the reconcile.
+		log.Error(err, "Failed to get the forwarding rule to probe.", "name", name)
+		return nil
+	}
+	status := &ProbeStatus{
+		Time:    metav1.Now(),
+		IP:      rule.GetIPAddress(),
+		Results: make([]ProbeResult, len(mappings)),
+	}
+	sem := make(chan struct{}, maxConcurrentProbes)
+	var wg sync.WaitGroup
+	for i, m := range mappings {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			status.Results[i] = r.probePort(ctx, status.IP, m.Port, timeout)
+		}()
+	}
+	wg.Wait()
+	slices.SortFunc(status.Results, func(a, b ProbeResult) int { return cmp.Compare(a.Port, b.Port) })
+
+	sName := types.NamespacedName{Namespace: sts.Namespace, Name: sts.Name}.String()
+	deleteProbeMetrics(sName)
+	var unreachable []string
+	for _, res := range status.Results {
+		port := strconv.Itoa(int(res.Port))
+		if !res.Reachable {
+			unreachable = append(unreachable, port)
+			probeReachable.WithLabelValues(sName, port).Set(0)
+			continue
+		}
+		probeReachable.WithLabelValues(sName, port).Set(1)
+	}
+	if len(unreachable) > 0 {
+		log.Info("Some of the mapped ports are unreachable.", "ip", status.IP, "ports", unreachable)
+		r.event(sts, corev1.EventTypeWarning, reasonProbeFailed, "%d of the %d mapped ports are unreachable through %s: %v", len(unreachable), len(status.Results), status.IP, unreachable)
+	}
+	return status
+}
+
+func (r *PortmapReconciler) probePort(ctx context.Context, ip string, port int32, timeout time.Duration) ProbeResult {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	res := ProbeResult{Port: port}
+	conn, err := r.dial(ctx, "tcp", net.JoinHostPort(ip, strconv.Itoa(int(port))))
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	_ = conn.Close()
+	res.Reachable = true
+	return res
+}
+
+func deleteProbeMetrics(sts string) {
+	probeReachable.DeletePartialMatch(prometheus.Labels{"sts": sts})
+}
@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestProbe(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	rec := record.NewFakeRecorder(10)
+	r := New(c, gcpClient, WithEventRecorder(rec))
+	var mu sync.Mutex
+	var dialed []string
+	r.dial = func(_ context.Context, network, address string) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		dialed = append(dialed, network+"://"+address)
+		if address == "10.0.0.2:30001" {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		_ = server.Close()
+		return client, nil
+	}
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+
+	// Probing is disabled by default.
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Empty(t, dialed)
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	require.Nil(t, parseStatus(sts).Probe)
+
+	settings := DefaultSettings()
+	settings.DriftCheckInterval = 0
+	settings.ProbeTimeout = time.Second
+	r.SetSettings(settings)
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"tcp://10.0.0.2:30000", "tcp://10.0.0.2:30001", "tcp://10.0.0.2:30002"}, dialed)
+
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	probe := parseStatus(sts).Probe
+	require.NotNil(t, probe)
+	require.Equal(t, "10.0.0.2", probe.IP)
+	require.Equal(t, []ProbeResult{
+		{Port: 30000, Reachable: true},
+		{Port: 30001, Error: "connection refused"},
+		{Port: 30002, Reachable: true},
+	}, probe.Results)
+	require.Equal(t, "Warning ProbeFailed 1 of the 3 mapped ports are unreachable through 10.0.0.2: [30001]", <-rec.Events)
+	require.Equal(t, 1.0, testutil.ToFloat64(probeReachable.WithLabelValues("default/sts", "30000")))
+	require.Equal(t, 0.0, testutil.ToFloat64(probeReachable.WithLabelValues("default/sts", "30001")))
+
+	// The metrics are removed along with the STS.
+	require.NoError(t, c.Delete(ctx, sts))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, 0, testutil.CollectAndCount(probeReachable))
+}
@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Progress records the sub-reconcilers that succeeded while reconciling a desired state that
+// failed overall, so that retries skip straight to the ones that failed or didn't run.
+type Progress struct {
+	// The hash of the desired state the resources were being reconciled with.
+	DesiredStateHash string `json:"desired_state_hash"`
+	// The names of the sub-reconcilers that succeeded.
+	Done []string `json:"done,omitempty"`
+	// When the first attempt to reconcile the desired state failed. Progress older than the
+	// drift check interval is ignored, so that resources aren't assumed to be up to date for
+	// longer than they would be after a successful reconcile.
+	Since metav1.Time `json:"since"`
+}
+
+// nextProgress returns the progress to record after failing to reconcile the desired state
+// hashed to hash, given the progress recorded by the previous attempt.
+func nextProgress(prev *Progress, hash string, done []string) *Progress {
+	since := metav1.Now()
+	if prev != nil && prev.DesiredStateHash == hash {
+		since = prev.Since
+	}
+	done = slices.Clone(done)
+	slices.Sort(done)
+	return &Progress{DesiredStateHash: hash, Done: done, Since: since}
+}
+
+// resumableProgress returns the names of the sub-reconcilers the previous attempt to reconcile
+// the desired state hashed to hash completed, as per its progress, if they can be skipped.
+// Progress made before the controller started isn't, since the resources could have drifted
+// while it was down.
+func (r *PortmapReconciler) resumableProgress(progress *Progress, hash string) map[string]bool {
+	interval := r.currentSettings().DriftCheckInterval
+	if interval <= 0 || progress == nil || progress.DesiredStateHash != hash || time.Since(progress.Since.Time) >= interval ||
+		progress.Since.Time.Before(r.startedAt) {
+		return nil
+	}
+	skip := make(map[string]bool, len(progress.Done))
+	for _, name := range progress.Done {
+		skip[name] = true
+	}
+	return skip
+}
+
+// doneSubReconciler wraps a sub-reconciler whose resource was ensured by a previous attempt,
+// so that it isn't ensured again.
+type doneSubReconciler struct {
+	subReconciler
+}
+
+func (d doneSubReconciler) Ensure(_ context.Context, log logr.Logger) error {
+	log.V(1).Info("Skipping a resource reconciled by a previous attempt.", "type", d.Name())
+	return nil
+}
+
+func (d doneSubReconciler) Status() metav1.Condition {
+	c := d.subReconciler.Status()
+	c.Status = metav1.ConditionTrue
+	c.Reason = reasonReconciled
+	c.Message = "Reconciled by a previous attempt."
+	return c
+}
@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// flakyFwdRule fails to create the forwarding rule until told otherwise, and counts the NEG
+// lookups.
+type flakyFwdRule struct {
+	gcp.Client
+	fail    bool
+	negGets int
+}
+
+func (c *flakyFwdRule) GetNEG(ctx context.Context, name string) (*computepb.NetworkEndpointGroup, error) {
+	c.negGets++
+	return c.Client.GetNEG(ctx, name)
+}
+
+func (c *flakyFwdRule) CreateForwardingRule(ctx context.Context, name, backendSvc, subnetFQN string, ip *string, globalAccess *bool) error {
+	if c.fail {
+		return errors.New("quota exceeded")
+	}
+	return c.Client.CreateForwardingRule(ctx, name, backendSvc, subnetFQN, ip, globalAccess)
+}
+
+func TestPartialProgress(t *testing.T) {
+	for _, externalState := range []bool{false, true} {
+		t.Run(fmt.Sprintf("externalState=%t", externalState), func(t *testing.T) {
+			ctx := context.Background()
+			s := initialState()
+			c := fake.NewClientBuilder().
+				WithLists(s.nodes, s.pods).
+				WithObjects(s.sts).
+				Build()
+			gcpClient := &flakyFwdRule{Client: gcpfake.New(s.project, s.region), fail: true}
+			settings := DefaultSettings()
+			settings.ExternalState = externalState
+			r := New(c, gcpClient, WithSettings(settings))
+			req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+			sts := &appsv1.StatefulSet{}
+			// The progress is in the state instead of the status if it's external.
+			progress := func() *Progress {
+				t.Helper()
+				require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+				status := parseStatus(sts)
+				if !externalState {
+					require.Nil(t, status.State)
+					return status.Progress
+				}
+				require.Nil(t, status.Progress)
+				state, err := r.readState(ctx, sts)
+				require.NoError(t, err)
+				require.NotNil(t, state)
+				return state.Progress
+			}
+
+			_, err := r.Reconcile(ctx, req)
+			require.Error(t, err)
+			require.Equal(t, 1, gcpClient.negGets)
+			p := progress()
+			require.NotNil(t, p)
+			require.Equal(t, []string{"NEG", "backend", "endpoints", "firewall"}, p.Done)
+			since := p.Since
+
+			// The retry skips the resources that were done, and keeps when the first attempt failed.
+			_, err = r.Reconcile(ctx, req)
+			require.Error(t, err)
+			require.Equal(t, 1, gcpClient.negGets)
+			require.Equal(t, since, progress().Since)
+			cond := meta.FindStatusCondition(parseStatus(sts).Conditions, "NEGReady")
+			require.NotNil(t, cond)
+			require.Equal(t, metav1.ConditionTrue, cond.Status)
+
+			// Once it succeeds, the progress is cleared.
+			gcpClient.fail = false
+			_, err = r.Reconcile(ctx, req)
+			require.NoError(t, err)
+			require.Nil(t, progress())
+			require.True(t, meta.IsStatusConditionTrue(parseStatus(sts).Conditions, readyCondition))
+			_, err = gcpClient.GetServiceAttachment(ctx, svcAttName("prefix-"))
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestResumableProgress(t *testing.T) {
+	progress := func(hash string, ago time.Duration) *Progress {
+		return &Progress{
+			DesiredStateHash: hash,
+			Done:             []string{"NEG", "firewall"},
+			Since:            metav1.NewTime(time.Now().Add(-ago)),
+		}
+	}
+
+	tests := []struct {
+		name     string
+		progress *Progress
+		interval time.Duration
+		started  time.Time
+		expected map[string]bool
+	}{{
+		name:     "Resumes recent progress on the same desired state",
+		progress: progress("hash", time.Minute),
+		interval: 10 * time.Minute,
+		expected: map[string]bool{"NEG": true, "firewall": true},
+	}, {
+		name:     "Ignores progress on another desired state",
+		progress: progress("other", time.Minute),
+		interval: 10 * time.Minute,
+	}, {
+		name:     "Ignores progress older than the drift check interval",
+		progress: progress("hash", time.Hour),
+		interval: 10 * time.Minute,
+	}, {
+		name:     "Ignores progress if drift checks are disabled",
+		progress: progress("hash", time.Minute),
+		interval: 0,
+	}, {
+		name:     "Ignores progress made before the controller started",
+		progress: progress("hash", time.Minute),
+		interval: 10 * time.Minute,
+		started:  time.Now(),
+	}, {
+		name:     "Ignores missing progress",
+		interval: 10 * time.Minute,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := New(nil, nil, WithDriftCheckInterval(tt.interval))
+			r.startedAt = tt.started
+			require.Equal(t, tt.expected, r.resumableProgress(tt.progress, "hash"))
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"go.uber.org/multierr"
+)
+
+// The reasons of failed conditions, by cause, so that alerts can be routed on them rather than
+// on their messages. Failures of any other cause are reasonReconcileFailed. They're part of
+// the status' API, so they mustn't change. See also reasonQuotaExceeded and reasonInvalidSpec.
+const (
+	// reasonPermissionDenied is the reason of the conditions of resources the controller's
+	// credentials aren't allowed to manage.
+	reasonPermissionDenied = "PermissionDenied"
+	// reasonGCPUnavailable is the reason of the conditions of resources that couldn't be
+	// reconciled because the GCP API failed, timed out or throttled the controller.
+	reasonGCPUnavailable = "GCPUnavailable"
+	// reasonDrift is the reason of the conditions of resources that were modified out of band,
+	// and of the Ready condition, when they're reverted. If reverting them fails for one of the
+	// causes above, that's reported instead.
+	reasonDrift = "Drift"
+)
+
+// failureReasons are the reasons of failed conditions, from the most actionable to the least,
+// which decides the reason of a condition that failed for several causes.
+var failureReasons = []string{
+	reasonQuotaExceeded,
+	reasonPermissionDenied,
+	reasonInvalidSpec,
+	reasonGCPUnavailable,
+	reasonReconcileFailed,
+}
+
+// failureReason returns the reason of a condition that failed with err. GCP errors are
+// classified by their error code or HTTP status: a spec GCP rejects as a bad request is
+// reported as reasonInvalidSpec.
+func failureReason(err error) string {
+	reason := reasonReconcileFailed
+	for _, e := range multierr.Errors(err) {
+		r := errorReason(e)
+		if slices.Index(failureReasons, r) < slices.Index(failureReasons, reason) {
+			reason = r
+		}
+	}
+	return reason
+}
+
+func errorReason(err error) string {
+	if gcp.ErrorKindOf(err) == gcp.ErrorKindQuotaExceeded {
+		return reasonQuotaExceeded
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return reasonGCPUnavailable
+	}
+	var ce *gcp.ClientError
+	if !errors.As(err, &ce) {
+		return reasonReconcileFailed
+	}
+	switch status := ce.StatusCode(); {
+	case status == http.StatusForbidden && strings.Contains(strings.ToLower(ce.Error()), "quota"):
+		return reasonQuotaExceeded
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return reasonPermissionDenied
+	case status == http.StatusBadRequest:
+		return reasonInvalidSpec
+	case status == -1 || status == http.StatusTooManyRequests || status >= http.StatusInternalServerError:
+		return reasonGCPUnavailable
+	}
+	return reasonReconcileFailed
+}
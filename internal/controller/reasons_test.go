@@ -0,0 +1,70 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/multierr"
+)
+
+func TestFailureReason(t *testing.T) {
+	quota := gcp.NewOperationError(http.StatusForbidden, gcp.ErrorKindQuotaExceeded, "projects/p/regions/r/forwardingRules/f", "Quota 'FORWARDING_RULES' exceeded.")
+	denied := gcp.NewClientError(http.StatusForbidden, "Required 'compute.firewalls.create' permission")
+
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{{
+		name:     "Unknown errors",
+		err:      errors.New("boom"),
+		expected: reasonReconcileFailed,
+	}, {
+		name:     "Quota exceeded by an operation",
+		err:      fmt.Errorf("failed to create the forwarding rule: %w", quota),
+		expected: reasonQuotaExceeded,
+	}, {
+		name:     "Quota exceeded by a call",
+		err:      gcp.NewClientError(http.StatusForbidden, "Quota exceeded for quota metric 'Read requests'"),
+		expected: reasonQuotaExceeded,
+	}, {
+		name:     "Permission denied",
+		err:      denied,
+		expected: reasonPermissionDenied,
+	}, {
+		name:     "Bad requests",
+		err:      gcp.NewClientError(http.StatusBadRequest, "Invalid value for field 'resource.natSubnets'"),
+		expected: reasonInvalidSpec,
+	}, {
+		name:     "GCP errors",
+		err:      gcp.NewClientError(http.StatusServiceUnavailable, "unavailable"),
+		expected: reasonGCPUnavailable,
+	}, {
+		name:     "Throttling",
+		err:      gcp.NewClientError(http.StatusTooManyRequests, "rate limit exceeded"),
+		expected: reasonGCPUnavailable,
+	}, {
+		name:     "Timeouts",
+		err:      fmt.Errorf("failed to get the NEG: %w", context.DeadlineExceeded),
+		expected: reasonGCPUnavailable,
+	}, {
+		name:     "Other client errors",
+		err:      gcp.NewClientError(http.StatusConflict, "already exists"),
+		expected: reasonReconcileFailed,
+	}, {
+		name:     "The most actionable cause of several",
+		err:      multierr.Combine(gcp.NewClientError(http.StatusBadGateway, "bad gateway"), denied, errors.New("boom")),
+		expected: reasonPermissionDenied,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, failureReason(tt.err))
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// recreateAnnotation requests recreating some of the STS' GCP resources, e.g. because one
+	// is corrupted. Its value is "all" or a comma-separated list of recreateTargets' keys.
+	recreateAnnotation = "psc-portmapper.0x5d.org/recreate"
+
+	// reasonRecreating is the reason of the event emitted when resources are recreated.
+	reasonRecreating = "Recreating"
+)
+
+// recreateTargets maps the recreate annotation's values to the sub-reconcilers' names.
+var recreateTargets = map[string]string{
+	"firewall":           "firewall",
+	"neg":                "NEG",
+	"backend":            "backend",
+	"forwarding-rule":    "forwarding rule",
+	"service-attachment": "service attachment",
+}
+
+// parseRecreate returns the names of the sub-reconcilers whose resources must be recreated for
+// the recreate annotation's value. It includes the ones depending on the selected resources,
+// because a resource can't be deleted while others reference it.
+func parseRecreate(value string) (map[string]bool, error) {
+	names := map[string]bool{}
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v == "all" {
+			for _, n := range recreateTargets {
+				names[n] = true
+			}
+			continue
+		}
+		n, ok := recreateTargets[v]
+		if !ok {
+			targets := slices.Sorted(maps.Keys(recreateTargets))
+			return nil, fmt.Errorf("invalid %s annotation %q, it must be all or a comma-separated list of %s", recreateAnnotation, value, strings.Join(targets, ", "))
+		}
+		names[n] = true
+	}
+	for added := true; added; {
+		added = false
+		for sub, deps := range subReconcilerDeps {
+			if names[sub] {
+				continue
+			}
+			for _, dep := range deps {
+				if names[dep] {
+					names[sub] = true
+					added = true
+				}
+			}
+		}
+	}
+	return names, nil
+}
+
+// recreate deletes the resources selected by the STS' recreate annotation, dependents first,
+// so that the reconcile that follows recreates them, and then removes the annotation. It
+// returns false if there was nothing to recreate.
+//
+// The resources keep their names, so the service attachment's URI doesn't change. Unless the
+// spec sets an IP, the forwarding rule is recreated with its previous one, so that it doesn't
+// change either if it's still free.
+func (r *PortmapReconciler) recreate(ctx context.Context, log logr.Logger, gc gcp.Client, spec *Spec, sts *appsv1.StatefulSet) (bool, error) {
+	value, ok := sts.Annotations[recreateAnnotation]
+	if !ok {
+		return false, nil
+	}
+	names, err := parseRecreate(value)
+	if err != nil {
+		log.Error(err, "Invalid recreate annotation.")
+		return false, err
+	}
+	if names["forwarding rule"] && spec.IP == nil {
+		rule, err := gc.GetForwardingRule(ctx, fwdRuleName(spec.Prefix))
+		if err != nil && !errors.Is(err, gcp.ErrNotFound) {
+			log.Error(err, "Failed to get the forwarding rule's IP before recreating it.")
+			return false, err
+		}
+		if ip := rule.GetIPAddress(); ip != "" {
+			spec.IP = &ip
+		}
+	}
+
+	subs := subReconcilers(gc, spec, nil, ownershipFor(sts), nil, nil, hooks{})
+	var recreated []string
+	for _, s := range subs {
+		if names[s.Name()] {
+			recreated = append(recreated, s.Name())
+		}
+	}
+	log.Info("Recreating resources as requested.", "resources", recreated)
+	r.event(sts, corev1.EventTypeNormal, reasonRecreating, "Recreating the %s as requested by the %s annotation", strings.Join(recreated, ", "), recreateAnnotation)
+	for _, s := range slices.Backward(subs) {
+		if !names[s.Name()] {
+			continue
+		}
+		err = s.Delete(ctx, log)
+		if err != nil && !errors.Is(err, gcp.ErrNotFound) {
+			log.Error(err, "Failed to delete resource to recreate it.", "type", s.Name())
+			r.reportNotOwned(sts, err)
+			return false, err
+		}
+	}
+
+	patch := client.MergeFrom(sts.DeepCopy())
+	delete(sts.Annotations, recreateAnnotation)
+	err = r.Patch(ctx, sts, patch)
+	if err != nil {
+		log.Error(err, "Failed to remove the recreate annotation.")
+		return false, err
+	}
+	return true, nil
+}
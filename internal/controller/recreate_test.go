@@ -0,0 +1,191 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestParseRecreate(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		expected    map[string]bool
+		expectedErr string
+	}{{
+		name:     "Recreates a resource nothing depends on alone",
+		value:    "firewall",
+		expected: map[string]bool{"firewall": true},
+	}, {
+		name:  "Recreates the resources depending on the selected ones",
+		value: "neg",
+		expected: map[string]bool{
+			"NEG":                          true,
+			"backend":                      true,
+			"endpoints":                    true,
+			"forwarding rule":              true,
+			"service attachment":           true,
+			"migration forwarding rule":    true,
+			"migration service attachment": true,
+			"canary":                       true,
+			"migration canary":             true,
+		},
+	}, {
+		name:     "Accepts several resources",
+		value:    "firewall, forwarding-rule",
+		expected: map[string]bool{"firewall": true, "forwarding rule": true, "service attachment": true, "canary": true},
+	}, {
+		name:  "Recreates everything",
+		value: "all",
+		expected: map[string]bool{
+			"firewall":                     true,
+			"NEG":                          true,
+			"backend":                      true,
+			"endpoints":                    true,
+			"forwarding rule":              true,
+			"service attachment":           true,
+			"migration forwarding rule":    true,
+			"migration service attachment": true,
+			"canary":                       true,
+			"migration canary":             true,
+		},
+	}, {
+		name:        "Rejects unknown resources",
+		value:       "firewall,nope",
+		expectedErr: `invalid psc-portmapper.0x5d.org/recreate annotation "firewall,nope", it must be all or a comma-separated list of backend, firewall, forwarding-rule, neg, service-attachment`,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names, err := parseRecreate(tt.value)
+			if tt.expectedErr != "" {
+				require.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, names)
+		})
+	}
+}
+
+// creations counts the NEGs and forwarding rules created.
+type creations struct {
+	gcp.Client
+	negs     int
+	fwdRules int
+}
+
+func (c *creations) CreatePortmapNEG(ctx context.Context, name, subnetFQN string, defaultPort *int32) error {
+	c.negs++
+	return c.Client.CreatePortmapNEG(ctx, name, subnetFQN, defaultPort)
+}
+
+func (c *creations) CreateForwardingRule(ctx context.Context, name, backendSvc, subnetFQN string, ip *string, globalAccess *bool) error {
+	c.fwdRules++
+	return c.Client.CreateForwardingRule(ctx, name, backendSvc, subnetFQN, ip, globalAccess)
+}
+
+func TestRecreate(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := &creations{Client: gcpfake.New(s.project, s.region)}
+	rec := record.NewFakeRecorder(10)
+	r := New(c, gcpClient, WithEventRecorder(rec))
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	rule, err := gcpClient.GetForwardingRule(ctx, fwdRuleName("prefix-"))
+	require.NoError(t, err)
+	ip := rule.GetIPAddress()
+
+	// The resources are recreated even though the desired state didn't change.
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	sts.Annotations[recreateAnnotation] = "neg"
+	require.NoError(t, c.Update(ctx, sts))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, 2, gcpClient.negs)
+	require.Equal(t, 2, gcpClient.fwdRules)
+	require.Equal(t, "Normal Recreating Recreating the NEG, backend, endpoints, forwarding rule, service attachment as requested by the psc-portmapper.0x5d.org/recreate annotation", <-rec.Events)
+
+	// The forwarding rule kept its IP, and the annotation was removed.
+	rule, err = gcpClient.GetForwardingRule(ctx, fwdRuleName("prefix-"))
+	require.NoError(t, err)
+	require.Equal(t, ip, rule.GetIPAddress())
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	require.NotContains(t, sts.Annotations, recreateAnnotation)
+	eps, err := gcpClient.ListEndpoints(ctx, negName("prefix-"))
+	require.NoError(t, err)
+	require.ElementsMatch(t, s.portMappings(), eps)
+
+	// It's only done once.
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, 2, gcpClient.negs)
+}
+
+func TestRecreateNEGInAnotherSubnet(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	r := New(c, gcpClient)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	neg, err := gcpClient.GetNEG(ctx, negName(s.spec.Prefix))
+	require.NoError(t, err)
+	require.Equal(t, gcp.SubnetFQN(s.project, s.region, "default"), neg.GetSubnetwork())
+	require.Nil(t, neg.DefaultPort)
+
+	// The existing NEG can't be updated.
+	subnet := gcp.SubnetFQN(s.project, s.region, "nodes")
+	gcpClient.AddPrivateSubnetwork(gcpClient.Network(), subnet, "10.1.0.0/24")
+	s.spec.NEGSubnetFQN = subnet
+	s.spec.NEGDefaultPort = ptr.To(int32(8080))
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	specStr, err := json.Marshal(s.spec)
+	require.NoError(t, err)
+	sts.Annotations[annotation] = string(specStr)
+	require.NoError(t, c.Update(ctx, sts))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	neg, err = gcpClient.GetNEG(ctx, negName(s.spec.Prefix))
+	require.NoError(t, err)
+	require.Equal(t, gcp.SubnetFQN(s.project, s.region, "default"), neg.GetSubnetwork())
+
+	// Recreating it applies the spec.
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	sts.Annotations[recreateAnnotation] = "neg"
+	require.NoError(t, c.Update(ctx, sts))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	neg, err = gcpClient.GetNEG(ctx, negName(s.spec.Prefix))
+	require.NoError(t, err)
+	require.Equal(t, subnet, neg.GetSubnetwork())
+	require.Equal(t, int32(8080), neg.GetDefaultPort())
+	eps, err := gcpClient.ListEndpoints(ctx, negName(s.spec.Prefix))
+	require.NoError(t, err)
+	require.ElementsMatch(t, s.portMappings(), eps)
+}
@@ -0,0 +1,183 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// ReadSnapshot returns the last snapshot exported for the StatefulSet, from the store, or from
+// its snapshot ConfigMap if the store is nil.
+func (r *PortmapReconciler) ReadSnapshot(ctx context.Context, name types.NamespacedName, store gcp.ObjectStore) (*Snapshot, error) {
+	var data []byte
+	if store != nil {
+		var err error
+		data, err = store.ReadObject(ctx, name.String())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the snapshot of %s: %w", name, err)
+		}
+	} else {
+		// The ConfigMap is named after the spec's prefix.
+		sts := &appsv1.StatefulSet{}
+		err := r.Get(ctx, name, sts)
+		if err != nil {
+			return nil, err
+		}
+		spec := lastAppliedSpec(sts)
+		if spec == nil {
+			return nil, fmt.Errorf("StatefulSet %s was never reconciled, so it has no snapshot", name)
+		}
+		cm := &corev1.ConfigMap{}
+		err = r.reader.Get(ctx, types.NamespacedName{Namespace: name.Namespace, Name: snapshotConfigMapName(spec.Prefix)}, cm)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the snapshot of %s: %w", name, err)
+		}
+		data = []byte(cm.Data[snapshotKey])
+	}
+	s := &Snapshot{}
+	err := json.Unmarshal(data, s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot of %s: %w", name, err)
+	}
+	if s.StatefulSet != name.String() || s.Spec == nil {
+		return nil, fmt.Errorf("the snapshot read for %s is of %q", name, s.StatefulSet)
+	}
+	return s, nil
+}
+
+// RestoreSnapshot recreates the snapshot's resources that don't exist anymore, e.g. after they
+// were deleted out of band, and attaches the NEG's missing endpoints. Resources that exist are
+// left as they are, even if they differ from the snapshot, since the StatefulSet's next
+// reconcile updates them. The resources are restored in the order they reference each other,
+// stopping at the first failure, and the names of the ones restored are returned.
+func (r *PortmapReconciler) RestoreSnapshot(ctx context.Context, log logr.Logger, s *Snapshot) ([]string, error) {
+	namespace, _, err := parseNamespacedName(s.StatefulSet)
+	if err != nil {
+		return nil, err
+	}
+	gc, release, err := r.gcpClientFor(ctx, log, namespace, s.Spec)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	gc, err = gcpClientInNetwork(gc, s.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	var restored []string
+	restore := func(kind, name string, get func() error, create func() error) error {
+		err := get()
+		if !errors.Is(err, gcp.ErrNotFound) {
+			return err
+		}
+		log.Info("Restoring.", "kind", kind, "name", name)
+		err = create()
+		if err != nil {
+			return fmt.Errorf("failed to restore %s %s: %w", kind, name, err)
+		}
+		restored = append(restored, name)
+		return nil
+	}
+
+	for _, fw := range s.Firewalls {
+		rule, err := gcp.FirewallRuleOf(fw)
+		if err != nil {
+			return restored, err
+		}
+		err = restore("firewall", fw.GetName(),
+			func() error { _, err := gc.GetFirewall(ctx, fw.GetName()); return err },
+			func() error { return gc.CreateFirewall(ctx, fw.GetName(), rule) })
+		if err != nil {
+			return restored, err
+		}
+	}
+	if neg := s.NEG; neg != nil {
+		err := restore("NEG", neg.GetName(),
+			func() error { _, err := gc.GetNEG(ctx, neg.GetName()); return err },
+			func() error {
+				return gc.CreatePortmapNEG(ctx, neg.GetName(), gcp.RelativeName(neg.GetSubnetwork()), neg.DefaultPort)
+			})
+		if err != nil {
+			return restored, err
+		}
+		err = restoreEndpoints(ctx, gc, neg.GetName(), s.Endpoints)
+		if err != nil {
+			return restored, err
+		}
+	}
+	if backend := s.BackendService; backend != nil {
+		if len(backend.GetBackends()) != 1 {
+			return restored, fmt.Errorf("backend service %s has %d backends, expected 1", backend.GetName(), len(backend.GetBackends()))
+		}
+		neg := path.Base(backend.GetBackends()[0].GetGroup())
+		err := restore("backend service", backend.GetName(),
+			func() error { _, err := gc.GetBackendService(ctx, backend.GetName()); return err },
+			func() error { return gc.CreateBackendService(ctx, backend.GetName(), neg) })
+		if err != nil {
+			return restored, err
+		}
+	}
+	for _, rule := range s.ForwardingRules {
+		err := restore("forwarding rule", rule.GetName(),
+			func() error { _, err := gc.GetForwardingRule(ctx, rule.GetName()); return err },
+			func() error {
+				// The rule keeps its IP, as long as it's still free.
+				return gc.CreateForwardingRule(ctx, rule.GetName(), path.Base(rule.GetBackendService()),
+					gcp.RelativeName(rule.GetSubnetwork()), rule.IPAddress, rule.AllowGlobalAccess)
+			})
+		if err != nil {
+			return restored, err
+		}
+	}
+	for _, att := range s.ServiceAttachments {
+		natSubnets := make([]string, 0, len(att.GetNatSubnets()))
+		for _, subnet := range att.GetNatSubnets() {
+			natSubnets = append(natSubnets, gcp.RelativeName(subnet))
+		}
+		err := restore("service attachment", att.GetName(),
+			func() error { _, err := gc.GetServiceAttachment(ctx, att.GetName()); return err },
+			func() error {
+				return gc.CreateServiceAttachment(ctx, att.GetName(), gcp.RelativeName(att.GetProducerForwardingRule()),
+					att.GetConsumerAcceptLists(), natSubnets, att.ReconcileConnections)
+			})
+		if err != nil {
+			return restored, err
+		}
+	}
+	return restored, nil
+}
+
+// restoreEndpoints attaches the endpoints that aren't attached to the NEG anymore.
+func restoreEndpoints(ctx context.Context, gc gcp.NEGs, neg string, endpoints []*gcp.PortMapping) error {
+	current, err := gc.ListEndpoints(ctx, neg)
+	if err != nil {
+		return err
+	}
+	attached := map[gcp.PortMapping]struct{}{}
+	for _, e := range current {
+		attached[*e] = struct{}{}
+	}
+	var missing []*gcp.PortMapping
+	for _, e := range endpoints {
+		if _, ok := attached[*e]; !ok {
+			missing = append(missing, e)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	err = gc.AttachEndpoints(ctx, neg, missing)
+	if err != nil {
+		return fmt.Errorf("failed to restore %d endpoints of NEG %s: %w", len(missing), neg, err)
+	}
+	return nil
+}
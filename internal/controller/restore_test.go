@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestRestoreSnapshot(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	r := New(c, gcpClient)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	for _, store := range []gcp.ObjectStore{nil, objectStore{}} {
+		r.exportSnapshots(ctx, testr.New(t), store)
+		snapshot, err := r.ReadSnapshot(ctx, req.NamespacedName, store)
+		require.NoError(t, err)
+		require.Equal(t, req.String(), snapshot.StatefulSet)
+	}
+	_, err = r.ReadSnapshot(ctx, req.NamespacedName, objectStore{})
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+
+	snapshot, err := r.ReadSnapshot(ctx, req.NamespacedName, nil)
+	require.NoError(t, err)
+	ip := snapshot.ForwardingRules[0].GetIPAddress()
+	require.NotEmpty(t, ip)
+
+	// Nothing is missing.
+	restored, err := r.RestoreSnapshot(ctx, testr.New(t), snapshot)
+	require.NoError(t, err)
+	require.Empty(t, restored)
+
+	// Everything but the NEG is deleted, along with one of its endpoints.
+	prefix := s.spec.Prefix
+	require.NoError(t, gcpClient.DeleteServiceAttachment(ctx, svcAttName(prefix)))
+	require.NoError(t, gcpClient.DeleteForwardingRule(ctx, fwdRuleName(prefix)))
+	require.NoError(t, gcpClient.DeleteBackendService(ctx, backendName(prefix)))
+	require.NoError(t, gcpClient.DeleteFirewall(ctx, firewallName(prefix)))
+	require.NoError(t, gcpClient.DetachEndpoints(ctx, negName(prefix), snapshot.Endpoints[:1]))
+
+	restored, err = r.RestoreSnapshot(ctx, testr.New(t), snapshot)
+	require.NoError(t, err)
+	require.Equal(t, []string{firewallName(prefix), backendName(prefix), fwdRuleName(prefix), svcAttName(prefix)}, restored)
+	endpoints, err := gcpClient.ListEndpoints(ctx, negName(prefix))
+	require.NoError(t, err)
+	require.ElementsMatch(t, snapshot.Endpoints, endpoints)
+	rule, err := gcpClient.GetForwardingRule(ctx, fwdRuleName(prefix))
+	require.NoError(t, err)
+	require.Equal(t, ip, rule.GetIPAddress())
+	att, err := gcpClient.GetServiceAttachment(ctx, svcAttName(prefix))
+	require.NoError(t, err)
+	require.Equal(t, gcp.ManagedDescription, att.GetDescription())
+
+	// The restored resources are up to date.
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+}
@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+)
+
+// ruleCostLimit bounds the cost of evaluating a rule, so that an expensive expression can't
+// stall reconciliations.
+const ruleCostLimit = 1000000
+
+// Rule is a CEL expression that specs must satisfy, e.g. spec.prefix.startsWith("team-"). The
+// spec is the spec variable, in its JSON form with the defaults applied, so its fields are
+// named as in the annotation. Optional fields that aren't set are missing, which can be checked
+// with has(), e.g. !has(spec.ip).
+type Rule struct {
+	Expression string `json:"expression"`
+	// The error reported when a spec doesn't satisfy the rule. It defaults to the expression.
+	Message string `json:"message,omitempty"`
+}
+
+var ruleEnv = func() *cel.Env {
+	env, err := cel.NewEnv(cel.Variable("spec", cel.MapType(cel.StringType, cel.DynType)))
+	if err != nil {
+		panic(err)
+	}
+	return env
+}()
+
+// compileRules compiles the rules' expressions, which must evaluate to a bool.
+func compileRules(rules []Rule) ([]cel.Program, error) {
+	programs := make([]cel.Program, 0, len(rules))
+	for i, r := range rules {
+		ast, iss := ruleEnv.Compile(r.Expression)
+		if iss.Err() != nil {
+			return nil, fmt.Errorf("invalid rules[%d]: %w", i, iss.Err())
+		}
+		if ast.OutputType() != cel.BoolType && ast.OutputType() != cel.DynType {
+			return nil, fmt.Errorf("rules[%d] evaluates to %s instead of a bool", i, ast.OutputType())
+		}
+		prg, err := ruleEnv.Program(ast, cel.CostLimit(ruleCostLimit))
+		if err != nil {
+			return nil, fmt.Errorf("invalid rules[%d]: %w", i, err)
+		}
+		programs = append(programs, prg)
+	}
+	return programs, nil
+}
+
+// evalRule returns an error if the spec, as returned by ruleInput, doesn't satisfy the rule.
+func evalRule(r Rule, prg cel.Program, input map[string]any) error {
+	out, _, err := prg.Eval(map[string]any{"spec": input})
+	if err != nil {
+		return fmt.Errorf("failed to evaluate the rule %q: %w", r.Expression, err)
+	}
+	ok, isBool := out.Value().(bool)
+	if !isBool {
+		return fmt.Errorf("the rule %q evaluated to %v instead of a bool", r.Expression, out.Value())
+	}
+	if ok {
+		return nil
+	}
+	if r.Message != "" {
+		return fmt.Errorf("%s", r.Message)
+	}
+	return fmt.Errorf("the spec doesn't satisfy the rule %q", r.Expression)
+}
+
+// ruleInput returns the spec's JSON form, which rules are evaluated against. Whole numbers are
+// decoded as ints rather than doubles, so that rules can compare them to int literals.
+func ruleInput(spec *Spec) (map[string]any, error) {
+	encoded, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(encoded))
+	dec.UseNumber()
+	var input map[string]any
+	err = dec.Decode(&input)
+	if err != nil {
+		return nil, err
+	}
+	return withInts(input).(map[string]any), nil
+}
+
+func withInts(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			v[k] = withInts(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = withInts(e)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return v
+}
@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"github.com/0x5d/psc-portmapper/api"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/utils/ptr"
+)
+
+// ScaleToZeroPolicy decides what happens to the forwarding rule and service attachment while the
+// STS is scaled to zero.
+type ScaleToZeroPolicy = api.ScaleToZeroPolicy
+
+const (
+	ScaleToZeroKeep     = api.ScaleToZeroKeep
+	ScaleToZeroTeardown = api.ScaleToZeroTeardown
+)
+
+// scaledToZero returns the policy applied to the STS if it's scaled to zero, or "" otherwise.
+func scaledToZero(sts *appsv1.StatefulSet, spec *Spec) ScaleToZeroPolicy {
+	if ptr.Deref(sts.Spec.Replicas, 1) != 0 {
+		return ""
+	}
+	if spec.ScaleToZero == "" {
+		return ScaleToZeroKeep
+	}
+	return spec.ScaleToZero
+}
+
+// resolveScaleToZero records on the spec whether its forwarding rules and service attachments
+// must be torn down, as the STS is scaled to zero.
+func resolveScaleToZero(sts *appsv1.StatefulSet, spec *Spec) {
+	spec.tornDown = scaledToZero(sts, spec) == ScaleToZeroTeardown
+}
+
+// scaleToZeroConditions are the types of the conditions reporting the deletion of each of the
+// sub-reconcilers torn down while the STS is scaled to zero.
+var scaleToZeroConditions = map[string]string{
+	"forwarding rule":              "ForwardingRuleDeleted",
+	"service attachment":           "AttachmentDeleted",
+	"migration forwarding rule":    "MigrationForwardingRuleDeleted",
+	"migration service attachment": "MigrationAttachmentDeleted",
+	"canary":                       "ConsumerCanaryDeleted",
+	"migration canary":             "ConsumerCanaryDeleted",
+}
+
+// withScaleToZero deletes the forwarding rules and service attachments instead of ensuring them
+// if the spec's are torn down. The ones that are already obsolete, e.g. after a migration, are
+// left as they are.
+func withScaleToZero(subs []subReconciler, spec *Spec) []subReconciler {
+	if !spec.tornDown {
+		return subs
+	}
+	tornDown := make([]subReconciler, 0, len(subs))
+	for _, s := range subs {
+		if condType, ok := scaleToZeroConditions[s.Name()]; ok {
+			s = obsolete(s, condType)
+		}
+		tornDown = append(tornDown, s)
+	}
+	return tornDown
+}
@@ -0,0 +1,110 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestScaleToZero(t *testing.T) {
+	tests := []struct {
+		name           string
+		policy         ScaleToZeroPolicy
+		expectedPolicy ScaleToZeroPolicy
+		tornDown       bool
+	}{{
+		name:           "Keeps the attachment by default",
+		expectedPolicy: ScaleToZeroKeep,
+	}, {
+		name:           "Keeps the attachment",
+		policy:         ScaleToZeroKeep,
+		expectedPolicy: ScaleToZeroKeep,
+	}, {
+		name:           "Tears down the forwarding rule and attachment",
+		policy:         ScaleToZeroTeardown,
+		expectedPolicy: ScaleToZeroTeardown,
+		tornDown:       true,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := initialState()
+			s.spec.ScaleToZero = tt.policy
+			specStr, err := json.Marshal(s.spec)
+			require.NoError(t, err)
+			s.sts.Annotations[annotation] = string(specStr)
+			c := fake.NewClientBuilder().
+				WithLists(s.nodes, s.pods).
+				WithObjects(s.sts).
+				Build()
+			gcpClient := gcpfake.New(s.project, s.region)
+			r := New(c, gcpClient)
+			req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+			svcAttFQN := gcp.ServiceAttachmentFQN(s.project, s.region, svcAttName(s.spec.Prefix))
+
+			// scale sets the STS' replicas, keeping as many pods, and reconciles.
+			scale := func(replicas int32) *Status {
+				t.Helper()
+				sts := &appsv1.StatefulSet{}
+				require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+				sts.Spec.Replicas = ptr.To(replicas)
+				require.NoError(t, c.Update(ctx, sts))
+				for i := range s.pods.Items {
+					pod := s.pods.Items[i].DeepCopy()
+					pod.ResourceVersion = ""
+					err := c.Delete(ctx, pod)
+					require.NoError(t, client.IgnoreNotFound(err))
+					if int32(i) < replicas {
+						require.NoError(t, c.Create(ctx, pod))
+					}
+				}
+				_, err := r.Reconcile(ctx, req)
+				require.NoError(t, err)
+				require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+				return parseStatus(sts)
+			}
+
+			status := scale(3)
+			require.Empty(t, status.ScaledToZero)
+
+			status = scale(0)
+			require.Equal(t, tt.expectedPolicy, status.ScaledToZero)
+			require.True(t, meta.IsStatusConditionTrue(status.Conditions, readyCondition))
+			_, err = gcpClient.GetServiceAttachment(ctx, svcAttName(s.spec.Prefix))
+			_, fwdRuleErr := gcpClient.GetForwardingRule(ctx, fwdRuleName(s.spec.Prefix))
+			if tt.tornDown {
+				require.ErrorIs(t, err, gcp.ErrNotFound)
+				require.ErrorIs(t, fwdRuleErr, gcp.ErrNotFound)
+				require.Empty(t, status.ServiceAttachments)
+				require.Equal(t, reasonDeleted, meta.FindStatusCondition(status.Conditions, "AttachmentDeleted").Reason)
+			} else {
+				require.NoError(t, err)
+				require.NoError(t, fwdRuleErr)
+				require.Equal(t, []string{svcAttFQN}, status.ServiceAttachments)
+			}
+			// The backend stays either way.
+			_, err = gcpClient.GetBackendService(ctx, backendName(s.spec.Prefix))
+			require.NoError(t, err)
+
+			// They're recreated once the STS is scaled up.
+			status = scale(2)
+			require.Empty(t, status.ScaledToZero)
+			require.Equal(t, []string{svcAttFQN}, status.ServiceAttachments)
+			require.True(t, meta.IsStatusConditionTrue(status.Conditions, "AttachmentReady"))
+			require.Nil(t, meta.FindStatusCondition(status.Conditions, "AttachmentDeleted"))
+			_, err = gcpClient.GetServiceAttachment(ctx, svcAttName(s.spec.Prefix))
+			require.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package controller
+
+import (
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// CacheOptions scopes the manager's cache, and therefore the StatefulSets the controller
+// reconciles, to the given namespaces and to the StatefulSets matching labelSelector. An empty
+// list of namespaces or an empty selector don't restrict anything.
+func CacheOptions(namespaces []string, labelSelector string) (cache.Options, error) {
+	opts := cache.Options{}
+	if len(namespaces) > 0 {
+		opts.DefaultNamespaces = make(map[string]cache.Config, len(namespaces))
+		for _, ns := range namespaces {
+			opts.DefaultNamespaces[ns] = cache.Config{}
+		}
+	}
+	if labelSelector != "" {
+		selector, err := labels.Parse(labelSelector)
+		if err != nil {
+			return cache.Options{}, fmt.Errorf("invalid label selector %q: %w", labelSelector, err)
+		}
+		opts.ByObject = map[client.Object]cache.ByObject{
+			&appsv1.StatefulSet{}: {Label: selector},
+		}
+	}
+	return opts, nil
+}
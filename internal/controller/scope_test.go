@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+)
+
+func TestCacheOptions(t *testing.T) {
+	tests := []struct {
+		name               string
+		namespaces         []string
+		labelSelector      string
+		expectedNamespaces map[string]cache.Config
+		expectedSelector   string
+		expectedErr        string
+	}{{
+		name: "Doesn't restrict anything by default",
+	}, {
+		name:               "Restricts the namespaces",
+		namespaces:         []string{"team-a", "team-b"},
+		expectedNamespaces: map[string]cache.Config{"team-a": {}, "team-b": {}},
+	}, {
+		name:             "Restricts the StatefulSets by label",
+		labelSelector:    "psc-portmapper.0x5d.org/instance=a",
+		expectedSelector: "psc-portmapper.0x5d.org/instance=a",
+	}, {
+		name:          "Fails if the selector is invalid",
+		labelSelector: "a=b=c",
+		expectedErr:   `invalid label selector "a=b=c"`,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := CacheOptions(tt.namespaces, tt.labelSelector)
+			if tt.expectedErr != "" {
+				require.ErrorContains(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedNamespaces, opts.DefaultNamespaces)
+			if tt.expectedSelector == "" {
+				require.Empty(t, opts.ByObject)
+				return
+			}
+			require.Len(t, opts.ByObject, 1)
+			for obj, byObj := range opts.ByObject {
+				require.IsType(t, &appsv1.StatefulSet{}, obj)
+				expected, err := labels.Parse(tt.expectedSelector)
+				require.NoError(t, err)
+				require.Equal(t, expected, byObj.Label)
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// Settings are the reconciler's settings that can be changed while it's running, see
+// PortmapReconciler.SetSettings.
+type Settings struct {
+	// How long to wait before retrying a failed reconcile. Specs can override it.
+	RequeueDelay time.Duration
+	// How long each step of a reconcile, i.e. ensuring or deleting a resource, can take. 0
+	// doesn't time them out. Specs can override it.
+	StepTimeout time.Duration
+	// See WithDriftCheckInterval.
+	DriftCheckInterval time.Duration
+	// How fast StatefulSets are requeued.
+	RateLimit RateLimit
+	// Merged into every spec. They're only applied to a StatefulSet's resources once it's
+	// reconciled again, e.g. on its next drift check.
+	SpecDefaults *SpecDefaults
+	// Specs violating it are rejected.
+	Policy *Policy
+	// How many times in a row a StatefulSet can fail to reconcile before it's reported as stuck,
+	// with a Warning event and the psc_portmapper_stuck metric. 0 disables reporting.
+	StuckAfterFailures int
+	// How StatefulSets with an invalid spec are handled. Defaults to InvalidSpecRequeue.
+	InvalidSpecs InvalidSpecMode
+	// How long a deleted StatefulSet's resources are kept while consumers are still connected
+	// to its service attachment. 0 deletes them right away.
+	DrainTimeout time.Duration
+	// How much of its connection limit a consumer can use, in percent, before a Warning event
+	// is emitted. 0 disables the events, but not the metrics.
+	ConnectionLimitAlertPercent int
+	// How many of its NAT subnets' addresses a service attachment can use, in percent, before a
+	// Warning event is emitted. 0 disables the events, but not the metrics.
+	NatSubnetAlertPercent int
+	// How many endpoints a NEG can have. StatefulSets with more replicas than fit are reported
+	// with a Warning event, and the extra replicas aren't mapped. 0 doesn't limit them.
+	NEGEndpointLimit int
+	// How long to wait for each connection when probing the mapped ports after the resources are
+	// reconciled. 0 disables probing. See probe.go.
+	ProbeTimeout time.Duration
+	// The subnet the specs' canaries are created in, usually in a dedicated test project and
+	// network. Specs can't enable the canary without it. See canary.go.
+	CanarySubnet string
+	// The minimum time between two writes of a StatefulSet's status that only refresh it, e.g.
+	// its last drift check or the messages of a failure being retried, so that a large fleet
+	// doesn't patch the API server constantly. Changes to the resources' state are written right
+	// away. 0 doesn't coalesce writes.
+	StatusWriteInterval time.Duration
+	// Where the instances backing the nodes are read from, in order. Defaults to their provider
+	// IDs. See instances.go.
+	InstanceSources []InstanceSource
+	// The <namespace>/<name> of the ConfigMap the adoption reports of the StatefulSets
+	// reconciled by another version of the controller are written to. Empty only reports them
+	// with events and logs. See adoption.go.
+	AdoptionReportConfigMap string
+	// Whether the StatefulSets' port mappings, probe results and the progress of failed attempts
+	// are written to the state store instead of their status annotation, which would outgrow
+	// the annotations' size limit with thousands of mappings. See state.go.
+	ExternalState bool
+	// The budget of mutating GCP operations per minute shared by every StatefulSet in bulk
+	// mode, which also reconciles them one at a time, e.g. while hundreds of them are migrated
+	// to a new cluster. 0 disables bulk mode. See bulk.go.
+	BulkOperationsPerMinute int
+	// How long the node ports of a deleted StatefulSet can't be reused by another one, so that
+	// consumers' stale connections don't reach a new workload. 0 lets them be reused right
+	// away. See cooldown.go.
+	NodePortCooldown time.Duration
+	// The <namespace>/<name> of the ConfigMap the released node ports are written to. It must
+	// be set if NodePortCooldown is.
+	ReleasedNodePortsConfigMap string
+}
+
+// InvalidSpecMode is how StatefulSets with an invalid spec are handled.
+type InvalidSpecMode string
+
+const (
+	// InvalidSpecRequeue retries them with a backoff, like any other failure.
+	InvalidSpecRequeue InvalidSpecMode = "requeue"
+	// InvalidSpecPark doesn't retry them until they change, to avoid retrying specs that can't
+	// succeed. Why the spec is invalid is reported with an event and the Ready condition.
+	InvalidSpecPark InvalidSpecMode = "park"
+)
+
+func (m InvalidSpecMode) Validate() error {
+	switch m {
+	case "", InvalidSpecRequeue, InvalidSpecPark:
+		return nil
+	}
+	return fmt.Errorf("invalid spec mode %q, it must be %q or %q", m, InvalidSpecRequeue, InvalidSpecPark)
+}
+
+// RateLimit configures the workqueue's rate limiter. Requeues are delayed by the longest of
+// a per-StatefulSet exponential backoff, an overall token bucket and, optionally, a token
+// bucket per namespace.
+type RateLimit struct {
+	// The backoff after a StatefulSet's first failure. It doubles with each failure.
+	BaseDelay time.Duration
+	// The maximum backoff.
+	MaxDelay time.Duration
+	// The overall requeues per second.
+	QPS float64
+	// The overall requeue burst.
+	Burst int
+	// The requeues per second of each namespace, so that a namespace with many failing
+	// StatefulSets can't fill the queue and starve the others. 0 doesn't limit them.
+	NamespaceQPS float64
+	// The requeue burst of each namespace. It's at least 1 if NamespaceQPS is set.
+	NamespaceBurst int
+}
+
+const (
+	defaultStuckAfterFailures          = 10
+	defaultConnectionLimitAlertPercent = 80
+	defaultNatSubnetAlertPercent       = 80
+	defaultNEGEndpointLimit            = 10000
+)
+
+// DefaultSettings returns the settings used unless others are set. The rate limit matches
+// controller-runtime's default.
+func DefaultSettings() Settings {
+	return Settings{
+		RequeueDelay:                defaultRequeueDelay,
+		DriftCheckInterval:          defaultDriftCheckInterval,
+		StuckAfterFailures:          defaultStuckAfterFailures,
+		ConnectionLimitAlertPercent: defaultConnectionLimitAlertPercent,
+		NatSubnetAlertPercent:       defaultNatSubnetAlertPercent,
+		NEGEndpointLimit:            defaultNEGEndpointLimit,
+		RateLimit: RateLimit{
+			BaseDelay: 5 * time.Millisecond,
+			MaxDelay:  1000 * time.Second,
+			QPS:       10,
+			Burst:     100,
+		},
+	}
+}
+
+// WithSettings sets the reconciler's initial settings.
+func WithSettings(s Settings) Option {
+	return func(r *PortmapReconciler) {
+		r.settings = s
+	}
+}
+
+// SetSettings replaces the reconciler's settings. It's safe to call while it's running, e.g.
+// when its config file changes.
+func (r *PortmapReconciler) SetSettings(s Settings) {
+	r.settingsMu.Lock()
+	defer r.settingsMu.Unlock()
+	r.settings = s
+	r.rateLimiter.set(s.RateLimit)
+	r.bulk.set(s.BulkOperationsPerMinute)
+}
+
+// requeueDelay returns how long to wait before retrying the spec's STS: the spec's
+// requeue_delay if it sets one, and the settings' otherwise.
+func (s Settings) requeueDelay(spec *Spec) time.Duration {
+	if spec.RequeueDelay != nil {
+		return spec.RequeueDelay.Duration
+	}
+	return s.RequeueDelay
+}
+
+// stepTimeout returns how long each step of reconciling the spec can take, as per
+// Settings.StepTimeout.
+func (s Settings) stepTimeout(spec *Spec) time.Duration {
+	if spec.StepTimeout != nil {
+		return spec.StepTimeout.Duration
+	}
+	return s.StepTimeout
+}
+
+// withStepTimeout returns the context of a single step, which times out after timeout, unless
+// it's 0.
+func withStepTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (r *PortmapReconciler) currentSettings() Settings {
+	r.settingsMu.RLock()
+	defer r.settingsMu.RUnlock()
+	return r.settings
+}
+
+// rateLimiter is a workqueue rate limiter whose limits can be replaced while it's in use.
+type rateLimiter struct {
+	mu      sync.RWMutex
+	limit   RateLimit
+	limiter workqueue.TypedRateLimiter[reconcile.Request]
+}
+
+var _ workqueue.TypedRateLimiter[reconcile.Request] = &rateLimiter{}
+
+// set replaces the limits. The StatefulSets' failure counts are reset if they changed.
+func (l *rateLimiter) set(limit RateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limiter != nil && l.limit == limit {
+		return
+	}
+	l.limit = limit
+	limiters := []workqueue.TypedRateLimiter[reconcile.Request]{
+		workqueue.NewTypedItemExponentialFailureRateLimiter[reconcile.Request](limit.BaseDelay, limit.MaxDelay),
+		&workqueue.TypedBucketRateLimiter[reconcile.Request]{Limiter: rate.NewLimiter(rate.Limit(limit.QPS), limit.Burst)},
+	}
+	if limit.NamespaceQPS > 0 {
+		limiters = append(limiters, newNamespaceRateLimiter(limit.NamespaceQPS, limit.NamespaceBurst))
+	}
+	l.limiter = workqueue.NewTypedMaxOfRateLimiter(limiters...)
+}
+
+func (l *rateLimiter) When(req reconcile.Request) time.Duration {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.limiter.When(req)
+}
+
+func (l *rateLimiter) Forget(req reconcile.Request) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	l.limiter.Forget(req)
+}
+
+func (l *rateLimiter) NumRequeues(req reconcile.Request) int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.limiter.NumRequeues(req)
+}
+
+// namespaceRateLimiter is a token bucket per namespace. Buckets are created as namespaces are
+// requeued, and never removed, since there are usually few namespaces.
+type namespaceRateLimiter struct {
+	qps   rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+var _ workqueue.TypedRateLimiter[reconcile.Request] = &namespaceRateLimiter{}
+
+func newNamespaceRateLimiter(qps float64, burst int) *namespaceRateLimiter {
+	return &namespaceRateLimiter{
+		qps:      rate.Limit(qps),
+		burst:    max(burst, 1),
+		limiters: map[string]*rate.Limiter{},
+	}
+}
+
+func (l *namespaceRateLimiter) When(req reconcile.Request) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limiter, ok := l.limiters[req.Namespace]
+	if !ok {
+		limiter = rate.NewLimiter(l.qps, l.burst)
+		l.limiters[req.Namespace] = limiter
+	}
+	return limiter.Reserve().Delay()
+}
+
+// Forget is a no-op, since the buckets are shared by the namespace's StatefulSets.
+func (l *namespaceRateLimiter) Forget(reconcile.Request) {}
+
+func (l *namespaceRateLimiter) NumRequeues(reconcile.Request) int {
+	return 0
+}
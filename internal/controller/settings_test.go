@@ -0,0 +1,72 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/0x5d/psc-portmapper/api"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestNamespaceRateLimit(t *testing.T) {
+	l := &rateLimiter{}
+	l.set(RateLimit{QPS: 1000, Burst: 1000, NamespaceQPS: 1, NamespaceBurst: 2})
+	req := func(namespace, name string) reconcile.Request {
+		return reconcile.Request{NamespacedName: types.NamespacedName{Namespace: namespace, Name: name}}
+	}
+
+	// The noisy namespace's burst is used up by its first StatefulSets.
+	require.Zero(t, l.When(req("noisy", "sts-0")))
+	require.Zero(t, l.When(req("noisy", "sts-1")))
+	require.Greater(t, l.When(req("noisy", "sts-2")), 500*time.Millisecond)
+	// The others' aren't.
+	require.Zero(t, l.When(req("quiet", "sts-0")))
+
+	// Namespaces aren't limited by default.
+	l.set(RateLimit{QPS: 1000, Burst: 1000})
+	for i := range 10 {
+		require.Zero(t, l.When(req("noisy", "sts-"+strconv.Itoa(i))))
+	}
+}
+
+func TestSpecTiming(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	var spec Spec
+	require.NoError(t, json.Unmarshal([]byte(s.sts.Annotations[annotation]), &spec))
+	spec.RequeueDelay = &api.Duration{Duration: 5 * time.Second}
+	spec.StepTimeout = &api.Duration{Duration: 10 * time.Millisecond}
+	jsonSpec, err := json.Marshal(spec)
+	require.NoError(t, err)
+	s.sts.Annotations[annotation] = string(jsonSpec)
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	// Every call takes longer than the spec's step timeout.
+	gcpClient := gcpfake.NewFaulty(gcpfake.New(s.project, s.region), gcpfake.Faults{MaxLatency: time.Hour, Seed: 1})
+	r := New(c, gcpClient)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+
+	start := time.Now()
+	res, err := r.Reconcile(ctx, req)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), time.Minute)
+	require.Equal(t, 5*time.Second, res.RequeueAfter)
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	ready := meta.FindStatusCondition(parseStatus(sts).Conditions, readyCondition)
+	require.Equal(t, metav1.ConditionFalse, ready.Status)
+	require.Equal(t, reasonGCPUnavailable, ready.Reason)
+}
@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// Shard is the share of the StatefulSets a controller replica reconciles, for fleets too large
+// for a single one. Each of the Count replicas reconciles the StatefulSets whose namespace/name
+// hash to its Index, so they're all active at once. The hash is consistent: changing Count only
+// moves about 1/Count of the StatefulSets between replicas. A Count of 0 or 1 reconciles all of
+// them.
+type Shard struct {
+	Index int
+	Count int
+}
+
+func (s Shard) Validate() error {
+	if s.Count < 0 {
+		return fmt.Errorf("the shard count (%d) can't be negative", s.Count)
+	}
+	if s.Index < 0 || (s.Index > 0 && s.Index >= s.Count) {
+		return fmt.Errorf("the shard index (%d) must be between 0 and the shard count (%d) - 1", s.Index, s.Count)
+	}
+	return nil
+}
+
+// sharded returns true if the StatefulSets are split between several replicas.
+func (s Shard) sharded() bool {
+	return s.Count > 1
+}
+
+// LeaderElectionID returns the ID of the shard's leader election lease, so that each shard
+// elects its own leader, and several replicas of the same shard can run for availability.
+func (s Shard) LeaderElectionID(id string) string {
+	if !s.sharded() {
+		return id
+	}
+	return fmt.Sprintf("%s-shard-%d", id, s.Index)
+}
+
+// owns returns true if the StatefulSet belongs to the shard.
+func (s Shard) owns(name types.NamespacedName) bool {
+	if !s.sharded() {
+		return true
+	}
+	h := fnv.New64a()
+	// hash.Hash's Write never fails.
+	_, _ = h.Write([]byte(name.String()))
+	return jumpHash(h.Sum64(), s.Count) == s.Index
+}
+
+// jumpHash maps key to one of the buckets, moving the fewest keys when the number of buckets
+// changes. See Lamping and Veach's "A Fast, Minimal Memory, Consistent Hash Algorithm".
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+func inShard(s Shard) predicate.Funcs {
+	return predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		return s.owns(client.ObjectKeyFromObject(obj))
+	})
+}
+
+// manages returns true if the StatefulSet is reconciled by this controller, as per its class
+// and shard.
+func (r *PortmapReconciler) manages(sts *appsv1.StatefulSet) bool {
+	return hasClass(sts, r.class) && r.shard.owns(client.ObjectKeyFromObject(sts))
+}
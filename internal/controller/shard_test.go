@@ -0,0 +1,120 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestShardValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		shard Shard
+		err   string
+	}{{
+		name: "Unsharded",
+	}, {
+		name:  "Sharded",
+		shard: Shard{Index: 2, Count: 3},
+	}, {
+		name:  "Negative count",
+		shard: Shard{Count: -1},
+		err:   "the shard count (-1) can't be negative",
+	}, {
+		name:  "Negative index",
+		shard: Shard{Index: -1, Count: 3},
+		err:   "the shard index (-1) must be between 0 and the shard count (3) - 1",
+	}, {
+		name:  "Index out of range",
+		shard: Shard{Index: 3, Count: 3},
+		err:   "the shard index (3) must be between 0 and the shard count (3) - 1",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.shard.Validate()
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestShardOwns(t *testing.T) {
+	names := make([]types.NamespacedName, 0, 1000)
+	for i := range 1000 {
+		names = append(names, types.NamespacedName{Namespace: fmt.Sprintf("ns-%d", i%10), Name: fmt.Sprintf("sts-%d", i)})
+	}
+	owner := func(count int, name types.NamespacedName) int {
+		owner := -1
+		for i := range count {
+			if (Shard{Index: i, Count: count}).owns(name) {
+				require.Equal(t, -1, owner, "%s is owned by shards %d and %d", name, owner, i)
+				owner = i
+			}
+		}
+		require.NotEqual(t, -1, owner, "%s isn't owned by any shard", name)
+		return owner
+	}
+
+	perShard := map[int]int{}
+	moved := 0
+	for _, name := range names {
+		require.True(t, Shard{}.owns(name))
+		o := owner(4, name)
+		perShard[o]++
+		if owner(5, name) != o {
+			moved++
+		}
+	}
+	// Every shard gets a fair share, and adding one only moves the new shard's share.
+	for i := range 4 {
+		require.InDelta(t, 250, perShard[i], 50)
+	}
+	require.InDelta(t, 200, moved, 50)
+}
+
+func TestShardLeaderElectionID(t *testing.T) {
+	require.Equal(t, "id", Shard{}.LeaderElectionID("id"))
+	require.Equal(t, "id", Shard{Count: 1}.LeaderElectionID("id"))
+	require.Equal(t, "id-shard-2", Shard{Index: 2, Count: 3}.LeaderElectionID("id"))
+}
+
+func TestShardReconcile(t *testing.T) {
+	ctx := context.Background()
+	for i := range 2 {
+		shard := Shard{Index: i, Count: 2}
+		t.Run(fmt.Sprintf("Shard %d", i), func(t *testing.T) {
+			s := initialState()
+			c := fake.NewClientBuilder().
+				WithLists(s.nodes, s.pods).
+				WithObjects(s.sts).
+				Build()
+			gcpClient := gcpfake.New(s.project, s.region)
+			r := New(c, gcpClient, WithShard(shard))
+			req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+			reconciled := shard.owns(req.NamespacedName)
+
+			require.Equal(t, reconciled, inShard(shard).Generic(event.GenericEvent{Object: s.sts}))
+			_, err := r.Reconcile(ctx, req)
+			require.NoError(t, err)
+			_, err = gcpClient.GetNEG(ctx, negName(s.spec.Prefix))
+			if reconciled {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, gcp.ErrNotFound)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/0x5d/psc-portmapper/internal/version"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// snapshotKey is the key of the snapshot in its ConfigMap.
+const snapshotKey = "snapshot.json"
+
+// Snapshot is the state of the GCP resources managed for a StatefulSet when it was taken, for
+// disaster recovery and audits. Resources that didn't exist, or that the controller doesn't
+// own, aren't included.
+type Snapshot struct {
+	StatefulSet       string      `json:"stateful_set"`
+	TakenAt           metav1.Time `json:"taken_at"`
+	ControllerVersion string      `json:"controller_version"`
+	// The spec the resources were last reconciled with.
+	Spec               *Spec                           `json:"spec"`
+	Firewalls          []*computepb.Firewall           `json:"firewalls,omitempty"`
+	NEG                *computepb.NetworkEndpointGroup `json:"neg,omitempty"`
+	Endpoints          []*gcp.PortMapping              `json:"endpoints,omitempty"`
+	BackendService     *computepb.BackendService       `json:"backend_service,omitempty"`
+	ForwardingRules    []*computepb.ForwardingRule     `json:"forwarding_rules,omitempty"`
+	ServiceAttachments []*computepb.ServiceAttachment  `json:"service_attachments,omitempty"`
+}
+
+// SnapshotExporter returns a runnable that snapshots the resources of each StatefulSet the
+// reconciler manages every interval, and writes them to the store, or to a ConfigMap next to
+// each StatefulSet if the store is nil. It only runs on the leader.
+func (r *PortmapReconciler) SnapshotExporter(log logr.Logger, interval time.Duration, store gcp.ObjectStore) manager.Runnable {
+	return manager.RunnableFunc(func(ctx context.Context) error {
+		log.Info("Exporting snapshots.", "interval", interval.String())
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				r.exportSnapshots(ctx, log, store)
+			}
+		}
+	})
+}
+
+// exportSnapshots snapshots the resources of each StatefulSet that was reconciled successfully.
+// Failures are logged, so that one StatefulSet doesn't keep the others from being exported.
+func (r *PortmapReconciler) exportSnapshots(ctx context.Context, log logr.Logger, store gcp.ObjectStore) {
+	stss := &appsv1.StatefulSetList{}
+	err := r.List(ctx, stss)
+	if err != nil {
+		log.Error(err, "Failed to list the StatefulSets.")
+		return
+	}
+	for i := range stss.Items {
+		sts := &stss.Items[i]
+		spec := lastAppliedSpec(sts)
+		_, ok := sts.Annotations[annotation]
+		if !ok || spec == nil || !r.manages(sts) || !sts.DeletionTimestamp.IsZero() {
+			continue
+		}
+		log := log.WithValues("namespace", sts.Namespace, "name", sts.Name)
+		err := r.exportSnapshot(ctx, log, spec, sts, store)
+		if err != nil {
+			log.Error(err, "Failed to export a snapshot.")
+		}
+	}
+}
+
+func (r *PortmapReconciler) exportSnapshot(ctx context.Context, log logr.Logger, spec *Spec, sts *appsv1.StatefulSet, store gcp.ObjectStore) error {
+	gc, release, err := r.gcpClientFor(ctx, log, sts.Namespace, spec)
+	if err != nil {
+		return err
+	}
+	defer release()
+	gc, err = gcpClientInNetwork(gc, spec)
+	if err != nil {
+		return err
+	}
+	snapshot, err := takeSnapshot(ctx, gc, spec, sts)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if store != nil {
+		return store.WriteObject(ctx, snapshot.StatefulSet, data)
+	}
+	return r.writeSnapshotConfigMap(ctx, spec, sts, data)
+}
+
+// takeSnapshot reads the resources derived from the spec. The migration's are included if the
+// spec has one, and the original forwarding rule and service attachment if they still exist.
+func takeSnapshot(ctx context.Context, gc gcp.Client, spec *Spec, sts *appsv1.StatefulSet) (*Snapshot, error) {
+	s := &Snapshot{
+		StatefulSet:       types.NamespacedName{Namespace: sts.Namespace, Name: sts.Name}.String(),
+		TakenAt:           metav1.Now(),
+		ControllerVersion: version.Get().Version,
+		Spec:              spec,
+	}
+	own := ownershipFor(sts)
+	ports := map[int32]struct{}{}
+	for _, p := range spec.NodePorts {
+		ports[p.NodePort] = struct{}{}
+	}
+	firewalls := slices.Sorted(maps.Keys(firewallRules(spec, ports)))
+	if spec.AllowICMP {
+		firewalls = append(firewalls, icmpFirewallName(spec.Prefix))
+	}
+	var err error
+	for _, name := range firewalls {
+		if fw, ok, getErr := getOwned(ctx, own, "firewall", name, gc.GetFirewall); ok {
+			s.Firewalls = append(s.Firewalls, fw)
+		} else {
+			err = errors.Join(err, getErr)
+		}
+	}
+	neg, ok, getErr := getOwned(ctx, own, "NEG", negName(spec.Prefix), gc.GetNEG)
+	err = errors.Join(err, getErr)
+	if ok {
+		s.NEG = neg
+		s.Endpoints, getErr = gc.ListEndpoints(ctx, negName(spec.Prefix))
+		err = errors.Join(err, getErr)
+	}
+	s.BackendService, _, getErr = getOwned(ctx, own, "backend", backendName(spec.Prefix), gc.GetBackendService)
+	err = errors.Join(err, getErr)
+	fwdRules, svcAtts := []string{fwdRuleName(spec.Prefix)}, []string{svcAttName(spec.Prefix)}
+	if spec.Migration != nil {
+		fwdRules = append(fwdRules, migrationFwdRuleName(spec.Prefix))
+		svcAtts = append(svcAtts, migrationSvcAttName(spec.Prefix))
+	}
+	for _, name := range fwdRules {
+		if rule, ok, getErr := getOwned(ctx, own, "forwarding rule", name, gc.GetForwardingRule); ok {
+			s.ForwardingRules = append(s.ForwardingRules, rule)
+		} else {
+			err = errors.Join(err, getErr)
+		}
+	}
+	for _, name := range svcAtts {
+		if att, ok, getErr := getOwned(ctx, own, "service attachment", name, gc.GetServiceAttachment); ok {
+			s.ServiceAttachments = append(s.ServiceAttachments, att)
+		} else {
+			err = errors.Join(err, getErr)
+		}
+	}
+	// An incomplete snapshot would replace the last complete one.
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the resources: %w", err)
+	}
+	return s, nil
+}
+
+// getOwned returns the resource and true if it exists and belongs to the controller. Missing
+// resources and the ones it doesn't own aren't errors.
+func getOwned[T described](ctx context.Context, o ownership, kind, name string, get func(context.Context, string) (T, error)) (T, bool, error) {
+	var zero T
+	res, err := get(ctx, name)
+	if errors.Is(err, gcp.ErrNotFound) {
+		return zero, false, nil
+	}
+	if err != nil {
+		return zero, false, err
+	}
+	if o.check(kind, name, res) != nil {
+		return zero, false, nil
+	}
+	return res, true, nil
+}
+
+func snapshotConfigMapName(prefix string) string {
+	return nameBase(prefix) + "-snapshot"
+}
+
+// writeSnapshotConfigMap writes the snapshot to the <prefix>psc-portmapper-snapshot ConfigMap
+// in the StatefulSet's namespace, creating it if it doesn't exist.
+func (r *PortmapReconciler) writeSnapshotConfigMap(ctx context.Context, spec *Spec, sts *appsv1.StatefulSet, data []byte) error {
+	name := types.NamespacedName{Namespace: sts.Namespace, Name: snapshotConfigMapName(spec.Prefix)}
+	cm := &corev1.ConfigMap{}
+	err := r.reader.Get(ctx, name, cm)
+	if apierrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: name.Namespace, Name: name.Name, Labels: nodePortLabels(spec.Labels)},
+			Data:       map[string]string{snapshotKey: string(data)},
+		}
+		return r.Create(ctx, cm)
+	}
+	if err != nil {
+		return err
+	}
+	if !isManaged(cm) {
+		return fmt.Errorf("ConfigMap %s %w, as it's missing the %s=%s label", name, errNotOwned, managedByLabel, portmapperApp)
+	}
+	cm.Data = map[string]string{snapshotKey: string(data)}
+	return r.Update(ctx, cm)
+}
@@ -0,0 +1,81 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+type objectStore map[string][]byte
+
+func (s objectStore) WriteObject(_ context.Context, key string, data []byte) error {
+	s[key] = data
+	return nil
+}
+
+func (s objectStore) ReadObject(_ context.Context, key string) ([]byte, error) {
+	data, ok := s[key]
+	if !ok {
+		return nil, gcp.ErrNotFound
+	}
+	return data, nil
+}
+
+func (s objectStore) DeleteObject(_ context.Context, key string) error {
+	delete(s, key)
+	return nil
+}
+
+func (s objectStore) Location(key string) string {
+	return "memory://" + key
+}
+
+func TestExportSnapshots(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	r := New(c, gcpClient)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	// Missing resources are left out.
+	require.NoError(t, gcpClient.DeleteServiceAttachment(ctx, svcAttName(s.spec.Prefix)))
+
+	r.exportSnapshots(ctx, testr.New(t), nil)
+	cm := &corev1.ConfigMap{}
+	require.NoError(t, c.Get(ctx, types.NamespacedName{Namespace: s.sts.Namespace, Name: "prefix-psc-portmapper-snapshot"}, cm))
+	require.True(t, isManaged(cm))
+	snapshot := &Snapshot{}
+	require.NoError(t, json.Unmarshal([]byte(cm.Data[snapshotKey]), snapshot))
+	require.Equal(t, req.String(), snapshot.StatefulSet)
+	require.Equal(t, s.spec.Prefix, snapshot.Spec.Prefix)
+	require.Len(t, snapshot.Firewalls, 1)
+	require.Equal(t, "prefix-psc-portmapper-firewall", snapshot.Firewalls[0].GetName())
+	require.Equal(t, "prefix-psc-portmapper-neg", snapshot.NEG.GetName())
+	require.Len(t, snapshot.Endpoints, len(s.pods.Items))
+	require.Equal(t, "prefix-psc-portmapper-backend", snapshot.BackendService.GetName())
+	require.Len(t, snapshot.ForwardingRules, 1)
+	require.Equal(t, "prefix-psc-portmapper-fwdrule", snapshot.ForwardingRules[0].GetName())
+	require.Empty(t, snapshot.ServiceAttachments)
+
+	// With a store, they're written to it instead.
+	store := objectStore{}
+	r.exportSnapshots(ctx, testr.New(t), store)
+	require.Contains(t, store, req.String())
+	require.NoError(t, json.Unmarshal(store[req.String()], snapshot))
+	require.Equal(t, req.String(), snapshot.StatefulSet)
+}
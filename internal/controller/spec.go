@@ -1,112 +1,177 @@
 package controller
 
 import (
+	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"regexp"
+	"maps"
 
+	"github.com/0x5d/psc-portmapper/api"
 	"github.com/go-logr/logr"
-	"go.uber.org/multierr"
 )
 
 // Spec is the configuration for the controller, which is loaded from an annotation on the
-// StatefulSet.
+// StatefulSet. It's defined in the api package, so that other tools can build and validate
+// specs, and extended with what the controller resolves from the STS and its settings.
 type Spec struct {
-	Prefix             string                `json:"prefix"`
-	IP                 *string               `json:"ip,omitempty"`
-	GlobalAccess       *bool                 `json:"global_access,omitempty"`
-	ConsumerAcceptList []*Consumer           `json:"consumer_accept_list,omitempty"`
-	NatSubnetFQNs      []string              `json:"nat_subnet_fqns,omitempty"`
-	NodePorts          map[string]PortConfig `json:"node_ports"`
+	api.Spec
+
+	// The controller's canary subnet, see resolveCanary.
+	canarySubnet string
+	// Set if the forwarding rules and service attachments must be torn down, as per ScaleToZero.
+	tornDown bool
+	// Set if the STS' migration ack annotation acknowledges the migration, see resolveMigration.
+	migrationAcknowledged bool
+}
+
+type (
+	Consumer        = api.Consumer
+	CredentialsRef  = api.CredentialsRef
+	ConsumerListRef = api.ConsumerListRef
+	Migration       = api.Migration
+	PortConfig      = api.PortConfig
+)
+
+// SpecDefaults are merged into every spec, so that platform teams can enforce organization-wide
+// PSC settings while app teams only set the ports. Specs override them, except for labels,
+// which are merged.
+type SpecDefaults struct {
+	ConsumerAcceptList []*Consumer       `json:"consumer_accept_list,omitempty"`
+	GlobalAccess       *bool             `json:"global_access,omitempty"`
+	NatSubnetFQNs      []string          `json:"nat_subnet_fqns,omitempty"`
+	Labels             map[string]string `json:"labels,omitempty"`
+}
+
+// ParseSpecDefaults decodes spec defaults in the spec annotation's format, e.g. from the
+// controller's config file, rejecting unknown fields. It returns nil if data is empty.
+func ParseSpecDefaults(data []byte) (*SpecDefaults, error) {
+	if isEmptyJSON(data) {
+		return nil, nil
+	}
+	d := &SpecDefaults{}
+	err := decodeStrict(data, d)
+	if err != nil {
+		return nil, fmt.Errorf("invalid spec defaults: %w", err)
+	}
+	return d, nil
 }
 
-// See https://cloud.google.com/compute/docs/reference/rest/v1/serviceAttachments
-type Consumer struct {
-	NetworkFQN      *string `json:"network_fqn,omitempty"`
-	ConnectionLimit uint32  `json:"connection_limit,omitempty"`
-	ProjectIdOrNum  *string `json:"project_id_or_num,omitempty"`
+// isEmptyJSON returns true if data is empty or null.
+func isEmptyJSON(data []byte) bool {
+	trimmed := bytes.TrimSpace(data)
+	return len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null"))
 }
 
-type PortConfig struct {
-	NodePort      int32 `json:"node_port"`
-	ContainerPort int32 `json:"container_port"`
-	StartingPort  int32 `json:"starting_port"`
+// decodeStrict decodes data into v, rejecting unknown fields, so that typos don't go
+// unnoticed.
+func decodeStrict(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
 }
 
-// networkFQNRegexp matches the format of a network FQN, e.g.
-// projects/my-project-id/global/networks/my-vpc-name
-var networkFQNRegexp = regexp.MustCompile(`^projects\/[^/]+\/global\/networks\/[^/]+$`)
+// WithGlobalAccess returns the defaults, enabling global access if globalAccess is true and
+// they don't set it. d can be nil.
+func (d *SpecDefaults) WithGlobalAccess(globalAccess bool) *SpecDefaults {
+	if !globalAccess || (d != nil && d.GlobalAccess != nil) {
+		return d
+	}
+	withGlobalAccess := &SpecDefaults{}
+	if d != nil {
+		*withGlobalAccess = *d
+	}
+	withGlobalAccess.GlobalAccess = &globalAccess
+	return withGlobalAccess
+}
 
-// subnetFQNRegexp matches the format of a subnet FQN, e.g.
-// projects/my-project-id/regions/us-east1/subnetworks/my-subnet-name
-var subnetFQNRegexp = regexp.MustCompile(`^projects\/[^/]+\/regions\/[^/]+\/subnetworks\/[^/]+$`)
+// apply sets the defaults on spec where it doesn't set them.
+func (d *SpecDefaults) apply(spec *Spec) {
+	if d == nil {
+		return
+	}
+	if len(spec.ConsumerAcceptList) == 0 {
+		spec.ConsumerAcceptList = d.ConsumerAcceptList
+	}
+	if spec.GlobalAccess == nil {
+		spec.GlobalAccess = d.GlobalAccess
+	}
+	if len(spec.NatSubnetFQNs) == 0 {
+		spec.NatSubnetFQNs = d.NatSubnetFQNs
+	}
+	if len(d.Labels) > 0 {
+		labels := maps.Clone(d.Labels)
+		maps.Copy(labels, spec.Labels)
+		spec.Labels = labels
+	}
+}
 
-func parseSpec(log logr.Logger, jsonSpec string) (*Spec, error) {
+// parseSpec decodes the spec, applies the defaults and validates the result, including against
+// the policy.
+func parseSpec(log logr.Logger, jsonSpec string, defaults *SpecDefaults, policy *Policy) (*Spec, error) {
 	var spec Spec
 	err := json.Unmarshal([]byte(jsonSpec), &spec)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't decode the spec from JSON: %w", err)
 	}
+	defaults.apply(&spec)
+	spec.ConsumerAcceptList = spec.withDefaultConnectionLimit(spec.ConsumerAcceptList)
 
 	err = validateSpec(log, &spec)
 	if err != nil {
 		return nil, fmt.Errorf("invalid spec: %w", err)
 	}
+	err = policy.validate(&spec)
+	if err != nil {
+		return nil, fmt.Errorf("the spec violates the policy: %w", err)
+	}
 	return &spec, nil
 }
 
+// validateSpec validates the spec, logging the consumers that can't connect.
 func validateSpec(log logr.Logger, spec *Spec) error {
 	if spec == nil {
 		return fmt.Errorf("spec is nil")
 	}
-
-	if len(spec.ConsumerAcceptList) == 0 {
+	if len(spec.ConsumerAcceptList) == 0 && spec.ConsumerAcceptListFrom == nil {
 		log.Info("consumer_accept_list is empty, no incoming connections will be allowed.")
 	}
+	logUnlimitedConsumers(log, spec.ConsumerAcceptList)
+	return spec.Validate()
+}
 
-	var err error
-	for i, c := range spec.ConsumerAcceptList {
-		if c.NetworkFQN == nil && c.ProjectIdOrNum == nil {
-			err = multierr.Append(err, fmt.Errorf("either network_fqn or project_id_or_num must be set in consumer_list[%d]", i))
-		}
-		if c.NetworkFQN != nil && c.ProjectIdOrNum != nil {
-			err = multierr.Append(err, fmt.Errorf("network_fqn and project_id_or_num can't both be set in consumer_list[%d]", i))
-		}
-		if c.NetworkFQN != nil {
-			matches := networkFQNRegexp.FindStringSubmatch(*c.NetworkFQN)
-			if matches == nil {
-				matchErr := fmt.Errorf(
-					"invalid value for network_fqn (%q) in consumer_list[%d], expected format: projects/<project-id>/global/networks/<network-name>",
-					*c.NetworkFQN,
-					i,
-				)
-				err = multierr.Append(err, matchErr)
-			}
+// withDefaultConnectionLimit returns the consumers, with the spec's default connection limit
+// set on those that don't set one. They're copied, since they can be shared with the defaults.
+func (s *Spec) withDefaultConnectionLimit(consumers []*Consumer) []*Consumer {
+	if s.DefaultConnectionLimit == 0 {
+		return consumers
+	}
+	withLimits := make([]*Consumer, 0, len(consumers))
+	for _, c := range consumers {
+		if c != nil && c.ConnectionLimit == 0 {
+			withLimit := *c
+			withLimit.ConnectionLimit = s.DefaultConnectionLimit
+			c = &withLimit
 		}
-		if c.ConnectionLimit == 0 {
+		withLimits = append(withLimits, c)
+	}
+	return withLimits
+}
+
+// validateConsumers validates the consumers of a list, which is named in the errors.
+func validateConsumers(log logr.Logger, consumers []*Consumer, list string) error {
+	logUnlimitedConsumers(log, consumers)
+	return api.ValidateConsumers(consumers, list)
+}
+
+// logUnlimitedConsumers logs the consumers without a connection limit, which can't connect.
+func logUnlimitedConsumers(log logr.Logger, consumers []*Consumer) {
+	for _, c := range consumers {
+		if c != nil && c.ConnectionLimit == 0 {
 			log.Info(
-				"connection_limit is not set, no connections will be allowed from it.",
+				"Neither connection_limit nor default_connection_limit are set, no connections will be allowed from the consumer.",
 				"network_fqn", c.NetworkFQN,
 				"project_id_or_num", c.ProjectIdOrNum,
 			)
 		}
 	}
-
-	if len(spec.NatSubnetFQNs) == 0 {
-		err = multierr.Append(err, errors.New("nat_subnet_fqns is empty"))
-	}
-	for i, sn := range spec.NatSubnetFQNs {
-		matches := subnetFQNRegexp.FindStringSubmatch(sn)
-		if matches == nil {
-			matchErr := fmt.Errorf(
-				"invalid value for nat_subnet_fqns[%d] (%q), expected format: projects/<project-id>/regions/<region-name>/subnetworks/<subnetwork-name>",
-				i,
-				sn,
-			)
-			err = multierr.Append(err, matchErr)
-		}
-	}
-
-	return err
 }
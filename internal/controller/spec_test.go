@@ -3,14 +3,17 @@ package controller
 import (
 	"testing"
 
+	"github.com/0x5d/psc-portmapper/api"
 	"github.com/go-logr/logr/testr"
 	"github.com/stretchr/testify/require"
+	"k8s.io/utils/ptr"
 )
 
 func TestParseSpec(t *testing.T) {
 	tests := []struct {
 		name         string
 		jsonSpec     string
+		defaults     *SpecDefaults
 		expectedErr  string
 		expectedSpec *Spec
 	}{{
@@ -30,13 +33,13 @@ func TestParseSpec(t *testing.T) {
 					"connection_limit": 10
 				}]
 			}`,
-		expectedSpec: &Spec{
+		expectedSpec: &Spec{Spec: api.Spec{
 			NatSubnetFQNs: []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
 			ConsumerAcceptList: []*Consumer{{
 				NetworkFQN:      stringPtr("projects/my-project-123/global/networks/my-vpc"),
 				ConnectionLimit: 10,
 			}},
-		},
+		}},
 	}, {
 		name: "Parses valid spec with ProjectIdOrNum",
 		jsonSpec: `{
@@ -46,19 +49,83 @@ func TestParseSpec(t *testing.T) {
 					"connection_limit": 10
 				}]
 			}`,
-		expectedSpec: &Spec{
+		expectedSpec: &Spec{Spec: api.Spec{
 			NatSubnetFQNs: []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
 			ConsumerAcceptList: []*Consumer{{
 				ProjectIdOrNum:  stringPtr("project1"),
 				ConnectionLimit: 10,
 			}},
 		}},
-	}
+	}, {
+		name:     "Applies the defaults",
+		jsonSpec: `{"labels": {"team": "a"}}`,
+		defaults: &SpecDefaults{
+			ConsumerAcceptList: []*Consumer{{ProjectIdOrNum: stringPtr("project1"), ConnectionLimit: 10}},
+			GlobalAccess:       ptr.To(true),
+			NatSubnetFQNs:      []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
+			Labels:             map[string]string{"org": "x"},
+		},
+		expectedSpec: &Spec{Spec: api.Spec{
+			ConsumerAcceptList: []*Consumer{{ProjectIdOrNum: stringPtr("project1"), ConnectionLimit: 10}},
+			GlobalAccess:       ptr.To(true),
+			NatSubnetFQNs:      []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
+			Labels:             map[string]string{"org": "x", "team": "a"},
+		}},
+	}, {
+		name: "The spec overrides the defaults",
+		jsonSpec: `{
+				"global_access": false,
+				"nat_subnet_fqns": ["projects/my-project-123/regions/us-east1/subnetworks/my-subnet"],
+				"labels": {"org": "y"}
+			}`,
+		defaults: &SpecDefaults{
+			GlobalAccess:  ptr.To(true),
+			NatSubnetFQNs: []string{"projects/my-project-123/regions/us-east1/subnetworks/default-subnet"},
+			Labels:        map[string]string{"org": "x"},
+		},
+		expectedSpec: &Spec{Spec: api.Spec{
+			GlobalAccess:  ptr.To(false),
+			NatSubnetFQNs: []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
+			Labels:        map[string]string{"org": "y"},
+		}},
+	}, {
+		name: "Applies the default connection limit to the consumers that don't set one",
+		jsonSpec: `{
+				"nat_subnet_fqns": ["projects/my-project-123/regions/us-east1/subnetworks/my-subnet"],
+				"default_connection_limit": 5,
+				"consumer_accept_list": [{"project_id_or_num": "project1"}, {"project_id_or_num": "project2", "connection_limit": 10}]
+			}`,
+		expectedSpec: &Spec{Spec: api.Spec{
+			NatSubnetFQNs:          []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
+			DefaultConnectionLimit: 5,
+			ConsumerAcceptList: []*Consumer{
+				{ProjectIdOrNum: stringPtr("project1"), ConnectionLimit: 5},
+				{ProjectIdOrNum: stringPtr("project2"), ConnectionLimit: 10},
+			},
+		}},
+	}, {
+		name:     "Applies the default connection limit to the default consumers",
+		jsonSpec: `{"default_connection_limit": 5}`,
+		defaults: &SpecDefaults{
+			ConsumerAcceptList: []*Consumer{{ProjectIdOrNum: stringPtr("project1")}},
+			NatSubnetFQNs:      []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
+		},
+		expectedSpec: &Spec{Spec: api.Spec{
+			DefaultConnectionLimit: 5,
+			ConsumerAcceptList:     []*Consumer{{ProjectIdOrNum: stringPtr("project1"), ConnectionLimit: 5}},
+			NatSubnetFQNs:          []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
+		}},
+	}, {
+		name:        "Validates the spec with the defaults applied",
+		jsonSpec:    `{}`,
+		defaults:    &SpecDefaults{NatSubnetFQNs: []string{"my-subnet"}},
+		expectedErr: `invalid spec: invalid value for nat_subnet_fqns[0] ("my-subnet"), expected format: projects/<project-id>/regions/<region-name>/subnetworks/<subnetwork-name>`,
+	}}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			log := testr.New(t)
-			spec, err := parseSpec(log, tt.jsonSpec)
+			spec, err := parseSpec(log, tt.jsonSpec, tt.defaults, nil)
 			if tt.expectedErr != "" {
 				require.EqualError(t, err, tt.expectedErr)
 				return
@@ -69,6 +136,61 @@ func TestParseSpec(t *testing.T) {
 	}
 }
 
+func TestDefaultConnectionLimitKeepsTheDefaults(t *testing.T) {
+	defaults := &SpecDefaults{
+		ConsumerAcceptList: []*Consumer{{ProjectIdOrNum: stringPtr("project1")}},
+		NatSubnetFQNs:      []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
+	}
+	_, err := parseSpec(testr.New(t), `{"default_connection_limit": 5}`, defaults, nil)
+	require.NoError(t, err)
+	// They're shared by every spec.
+	require.Zero(t, defaults.ConsumerAcceptList[0].ConnectionLimit)
+}
+
+func TestSpecDefaultsWithGlobalAccess(t *testing.T) {
+	tests := []struct {
+		name         string
+		defaults     *SpecDefaults
+		globalAccess bool
+		expected     *SpecDefaults
+	}{{
+		name:         "Enables global access without defaults",
+		globalAccess: true,
+		expected:     &SpecDefaults{GlobalAccess: ptr.To(true)},
+	}, {
+		name:         "Enables global access if the defaults don't set it",
+		defaults:     &SpecDefaults{NatSubnetFQNs: []string{"my-subnet"}},
+		globalAccess: true,
+		expected:     &SpecDefaults{NatSubnetFQNs: []string{"my-subnet"}, GlobalAccess: ptr.To(true)},
+	}, {
+		name:         "Keeps the defaults' global access",
+		defaults:     &SpecDefaults{GlobalAccess: ptr.To(false)},
+		globalAccess: true,
+		expected:     &SpecDefaults{GlobalAccess: ptr.To(false)},
+	}, {
+		name:     "Keeps the defaults if disabled",
+		defaults: &SpecDefaults{NatSubnetFQNs: []string{"my-subnet"}},
+		expected: &SpecDefaults{NatSubnetFQNs: []string{"my-subnet"}},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, tt.defaults.WithGlobalAccess(tt.globalAccess))
+		})
+	}
+}
+
+func TestParseSpecDefaults(t *testing.T) {
+	d, err := ParseSpecDefaults([]byte("null"))
+	require.NoError(t, err)
+	require.Nil(t, d)
+	d, err = ParseSpecDefaults([]byte(`{"labels": {"team": "platform"}}`))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"team": "platform"}, d.Labels)
+	_, err = ParseSpecDefaults([]byte(`{"label": {}}`))
+	require.ErrorContains(t, err, `invalid spec defaults: json: unknown field "label"`)
+}
+
 func TestValidateSpec(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -79,70 +201,146 @@ func TestValidateSpec(t *testing.T) {
 		expectedErr: "spec is nil",
 	}, {
 		name: "Returns no errors for a spec with only NetworkFQN",
-		spec: &Spec{
+		spec: &Spec{Spec: api.Spec{
 			NatSubnetFQNs: []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
 			ConsumerAcceptList: []*Consumer{{
 				NetworkFQN:      stringPtr("projects/my-project-123/global/networks/my-vpc"),
 				ConnectionLimit: 10,
 			}},
-		},
+		}},
 	}, {
 		name: "Returns no errors for a spec with only ProjectIdOrNum",
-		spec: &Spec{
+		spec: &Spec{Spec: api.Spec{
 			NatSubnetFQNs:      []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
 			ConsumerAcceptList: []*Consumer{{ProjectIdOrNum: stringPtr("project1"), ConnectionLimit: 10}},
-		},
+		}},
 	}, {
 		name: "Fails if NetworkFQN is invalid",
-		spec: &Spec{
+		spec: &Spec{Spec: api.Spec{
 			NatSubnetFQNs:      []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
 			ConsumerAcceptList: []*Consumer{{NetworkFQN: stringPtr("net")}},
-		},
+		}},
 		expectedErr: "invalid value for network_fqn (\"net\") in consumer_list[0], expected format: projects/<project-id>/global/networks/<network-name>",
 	}, {
 		name: "Fails if both NetworkFQN and ProjectIdOrNum are set",
-		spec: &Spec{
+		spec: &Spec{Spec: api.Spec{
 			NatSubnetFQNs: []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
 			ConsumerAcceptList: []*Consumer{{
 				NetworkFQN:      stringPtr("projects/my-project-123/global/networks/my-vpc"),
 				ProjectIdOrNum:  stringPtr("project1"),
 				ConnectionLimit: 10,
 			}},
-		},
+		}},
 		expectedErr: "network_fqn and project_id_or_num can't both be set in consumer_list[0]",
 	}, {
 		name: "Fails if neither NetworkFQN nor ProjectIdOrNum are set",
-		spec: &Spec{
+		spec: &Spec{Spec: api.Spec{
 			NatSubnetFQNs:      []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
 			ConsumerAcceptList: []*Consumer{{ConnectionLimit: 10}},
-		},
+		}},
 		expectedErr: "either network_fqn or project_id_or_num must be set in consumer_list[0]",
 	}, {
 		name: "It's OK if ConnectionLimit is not set",
-		spec: &Spec{
+		spec: &Spec{Spec: api.Spec{
 			NatSubnetFQNs:      []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
 			ConsumerAcceptList: []*Consumer{{ProjectIdOrNum: stringPtr("my-project")}},
-		},
+		}},
 	}, {
 		name:        "Fails if a NatSubnetFQNs is empty",
 		spec:        &Spec{},
 		expectedErr: "nat_subnet_fqns is empty",
 	}, {
 		name: "Fails if a NatSubnetFQN is invalid",
-		spec: &Spec{
+		spec: &Spec{Spec: api.Spec{
 			NatSubnetFQNs: []string{"subnet", "projects/my-project-123/regions/us-east1//my-subnet"},
-		},
+		}},
 		expectedErr: "invalid value for nat_subnet_fqns[0] (\"subnet\"), expected format: projects/<project-id>/regions/<region-name>/subnetworks/<subnetwork-name>; invalid value for nat_subnet_fqns[1] (\"projects/my-project-123/regions/us-east1//my-subnet\"), expected format: projects/<project-id>/regions/<region-name>/subnetworks/<subnetwork-name>",
+	}, {
+		name: "Fails if a draining NAT subnet is invalid or still in use",
+		spec: &Spec{Spec: api.Spec{
+			NatSubnetFQNs:         []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
+			DrainingNatSubnetFQNs: []string{"subnet", "projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
+		}},
+		expectedErr: "invalid value for draining_nat_subnet_fqns[0] (\"subnet\"), expected format: projects/<project-id>/regions/<region-name>/subnetworks/<subnetwork-name>; draining_nat_subnet_fqns[1] (\"projects/my-project-123/regions/us-east1/subnetworks/my-subnet\") is also in nat_subnet_fqns",
+	}, {
+		name: "Fails if the migration is invalid",
+		spec: &Spec{Spec: api.Spec{
+			NatSubnetFQNs: []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
+			Migration:     &Migration{SubnetFQN: "subnet"},
+		}},
+		expectedErr: "invalid value for migration.subnet_fqn (\"subnet\"), expected format: projects/<project-id>/regions/<region-name>/subnetworks/<subnetwork-name>; migration.nat_subnet_fqns is empty",
+	}, {
+		name: "Fails if the network is invalid or has no subnet",
+		spec: &Spec{Spec: api.Spec{
+			NatSubnetFQNs: []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
+			Network:       "vpc",
+		}},
+		expectedErr: "invalid value for network (\"vpc\"), expected format: projects/<project-id>/global/networks/<network-name>; subnetwork must be set if network is set",
+	}, {
+		name: "Fails if the subnet is invalid",
+		spec: &Spec{Spec: api.Spec{
+			NatSubnetFQNs: []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
+			Network:       "projects/my-project-123/global/networks/my-vpc",
+			Subnetwork:    "subnet",
+		}},
+		expectedErr: "invalid value for subnetwork (\"subnet\"), expected format: projects/<project-id>/regions/<region-name>/subnetworks/<subnetwork-name>",
+	}, {
+		name: "Fails if the NEG subnet or default port is invalid",
+		spec: &Spec{Spec: api.Spec{
+			NatSubnetFQNs:  []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
+			NEGSubnetFQN:   "subnet",
+			NEGDefaultPort: ptr.To(int32(0)),
+		}},
+		expectedErr: "invalid value for neg_subnetwork (\"subnet\"), expected format: projects/<project-id>/regions/<region-name>/subnetworks/<subnetwork-name>; neg_default_port (0) must be between 1 and 65535",
+	}, {
+		name: "Fails if the scale to zero policy is invalid",
+		spec: &Spec{Spec: api.Spec{
+			NatSubnetFQNs: []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
+			ScaleToZero:   "delete",
+		}},
+		expectedErr: `invalid scale_to_zero "delete", it must be "keep" or "teardown"`,
+	}, {
+		name: "Fails if the firewall's deletion policy, sources or destinations are invalid",
+		spec: &Spec{Spec: api.Spec{
+			NatSubnetFQNs:     []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
+			FirewallOnDelete:  "keep",
+			SourceRanges:      []string{"10.0.0.0/8", "10.0.0.1"},
+			SourceTags:        []string{"Bastion"},
+			DestinationRanges: []string{"everything"},
+		}},
+		expectedErr: `invalid firewall_on_delete "keep", it must be "delete" or "disable"; invalid source_ranges[1]: netip.ParsePrefix("10.0.0.1"): no '/'; invalid destination_ranges[0]: netip.ParsePrefix("everything"): no '/'; invalid source_tags[0] "Bastion", it must be a network tag, e.g. my-tag`,
+	}, {
+		name: "Fails if the ports' firewall overrides are invalid",
+		spec: &Spec{Spec: api.Spec{
+			NatSubnetFQNs:    []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
+			Prefix:           "p-",
+			FirewallPerPort:  true,
+			FirewallPriority: ptr.To(int32(70000)),
+			NodePorts: map[string]PortConfig{
+				"Admin": {NodePort: 30000, StartingPort: 10000, ContainerPort: 9000},
+				"app":   {NodePort: 30001, StartingPort: 11000, ContainerPort: 9001, SourceRanges: []string{"10.0.0.1"}, FirewallPriority: ptr.To(int32(-1))},
+			},
+		}},
+		expectedErr: `firewall_priority (70000) must be between 0 and 65535; node_ports[Admin]'s firewall name "p-psc-portmapper-Admin-firewall" is invalid, the port name must be lowercase and short enough for it to be a valid GCP resource name; invalid node_ports[app].source_ranges[0]: netip.ParsePrefix("10.0.0.1"): no '/'; node_ports[app].firewall_priority (-1) must be between 0 and 65535`,
+	}, {
+		name: "Fails if the ports override the firewall without a rule per port",
+		spec: &Spec{Spec: api.Spec{
+			NatSubnetFQNs: []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
+			NodePorts: map[string]PortConfig{
+				"app": {NodePort: 30001, StartingPort: 11000, ContainerPort: 9001, SourceTags: []string{"bastion"}},
+			},
+		}},
+		expectedErr: "node_ports[app] can only set source_ranges, source_tags or firewall_priority if firewall_per_port is set",
 	}, {
 		name: "Accumulates errors",
-		spec: &Spec{
+		spec: &Spec{Spec: api.Spec{
 			NatSubnetFQNs: []string{"projects/my-project-123/regions/us-east1/subnetworks/my-subnet"},
 			ConsumerAcceptList: []*Consumer{
 				{ProjectIdOrNum: stringPtr("my-project"), NetworkFQN: stringPtr("projects/my-project-123/global/networks/my-vpc")},
 				{ConnectionLimit: 0},
 				{NetworkFQN: stringPtr("net")},
 			},
-		},
+		}},
 		expectedErr: "network_fqn and project_id_or_num can't both be set in consumer_list[0]; either network_fqn or project_id_or_num must be set in consumer_list[1]; invalid value for network_fqn (\"net\") in consumer_list[2], expected format: projects/<project-id>/global/networks/<network-name>",
 	}}
 
@@ -0,0 +1,223 @@
+package controller
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// stateKey is the key of the state in its ConfigMap.
+const stateKey = "state.json"
+
+// State is the part of a StatefulSet's state that grows with its port mappings, along with the
+// progress of failed attempts, which is kept out of its status annotation if
+// Settings.ExternalState is set, since annotations are limited to 256 KiB.
+type State struct {
+	StatefulSet string `json:"stateful_set"`
+	// The hash of the desired state the mappings were reconciled with.
+	DesiredStateHash string `json:"desired_state_hash"`
+	// The port mappings attached to the NEG, sorted by port, as of the last successful
+	// reconcile.
+	Mappings []*gcp.PortMapping `json:"mappings"`
+	// The last connectivity probe, with the result of each port.
+	Probe *ProbeStatus `json:"probe,omitempty"`
+	// What the last attempt to reconcile the resources got done, if it failed.
+	Progress *Progress `json:"progress,omitempty"`
+}
+
+// StateRef is where a StatefulSet's state was written, in its status.
+type StateRef struct {
+	// A gs:// URL, or the <namespace>/<name> of a ConfigMap.
+	Location string `json:"location"`
+	// The hash of the state, so that it's only written again once it changes.
+	Hash string `json:"hash"`
+}
+
+// WithStateStore writes the StatefulSets' state to the store, instead of to a ConfigMap next to
+// each of them, if Settings.ExternalState is set.
+func WithStateStore(s gcp.ObjectStore) Option {
+	return func(r *PortmapReconciler) {
+		r.stateStore = s
+	}
+}
+
+func stateConfigMapName(prefix string) string {
+	return nameBase(prefix) + "-state"
+}
+
+// stateLocation returns where the STS' state is written.
+func (r *PortmapReconciler) stateLocation(spec *Spec, sts *appsv1.StatefulSet) string {
+	name := types.NamespacedName{Namespace: sts.Namespace, Name: sts.Name}
+	if r.stateStore != nil {
+		return r.stateStore.Location(name.String())
+	}
+	return types.NamespacedName{Namespace: sts.Namespace, Name: stateConfigMapName(spec.Prefix)}.String()
+}
+
+// writeState writes the state reconciling the STS left to the state store if external state is
+// enabled, and returns the reference to record in its status. state's mappings and probe are
+// those of a successful reconcile. After a failed one, i.e. if state has progress, the previous
+// state's are kept instead. If external state isn't enabled, it deletes the state written while
+// it was, and returns a nil reference.
+func (r *PortmapReconciler) writeState(ctx context.Context, log logr.Logger, spec *Spec, sts *appsv1.StatefulSet, state *State) (*StateRef, error) {
+	prev := parseStatus(sts).State
+	if !r.currentSettings().ExternalState {
+		if prev != nil {
+			err := r.deleteState(ctx, log, spec, sts)
+			if err != nil {
+				return prev, err
+			}
+		}
+		return nil, nil
+	}
+	state.StatefulSet = types.NamespacedName{Namespace: sts.Namespace, Name: sts.Name}.String()
+	if state.Progress != nil {
+		last, err := r.readState(ctx, sts)
+		if err != nil {
+			log.Error(err, "Failed to read the state.", "location", prev.Location)
+			return prev, err
+		}
+		state.DesiredStateHash, state.Mappings, state.Probe = "", nil, nil
+		if last != nil {
+			state.DesiredStateHash, state.Mappings, state.Probe = last.DesiredStateHash, last.Mappings, last.Probe
+		}
+	} else {
+		state.Mappings = slices.Clone(state.Mappings)
+		slices.SortFunc(state.Mappings, func(a, b *gcp.PortMapping) int { return cmp.Compare(a.Port, b.Port) })
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return prev, err
+	}
+	sum := sha256.Sum256(data)
+	ref := &StateRef{Location: r.stateLocation(spec, sts), Hash: hex.EncodeToString(sum[:])}
+	if prev != nil && *prev == *ref {
+		return ref, nil
+	}
+	if r.stateStore != nil {
+		err = r.stateStore.WriteObject(ctx, state.StatefulSet, data)
+	} else {
+		err = r.writeStateConfigMap(ctx, spec, sts, data)
+	}
+	if err != nil {
+		log.Error(err, "Failed to write the state.", "location", ref.Location)
+		return prev, err
+	}
+	return ref, nil
+}
+
+// lastProgress returns what the last attempt to reconcile the STS got done if it failed, from
+// its status or, if external state is enabled, its state. The state is only read after failed
+// attempts, which leave the status without a desired state hash.
+func (r *PortmapReconciler) lastProgress(ctx context.Context, log logr.Logger, sts *appsv1.StatefulSet) *Progress {
+	status := parseStatus(sts)
+	if status.Progress != nil || status.State == nil || status.DesiredStateHash != "" {
+		return status.Progress
+	}
+	state, err := r.readState(ctx, sts)
+	if err != nil {
+		// The resources are all reconciled again then.
+		log.Error(err, "Failed to read the progress from the state.", "location", status.State.Location)
+		return nil
+	}
+	if state == nil {
+		return nil
+	}
+	return state.Progress
+}
+
+// writeStateConfigMap writes the state to the <prefix>psc-portmapper-state ConfigMap in the
+// StatefulSet's namespace, creating it if it doesn't exist.
+func (r *PortmapReconciler) writeStateConfigMap(ctx context.Context, spec *Spec, sts *appsv1.StatefulSet, data []byte) error {
+	name := types.NamespacedName{Namespace: sts.Namespace, Name: stateConfigMapName(spec.Prefix)}
+	cm := &corev1.ConfigMap{}
+	err := r.reader.Get(ctx, name, cm)
+	if apierrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: name.Namespace, Name: name.Name, Labels: nodePortLabels(spec.Labels)},
+			Data:       map[string]string{stateKey: string(data)},
+		}
+		return r.Create(ctx, cm)
+	}
+	if err != nil {
+		return err
+	}
+	if !isManaged(cm) {
+		return fmt.Errorf("ConfigMap %s %w, as it's missing the %s=%s label", name, errNotOwned, managedByLabel, portmapperApp)
+	}
+	cm.Data = map[string]string{stateKey: string(data)}
+	return r.Update(ctx, cm)
+}
+
+// deleteState deletes the STS' state from the store, or its state ConfigMap if the controller
+// created it.
+func (r *PortmapReconciler) deleteState(ctx context.Context, log logr.Logger, spec *Spec, sts *appsv1.StatefulSet) error {
+	location := r.stateLocation(spec, sts)
+	var err error
+	if r.stateStore != nil {
+		err = r.stateStore.DeleteObject(ctx, types.NamespacedName{Namespace: sts.Namespace, Name: sts.Name}.String())
+	} else {
+		err = r.deleteStateConfigMap(ctx, types.NamespacedName{Namespace: sts.Namespace, Name: stateConfigMapName(spec.Prefix)})
+	}
+	if err != nil {
+		log.Error(err, "Failed to delete the state.", "location", location)
+	}
+	return err
+}
+
+func (r *PortmapReconciler) deleteStateConfigMap(ctx context.Context, name types.NamespacedName) error {
+	cm := &corev1.ConfigMap{}
+	err := r.reader.Get(ctx, name, cm)
+	if apierrors.IsNotFound(err) || (err == nil && !isManaged(cm)) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return client.IgnoreNotFound(r.Delete(ctx, cm))
+}
+
+// readState returns the state the STS' status references, or nil if it doesn't reference any.
+func (r *PortmapReconciler) readState(ctx context.Context, sts *appsv1.StatefulSet) (*State, error) {
+	ref := parseStatus(sts).State
+	if ref == nil {
+		return nil, nil
+	}
+	var data []byte
+	if r.stateStore != nil {
+		var err error
+		data, err = r.stateStore.ReadObject(ctx, types.NamespacedName{Namespace: sts.Namespace, Name: sts.Name}.String())
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// The state of a failed first reconcile is referenced before there's an applied spec.
+		namespace, name, _ := strings.Cut(ref.Location, "/")
+		cm := &corev1.ConfigMap{}
+		err := r.reader.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, cm)
+		if err != nil {
+			return nil, err
+		}
+		data = []byte(cm.Data[stateKey])
+	}
+	state := &State{}
+	err := json.Unmarshal(data, state)
+	if err != nil {
+		return nil, fmt.Errorf("invalid state at %s: %w", ref.Location, err)
+	}
+	return state, nil
+}
@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestExternalState(t *testing.T) {
+	tests := []struct {
+		name     string
+		store    objectStore
+		location string
+	}{{
+		name:     "ConfigMap",
+		location: "default/prefix-psc-portmapper-state",
+	}, {
+		name:     "Store",
+		store:    objectStore{},
+		location: "memory://default/sts",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := initialState()
+			c := fake.NewClientBuilder().
+				WithLists(s.nodes, s.pods).
+				WithObjects(s.sts).
+				Build()
+			settings := DefaultSettings()
+			settings.DriftCheckInterval = 0
+			settings.ProbeTimeout = time.Second
+			settings.ExternalState = true
+			opts := []Option{WithSettings(settings)}
+			if tt.store != nil {
+				opts = append(opts, WithStateStore(tt.store))
+			}
+			r := New(c, gcpfake.New(s.project, s.region), opts...)
+			r.dial = func(context.Context, string, string) (net.Conn, error) {
+				client, server := net.Pipe()
+				_ = server.Close()
+				return client, nil
+			}
+			req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+			cmName := types.NamespacedName{Namespace: s.sts.Namespace, Name: "prefix-psc-portmapper-state"}
+			stored := func() bool {
+				if tt.store != nil {
+					_, ok := tt.store[req.String()]
+					return ok
+				}
+				err := c.Get(ctx, cmName, &corev1.ConfigMap{})
+				if apierrors.IsNotFound(err) {
+					return false
+				}
+				require.NoError(t, err)
+				return true
+			}
+
+			// The per-port results are only in the state.
+			_, err := r.Reconcile(ctx, req)
+			require.NoError(t, err)
+			sts := &appsv1.StatefulSet{}
+			require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+			status := parseStatus(sts)
+			require.NotNil(t, status.State)
+			require.Equal(t, tt.location, status.State.Location)
+			require.NotNil(t, status.Probe)
+			require.Nil(t, status.Probe.Results)
+			state, err := r.readState(ctx, sts)
+			require.NoError(t, err)
+			require.Equal(t, req.String(), state.StatefulSet)
+			require.Equal(t, status.DesiredStateHash, state.DesiredStateHash)
+			require.Equal(t, []*gcp.PortMapping{
+				{Port: 30000, Instance: "projects/my-project/zones/us-east1-a/instances/node-0", InstancePort: 30000},
+				{Port: 30001, Instance: "projects/my-project/zones/us-east1-a/instances/node-1", InstancePort: 30000},
+				{Port: 30002, Instance: "projects/my-project/zones/us-east1-a/instances/node-2", InstancePort: 30000},
+			}, state.Mappings)
+			require.Len(t, state.Probe.Results, 3)
+
+			// Disabling it moves them back to the status.
+			settings.ExternalState = false
+			r.SetSettings(settings)
+			_, err = r.Reconcile(ctx, req)
+			require.NoError(t, err)
+			require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+			status = parseStatus(sts)
+			require.Nil(t, status.State)
+			require.Len(t, status.Probe.Results, 3)
+			require.False(t, stored())
+
+			// It's deleted along with the STS.
+			settings.ExternalState = true
+			r.SetSettings(settings)
+			_, err = r.Reconcile(ctx, req)
+			require.NoError(t, err)
+			require.True(t, stored())
+			require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+			require.NoError(t, c.Delete(ctx, sts))
+			_, err = r.Reconcile(ctx, req)
+			require.NoError(t, err)
+			require.False(t, stored())
+		})
+	}
+}
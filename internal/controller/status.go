@@ -0,0 +1,391 @@
+package controller
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/0x5d/psc-portmapper/internal/version"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	statusAnnotation = "psc-portmapper.0x5d.org/status"
+
+	readyCondition = "Ready"
+
+	// reasonInvalidSpec is the reason of the Ready condition of a StatefulSet whose spec is
+	// invalid, and of the event of a parked one. See InvalidSpecPark.
+	reasonInvalidSpec = "InvalidSpec"
+)
+
+// Status is the state of a spec's resources, which is written to an annotation on the
+// StatefulSet.
+type Status struct {
+	ObservedGeneration int64              `json:"observed_generation,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+	// The hash of the desired state the resources were last reconciled successfully with.
+	DesiredStateHash string `json:"desired_state_hash,omitempty"`
+	// When the resources were last checked for drift, i.e. the last time they were reconciled
+	// successfully against the GCP API.
+	LastDriftCheck *metav1.Time `json:"last_drift_check,omitempty"`
+	// The version of the controller that last reconciled the resources.
+	ControllerVersion string `json:"controller_version,omitempty"`
+	// What the last attempt to reconcile the resources got done, if it failed, unless it's in
+	// the state.
+	Progress *Progress `json:"progress,omitempty"`
+	// The FQNs of the service attachments consumers can connect to, as of the last successful
+	// reconcile. There are two during migrations.
+	ServiceAttachments []string `json:"service_attachments,omitempty"`
+	// The IPs of the forwarding rules, by name, as soon as they exist, i.e. possibly before the
+	// service attachments using them are ready. See fwdRuleIPs.
+	ForwardingRuleIPs map[string]string `json:"forwarding_rule_ips,omitempty"`
+	// The port mappings on each side of the STS' rolling update partition, if it sets one.
+	Partition *PartitionStatus `json:"partition,omitempty"`
+	// The spec's scale_to_zero policy, if the STS is scaled to zero.
+	ScaledToZero ScaleToZeroPolicy `json:"scaled_to_zero,omitempty"`
+	// The result of the last connectivity probe of the mapped ports, as of the last successful
+	// reconcile, if probing is enabled.
+	Probe *ProbeStatus `json:"probe,omitempty"`
+	// Where the port mappings and probe results of the last successful reconcile, and the
+	// progress of the last attempt if it failed, were written, if Settings.ExternalState is set.
+	// See state.go.
+	State *StateRef `json:"state,omitempty"`
+	// Whether the STS was reconciled by a controller that didn't mark the resources it created,
+	// whose unmarked resources are then trusted. See ownershipFor.
+	LegacyResources bool `json:"legacy_resources,omitempty"`
+}
+
+// parseStatus returns the status in the STS' annotation, or an empty status if it's missing
+// or can't be decoded, as it'll be overwritten anyway.
+func parseStatus(sts *appsv1.StatefulSet) *Status {
+	status := &Status{}
+	jsonStatus, ok := sts.Annotations[statusAnnotation]
+	if !ok {
+		return status
+	}
+	err := json.Unmarshal([]byte(jsonStatus), status)
+	if err != nil {
+		return &Status{}
+	}
+	return status
+}
+
+// initialStatus sets the STS' status annotation to the running controller's version if it
+// doesn't have one, when the finalizer is added, so that it's not mistaken for a StatefulSet
+// reconciled by a controller predating the status if its first reconcile fails. See
+// legacyStatefulSet.
+func initialStatus(sts *appsv1.StatefulSet) error {
+	if _, ok := sts.Annotations[statusAnnotation]; ok {
+		return nil
+	}
+	jsonStatus, err := json.Marshal(&Status{ControllerVersion: version.Get().Version})
+	if err != nil {
+		return err
+	}
+	if sts.Annotations == nil {
+		sts.Annotations = map[string]string{}
+	}
+	sts.Annotations[statusAnnotation] = string(jsonStatus)
+	return nil
+}
+
+// aggregateConditions returns the sub-reconcilers' conditions, followed by the Ready
+// condition, which is only true if all of them are. Its reason is the first condition's that
+// isn't true, or reasonDrift if all of them are but one was reverted.
+func aggregateConditions(subs []subReconciler) []metav1.Condition {
+	conds := make([]metav1.Condition, 0, len(subs)+1)
+	ready := metav1.Condition{Type: readyCondition, Status: metav1.ConditionTrue, Reason: reasonReconciled}
+	for _, s := range subs {
+		c := s.Status()
+		conds = append(conds, c)
+		if c.Status != metav1.ConditionTrue && ready.Status == metav1.ConditionTrue {
+			ready.Status = c.Status
+			ready.Reason = c.Reason
+			ready.Message = fmt.Sprintf("%s isn't ready: %s", s.Name(), c.Message)
+		}
+		if c.Status == metav1.ConditionTrue && c.Reason == reasonDrift && ready.Reason == reasonReconciled {
+			ready.Reason = reasonDrift
+			ready.Message = fmt.Sprintf("%s was modified out of band and reverted", s.Name())
+		}
+	}
+	return append(conds, ready)
+}
+
+// desiredStateHash hashes everything the GCP resources are derived from, so that reconciles
+// where none of it changed can be skipped. That includes the IDs of the instances the endpoints
+// point to, so that they're attached again once an instance is recreated under the same name,
+// since GCP detaches the endpoints of deleted instances.
+func desiredStateHash(spec *Spec, sts *appsv1.StatefulSet, mappings []*gcp.PortMapping, instanceIDs map[string]string) (string, error) {
+	sorted := slices.Clone(mappings)
+	slices.SortFunc(sorted, func(a, b *gcp.PortMapping) int { return cmp.Compare(a.Port, b.Port) })
+	data, err := json.Marshal(struct {
+		Spec         *Spec
+		Replicas     *int32
+		Mappings     []*gcp.PortMapping
+		MigrationAck string
+		// Only set if there's a partition, so that the other hashes don't change.
+		Partition *int32 `json:",omitempty"`
+		// Only set if the nodes report them, for the same reason.
+		InstanceIDs map[string]string `json:",omitempty"`
+	}{spec, sts.Spec.Replicas, sorted, sts.Annotations[migrationAckAnnotation], stsPartition(sts), instanceIDs})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// isUpToDate returns true if the resources were reconciled successfully with the desired
+// state hashed to hash since the controller started, and checked for drift recently enough
+// that they can be assumed to still match it. It also checks appliedStates, since the cache
+// can lag behind the controller's own status writes.
+func (r *PortmapReconciler) isUpToDate(sts *appsv1.StatefulSet, hash string) bool {
+	interval := r.currentSettings().DriftCheckInterval
+	if interval <= 0 {
+		return false
+	}
+	if r.appliedStates.recent(types.NamespacedName{Namespace: sts.Namespace, Name: sts.Name}, hash, sts.Generation, interval) {
+		return true
+	}
+	status := parseStatus(sts)
+	return status.DesiredStateHash == hash &&
+		status.ObservedGeneration == sts.Generation &&
+		status.LastDriftCheck != nil &&
+		time.Since(status.LastDriftCheck.Time) < interval &&
+		!status.LastDriftCheck.Time.Before(r.startedAt) &&
+		meta.IsStatusConditionTrue(status.Conditions, readyCondition)
+}
+
+// statusUpdate is what a reconcile reports in the STS' status. See updateStatus.
+type statusUpdate struct {
+	conds []metav1.Condition
+	// The desired state the resources were reconciled with, or empty if reconciling them
+	// failed.
+	hash string
+	// The spec the resources were reconciled with, or nil if reconciling them failed. It's
+	// stored in the last applied spec annotation.
+	applied *Spec
+	// What a failed attempt got done, and nil otherwise.
+	progress *Progress
+	// The FQNs of the applied spec's service attachments.
+	svcAtts []string
+	// The IPs of the applied spec's forwarding rules, or nil to keep the status'.
+	fwdRuleIPs map[string]string
+	// The mappings on each side of the STS' partition, if it sets one.
+	partition    *PartitionStatus
+	scaledToZero ScaleToZeroPolicy
+	// The result of probing the applied spec's ports, if they were.
+	probe *ProbeStatus
+	// Where the rest of the state was written, if it was.
+	state *StateRef
+}
+
+// updateStatus sets u's conditions in the STS' status annotation, and the rest of u if the
+// spec was applied. The STS is only patched if either annotation changed, so that writing them
+// doesn't trigger reconciles endlessly. Writes that only refresh the status are coalesced, see
+// statusDigest.
+func (r *PortmapReconciler) updateStatus(ctx context.Context, log logr.Logger, sts *appsv1.StatefulSet, u statusUpdate) error {
+	status := parseStatus(sts)
+	status.ObservedGeneration = sts.Generation
+	status.DesiredStateHash = u.hash
+	status.Progress = u.progress
+	status.State = u.state
+	status.Partition = u.partition
+	status.ScaledToZero = u.scaledToZero
+	if u.hash != "" {
+		status.LastDriftCheck = &metav1.Time{Time: time.Now()}
+	}
+	status.ControllerVersion = version.Get().Version
+	// Remembered once the status is written, which would make the STS look new otherwise.
+	if legacyStatefulSet(sts) {
+		status.LegacyResources = true
+	}
+	if u.fwdRuleIPs != nil {
+		status.ForwardingRuleIPs = u.fwdRuleIPs
+	}
+	for _, c := range u.conds {
+		c.ObservedGeneration = sts.Generation
+		// Keeps the last transition time if the condition's status didn't change.
+		meta.SetStatusCondition(&status.Conditions, c)
+	}
+	if u.applied != nil {
+		status.ServiceAttachments = u.svcAtts
+		status.Probe = u.probe
+		// A successful reconcile reports every resource, so the conditions of the ones that
+		// aren't managed anymore, e.g. after a migration, are dropped.
+		status.Conditions = slices.DeleteFunc(status.Conditions, func(c metav1.Condition) bool {
+			return !slices.ContainsFunc(u.conds, func(cond metav1.Condition) bool { return cond.Type == c.Type })
+		})
+	}
+	jsonStatus, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	annotations := map[string]string{statusAnnotation: string(jsonStatus)}
+	if u.applied != nil {
+		jsonSpec, err := json.Marshal(u.applied)
+		if err != nil {
+			return err
+		}
+		annotations[lastAppliedAnnotation] = string(jsonSpec)
+	}
+	changed := false
+	for k, v := range annotations {
+		changed = changed || sts.Annotations[k] != v
+	}
+	if !changed {
+		return nil
+	}
+	name := types.NamespacedName{Namespace: sts.Namespace, Name: sts.Name}
+	if interval := r.currentSettings().StatusWriteInterval; interval > 0 && !r.statusWrites.due(name, interval) {
+		appliedChanged := u.applied != nil && sts.Annotations[lastAppliedAnnotation] != annotations[lastAppliedAnnotation]
+		if !appliedChanged && statusDigest(parseStatus(sts)) == statusDigest(status) {
+			log.V(1).Info("Coalescing a status update that only refreshes it.", "interval", interval)
+			return nil
+		}
+	}
+	patch := client.MergeFrom(sts.DeepCopy())
+	maps.Copy(sts.Annotations, annotations)
+	err = r.Patch(ctx, sts, patch)
+	if err != nil {
+		log.Error(err, "Failed to update the status annotation.", "namespace", sts.Namespace, "name", sts.Name)
+		return err
+	}
+	r.statusWrites.record(name)
+	return nil
+}
+
+// statusDigest returns the parts of the status whose changes are written right away. The rest,
+// i.e. the last drift check, the probe results, the progress of failed attempts and the
+// conditions' messages and transition times, change on every drift check or retry without the
+// resources changing, so their writes are coalesced, see Settings.StatusWriteInterval.
+func statusDigest(status *Status) string {
+	digest := *status
+	digest.LastDriftCheck = nil
+	digest.Probe = nil
+	// The state's hash changes with the probe results.
+	if status.State != nil {
+		digest.State = &StateRef{Location: status.State.Location}
+	}
+	digest.Progress = nil
+	digest.Conditions = make([]metav1.Condition, 0, len(status.Conditions))
+	for _, c := range status.Conditions {
+		digest.Conditions = append(digest.Conditions, metav1.Condition{Type: c.Type, Status: c.Status, Reason: c.Reason})
+	}
+	// It can't fail, since the status was just decoded or is about to be encoded.
+	data, _ := json.Marshal(digest)
+	return string(data)
+}
+
+// statusWrites tracks when each StatefulSet's status was last written by the controller, to
+// coalesce the writes that only refresh it. See Settings.StatusWriteInterval.
+type statusWrites struct {
+	mu     sync.Mutex
+	byName map[types.NamespacedName]time.Time
+}
+
+func (w *statusWrites) record(name types.NamespacedName) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.byName == nil {
+		w.byName = map[types.NamespacedName]time.Time{}
+	}
+	w.byName[name] = time.Now()
+}
+
+// due returns true if the StatefulSet's status wasn't written in the last interval.
+func (w *statusWrites) due(name types.NamespacedName, interval time.Duration) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	last, ok := w.byName[name]
+	return !ok || time.Since(last) >= interval
+}
+
+// appliedStates tracks the desired state each StatefulSet was last reconciled successfully
+// with, and when, so that a reconcile of the same state right after isn't repeated. A failed
+// reconcile forgets it.
+type appliedStates struct {
+	mu     sync.Mutex
+	byName map[types.NamespacedName]appliedState
+}
+
+type appliedState struct {
+	hash       string
+	generation int64
+	at         time.Time
+}
+
+func (a *appliedStates) record(name types.NamespacedName, hash string, generation int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.byName == nil {
+		a.byName = map[types.NamespacedName]appliedState{}
+	}
+	a.byName[name] = appliedState{hash: hash, generation: generation, at: time.Now()}
+}
+
+func (a *appliedStates) forget(name types.NamespacedName) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.byName, name)
+}
+
+// recent returns true if the StatefulSet's generation was reconciled successfully with the
+// desired state hashed to hash in the last interval.
+func (a *appliedStates) recent(name types.NamespacedName, hash string, generation int64, interval time.Duration) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.byName[name]
+	return ok && s.hash == hash && s.generation == generation && time.Since(s.at) < interval
+}
+
+// parkInvalidSpec reports why the STS' spec is invalid with a Warning event and its Ready
+// condition, without retrying. The STS is reconciled again when it changes. Reconciles in
+// between, e.g. on node changes, don't report it again.
+func (r *PortmapReconciler) parkInvalidSpec(ctx context.Context, log logr.Logger, sts *appsv1.StatefulSet, specErr error) error {
+	cond := invalidSpecCondition(specErr)
+	current := meta.FindStatusCondition(parseStatus(sts).Conditions, readyCondition)
+	if current != nil && current.Reason == cond.Reason && current.Message == cond.Message {
+		log.V(1).Info("The spec is still invalid. Not retrying until it changes.")
+		return nil
+	}
+	log.Error(specErr, "The spec is invalid. Not retrying until it changes.")
+	r.event(sts, corev1.EventTypeWarning, reasonInvalidSpec, "Invalid spec, not retrying until it changes: %v", specErr)
+	return r.updateStatus(ctx, log, sts, statusUpdate{conds: []metav1.Condition{cond}})
+}
+
+// reportInvalidSpec reports why the STS' spec is invalid with the Ready condition of its
+// status, so that it reflects the STS' current generation while it's retried, e.g. for GitOps
+// tools computing its health. Unlike parkInvalidSpec, it doesn't emit an event, since it's
+// reported on every retry.
+func (r *PortmapReconciler) reportInvalidSpec(ctx context.Context, log logr.Logger, sts *appsv1.StatefulSet, specErr error) {
+	err := r.updateStatus(ctx, log, sts, statusUpdate{conds: []metav1.Condition{invalidSpecCondition(specErr)}})
+	if err != nil {
+		log.Error(err, "Failed to report the invalid spec in the status.")
+	}
+}
+
+// invalidSpecCondition is the Ready condition of a StatefulSet whose spec is invalid.
+func invalidSpecCondition(specErr error) metav1.Condition {
+	return metav1.Condition{
+		Type:    readyCondition,
+		Status:  metav1.ConditionFalse,
+		Reason:  reasonInvalidSpec,
+		Message: specErr.Error(),
+	}
+}
@@ -0,0 +1,374 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestAggregateConditions(t *testing.T) {
+	ready := &negReconciler{condition: condition{condType: "NEGReady", ensured: true}}
+	failed := &backendReconciler{condition: condition{condType: "BackendReady", ensured: true, err: errors.New("boom")}}
+	pending := &endpointsReconciler{condition: condition{condType: "EndpointsReady"}}
+
+	tests := []struct {
+		name          string
+		subs          []subReconciler
+		expectedReady metav1.Condition
+	}{{
+		name:          "Ready if all the resources are",
+		subs:          []subReconciler{ready},
+		expectedReady: metav1.Condition{Type: readyCondition, Status: metav1.ConditionTrue, Reason: reasonReconciled},
+	}, {
+		name: "Not ready if a resource failed",
+		subs: []subReconciler{ready, failed, pending},
+		expectedReady: metav1.Condition{
+			Type:    readyCondition,
+			Status:  metav1.ConditionFalse,
+			Reason:  reasonReconcileFailed,
+			Message: "backend isn't ready: boom",
+		},
+	}, {
+		name: "Reports the cause of a resource's failure",
+		subs: []subReconciler{ready, &backendReconciler{condition: condition{
+			condType: "BackendReady",
+			ensured:  true,
+			err:      gcp.NewClientError(http.StatusForbidden, "permission denied"),
+		}}},
+		expectedReady: metav1.Condition{
+			Type:    readyCondition,
+			Status:  metav1.ConditionFalse,
+			Reason:  reasonPermissionDenied,
+			Message: "backend isn't ready: permission denied (status 403)",
+		},
+	}, {
+		name: "Reports reverted drift",
+		subs: []subReconciler{ready, &firewallReconciler{condition: condition{condType: "FirewallReady", ensured: true, drifted: true}}},
+		expectedReady: metav1.Condition{
+			Type:    readyCondition,
+			Status:  metav1.ConditionTrue,
+			Reason:  reasonDrift,
+			Message: "firewall was modified out of band and reverted",
+		},
+	}, {
+		name: "Unknown if a resource is pending",
+		subs: []subReconciler{ready, pending},
+		expectedReady: metav1.Condition{
+			Type:    readyCondition,
+			Status:  metav1.ConditionUnknown,
+			Reason:  reasonPending,
+			Message: "endpoints isn't ready: Waiting for the resources it depends on to be reconciled.",
+		},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conds := aggregateConditions(tt.subs)
+			require.Len(t, conds, len(tt.subs)+1)
+			require.Equal(t, tt.expectedReady, conds[len(conds)-1])
+		})
+	}
+}
+
+func TestUpdateStatus(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().WithObjects(s.sts).Build()
+	r := New(c, nil)
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(s.sts), sts))
+
+	conds := []metav1.Condition{{Type: readyCondition, Status: metav1.ConditionTrue, Reason: reasonReconciled}}
+	require.NoError(t, r.updateStatus(ctx, testr.New(t), sts, statusUpdate{conds: conds}))
+	status := parseStatus(sts)
+	require.Len(t, status.Conditions, 1)
+	require.Equal(t, "dev", status.ControllerVersion)
+	version := sts.ResourceVersion
+
+	// The STS isn't patched if the status didn't change.
+	require.NoError(t, r.updateStatus(ctx, testr.New(t), sts, statusUpdate{conds: conds}))
+	require.Equal(t, version, sts.ResourceVersion)
+
+	conds[0].Status = metav1.ConditionFalse
+	require.NoError(t, r.updateStatus(ctx, testr.New(t), sts, statusUpdate{conds: conds}))
+	require.NotEqual(t, version, sts.ResourceVersion)
+	status = parseStatus(sts)
+	require.Equal(t, metav1.ConditionFalse, status.Conditions[0].Status)
+}
+
+func TestUpdateStatusCoalescesRefreshes(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().WithObjects(s.sts).Build()
+	settings := DefaultSettings()
+	settings.StatusWriteInterval = time.Hour
+	r := New(c, nil, WithSettings(settings))
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(s.sts), sts))
+	log := testr.New(t)
+
+	conds := []metav1.Condition{{Type: readyCondition, Status: metav1.ConditionTrue, Reason: reasonReconciled}}
+	require.NoError(t, r.updateStatus(ctx, log, sts, statusUpdate{conds: conds, hash: "hash", applied: s.spec}))
+	version := sts.ResourceVersion
+	// The last drift check is stored with a precision of a second, so refreshes change the
+	// probe's results instead.
+	probe := func(reachable bool) *ProbeStatus {
+		return &ProbeStatus{IP: "10.0.0.2", Results: []ProbeResult{{Port: 30000, Reachable: reachable}}}
+	}
+
+	applied := *s.spec
+	applied.Labels = map[string]string{"new": "label"}
+	tests := []struct {
+		name      string
+		update    func() error
+		coalesced bool
+	}{{
+		name: "Coalesces drift checks",
+		update: func() error {
+			return r.updateStatus(ctx, log, sts, statusUpdate{conds: conds, hash: "hash", applied: s.spec, probe: probe(true)})
+		},
+		coalesced: true,
+	}, {
+		name: "Writes a new desired state",
+		update: func() error {
+			return r.updateStatus(ctx, log, sts, statusUpdate{conds: conds, hash: "other", applied: s.spec})
+		},
+	}, {
+		name: "Writes a new applied spec",
+		update: func() error {
+			return r.updateStatus(ctx, log, sts, statusUpdate{conds: conds, hash: "other", applied: &applied})
+		},
+	}, {
+		name: "Writes a failure",
+		update: func() error {
+			failed := []metav1.Condition{{Type: readyCondition, Status: metav1.ConditionFalse, Reason: reasonReconcileFailed, Message: "failed"}}
+			return r.updateStatus(ctx, log, sts, statusUpdate{conds: failed})
+		},
+	}, {
+		name: "Coalesces retries failing differently",
+		update: func() error {
+			failed := []metav1.Condition{{Type: readyCondition, Status: metav1.ConditionFalse, Reason: reasonReconcileFailed, Message: "failed again"}}
+			return r.updateStatus(ctx, log, sts, statusUpdate{conds: failed, progress: &Progress{}})
+		},
+		coalesced: true,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, tt.update())
+			require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(s.sts), sts))
+			if tt.coalesced {
+				require.Equal(t, version, sts.ResourceVersion)
+				return
+			}
+			require.NotEqual(t, version, sts.ResourceVersion)
+			version = sts.ResourceVersion
+		})
+	}
+
+	// Refreshes are written once the interval elapsed.
+	settings.StatusWriteInterval = time.Nanosecond
+	r.SetSettings(settings)
+	require.NoError(t, r.updateStatus(ctx, log, sts, statusUpdate{conds: conds, hash: "other", applied: &applied, probe: probe(true)}))
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(s.sts), sts))
+	version = sts.ResourceVersion
+	require.NoError(t, r.updateStatus(ctx, log, sts, statusUpdate{conds: conds, hash: "other", applied: &applied, probe: probe(false)}))
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(s.sts), sts))
+	require.NotEqual(t, version, sts.ResourceVersion)
+	require.Equal(t, probe(false), parseStatus(sts).Probe)
+}
+
+func TestReconcileSkipsWhenUpToDate(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.NewFaulty(gcpfake.New(s.project, s.region), gcpfake.Faults{})
+	r := New(c, gcpClient)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	// Every GCP call fails from now on, so reconciles only succeed if they're skipped.
+	gcpClient.SetFaults(gcpfake.Faults{ErrorRate: 1})
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	// Changing the pods' placement changes the desired state.
+	removed := s.pods.Items[len(s.pods.Items)-1]
+	require.NoError(t, c.Delete(ctx, &removed))
+	_, err = r.Reconcile(ctx, req)
+	require.ErrorContains(t, err, "injected fault")
+
+	// So does the drift check being due.
+	gcpClient.SetFaults(gcpfake.Faults{})
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	gcpClient.SetFaults(gcpfake.Faults{ErrorRate: 1})
+	settings := DefaultSettings()
+	settings.DriftCheckInterval = time.Nanosecond
+	r.SetSettings(settings)
+	_, err = r.Reconcile(ctx, req)
+	require.ErrorContains(t, err, "injected fault")
+}
+
+func TestReconcileSkipsJustAppliedState(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.NewFaulty(gcpfake.New(s.project, s.region), gcpfake.Faults{})
+	r := New(c, gcpClient)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+
+	_, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	// Events queued while the reconcile was in flight may see the STS without its status.
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	delete(sts.Annotations, statusAnnotation)
+	require.NoError(t, c.Update(ctx, sts))
+
+	// Every GCP call fails from now on, so reconciles only succeed if they're skipped.
+	gcpClient.SetFaults(gcpfake.Faults{ErrorRate: 1})
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	// Resources suspected of drift are still checked right away.
+	r.driftSuspects.add(req.NamespacedName)
+	_, err = r.Reconcile(ctx, req)
+	require.ErrorContains(t, err, "injected fault")
+
+	// And the failure is forgotten, so the next reconcile isn't skipped either.
+	_, err = r.Reconcile(ctx, req)
+	require.ErrorContains(t, err, "injected fault")
+}
+
+func TestReconcileChecksDriftAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.NewFaulty(gcpfake.New(s.project, s.region), gcpfake.Faults{})
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	_, err := New(c, gcpClient).Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	// The resources could have drifted while the controller was down, so a restarted one
+	// checks them even though the drift check isn't due.
+	gcpClient.SetFaults(gcpfake.Faults{ErrorRate: 1})
+	r := New(c, gcpClient)
+	r.startedAt = r.startedAt.Add(time.Second)
+	_, err = r.Reconcile(ctx, req)
+	require.ErrorContains(t, err, "injected fault")
+}
+
+func TestParkInvalidSpec(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	validSpec := s.sts.Annotations[annotation]
+	s.sts.Annotations[annotation] = "{"
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	rec := record.NewFakeRecorder(10)
+	settings := DefaultSettings()
+	settings.InvalidSpecs = InvalidSpecPark
+	r := New(c, gcpfake.New(s.project, s.region), WithEventRecorder(rec), WithSettings(settings))
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+	expectedMsg := "couldn't decode the spec from JSON: unexpected end of JSON input"
+
+	// The STS isn't retried, and the error is reported.
+	res, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Zero(t, res)
+	require.Len(t, rec.Events, 1)
+	require.Equal(t, "Warning InvalidSpec Invalid spec, not retrying until it changes: "+expectedMsg, <-rec.Events)
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	ready := meta.FindStatusCondition(parseStatus(sts).Conditions, readyCondition)
+	require.Equal(t, metav1.ConditionFalse, ready.Status)
+	require.Equal(t, reasonInvalidSpec, ready.Reason)
+	require.Equal(t, expectedMsg, ready.Message)
+
+	// It's only reported once.
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Empty(t, rec.Events)
+
+	// Fixing the spec reconciles it.
+	sts.Annotations[annotation] = validSpec
+	require.NoError(t, c.Update(ctx, sts))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	require.True(t, meta.IsStatusConditionTrue(parseStatus(sts).Conditions, readyCondition))
+}
+
+func TestReportInvalidSpec(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	s.sts.Annotations[annotation] = "{"
+	s.sts.Generation = 3
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	rec := record.NewFakeRecorder(10)
+	r := New(c, gcpfake.New(s.project, s.region), WithEventRecorder(rec))
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+
+	// The STS is retried, and its status reflects its generation.
+	_, err := r.Reconcile(ctx, req)
+	require.ErrorContains(t, err, "couldn't decode the spec from JSON")
+	require.Empty(t, rec.Events)
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	status := parseStatus(sts)
+	require.Equal(t, sts.Generation, status.ObservedGeneration)
+	ready := meta.FindStatusCondition(status.Conditions, readyCondition)
+	require.Equal(t, metav1.ConditionFalse, ready.Status)
+	require.Equal(t, reasonInvalidSpec, ready.Reason)
+	require.Equal(t, sts.Generation, ready.ObservedGeneration)
+}
+
+// The health checks of GitOps tools match the status annotation's JSON, see the readme.
+func TestStatusJSONForHealthChecks(t *testing.T) {
+	status := &Status{
+		ObservedGeneration: 2,
+		Conditions: []metav1.Condition{{
+			Type:               readyCondition,
+			Status:             metav1.ConditionTrue,
+			ObservedGeneration: 2,
+			Reason:             reasonReconciled,
+		}},
+	}
+	data, err := json.Marshal(status)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"observed_generation":2,`)
+	require.Contains(t, string(data), `"type":"Ready","status":"True"`)
+}
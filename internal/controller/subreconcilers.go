@@ -0,0 +1,608 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/go-logr/logr"
+	"go.uber.org/multierr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+// subReconciler manages a single kind of GCP resource for a spec.
+type subReconciler interface {
+	// Name identifies the resource in logs.
+	Name() string
+	// Ensure creates or updates the resource so that it matches the spec.
+	Ensure(ctx context.Context, log logr.Logger) error
+	// Delete deletes the resource. It returns gcp.ErrNotFound if it doesn't exist.
+	Delete(ctx context.Context, log logr.Logger) error
+	// Exists returns whether the resource exists, e.g. to verify that it was deleted.
+	Exists(ctx context.Context) (bool, error)
+	// Status returns the resource's condition as of the last call to Ensure.
+	Status() metav1.Condition
+}
+
+const (
+	reasonReconciled      = "Reconciled"
+	reasonReconcileFailed = "ReconcileFailed"
+	reasonPending         = "Pending"
+)
+
+// condition tracks the result of a subReconciler's last Ensure call as a condition of the
+// given type.
+type condition struct {
+	condType string
+	ensured  bool
+	err      error
+	// drifted is set if the resource was modified out of band, see reasonDrift.
+	drifted bool
+}
+
+// record records the result of Ensure and returns err.
+func (c *condition) record(err error) error {
+	c.ensured = true
+	c.err = err
+	return err
+}
+
+func (c *condition) Status() metav1.Condition {
+	switch {
+	case !c.ensured:
+		return metav1.Condition{
+			Type:    c.condType,
+			Status:  metav1.ConditionUnknown,
+			Reason:  reasonPending,
+			Message: "Waiting for the resources it depends on to be reconciled.",
+		}
+	case c.err != nil:
+		reason := failureReason(c.err)
+		if reason == reasonReconcileFailed && c.drifted {
+			reason = reasonDrift
+		}
+		return metav1.Condition{
+			Type:    c.condType,
+			Status:  metav1.ConditionFalse,
+			Reason:  reason,
+			Message: c.err.Error(),
+		}
+	case c.drifted:
+		return metav1.Condition{
+			Type:    c.condType,
+			Status:  metav1.ConditionTrue,
+			Reason:  reasonDrift,
+			Message: "Reverted the changes made out of band.",
+		}
+	default:
+		return metav1.Condition{Type: c.condType, Status: metav1.ConditionTrue, Reason: reasonReconciled}
+	}
+}
+
+// exists returns whether get finds the resource.
+func exists[T any](ctx context.Context, get func(context.Context, string) (T, error), name string) (bool, error) {
+	_, err := get(ctx, name)
+	if errors.Is(err, gcp.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// subReconcilerDeps maps each sub-reconciler's name to the names of the ones whose resources
+// its resource references, and which must therefore be ensured before it.
+var subReconcilerDeps = map[string][]string{
+	"backend":            {"NEG"},
+	"endpoints":          {"NEG"},
+	"forwarding rule":    {"backend"},
+	"service attachment": {"forwarding rule"},
+
+	"migration forwarding rule":    {"backend"},
+	"migration service attachment": {"migration forwarding rule"},
+	"canary":                       {"service attachment"},
+	"migration canary":             {"migration service attachment"},
+	// Obsolete resources are deleted, so dependents go first.
+	"obsolete forwarding rule":           {"obsolete service attachment"},
+	"obsolete migration forwarding rule": {"obsolete migration service attachment"},
+}
+
+// independentDeletes are the sub-reconcilers whose resources don't depend on the others', and
+// that no others depend on, so they're deleted concurrently with them. See subReconcilerDeps.
+var independentDeletes = map[string]bool{
+	"firewall": true,
+}
+
+// hooks are called by the sub-reconcilers with what they found in GCP. They're all optional.
+type hooks struct {
+	// firewallDrift is called before fixing a firewall that doesn't match the spec.
+	firewallDrift func(name string, diff gcp.FirewallDiff)
+	// serviceAttachment is called with the service attachment, if it exists.
+	serviceAttachment func(*computepb.ServiceAttachment)
+	// natSubnetsRemoved is called with the NAT subnets removed from the service attachment,
+	// once it's updated.
+	natSubnetsRemoved func([]string)
+	// forwardingRuleIP is called with the name and IP of each forwarding rule once it exists,
+	// before the service attachment using it is reconciled.
+	forwardingRuleIP func(name, ip string)
+}
+
+// subReconcilers returns the sub-reconcilers for spec, in the order their resources are
+// created. They must be deleted in reverse. lastApplied is the spec the resources were last
+// reconciled with, if known, see threeWayMerge and withMigration. own decides which existing
+// resources they can modify or delete.
+func subReconcilers(gc gcp.Client, spec, lastApplied *Spec, own ownership, ports map[int32]struct{}, mappings []*gcp.PortMapping, h hooks) []subReconciler {
+	subs := []subReconciler{
+		newFirewallReconciler(gc, spec, lastApplied, own, ports, h),
+		&negReconciler{
+			condition:   condition{condType: "NEGReady"},
+			gc:          gc,
+			own:         own,
+			name:        negName(spec.Prefix),
+			subnetFQN:   spec.NEGSubnetFQN,
+			defaultPort: spec.NEGDefaultPort,
+		},
+		&backendReconciler{
+			condition: condition{condType: "BackendReady"},
+			gc:        gc,
+			own:       own,
+			name:      backendName(spec.Prefix),
+			neg:       negName(spec.Prefix),
+		},
+		&endpointsReconciler{
+			condition: condition{condType: "EndpointsReady"},
+			gc:        gc,
+			neg:       negName(spec.Prefix),
+			mappings:  mappings,
+		},
+		&forwardingRuleReconciler{
+			condition:    condition{condType: "ForwardingRuleReady"},
+			kind:         "forwarding rule",
+			gc:           gc,
+			own:          own,
+			name:         fwdRuleName(spec.Prefix),
+			backend:      backendName(spec.Prefix),
+			ip:           spec.IP,
+			globalAccess: spec.GlobalAccess,
+			onIP:         h.forwardingRuleIP,
+		},
+		&serviceAttachmentReconciler{
+			condition:            condition{condType: "AttachmentReady"},
+			kind:                 "service attachment",
+			gc:                   gc,
+			own:                  own,
+			name:                 svcAttName(spec.Prefix),
+			fwdRule:              fwdRuleName(spec.Prefix),
+			consumers:            spec.ConsumerAcceptList,
+			natSubnetFQNs:        spec.NatSubnetFQNs,
+			drainingSubnetFQNs:   spec.DrainingNatSubnetFQNs,
+			enforceSubnetOrder:   spec.EnforceNatSubnetOrder,
+			lastApplied:          lastApplied,
+			onGet:                h.serviceAttachment,
+			onSubnetsRemoved:     h.natSubnetsRemoved,
+			reconcileConnections: spec.ReconcileConnections,
+		},
+	}
+	return withScaleToZero(withCanary(withMigration(subs, gc, spec, lastApplied, own, h), gc, spec, lastApplied, own), spec)
+}
+
+// firewallReconciler manages the spec's firewall rules: one for all of its ports, or one per
+// port if it sets firewall_per_port, and the ICMP rule if it sets allow_icmp.
+type firewallReconciler struct {
+	condition
+	gc  firewallClient
+	own ownership
+	// rules are the desired rules, by name.
+	rules map[string]gcp.FirewallRule
+	// icmp is nil unless the spec sets allow_icmp.
+	icmp *icmpFirewall
+	// obsolete are the names of the other rules the spec or the last applied one could have
+	// created, e.g. the single rule once firewall_per_port is set. They're deleted if they exist.
+	obsolete []string
+	// onDelete decides whether Delete deletes the firewalls or disables them.
+	onDelete FirewallOnDelete
+	onDrift  func(name string, diff gcp.FirewallDiff)
+}
+
+func (f *firewallReconciler) Name() string {
+	return "firewall"
+}
+
+func (f *firewallReconciler) Ensure(ctx context.Context, log logr.Logger) error {
+	var errs error
+	for _, name := range slices.Sorted(maps.Keys(f.rules)) {
+		errs = multierr.Append(errs, f.ensure(ctx, log, name, f.rules[name]))
+	}
+	if f.icmp != nil {
+		ranges, err := natSubnetRanges(ctx, f.gc, f.icmp.natSubnets)
+		if err != nil {
+			log.Error(err, "Failed to get the NAT subnets' ranges for the ICMP firewall.", "name", f.icmp.name)
+			errs = multierr.Append(errs, err)
+		} else {
+			rule := f.icmp.rule
+			rule.SourceRanges = ranges
+			errs = multierr.Append(errs, f.ensure(ctx, log, f.icmp.name, rule))
+		}
+	}
+	for _, name := range f.obsolete {
+		err := f.delete(ctx, name)
+		if err == nil {
+			log.Info("Deleted an obsolete firewall.", "name", name)
+		}
+		if !errors.Is(err, gcp.ErrNotFound) {
+			errs = multierr.Append(errs, err)
+		}
+	}
+	return f.record(errs)
+}
+
+func (f *firewallReconciler) ensure(ctx context.Context, log logr.Logger, name string, rule gcp.FirewallRule) error {
+	var diff gcp.FirewallDiff
+	e := &ensurer[*computepb.Firewall]{
+		kind: f.Name(),
+		name: name,
+		own:  f.own,
+		get: func(ctx context.Context) (*computepb.Firewall, error) {
+			return f.gc.GetFirewall(ctx, name)
+		},
+		needsUpdate: func(fw *computepb.Firewall) bool {
+			diff = gcp.DiffFirewall(fw, rule)
+			return !diff.Empty()
+		},
+		create: func(ctx context.Context) error {
+			return f.gc.CreateFirewall(ctx, name, rule)
+		},
+		update: func(ctx context.Context) error {
+			if f.onDrift != nil {
+				f.drifted = true
+				f.onDrift(name, diff)
+			}
+			return f.gc.UpdateFirewall(ctx, name, rule)
+		},
+	}
+	_, err := e.ensure(ctx, log)
+	return err
+}
+
+// Delete deletes or disables all of the rules. It returns gcp.ErrNotFound if none of them
+// exist.
+func (f *firewallReconciler) Delete(ctx context.Context, _ logr.Logger) error {
+	var errs error
+	found := false
+	for _, name := range f.names() {
+		err := f.delete(ctx, name)
+		if errors.Is(err, gcp.ErrNotFound) {
+			continue
+		}
+		found = true
+		errs = multierr.Append(errs, err)
+	}
+	if !found {
+		return gcp.ErrNotFound
+	}
+	return errs
+}
+
+// delete deletes or disables the rule, unless it's disabled on delete and already disabled.
+func (f *firewallReconciler) delete(ctx context.Context, name string) error {
+	if f.onDelete == FirewallDisable {
+		return deleteOwned(ctx, f.own, f.Name(), name, f.gc.GetFirewall, func(ctx context.Context, name string) error {
+			enabled, err := enabledFirewallExists(ctx, f.gc, name)
+			if err != nil || !enabled {
+				return err
+			}
+			return f.gc.DisableFirewall(ctx, name)
+		})
+	}
+	return deleteOwned(ctx, f.own, f.Name(), name, f.gc.GetFirewall, f.gc.DeleteFirewall)
+}
+
+// Exists returns true if any of the rules exist. Disabled rules don't count if they're
+// disabled on delete.
+func (f *firewallReconciler) Exists(ctx context.Context) (bool, error) {
+	for _, name := range f.names() {
+		var found bool
+		var err error
+		if f.onDelete == FirewallDisable {
+			found, err = enabledFirewallExists(ctx, f.gc, name)
+		} else {
+			found, err = exists(ctx, f.gc.GetFirewall, name)
+		}
+		if err != nil || found {
+			return found, err
+		}
+	}
+	return false, nil
+}
+
+func (f *firewallReconciler) names() []string {
+	names := append(slices.Sorted(maps.Keys(f.rules)), f.obsolete...)
+	if f.icmp != nil {
+		names = append(names, f.icmp.name)
+	}
+	return names
+}
+
+type negReconciler struct {
+	condition
+	gc   gcp.NEGs
+	own  ownership
+	name string
+	// subnetFQN is empty to use the client's subnet.
+	subnetFQN   string
+	defaultPort *int32
+}
+
+func (n *negReconciler) Name() string {
+	return "NEG"
+}
+
+func (n *negReconciler) Ensure(ctx context.Context, log logr.Logger) error {
+	e := &ensurer[*computepb.NetworkEndpointGroup]{
+		kind: n.Name(),
+		name: n.name,
+		own:  n.own,
+		get: func(ctx context.Context) (*computepb.NetworkEndpointGroup, error) {
+			return n.gc.GetNEG(ctx, n.name)
+		},
+		create: func(ctx context.Context) error {
+			return n.gc.CreatePortmapNEG(ctx, n.name, n.subnetFQN, n.defaultPort)
+		},
+	}
+	_, err := e.ensure(ctx, log)
+	return n.record(err)
+}
+
+func (n *negReconciler) Delete(ctx context.Context, _ logr.Logger) error {
+	return deleteOwned(ctx, n.own, n.Name(), n.name, n.gc.GetNEG, n.gc.DeletePortmapNEG)
+}
+
+func (n *negReconciler) Exists(ctx context.Context) (bool, error) {
+	return exists(ctx, n.gc.GetNEG, n.name)
+}
+
+type backendReconciler struct {
+	condition
+	gc   gcp.BackendServices
+	own  ownership
+	name string
+	neg  string
+}
+
+func (b *backendReconciler) Name() string {
+	return "backend"
+}
+
+func (b *backendReconciler) Ensure(ctx context.Context, log logr.Logger) error {
+	e := &ensurer[*computepb.BackendService]{
+		kind: b.Name(),
+		name: b.name,
+		own:  b.own,
+		get: func(ctx context.Context) (*computepb.BackendService, error) {
+			return b.gc.GetBackendService(ctx, b.name)
+		},
+		create: func(ctx context.Context) error {
+			return b.gc.CreateBackendService(ctx, b.name, b.neg)
+		},
+	}
+	_, err := e.ensure(ctx, log)
+	return b.record(err)
+}
+
+func (b *backendReconciler) Delete(ctx context.Context, _ logr.Logger) error {
+	return deleteOwned(ctx, b.own, b.Name(), b.name, b.gc.GetBackendService, b.gc.DeleteBackendService)
+}
+
+func (b *backendReconciler) Exists(ctx context.Context) (bool, error) {
+	return exists(ctx, b.gc.GetBackendService, b.name)
+}
+
+type endpointsReconciler struct {
+	condition
+	gc       gcp.NEGs
+	neg      string
+	mappings []*gcp.PortMapping
+}
+
+func (e *endpointsReconciler) Name() string {
+	return "endpoints"
+}
+
+func (e *endpointsReconciler) Ensure(ctx context.Context, log logr.Logger) error {
+	eps, err := e.gc.ListEndpoints(ctx, e.neg)
+	if err != nil {
+		if errors.Is(err, gcp.ErrNotFound) {
+			log.Error(err, "Couldn't attach the endpoints to the NEG. Was the NEG removed manually or by another process?", "name", e.neg)
+		} else {
+			log.Error(err, "Got an unexpected error trying to list the NEG's endpoints.", "name", e.neg)
+		}
+		return e.record(err)
+	}
+	// Endpoints must be detached first because the API doesn't allow attaching registering
+	// endpoints with the same port twice.
+	obsolete := getObsoletePortMappings(e.mappings, eps)
+	attached := len(eps) - len(obsolete)
+	if len(obsolete) > 0 {
+		err = e.gc.DetachEndpoints(ctx, e.neg, obsolete)
+		if err != nil {
+			log.Error(err, "Failed to detach obsolete endpoints from the NEG.", "name", e.neg)
+			setEndpointMetrics(e.neg, len(e.mappings), attached, len(obsolete))
+			return e.record(err)
+		}
+	}
+
+	// Only the missing endpoints are attached, so that the others, e.g. those of the pods below
+	// a rolling update's partition, aren't touched.
+	missing := getObsoletePortMappings(eps, e.mappings)
+	if len(missing) == 0 {
+		setEndpointMetrics(e.neg, len(e.mappings), len(e.mappings), 0)
+		return e.record(nil)
+	}
+	err = e.gc.AttachEndpoints(ctx, e.neg, missing)
+	if err != nil {
+		log.Error(err, "Failed to attach the endpoints to the NEG.", "name", e.neg)
+		setEndpointMetrics(e.neg, len(e.mappings), attached, 0)
+		return e.record(err)
+	}
+	setEndpointMetrics(e.neg, len(e.mappings), len(e.mappings), 0)
+	return e.record(nil)
+}
+
+// Delete is a no-op, because endpoints are deleted along with their NEG. It only removes the
+// NEG's endpoint metrics.
+func (e *endpointsReconciler) Delete(context.Context, logr.Logger) error {
+	deleteEndpointMetrics(e.neg)
+	return nil
+}
+
+// Exists returns false, since the endpoints are verified to be deleted along with their NEG.
+func (e *endpointsReconciler) Exists(context.Context) (bool, error) {
+	return false, nil
+}
+
+type forwardingRuleReconciler struct {
+	condition
+	// kind names the sub-reconciler, since there's another one during migrations.
+	kind    string
+	gc      gcp.ForwardingRules
+	own     ownership
+	name    string
+	backend string
+	// subnetFQN is empty to use the client's subnet.
+	subnetFQN    string
+	ip           *string
+	globalAccess *bool
+	onIP         func(name, ip string)
+}
+
+func (f *forwardingRuleReconciler) Name() string {
+	return f.kind
+}
+
+func (f *forwardingRuleReconciler) Ensure(ctx context.Context, log logr.Logger) error {
+	var ip string
+	e := &ensurer[*computepb.ForwardingRule]{
+		kind: f.Name(),
+		name: f.name,
+		own:  f.own,
+		get: func(ctx context.Context) (*computepb.ForwardingRule, error) {
+			rule, err := f.gc.GetForwardingRule(ctx, f.name)
+			ip = rule.GetIPAddress()
+			return rule, err
+		},
+		// Global access is the only field that can change without recreating the rule. It's
+		// disabled unless the spec or the defaults enable it.
+		needsUpdate: func(rule *computepb.ForwardingRule) bool {
+			return rule.GetAllowGlobalAccess() != ptr.Deref(f.globalAccess, false)
+		},
+		update: func(ctx context.Context) error {
+			log.Info("Updating the forwarding rule's global access.", "name", f.name, "globalAccess", ptr.Deref(f.globalAccess, false))
+			return f.gc.SetForwardingRuleGlobalAccess(ctx, f.name, ptr.Deref(f.globalAccess, false))
+		},
+		create: func(ctx context.Context) error {
+			return f.gc.CreateForwardingRule(ctx, f.name, f.backend, f.subnetFQN, f.ip, f.globalAccess)
+		},
+	}
+	a, err := e.ensure(ctx, log)
+	if err != nil || f.onIP == nil {
+		return f.record(err)
+	}
+	if a == actionCreate {
+		// GCP assigns the IP on creation, unless the spec sets it. Failing to get it doesn't fail
+		// the rule, since it's reported on the next reconcile anyway.
+		rule, getErr := f.gc.GetForwardingRule(ctx, f.name)
+		if getErr != nil {
+			log.Error(getErr, "Failed to get the forwarding rule's IP.", "name", f.name)
+		}
+		ip = rule.GetIPAddress()
+	}
+	if ip != "" {
+		f.onIP(f.name, ip)
+	}
+	return f.record(nil)
+}
+
+func (f *forwardingRuleReconciler) Delete(ctx context.Context, _ logr.Logger) error {
+	return deleteOwned(ctx, f.own, f.Name(), f.name, f.gc.GetForwardingRule, f.gc.DeleteForwardingRule)
+}
+
+func (f *forwardingRuleReconciler) Exists(ctx context.Context) (bool, error) {
+	return exists(ctx, f.gc.GetForwardingRule, f.name)
+}
+
+type serviceAttachmentReconciler struct {
+	condition
+	// kind names the sub-reconciler, since there's another one during migrations.
+	kind string
+	gc   interface {
+		gcp.Scope
+		gcp.ServiceAttachments
+	}
+	own                ownership
+	name               string
+	fwdRule            string
+	consumers          []*Consumer
+	natSubnetFQNs      []string
+	drainingSubnetFQNs []string
+	// If true, the NAT subnets are reordered to match natSubnetFQNs.
+	enforceSubnetOrder bool
+	// reconcileConnections is nil if the spec doesn't set it.
+	reconcileConnections *bool
+	lastApplied          *Spec
+	onGet                func(*computepb.ServiceAttachment)
+	onSubnetsRemoved     func([]string)
+}
+
+func (s *serviceAttachmentReconciler) Name() string {
+	return s.kind
+}
+
+func (s *serviceAttachmentReconciler) Ensure(ctx context.Context, log logr.Logger) error {
+	var (
+		consumers            []*computepb.ServiceAttachmentConsumerProjectLimit
+		natSubnetFQNs        []string
+		removedSubnets       []string
+		reconcileConnections *bool
+	)
+	e := &ensurer[*computepb.ServiceAttachment]{
+		kind: s.Name(),
+		name: s.name,
+		own:  s.own,
+		get: func(ctx context.Context) (*computepb.ServiceAttachment, error) {
+			return s.gc.GetServiceAttachment(ctx, s.name)
+		},
+		needsUpdate: func(svcAtt *computepb.ServiceAttachment) bool {
+			if s.onGet != nil {
+				s.onGet(svcAtt)
+			}
+			var changed bool
+			consumers, natSubnetFQNs, changed = mergeServiceAttachment(s.lastApplied, toConsumerProjectLimits(s.consumers), s.natSubnetFQNs, s.drainingSubnetFQNs, s.enforceSubnetOrder, svcAtt)
+			removedSubnets = removedNatSubnets(svcAtt.GetNatSubnets(), natSubnetFQNs)
+			reconcileConnections = mergeReconcileConnections(s.lastApplied, s.reconcileConnections)
+			return changed || (reconcileConnections != nil && *reconcileConnections != svcAtt.GetReconcileConnections())
+		},
+		update: func(ctx context.Context) error {
+			err := s.gc.UpdateServiceAttachment(ctx, s.name, consumers, natSubnetFQNs, reconcileConnections)
+			if err == nil && len(removedSubnets) > 0 && s.onSubnetsRemoved != nil {
+				s.onSubnetsRemoved(removedSubnets)
+			}
+			return err
+		},
+		create: func(ctx context.Context) error {
+			fwdRuleFQN := gcp.ForwardingRuleFQN(s.gc.Project(), s.gc.Region(), s.fwdRule)
+			return s.gc.CreateServiceAttachment(ctx, s.name, fwdRuleFQN, toConsumerProjectLimits(s.consumers), s.natSubnetFQNs, s.reconcileConnections)
+		},
+	}
+	_, err := e.ensure(ctx, log)
+	return s.record(err)
+}
+
+func (s *serviceAttachmentReconciler) Delete(ctx context.Context, _ logr.Logger) error {
+	return deleteOwned(ctx, s.own, s.Name(), s.name, s.gc.GetServiceAttachment, s.gc.DeleteServiceAttachment)
+}
+
+func (s *serviceAttachmentReconciler) Exists(ctx context.Context) (bool, error) {
+	return exists(ctx, s.gc.GetServiceAttachment, s.name)
+}
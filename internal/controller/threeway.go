@@ -0,0 +1,143 @@
+package controller
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/utils/ptr"
+)
+
+// lastAppliedAnnotation holds the spec, with the defaults applied, that the STS' resources were
+// last reconciled successfully with.
+const lastAppliedAnnotation = "psc-portmapper.0x5d.org/last-applied-spec"
+
+// lastAppliedSpec returns the spec the STS' resources were last reconciled successfully with,
+// or nil if it's unknown, e.g. because they were reconciled by an older controller.
+func lastAppliedSpec(sts *appsv1.StatefulSet) *Spec {
+	jsonSpec, ok := sts.Annotations[lastAppliedAnnotation]
+	if !ok {
+		return nil
+	}
+	spec := &Spec{}
+	if json.Unmarshal([]byte(jsonSpec), spec) != nil {
+		return nil
+	}
+	return spec
+}
+
+// threeWayMerge returns the entries a resource should have: the desired ones, and the actual
+// ones that weren't in the last applied spec, e.g. because they were added out of band. So
+// entries removed from the spec since it was last applied are removed from the resource, but
+// nothing is removed if the last applied spec is unknown.
+func threeWayMerge[V any](lastApplied, desired, actual map[string]V) map[string]V {
+	merged := make(map[string]V, len(desired))
+	for k, v := range actual {
+		if _, owned := lastApplied[k]; !owned {
+			merged[k] = v
+		}
+	}
+	maps.Copy(merged, desired)
+	return merged
+}
+
+// mergeServiceAttachment returns the consumer accept list and NAT subnets the attachment should
+// have given the last applied spec and the desired ones, and whether they differ from the
+// actual ones. The draining subnets are removed as if they had been applied. The NAT subnets
+// are in the desired order, followed by the ones added out of band, and if enforceSubnetOrder
+// is true, a different order counts as a difference.
+func mergeServiceAttachment(
+	lastApplied *Spec,
+	consumers []*computepb.ServiceAttachmentConsumerProjectLimit,
+	natSubnetFQNs []string,
+	drainingSubnetFQNs []string,
+	enforceSubnetOrder bool,
+	actual *computepb.ServiceAttachment,
+) ([]*computepb.ServiceAttachmentConsumerProjectLimit, []string, bool) {
+	var lastConsumers map[string]*computepb.ServiceAttachmentConsumerProjectLimit
+	lastSubnets := subnetsByKey(drainingSubnetFQNs)
+	if lastApplied != nil {
+		lastConsumers = consumersByKey(toConsumerProjectLimits(lastApplied.ConsumerAcceptList))
+		maps.Copy(lastSubnets, subnetsByKey(lastApplied.NatSubnetFQNs))
+	}
+	actualConsumers := consumersByKey(actual.GetConsumerAcceptLists())
+	actualSubnets := subnetsByKey(actual.GetNatSubnets())
+
+	mergedConsumers := threeWayMerge(lastConsumers, consumersByKey(consumers), actualConsumers)
+	mergedSubnets := threeWayMerge(lastSubnets, subnetsByKey(natSubnetFQNs), actualSubnets)
+	changed := !maps.EqualFunc(mergedConsumers, actualConsumers, func(a, b *computepb.ServiceAttachmentConsumerProjectLimit) bool {
+		return a.GetConnectionLimit() == b.GetConnectionLimit()
+	}) || !maps.EqualFunc(mergedSubnets, actualSubnets, func(_, _ string) bool {
+		// They're keyed by FQN, but the API returns URLs.
+		return true
+	})
+
+	keys := slices.Sorted(maps.Keys(mergedConsumers))
+	mergedList := make([]*computepb.ServiceAttachmentConsumerProjectLimit, 0, len(keys))
+	for _, k := range keys {
+		mergedList = append(mergedList, mergedConsumers[k])
+	}
+	orderedSubnets := orderSubnets(mergedSubnets, natSubnetFQNs, actual.GetNatSubnets())
+	if enforceSubnetOrder && !changed {
+		changed = !slices.Equal(orderedSubnets, subnetKeys(actual.GetNatSubnets()))
+	}
+	return mergedList, orderedSubnets, changed
+}
+
+// orderSubnets returns the FQNs of the merged subnets: the desired ones in their order, followed
+// by the others in the order they're in the actual attachment.
+func orderSubnets(merged map[string]string, desired, actual []string) []string {
+	var ordered []string
+	for _, s := range append(subnetKeys(desired), subnetKeys(actual)...) {
+		if _, ok := merged[s]; ok && !slices.Contains(ordered, s) {
+			ordered = append(ordered, s)
+		}
+	}
+	return ordered
+}
+
+// subnetKeys returns the subnets' FQNs, since the API returns them as URLs.
+func subnetKeys(subnets []string) []string {
+	keys := make([]string, 0, len(subnets))
+	for _, s := range subnets {
+		keys = append(keys, gcp.RelativeName(s))
+	}
+	return keys
+}
+
+// consumersByKey indexes consumers by project, or by network if they don't set one.
+func consumersByKey(cs []*computepb.ServiceAttachmentConsumerProjectLimit) map[string]*computepb.ServiceAttachmentConsumerProjectLimit {
+	byKey := make(map[string]*computepb.ServiceAttachmentConsumerProjectLimit, len(cs))
+	for _, c := range cs {
+		if c.ProjectIdOrNum != nil {
+			byKey["project:"+c.GetProjectIdOrNum()] = c
+			continue
+		}
+		byKey["network:"+gcp.RelativeName(c.GetNetworkUrl())] = c
+	}
+	return byKey
+}
+
+// subnetsByKey indexes subnets by FQN, since the API returns them as URLs.
+func subnetsByKey(subnets []string) map[string]string {
+	byKey := make(map[string]string, len(subnets))
+	for _, s := range subnets {
+		byKey[gcp.RelativeName(s)] = s
+	}
+	return byKey
+}
+
+// mergeReconcileConnections returns the reconcileConnections the attachment should have, or nil
+// if it should be left as is. If the spec stopped setting it, it's reset to the API's default.
+func mergeReconcileConnections(lastApplied *Spec, desired *bool) *bool {
+	if desired != nil {
+		return desired
+	}
+	if lastApplied != nil && lastApplied.ReconcileConnections != nil {
+		return ptr.To(false)
+	}
+	return nil
+}
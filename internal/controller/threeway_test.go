@@ -0,0 +1,260 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/0x5d/psc-portmapper/api"
+	gcpfake "github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestMergeServiceAttachment(t *testing.T) {
+	subnet := "projects/p/regions/us-east1/subnetworks/nat"
+	subnetURL := "https://www.googleapis.com/compute/v1/" + subnet
+	otherSubnet := "projects/p/regions/us-east1/subnetworks/other"
+	thirdSubnet := "projects/p/regions/us-east1/subnetworks/third"
+	consumer := func(project string, limit uint32) *computepb.ServiceAttachmentConsumerProjectLimit {
+		return &computepb.ServiceAttachmentConsumerProjectLimit{ProjectIdOrNum: proto.String(project), ConnectionLimit: proto.Uint32(limit)}
+	}
+	specConsumer := func(project string, limit uint32) *Consumer {
+		return &Consumer{ProjectIdOrNum: proto.String(project), ConnectionLimit: limit}
+	}
+
+	tests := []struct {
+		name              string
+		lastApplied       *Spec
+		consumers         []*computepb.ServiceAttachmentConsumerProjectLimit
+		natSubnets        []string
+		drainingSubnets   []string
+		enforceOrder      bool
+		actual            *computepb.ServiceAttachment
+		expectedConsumers []*computepb.ServiceAttachmentConsumerProjectLimit
+		expectedSubnets   []string
+		expectedChanged   bool
+	}{{
+		name:        "Doesn't change an up to date attachment",
+		lastApplied: &Spec{Spec: api.Spec{ConsumerAcceptList: []*Consumer{specConsumer("a", 10)}, NatSubnetFQNs: []string{subnet}}},
+		consumers:   []*computepb.ServiceAttachmentConsumerProjectLimit{consumer("a", 10)},
+		natSubnets:  []string{subnet},
+		actual: &computepb.ServiceAttachment{
+			ConsumerAcceptLists: []*computepb.ServiceAttachmentConsumerProjectLimit{consumer("a", 10)},
+			NatSubnets:          []string{subnetURL},
+		},
+		expectedConsumers: []*computepb.ServiceAttachmentConsumerProjectLimit{consumer("a", 10)},
+		expectedSubnets:   []string{subnet},
+	}, {
+		name:        "Removes the consumers removed from the spec",
+		lastApplied: &Spec{Spec: api.Spec{ConsumerAcceptList: []*Consumer{specConsumer("a", 10), specConsumer("b", 10)}, NatSubnetFQNs: []string{subnet}}},
+		consumers:   []*computepb.ServiceAttachmentConsumerProjectLimit{consumer("a", 10)},
+		natSubnets:  []string{subnet},
+		actual: &computepb.ServiceAttachment{
+			ConsumerAcceptLists: []*computepb.ServiceAttachmentConsumerProjectLimit{consumer("a", 10), consumer("b", 10)},
+			NatSubnets:          []string{subnetURL},
+		},
+		expectedConsumers: []*computepb.ServiceAttachmentConsumerProjectLimit{consumer("a", 10)},
+		expectedSubnets:   []string{subnet},
+		expectedChanged:   true,
+	}, {
+		name:        "Keeps the consumers added out of band",
+		lastApplied: &Spec{Spec: api.Spec{ConsumerAcceptList: []*Consumer{specConsumer("a", 10)}, NatSubnetFQNs: []string{subnet}}},
+		consumers:   []*computepb.ServiceAttachmentConsumerProjectLimit{consumer("a", 10)},
+		natSubnets:  []string{subnet},
+		actual: &computepb.ServiceAttachment{
+			ConsumerAcceptLists: []*computepb.ServiceAttachmentConsumerProjectLimit{consumer("a", 10), consumer("manual", 5)},
+			NatSubnets:          []string{subnetURL},
+		},
+		expectedConsumers: []*computepb.ServiceAttachmentConsumerProjectLimit{consumer("a", 10), consumer("manual", 5)},
+		expectedSubnets:   []string{subnet},
+	}, {
+		name:       "Doesn't remove anything if the last applied spec is unknown",
+		consumers:  []*computepb.ServiceAttachmentConsumerProjectLimit{consumer("a", 10)},
+		natSubnets: []string{subnet},
+		actual: &computepb.ServiceAttachment{
+			ConsumerAcceptLists: []*computepb.ServiceAttachmentConsumerProjectLimit{consumer("b", 10)},
+			NatSubnets:          []string{subnetURL, otherSubnet},
+		},
+		expectedConsumers: []*computepb.ServiceAttachmentConsumerProjectLimit{consumer("a", 10), consumer("b", 10)},
+		expectedSubnets:   []string{subnet, otherSubnet},
+		expectedChanged:   true,
+	}, {
+		name:        "Updates connection limits",
+		lastApplied: &Spec{Spec: api.Spec{ConsumerAcceptList: []*Consumer{specConsumer("a", 10)}}},
+		consumers:   []*computepb.ServiceAttachmentConsumerProjectLimit{consumer("a", 20)},
+		actual: &computepb.ServiceAttachment{
+			ConsumerAcceptLists: []*computepb.ServiceAttachmentConsumerProjectLimit{consumer("a", 10)},
+		},
+		expectedConsumers: []*computepb.ServiceAttachmentConsumerProjectLimit{consumer("a", 20)},
+		expectedChanged:   true,
+	}, {
+		name:        "Removes the NAT subnets removed from the spec",
+		lastApplied: &Spec{Spec: api.Spec{NatSubnetFQNs: []string{subnet, otherSubnet}}},
+		natSubnets:  []string{otherSubnet},
+		actual: &computepb.ServiceAttachment{
+			NatSubnets: []string{subnetURL, otherSubnet},
+		},
+		expectedConsumers: []*computepb.ServiceAttachmentConsumerProjectLimit{},
+		expectedSubnets:   []string{otherSubnet},
+		expectedChanged:   true,
+	}, {
+		name:            "Removes the draining NAT subnets even if the last applied spec is unknown",
+		natSubnets:      []string{otherSubnet},
+		drainingSubnets: []string{subnet},
+		actual: &computepb.ServiceAttachment{
+			NatSubnets: []string{subnetURL, otherSubnet},
+		},
+		expectedConsumers: []*computepb.ServiceAttachmentConsumerProjectLimit{},
+		expectedSubnets:   []string{otherSubnet},
+		expectedChanged:   true,
+	}, {
+		name:            "Doesn't change an attachment whose draining NAT subnets were removed",
+		lastApplied:     &Spec{Spec: api.Spec{NatSubnetFQNs: []string{otherSubnet}}},
+		natSubnets:      []string{otherSubnet},
+		drainingSubnets: []string{subnet},
+		actual: &computepb.ServiceAttachment{
+			NatSubnets: []string{otherSubnet},
+		},
+		expectedConsumers: []*computepb.ServiceAttachmentConsumerProjectLimit{},
+		expectedSubnets:   []string{otherSubnet},
+	}, {
+		name:        "Orders the NAT subnets as in the spec, then as added out of band",
+		lastApplied: &Spec{Spec: api.Spec{NatSubnetFQNs: []string{otherSubnet}}},
+		natSubnets:  []string{thirdSubnet, otherSubnet},
+		actual: &computepb.ServiceAttachment{
+			NatSubnets: []string{otherSubnet, subnetURL},
+		},
+		expectedConsumers: []*computepb.ServiceAttachmentConsumerProjectLimit{},
+		expectedSubnets:   []string{thirdSubnet, otherSubnet, subnet},
+		expectedChanged:   true,
+	}, {
+		name:        "Doesn't reorder the NAT subnets by default",
+		lastApplied: &Spec{Spec: api.Spec{NatSubnetFQNs: []string{otherSubnet, subnet}}},
+		natSubnets:  []string{otherSubnet, subnet},
+		actual: &computepb.ServiceAttachment{
+			NatSubnets: []string{subnetURL, otherSubnet},
+		},
+		expectedConsumers: []*computepb.ServiceAttachmentConsumerProjectLimit{},
+		expectedSubnets:   []string{otherSubnet, subnet},
+	}, {
+		name:         "Reorders the NAT subnets if the order is enforced",
+		lastApplied:  &Spec{Spec: api.Spec{NatSubnetFQNs: []string{otherSubnet, subnet}}},
+		natSubnets:   []string{otherSubnet, subnet},
+		enforceOrder: true,
+		actual: &computepb.ServiceAttachment{
+			NatSubnets: []string{subnetURL, otherSubnet},
+		},
+		expectedConsumers: []*computepb.ServiceAttachmentConsumerProjectLimit{},
+		expectedSubnets:   []string{otherSubnet, subnet},
+		expectedChanged:   true,
+	}, {
+		name:         "Doesn't change NAT subnets in the enforced order",
+		lastApplied:  &Spec{Spec: api.Spec{NatSubnetFQNs: []string{otherSubnet, subnet}}},
+		natSubnets:   []string{otherSubnet, subnet},
+		enforceOrder: true,
+		actual: &computepb.ServiceAttachment{
+			NatSubnets: []string{otherSubnet, subnetURL},
+		},
+		expectedConsumers: []*computepb.ServiceAttachmentConsumerProjectLimit{},
+		expectedSubnets:   []string{otherSubnet, subnet},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			consumers, subnets, changed := mergeServiceAttachment(tt.lastApplied, tt.consumers, tt.natSubnets, tt.drainingSubnets, tt.enforceOrder, tt.actual)
+			require.Equal(t, tt.expectedChanged, changed)
+			require.Len(t, consumers, len(tt.expectedConsumers))
+			for i, c := range tt.expectedConsumers {
+				require.True(t, proto.Equal(c, consumers[i]), "expected %v, got %v", c, consumers[i])
+			}
+			require.Equal(t, tt.expectedSubnets, subnets)
+		})
+	}
+}
+
+func TestLastAppliedSpecCleanup(t *testing.T) {
+	ctx := context.Background()
+	s := initialState()
+	s.spec.ConsumerAcceptList = []*Consumer{
+		{ProjectIdOrNum: proto.String("kept"), ConnectionLimit: 10},
+		{ProjectIdOrNum: proto.String("removed"), ConnectionLimit: 10},
+	}
+	specStr, err := json.Marshal(s.spec)
+	require.NoError(t, err)
+	s.sts.Annotations[annotation] = string(specStr)
+	c := fake.NewClientBuilder().
+		WithLists(s.nodes, s.pods).
+		WithObjects(s.sts).
+		Build()
+	gcpClient := gcpfake.New(s.project, s.region)
+	r := New(c, gcpClient)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(s.sts)}
+
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	sts := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	applied := lastAppliedSpec(sts)
+	require.NotNil(t, applied)
+	require.Len(t, applied.ConsumerAcceptList, 2)
+
+	// A consumer is accepted out of band.
+	svcAtt, err := gcpClient.GetServiceAttachment(ctx, svcAttName("prefix-"))
+	require.NoError(t, err)
+	manual := &computepb.ServiceAttachmentConsumerProjectLimit{ProjectIdOrNum: proto.String("manual"), ConnectionLimit: proto.Uint32(5)}
+	require.NoError(t, gcpClient.UpdateServiceAttachment(ctx, svcAttName("prefix-"), append(svcAtt.ConsumerAcceptLists, manual), svcAtt.NatSubnets, nil))
+
+	// A consumer is removed from the spec.
+	s.spec.ConsumerAcceptList = s.spec.ConsumerAcceptList[:1]
+	specStr, err = json.Marshal(s.spec)
+	require.NoError(t, err)
+	sts.Annotations[annotation] = string(specStr)
+	require.NoError(t, c.Update(ctx, sts))
+	_, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+
+	svcAtt, err = gcpClient.GetServiceAttachment(ctx, svcAttName("prefix-"))
+	require.NoError(t, err)
+	projects := make([]string, 0, len(svcAtt.ConsumerAcceptLists))
+	for _, c := range svcAtt.ConsumerAcceptLists {
+		projects = append(projects, c.GetProjectIdOrNum())
+	}
+	require.ElementsMatch(t, []string{"kept", "manual"}, projects)
+	require.NoError(t, c.Get(ctx, req.NamespacedName, sts))
+	require.Len(t, lastAppliedSpec(sts).ConsumerAcceptList, 1)
+}
+
+func TestMergeReconcileConnections(t *testing.T) {
+	tests := []struct {
+		name        string
+		lastApplied *Spec
+		desired     *bool
+		expected    *bool
+	}{{
+		name:     "Sets the desired value",
+		desired:  ptr.To(true),
+		expected: ptr.To(true),
+	}, {
+		name:        "Resets the value if the spec stopped setting it",
+		lastApplied: &Spec{Spec: api.Spec{ReconcileConnections: ptr.To(true)}},
+		expected:    ptr.To(false),
+	}, {
+		name:        "Leaves the value as is if the spec never set it",
+		lastApplied: &Spec{},
+	}, {
+		name: "Leaves the value as is if the last applied spec is unknown",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, mergeReconcileConnections(tt.lastApplied, tt.desired))
+		})
+	}
+}
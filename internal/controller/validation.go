@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// ValidationPath is the path the validating webhook is served at.
+const ValidationPath = "/validate-apps-v1-statefulset-spec"
+
+// ValidationHandler returns the handler of the validating webhook, which rejects the
+// StatefulSets the controller manages if their spec is invalid, including if it violates the
+// config file's policy and its rules, as the controller would once it reconciles them. Only
+// changed specs are validated, so that a stricter policy doesn't block e.g. scaling the
+// StatefulSets it was tightened after.
+func (r *PortmapReconciler) ValidationHandler() admission.Handler {
+	return admission.HandlerFunc(r.handleValidation)
+}
+
+func (r *PortmapReconciler) handleValidation(ctx context.Context, req admission.Request) admission.Response {
+	sts := &appsv1.StatefulSet{}
+	err := json.Unmarshal(req.Object.Raw, sts)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	var old *appsv1.StatefulSet
+	if len(req.OldObject.Raw) > 0 {
+		old = &appsv1.StatefulSet{}
+		err = json.Unmarshal(req.OldObject.Raw, old)
+		if err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+	}
+	log := log.FromContext(ctx).WithValues("namespace", req.Namespace, "name", req.Name)
+	err = r.validateChangedSpec(ctx, log, sts, old)
+	if err != nil {
+		log.Info("Rejecting a StatefulSet with an invalid spec.", "error", err.Error())
+		return admission.Denied(err.Error())
+	}
+	return admission.Allowed("")
+}
+
+// validateChangedSpec validates the STS' spec against the current settings' defaults and
+// policy, and checks that its node ports aren't cooling down, if the controller manages the STS
+// and its spec changed since old, which is nil on creation.
+func (r *PortmapReconciler) validateChangedSpec(ctx context.Context, log logr.Logger, sts, old *appsv1.StatefulSet) error {
+	jsonSpec, ok := sts.Annotations[annotation]
+	if !ok || !hasClass(sts, r.class) {
+		return nil
+	}
+	if old != nil && old.Annotations[annotation] == jsonSpec {
+		return nil
+	}
+	settings := r.currentSettings()
+	spec, err := parseSpec(log, jsonSpec, settings.SpecDefaults, settings.Policy)
+	if err != nil {
+		return err
+	}
+	err = validateTargetPorts(spec, &sts.Spec.Template.Spec)
+	if err != nil {
+		return err
+	}
+	_, err = r.checkNodePortCooldown(ctx, sts, spec)
+	return err
+}
@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestHandleValidation(t *testing.T) {
+	valid := `{"prefix":"team-","nat_subnet_fqns":["projects/p/regions/r/subnetworks/s"],"node_ports":{"app":{"node_port":30000,"container_port":8080,"starting_port":30000}}}`
+	violating := `{"prefix":"other-","nat_subnet_fqns":["projects/p/regions/r/subnetworks/s"],"node_ports":{"app":{"node_port":30000,"container_port":8080,"starting_port":30000}}}`
+	raw := func(annotations map[string]string) []byte {
+		sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "kafka", Annotations: annotations}}
+		b, err := json.Marshal(sts)
+		require.NoError(t, err)
+		return b
+	}
+	policy := &Policy{Rules: []Rule{{Expression: `spec.prefix.startsWith("team-")`, Message: "the prefix must start with the team's code"}}}
+	require.NoError(t, policy.Validate())
+
+	tests := []struct {
+		name        string
+		object      []byte
+		old         []byte
+		expectedErr string
+	}{{
+		name:   "Admits valid specs",
+		object: raw(map[string]string{annotation: valid}),
+	}, {
+		name:   "Admits StatefulSets without a spec",
+		object: raw(nil),
+	}, {
+		name:   "Admits StatefulSets of another class",
+		object: raw(map[string]string{annotation: violating, classAnnotation: "other"}),
+	}, {
+		name:        "Rejects specs violating the policy's rules",
+		object:      raw(map[string]string{annotation: violating}),
+		expectedErr: "the spec violates the policy: the prefix must start with the team's code",
+	}, {
+		name:        "Rejects invalid specs",
+		object:      raw(map[string]string{annotation: `{"prefix":"team-"}`}),
+		expectedErr: "invalid spec",
+	}, {
+		name:   "Admits updates that don't change the spec",
+		object: raw(map[string]string{annotation: violating}),
+		old:    raw(map[string]string{annotation: violating}),
+	}, {
+		name:        "Rejects updates to a violating spec",
+		object:      raw(map[string]string{annotation: violating}),
+		old:         raw(map[string]string{annotation: valid}),
+		expectedErr: "the prefix must start with the team's code",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := DefaultSettings()
+			settings.Policy = policy
+			r := New(nil, nil, WithSettings(settings))
+			req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				Namespace: "default",
+				Name:      "kafka",
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: tt.object},
+				OldObject: runtime.RawExtension{Raw: tt.old},
+			}}
+			if tt.old != nil {
+				req.Operation = admissionv1.Update
+			}
+			resp := r.ValidationHandler().Handle(context.Background(), req)
+			if tt.expectedErr != "" {
+				require.False(t, resp.Allowed)
+				require.Contains(t, resp.Result.Message, tt.expectedErr)
+				return
+			}
+			require.True(t, resp.Allowed)
+		})
+	}
+}
@@ -0,0 +1,130 @@
+// Package debug implements an opt-in HTTP server exposing runtime diagnostics, to help
+// diagnose slow or stuck reconciles. It's unauthenticated, so it should only be bound to
+// localhost and reached with kubectl port-forward.
+package debug
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// shutdownTimeout bounds how long the server waits for requests in flight when it's stopped.
+const shutdownTimeout = 5 * time.Second
+
+// Sources provides the diagnostics. Nil sources are served as null.
+type Sources struct {
+	// The last reconcile result of each StatefulSet.
+	Reconciles func() any
+	// The GCP clients built for per-spec credentials.
+	GCPClients func() any
+	// The progress of bulk mode.
+	Bulk func() any
+	// The registry controller-runtime's work queue metrics are registered in.
+	Metrics prometheus.Gatherer
+}
+
+// Server serves pprof under /debug/pprof/, and the diagnostics under /debug/queue,
+// /debug/reconciles, /debug/gcp-clients and /debug/bulk as JSON. It's a manager.Runnable that runs on every
+// replica, not only on the leader.
+type Server struct {
+	addr string
+	mux  *http.ServeMux
+	src  Sources
+}
+
+func NewServer(addr string, src Sources) *Server {
+	s := &Server{addr: addr, mux: http.NewServeMux(), src: src}
+	s.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	s.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	s.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	s.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	s.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	s.mux.HandleFunc("/debug/queue", s.queue)
+	s.mux.HandleFunc("/debug/reconciles", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, call(s.src.Reconciles))
+	})
+	s.mux.HandleFunc("/debug/gcp-clients", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, call(s.src.GCPClients))
+	})
+	s.mux.HandleFunc("/debug/bulk", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, call(s.src.Bulk))
+	})
+	return s
+}
+
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
+
+// Start serves until ctx is done.
+func (s *Server) Start(ctx context.Context) error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: s.mux, ReadHeaderTimeout: 10 * time.Second}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	err = srv.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		<-done
+		return nil
+	}
+	return err
+}
+
+func (s *Server) NeedLeaderElection() bool {
+	return false
+}
+
+// queue returns the depth of each of controller-runtime's work queues, by controller name.
+func (s *Server) queue(w http.ResponseWriter, _ *http.Request) {
+	depths := map[string]float64{}
+	if s.src.Metrics != nil {
+		families, err := s.src.Metrics.Gather()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, f := range families {
+			if f.GetName() != "workqueue_depth" {
+				continue
+			}
+			for _, m := range f.GetMetric() {
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "name" {
+						depths[l.GetValue()] = m.GetGauge().GetValue()
+					}
+				}
+			}
+		}
+	}
+	writeJSON(w, map[string]any{"depth": depths})
+}
+
+func call(f func() any) any {
+	if f == nil {
+		return nil
+	}
+	return f()
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
@@ -0,0 +1,60 @@
+package debug
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	depth := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "workqueue_depth"}, []string{"name"})
+	reg.MustRegister(depth)
+	depth.WithLabelValues("statefulset").Set(3)
+
+	s := NewServer("", Sources{
+		Reconciles: func() any { return map[string]string{"ns/sts": "ok"} },
+		Bulk:       func() any { return map[string]int{"pending": 2} },
+		Metrics:    reg,
+	})
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		path     string
+		expected string
+	}{{
+		path:     "/debug/queue",
+		expected: `{"depth": {"statefulset": 3}}`,
+	}, {
+		path:     "/debug/reconciles",
+		expected: `{"ns/sts": "ok"}`,
+	}, {
+		path:     "/debug/gcp-clients",
+		expected: `null`,
+	}, {
+		path:     "/debug/bulk",
+		expected: `{"pending": 2}`,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			res, err := http.Get(srv.URL + tt.path)
+			require.NoError(t, err)
+			defer res.Body.Close()
+			require.Equal(t, http.StatusOK, res.StatusCode)
+			var body json.RawMessage
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+			require.JSONEq(t, tt.expected, string(body))
+		})
+	}
+
+	res, err := http.Get(srv.URL + "/debug/pprof/goroutine?debug=1")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+}
@@ -0,0 +1,135 @@
+package gcp
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"google.golang.org/api/option"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+const (
+	// maxAssetChanges is how many notifications are pulled at once.
+	maxAssetChanges = 100
+	// pullRetryDelay is how long the feed waits before pulling again after failing to.
+	pullRetryDelay = 10 * time.Second
+)
+
+// AssetFeed pulls Cloud Asset Inventory change notifications from a Pub/Sub subscription, and
+// calls a handler with the name of each changed resource, e.g. so that resources deleted out
+// of band are recreated right away. The Cloud Asset feed publishing to the subscription's
+// topic must be created separately.
+//
+// It's a manager.Runnable that only runs on the leader, so that the notifications are
+// handled by the replica that reconciles.
+type AssetFeed struct {
+	log          logr.Logger
+	svc          *pubsub.Service
+	subscription string
+	onChange     func(ctx context.Context, resource string)
+}
+
+// NewAssetFeed returns a feed pulling from cfg.AssetFeedSubscription, which can be a name in
+// cfg.Project or an FQN.
+func NewAssetFeed(ctx context.Context, log logr.Logger, cfg ClientConfig, onChange func(ctx context.Context, resource string), opts ...option.ClientOption) (*AssetFeed, error) {
+	if cfg.AssetFeedSubscription == "" {
+		return nil, errors.New("the asset feed subscription must be set")
+	}
+	credOpts, err := credentialOptions(ctx, cfg.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	svc, err := pubsub.NewService(ctx, append(credOpts, opts...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the Pub/Sub client: %w", err)
+	}
+	sub := cfg.AssetFeedSubscription
+	if !isFQN(sub) {
+		sub = fqnBase(cfg.Project) + "/subscriptions/" + sub
+	}
+	return &AssetFeed{log: log, svc: svc, subscription: sub, onChange: onChange}, nil
+}
+
+// Start pulls notifications until ctx is done.
+func (f *AssetFeed) Start(ctx context.Context) error {
+	f.log.Info("Pulling asset changes.", "subscription", f.subscription)
+	for {
+		err := f.pull(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			f.log.Error(err, "Failed to pull asset changes.", "subscription", f.subscription)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(pullRetryDelay):
+			}
+		}
+	}
+}
+
+// pull handles a batch of notifications, and acknowledges them. Notifications that can't be
+// parsed are acknowledged too, since they'd never be.
+func (f *AssetFeed) pull(ctx context.Context) error {
+	res, err := f.svc.Projects.Subscriptions.Pull(f.subscription, &pubsub.PullRequest{MaxMessages: maxAssetChanges}).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	if len(res.ReceivedMessages) == 0 {
+		return nil
+	}
+	ackIDs := make([]string, 0, len(res.ReceivedMessages))
+	for _, m := range res.ReceivedMessages {
+		ackIDs = append(ackIDs, m.AckId)
+		resource, err := parseAssetChange(m.Message)
+		if err != nil {
+			f.log.Error(err, "Failed to parse an asset change. Dropping it.", "messageID", m.Message.MessageId)
+			continue
+		}
+		f.log.V(1).Info("Asset changed.", "resource", resource)
+		f.onChange(ctx, resource)
+	}
+	_, err = f.svc.Projects.Subscriptions.Acknowledge(f.subscription, &pubsub.AcknowledgeRequest{AckIds: ackIDs}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to acknowledge the asset changes: %w", err)
+	}
+	return nil
+}
+
+// assetChange is the part of a feed's TemporalAsset notifications the controller uses.
+// https://cloud.google.com/asset-inventory/docs/monitor-asset-changes#notification_format
+type assetChange struct {
+	Asset struct {
+		// e.g. //compute.googleapis.com/projects/my-project/global/firewalls/my-firewall
+		Name string `json:"name"`
+	} `json:"asset"`
+}
+
+// parseAssetChange returns the name of the resource that changed, which is the last segment of
+// its full asset name.
+func parseAssetChange(m *pubsub.PubsubMessage) (string, error) {
+	if m == nil {
+		return "", errors.New("empty message")
+	}
+	data, err := base64.StdEncoding.DecodeString(m.Data)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode the message data: %w", err)
+	}
+	change := &assetChange{}
+	err = json.Unmarshal(data, change)
+	if err != nil {
+		return "", fmt.Errorf("failed to unmarshal the asset change: %w", err)
+	}
+	if !strings.HasPrefix(change.Asset.Name, "//") {
+		return "", fmt.Errorf("invalid asset name %q", change.Asset.Name)
+	}
+	return path.Base(change.Asset.Name), nil
+}
@@ -0,0 +1,102 @@
+package gcp
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+func TestParseAssetChange(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		expected    string
+		expectedErr string
+	}{{
+		name:     "Returns the resource's name",
+		data:     `{"asset": {"name": "//compute.googleapis.com/projects/p/regions/r/serviceAttachments/my-svcatt"}, "deleted": true}`,
+		expected: "my-svcatt",
+	}, {
+		name:        "Fails if the asset has no name",
+		data:        `{"deleted": true}`,
+		expectedErr: `invalid asset name ""`,
+	}, {
+		name:        "Fails if the data isn't JSON",
+		data:        `not json`,
+		expectedErr: "failed to unmarshal the asset change: invalid character 'o' in literal null (expecting 'u')",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &pubsub.PubsubMessage{Data: base64.StdEncoding.EncodeToString([]byte(tt.data))}
+			resource, err := parseAssetChange(m)
+			if tt.expectedErr != "" {
+				require.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, resource)
+		})
+	}
+}
+
+func TestAssetFeed(t *testing.T) {
+	messages := []*pubsub.ReceivedMessage{{
+		AckId:   "1",
+		Message: &pubsub.PubsubMessage{Data: base64.StdEncoding.EncodeToString([]byte(`{"asset": {"name": "//compute.googleapis.com/projects/p/global/firewalls/my-fw"}}`))},
+	}, {
+		AckId:   "2",
+		Message: &pubsub.PubsubMessage{Data: "invalid"},
+	}}
+	var mu sync.Mutex
+	var acked []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/projects/my-project/subscriptions/my-sub:pull", func(w http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		res := &pubsub.PullResponse{ReceivedMessages: messages}
+		messages = nil
+		mu.Unlock()
+		_ = json.NewEncoder(w).Encode(res)
+	})
+	mux.HandleFunc("POST /v1/projects/my-project/subscriptions/my-sub:acknowledge", func(w http.ResponseWriter, r *http.Request) {
+		req := &pubsub.AcknowledgeRequest{}
+		_ = json.NewDecoder(r.Body).Decode(req)
+		mu.Lock()
+		acked = append(acked, req.AckIds...)
+		mu.Unlock()
+		_, _ = w.Write([]byte("{}"))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan string, 1)
+	cfg := ClientConfig{Project: "my-project", AssetFeedSubscription: "my-sub"}
+	f, err := NewAssetFeed(ctx, testr.New(t), cfg, func(_ context.Context, resource string) {
+		changed <- resource
+	}, option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+	require.NoError(t, err)
+	done := make(chan error)
+	go func() { done <- f.Start(ctx) }()
+
+	require.Equal(t, "my-fw", <-changed)
+	// Invalid notifications are acknowledged too.
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(acked) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+}
@@ -5,13 +5,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"net/http"
 
 	compute "cloud.google.com/go/compute/apiv1"
 	"cloud.google.com/go/compute/apiv1/computepb"
-	"github.com/google/uuid"
 	"github.com/googleapis/gax-go/v2"
 	"github.com/googleapis/gax-go/v2/apierror"
+	"go.uber.org/multierr"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	"k8s.io/utils/net"
@@ -24,40 +26,139 @@ type ClientError struct {
 
 var ErrNotFound = &ClientError{msg: "not found", status: http.StatusNotFound}
 
+// NewClientError returns an error as the GCP API would return it. It's meant for alternative
+// Client implementations, like fakes.
+func NewClientError(status int, msg string) *ClientError {
+	return &ClientError{msg: msg, status: status}
+}
+
 func (e *ClientError) Error() string {
 	return fmt.Sprintf("%s (status %d)", e.msg, e.status)
 }
 
+// StatusCode returns the HTTP status code of the error, or -1 if it's not an HTTP error.
+func (e *ClientError) StatusCode() int {
+	return e.status
+}
+
+// ManagedDescription is the description of the resources the controller creates, so that it
+// can tell them apart from unrelated ones with the same name.
+const ManagedDescription = "Managed by psc-portmapper."
+
+// Client manages all the resources the controller needs. It's composed of per-resource
+// interfaces, so that code that only deals with some of them can depend on just those.
 type Client interface {
-	// Accessors
+	Scope
+	NEGs
+	Firewalls
+	BackendServices
+	ForwardingRules
+	ServiceAttachments
+	Subnetworks
+	ConsumerEndpoints
+}
+
+// Scope is the project and region resources are managed in, and the network they're created in.
+type Scope interface {
 	Project() string
 	Region() string
-	// NEGs API
+	// Network returns the network's FQN.
+	Network() string
+}
+
+// NetworkScoper is implemented by the clients that can create resources in other networks than
+// their own, e.g. for specs that set their own network.
+type NetworkScoper interface {
+	// InNetwork returns a client creating resources in the network, and in the subnet unless
+	// they set another one. It shares the receiver's connections, so it mustn't be closed.
+	InNetwork(networkFQN, subnetFQN string) Client
+}
+
+// EndpointAnnotator is implemented by the clients that can add more annotations to the
+// endpoints they attach than the ones of ClientConfig, e.g. a spec's endpoint_annotations.
+type EndpointAnnotator interface {
+	// WithEndpointAnnotations returns a client attaching endpoints with the annotations,
+	// merged over ClientConfig's. It shares the receiver's connections, so it mustn't be closed.
+	WithEndpointAnnotations(annotations map[string]string) Client
+}
+
+// NEGs manages port mapping network endpoint groups and their endpoints.
+type NEGs interface {
 	GetNEG(ctx context.Context, name string) (*computepb.NetworkEndpointGroup, error)
-	CreatePortmapNEG(ctx context.Context, name string) error
+	// CreatePortmapNEG creates a port mapping NEG in the subnet, or in the client's subnet if
+	// subnetFQN is empty. defaultPort is the port of the endpoints that don't set one, if set.
+	CreatePortmapNEG(ctx context.Context, name, subnetFQN string, defaultPort *int32) error
 	DeletePortmapNEG(ctx context.Context, name string) error
 	ListEndpoints(ctx context.Context, neg string) ([]*PortMapping, error)
 	AttachEndpoints(ctx context.Context, neg string, mappings []*PortMapping) error
 	DetachEndpoints(ctx context.Context, neg string, mappings []*PortMapping) error
-	// Firewalls API
+}
+
+// Firewalls manages the firewall rules allowing traffic to the node ports. It's the only
+// firewall API the controller uses, so that the backend can be swapped: GCPClient implements
+// it with VPC firewall rules, and another backend, e.g. firewall policies, must describe its
+// rules as a computepb.Firewall in GetFirewall, so that DiffFirewall can compare them, with
+// ManagedDescription as the description of the rules it created.
+type Firewalls interface {
 	GetFirewall(ctx context.Context, name string) (*computepb.Firewall, error)
-	CreateFirewall(ctx context.Context, name string, ports map[int32]struct{}) error
-	UpdateFirewall(ctx context.Context, name string, ports map[int32]struct{}) error
+	CreateFirewall(ctx context.Context, name string, rule FirewallRule) error
+	// UpdateFirewall sets the rule's ports and sources, and enables it if it was disabled.
+	UpdateFirewall(ctx context.Context, name string, rule FirewallRule) error
+	// DisableFirewall disables the rule without deleting it, so that it stops allowing traffic
+	// but can be audited or enabled again.
+	DisableFirewall(ctx context.Context, name string) error
 	DeleteFirewall(ctx context.Context, name string) error
-	// Backend Services API
+}
+
+// BackendServices manages regional backend services.
+type BackendServices interface {
 	GetBackendService(ctx context.Context, name string) (*computepb.BackendService, error)
 	CreateBackendService(ctx context.Context, name string, neg string) error
 	DeleteBackendService(ctx context.Context, name string) error
-	// Forwarding Rules API
+}
+
+// ForwardingRules manages regional forwarding rules.
+type ForwardingRules interface {
 	GetForwardingRule(ctx context.Context, name string) (*computepb.ForwardingRule, error)
-	CreateForwardingRule(ctx context.Context, name, backendSvc string, ip *string, globalAccess *bool) error
+	// CreateForwardingRule creates a rule in the subnet, or in the client's subnet if it's
+	// empty.
+	CreateForwardingRule(ctx context.Context, name, backendSvc, subnetFQN string, ip *string, globalAccess *bool) error
+	// SetForwardingRuleGlobalAccess sets whether the rule can be reached from other regions.
+	SetForwardingRuleGlobalAccess(ctx context.Context, name string, globalAccess bool) error
 	DeleteForwardingRule(ctx context.Context, name string) error
-	// Service Attachments API
+}
+
+// ServiceAttachments manages PSC service attachments.
+type ServiceAttachments interface {
 	GetServiceAttachment(ctx context.Context, name string) (*computepb.ServiceAttachment, error)
-	CreateServiceAttachment(ctx context.Context, name, fwdRuleFQN string, consumers []*computepb.ServiceAttachmentConsumerProjectLimit, natSubnetFQNs []string) error
+	// CreateServiceAttachment creates an attachment accepting the consumers automatically. If
+	// reconcileConnections is set, changes to the accept list apply to the existing connections
+	// too.
+	CreateServiceAttachment(ctx context.Context, name, fwdRuleFQN string, consumers []*computepb.ServiceAttachmentConsumerProjectLimit, natSubnetFQNs []string, reconcileConnections *bool) error
+	// UpdateServiceAttachment replaces the attachment's consumer accept list and NAT subnets,
+	// and sets reconcileConnections unless it's nil.
+	UpdateServiceAttachment(ctx context.Context, name string, consumers []*computepb.ServiceAttachmentConsumerProjectLimit, natSubnetFQNs []string, reconcileConnections *bool) error
 	DeleteServiceAttachment(ctx context.Context, name string) error
 }
 
+// Subnetworks reads subnets, e.g. to know the size of the service attachments' NAT subnets.
+type Subnetworks interface {
+	// GetSubnetwork gets a subnet by FQN, since NAT subnets can be in another project or
+	// region than the rest of the resources.
+	GetSubnetwork(ctx context.Context, fqn string) (*computepb.Subnetwork, error)
+}
+
+// ConsumerEndpoints manages PSC consumer endpoints, i.e. forwarding rules in a consumer's
+// network targeting a service attachment, e.g. canaries verifying that an attachment can be
+// connected to. They're identified by their subnet, since it's in the consumer's project and
+// network rather than the client's.
+type ConsumerEndpoints interface {
+	GetConsumerEndpoint(ctx context.Context, subnetFQN, name string) (*computepb.ForwardingRule, error)
+	// CreateConsumerEndpoint creates an endpoint with an IP in the subnet.
+	CreateConsumerEndpoint(ctx context.Context, subnetFQN, name, svcAttFQN string) error
+	DeleteConsumerEndpoint(ctx context.Context, subnetFQN, name string) error
+}
+
 type GCPClient struct {
 	cfg         *ClientConfig
 	negs        *compute.RegionNetworkEndpointGroupsClient
@@ -65,6 +166,10 @@ type GCPClient struct {
 	backendSvcs *compute.RegionBackendServicesClient
 	fwdRules    *compute.ForwardingRulesClient
 	svcAtts     *compute.ServiceAttachmentsClient
+	subnets     *compute.SubnetworksClient
+	// The annotations of the endpoints it attaches, if they're not cfg's. See
+	// WithEndpointAnnotations.
+	endpointAnnotations map[string]string
 }
 
 type PortMapping struct {
@@ -73,37 +178,82 @@ type PortMapping struct {
 	InstancePort int32
 }
 
-var _ Client = &GCPClient{}
+var (
+	_ Client            = &GCPClient{}
+	_ NetworkScoper     = &GCPClient{}
+	_ EndpointAnnotator = &GCPClient{}
+)
 
 func NewClient(ctx context.Context, cfg ClientConfig, opts ...option.ClientOption) (*GCPClient, error) {
+	credOpts, err := credentialOptions(ctx, cfg.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	// Explicitly passed options take precedence over the configured credentials.
+	return newClient(ctx, cfg, append(credOpts, opts...)...)
+}
+
+func newClient(ctx context.Context, cfg ClientConfig, opts ...option.ClientOption) (*GCPClient, error) {
 	if !isFQN(cfg.Network) {
 		cfg.Network = NetworkFQN(cfg.Project, cfg.Network)
 	}
 	if !isFQN(cfg.Subnetwork) {
 		cfg.Subnetwork = SubnetFQN(cfg.Project, cfg.Region, cfg.Subnetwork)
 	}
-	negs, err := compute.NewRegionNetworkEndpointGroupsRESTClient(ctx, opts...)
+	opts, err := httpOptions(ctx, cfg.HTTP, opts)
 	if err != nil {
 		return nil, err
 	}
-	firewalls, err := compute.NewFirewallsRESTClient(ctx, opts...)
-	if err != nil {
-		return nil, err
+	c := &GCPClient{cfg: &cfg}
+	c.negs, err = compute.NewRegionNetworkEndpointGroupsRESTClient(ctx, opts...)
+	if err == nil {
+		c.firewalls, err = compute.NewFirewallsRESTClient(ctx, opts...)
 	}
-	backendSvcs, err := compute.NewRegionBackendServicesRESTClient(ctx, opts...)
-	if err != nil {
-		return nil, err
+	if err == nil {
+		c.backendSvcs, err = compute.NewRegionBackendServicesRESTClient(ctx, opts...)
 	}
-	fwdRules, err := compute.NewForwardingRulesRESTClient(ctx, opts...)
-	if err != nil {
-		return nil, err
+	if err == nil {
+		c.fwdRules, err = compute.NewForwardingRulesRESTClient(ctx, opts...)
+	}
+	if err == nil {
+		c.svcAtts, err = compute.NewServiceAttachmentsRESTClient(ctx, opts...)
+	}
+	if err == nil {
+		c.subnets, err = compute.NewSubnetworksRESTClient(ctx, opts...)
 	}
-	svcAtts, err := compute.NewServiceAttachmentsRESTClient(ctx, opts...)
 	if err != nil {
-		return nil, err
+		// Don't leak the clients that were created before the failure.
+		return nil, multierr.Append(err, c.Close())
 	}
+	return c, nil
+}
 
-	return &GCPClient{cfg: &cfg, negs: negs, firewalls: firewalls, backendSvcs: backendSvcs, fwdRules: fwdRules, svcAtts: svcAtts}, nil
+// Close closes the underlying compute clients. The client can't be used afterwards.
+func (c *GCPClient) Close() error {
+	closers := []io.Closer{}
+	if c.negs != nil {
+		closers = append(closers, c.negs)
+	}
+	if c.firewalls != nil {
+		closers = append(closers, c.firewalls)
+	}
+	if c.backendSvcs != nil {
+		closers = append(closers, c.backendSvcs)
+	}
+	if c.fwdRules != nil {
+		closers = append(closers, c.fwdRules)
+	}
+	if c.svcAtts != nil {
+		closers = append(closers, c.svcAtts)
+	}
+	if c.subnets != nil {
+		closers = append(closers, c.subnets)
+	}
+	var err error
+	for _, cl := range closers {
+		err = multierr.Append(err, cl.Close())
+	}
+	return err
 }
 
 func (c *GCPClient) Project() string {
@@ -114,6 +264,32 @@ func (c *GCPClient) Region() string {
 	return c.cfg.Region
 }
 
+func (c *GCPClient) Network() string {
+	return c.cfg.Network
+}
+
+func (c *GCPClient) InNetwork(networkFQN, subnetFQN string) Client {
+	cfg := *c.cfg
+	cfg.Network = networkFQN
+	if subnetFQN != "" {
+		cfg.Subnetwork = subnetFQN
+	}
+	inNetwork := *c
+	inNetwork.cfg = &cfg
+	return &inNetwork
+}
+
+func (c *GCPClient) WithEndpointAnnotations(annotations map[string]string) Client {
+	merged := maps.Clone(c.cfg.Annotations)
+	if merged == nil {
+		merged = make(map[string]string, len(annotations))
+	}
+	maps.Copy(merged, annotations)
+	annotated := *c
+	annotated.endpointAnnotations = merged
+	return &annotated
+}
+
 func (c *GCPClient) GetNEG(ctx context.Context, name string) (*computepb.NetworkEndpointGroup, error) {
 	req := &computepb.GetRegionNetworkEndpointGroupRequest{
 		Project:              c.cfg.Project,
@@ -123,36 +299,41 @@ func (c *GCPClient) GetNEG(ctx context.Context, name string) (*computepb.Network
 	return get(ctx, c.negs.Get, req)
 }
 
-func (c *GCPClient) CreatePortmapNEG(ctx context.Context, name string) error {
-	reqID := uuid.New().String()
+func (c *GCPClient) CreatePortmapNEG(ctx context.Context, name, subnetFQN string, defaultPort *int32) error {
+	reqID := requestID(ctx)
 	endpointType := computepb.NetworkEndpointGroup_GCE_VM_IP_PORTMAP.String()
+	if subnetFQN == "" {
+		subnetFQN = c.cfg.Subnetwork
+	}
 	req := &computepb.InsertRegionNetworkEndpointGroupRequest{
 		RequestId: &reqID,
 		Project:   c.cfg.Project,
 		Region:    c.cfg.Region,
 		NetworkEndpointGroupResource: &computepb.NetworkEndpointGroup{
 			Name:                &name,
+			Description:         toPtr(ManagedDescription),
 			Network:             &c.cfg.Network,
-			Subnetwork:          &c.cfg.Subnetwork,
+			Subnetwork:          &subnetFQN,
+			DefaultPort:         defaultPort,
 			Annotations:         c.cfg.Annotations,
 			NetworkEndpointType: &endpointType,
 		},
 	}
-	return call(ctx, c.negs.Insert, req)
+	return call(ctx, c.cfg.Operations, c.negs.Insert, req)
 }
 
 func (c *GCPClient) DeletePortmapNEG(
 	ctx context.Context,
 	name string,
 ) error {
-	reqID := uuid.New().String()
+	reqID := requestID(ctx)
 	req := &computepb.DeleteRegionNetworkEndpointGroupRequest{
 		RequestId:            &reqID,
 		Project:              c.cfg.Project,
 		Region:               c.cfg.Region,
 		NetworkEndpointGroup: name,
 	}
-	return call(ctx, c.negs.Delete, req)
+	return call(ctx, c.cfg.Operations, c.negs.Delete, req)
 }
 
 func (c *GCPClient) ListEndpoints(ctx context.Context, neg string) ([]*PortMapping, error) {
@@ -180,16 +361,20 @@ func (c *GCPClient) ListEndpoints(ctx context.Context, neg string) ([]*PortMappi
 }
 
 func (c *GCPClient) AttachEndpoints(ctx context.Context, neg string, mappings []*PortMapping) error {
+	annotations := c.cfg.Annotations
+	if c.endpointAnnotations != nil {
+		annotations = c.endpointAnnotations
+	}
 	ms := make([]*computepb.NetworkEndpoint, 0, len(mappings))
 	for _, m := range mappings {
 		ms = append(ms, &computepb.NetworkEndpoint{
-			Annotations:           c.cfg.Annotations,
+			Annotations:           annotations,
 			ClientDestinationPort: &m.Port,
 			Instance:              &m.Instance,
 			Port:                  &m.InstancePort,
 		})
 	}
-	reqID := uuid.New().String()
+	reqID := requestID(ctx)
 	req := &computepb.AttachNetworkEndpointsRegionNetworkEndpointGroupRequest{
 		RequestId:            &reqID,
 		Project:              c.cfg.Project,
@@ -199,7 +384,7 @@ func (c *GCPClient) AttachEndpoints(ctx context.Context, neg string, mappings []
 			NetworkEndpoints: ms,
 		},
 	}
-	return call(ctx, c.negs.AttachNetworkEndpoints, req)
+	return call(ctx, c.cfg.Operations, c.negs.AttachNetworkEndpoints, req)
 }
 
 func (c *GCPClient) DetachEndpoints(ctx context.Context, neg string, mappings []*PortMapping) error {
@@ -212,7 +397,7 @@ func (c *GCPClient) DetachEndpoints(ctx context.Context, neg string, mappings []
 			Port:                  &m.InstancePort,
 		})
 	}
-	reqID := uuid.New().String()
+	reqID := requestID(ctx)
 	req := &computepb.DetachNetworkEndpointsRegionNetworkEndpointGroupRequest{
 		RequestId:            &reqID,
 		Project:              c.cfg.Project,
@@ -222,7 +407,7 @@ func (c *GCPClient) DetachEndpoints(ctx context.Context, neg string, mappings []
 			NetworkEndpoints: ms,
 		},
 	}
-	return call(ctx, c.negs.DetachNetworkEndpoints, req)
+	return call(ctx, c.cfg.Operations, c.negs.DetachNetworkEndpoints, req)
 }
 
 func (c *GCPClient) GetFirewall(ctx context.Context, name string) (*computepb.Firewall, error) {
@@ -230,59 +415,80 @@ func (c *GCPClient) GetFirewall(ctx context.Context, name string) (*computepb.Fi
 	return get(ctx, c.firewalls.Get, req)
 }
 
-func (c *GCPClient) CreateFirewall(ctx context.Context, name string, ports map[int32]struct{}) error {
-	reqID := uuid.New().String()
-	priority := int32(1000)
+func (c *GCPClient) CreateFirewall(ctx context.Context, name string, rule FirewallRule) error {
+	reqID := requestID(ctx)
+	req := &computepb.InsertFirewallRequest{
+		RequestId:        &reqID,
+		Project:          c.cfg.Project,
+		FirewallResource: c.firewall(name, rule),
+	}
+	return call(ctx, c.cfg.Operations, c.firewalls.Insert, req)
+}
+
+// UpdateFirewall replaces the rule, rather than patching it, since a patch can't clear its
+// source or destination ranges.
+func (c *GCPClient) UpdateFirewall(ctx context.Context, name string, rule FirewallRule) error {
+	reqID := requestID(ctx)
+	req := &computepb.UpdateFirewallRequest{
+		RequestId:        &reqID,
+		Project:          c.cfg.Project,
+		Firewall:         name,
+		FirewallResource: c.firewall(name, rule),
+	}
+	return call(ctx, c.cfg.Operations, c.firewalls.Update, req)
+}
+
+func (c *GCPClient) firewall(name string, rule FirewallRule) *computepb.Firewall {
 	ingress := computepb.FirewallPolicyRule_INGRESS.String()
-	strPorts := toSortedStr(ports)
+	return &computepb.Firewall{
+		Name:              &name,
+		Description:       toPtr(ManagedDescription),
+		Direction:         &ingress,
+		Network:           &c.cfg.Network,
+		Priority:          toPtr(rule.priority()),
+		Disabled:          toPtr(false),
+		SourceRanges:      rule.SourceRanges,
+		SourceTags:        rule.SourceTags,
+		DestinationRanges: rule.DestinationRanges,
+		Allowed:           allowed(rule),
+	}
+}
 
-	req := &computepb.InsertFirewallRequest{
-		RequestId: &reqID,
-		Project:   c.cfg.Project,
-		FirewallResource: &computepb.Firewall{
-			Name:      &name,
-			Direction: &ingress,
-			Network:   &c.cfg.Network,
-			Priority:  &priority,
-			// TODO: TargetTags: []string{}, OR DestinationRanges: []string{},
-			Allowed: []*computepb.Allowed{{
-				IPProtocol: toPtr(string(net.TCP)),
-				Ports:      strPorts,
-			}},
-		},
+func allowed(rule FirewallRule) []*computepb.Allowed {
+	if rule.ICMP {
+		return []*computepb.Allowed{{IPProtocol: toPtr(rule.protocol())}}
 	}
-	return call(ctx, c.firewalls.Insert, req)
+	return []*computepb.Allowed{{
+		IPProtocol: toPtr(string(net.TCP)),
+		Ports:      toSortedStr(rule.Ports),
+	}}
 }
 
-func (c *GCPClient) UpdateFirewall(ctx context.Context, name string, ports map[int32]struct{}) error {
-	reqID := uuid.New().String()
-	strPorts := toSortedStr(ports)
+func (c *GCPClient) DisableFirewall(ctx context.Context, name string) error {
+	reqID := requestID(ctx)
 	req := &computepb.PatchFirewallRequest{
 		RequestId: &reqID,
 		Project:   c.cfg.Project,
 		Firewall:  name,
 		FirewallResource: &computepb.Firewall{
-			Name: &name,
-			Allowed: []*computepb.Allowed{{
-				IPProtocol: toPtr(string(net.TCP)),
-				Ports:      strPorts,
-			}},
+			Name:     &name,
+			Disabled: toPtr(true),
 		},
 	}
-	return call(ctx, c.firewalls.Patch, req)
+	return call(ctx, c.cfg.Operations, c.firewalls.Patch, req)
 }
 
 func (c *GCPClient) DeleteFirewall(
 	ctx context.Context,
 	name string,
 ) error {
-	reqID := uuid.New().String()
+	reqID := requestID(ctx)
 	req := &computepb.DeleteFirewallRequest{
 		RequestId: &reqID,
 		Project:   c.cfg.Project,
 		Firewall:  name,
 	}
-	return call(ctx, c.firewalls.Delete, req)
+	return call(ctx, c.cfg.Operations, c.firewalls.Delete, req)
 }
 
 func (c *GCPClient) GetBackendService(ctx context.Context, name string) (*computepb.BackendService, error) {
@@ -295,7 +501,7 @@ func (c *GCPClient) GetBackendService(ctx context.Context, name string) (*comput
 }
 
 func (c *GCPClient) CreateBackendService(ctx context.Context, name string, neg string) error {
-	reqID := uuid.New().String()
+	reqID := requestID(ctx)
 	negFQN := NEGFQN(c.cfg.Project, c.cfg.Region, neg)
 	internal := computepb.BackendService_INTERNAL.String()
 	req := &computepb.InsertRegionBackendServiceRequest{
@@ -304,6 +510,7 @@ func (c *GCPClient) CreateBackendService(ctx context.Context, name string, neg s
 		Region:    c.cfg.Region,
 		BackendServiceResource: &computepb.BackendService{
 			Name:                &name,
+			Description:         toPtr(ManagedDescription),
 			Network:             &c.cfg.Network,
 			Protocol:            toPtr(string(net.TCP)),
 			LoadBalancingScheme: &internal,
@@ -314,21 +521,21 @@ func (c *GCPClient) CreateBackendService(ctx context.Context, name string, neg s
 			}},
 		},
 	}
-	return call(ctx, c.backendSvcs.Insert, req)
+	return call(ctx, c.cfg.Operations, c.backendSvcs.Insert, req)
 }
 
 func (c *GCPClient) DeleteBackendService(
 	ctx context.Context,
 	name string,
 ) error {
-	reqID := uuid.New().String()
+	reqID := requestID(ctx)
 	req := &computepb.DeleteRegionBackendServiceRequest{
 		RequestId:      &reqID,
 		Project:        c.cfg.Project,
 		Region:         c.cfg.Region,
 		BackendService: name,
 	}
-	return call(ctx, c.backendSvcs.Delete, req)
+	return call(ctx, c.cfg.Operations, c.backendSvcs.Delete, req)
 }
 
 func (c *GCPClient) GetForwardingRule(ctx context.Context, name string) (*computepb.ForwardingRule, error) {
@@ -340,44 +547,68 @@ func (c *GCPClient) GetForwardingRule(ctx context.Context, name string) (*comput
 	return get(ctx, c.fwdRules.Get, req)
 }
 
-func (c *GCPClient) CreateForwardingRule(ctx context.Context, name, backendSvc string, ip *string, globalAccess *bool) error {
-	reqID := uuid.New().String()
+func (c *GCPClient) CreateForwardingRule(ctx context.Context, name, backendSvc, subnetFQN string, ip *string, globalAccess *bool) error {
+	reqID := requestID(ctx)
 	scheme := computepb.BackendService_INTERNAL.String()
 	tcp := computepb.ForwardingRule_TCP.String()
 	backendFQN := BackendServiceFQN(c.cfg.Project, c.cfg.Region, backendSvc)
 	// AllPorts must be set to true when the target is a backend service with a port mapping network endpoint group backend.
 	allPorts := true
+	if subnetFQN == "" {
+		subnetFQN = c.cfg.Subnetwork
+	}
 	req := &computepb.InsertForwardingRuleRequest{
 		RequestId: &reqID,
 		Project:   c.cfg.Project,
 		Region:    c.cfg.Region,
 		ForwardingRuleResource: &computepb.ForwardingRule{
 			Name:                &name,
+			Description:         toPtr(ManagedDescription),
 			IPAddress:           ip,
 			IPProtocol:          &tcp,
 			AllowGlobalAccess:   globalAccess,
 			BackendService:      &backendFQN,
 			Network:             &c.cfg.Network,
-			Subnetwork:          &c.cfg.Subnetwork,
+			Subnetwork:          &subnetFQN,
 			AllPorts:            &allPorts,
 			LoadBalancingScheme: &scheme,
 		},
 	}
-	return call(ctx, c.fwdRules.Insert, req)
+	return call(ctx, c.cfg.Operations, c.fwdRules.Insert, req)
+}
+
+func (c *GCPClient) SetForwardingRuleGlobalAccess(ctx context.Context, name string, globalAccess bool) error {
+	// Patching requires the rule's current fingerprint, to detect concurrent changes.
+	current, err := c.GetForwardingRule(ctx, name)
+	if err != nil {
+		return err
+	}
+	reqID := requestID(ctx)
+	req := &computepb.PatchForwardingRuleRequest{
+		RequestId:      &reqID,
+		Project:        c.cfg.Project,
+		Region:         c.cfg.Region,
+		ForwardingRule: name,
+		ForwardingRuleResource: &computepb.ForwardingRule{
+			Fingerprint:       current.Fingerprint,
+			AllowGlobalAccess: &globalAccess,
+		},
+	}
+	return call(ctx, c.cfg.Operations, c.fwdRules.Patch, req)
 }
 
 func (c *GCPClient) DeleteForwardingRule(
 	ctx context.Context,
 	name string,
 ) error {
-	reqID := uuid.New().String()
+	reqID := requestID(ctx)
 	req := &computepb.DeleteForwardingRuleRequest{
 		RequestId:      &reqID,
 		Project:        c.cfg.Project,
 		Region:         c.cfg.Region,
 		ForwardingRule: name,
 	}
-	return call(ctx, c.fwdRules.Delete, req)
+	return call(ctx, c.cfg.Operations, c.fwdRules.Delete, req)
 }
 
 func (c *GCPClient) GetServiceAttachment(ctx context.Context, name string) (*computepb.ServiceAttachment, error) {
@@ -395,8 +626,9 @@ func (c *GCPClient) CreateServiceAttachment(
 	fwdRuleFQN string,
 	consumers []*computepb.ServiceAttachmentConsumerProjectLimit,
 	natSubnetFQNs []string,
+	reconcileConnections *bool,
 ) error {
-	reqID := uuid.New().String()
+	reqID := requestID(ctx)
 	acceptAuto := computepb.ServiceAttachment_ACCEPT_AUTOMATIC.String()
 	req := &computepb.InsertServiceAttachmentRequest{
 		RequestId: &reqID,
@@ -404,27 +636,142 @@ func (c *GCPClient) CreateServiceAttachment(
 		Region:    c.cfg.Region,
 		ServiceAttachmentResource: &computepb.ServiceAttachment{
 			Name:                   &name,
+			Description:            toPtr(ManagedDescription),
 			ProducerForwardingRule: &fwdRuleFQN,
 			ConsumerAcceptLists:    consumers,
 			NatSubnets:             natSubnetFQNs,
 			ConnectionPreference:   &acceptAuto,
+			ReconcileConnections:   reconcileConnections,
 		},
 	}
-	return call(ctx, c.svcAtts.Insert, req)
+	return call(ctx, c.cfg.Operations, c.svcAtts.Insert, req)
+}
+
+func (c *GCPClient) UpdateServiceAttachment(
+	ctx context.Context,
+	name string,
+	consumers []*computepb.ServiceAttachmentConsumerProjectLimit,
+	natSubnetFQNs []string,
+	reconcileConnections *bool,
+) error {
+	// Patching requires the attachment's current fingerprint, to detect concurrent changes.
+	current, err := c.GetServiceAttachment(ctx, name)
+	if err != nil {
+		return err
+	}
+	reqID := requestID(ctx)
+	req := &computepb.PatchServiceAttachmentRequest{
+		RequestId:         &reqID,
+		Project:           c.cfg.Project,
+		Region:            c.cfg.Region,
+		ServiceAttachment: name,
+		ServiceAttachmentResource: &computepb.ServiceAttachment{
+			Name:                 &name,
+			Fingerprint:          current.Fingerprint,
+			ConsumerAcceptLists:  consumers,
+			NatSubnets:           natSubnetFQNs,
+			ReconcileConnections: reconcileConnections,
+		},
+	}
+	return call(ctx, c.cfg.Operations, c.svcAtts.Patch, req)
 }
 
 func (c *GCPClient) DeleteServiceAttachment(
 	ctx context.Context,
 	name string,
 ) error {
-	reqID := uuid.New().String()
+	reqID := requestID(ctx)
 	req := &computepb.DeleteServiceAttachmentRequest{
 		RequestId:         &reqID,
 		Project:           c.cfg.Project,
 		Region:            c.cfg.Region,
 		ServiceAttachment: name,
 	}
-	return call(ctx, c.svcAtts.Delete, req)
+	return call(ctx, c.cfg.Operations, c.svcAtts.Delete, req)
+}
+
+func (c *GCPClient) GetSubnetwork(ctx context.Context, fqn string) (*computepb.Subnetwork, error) {
+	project, region, name, err := parseSubnetFQN(fqn)
+	if err != nil {
+		return nil, err
+	}
+	req := &computepb.GetSubnetworkRequest{
+		Project:    project,
+		Region:     region,
+		Subnetwork: name,
+	}
+	return get(ctx, c.subnets.Get, req)
+}
+
+func (c *GCPClient) GetConsumerEndpoint(ctx context.Context, subnetFQN, name string) (*computepb.ForwardingRule, error) {
+	project, region, _, err := parseSubnetFQN(subnetFQN)
+	if err != nil {
+		return nil, err
+	}
+	req := &computepb.GetForwardingRuleRequest{
+		Project:        project,
+		Region:         region,
+		ForwardingRule: name,
+	}
+	return get(ctx, c.fwdRules.Get, req)
+}
+
+func (c *GCPClient) CreateConsumerEndpoint(ctx context.Context, subnetFQN, name, svcAttFQN string) error {
+	project, region, _, err := parseSubnetFQN(subnetFQN)
+	if err != nil {
+		return err
+	}
+	subnet, err := c.GetSubnetwork(ctx, subnetFQN)
+	if err != nil {
+		return err
+	}
+	reqID := requestID(ctx)
+	subnetFQN = RelativeName(subnetFQN)
+	req := &computepb.InsertForwardingRuleRequest{
+		RequestId: &reqID,
+		Project:   project,
+		Region:    region,
+		// PSC endpoints have no load balancing scheme, and get an IP from the subnet unless
+		// they reserve one.
+		ForwardingRuleResource: &computepb.ForwardingRule{
+			Name:        &name,
+			Description: toPtr(ManagedDescription),
+			Target:      &svcAttFQN,
+			Network:     toPtr(RelativeName(subnet.GetNetwork())),
+			Subnetwork:  &subnetFQN,
+		},
+	}
+	return call(ctx, c.cfg.Operations, c.fwdRules.Insert, req)
+}
+
+func (c *GCPClient) DeleteConsumerEndpoint(ctx context.Context, subnetFQN, name string) error {
+	project, region, _, err := parseSubnetFQN(subnetFQN)
+	if err != nil {
+		return err
+	}
+	reqID := requestID(ctx)
+	req := &computepb.DeleteForwardingRuleRequest{
+		RequestId:      &reqID,
+		Project:        project,
+		Region:         region,
+		ForwardingRule: name,
+	}
+	return call(ctx, c.cfg.Operations, c.fwdRules.Delete, req)
+}
+
+// Check verifies that the API is reachable with the client's credentials, by listing at most
+// one firewall rule in the project.
+func (c *GCPClient) Check(ctx context.Context) error {
+	maxResults := uint32(1)
+	req := &computepb.ListFirewallsRequest{
+		Project:    c.cfg.Project,
+		MaxResults: &maxResults,
+	}
+	_, err := c.firewalls.List(ctx, req, callOpts()...).Next()
+	if err != nil && err != iterator.Done {
+		return toClientError(err)
+	}
+	return nil
 }
 
 func callOpts() []gax.CallOption {
@@ -443,14 +790,15 @@ func get[T any, U any, F func(context.Context, T, ...gax.CallOption) (U, error)]
 	return u, toClientError(err)
 }
 
-func call[T any, F func(context.Context, T, ...gax.CallOption) (*compute.Operation, error)](ctx context.Context, f F, req T) error {
+func call[T any, F func(context.Context, T, ...gax.CallOption) (*compute.Operation, error)](ctx context.Context, ops *OperationConfig, f F, req T) error {
 	op, err := f(ctx, req)
 	if err != nil {
 		return toClientError(err)
 	}
-	err = op.Wait(ctx, callOpts()...)
-	if err == nil {
-		return nil
+	err = wait(ctx, op, ops)
+	var oe *OperationError
+	if err == nil || errors.As(err, &oe) {
+		return err
 	}
 	return toClientError(err)
 }
@@ -1,9 +1,60 @@
 package gcp
 
+import "time"
+
 type ClientConfig struct {
-	Project     string            `env:"PROJECT"`
-	Region      string            `env:"REGION"`
-	Network     string            `env:"NETWORK"`
-	Subnetwork  string            `env:"SUBNET"`
-	Annotations map[string]string `env:"ANNOTATIONS"`
+	Project     string             `env:"PROJECT"`
+	Region      string             `env:"REGION"`
+	Network     string             `env:"NETWORK"`
+	Subnetwork  string             `env:"SUBNET"`
+	Annotations map[string]string  `env:"ANNOTATIONS"`
+	Credentials *CredentialsConfig `env:", prefix=CREDENTIALS_"`
+	HTTP        *HTTPConfig        `env:", prefix=HTTP_"`
+	Operations  *OperationConfig   `env:", prefix=OPERATIONS_"`
+	// A Pub/Sub subscription to a Cloud Asset feed of the managed resources, as a name in
+	// Project or an FQN. If set, resources changed out of band are reconciled right away.
+	AssetFeedSubscription string `env:"ASSET_FEED_SUBSCRIPTION"`
+	// The GCS bucket snapshots of the managed resources are written to, optionally followed by
+	// the objects' prefix, e.g. my-bucket/psc-portmapper/. If unset, they're written to
+	// ConfigMaps.
+	SnapshotBucket string `env:"SNAPSHOT_BUCKET"`
+	// The GCS bucket the StatefulSets' state is written to if the controller's external state
+	// is enabled, optionally followed by the objects' prefix. If unset, it's written to
+	// ConfigMaps.
+	StateBucket string `env:"STATE_BUCKET"`
+}
+
+// CredentialsConfig selects how the controller authenticates against GCP. If nothing is
+// set, Application Default Credentials are used.
+type CredentialsConfig struct {
+	// Path to a service account key file.
+	File string `env:"FILE"`
+	// Path to an external account (workload identity federation) credential configuration file.
+	ExternalAccountFile string `env:"EXTERNAL_ACCOUNT_FILE"`
+	// Email of a service account to impersonate, using the credentials above (or ADC) as the
+	// source identity.
+	ImpersonateServiceAccount string `env:"IMPERSONATE_SERVICE_ACCOUNT"`
+	// Optional delegation chain for the impersonation.
+	ImpersonateDelegates []string `env:"IMPERSONATE_DELEGATES"`
+	// The service accounts the credentials Secrets without a key can impersonate, which is
+	// done with the controller's identity, as <namespace>/<service account> entries, so that
+	// the Secrets of a namespace can only impersonate the ones allowed for it. Secrets with a
+	// key impersonate with their own.
+	SecretImpersonationTargets []string `env:"SECRET_IMPERSONATION_TARGETS"`
+	// The files and URLs the external account configurations in credentials Secrets can read
+	// their subject token from, since it's read by the controller.
+	SecretCredentialSources []string `env:"SECRET_CREDENTIAL_SOURCES"`
+}
+
+// HTTPConfig tunes the HTTP transport shared by the compute clients. Zero values keep the
+// client library defaults.
+type HTTPConfig struct {
+	MaxIdleConnsPerHost int           `env:"MAX_IDLE_CONNS_PER_HOST"`
+	IdleConnTimeout     time.Duration `env:"IDLE_CONN_TIMEOUT"`
+	KeepAlive           time.Duration `env:"KEEPALIVE"`
+	ReadIdleTimeout     time.Duration `env:"READ_IDLE_TIMEOUT"`
+}
+
+func (c *HTTPConfig) isZero() bool {
+	return *c == HTTPConfig{}
 }
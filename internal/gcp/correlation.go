@@ -0,0 +1,40 @@
+package gcp
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+)
+
+type correlationKey struct{}
+
+type correlation struct {
+	id   uuid.UUID
+	sent atomic.Int64
+}
+
+// WithCorrelationID returns a context whose mutating requests have request IDs derived from id,
+// so that GCP audit log entries can be matched to the controller's logs. The first request's
+// ID is id itself. Request IDs must be unique, so the next ones are derived from id and their
+// sequence number.
+func WithCorrelationID(ctx context.Context, id uuid.UUID) context.Context {
+	return context.WithValue(ctx, correlationKey{}, &correlation{id: id})
+}
+
+// requestID returns the ID for a mutating request, which makes retrying it idempotent. It's
+// logged along with the context's logger's values, e.g. the correlation ID.
+func requestID(ctx context.Context) string {
+	id := uuid.New()
+	if c, ok := ctx.Value(correlationKey{}).(*correlation); ok {
+		n := c.sent.Add(1) - 1
+		id = c.id
+		if n > 0 {
+			id = uuid.NewSHA1(c.id, []byte(strconv.FormatInt(n, 10)))
+		}
+	}
+	logr.FromContextOrDiscard(ctx).V(1).Info("Sending a GCP request.", "request_id", id.String())
+	return id.String()
+}
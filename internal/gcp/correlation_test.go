@@ -0,0 +1,25 @@
+package gcp
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestID(t *testing.T) {
+	id := uuid.New()
+	ctx := WithCorrelationID(context.Background(), id)
+	first, second, third := requestID(ctx), requestID(ctx), requestID(ctx)
+	require.Equal(t, id.String(), first, "expected the first request ID to be the correlation ID")
+	require.NotEqual(t, first, second)
+	require.NotEqual(t, second, third)
+
+	// They're derived deterministically from the correlation ID.
+	ctx = WithCorrelationID(context.Background(), id)
+	require.Equal(t, []string{first, second, third}, []string{requestID(ctx), requestID(ctx), requestID(ctx)})
+
+	// Without a correlation ID, they're random.
+	require.NotEqual(t, requestID(context.Background()), requestID(context.Background()))
+}
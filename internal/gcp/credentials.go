@@ -0,0 +1,196 @@
+package gcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	compute "cloud.google.com/go/compute/apiv1"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+const (
+	serviceAccountKeyType = "service_account"
+	externalAccountType   = "external_account"
+)
+
+// ErrCredentialsNotAllowed is returned for runtime credentials that would make the controller
+// use its own identity, files or network on behalf of whoever provided them.
+var ErrCredentialsNotAllowed = errors.New("credentials not allowed")
+
+// Credentials are credentials provided at runtime (e.g. read from a Secret), rather than
+// through the controller's config.
+type Credentials struct {
+	// Identifies where the credentials come from (e.g. the Secret's namespace/name), so that
+	// clients built for outdated credentials can be replaced when they're rotated.
+	ID string
+	// The namespace the credentials were read from, which determines the service accounts
+	// they can impersonate without a key. See CredentialsConfig.SecretImpersonationTargets.
+	Namespace string
+	// A service account key or an external account (workload identity federation) configuration.
+	JSON []byte
+	// Email of a service account to impersonate.
+	ImpersonateServiceAccount string
+}
+
+// credentialOptions builds the client options needed to authenticate with the configured
+// credentials. It returns no options when cfg is empty, so that the compute clients fall
+// back to Application Default Credentials.
+func credentialOptions(ctx context.Context, cfg *CredentialsConfig) ([]option.ClientOption, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.File != "" && cfg.ExternalAccountFile != "" {
+		return nil, errors.New("a credentials file and an external account file can't both be set")
+	}
+
+	var opts []option.ClientOption
+	switch {
+	case cfg.File != "":
+		creds, err := credentialsFromFile(ctx, cfg.File, serviceAccountKeyType)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, option.WithCredentials(creds))
+	case cfg.ExternalAccountFile != "":
+		creds, err := credentialsFromFile(ctx, cfg.ExternalAccountFile, externalAccountType)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, option.WithCredentials(creds))
+	}
+	return impersonationOptions(ctx, cfg.ImpersonateServiceAccount, cfg.ImpersonateDelegates, opts)
+}
+
+// runtimeCredentialOptions builds the client options for credentials provided at runtime.
+// If no key is given, the impersonation uses the controller's own identity, so it's only
+// allowed for the service accounts cfg.SecretImpersonationTargets allows for the credentials'
+// namespace. Since the controller
+// reads the subject tokens of external account configurations, their credential source must
+// be in cfg.SecretCredentialSources.
+func runtimeCredentialOptions(ctx context.Context, base []option.ClientOption, cfg *CredentialsConfig, c *Credentials) ([]option.ClientOption, error) {
+	if c == nil {
+		return base, nil
+	}
+	if cfg == nil {
+		cfg = &CredentialsConfig{}
+	}
+	opts := base
+	if len(c.JSON) > 0 {
+		err := checkExternalAccount(c.JSON, cfg.SecretCredentialSources)
+		if err != nil {
+			return nil, err
+		}
+		creds, err := credentialsFromJSON(ctx, c.JSON, "secret", serviceAccountKeyType, externalAccountType)
+		if err != nil {
+			return nil, err
+		}
+		opts = []option.ClientOption{option.WithCredentials(creds)}
+	} else if c.ImpersonateServiceAccount != "" && !slices.Contains(cfg.SecretImpersonationTargets, c.Namespace+"/"+c.ImpersonateServiceAccount) {
+		return nil, fmt.Errorf("%w: the controller's identity can't impersonate service account %s, as it isn't one of the impersonation targets allowed for namespace %q. Set a key to impersonate it with",
+			ErrCredentialsNotAllowed, c.ImpersonateServiceAccount, c.Namespace)
+	}
+	return impersonationOptions(ctx, c.ImpersonateServiceAccount, nil, opts)
+}
+
+// checkExternalAccount returns an error if data is an external account configuration whose
+// subject token isn't read from one of the allowed files or URLs, or which sends it anywhere
+// but Google's APIs. Other credential sources, e.g. executables or AWS' metadata, are
+// rejected, since they'd run or use the controller's own.
+func checkExternalAccount(data []byte, allowedSources []string) error {
+	var f struct {
+		Type                           string                     `json:"type"`
+		TokenURL                       string                     `json:"token_url"`
+		ServiceAccountImpersonationURL string                     `json:"service_account_impersonation_url"`
+		CredentialSource               map[string]json.RawMessage `json:"credential_source"`
+	}
+	err := json.Unmarshal(data, &f)
+	if err != nil || f.Type != externalAccountType {
+		// Decoding errors are reported by credentialsFromJSON.
+		return nil
+	}
+	for _, u := range []string{f.TokenURL, f.ServiceAccountImpersonationURL} {
+		if u == "" {
+			continue
+		}
+		parsed, err := url.Parse(u)
+		if err != nil || parsed.Scheme != "https" || !strings.HasSuffix(parsed.Hostname(), ".googleapis.com") {
+			return fmt.Errorf("%w: the external account configuration sends its tokens to %s, which isn't a Google API", ErrCredentialsNotAllowed, u)
+		}
+	}
+	var source string
+	for k, v := range f.CredentialSource {
+		switch k {
+		case "file", "url":
+			if source != "" || json.Unmarshal(v, &source) != nil {
+				return fmt.Errorf("%w: the external account configuration's credential source must set one file or URL", ErrCredentialsNotAllowed)
+			}
+		case "format", "headers":
+		default:
+			return fmt.Errorf("%w: the external account configuration's credential source can't set %s", ErrCredentialsNotAllowed, k)
+		}
+	}
+	if !slices.Contains(allowedSources, source) {
+		return fmt.Errorf("%w: the external account configuration's credential source %q isn't one of the allowed ones", ErrCredentialsNotAllowed, source)
+	}
+	return nil
+}
+
+// validateImpersonationTargets returns an error if a target isn't <namespace>/<service account>.
+func validateImpersonationTargets(targets []string) error {
+	for _, t := range targets {
+		namespace, sa, ok := strings.Cut(t, "/")
+		if !ok || namespace == "" || sa == "" {
+			return fmt.Errorf("invalid secret impersonation target %q, it must be <namespace>/<service account>", t)
+		}
+	}
+	return nil
+}
+
+func impersonationOptions(ctx context.Context, target string, delegates []string, opts []option.ClientOption) ([]option.ClientOption, error) {
+	if target == "" {
+		return opts, nil
+	}
+	ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: target,
+		Delegates:       delegates,
+		Scopes:          compute.DefaultAuthScopes(),
+	}, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to impersonate service account %s: %w", target, err)
+	}
+	return []option.ClientOption{option.WithTokenSource(ts)}, nil
+}
+
+func credentialsFromFile(ctx context.Context, path, expectedType string) (*google.Credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials file %s: %w", path, err)
+	}
+	return credentialsFromJSON(ctx, data, "file "+path, expectedType)
+}
+
+func credentialsFromJSON(ctx context.Context, data []byte, source string, allowedTypes ...string) (*google.Credentials, error) {
+	var f struct {
+		Type string `json:"type"`
+	}
+	err := json.Unmarshal(data, &f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode credentials %s: %w", source, err)
+	}
+	if !slices.Contains(allowedTypes, f.Type) {
+		return nil, fmt.Errorf("expected credentials %s to be of type %q, got %q", source, allowedTypes, f.Type)
+	}
+	creds, err := google.CredentialsFromJSON(ctx, data, compute.DefaultAuthScopes()...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load credentials %s: %w", source, err)
+	}
+	return creds, nil
+}
@@ -0,0 +1,156 @@
+package gcp
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentialOptions(t *testing.T) {
+	dir := t.TempDir()
+	externalAccount := filepath.Join(dir, "external-account.json")
+	err := os.WriteFile(externalAccount, []byte(`{
+		"type": "external_account",
+		"audience": "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider",
+		"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+		"token_url": "https://sts.googleapis.com/v1/token",
+		"credential_source": {"file": "/var/run/token"}
+	}`), 0o600)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		cfg         *CredentialsConfig
+		expectedLen int
+		expectedErr string
+	}{{
+		name: "Uses ADC if the config is nil",
+	}, {
+		name: "Uses ADC if the config is empty",
+		cfg:  &CredentialsConfig{},
+	}, {
+		name:        "Fails if both a key file and an external account file are set",
+		cfg:         &CredentialsConfig{File: "key.json", ExternalAccountFile: "wif.json"},
+		expectedErr: "a credentials file and an external account file can't both be set",
+	}, {
+		name:        "Fails if the file doesn't exist",
+		cfg:         &CredentialsConfig{File: filepath.Join(dir, "missing.json")},
+		expectedErr: "failed to read credentials file " + filepath.Join(dir, "missing.json") + ": open " + filepath.Join(dir, "missing.json") + ": no such file or directory",
+	}, {
+		name:        "Fails if the file type doesn't match",
+		cfg:         &CredentialsConfig{File: externalAccount},
+		expectedErr: "expected credentials file " + externalAccount + " to be of type [\"service_account\"], got \"external_account\"",
+	}, {
+		name:        "Loads external account credentials",
+		cfg:         &CredentialsConfig{ExternalAccountFile: externalAccount},
+		expectedLen: 1,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := credentialOptions(context.Background(), tt.cfg)
+			if tt.expectedErr != "" {
+				require.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, opts, tt.expectedLen)
+		})
+	}
+}
+
+func TestRuntimeCredentialOptions(t *testing.T) {
+	externalAccount := func(source, tokenURL string) []byte {
+		return []byte(`{
+			"type": "external_account",
+			"audience": "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider",
+			"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+			"token_url": "` + tokenURL + `",
+			"credential_source": ` + source + `
+		}`)
+	}
+	cfg := &CredentialsConfig{
+		SecretImpersonationTargets: []string{"team-a/allowed@my-project.iam.gserviceaccount.com"},
+		SecretCredentialSources:    []string{"/var/run/tenant/token"},
+	}
+	sts := "https://sts.googleapis.com/v1/token"
+
+	tests := []struct {
+		name        string
+		cfg         *CredentialsConfig
+		creds       *Credentials
+		expectedLen int
+		expectedErr string
+	}{{
+		name: "Uses the base options without credentials",
+		cfg:  cfg,
+	}, {
+		name:        "Fails to impersonate a service account that isn't allowed with the controller's identity",
+		cfg:         cfg,
+		creds:       &Credentials{Namespace: "team-a", ImpersonateServiceAccount: "other@my-project.iam.gserviceaccount.com"},
+		expectedErr: "the controller's identity can't impersonate service account other@my-project.iam.gserviceaccount.com",
+	}, {
+		name:        "Fails to impersonate a service account allowed for another namespace",
+		cfg:         cfg,
+		creds:       &Credentials{Namespace: "team-b", ImpersonateServiceAccount: "allowed@my-project.iam.gserviceaccount.com"},
+		expectedErr: `the controller's identity can't impersonate service account allowed@my-project.iam.gserviceaccount.com, as it isn't one of the impersonation targets allowed for namespace "team-b"`,
+	}, {
+		name:        "Fails to impersonate without allowed targets",
+		creds:       &Credentials{Namespace: "team-a", ImpersonateServiceAccount: "allowed@my-project.iam.gserviceaccount.com"},
+		expectedErr: "the controller's identity can't impersonate service account allowed@my-project.iam.gserviceaccount.com",
+	}, {
+		name:        "Loads external account credentials with an allowed file",
+		cfg:         cfg,
+		creds:       &Credentials{JSON: externalAccount(`{"file": "/var/run/tenant/token"}`, sts)},
+		expectedLen: 1,
+	}, {
+		name:        "Fails for external accounts reading other files",
+		cfg:         cfg,
+		creds:       &Credentials{JSON: externalAccount(`{"file": "/var/run/secrets/kubernetes.io/serviceaccount/token"}`, sts)},
+		expectedErr: `the external account configuration's credential source "/var/run/secrets/kubernetes.io/serviceaccount/token" isn't one of the allowed ones`,
+	}, {
+		name:        "Fails for external accounts calling other URLs",
+		cfg:         cfg,
+		creds:       &Credentials{JSON: externalAccount(`{"url": "http://169.254.169.254/computeMetadata/v1/instance/service-accounts/default/token"}`, sts)},
+		expectedErr: "isn't one of the allowed ones",
+	}, {
+		name:        "Fails for external accounts running executables",
+		cfg:         cfg,
+		creds:       &Credentials{JSON: externalAccount(`{"executable": {"command": "cat /etc/passwd"}}`, sts)},
+		expectedErr: "the external account configuration's credential source can't set executable",
+	}, {
+		name:        "Fails for external accounts using the controller's AWS credentials",
+		cfg:         cfg,
+		creds:       &Credentials{JSON: externalAccount(`{"environment_id": "aws1", "file": "/var/run/tenant/token"}`, sts)},
+		expectedErr: "the external account configuration's credential source can't set environment_id",
+	}, {
+		name:        "Fails for external accounts sending their token elsewhere",
+		cfg:         cfg,
+		creds:       &Credentials{JSON: externalAccount(`{"file": "/var/run/tenant/token"}`, "https://example.com/token")},
+		expectedErr: "the external account configuration sends its tokens to https://example.com/token, which isn't a Google API",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := runtimeCredentialOptions(context.Background(), nil, tt.cfg, tt.creds)
+			if tt.expectedErr != "" {
+				require.ErrorIs(t, err, ErrCredentialsNotAllowed)
+				require.ErrorContains(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, opts, tt.expectedLen)
+		})
+	}
+}
+
+func TestValidateImpersonationTargets(t *testing.T) {
+	require.NoError(t, validateImpersonationTargets(nil))
+	require.NoError(t, validateImpersonationTargets([]string{"team-a/sa@my-project.iam.gserviceaccount.com"}))
+	for _, target := range []string{"sa@my-project.iam.gserviceaccount.com", "/sa@my-project.iam.gserviceaccount.com", "team-a/"} {
+		require.ErrorContains(t, validateImpersonationTargets([]string{target}), "it must be <namespace>/<service account>")
+	}
+}
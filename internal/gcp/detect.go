@@ -0,0 +1,83 @@
+package gcp
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"go.uber.org/multierr"
+)
+
+// Metadata is the part of the GCE metadata server client used to detect the configuration.
+type Metadata interface {
+	ProjectIDWithContext(ctx context.Context) (string, error)
+	ZoneWithContext(ctx context.Context) (string, error)
+	GetWithContext(ctx context.Context, suffix string) (string, error)
+}
+
+// Detect fills in cfg's project, region and network if they're unset. They're read from the
+// metadata server if md isn't nil, which is the case when running on GCE or GKE. The project
+// and region can also be inferred from the cluster's nodes' provider IDs, which are tried if
+// the metadata server isn't available. It returns an error if any of them is still unset.
+func Detect(ctx context.Context, cfg *ClientConfig, md Metadata, providerIDs []string) error {
+	var errs error
+	if md != nil {
+		if cfg.Project == "" {
+			p, err := md.ProjectIDWithContext(ctx)
+			errs = multierr.Append(errs, err)
+			cfg.Project = p
+		}
+		if cfg.Region == "" {
+			z, err := md.ZoneWithContext(ctx)
+			errs = multierr.Append(errs, err)
+			if z != "" {
+				cfg.Region = regionOf(z)
+			}
+		}
+		if cfg.Network == "" {
+			// Formatted like projects/<project-number>/networks/<name>. Only the name is kept,
+			// because resources are referenced by project ID.
+			n, err := md.GetWithContext(ctx, "instance/network-interfaces/0/network")
+			errs = multierr.Append(errs, err)
+			if n != "" {
+				cfg.Network = path.Base(strings.TrimSpace(n))
+			}
+		}
+	}
+	for _, id := range providerIDs {
+		if cfg.Project != "" && cfg.Region != "" {
+			break
+		}
+		project, zone, _, err := ParseProviderID(id)
+		if err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+		if cfg.Project == "" {
+			cfg.Project = project
+		}
+		if cfg.Region == "" {
+			cfg.Region = regionOf(zone)
+		}
+	}
+
+	var missing []string
+	for _, f := range []struct{ name, value string }{
+		{"GCP_PROJECT", cfg.Project},
+		{"GCP_REGION", cfg.Region},
+		{"GCP_NETWORK", cfg.Network},
+	} {
+		if f.value == "" {
+			missing = append(missing, f.name)
+		}
+	}
+	if len(missing) > 0 {
+		err := fmt.Errorf("couldn't detect %s, they must be set", strings.Join(missing, ", "))
+		if errs != nil {
+			err = fmt.Errorf("%w: %w", err, errs)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMetadata is a metadata server that fails if err is set.
+type fakeMetadata struct {
+	project, zone, network string
+	err                    error
+}
+
+func (m *fakeMetadata) ProjectIDWithContext(context.Context) (string, error) {
+	return m.project, m.err
+}
+
+func (m *fakeMetadata) ZoneWithContext(context.Context) (string, error) {
+	return m.zone, m.err
+}
+
+func (m *fakeMetadata) GetWithContext(_ context.Context, suffix string) (string, error) {
+	if suffix != "instance/network-interfaces/0/network" {
+		return "", errors.New("unexpected metadata key " + suffix)
+	}
+	return m.network, m.err
+}
+
+func TestDetect(t *testing.T) {
+	md := &fakeMetadata{project: "md-project", zone: "us-east1-b", network: "projects/1234/networks/md-network"}
+
+	tests := []struct {
+		name        string
+		cfg         ClientConfig
+		md          Metadata
+		providerIDs []string
+		expected    ClientConfig
+		expectedErr string
+	}{{
+		name:     "Keeps the configured values",
+		cfg:      ClientConfig{Project: "p", Region: "r", Network: "n"},
+		md:       md,
+		expected: ClientConfig{Project: "p", Region: "r", Network: "n"},
+	}, {
+		name:     "Fills in unset values from the metadata server",
+		cfg:      ClientConfig{Region: "europe-west1"},
+		md:       md,
+		expected: ClientConfig{Project: "md-project", Region: "europe-west1", Network: "md-network"},
+	}, {
+		name:        "Falls back to the nodes' provider IDs",
+		cfg:         ClientConfig{Network: "n"},
+		providerIDs: []string{"invalid", "gce://node-project/asia-east1-a/instance-1"},
+		expected:    ClientConfig{Project: "node-project", Region: "asia-east1", Network: "n"},
+	}, {
+		name:        "Fails if the network can't be detected",
+		md:          &fakeMetadata{err: errors.New("metadata server unavailable")},
+		providerIDs: []string{"gce://node-project/asia-east1-a/instance-1"},
+		expectedErr: "couldn't detect GCP_NETWORK, they must be set: metadata server unavailable",
+	}, {
+		name:        "Fails if nothing can be detected",
+		expectedErr: "couldn't detect GCP_PROJECT, GCP_REGION, GCP_NETWORK",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			err := Detect(context.Background(), &cfg, tt.md, tt.providerIDs)
+			if tt.expectedErr != "" {
+				require.ErrorContains(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, cfg)
+		})
+	}
+}
@@ -0,0 +1,663 @@
+// Package fake implements gcp.Client with in-memory resources, for tests and local development.
+package fake
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"google.golang.org/protobuf/proto"
+)
+
+// Client is a stateful, in-memory gcp.Client. Resources behave like their GCP counterparts
+// as far as the controller is concerned: they can't be created twice, getting or deleting a
+// missing resource returns gcp.ErrNotFound, and resources can't be deleted while others
+// depend on them.
+type Client struct {
+	project string
+	region  string
+	network string
+	subnet  string
+	// The annotations of the endpoints it attaches. See WithEndpointAnnotations.
+	endpointAnnotations map[string]string
+	// Shared with the clients returned by InNetwork and WithEndpointAnnotations.
+	*resources
+}
+
+type resources struct {
+	mu        sync.Mutex
+	negs      map[string]*computepb.NetworkEndpointGroup
+	endpoints map[string]map[int32]gcp.PortMapping
+	// The annotations of each NEG's endpoints, by port.
+	endpointAnnotations map[string]map[int32]map[string]string
+	firewalls           map[string]*computepb.Firewall
+	backends            map[string]*computepb.BackendService
+	fwdRules            map[string]*computepb.ForwardingRule
+	svcAtts             map[string]*computepb.ServiceAttachment
+	// Keyed by FQN, since they're not managed in the client's project and region.
+	subnets           map[string]*computepb.Subnetwork
+	consumerEndpoints map[string]*computepb.ForwardingRule
+	// Used to assign forwarding rules an IP when they don't request one.
+	nextIP int
+}
+
+var (
+	_ gcp.Client            = &Client{}
+	_ gcp.NetworkScoper     = &Client{}
+	_ gcp.EndpointAnnotator = &Client{}
+)
+
+func New(project, region string) *Client {
+	return &Client{
+		project: project,
+		region:  region,
+		network: gcp.NetworkFQN(project, "default"),
+		subnet:  gcp.SubnetFQN(project, region, "default"),
+		resources: &resources{
+			negs:      map[string]*computepb.NetworkEndpointGroup{},
+			endpoints: map[string]map[int32]gcp.PortMapping{},
+			firewalls: map[string]*computepb.Firewall{},
+			backends:  map[string]*computepb.BackendService{},
+			fwdRules:  map[string]*computepb.ForwardingRule{},
+			svcAtts:   map[string]*computepb.ServiceAttachment{},
+			subnets:   map[string]*computepb.Subnetwork{},
+			nextIP:    2,
+
+			consumerEndpoints:   map[string]*computepb.ForwardingRule{},
+			endpointAnnotations: map[string]map[int32]map[string]string{},
+		},
+	}
+}
+
+func (c *Client) Project() string {
+	return c.project
+}
+
+func (c *Client) Region() string {
+	return c.region
+}
+
+func (c *Client) Network() string {
+	return c.network
+}
+
+// InNetwork returns a client creating resources in the network, which shares the receiver's
+// resources.
+func (c *Client) InNetwork(networkFQN, subnetFQN string) gcp.Client {
+	inNetwork := *c
+	inNetwork.network = networkFQN
+	if subnetFQN != "" {
+		inNetwork.subnet = subnetFQN
+	}
+	return &inNetwork
+}
+
+// WithEndpointAnnotations returns a client attaching endpoints with the annotations, which
+// shares the receiver's resources.
+func (c *Client) WithEndpointAnnotations(annotations map[string]string) gcp.Client {
+	annotated := *c
+	annotated.endpointAnnotations = maps.Clone(annotations)
+	return &annotated
+}
+
+// EndpointAnnotations returns the annotations the NEG's endpoint for the port was attached
+// with.
+func (c *Client) EndpointAnnotations(neg string, port int32) map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.resources.endpointAnnotations[neg][port]
+}
+
+func (c *Client) GetNEG(_ context.Context, name string) (*computepb.NetworkEndpointGroup, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return getResource(c.negs, name)
+}
+
+func (c *Client) CreatePortmapNEG(_ context.Context, name, subnetFQN string, defaultPort *int32) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	endpointType := computepb.NetworkEndpointGroup_GCE_VM_IP_PORTMAP.String()
+	if subnetFQN == "" {
+		subnetFQN = c.subnet
+	}
+	err := insertResource(c.negs, name, &computepb.NetworkEndpointGroup{
+		Name:                &name,
+		Description:         proto.String(gcp.ManagedDescription),
+		SelfLink:            proto.String(gcp.NEGFQN(c.project, c.region, name)),
+		Network:             &c.network,
+		Subnetwork:          &subnetFQN,
+		DefaultPort:         defaultPort,
+		NetworkEndpointType: &endpointType,
+		Size:                proto.Int32(0),
+	})
+	if err != nil {
+		return err
+	}
+	c.endpoints[name] = map[int32]gcp.PortMapping{}
+	return nil
+}
+
+func (c *Client) DeletePortmapNEG(_ context.Context, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fqn := gcp.NEGFQN(c.project, c.region, name)
+	for beName, be := range c.backends {
+		for _, b := range be.Backends {
+			if b.GetGroup() == fqn {
+				return inUse(fqn, gcp.BackendServiceFQN(c.project, c.region, beName))
+			}
+		}
+	}
+	err := deleteResource(c.negs, name)
+	if err != nil {
+		return err
+	}
+	delete(c.endpoints, name)
+	delete(c.resources.endpointAnnotations, name)
+	return nil
+}
+
+func (c *Client) ListEndpoints(_ context.Context, neg string) ([]*gcp.PortMapping, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	eps, ok := c.endpoints[neg]
+	if !ok {
+		return nil, gcp.ErrNotFound
+	}
+	ms := make([]*gcp.PortMapping, 0, len(eps))
+	for _, m := range eps {
+		ms = append(ms, &m)
+	}
+	slices.SortFunc(ms, func(a, b *gcp.PortMapping) int { return cmp.Compare(a.Port, b.Port) })
+	return ms, nil
+}
+
+func (c *Client) AttachEndpoints(_ context.Context, neg string, mappings []*gcp.PortMapping) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	eps, ok := c.endpoints[neg]
+	if !ok {
+		return gcp.ErrNotFound
+	}
+	// Validate everything first, as the API doesn't attach endpoints partially.
+	for _, m := range mappings {
+		if existing, ok := eps[m.Port]; ok && existing != *m {
+			msg := fmt.Sprintf("client destination port %d is already in use by another endpoint in %s", m.Port, neg)
+			return gcp.NewClientError(http.StatusBadRequest, msg)
+		}
+	}
+	if c.resources.endpointAnnotations[neg] == nil {
+		c.resources.endpointAnnotations[neg] = map[int32]map[string]string{}
+	}
+	for _, m := range mappings {
+		eps[m.Port] = *m
+		c.resources.endpointAnnotations[neg][m.Port] = c.endpointAnnotations
+	}
+	c.negs[neg].Size = proto.Int32(int32(len(eps)))
+	return nil
+}
+
+func (c *Client) DetachEndpoints(_ context.Context, neg string, mappings []*gcp.PortMapping) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	eps, ok := c.endpoints[neg]
+	if !ok {
+		return gcp.ErrNotFound
+	}
+	for _, m := range mappings {
+		if existing, ok := eps[m.Port]; !ok || existing != *m {
+			msg := fmt.Sprintf("endpoint for client destination port %d isn't attached to %s", m.Port, neg)
+			return gcp.NewClientError(http.StatusBadRequest, msg)
+		}
+	}
+	for _, m := range mappings {
+		delete(eps, m.Port)
+		delete(c.resources.endpointAnnotations[neg], m.Port)
+	}
+	c.negs[neg].Size = proto.Int32(int32(len(eps)))
+	return nil
+}
+
+func (c *Client) GetFirewall(_ context.Context, name string) (*computepb.Firewall, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return getResource(c.firewalls, name)
+}
+
+func (c *Client) CreateFirewall(_ context.Context, name string, rule gcp.FirewallRule) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ingress := computepb.FirewallPolicyRule_INGRESS.String()
+	return insertResource(c.firewalls, name, &computepb.Firewall{
+		Name:              &name,
+		Description:       proto.String(gcp.ManagedDescription),
+		SelfLink:          proto.String(gcp.FirewallFQN(c.project, name)),
+		Direction:         &ingress,
+		Network:           &c.network,
+		Priority:          proto.Int32(priority(rule)),
+		SourceRanges:      rule.SourceRanges,
+		SourceTags:        rule.SourceTags,
+		DestinationRanges: rule.DestinationRanges,
+		Allowed:           allowed(rule),
+	})
+}
+
+// AddFirewall adds a firewall as if it was created out of band, e.g. by a user, so it can
+// have any description.
+func (c *Client) AddFirewall(name, description string, ports map[int32]struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ingress := computepb.FirewallPolicyRule_INGRESS.String()
+	c.firewalls[name] = &computepb.Firewall{
+		Name:        &name,
+		Description: &description,
+		SelfLink:    proto.String(gcp.FirewallFQN(c.project, name)),
+		Direction:   &ingress,
+		Network:     &c.network,
+		Priority:    proto.Int32(1000),
+		Allowed:     allowedTCP(ports),
+	}
+}
+
+// ClearDescriptions clears the descriptions of all the resources, as if they were created by
+// a controller that didn't mark the ones it created.
+func (c *Client) ClearDescriptions() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range c.negs {
+		r.Description = nil
+	}
+	for _, r := range c.firewalls {
+		r.Description = nil
+	}
+	for _, r := range c.backends {
+		r.Description = nil
+	}
+	for _, r := range c.fwdRules {
+		r.Description = nil
+	}
+	for _, r := range c.svcAtts {
+		r.Description = nil
+	}
+}
+
+func (c *Client) UpdateFirewall(_ context.Context, name string, rule gcp.FirewallRule) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fw, ok := c.firewalls[name]
+	if !ok {
+		return gcp.ErrNotFound
+	}
+	fw.Allowed = allowed(rule)
+	fw.Priority = proto.Int32(priority(rule))
+	fw.SourceRanges = rule.SourceRanges
+	fw.SourceTags = rule.SourceTags
+	fw.DestinationRanges = rule.DestinationRanges
+	fw.Disabled = nil
+	return nil
+}
+
+func (c *Client) DisableFirewall(_ context.Context, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fw, ok := c.firewalls[name]
+	if !ok {
+		return gcp.ErrNotFound
+	}
+	fw.Disabled = proto.Bool(true)
+	return nil
+}
+
+func (c *Client) DeleteFirewall(_ context.Context, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return deleteResource(c.firewalls, name)
+}
+
+func (c *Client) GetBackendService(_ context.Context, name string) (*computepb.BackendService, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return getResource(c.backends, name)
+}
+
+func (c *Client) CreateBackendService(_ context.Context, name string, neg string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	negFQN := gcp.NEGFQN(c.project, c.region, neg)
+	if _, ok := c.negs[neg]; !ok {
+		return notReady(negFQN)
+	}
+	internal := computepb.BackendService_INTERNAL.String()
+	return insertResource(c.backends, name, &computepb.BackendService{
+		Name:                &name,
+		Description:         proto.String(gcp.ManagedDescription),
+		SelfLink:            proto.String(gcp.BackendServiceFQN(c.project, c.region, name)),
+		Network:             &c.network,
+		Protocol:            proto.String("TCP"),
+		LoadBalancingScheme: &internal,
+		Backends:            []*computepb.Backend{{Group: &negFQN}},
+	})
+}
+
+func (c *Client) DeleteBackendService(_ context.Context, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fqn := gcp.BackendServiceFQN(c.project, c.region, name)
+	for ruleName, rule := range c.fwdRules {
+		if rule.GetBackendService() == fqn {
+			return inUse(fqn, gcp.ForwardingRuleFQN(c.project, c.region, ruleName))
+		}
+	}
+	return deleteResource(c.backends, name)
+}
+
+func (c *Client) GetForwardingRule(_ context.Context, name string) (*computepb.ForwardingRule, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return getResource(c.fwdRules, name)
+}
+
+func (c *Client) CreateForwardingRule(_ context.Context, name, backendSvc, subnetFQN string, ip *string, globalAccess *bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	backendFQN := gcp.BackendServiceFQN(c.project, c.region, backendSvc)
+	if _, ok := c.backends[backendSvc]; !ok {
+		return notReady(backendFQN)
+	}
+	if subnetFQN == "" {
+		subnetFQN = c.subnet
+	}
+	if ip == nil {
+		ip = proto.String("10.0.0." + strconv.Itoa(c.nextIP))
+		c.nextIP++
+	}
+	scheme := computepb.BackendService_INTERNAL.String()
+	return insertResource(c.fwdRules, name, &computepb.ForwardingRule{
+		Name:                &name,
+		Description:         proto.String(gcp.ManagedDescription),
+		SelfLink:            proto.String(gcp.ForwardingRuleFQN(c.project, c.region, name)),
+		IPAddress:           ip,
+		IPProtocol:          proto.String(computepb.ForwardingRule_TCP.String()),
+		AllowGlobalAccess:   globalAccess,
+		BackendService:      &backendFQN,
+		Network:             &c.network,
+		Subnetwork:          proto.String(gcp.RelativeName(subnetFQN)),
+		AllPorts:            proto.Bool(true),
+		LoadBalancingScheme: &scheme,
+	})
+}
+
+func (c *Client) SetForwardingRuleGlobalAccess(_ context.Context, name string, globalAccess bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rule, ok := c.fwdRules[name]
+	if !ok {
+		return gcp.ErrNotFound
+	}
+	rule.AllowGlobalAccess = &globalAccess
+	return nil
+}
+
+func (c *Client) DeleteForwardingRule(_ context.Context, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fqn := gcp.ForwardingRuleFQN(c.project, c.region, name)
+	for attName, att := range c.svcAtts {
+		if att.GetProducerForwardingRule() == fqn {
+			return inUse(fqn, gcp.ServiceAttachmentFQN(c.project, c.region, attName))
+		}
+	}
+	return deleteResource(c.fwdRules, name)
+}
+
+func (c *Client) GetServiceAttachment(_ context.Context, name string) (*computepb.ServiceAttachment, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return getResource(c.svcAtts, name)
+}
+
+func (c *Client) CreateServiceAttachment(
+	_ context.Context,
+	name,
+	fwdRuleFQN string,
+	consumers []*computepb.ServiceAttachmentConsumerProjectLimit,
+	natSubnetFQNs []string,
+	reconcileConnections *bool,
+) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	found := false
+	for _, rule := range c.fwdRules {
+		if rule.GetSelfLink() == fwdRuleFQN {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return notReady(fwdRuleFQN)
+	}
+	acceptAuto := computepb.ServiceAttachment_ACCEPT_AUTOMATIC.String()
+	return insertResource(c.svcAtts, name, &computepb.ServiceAttachment{
+		Name:                   &name,
+		Description:            proto.String(gcp.ManagedDescription),
+		SelfLink:               proto.String(gcp.ServiceAttachmentFQN(c.project, c.region, name)),
+		ProducerForwardingRule: &fwdRuleFQN,
+		ConsumerAcceptLists:    consumers,
+		NatSubnets:             natSubnetFQNs,
+		ConnectionPreference:   &acceptAuto,
+		ReconcileConnections:   reconcileConnections,
+	})
+}
+
+func (c *Client) UpdateServiceAttachment(
+	_ context.Context,
+	name string,
+	consumers []*computepb.ServiceAttachmentConsumerProjectLimit,
+	natSubnetFQNs []string,
+	reconcileConnections *bool,
+) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	svcAtt, ok := c.svcAtts[name]
+	if !ok {
+		return gcp.ErrNotFound
+	}
+	svcAtt.ConsumerAcceptLists = consumers
+	svcAtt.NatSubnets = natSubnetFQNs
+	if reconcileConnections != nil {
+		svcAtt.ReconcileConnections = reconcileConnections
+	}
+	return nil
+}
+
+// SetConnectedEndpoints sets the consumer endpoints connected to a service attachment, to
+// simulate consumers connecting and disconnecting.
+func (c *Client) SetConnectedEndpoints(name string, eps []*computepb.ServiceAttachmentConnectedEndpoint) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	svcAtt, ok := c.svcAtts[name]
+	if !ok {
+		return gcp.ErrNotFound
+	}
+	svcAtt.ConnectedEndpoints = eps
+	return nil
+}
+
+func (c *Client) DeleteServiceAttachment(_ context.Context, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return deleteResource(c.svcAtts, name)
+}
+
+func (c *Client) GetSubnetwork(_ context.Context, fqn string) (*computepb.Subnetwork, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return getResource(c.subnets, gcp.RelativeName(fqn))
+}
+
+// AddSubnetwork adds a subnet of the client's network with the given primary range, e.g. to be
+// used as a NAT subnet.
+func (c *Client) AddSubnetwork(fqn, ipCIDRRange string) {
+	c.addSubnetwork(c.network, fqn, ipCIDRRange, computepb.Subnetwork_PRIVATE_SERVICE_CONNECT)
+}
+
+// AddPrivateSubnetwork adds a regular subnet of the network with the given primary range, e.g.
+// for the nodes or the forwarding rules of a spec in another network.
+func (c *Client) AddPrivateSubnetwork(networkFQN, fqn, ipCIDRRange string) {
+	c.addSubnetwork(networkFQN, fqn, ipCIDRRange, computepb.Subnetwork_PRIVATE)
+}
+
+func (c *Client) addSubnetwork(networkFQN, fqn, ipCIDRRange string, purpose computepb.Subnetwork_Purpose) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subnets[fqn] = &computepb.Subnetwork{
+		Name:        proto.String(path.Base(fqn)),
+		SelfLink:    &fqn,
+		Network:     &networkFQN,
+		IpCidrRange: &ipCIDRRange,
+		Purpose:     proto.String(purpose.String()),
+	}
+}
+
+// GetConsumerEndpoint returns the endpoint with the status of its connection as of now, i.e.
+// ACCEPTED if its project or network is in the service attachment's accept list, PENDING if
+// it isn't, and CLOSED if the attachment doesn't exist anymore.
+func (c *Client) GetConsumerEndpoint(_ context.Context, subnetFQN, name string) (*computepb.ForwardingRule, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ep, err := getResource(c.consumerEndpoints, consumerEndpointFQN(subnetFQN, name))
+	if err != nil {
+		return nil, err
+	}
+	status := computepb.ForwardingRule_CLOSED
+	for attName, att := range c.svcAtts {
+		if gcp.ServiceAttachmentFQN(c.project, c.region, attName) != ep.GetTarget() {
+			continue
+		}
+		status = computepb.ForwardingRule_PENDING
+		project := projectOf(ep.GetSelfLink())
+		for _, consumer := range att.GetConsumerAcceptLists() {
+			if consumer.GetProjectIdOrNum() == project || gcp.RelativeName(consumer.GetNetworkUrl()) == ep.GetNetwork() {
+				status = computepb.ForwardingRule_ACCEPTED
+			}
+		}
+	}
+	ep.PscConnectionStatus = proto.String(status.String())
+	return ep, nil
+}
+
+func (c *Client) CreateConsumerEndpoint(_ context.Context, subnetFQN, name, svcAttFQN string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	subnet, ok := c.subnets[gcp.RelativeName(subnetFQN)]
+	if !ok {
+		return gcp.ErrNotFound
+	}
+	fqn := consumerEndpointFQN(subnetFQN, name)
+	return insertResource(c.consumerEndpoints, fqn, &computepb.ForwardingRule{
+		Name:        &name,
+		Description: proto.String(gcp.ManagedDescription),
+		SelfLink:    &fqn,
+		IPAddress:   proto.String("10.0.1." + strconv.Itoa(len(c.consumerEndpoints)+2)),
+		Target:      &svcAttFQN,
+		Network:     subnet.Network,
+		Subnetwork:  proto.String(gcp.RelativeName(subnetFQN)),
+	})
+}
+
+func (c *Client) DeleteConsumerEndpoint(_ context.Context, subnetFQN, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return deleteResource(c.consumerEndpoints, consumerEndpointFQN(subnetFQN, name))
+}
+
+// consumerEndpointFQN returns the FQN of an endpoint in the project and region of its subnet.
+func consumerEndpointFQN(subnetFQN, name string) string {
+	// projects/<project>/regions/<region>/subnetworks/<subnet>
+	parts := strings.Split(gcp.RelativeName(subnetFQN), "/")
+	if len(parts) < 4 {
+		return name
+	}
+	return gcp.ForwardingRuleFQN(parts[1], parts[3], name)
+}
+
+// projectOf returns the project of a relative resource name, or "" if it isn't one, e.g. if
+// it's a bare name.
+func projectOf(name string) string {
+	// projects/<project>/...
+	parts := strings.Split(name, "/")
+	if len(parts) < 2 || parts[0] != "projects" {
+		return ""
+	}
+	return parts[1]
+}
+
+func getResource[T proto.Message](m map[string]T, name string) (T, error) {
+	r, ok := m[name]
+	if !ok {
+		var zero T
+		return zero, gcp.ErrNotFound
+	}
+	// Return a copy, so that callers can't modify the stored state.
+	return proto.Clone(r).(T), nil
+}
+
+func insertResource[T proto.Message](m map[string]T, name string, r T) error {
+	if _, ok := m[name]; ok {
+		return gcp.NewClientError(http.StatusConflict, fmt.Sprintf("the resource %q already exists", name))
+	}
+	m[name] = r
+	return nil
+}
+
+func deleteResource[T any](m map[string]T, name string) error {
+	if _, ok := m[name]; !ok {
+		return gcp.ErrNotFound
+	}
+	delete(m, name)
+	return nil
+}
+
+// inUse and notReady return the errors the API's operations complete with.
+func inUse(resource, user string) error {
+	msg := fmt.Sprintf("The resource '%s' is already being used by '%s'", resource, user)
+	return gcp.NewOperationError(http.StatusBadRequest, gcp.ErrorKindResourceInUse, resource, msg)
+}
+
+func notReady(resource string) error {
+	msg := fmt.Sprintf("The resource '%s' is not ready", resource)
+	return gcp.NewOperationError(http.StatusBadRequest, gcp.ErrorKindResourceNotReady, "", msg)
+}
+
+func priority(rule gcp.FirewallRule) int32 {
+	if rule.Priority == nil {
+		return gcp.DefaultFirewallPriority
+	}
+	return *rule.Priority
+}
+
+func allowed(rule gcp.FirewallRule) []*computepb.Allowed {
+	if rule.ICMP {
+		return []*computepb.Allowed{{IPProtocol: proto.String("icmp")}}
+	}
+	return allowedTCP(rule.Ports)
+}
+
+func allowedTCP(ports map[int32]struct{}) []*computepb.Allowed {
+	strPorts := make([]string, 0, len(ports))
+	for p := range ports {
+		strPorts = append(strPorts, strconv.Itoa(int(p)))
+	}
+	slices.Sort(strPorts)
+	return []*computepb.Allowed{{IPProtocol: proto.String("tcp"), Ports: strPorts}}
+}
@@ -0,0 +1,184 @@
+package fake
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestClientResources(t *testing.T) {
+	ctx := context.Background()
+	c := New("my-project", "us-east1")
+	fwdRuleFQN := gcp.ForwardingRuleFQN("my-project", "us-east1", "rule")
+
+	// Resources can't be created before the ones they depend on.
+	err := c.CreateBackendService(ctx, "backend", "neg")
+	require.Equal(t, gcp.ErrorKindResourceNotReady, gcp.ErrorKindOf(err))
+	err = c.CreateForwardingRule(ctx, "rule", "backend", "", nil, nil)
+	require.Equal(t, gcp.ErrorKindResourceNotReady, gcp.ErrorKindOf(err))
+	err = c.CreateServiceAttachment(ctx, "svc-att", fwdRuleFQN, nil, nil, nil)
+	require.Equal(t, gcp.ErrorKindResourceNotReady, gcp.ErrorKindOf(err))
+
+	require.NoError(t, c.CreatePortmapNEG(ctx, "neg", "", nil))
+	require.NoError(t, c.CreateBackendService(ctx, "backend", "neg"))
+	require.NoError(t, c.CreateForwardingRule(ctx, "rule", "backend", "", nil, nil))
+	require.NoError(t, c.CreateServiceAttachment(ctx, "svc-att", fwdRuleFQN, nil, nil, nil))
+	require.NoError(t, c.CreateFirewall(ctx, "fw", gcp.FirewallRule{Ports: map[int32]struct{}{30000: {}}}))
+
+	// They can't be created twice.
+	err = c.CreatePortmapNEG(ctx, "neg", "", nil)
+	var clientErr *gcp.ClientError
+	require.ErrorAs(t, err, &clientErr)
+	require.Equal(t, http.StatusConflict, clientErr.StatusCode())
+
+	neg, err := c.GetNEG(ctx, "neg")
+	require.NoError(t, err)
+	require.Equal(t, gcp.NEGFQN("my-project", "us-east1", "neg"), neg.GetSelfLink())
+	require.Equal(t, gcp.ManagedDescription, neg.GetDescription())
+	backend, err := c.GetBackendService(ctx, "backend")
+	require.NoError(t, err)
+	require.Equal(t, neg.GetSelfLink(), backend.GetBackends()[0].GetGroup())
+	rule, err := c.GetForwardingRule(ctx, "rule")
+	require.NoError(t, err)
+	require.Equal(t, backend.GetSelfLink(), rule.GetBackendService())
+	require.Equal(t, "10.0.0.2", rule.GetIPAddress())
+	svcAtt, err := c.GetServiceAttachment(ctx, "svc-att")
+	require.NoError(t, err)
+	require.Equal(t, fwdRuleFQN, svcAtt.GetProducerForwardingRule())
+	fw, err := c.GetFirewall(ctx, "fw")
+	require.NoError(t, err)
+	require.Equal(t, []string{"30000"}, fw.GetAllowed()[0].GetPorts())
+
+	// Modifying a returned resource doesn't modify the stored one.
+	fw.Allowed = nil
+	fw, err = c.GetFirewall(ctx, "fw")
+	require.NoError(t, err)
+	require.Len(t, fw.GetAllowed(), 1)
+
+	// Resources can't be deleted while others depend on them.
+	err = c.DeletePortmapNEG(ctx, "neg")
+	require.Equal(t, gcp.ErrorKindResourceInUse, gcp.ErrorKindOf(err))
+	err = c.DeleteBackendService(ctx, "backend")
+	require.Equal(t, gcp.ErrorKindResourceInUse, gcp.ErrorKindOf(err))
+	err = c.DeleteForwardingRule(ctx, "rule")
+	require.Equal(t, gcp.ErrorKindResourceInUse, gcp.ErrorKindOf(err))
+
+	require.NoError(t, c.DeleteServiceAttachment(ctx, "svc-att"))
+	require.NoError(t, c.DeleteForwardingRule(ctx, "rule"))
+	require.NoError(t, c.DeleteBackendService(ctx, "backend"))
+	require.NoError(t, c.DeletePortmapNEG(ctx, "neg"))
+	require.NoError(t, c.DeleteFirewall(ctx, "fw"))
+
+	// Missing resources aren't found.
+	_, err = c.GetNEG(ctx, "neg")
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+	_, err = c.GetBackendService(ctx, "backend")
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+	_, err = c.GetForwardingRule(ctx, "rule")
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+	_, err = c.GetServiceAttachment(ctx, "svc-att")
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+	_, err = c.GetFirewall(ctx, "fw")
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+	require.ErrorIs(t, c.DeletePortmapNEG(ctx, "neg"), gcp.ErrNotFound)
+	require.ErrorIs(t, c.DeleteBackendService(ctx, "backend"), gcp.ErrNotFound)
+	require.ErrorIs(t, c.DeleteForwardingRule(ctx, "rule"), gcp.ErrNotFound)
+	require.ErrorIs(t, c.DeleteServiceAttachment(ctx, "svc-att"), gcp.ErrNotFound)
+	require.ErrorIs(t, c.DeleteFirewall(ctx, "fw"), gcp.ErrNotFound)
+}
+
+func TestClientEndpoints(t *testing.T) {
+	ctx := context.Background()
+	c := New("my-project", "us-east1")
+	m1 := &gcp.PortMapping{Port: 30001, Instance: "node-1", InstancePort: 30000}
+	m2 := &gcp.PortMapping{Port: 30000, Instance: "node-0", InstancePort: 30000}
+
+	_, err := c.ListEndpoints(ctx, "neg")
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+	require.ErrorIs(t, c.AttachEndpoints(ctx, "neg", []*gcp.PortMapping{m1}), gcp.ErrNotFound)
+
+	require.NoError(t, c.CreatePortmapNEG(ctx, "neg", "", nil))
+	require.NoError(t, c.AttachEndpoints(ctx, "neg", []*gcp.PortMapping{m1, m2}))
+	eps, err := c.ListEndpoints(ctx, "neg")
+	require.NoError(t, err)
+	require.Equal(t, []*gcp.PortMapping{m2, m1}, eps)
+	neg, err := c.GetNEG(ctx, "neg")
+	require.NoError(t, err)
+	require.Equal(t, int32(2), neg.GetSize())
+
+	// A port can't be mapped to another instance, and nothing is attached if one can't.
+	m3 := &gcp.PortMapping{Port: 30002, Instance: "node-2", InstancePort: 30000}
+	conflicting := &gcp.PortMapping{Port: 30000, Instance: "node-2", InstancePort: 30000}
+	err = c.AttachEndpoints(ctx, "neg", []*gcp.PortMapping{m3, conflicting})
+	var clientErr *gcp.ClientError
+	require.ErrorAs(t, err, &clientErr)
+	require.Equal(t, http.StatusBadRequest, clientErr.StatusCode())
+	eps, err = c.ListEndpoints(ctx, "neg")
+	require.NoError(t, err)
+	require.Len(t, eps, 2)
+
+	// Endpoints that aren't attached can't be detached.
+	require.Error(t, c.DetachEndpoints(ctx, "neg", []*gcp.PortMapping{m3}))
+	require.NoError(t, c.DetachEndpoints(ctx, "neg", []*gcp.PortMapping{m2}))
+	eps, err = c.ListEndpoints(ctx, "neg")
+	require.NoError(t, err)
+	require.Equal(t, []*gcp.PortMapping{m1}, eps)
+}
+
+func TestClientConsumerEndpoints(t *testing.T) {
+	ctx := context.Background()
+	c := New("my-project", "us-east1")
+	fwdRuleFQN := gcp.ForwardingRuleFQN("my-project", "us-east1", "rule")
+	svcAttFQN := gcp.ServiceAttachmentFQN("my-project", "us-east1", "svc-att")
+	consumerNetwork := gcp.NetworkFQN("consumer", "consumer-vpc")
+	consumerSubnet := gcp.SubnetFQN("consumer", "us-east1", "consumer-subnet")
+	c.AddPrivateSubnetwork(consumerNetwork, consumerSubnet, "10.0.1.0/24")
+	// A subnet referenced by its bare name, so its endpoints' names are bare too.
+	c.AddPrivateSubnetwork(consumerNetwork, "bare-subnet", "10.0.2.0/24")
+
+	require.NoError(t, c.CreatePortmapNEG(ctx, "neg", "", nil))
+	require.NoError(t, c.CreateBackendService(ctx, "backend", "neg"))
+	require.NoError(t, c.CreateForwardingRule(ctx, "rule", "backend", "", nil, nil))
+	require.NoError(t, c.CreateServiceAttachment(ctx, "svc-att", fwdRuleFQN, nil, nil, nil))
+
+	require.ErrorIs(t, c.CreateConsumerEndpoint(ctx, gcp.SubnetFQN("consumer", "us-east1", "missing"), "ep", svcAttFQN), gcp.ErrNotFound)
+	require.NoError(t, c.CreateConsumerEndpoint(ctx, consumerSubnet, "ep", svcAttFQN))
+	require.NoError(t, c.CreateConsumerEndpoint(ctx, "bare-subnet", "bare-ep", svcAttFQN))
+	_, err := c.GetConsumerEndpoint(ctx, consumerSubnet, "missing")
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+
+	status := func(subnet, name string) string {
+		t.Helper()
+		ep, err := c.GetConsumerEndpoint(ctx, subnet, name)
+		require.NoError(t, err)
+		return ep.GetPscConnectionStatus()
+	}
+
+	// Endpoints are pending until their project or network is accepted.
+	require.Equal(t, computepb.ForwardingRule_PENDING.String(), status(consumerSubnet, "ep"))
+	require.Equal(t, computepb.ForwardingRule_PENDING.String(), status("bare-subnet", "bare-ep"))
+
+	consumers := []*computepb.ServiceAttachmentConsumerProjectLimit{{ProjectIdOrNum: proto.String("consumer")}}
+	require.NoError(t, c.UpdateServiceAttachment(ctx, "svc-att", consumers, nil, nil))
+	require.Equal(t, computepb.ForwardingRule_ACCEPTED.String(), status(consumerSubnet, "ep"))
+	// The bare endpoint's project isn't known, so only accepting its network accepts it.
+	require.Equal(t, computepb.ForwardingRule_PENDING.String(), status("bare-subnet", "bare-ep"))
+
+	consumers = []*computepb.ServiceAttachmentConsumerProjectLimit{{NetworkUrl: proto.String(consumerNetwork)}}
+	require.NoError(t, c.UpdateServiceAttachment(ctx, "svc-att", consumers, nil, nil))
+	require.Equal(t, computepb.ForwardingRule_ACCEPTED.String(), status(consumerSubnet, "ep"))
+	require.Equal(t, computepb.ForwardingRule_ACCEPTED.String(), status("bare-subnet", "bare-ep"))
+
+	// They're closed once the service attachment is deleted.
+	require.NoError(t, c.DeleteServiceAttachment(ctx, "svc-att"))
+	require.Equal(t, computepb.ForwardingRule_CLOSED.String(), status(consumerSubnet, "ep"))
+
+	require.NoError(t, c.DeleteConsumerEndpoint(ctx, consumerSubnet, "ep"))
+	require.ErrorIs(t, c.DeleteConsumerEndpoint(ctx, consumerSubnet, "ep"), gcp.ErrNotFound)
+	require.NoError(t, c.DeleteConsumerEndpoint(ctx, "bare-subnet", "bare-ep"))
+}
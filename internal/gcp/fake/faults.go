@@ -0,0 +1,277 @@
+package fake
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+)
+
+// Faults configures the failures injected by a FaultyClient. Rates are probabilities in [0, 1].
+type Faults struct {
+	// The rate at which calls fail before reaching the wrapped client, like when the API is
+	// unavailable.
+	ErrorRate float64
+	// The rate at which mutating calls fail after the wrapped client applied them, like when
+	// waiting for an operation times out but the operation eventually succeeds.
+	LostResponseRate float64
+	// The rate at which AttachEndpoints attaches only some of the endpoints and then fails.
+	PartialAttachRate float64
+	// The maximum latency added to each call. The actual latency is random.
+	MaxLatency time.Duration
+	// The seed for the random number generator, so that failures are reproducible.
+	Seed uint64
+}
+
+// FaultyClient wraps a gcp.Client and injects failures into its calls, to test that the
+// controller converges despite them. The client isn't embedded, so that the methods added to
+// gcp.Client have to be wrapped too.
+type FaultyClient struct {
+	client gcp.Client
+
+	mu     sync.Mutex
+	faults Faults
+	rand   *rand.Rand
+}
+
+var _ gcp.Client = &FaultyClient{}
+
+func NewFaulty(c gcp.Client, faults Faults) *FaultyClient {
+	fc := &FaultyClient{client: c}
+	fc.SetFaults(faults)
+	return fc
+}
+
+// SetFaults replaces the faults being injected, e.g. to stop injecting them with Faults{}.
+func (c *FaultyClient) SetFaults(faults Faults) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.faults = faults
+	c.rand = rand.New(rand.NewPCG(faults.Seed, faults.Seed))
+}
+
+func (c *FaultyClient) Project() string {
+	return c.client.Project()
+}
+
+func (c *FaultyClient) Region() string {
+	return c.client.Region()
+}
+
+func (c *FaultyClient) Network() string {
+	return c.client.Network()
+}
+
+func (c *FaultyClient) GetNEG(ctx context.Context, name string) (*computepb.NetworkEndpointGroup, error) {
+	err := c.inject(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.GetNEG(ctx, name)
+}
+
+func (c *FaultyClient) CreatePortmapNEG(ctx context.Context, name, subnetFQN string, defaultPort *int32) error {
+	return c.mutate(ctx, func() error { return c.client.CreatePortmapNEG(ctx, name, subnetFQN, defaultPort) })
+}
+
+func (c *FaultyClient) DeletePortmapNEG(ctx context.Context, name string) error {
+	return c.mutate(ctx, func() error { return c.client.DeletePortmapNEG(ctx, name) })
+}
+
+func (c *FaultyClient) ListEndpoints(ctx context.Context, neg string) ([]*gcp.PortMapping, error) {
+	err := c.inject(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.ListEndpoints(ctx, neg)
+}
+
+func (c *FaultyClient) AttachEndpoints(ctx context.Context, neg string, mappings []*gcp.PortMapping) error {
+	if len(mappings) > 1 && c.roll(func(f Faults) float64 { return f.PartialAttachRate }) {
+		err := c.client.AttachEndpoints(ctx, neg, mappings[:c.intN(len(mappings))])
+		if err != nil {
+			return err
+		}
+		return gcp.NewClientError(http.StatusServiceUnavailable, "injected fault: only some endpoints were attached")
+	}
+	return c.mutate(ctx, func() error { return c.client.AttachEndpoints(ctx, neg, mappings) })
+}
+
+func (c *FaultyClient) DetachEndpoints(ctx context.Context, neg string, mappings []*gcp.PortMapping) error {
+	return c.mutate(ctx, func() error { return c.client.DetachEndpoints(ctx, neg, mappings) })
+}
+
+func (c *FaultyClient) GetFirewall(ctx context.Context, name string) (*computepb.Firewall, error) {
+	err := c.inject(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.GetFirewall(ctx, name)
+}
+
+func (c *FaultyClient) CreateFirewall(ctx context.Context, name string, rule gcp.FirewallRule) error {
+	return c.mutate(ctx, func() error { return c.client.CreateFirewall(ctx, name, rule) })
+}
+
+func (c *FaultyClient) UpdateFirewall(ctx context.Context, name string, rule gcp.FirewallRule) error {
+	return c.mutate(ctx, func() error { return c.client.UpdateFirewall(ctx, name, rule) })
+}
+
+func (c *FaultyClient) DisableFirewall(ctx context.Context, name string) error {
+	return c.mutate(ctx, func() error { return c.client.DisableFirewall(ctx, name) })
+}
+
+func (c *FaultyClient) DeleteFirewall(ctx context.Context, name string) error {
+	return c.mutate(ctx, func() error { return c.client.DeleteFirewall(ctx, name) })
+}
+
+func (c *FaultyClient) GetBackendService(ctx context.Context, name string) (*computepb.BackendService, error) {
+	err := c.inject(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.GetBackendService(ctx, name)
+}
+
+func (c *FaultyClient) CreateBackendService(ctx context.Context, name string, neg string) error {
+	return c.mutate(ctx, func() error { return c.client.CreateBackendService(ctx, name, neg) })
+}
+
+func (c *FaultyClient) DeleteBackendService(ctx context.Context, name string) error {
+	return c.mutate(ctx, func() error { return c.client.DeleteBackendService(ctx, name) })
+}
+
+func (c *FaultyClient) GetForwardingRule(ctx context.Context, name string) (*computepb.ForwardingRule, error) {
+	err := c.inject(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.GetForwardingRule(ctx, name)
+}
+
+func (c *FaultyClient) CreateForwardingRule(ctx context.Context, name, backendSvc, subnetFQN string, ip *string, globalAccess *bool) error {
+	return c.mutate(ctx, func() error { return c.client.CreateForwardingRule(ctx, name, backendSvc, subnetFQN, ip, globalAccess) })
+}
+
+func (c *FaultyClient) SetForwardingRuleGlobalAccess(ctx context.Context, name string, globalAccess bool) error {
+	return c.mutate(ctx, func() error { return c.client.SetForwardingRuleGlobalAccess(ctx, name, globalAccess) })
+}
+
+func (c *FaultyClient) DeleteForwardingRule(ctx context.Context, name string) error {
+	return c.mutate(ctx, func() error { return c.client.DeleteForwardingRule(ctx, name) })
+}
+
+func (c *FaultyClient) GetServiceAttachment(ctx context.Context, name string) (*computepb.ServiceAttachment, error) {
+	err := c.inject(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.GetServiceAttachment(ctx, name)
+}
+
+func (c *FaultyClient) CreateServiceAttachment(
+	ctx context.Context,
+	name,
+	fwdRuleFQN string,
+	consumers []*computepb.ServiceAttachmentConsumerProjectLimit,
+	natSubnetFQNs []string,
+	reconcileConnections *bool,
+) error {
+	return c.mutate(ctx, func() error {
+		return c.client.CreateServiceAttachment(ctx, name, fwdRuleFQN, consumers, natSubnetFQNs, reconcileConnections)
+	})
+}
+
+func (c *FaultyClient) UpdateServiceAttachment(
+	ctx context.Context,
+	name string,
+	consumers []*computepb.ServiceAttachmentConsumerProjectLimit,
+	natSubnetFQNs []string,
+	reconcileConnections *bool,
+) error {
+	return c.mutate(ctx, func() error {
+		return c.client.UpdateServiceAttachment(ctx, name, consumers, natSubnetFQNs, reconcileConnections)
+	})
+}
+
+func (c *FaultyClient) DeleteServiceAttachment(ctx context.Context, name string) error {
+	return c.mutate(ctx, func() error { return c.client.DeleteServiceAttachment(ctx, name) })
+}
+
+func (c *FaultyClient) GetSubnetwork(ctx context.Context, fqn string) (*computepb.Subnetwork, error) {
+	err := c.inject(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.GetSubnetwork(ctx, fqn)
+}
+
+func (c *FaultyClient) GetConsumerEndpoint(ctx context.Context, subnetFQN, name string) (*computepb.ForwardingRule, error) {
+	err := c.inject(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.GetConsumerEndpoint(ctx, subnetFQN, name)
+}
+
+func (c *FaultyClient) CreateConsumerEndpoint(ctx context.Context, subnetFQN, name, svcAttFQN string) error {
+	return c.mutate(ctx, func() error { return c.client.CreateConsumerEndpoint(ctx, subnetFQN, name, svcAttFQN) })
+}
+
+func (c *FaultyClient) DeleteConsumerEndpoint(ctx context.Context, subnetFQN, name string) error {
+	return c.mutate(ctx, func() error { return c.client.DeleteConsumerEndpoint(ctx, subnetFQN, name) })
+}
+
+// mutate injects faults around a mutating call.
+func (c *FaultyClient) mutate(ctx context.Context, call func() error) error {
+	err := c.inject(ctx)
+	if err != nil {
+		return err
+	}
+	err = call()
+	if err != nil {
+		return err
+	}
+	if c.roll(func(f Faults) float64 { return f.LostResponseRate }) {
+		return gcp.NewClientError(-1, "injected fault: timed out waiting for the operation")
+	}
+	return nil
+}
+
+// inject sleeps for a random latency and then fails at the configured error rate.
+func (c *FaultyClient) inject(ctx context.Context) error {
+	c.mu.Lock()
+	var latency time.Duration
+	if c.faults.MaxLatency > 0 {
+		latency = time.Duration(c.rand.Int64N(int64(c.faults.MaxLatency)))
+	}
+	c.mu.Unlock()
+	if latency > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(latency):
+		}
+	}
+	if c.roll(func(f Faults) float64 { return f.ErrorRate }) {
+		return gcp.NewClientError(http.StatusServiceUnavailable, "injected fault: service unavailable")
+	}
+	return nil
+}
+
+func (c *FaultyClient) roll(rate func(Faults) float64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := rate(c.faults)
+	return r > 0 && c.rand.Float64() < r
+}
+
+func (c *FaultyClient) intN(n int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rand.IntN(n)
+}
@@ -0,0 +1,34 @@
+package fake
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFaultyClientInjectsFaults checks that every call to the GCP API goes through the injected
+// faults, including the ones of the methods added to gcp.Client later.
+func TestFaultyClientInjectsFaults(t *testing.T) {
+	c := reflect.ValueOf(NewFaulty(New("my-project", "us-east1"), Faults{ErrorRate: 1}))
+	ctxType := reflect.TypeFor[context.Context]()
+	iface := reflect.TypeFor[gcp.Client]()
+	for i := range iface.NumMethod() {
+		m := iface.Method(i)
+		if m.Type.NumIn() == 0 || m.Type.In(0) != ctxType {
+			// Not an API call, e.g. Project.
+			continue
+		}
+		t.Run(m.Name, func(t *testing.T) {
+			args := []reflect.Value{reflect.ValueOf(context.Background())}
+			for j := 1; j < m.Type.NumIn(); j++ {
+				args = append(args, reflect.Zero(m.Type.In(j)))
+			}
+			out := c.MethodByName(m.Name).Call(args)
+			err, _ := out[len(out)-1].Interface().(error)
+			require.ErrorContains(t, err, "injected fault")
+		})
+	}
+}
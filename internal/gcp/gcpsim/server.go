@@ -0,0 +1,509 @@
+// Package gcpsim serves the subset of the Compute Engine REST API used by the controller, so
+// that the real gcp.GCPClient (including its operation polling) can be tested end to end
+// without hitting Google.
+package gcpsim
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"google.golang.org/api/option"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const basePath = "/compute/v1/projects/{project}"
+
+// Server is an http.Handler simulating the Compute Engine API. Its state is kept in a
+// fake.Client, which can be used to inspect or seed it.
+type Server struct {
+	*fake.Client
+	mux *http.ServeMux
+
+	mu      sync.Mutex
+	ops     map[string]*operation
+	nextOp  int
+	opPolls int
+}
+
+type operation struct {
+	proto *computepb.Operation
+	// How many more times the operation has to be polled before it's done.
+	pendingPolls int
+}
+
+var _ http.Handler = &Server{}
+
+func New(project, region string) *Server {
+	s := &Server{
+		Client: fake.New(project, region),
+		mux:    http.NewServeMux(),
+		ops:    map[string]*operation{},
+	}
+	regional := basePath + "/regions/{region}"
+	s.handle("GET "+regional+"/networkEndpointGroups/{name}", s.getNEG)
+	s.handle("POST "+regional+"/networkEndpointGroups", s.insertNEG)
+	s.handle("DELETE "+regional+"/networkEndpointGroups/{name}", s.deleteNEG)
+	s.handle("POST "+regional+"/networkEndpointGroups/{name}/listNetworkEndpoints", s.listEndpoints)
+	s.handle("POST "+regional+"/networkEndpointGroups/{name}/attachNetworkEndpoints", s.attachEndpoints)
+	s.handle("POST "+regional+"/networkEndpointGroups/{name}/detachNetworkEndpoints", s.detachEndpoints)
+	s.handle("GET "+basePath+"/global/firewalls", s.listFirewalls)
+	s.handle("GET "+basePath+"/global/firewalls/{name}", s.getFirewall)
+	s.handle("POST "+basePath+"/global/firewalls", s.insertFirewall)
+	s.handle("PUT "+basePath+"/global/firewalls/{name}", s.updateFirewall)
+	s.handle("PATCH "+basePath+"/global/firewalls/{name}", s.patchFirewall)
+	s.handle("DELETE "+basePath+"/global/firewalls/{name}", s.deleteFirewall)
+	s.handle("GET "+regional+"/backendServices/{name}", s.getBackendService)
+	s.handle("POST "+regional+"/backendServices", s.insertBackendService)
+	s.handle("DELETE "+regional+"/backendServices/{name}", s.deleteBackendService)
+	s.handle("GET "+regional+"/forwardingRules/{name}", s.getForwardingRule)
+	s.handle("POST "+regional+"/forwardingRules", s.insertForwardingRule)
+	s.handle("PATCH "+regional+"/forwardingRules/{name}", s.patchForwardingRule)
+	s.handle("DELETE "+regional+"/forwardingRules/{name}", s.deleteForwardingRule)
+	s.handle("GET "+regional+"/serviceAttachments/{name}", s.getServiceAttachment)
+	s.handle("POST "+regional+"/serviceAttachments", s.insertServiceAttachment)
+	s.handle("PATCH "+regional+"/serviceAttachments/{name}", s.patchServiceAttachment)
+	s.handle("DELETE "+regional+"/serviceAttachments/{name}", s.deleteServiceAttachment)
+	s.handle("GET "+regional+"/subnetworks/{name}", s.getSubnetwork)
+	s.handle("GET "+regional+"/operations/{name}", s.getOperation)
+	s.handle("GET "+basePath+"/global/operations/{name}", s.getOperation)
+	return s
+}
+
+// ClientOptions returns the options for a gcp.GCPClient to use the server listening at url.
+func ClientOptions(url string) []option.ClientOption {
+	return []option.ClientOption{option.WithEndpoint(url), option.WithoutAuthentication()}
+}
+
+// SetOperationPolls sets how many times operations created from now on have to be polled
+// before they're done. It defaults to 0, i.e. operations are done as soon as they're created.
+func (s *Server) SetOperationPolls(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opPolls = n
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+type handlerFunc func(r *http.Request) (proto.Message, error)
+
+func (s *Server) handle(pattern string, h handlerFunc) {
+	s.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("project") != s.Project() || (r.PathValue("region") != "" && r.PathValue("region") != s.Region()) {
+			writeError(w, gcp.ErrNotFound)
+			return
+		}
+		res, err := h(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		body, err := protojson.Marshal(res)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(body)
+	})
+}
+
+// mutate applies f and returns the operation tracking it, the way every mutating call in the
+// Compute Engine API does. The errors the API reports in operations, e.g. when deleting a
+// resource in use, complete the operation instead of failing the call.
+func (s *Server) mutate(r *http.Request, target string, f func(ctx context.Context) error) (proto.Message, error) {
+	err := f(r.Context())
+	var opErr *gcp.OperationError
+	if err != nil && !errors.As(err, &opErr) {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextOp++
+	name := "operation-" + strconv.Itoa(s.nextOp)
+	op := &computepb.Operation{
+		Name:          &name,
+		OperationType: proto.String(r.Method),
+		TargetLink:    &target,
+		Status:        computepb.Operation_DONE.Enum(),
+		Progress:      proto.Int32(100),
+	}
+	if region := r.PathValue("region"); region != "" {
+		op.Region = &region
+	}
+	if opErr != nil {
+		op.Error = &computepb.Error{}
+		for _, e := range opErr.Errors {
+			op.Error.Errors = append(op.Error.Errors, &computepb.Errors{Code: proto.String(e.Code), Message: proto.String(e.Message)})
+		}
+		op.HttpErrorStatusCode = proto.Int32(int32(opErr.StatusCode()))
+		op.HttpErrorMessage = proto.String(http.StatusText(opErr.StatusCode()))
+		s.ops[name] = &operation{proto: op}
+		return proto.Clone(op), nil
+	}
+	if s.opPolls > 0 {
+		op.Status = computepb.Operation_RUNNING.Enum()
+		op.Progress = proto.Int32(0)
+	}
+	s.ops[name] = &operation{proto: op, pendingPolls: s.opPolls}
+	return proto.Clone(op), nil
+}
+
+func (s *Server) getOperation(r *http.Request) (proto.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	op, ok := s.ops[r.PathValue("name")]
+	if !ok {
+		return nil, gcp.ErrNotFound
+	}
+	if op.pendingPolls > 0 {
+		op.pendingPolls--
+	}
+	if op.pendingPolls == 0 {
+		op.proto.Status = computepb.Operation_DONE.Enum()
+		op.proto.Progress = proto.Int32(100)
+	}
+	return proto.Clone(op.proto), nil
+}
+
+func (s *Server) getNEG(r *http.Request) (proto.Message, error) {
+	return s.GetNEG(r.Context(), r.PathValue("name"))
+}
+
+// in returns the client creating resources in the requested network, if any.
+func (s *Server) in(network string) gcp.Client {
+	if network == "" {
+		return s.Client
+	}
+	return s.InNetwork(gcp.RelativeName(network), "")
+}
+
+func (s *Server) insertNEG(r *http.Request) (proto.Message, error) {
+	neg := &computepb.NetworkEndpointGroup{}
+	err := decode(r, neg)
+	if err != nil {
+		return nil, err
+	}
+	if neg.GetNetworkEndpointType() != computepb.NetworkEndpointGroup_GCE_VM_IP_PORTMAP.String() {
+		return nil, badRequest("only %s NEGs are supported", computepb.NetworkEndpointGroup_GCE_VM_IP_PORTMAP)
+	}
+	target := gcp.NEGFQN(s.Project(), s.Region(), neg.GetName())
+	return s.mutate(r, target, func(ctx context.Context) error {
+		return s.in(neg.GetNetwork()).CreatePortmapNEG(ctx, neg.GetName(), neg.GetSubnetwork(), neg.DefaultPort)
+	})
+}
+
+func (s *Server) deleteNEG(r *http.Request) (proto.Message, error) {
+	name := r.PathValue("name")
+	return s.mutate(r, gcp.NEGFQN(s.Project(), s.Region(), name), func(ctx context.Context) error {
+		return s.DeletePortmapNEG(ctx, name)
+	})
+}
+
+func (s *Server) listEndpoints(r *http.Request) (proto.Message, error) {
+	ms, err := s.ListEndpoints(r.Context(), r.PathValue("name"))
+	if err != nil {
+		return nil, err
+	}
+	res := &computepb.NetworkEndpointGroupsListNetworkEndpoints{}
+	for _, m := range ms {
+		res.Items = append(res.Items, &computepb.NetworkEndpointWithHealthStatus{
+			NetworkEndpoint: &computepb.NetworkEndpoint{
+				ClientDestinationPort: &m.Port,
+				Instance:              &m.Instance,
+				Port:                  &m.InstancePort,
+			},
+		})
+	}
+	return res, nil
+}
+
+func (s *Server) attachEndpoints(r *http.Request) (proto.Message, error) {
+	req := &computepb.RegionNetworkEndpointGroupsAttachEndpointsRequest{}
+	err := decode(r, req)
+	if err != nil {
+		return nil, err
+	}
+	name := r.PathValue("name")
+	return s.mutate(r, gcp.NEGFQN(s.Project(), s.Region(), name), func(ctx context.Context) error {
+		return s.AttachEndpoints(ctx, name, toPortMappings(req.GetNetworkEndpoints()))
+	})
+}
+
+func (s *Server) detachEndpoints(r *http.Request) (proto.Message, error) {
+	req := &computepb.RegionNetworkEndpointGroupsDetachEndpointsRequest{}
+	err := decode(r, req)
+	if err != nil {
+		return nil, err
+	}
+	name := r.PathValue("name")
+	return s.mutate(r, gcp.NEGFQN(s.Project(), s.Region(), name), func(ctx context.Context) error {
+		return s.DetachEndpoints(ctx, name, toPortMappings(req.GetNetworkEndpoints()))
+	})
+}
+
+// listFirewalls always returns an empty list, because listing is only used to check that the
+// API is reachable.
+func (s *Server) listFirewalls(*http.Request) (proto.Message, error) {
+	return &computepb.FirewallList{}, nil
+}
+
+func (s *Server) getFirewall(r *http.Request) (proto.Message, error) {
+	return s.GetFirewall(r.Context(), r.PathValue("name"))
+}
+
+func (s *Server) insertFirewall(r *http.Request) (proto.Message, error) {
+	fw := &computepb.Firewall{}
+	err := decode(r, fw)
+	if err != nil {
+		return nil, err
+	}
+	rule, err := firewallRule(fw)
+	if err != nil {
+		return nil, err
+	}
+	return s.mutate(r, gcp.FirewallFQN(s.Project(), fw.GetName()), func(ctx context.Context) error {
+		return s.in(fw.GetNetwork()).CreateFirewall(ctx, fw.GetName(), rule)
+	})
+}
+
+func (s *Server) updateFirewall(r *http.Request) (proto.Message, error) {
+	fw := &computepb.Firewall{}
+	err := decode(r, fw)
+	if err != nil {
+		return nil, err
+	}
+	rule, err := firewallRule(fw)
+	if err != nil {
+		return nil, err
+	}
+	name := r.PathValue("name")
+	return s.mutate(r, gcp.FirewallFQN(s.Project(), name), func(ctx context.Context) error {
+		return s.UpdateFirewall(ctx, name, rule)
+	})
+}
+
+// patchFirewall only supports disabling rules, since they're otherwise updated as a whole.
+func (s *Server) patchFirewall(r *http.Request) (proto.Message, error) {
+	fw := &computepb.Firewall{}
+	err := decode(r, fw)
+	if err != nil {
+		return nil, err
+	}
+	if !fw.GetDisabled() {
+		return nil, badRequest("only disabling firewalls is supported")
+	}
+	name := r.PathValue("name")
+	return s.mutate(r, gcp.FirewallFQN(s.Project(), name), func(ctx context.Context) error {
+		return s.DisableFirewall(ctx, name)
+	})
+}
+
+func (s *Server) deleteFirewall(r *http.Request) (proto.Message, error) {
+	name := r.PathValue("name")
+	return s.mutate(r, gcp.FirewallFQN(s.Project(), name), func(ctx context.Context) error {
+		return s.DeleteFirewall(ctx, name)
+	})
+}
+
+func (s *Server) getBackendService(r *http.Request) (proto.Message, error) {
+	return s.GetBackendService(r.Context(), r.PathValue("name"))
+}
+
+func (s *Server) insertBackendService(r *http.Request) (proto.Message, error) {
+	be := &computepb.BackendService{}
+	err := decode(r, be)
+	if err != nil {
+		return nil, err
+	}
+	if len(be.GetBackends()) != 1 {
+		return nil, badRequest("expected exactly 1 backend, got %d", len(be.GetBackends()))
+	}
+	neg := path.Base(be.GetBackends()[0].GetGroup())
+	target := gcp.BackendServiceFQN(s.Project(), s.Region(), be.GetName())
+	return s.mutate(r, target, func(ctx context.Context) error {
+		return s.in(be.GetNetwork()).CreateBackendService(ctx, be.GetName(), neg)
+	})
+}
+
+func (s *Server) deleteBackendService(r *http.Request) (proto.Message, error) {
+	name := r.PathValue("name")
+	return s.mutate(r, gcp.BackendServiceFQN(s.Project(), s.Region(), name), func(ctx context.Context) error {
+		return s.DeleteBackendService(ctx, name)
+	})
+}
+
+func (s *Server) getForwardingRule(r *http.Request) (proto.Message, error) {
+	return s.GetForwardingRule(r.Context(), r.PathValue("name"))
+}
+
+func (s *Server) insertForwardingRule(r *http.Request) (proto.Message, error) {
+	rule := &computepb.ForwardingRule{}
+	err := decode(r, rule)
+	if err != nil {
+		return nil, err
+	}
+	if !rule.GetAllPorts() {
+		return nil, badRequest("allPorts must be set for port mapping NEG backends")
+	}
+	backend := path.Base(rule.GetBackendService())
+	target := gcp.ForwardingRuleFQN(s.Project(), s.Region(), rule.GetName())
+	return s.mutate(r, target, func(ctx context.Context) error {
+		return s.in(rule.GetNetwork()).CreateForwardingRule(ctx, rule.GetName(), backend, rule.GetSubnetwork(), rule.IPAddress, rule.AllowGlobalAccess)
+	})
+}
+
+func (s *Server) patchForwardingRule(r *http.Request) (proto.Message, error) {
+	rule := &computepb.ForwardingRule{}
+	err := decode(r, rule)
+	if err != nil {
+		return nil, err
+	}
+	name := r.PathValue("name")
+	return s.mutate(r, gcp.ForwardingRuleFQN(s.Project(), s.Region(), name), func(ctx context.Context) error {
+		return s.SetForwardingRuleGlobalAccess(ctx, name, rule.GetAllowGlobalAccess())
+	})
+}
+
+func (s *Server) deleteForwardingRule(r *http.Request) (proto.Message, error) {
+	name := r.PathValue("name")
+	return s.mutate(r, gcp.ForwardingRuleFQN(s.Project(), s.Region(), name), func(ctx context.Context) error {
+		return s.DeleteForwardingRule(ctx, name)
+	})
+}
+
+func (s *Server) getServiceAttachment(r *http.Request) (proto.Message, error) {
+	return s.GetServiceAttachment(r.Context(), r.PathValue("name"))
+}
+
+func (s *Server) getSubnetwork(r *http.Request) (proto.Message, error) {
+	return s.GetSubnetwork(r.Context(), gcp.SubnetFQN(r.PathValue("project"), r.PathValue("region"), r.PathValue("name")))
+}
+
+func (s *Server) insertServiceAttachment(r *http.Request) (proto.Message, error) {
+	att := &computepb.ServiceAttachment{}
+	err := decode(r, att)
+	if err != nil {
+		return nil, err
+	}
+	target := gcp.ServiceAttachmentFQN(s.Project(), s.Region(), att.GetName())
+	return s.mutate(r, target, func(ctx context.Context) error {
+		return s.CreateServiceAttachment(ctx, att.GetName(), att.GetProducerForwardingRule(), att.GetConsumerAcceptLists(), att.GetNatSubnets(), att.ReconcileConnections)
+	})
+}
+
+func (s *Server) patchServiceAttachment(r *http.Request) (proto.Message, error) {
+	att := &computepb.ServiceAttachment{}
+	err := decode(r, att)
+	if err != nil {
+		return nil, err
+	}
+	name := r.PathValue("name")
+	return s.mutate(r, gcp.ServiceAttachmentFQN(s.Project(), s.Region(), name), func(ctx context.Context) error {
+		return s.UpdateServiceAttachment(ctx, name, att.GetConsumerAcceptLists(), att.GetNatSubnets(), att.ReconcileConnections)
+	})
+}
+
+func (s *Server) deleteServiceAttachment(r *http.Request) (proto.Message, error) {
+	name := r.PathValue("name")
+	return s.mutate(r, gcp.ServiceAttachmentFQN(s.Project(), s.Region(), name), func(ctx context.Context) error {
+		return s.DeleteServiceAttachment(ctx, name)
+	})
+}
+
+func decode(r *http.Request, m proto.Message) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(body, m)
+	if err != nil {
+		return badRequest("invalid request body: %v", err)
+	}
+	return nil
+}
+
+func toPortMappings(eps []*computepb.NetworkEndpoint) []*gcp.PortMapping {
+	ms := make([]*gcp.PortMapping, 0, len(eps))
+	for _, ep := range eps {
+		ms = append(ms, &gcp.PortMapping{
+			Port:         ep.GetClientDestinationPort(),
+			Instance:     ep.GetInstance(),
+			InstancePort: ep.GetPort(),
+		})
+	}
+	return ms
+}
+
+func firewallRule(fw *computepb.Firewall) (gcp.FirewallRule, error) {
+	icmp := len(fw.GetAllowed()) == 1 && strings.EqualFold(fw.GetAllowed()[0].GetIPProtocol(), "icmp")
+	if icmp {
+		return gcp.FirewallRule{
+			ICMP:              true,
+			SourceRanges:      fw.GetSourceRanges(),
+			SourceTags:        fw.GetSourceTags(),
+			DestinationRanges: fw.GetDestinationRanges(),
+			Priority:          fw.Priority,
+		}, nil
+	}
+	ports, err := tcpPorts(fw)
+	if err != nil {
+		return gcp.FirewallRule{}, err
+	}
+	return gcp.FirewallRule{
+		Ports:             ports,
+		SourceRanges:      fw.GetSourceRanges(),
+		SourceTags:        fw.GetSourceTags(),
+		DestinationRanges: fw.GetDestinationRanges(),
+		Priority:          fw.Priority,
+	}, nil
+}
+
+func tcpPorts(fw *computepb.Firewall) (map[int32]struct{}, error) {
+	ports := map[int32]struct{}{}
+	for _, a := range fw.GetAllowed() {
+		if !strings.EqualFold(a.GetIPProtocol(), "tcp") {
+			return nil, badRequest("only tcp rules are supported, got %q", a.GetIPProtocol())
+		}
+		for _, p := range a.GetPorts() {
+			port, err := strconv.ParseInt(p, 10, 32)
+			if err != nil {
+				return nil, badRequest("invalid port %q", p)
+			}
+			ports[int32(port)] = struct{}{}
+		}
+	}
+	return ports, nil
+}
+
+func badRequest(format string, args ...any) error {
+	return gcp.NewClientError(http.StatusBadRequest, fmt.Sprintf(format, args...))
+}
+
+// writeError writes err the way the Compute Engine API does, so that the client library
+// decodes it into an *apierror.APIError.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	msg := err.Error()
+	var ce *gcp.ClientError
+	if errors.As(err, &ce) && ce.StatusCode() > 0 {
+		status = ce.StatusCode()
+	}
+	body, _ := json.Marshal(map[string]any{"error": map[string]any{"code": status, "message": msg}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,157 @@
+package gcpsim
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	project, region := "my-project", "us-central1"
+	ctx := context.Background()
+
+	sim := New(project, region)
+	sim.SetOperationPolls(1)
+	srv := httptest.NewServer(sim)
+	t.Cleanup(srv.Close)
+
+	c, err := gcp.NewClient(ctx, gcp.ClientConfig{
+		Project:    project,
+		Region:     region,
+		Network:    "my-network",
+		Subnetwork: "my-subnet",
+	}, ClientOptions(srv.URL)...)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = c.Close() })
+
+	require.NoError(t, c.Check(ctx))
+
+	_, err = c.GetNEG(ctx, "neg")
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+
+	require.NoError(t, c.CreatePortmapNEG(ctx, "neg", "", nil))
+	neg, err := c.GetNEG(ctx, "neg")
+	require.NoError(t, err)
+	require.Equal(t, "neg", neg.GetName())
+	require.Equal(t, gcp.NetworkFQN(project, "my-network"), neg.GetNetwork())
+
+	other := gcp.SubnetFQN(project, region, "other")
+	require.NoError(t, c.InNetwork(gcp.NetworkFQN(project, "other"), other).CreatePortmapNEG(ctx, "other-neg", "", nil))
+	neg, err = c.GetNEG(ctx, "other-neg")
+	require.NoError(t, err)
+	require.Equal(t, gcp.NetworkFQN(project, "other"), neg.GetNetwork())
+	require.Equal(t, other, neg.GetSubnetwork())
+
+	err = c.CreatePortmapNEG(ctx, "neg", "", nil)
+	var ce *gcp.ClientError
+	require.ErrorAs(t, err, &ce)
+	require.Equal(t, http.StatusConflict, ce.StatusCode())
+
+	mappings := []*gcp.PortMapping{
+		{Port: 10000, Instance: "instance-0", InstancePort: 9092},
+		{Port: 10001, Instance: "instance-1", InstancePort: 9092},
+	}
+	require.NoError(t, c.AttachEndpoints(ctx, "neg", mappings))
+	ms, err := c.ListEndpoints(ctx, "neg")
+	require.NoError(t, err)
+	require.ElementsMatch(t, mappings, ms)
+
+	require.NoError(t, c.DetachEndpoints(ctx, "neg", mappings[1:]))
+	ms, err = c.ListEndpoints(ctx, "neg")
+	require.NoError(t, err)
+	require.Equal(t, mappings[:1], ms)
+
+	fwRule := gcp.FirewallRule{Ports: map[int32]struct{}{10000: {}}, SourceRanges: []string{"10.0.0.0/8"}}
+	require.NoError(t, c.CreateFirewall(ctx, "fw", fwRule))
+	fwRule.Ports[10001] = struct{}{}
+	fwRule.SourceRanges = nil
+	fwRule.DestinationRanges = []string{"10.1.0.0/16"}
+	require.NoError(t, c.UpdateFirewall(ctx, "fw", fwRule))
+	fw, err := c.GetFirewall(ctx, "fw")
+	require.NoError(t, err)
+	require.False(t, gcp.FirewallNeedsUpdate(fw, fwRule))
+	require.NoError(t, c.DisableFirewall(ctx, "fw"))
+	fw, err = c.GetFirewall(ctx, "fw")
+	require.NoError(t, err)
+	require.True(t, fw.GetDisabled())
+
+	require.NoError(t, c.CreateBackendService(ctx, "be", "neg"))
+	require.NoError(t, c.CreateForwardingRule(ctx, "fr", "be", "", nil, nil))
+	rule, err := c.GetForwardingRule(ctx, "fr")
+	require.NoError(t, err)
+	require.NotEmpty(t, rule.GetIPAddress())
+	require.NoError(t, c.SetForwardingRuleGlobalAccess(ctx, "fr", true))
+	rule, err = c.GetForwardingRule(ctx, "fr")
+	require.NoError(t, err)
+	require.True(t, rule.GetAllowGlobalAccess())
+	require.NoError(t, c.CreateServiceAttachment(ctx, "sa", rule.GetSelfLink(), nil, nil, nil))
+	_, err = c.GetServiceAttachment(ctx, "sa")
+	require.NoError(t, err)
+
+	natSubnet := gcp.SubnetFQN(project, region, "nat")
+	sim.AddSubnetwork(natSubnet, "10.1.0.0/24")
+	subnet, err := c.GetSubnetwork(ctx, natSubnet)
+	require.NoError(t, err)
+	require.Equal(t, "10.1.0.0/24", subnet.GetIpCidrRange())
+	_, err = c.GetSubnetwork(ctx, "not-an-fqn")
+	require.Error(t, err)
+
+	// Resources in use can't be deleted.
+	err = c.DeletePortmapNEG(ctx, "neg")
+	require.ErrorAs(t, err, &ce)
+	require.Equal(t, http.StatusBadRequest, ce.StatusCode())
+	var oe *gcp.OperationError
+	require.ErrorAs(t, err, &oe)
+	require.Equal(t, gcp.ErrorKindResourceInUse, gcp.ErrorKindOf(err))
+	require.Equal(t, gcp.BackendServiceFQN(project, region, "be"), oe.Resource(gcp.ErrorKindResourceInUse))
+	require.Equal(t, gcp.NEGFQN(project, region, "neg"), gcp.RelativeName(oe.TargetLink))
+
+	require.NoError(t, c.DeleteServiceAttachment(ctx, "sa"))
+	require.NoError(t, c.DeleteForwardingRule(ctx, "fr"))
+	require.NoError(t, c.DeleteBackendService(ctx, "be"))
+	require.NoError(t, c.DeletePortmapNEG(ctx, "neg"))
+	require.NoError(t, c.DeleteFirewall(ctx, "fw"))
+
+	_, err = sim.GetNEG(ctx, "neg")
+	require.ErrorIs(t, err, gcp.ErrNotFound)
+}
+
+func TestOperationProgress(t *testing.T) {
+	project, region := "my-project", "us-central1"
+	sim := New(project, region)
+	sim.SetOperationPolls(3)
+	srv := httptest.NewServer(sim)
+	t.Cleanup(srv.Close)
+
+	c, err := gcp.NewClient(context.Background(), gcp.ClientConfig{
+		Project:    project,
+		Region:     region,
+		Network:    "my-network",
+		Subnetwork: "my-subnet",
+		Operations: &gcp.OperationConfig{
+			PollInitial:      time.Millisecond,
+			PollMax:          time.Millisecond,
+			ProgressInterval: time.Nanosecond,
+		},
+	}, ClientOptions(srv.URL)...)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = c.Close() })
+
+	var reports []gcp.OperationProgress
+	ctx := gcp.WithOperationProgress(context.Background(), func(p gcp.OperationProgress) {
+		reports = append(reports, p)
+	})
+	require.NoError(t, c.CreatePortmapNEG(ctx, "neg", "", nil))
+	// The operation is reported after each poll but the last, which finds it done.
+	require.Len(t, reports, 2)
+	for _, p := range reports {
+		require.Equal(t, "POST", p.Type)
+		require.Equal(t, gcp.NEGFQN(project, region, "neg"), p.TargetLink)
+		require.Equal(t, "RUNNING", p.Status)
+	}
+}
@@ -70,60 +70,74 @@ func (mr *MockClientMockRecorder) CreateBackendService(ctx, name, neg any) *gomo
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateBackendService", reflect.TypeOf((*MockClient)(nil).CreateBackendService), ctx, name, neg)
 }
 
+// CreateConsumerEndpoint mocks base method.
+func (m *MockClient) CreateConsumerEndpoint(ctx context.Context, subnetFQN, name, svcAttFQN string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateConsumerEndpoint", ctx, subnetFQN, name, svcAttFQN)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateConsumerEndpoint indicates an expected call of CreateConsumerEndpoint.
+func (mr *MockClientMockRecorder) CreateConsumerEndpoint(ctx, subnetFQN, name, svcAttFQN any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateConsumerEndpoint", reflect.TypeOf((*MockClient)(nil).CreateConsumerEndpoint), ctx, subnetFQN, name, svcAttFQN)
+}
+
 // CreateFirewall mocks base method.
-func (m *MockClient) CreateFirewall(ctx context.Context, name string, ports map[int32]struct{}) error {
+func (m *MockClient) CreateFirewall(ctx context.Context, name string, rule gcp.FirewallRule) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CreateFirewall", ctx, name, ports)
+	ret := m.ctrl.Call(m, "CreateFirewall", ctx, name, rule)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // CreateFirewall indicates an expected call of CreateFirewall.
-func (mr *MockClientMockRecorder) CreateFirewall(ctx, name, ports any) *gomock.Call {
+func (mr *MockClientMockRecorder) CreateFirewall(ctx, name, rule any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateFirewall", reflect.TypeOf((*MockClient)(nil).CreateFirewall), ctx, name, ports)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateFirewall", reflect.TypeOf((*MockClient)(nil).CreateFirewall), ctx, name, rule)
 }
 
 // CreateForwardingRule mocks base method.
-func (m *MockClient) CreateForwardingRule(ctx context.Context, name, backendSvc string, ip *string, globalAccess *bool) error {
+func (m *MockClient) CreateForwardingRule(ctx context.Context, name, backendSvc, subnetFQN string, ip *string, globalAccess *bool) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CreateForwardingRule", ctx, name, backendSvc, ip, globalAccess)
+	ret := m.ctrl.Call(m, "CreateForwardingRule", ctx, name, backendSvc, subnetFQN, ip, globalAccess)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // CreateForwardingRule indicates an expected call of CreateForwardingRule.
-func (mr *MockClientMockRecorder) CreateForwardingRule(ctx, name, backendSvc, ip, globalAccess any) *gomock.Call {
+func (mr *MockClientMockRecorder) CreateForwardingRule(ctx, name, backendSvc, subnetFQN, ip, globalAccess any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateForwardingRule", reflect.TypeOf((*MockClient)(nil).CreateForwardingRule), ctx, name, backendSvc, ip, globalAccess)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateForwardingRule", reflect.TypeOf((*MockClient)(nil).CreateForwardingRule), ctx, name, backendSvc, subnetFQN, ip, globalAccess)
 }
 
 // CreatePortmapNEG mocks base method.
-func (m *MockClient) CreatePortmapNEG(ctx context.Context, name string) error {
+func (m *MockClient) CreatePortmapNEG(ctx context.Context, name, subnetFQN string, defaultPort *int32) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CreatePortmapNEG", ctx, name)
+	ret := m.ctrl.Call(m, "CreatePortmapNEG", ctx, name, subnetFQN, defaultPort)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // CreatePortmapNEG indicates an expected call of CreatePortmapNEG.
-func (mr *MockClientMockRecorder) CreatePortmapNEG(ctx, name any) *gomock.Call {
+func (mr *MockClientMockRecorder) CreatePortmapNEG(ctx, name, subnetFQN, defaultPort any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreatePortmapNEG", reflect.TypeOf((*MockClient)(nil).CreatePortmapNEG), ctx, name)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreatePortmapNEG", reflect.TypeOf((*MockClient)(nil).CreatePortmapNEG), ctx, name, subnetFQN, defaultPort)
 }
 
 // CreateServiceAttachment mocks base method.
-func (m *MockClient) CreateServiceAttachment(ctx context.Context, name, fwdRuleFQN string, consumers []*computepb.ServiceAttachmentConsumerProjectLimit, natSubnetFQNs []string) error {
+func (m *MockClient) CreateServiceAttachment(ctx context.Context, name, fwdRuleFQN string, consumers []*computepb.ServiceAttachmentConsumerProjectLimit, natSubnetFQNs []string, reconcileConnections *bool) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CreateServiceAttachment", ctx, name, fwdRuleFQN, consumers, natSubnetFQNs)
+	ret := m.ctrl.Call(m, "CreateServiceAttachment", ctx, name, fwdRuleFQN, consumers, natSubnetFQNs, reconcileConnections)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // CreateServiceAttachment indicates an expected call of CreateServiceAttachment.
-func (mr *MockClientMockRecorder) CreateServiceAttachment(ctx, name, fwdRuleFQN, consumers, natSubnetFQNs any) *gomock.Call {
+func (mr *MockClientMockRecorder) CreateServiceAttachment(ctx, name, fwdRuleFQN, consumers, natSubnetFQNs, reconcileConnections any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateServiceAttachment", reflect.TypeOf((*MockClient)(nil).CreateServiceAttachment), ctx, name, fwdRuleFQN, consumers, natSubnetFQNs)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateServiceAttachment", reflect.TypeOf((*MockClient)(nil).CreateServiceAttachment), ctx, name, fwdRuleFQN, consumers, natSubnetFQNs, reconcileConnections)
 }
 
 // DeleteBackendService mocks base method.
@@ -140,6 +154,20 @@ func (mr *MockClientMockRecorder) DeleteBackendService(ctx, name any) *gomock.Ca
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteBackendService", reflect.TypeOf((*MockClient)(nil).DeleteBackendService), ctx, name)
 }
 
+// DeleteConsumerEndpoint mocks base method.
+func (m *MockClient) DeleteConsumerEndpoint(ctx context.Context, subnetFQN, name string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteConsumerEndpoint", ctx, subnetFQN, name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteConsumerEndpoint indicates an expected call of DeleteConsumerEndpoint.
+func (mr *MockClientMockRecorder) DeleteConsumerEndpoint(ctx, subnetFQN, name any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteConsumerEndpoint", reflect.TypeOf((*MockClient)(nil).DeleteConsumerEndpoint), ctx, subnetFQN, name)
+}
+
 // DeleteFirewall mocks base method.
 func (m *MockClient) DeleteFirewall(ctx context.Context, name string) error {
 	m.ctrl.T.Helper()
@@ -210,6 +238,20 @@ func (mr *MockClientMockRecorder) DetachEndpoints(ctx, neg, mappings any) *gomoc
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DetachEndpoints", reflect.TypeOf((*MockClient)(nil).DetachEndpoints), ctx, neg, mappings)
 }
 
+// DisableFirewall mocks base method.
+func (m *MockClient) DisableFirewall(ctx context.Context, name string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DisableFirewall", ctx, name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DisableFirewall indicates an expected call of DisableFirewall.
+func (mr *MockClientMockRecorder) DisableFirewall(ctx, name any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DisableFirewall", reflect.TypeOf((*MockClient)(nil).DisableFirewall), ctx, name)
+}
+
 // GetBackendService mocks base method.
 func (m *MockClient) GetBackendService(ctx context.Context, name string) (*computepb.BackendService, error) {
 	m.ctrl.T.Helper()
@@ -225,6 +267,21 @@ func (mr *MockClientMockRecorder) GetBackendService(ctx, name any) *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBackendService", reflect.TypeOf((*MockClient)(nil).GetBackendService), ctx, name)
 }
 
+// GetConsumerEndpoint mocks base method.
+func (m *MockClient) GetConsumerEndpoint(ctx context.Context, subnetFQN, name string) (*computepb.ForwardingRule, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetConsumerEndpoint", ctx, subnetFQN, name)
+	ret0, _ := ret[0].(*computepb.ForwardingRule)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetConsumerEndpoint indicates an expected call of GetConsumerEndpoint.
+func (mr *MockClientMockRecorder) GetConsumerEndpoint(ctx, subnetFQN, name any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetConsumerEndpoint", reflect.TypeOf((*MockClient)(nil).GetConsumerEndpoint), ctx, subnetFQN, name)
+}
+
 // GetFirewall mocks base method.
 func (m *MockClient) GetFirewall(ctx context.Context, name string) (*computepb.Firewall, error) {
 	m.ctrl.T.Helper()
@@ -285,6 +342,21 @@ func (mr *MockClientMockRecorder) GetServiceAttachment(ctx, name any) *gomock.Ca
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetServiceAttachment", reflect.TypeOf((*MockClient)(nil).GetServiceAttachment), ctx, name)
 }
 
+// GetSubnetwork mocks base method.
+func (m *MockClient) GetSubnetwork(ctx context.Context, fqn string) (*computepb.Subnetwork, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSubnetwork", ctx, fqn)
+	ret0, _ := ret[0].(*computepb.Subnetwork)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSubnetwork indicates an expected call of GetSubnetwork.
+func (mr *MockClientMockRecorder) GetSubnetwork(ctx, fqn any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSubnetwork", reflect.TypeOf((*MockClient)(nil).GetSubnetwork), ctx, fqn)
+}
+
 // ListEndpoints mocks base method.
 func (m *MockClient) ListEndpoints(ctx context.Context, neg string) ([]*gcp.PortMapping, error) {
 	m.ctrl.T.Helper()
@@ -300,6 +372,20 @@ func (mr *MockClientMockRecorder) ListEndpoints(ctx, neg any) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListEndpoints", reflect.TypeOf((*MockClient)(nil).ListEndpoints), ctx, neg)
 }
 
+// Network mocks base method.
+func (m *MockClient) Network() string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Network")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// Network indicates an expected call of Network.
+func (mr *MockClientMockRecorder) Network() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Network", reflect.TypeOf((*MockClient)(nil).Network))
+}
+
 // Project mocks base method.
 func (m *MockClient) Project() string {
 	m.ctrl.T.Helper()
@@ -328,16 +414,44 @@ func (mr *MockClientMockRecorder) Region() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Region", reflect.TypeOf((*MockClient)(nil).Region))
 }
 
+// SetForwardingRuleGlobalAccess mocks base method.
+func (m *MockClient) SetForwardingRuleGlobalAccess(ctx context.Context, name string, globalAccess bool) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetForwardingRuleGlobalAccess", ctx, name, globalAccess)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetForwardingRuleGlobalAccess indicates an expected call of SetForwardingRuleGlobalAccess.
+func (mr *MockClientMockRecorder) SetForwardingRuleGlobalAccess(ctx, name, globalAccess any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetForwardingRuleGlobalAccess", reflect.TypeOf((*MockClient)(nil).SetForwardingRuleGlobalAccess), ctx, name, globalAccess)
+}
+
 // UpdateFirewall mocks base method.
-func (m *MockClient) UpdateFirewall(ctx context.Context, name string, ports map[int32]struct{}) error {
+func (m *MockClient) UpdateFirewall(ctx context.Context, name string, rule gcp.FirewallRule) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "UpdateFirewall", ctx, name, ports)
+	ret := m.ctrl.Call(m, "UpdateFirewall", ctx, name, rule)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // UpdateFirewall indicates an expected call of UpdateFirewall.
-func (mr *MockClientMockRecorder) UpdateFirewall(ctx, name, ports any) *gomock.Call {
+func (mr *MockClientMockRecorder) UpdateFirewall(ctx, name, rule any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateFirewall", reflect.TypeOf((*MockClient)(nil).UpdateFirewall), ctx, name, rule)
+}
+
+// UpdateServiceAttachment mocks base method.
+func (m *MockClient) UpdateServiceAttachment(ctx context.Context, name string, consumers []*computepb.ServiceAttachmentConsumerProjectLimit, natSubnetFQNs []string, reconcileConnections *bool) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateServiceAttachment", ctx, name, consumers, natSubnetFQNs, reconcileConnections)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateServiceAttachment indicates an expected call of UpdateServiceAttachment.
+func (mr *MockClientMockRecorder) UpdateServiceAttachment(ctx, name, consumers, natSubnetFQNs, reconcileConnections any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateFirewall", reflect.TypeOf((*MockClient)(nil).UpdateFirewall), ctx, name, ports)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateServiceAttachment", reflect.TypeOf((*MockClient)(nil).UpdateServiceAttachment), ctx, name, consumers, natSubnetFQNs, reconcileConnections)
 }
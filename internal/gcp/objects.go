@@ -0,0 +1,113 @@
+package gcp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// ObjectStore stores JSON documents by key, e.g. the snapshots of the controller's resources.
+type ObjectStore interface {
+	// WriteObject writes the document, replacing the previous one.
+	WriteObject(ctx context.Context, key string, data []byte) error
+	// ReadObject returns the last document written with the key, or ErrNotFound.
+	ReadObject(ctx context.Context, key string) ([]byte, error)
+	// DeleteObject deletes the document, if it exists.
+	DeleteObject(ctx context.Context, key string) error
+	// Location returns where the document with the key is stored, for users to find it.
+	Location(key string) string
+}
+
+// GCSObjects stores documents as JSON objects in a GCS bucket, named <prefix><key>.json.
+type GCSObjects struct {
+	svc    *storage.Service
+	bucket string
+	prefix string
+}
+
+var _ ObjectStore = &GCSObjects{}
+
+// NewGCSObjects returns a store writing to the bucket, which is a bucket name, optionally
+// followed by the prefix of the objects, e.g. my-bucket/psc-portmapper/.
+func NewGCSObjects(ctx context.Context, cfg ClientConfig, bucket string, opts ...option.ClientOption) (*GCSObjects, error) {
+	bucket, prefix, err := ParseBucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	credOpts, err := credentialOptions(ctx, cfg.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	svc, err := storage.NewService(ctx, append(credOpts, opts...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the GCS client: %w", err)
+	}
+	return &GCSObjects{svc: svc, bucket: bucket, prefix: prefix}, nil
+}
+
+// ParseBucket returns the bucket and object prefix of a bucket, e.g. gs://my-bucket/psc-portmapper/.
+// The gs:// scheme is optional.
+func ParseBucket(s string) (string, string, error) {
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(s, "gs://"), "/")
+	if bucket == "" {
+		return "", "", errors.New("the bucket must be set")
+	}
+	return bucket, prefix, nil
+}
+
+func (g *GCSObjects) WriteObject(ctx context.Context, key string, data []byte) error {
+	obj := &storage.Object{Name: g.name(key), ContentType: "application/json"}
+	_, err := g.svc.Objects.Insert(g.bucket, obj).Media(bytes.NewReader(data)).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to write gs://%s/%s: %w", g.bucket, obj.Name, err)
+	}
+	return nil
+}
+
+func (g *GCSObjects) ReadObject(ctx context.Context, key string) ([]byte, error) {
+	name := g.name(key)
+	res, err := g.svc.Objects.Get(g.bucket, name).Context(ctx).Download()
+	if isNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gs://%s/%s: %w", g.bucket, name, err)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gs://%s/%s: %w", g.bucket, name, err)
+	}
+	return data, nil
+}
+
+func (g *GCSObjects) DeleteObject(ctx context.Context, key string) error {
+	name := g.name(key)
+	err := g.svc.Objects.Delete(g.bucket, name).Context(ctx).Do()
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to delete gs://%s/%s: %w", g.bucket, name, err)
+	}
+	return nil
+}
+
+// Location returns the gs:// URL of the document's object.
+func (g *GCSObjects) Location(key string) string {
+	return "gs://" + g.bucket + "/" + g.name(key)
+}
+
+func (g *GCSObjects) name(key string) string {
+	return g.prefix + key + ".json"
+}
+
+func isNotFound(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusNotFound
+}
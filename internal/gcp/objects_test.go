@@ -0,0 +1,109 @@
+package gcp
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+	storage "google.golang.org/api/storage/v1"
+)
+
+func TestParseBucket(t *testing.T) {
+	tests := []struct {
+		bucket         string
+		expectedBucket string
+		expectedPrefix string
+		expectedErr    string
+	}{{
+		bucket:         "my-bucket",
+		expectedBucket: "my-bucket",
+	}, {
+		bucket:         "gs://my-bucket/psc-portmapper/",
+		expectedBucket: "my-bucket",
+		expectedPrefix: "psc-portmapper/",
+	}, {
+		bucket:      "gs://",
+		expectedErr: "the bucket must be set",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.bucket, func(t *testing.T) {
+			bucket, prefix, err := ParseBucket(tt.bucket)
+			if tt.expectedErr != "" {
+				require.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedBucket, bucket)
+			require.Equal(t, tt.expectedPrefix, prefix)
+		})
+	}
+}
+
+func TestGCSObjects(t *testing.T) {
+	var name, data string
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /upload/storage/v1/b/my-bucket/o", func(w http.ResponseWriter, r *http.Request) {
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		require.NoError(t, err)
+		parts := multipart.NewReader(r.Body, params["boundary"])
+		part, err := parts.NextPart()
+		require.NoError(t, err)
+		obj := &storage.Object{}
+		require.NoError(t, json.NewDecoder(part).Decode(obj))
+		part, err = parts.NextPart()
+		require.NoError(t, err)
+		media, err := io.ReadAll(part)
+		require.NoError(t, err)
+		name, data = obj.Name, string(media)
+		_ = json.NewEncoder(w).Encode(obj)
+	})
+	mux.HandleFunc("GET /storage/v1/b/my-bucket/o/{name...}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("name") != name {
+			http.Error(w, `{"error": {"code": 404, "message": "No such object"}}`, http.StatusNotFound)
+			return
+		}
+		require.Equal(t, "media", r.URL.Query().Get("alt"))
+		_, _ = w.Write([]byte(data))
+	})
+	mux.HandleFunc("DELETE /storage/v1/b/my-bucket/o/{name...}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("name") != name {
+			http.Error(w, `{"error": {"code": 404, "message": "No such object"}}`, http.StatusNotFound)
+			return
+		}
+		name, data = "", ""
+		w.WriteHeader(http.StatusNoContent)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	ctx := context.Background()
+	cfg := ClientConfig{Project: "my-project"}
+	s, err := NewGCSObjects(ctx, cfg, "gs://my-bucket/psc-portmapper/", option.WithEndpoint(srv.URL+"/storage/v1/"), option.WithoutAuthentication())
+	require.NoError(t, err)
+	require.NoError(t, s.WriteObject(ctx, "default/kafka", []byte(`{"stateful_set": "default/kafka"}`)))
+	require.Equal(t, "psc-portmapper/default/kafka.json", name)
+	require.Equal(t, "gs://my-bucket/psc-portmapper/default/kafka.json", s.Location("default/kafka"))
+	require.Equal(t, `{"stateful_set": "default/kafka"}`, data)
+	read, err := s.ReadObject(ctx, "default/kafka")
+	require.NoError(t, err)
+	require.Equal(t, data, string(read))
+	_, err = s.ReadObject(ctx, "default/zookeeper")
+	require.ErrorIs(t, err, ErrNotFound)
+	require.NoError(t, s.DeleteObject(ctx, "default/kafka"))
+	_, err = s.ReadObject(ctx, "default/kafka")
+	require.ErrorIs(t, err, ErrNotFound)
+	// Deleting a missing object isn't an error.
+	require.NoError(t, s.DeleteObject(ctx, "default/kafka"))
+
+	s, err = NewGCSObjects(ctx, cfg, "gs://other-bucket", option.WithEndpoint(srv.URL+"/storage/v1/"), option.WithoutAuthentication())
+	require.NoError(t, err)
+	require.ErrorContains(t, s.WriteObject(ctx, "default/kafka", nil), "failed to write gs://other-bucket/default/kafka.json")
+}
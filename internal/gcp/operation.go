@@ -0,0 +1,258 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	compute "cloud.google.com/go/compute/apiv1"
+	"github.com/go-logr/logr"
+	"github.com/googleapis/gax-go/v2"
+)
+
+// OperationConfig configures how the operations started by mutating calls are polled until
+// they're done. Zero values use the defaults.
+type OperationConfig struct {
+	// How long to wait before polling an operation for the second time. The first poll is
+	// immediate, since most operations are done by then.
+	PollInitial time.Duration `env:"POLL_INITIAL, default=1s"`
+	// The longest wait between two polls.
+	PollMax time.Duration `env:"POLL_MAX, default=30s"`
+	// How much the wait between polls grows after each one.
+	PollMultiplier float64 `env:"POLL_MULTIPLIER, default=2"`
+	// How often the progress of an operation that's still running is reported, see
+	// WithOperationProgress. 0 disables reporting.
+	ProgressInterval time.Duration `env:"PROGRESS_INTERVAL, default=30s"`
+}
+
+var defaultOperationConfig = OperationConfig{
+	PollInitial:      time.Second,
+	PollMax:          30 * time.Second,
+	PollMultiplier:   2,
+	ProgressInterval: 30 * time.Second,
+}
+
+// withDefaults returns the config with its zero values replaced with the defaults.
+func (c *OperationConfig) withDefaults() OperationConfig {
+	if c == nil {
+		return defaultOperationConfig
+	}
+	cfg := *c
+	if cfg.PollInitial <= 0 {
+		cfg.PollInitial = defaultOperationConfig.PollInitial
+	}
+	if cfg.PollMax <= 0 {
+		cfg.PollMax = defaultOperationConfig.PollMax
+	}
+	if cfg.PollMultiplier < 1 {
+		cfg.PollMultiplier = defaultOperationConfig.PollMultiplier
+	}
+	return cfg
+}
+
+// OperationProgress describes a GCP operation that's still running.
+type OperationProgress struct {
+	Name string
+	// The kind of operation, e.g. insert or delete.
+	Type       string
+	TargetLink string
+	Status     string
+	// How far along it is, from 0 to 100. Most operations don't report it.
+	Progress int32
+	Elapsed  time.Duration
+}
+
+type progressKey struct{}
+
+// WithOperationProgress returns a context whose mutating calls pass the progress of their
+// operation to report every OperationConfig.ProgressInterval while it's running, so that
+// long-running ones can be surfaced, e.g. as events. Progress is logged regardless, with the
+// context's logger.
+func WithOperationProgress(ctx context.Context, report func(OperationProgress)) context.Context {
+	return context.WithValue(ctx, progressKey{}, report)
+}
+
+// wait polls the operation with an exponential backoff until it's done, reporting its
+// progress every cfg.ProgressInterval.
+func wait(ctx context.Context, op *compute.Operation, cfg *OperationConfig) error {
+	c := cfg.withDefaults()
+	bo := gax.Backoff{Initial: c.PollInitial, Max: c.PollMax, Multiplier: c.PollMultiplier}
+	start := time.Now()
+	lastReport := start
+	for {
+		err := op.Poll(ctx, callOpts()...)
+		// Operations that fail are done, and their errors are only in the operation.
+		if oe := operationError(op); oe != nil {
+			return oe
+		}
+		if err != nil {
+			return err
+		}
+		if op.Done() {
+			return nil
+		}
+		if now := time.Now(); c.ProgressInterval > 0 && now.Sub(lastReport) >= c.ProgressInterval {
+			lastReport = now
+			reportProgress(ctx, op, now.Sub(start))
+		}
+		err = gax.Sleep(ctx, bo.Pause())
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func reportProgress(ctx context.Context, op *compute.Operation, elapsed time.Duration) {
+	p := op.Proto()
+	progress := OperationProgress{
+		Name:       p.GetName(),
+		Type:       p.GetOperationType(),
+		TargetLink: p.GetTargetLink(),
+		Status:     p.GetStatus().String(),
+		Progress:   p.GetProgress(),
+		Elapsed:    elapsed,
+	}
+	logr.FromContextOrDiscard(ctx).Info("Waiting for a GCP operation.", "operation", progress.Name,
+		"type", progress.Type, "target", progress.TargetLink, "status", progress.Status,
+		"progress", progress.Progress, "elapsed", elapsed)
+	if report, ok := ctx.Value(progressKey{}).(func(OperationProgress)); ok {
+		report(progress)
+	}
+}
+
+// ErrorKind classifies the errors GCP operations complete with, so that callers can handle
+// them differently. Its values are the API's error codes.
+type ErrorKind string
+
+const (
+	// ErrorKindResourceInUse is returned when deleting a resource that another one still uses,
+	// e.g. a backend service a forwarding rule points to. It can be deleted once that one is.
+	ErrorKindResourceInUse ErrorKind = "RESOURCE_IN_USE_BY_ANOTHER_RESOURCE"
+	// ErrorKindResourceNotReady is returned when a resource the operation depends on is still
+	// being created or changed, e.g. by a previous operation.
+	ErrorKindResourceNotReady ErrorKind = "RESOURCE_NOT_READY"
+	// ErrorKindQuotaExceeded is returned when the project is out of quota for the resource.
+	ErrorKindQuotaExceeded ErrorKind = "QUOTA_EXCEEDED"
+)
+
+// resourceLinkRegexp matches the resource links quoted in the messages of operation errors,
+// e.g. The resource 'projects/p/regions/r/backendServices/b' is already being used by
+// 'projects/p/regions/r/forwardingRules/f'.
+var resourceLinkRegexp = regexp.MustCompile(`'((?:https://[^']*/)?projects/[^']+)'`)
+
+// OperationError is returned when a GCP operation completes with errors. It unwraps to a
+// *ClientError with the operation's HTTP status.
+type OperationError struct {
+	Operation  string
+	Type       string
+	TargetLink string
+	Errors     []OperationErrorEntry
+	status     int
+}
+
+// OperationErrorEntry is one of an operation's errors.
+type OperationErrorEntry struct {
+	Code    string
+	Message string
+	// Resource is the relative name of the resource the error is about, if its message names
+	// one: the resource using the target for ErrorKindResourceInUse, and otherwise the first
+	// one named.
+	Resource string
+}
+
+// NewOperationError returns an error as a GCP operation targeting the resource would complete
+// with it. It's meant for alternative Client implementations, like fakes.
+func NewOperationError(status int, kind ErrorKind, target, msg string) *OperationError {
+	return &OperationError{
+		TargetLink: target,
+		Errors:     []OperationErrorEntry{newOperationErrorEntry(string(kind), msg)},
+		status:     status,
+	}
+}
+
+func newOperationErrorEntry(code, msg string) OperationErrorEntry {
+	e := OperationErrorEntry{Code: code, Message: msg}
+	links := resourceLinkRegexp.FindAllStringSubmatch(msg, -1)
+	switch {
+	case len(links) == 0:
+	case ErrorKind(code) == ErrorKindResourceInUse:
+		e.Resource = RelativeName(links[len(links)-1][1])
+	default:
+		e.Resource = RelativeName(links[0][1])
+	}
+	return e
+}
+
+// operationError returns the errors the operation completed with, if any.
+func operationError(op *compute.Operation) *OperationError {
+	p := op.Proto()
+	errs := p.GetError().GetErrors()
+	if len(errs) == 0 {
+		return nil
+	}
+	e := &OperationError{
+		Operation:  p.GetName(),
+		Type:       p.GetOperationType(),
+		TargetLink: p.GetTargetLink(),
+		status:     int(p.GetHttpErrorStatusCode()),
+	}
+	for _, oe := range errs {
+		e.Errors = append(e.Errors, newOperationErrorEntry(oe.GetCode(), oe.GetMessage()))
+	}
+	return e
+}
+
+func (e *OperationError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, oe := range e.Errors {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", oe.Code, oe.Message))
+	}
+	msg := strings.Join(msgs, "; ")
+	if e.Operation == "" {
+		return msg
+	}
+	return fmt.Sprintf("operation %s (%s %s) failed: %s", e.Operation, e.Type, RelativeName(e.TargetLink), msg)
+}
+
+func (e *OperationError) Unwrap() error {
+	return &ClientError{msg: e.Error(), status: e.status}
+}
+
+// StatusCode returns the HTTP status code of the operation's error.
+func (e *OperationError) StatusCode() int {
+	return e.status
+}
+
+// Kind returns the kind of the operation's first error with a known kind, or "".
+func (e *OperationError) Kind() ErrorKind {
+	for _, oe := range e.Errors {
+		switch k := ErrorKind(oe.Code); k {
+		case ErrorKindResourceInUse, ErrorKindResourceNotReady, ErrorKindQuotaExceeded:
+			return k
+		}
+	}
+	return ""
+}
+
+// Resource returns the resource the operation's first error of the kind is about, if any.
+func (e *OperationError) Resource(kind ErrorKind) string {
+	for _, oe := range e.Errors {
+		if ErrorKind(oe.Code) == kind {
+			return oe.Resource
+		}
+	}
+	return ""
+}
+
+// ErrorKindOf returns the kind of the operation error err wraps, or "" if it doesn't wrap one
+// or its kind isn't known.
+func ErrorKindOf(err error) ErrorKind {
+	var oe *OperationError
+	if errors.As(err, &oe) {
+		return oe.Kind()
+	}
+	return ""
+}
@@ -0,0 +1,55 @@
+package gcp
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOperationError(t *testing.T) {
+	tests := []struct {
+		name             string
+		err              *OperationError
+		expectedKind     ErrorKind
+		expectedResource string
+		expectedMsg      string
+	}{{
+		name: "Resource in use",
+		err: &OperationError{
+			Operation:  "operation-1",
+			Type:       "delete",
+			TargetLink: "https://www.googleapis.com/compute/v1/projects/p/regions/r/backendServices/be",
+			Errors: []OperationErrorEntry{newOperationErrorEntry(
+				"RESOURCE_IN_USE_BY_ANOTHER_RESOURCE",
+				"The backend_service resource 'projects/p/regions/r/backendServices/be' is already being used by 'https://www.googleapis.com/compute/v1/projects/p/regions/r/forwardingRules/fr'",
+			)},
+		},
+		expectedKind:     ErrorKindResourceInUse,
+		expectedResource: "projects/p/regions/r/forwardingRules/fr",
+		expectedMsg:      "operation operation-1 (delete projects/p/regions/r/backendServices/be) failed: RESOURCE_IN_USE_BY_ANOTHER_RESOURCE: The backend_service resource 'projects/p/regions/r/backendServices/be' is already being used by 'https://www.googleapis.com/compute/v1/projects/p/regions/r/forwardingRules/fr'",
+	}, {
+		name:             "Resource not ready",
+		err:              NewOperationError(http.StatusBadRequest, ErrorKindResourceNotReady, "", "The resource 'projects/p/regions/r/networkEndpointGroups/neg' is not ready"),
+		expectedKind:     ErrorKindResourceNotReady,
+		expectedResource: "projects/p/regions/r/networkEndpointGroups/neg",
+		expectedMsg:      "RESOURCE_NOT_READY: The resource 'projects/p/regions/r/networkEndpointGroups/neg' is not ready",
+	}, {
+		name: "Unknown errors",
+		err: &OperationError{Errors: []OperationErrorEntry{
+			newOperationErrorEntry("INTERNAL_ERROR", "Internal error."),
+			newOperationErrorEntry("QUOTA_EXCEEDED", "Quota 'FORWARDING_RULES' exceeded."),
+		}},
+		expectedKind: ErrorKindQuotaExceeded,
+		expectedMsg:  "INTERNAL_ERROR: Internal error.; QUOTA_EXCEEDED: Quota 'FORWARDING_RULES' exceeded.",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expectedKind, tt.err.Kind())
+			require.Equal(t, tt.expectedKind, ErrorKindOf(tt.err))
+			require.Equal(t, tt.expectedResource, tt.err.Resource(tt.expectedKind))
+			require.EqualError(t, tt.err, tt.expectedMsg)
+		})
+	}
+}
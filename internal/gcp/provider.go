@@ -0,0 +1,181 @@
+package gcp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"sync"
+
+	"go.uber.org/multierr"
+	"google.golang.org/api/option"
+)
+
+// ClientProvider returns clients that authenticate with credentials provided at runtime,
+// e.g. per-spec credentials read from a Secret.
+type ClientProvider interface {
+	// ClientFor returns the client for creds, and a function to call once it's not used
+	// anymore, e.g. at the end of a reconcile.
+	ClientFor(ctx context.Context, creds *Credentials) (Client, func(), error)
+}
+
+// CachingClientProvider builds a GCPClient for each distinct set of credentials and reuses
+// it for as long as the credentials don't change. When credentials with a known ID change
+// (i.e. they were rotated), a new client is built lazily, and the outdated one is closed once
+// the callers using it are done, so that their calls in flight don't fail.
+type CachingClientProvider struct {
+	cfg  ClientConfig
+	opts []option.ClientOption
+	// Builds the clients, replaced in tests.
+	build func(ctx context.Context, cfg ClientConfig, opts ...option.ClientOption) (*GCPClient, error)
+
+	mu      sync.Mutex
+	clients map[string]*cachedClient
+	// The outdated clients still in use.
+	retired map[*cachedClient]struct{}
+}
+
+type cachedClient struct {
+	// The hash of the credentials the client was built with.
+	hash   string
+	client *GCPClient
+	// The number of callers that didn't release the client yet.
+	users int
+}
+
+var _ ClientProvider = &CachingClientProvider{}
+
+func NewClientProvider(ctx context.Context, cfg ClientConfig, opts ...option.ClientOption) (*CachingClientProvider, error) {
+	if cfg.Credentials != nil {
+		err := validateImpersonationTargets(cfg.Credentials.SecretImpersonationTargets)
+		if err != nil {
+			return nil, err
+		}
+	}
+	credOpts, err := credentialOptions(ctx, cfg.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	return &CachingClientProvider{
+		cfg:     cfg,
+		opts:    append(credOpts, opts...),
+		build:   newClient,
+		clients: map[string]*cachedClient{},
+		retired: map[*cachedClient]struct{}{},
+	}, nil
+}
+
+func (p *CachingClientProvider) ClientFor(ctx context.Context, creds *Credentials) (Client, func(), error) {
+	hash := credentialsHash(creds)
+	id := hash
+	if creds != nil && creds.ID != "" {
+		id = creds.ID
+	}
+
+	p.mu.Lock()
+	cached, ok := p.clients[id]
+	if ok && cached.hash == hash {
+		defer p.mu.Unlock()
+		return cached.client, p.use(cached), nil
+	}
+	p.mu.Unlock()
+
+	// Building the client can take a while, e.g. to exchange the credentials' token, so it's
+	// done without holding the lock, so that the clients for other credentials aren't blocked.
+	opts, err := runtimeCredentialOptions(ctx, p.opts, p.cfg.Credentials, creds)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The client outlives the reconcile that requested it, so it mustn't be bound to its context.
+	c, err := p.build(context.WithoutCancel(ctx), p.cfg, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cached, ok = p.clients[id]
+	if ok && cached.hash == hash {
+		// Another caller built one for the same credentials in the meantime.
+		_ = c.Close()
+		return cached.client, p.use(cached), nil
+	}
+	if ok {
+		// The credentials were rotated. The old client is closed once it's released.
+		if cached.users > 0 {
+			p.retired[cached] = struct{}{}
+		} else {
+			_ = cached.client.Close()
+		}
+	}
+	next := &cachedClient{hash: hash, client: c}
+	p.clients[id] = next
+	return c, p.use(next), nil
+}
+
+// use counts a user of the client, and returns the function releasing it, which closes the
+// client if it's outdated and was the last user. p.mu must be held.
+func (p *CachingClientProvider) use(c *cachedClient) func() {
+	c.users++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			c.users--
+			if _, ok := p.retired[c]; ok && c.users == 0 {
+				delete(p.retired, c)
+				_ = c.client.Close()
+			}
+		})
+	}
+}
+
+// CachedClient describes a client in the cache, without exposing its credentials.
+type CachedClient struct {
+	// The ID of the credentials, or their hash if they have none.
+	ID string `json:"id"`
+	// A prefix of the credentials' hash, to tell whether they were rotated.
+	CredentialsHash string `json:"credentials_hash"`
+}
+
+// Cached returns the clients in the cache, sorted by ID.
+func (p *CachingClientProvider) Cached() []CachedClient {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cached := make([]CachedClient, 0, len(p.clients))
+	for id, c := range p.clients {
+		cached = append(cached, CachedClient{ID: id, CredentialsHash: c.hash[:12]})
+	}
+	slices.SortFunc(cached, func(a, b CachedClient) int { return strings.Compare(a.ID, b.ID) })
+	return cached
+}
+
+// Close closes all the clients built so far, including the outdated ones still in use.
+func (p *CachingClientProvider) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var err error
+	for id, c := range p.clients {
+		err = multierr.Append(err, c.client.Close())
+		delete(p.clients, id)
+	}
+	for c := range p.retired {
+		err = multierr.Append(err, c.client.Close())
+		delete(p.retired, c)
+	}
+	return err
+}
+
+func credentialsHash(creds *Credentials) string {
+	h := sha256.New()
+	if creds != nil {
+		h.Write(creds.JSON)
+		h.Write([]byte{0})
+		h.Write([]byte(creds.ImpersonateServiceAccount))
+		h.Write([]byte{0})
+		h.Write([]byte(creds.Namespace))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
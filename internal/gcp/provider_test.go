@@ -0,0 +1,152 @@
+package gcp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+)
+
+func TestCachingClientProvider(t *testing.T) {
+	ctx := context.Background()
+	cfg := ClientConfig{
+		Project:     "my-project",
+		Region:      "us-east1",
+		Network:     "my-vpc",
+		Subnetwork:  "my-subnet",
+		Credentials: &CredentialsConfig{SecretCredentialSources: []string{"/var/run/token"}},
+	}
+	p, err := NewClientProvider(ctx, cfg, option.WithoutAuthentication())
+	require.NoError(t, err)
+	defer func() { require.NoError(t, p.Close()) }()
+
+	c1, release, err := p.ClientFor(ctx, &Credentials{ID: "ns/secret"})
+	require.NoError(t, err)
+	release()
+
+	c2, release, err := p.ClientFor(ctx, &Credentials{ID: "ns/secret"})
+	require.NoError(t, err)
+	require.Same(t, c1, c2, "expected the client to be reused while the credentials don't change")
+	release()
+
+	c3, release, err := p.ClientFor(ctx, &Credentials{ID: "ns/other-secret"})
+	require.NoError(t, err)
+	release()
+	require.NotSame(t, c1, c3, "expected a different client for different credentials")
+
+	rotated := rotatedCredentials()
+	c4, release, err := p.ClientFor(ctx, rotated)
+	require.NoError(t, err)
+	release()
+	require.NotSame(t, c1, c4, "expected a new client after the credentials were rotated")
+	require.Len(t, p.clients, 2, "expected the outdated client to be replaced")
+	cached := p.Cached()
+	require.Equal(t, []string{"ns/other-secret", "ns/secret"}, []string{cached[0].ID, cached[1].ID})
+	require.Equal(t, credentialsHash(rotated)[:12], cached[1].CredentialsHash)
+}
+
+func TestCachingClientProviderRotationInUse(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error": {"code": 404, "message": "not found"}}`))
+	}))
+	defer srv.Close()
+	cfg := ClientConfig{
+		Project:     "my-project",
+		Region:      "us-east1",
+		Network:     "my-vpc",
+		Subnetwork:  "my-subnet",
+		Credentials: &CredentialsConfig{SecretCredentialSources: []string{"/var/run/token"}},
+	}
+	p, err := NewClientProvider(ctx, cfg, option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	require.NoError(t, err)
+	defer func() { require.NoError(t, p.Close()) }()
+
+	// A reconcile gets the client, and the credentials are rotated while it's using it.
+	old, release, err := p.ClientFor(ctx, &Credentials{ID: "ns/secret"})
+	require.NoError(t, err)
+	_, releaseRotated, err := p.ClientFor(ctx, rotatedCredentials())
+	require.NoError(t, err)
+	defer releaseRotated()
+	require.Len(t, p.retired, 1)
+
+	// Its next calls still work, and the old client is closed once it's released.
+	_, err = old.GetFirewall(ctx, "fw")
+	require.ErrorIs(t, err, ErrNotFound)
+	release()
+	require.Empty(t, p.retired)
+	// Releasing it again does nothing.
+	release()
+}
+
+func TestCachingClientProviderConcurrentBuilds(t *testing.T) {
+	ctx := context.Background()
+	cfg := ClientConfig{
+		Project:     "my-project",
+		Region:      "us-east1",
+		Network:     "my-vpc",
+		Subnetwork:  "my-subnet",
+		Credentials: &CredentialsConfig{SecretCredentialSources: []string{"/var/run/token"}},
+	}
+	p, err := NewClientProvider(ctx, cfg, option.WithoutAuthentication())
+	require.NoError(t, err)
+	defer func() { require.NoError(t, p.Close()) }()
+	// The first build of each client blocks until it's unblocked.
+	unblock := make(chan struct{})
+	var builds atomic.Int32
+	p.build = func(ctx context.Context, cfg ClientConfig, opts ...option.ClientOption) (*GCPClient, error) {
+		if builds.Add(1) == 1 {
+			<-unblock
+		}
+		return newClient(ctx, cfg, opts...)
+	}
+
+	type result struct {
+		client Client
+		err    error
+	}
+	slow := make(chan result)
+	go func() {
+		c, release, err := p.ClientFor(ctx, &Credentials{ID: "ns/secret"})
+		if err == nil {
+			release()
+		}
+		slow <- result{c, err}
+	}()
+	require.Eventually(t, func() bool { return builds.Load() == 1 }, time.Second, time.Millisecond)
+
+	// A slow build doesn't block the clients for other credentials, nor the ones for the same
+	// credentials, which are built concurrently.
+	other, release, err := p.ClientFor(ctx, &Credentials{ID: "ns/other-secret"})
+	require.NoError(t, err)
+	release()
+	fast, release, err := p.ClientFor(ctx, &Credentials{ID: "ns/secret"})
+	require.NoError(t, err)
+	release()
+	require.NotSame(t, other, fast)
+
+	// The slower build is discarded in favor of the client already cached.
+	close(unblock)
+	res := <-slow
+	require.NoError(t, res.err)
+	require.Same(t, fast, res.client)
+	require.Len(t, p.clients, 2)
+	require.Empty(t, p.retired)
+}
+
+func rotatedCredentials() *Credentials {
+	return &Credentials{ID: "ns/secret", JSON: []byte(`{
+		"type": "external_account",
+		"audience": "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider",
+		"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+		"token_url": "https://sts.googleapis.com/v1/token",
+		"credential_source": {"file": "/var/run/token"}
+	}`)}
+}
@@ -0,0 +1,62 @@
+package gcp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// httpOptions makes all the compute clients share a single, tuned HTTP transport. The
+// Compute Engine API only has REST clients (there's no gRPC transport to switch to), so
+// connection reuse and keepalives are tuned here instead.
+func httpOptions(ctx context.Context, cfg *HTTPConfig, opts []option.ClientOption) ([]option.ClientOption, error) {
+	if cfg == nil || cfg.isZero() {
+		return opts, nil
+	}
+	tr, _, err := newHTTPTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+	rt, err := htransport.NewTransport(ctx, tr, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build the HTTP transport: %w", err)
+	}
+	return append(opts, option.WithHTTPClient(&http.Client{Transport: rt})), nil
+}
+
+// newHTTPTransport returns the default transport tuned as per cfg, along with its HTTP/2
+// transport.
+func newHTTPTransport(cfg *HTTPConfig) (*http.Transport, *http2.Transport, error) {
+	base, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return nil, nil, fmt.Errorf("unexpected default HTTP transport type %T", http.DefaultTransport)
+	}
+	tr := base.Clone()
+	if cfg.MaxIdleConnsPerHost > 0 {
+		tr.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+		if tr.MaxIdleConns < cfg.MaxIdleConnsPerHost {
+			tr.MaxIdleConns = cfg.MaxIdleConnsPerHost
+		}
+	}
+	if cfg.IdleConnTimeout > 0 {
+		tr.IdleConnTimeout = cfg.IdleConnTimeout
+	}
+	if cfg.KeepAlive > 0 {
+		tr.DialContext = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: cfg.KeepAlive}).DialContext
+	}
+	h2, err := http2.ConfigureTransports(tr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to configure HTTP/2: %w", err)
+	}
+	if cfg.ReadIdleTimeout > 0 {
+		// Sends a ping on idle HTTP/2 connections, so broken ones are detected and pruned.
+		h2.ReadIdleTimeout = cfg.ReadIdleTimeout
+	}
+	return tr, h2, nil
+}
@@ -0,0 +1,95 @@
+package gcp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+)
+
+func TestNewHTTPTransport(t *testing.T) {
+	cfg := &HTTPConfig{
+		MaxIdleConnsPerHost: 500,
+		IdleConnTimeout:     2 * time.Minute,
+		KeepAlive:           15 * time.Second,
+		ReadIdleTimeout:     30 * time.Second,
+	}
+	tr, h2, err := newHTTPTransport(cfg)
+	require.NoError(t, err)
+	require.Equal(t, 500, tr.MaxIdleConnsPerHost)
+	// The overall limit is raised so that it doesn't cap the per-host one.
+	require.Equal(t, 500, tr.MaxIdleConns)
+	require.Equal(t, 2*time.Minute, tr.IdleConnTimeout)
+	require.NotNil(t, tr.DialContext)
+	require.Contains(t, tr.TLSNextProto, "h2", "expected HTTP/2 to be configured")
+	require.Equal(t, 30*time.Second, h2.ReadIdleTimeout)
+	require.NotSame(t, http.DefaultTransport, tr, "expected the default transport to be left as is")
+
+	// Unset values keep the defaults.
+	tr, h2, err = newHTTPTransport(&HTTPConfig{IdleConnTimeout: time.Minute})
+	require.NoError(t, err)
+	def := http.DefaultTransport.(*http.Transport)
+	require.Equal(t, def.MaxIdleConnsPerHost, tr.MaxIdleConnsPerHost)
+	require.Equal(t, def.MaxIdleConns, tr.MaxIdleConns)
+	require.Zero(t, h2.ReadIdleTimeout)
+}
+
+func TestHTTPOptions(t *testing.T) {
+	ctx := context.Background()
+	opts := []option.ClientOption{option.WithoutAuthentication()}
+
+	// Without tuning, the clients build their own transports.
+	got, err := httpOptions(ctx, nil, opts)
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	got, err = httpOptions(ctx, &HTTPConfig{}, opts)
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+
+	got, err = httpOptions(ctx, &HTTPConfig{MaxIdleConnsPerHost: 10}, opts)
+	require.NoError(t, err)
+	require.Len(t, got, 2, "expected an HTTP client option")
+}
+
+func TestComputeClientsShareTransport(t *testing.T) {
+	ctx := context.Background()
+	var mu sync.Mutex
+	conns := map[string]struct{}{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		conns[r.RemoteAddr] = struct{}{}
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error": {"code": 404, "message": "not found"}}`))
+	}))
+	defer srv.Close()
+	cfg := ClientConfig{
+		Project:    "my-project",
+		Region:     "us-east1",
+		Network:    "my-vpc",
+		Subnetwork: "my-subnet",
+		HTTP:       &HTTPConfig{MaxIdleConnsPerHost: 10},
+	}
+	c, err := newClient(ctx, cfg, option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	require.NoError(t, err)
+	defer func() { require.NoError(t, c.Close()) }()
+
+	// Each call goes through a different compute client, and they all reuse one connection.
+	_, err = c.GetFirewall(ctx, "fw")
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = c.GetBackendService(ctx, "backend")
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = c.GetForwardingRule(ctx, "rule")
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = c.GetServiceAttachment(ctx, "svc-att")
+	require.ErrorIs(t, err, ErrNotFound)
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, conns, 1, "expected the compute clients to share the transport's connections")
+}
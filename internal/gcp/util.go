@@ -1,6 +1,9 @@
 package gcp
 
 import (
+	"fmt"
+	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -8,38 +11,211 @@ import (
 	"cloud.google.com/go/compute/apiv1/computepb"
 )
 
-func FirewallNeedsUpdate(fw *computepb.Firewall, expectedPorts map[int32]struct{}) bool {
-	fw.GetAllowed()
-	if fw == nil || fw.GetAllowed() == nil || len(fw.Allowed) != 1 {
-		return true
+// allSources is the source range GCP sets on ingress rules that don't set any sources.
+const allSources = "0.0.0.0/0"
+
+// DefaultFirewallPriority is the priority of the rules that don't set one.
+const DefaultFirewallPriority int32 = 1000
+
+// FirewallRule is the rule allowing traffic to the node ports.
+type FirewallRule struct {
+	Ports map[int32]struct{}
+	// The CIDR ranges allowed. If neither these nor SourceTags are set, all sources are.
+	SourceRanges []string
+	// The network tags of the instances allowed.
+	SourceTags []string
+	// The CIDR ranges traffic is allowed to. If unset, it's allowed to all of the network's
+	// instances.
+	DestinationRanges []string
+	// The rule's priority, from 0 to 65535, lower values taking precedence. If nil, it's
+	// DefaultFirewallPriority.
+	Priority *int32
+	// If true, the rule allows ICMP instead of the TCP ports.
+	ICMP bool
+}
+
+func (r FirewallRule) protocol() string {
+	if r.ICMP {
+		return "icmp"
 	}
-	rule := fw.Allowed[0]
-	if rule == nil || len(rule.Ports) == 0 {
-		return true
+	return "tcp"
+}
+
+func (r FirewallRule) priority() int32 {
+	if r.Priority == nil {
+		return DefaultFirewallPriority
+	}
+	return *r.Priority
+}
+
+// sourceRanges returns the rule's source ranges as GCP sets them.
+func (r FirewallRule) sourceRanges() []string {
+	if len(r.SourceRanges) == 0 && len(r.SourceTags) == 0 {
+		return []string{allSources}
 	}
-	if rule.IPProtocol == nil || *rule.IPProtocol != "tcp" {
-		return true
+	return r.SourceRanges
+}
+
+// FirewallRuleOf returns the rule a firewall created by the controller allows, e.g. to
+// recreate it. It fails if the firewall allows anything else than TCP ports or ICMP.
+func FirewallRuleOf(fw *computepb.Firewall) (FirewallRule, error) {
+	rule := FirewallRule{
+		Ports:             map[int32]struct{}{},
+		SourceRanges:      fw.GetSourceRanges(),
+		SourceTags:        fw.GetSourceTags(),
+		DestinationRanges: fw.GetDestinationRanges(),
+		Priority:          fw.Priority,
 	}
-	strPorts := toSortedStr(expectedPorts)
-	portSet := map[string]struct{}{}
-	for _, p := range strPorts {
-		portSet[p] = struct{}{}
+	for _, a := range fw.GetAllowed() {
+		switch a.GetIPProtocol() {
+		case "icmp":
+			rule.ICMP = true
+		case "tcp":
+			for _, p := range a.GetPorts() {
+				port, err := strconv.ParseInt(p, 10, 32)
+				if err != nil {
+					return FirewallRule{}, fmt.Errorf("firewall %s allows port %q, which isn't a single port", fw.GetName(), p)
+				}
+				rule.Ports[int32(port)] = struct{}{}
+			}
+		default:
+			return FirewallRule{}, fmt.Errorf("firewall %s allows protocol %q", fw.GetName(), a.GetIPProtocol())
+		}
 	}
-	if len(rule.Ports) != len(portSet) {
-		return true
+	if rule.ICMP && len(rule.Ports) > 0 {
+		return FirewallRule{}, fmt.Errorf("firewall %s allows both TCP and ICMP", fw.GetName())
 	}
-	for _, p := range rule.Ports {
-		if _, ok := portSet[p]; !ok {
-			return true
+	return rule, nil
+}
+
+// FirewallNeedsUpdate returns true if the firewall doesn't match the expected rule.
+func FirewallNeedsUpdate(fw *computepb.Firewall, expected FirewallRule) bool {
+	return !DiffFirewall(fw, expected).Empty()
+}
+
+// FirewallDiff describes how a firewall rule differs from the expected one, which allows only
+// the expected TCP ports, or ICMP.
+type FirewallDiff struct {
+	// The TCP ports allowed that aren't expected. "all" if a TCP rule has no ports.
+	AddedPorts []string
+	// The expected TCP ports that aren't allowed.
+	RemovedPorts []string
+	// The protocol of each of the rule's allowed entries, if they aren't just the expected one.
+	Protocols []string
+	// The rule's source ranges, tags and destination ranges, if they aren't the expected ones.
+	SourceRanges      []string
+	SourceTags        []string
+	DestinationRanges []string
+	// The rule's priority, if it isn't the expected one.
+	Priority *int32
+	// True if the rule is disabled, so it allows nothing.
+	Disabled bool
+}
+
+// DiffFirewall compares fw with the expected rule.
+func DiffFirewall(fw *computepb.Firewall, expected FirewallRule) FirewallDiff {
+	d := FirewallDiff{Disabled: fw.GetDisabled()}
+	protocols := []string{}
+	actual := map[string]struct{}{}
+	for _, rule := range fw.GetAllowed() {
+		protocols = append(protocols, rule.GetIPProtocol())
+		if rule.GetIPProtocol() != "tcp" {
+			continue
+		}
+		if len(rule.GetPorts()) == 0 {
+			actual["all"] = struct{}{}
+		}
+		for _, p := range rule.GetPorts() {
+			actual[p] = struct{}{}
 		}
 	}
-	return false
+	if !slices.Equal(protocols, []string{expected.protocol()}) {
+		d.Protocols = protocols
+	}
+	expectedPorts := map[string]struct{}{}
+	for _, p := range toSortedStr(expected.Ports) {
+		expectedPorts[p] = struct{}{}
+		if _, ok := actual[p]; !ok {
+			d.RemovedPorts = append(d.RemovedPorts, p)
+		}
+	}
+	for p := range actual {
+		if _, ok := expectedPorts[p]; !ok {
+			d.AddedPorts = append(d.AddedPorts, p)
+		}
+	}
+	sort.Strings(d.AddedPorts)
+
+	// Rules created by a client that doesn't report the default source range, e.g. a fake,
+	// are compared as if it did.
+	sourceRanges := fw.GetSourceRanges()
+	if len(sourceRanges) == 0 && len(fw.GetSourceTags()) == 0 {
+		sourceRanges = []string{allSources}
+	}
+	d.SourceRanges = diffSet(sourceRanges, expected.sourceRanges())
+	d.SourceTags = diffSet(fw.GetSourceTags(), expected.SourceTags)
+	d.DestinationRanges = diffSet(fw.GetDestinationRanges(), expected.DestinationRanges)
+	if fw.GetPriority() != expected.priority() {
+		d.Priority = toPtr(fw.GetPriority())
+	}
+	return d
+}
+
+// diffSet returns actual, sorted and never nil, if it doesn't have the same elements as
+// expected, and nil otherwise.
+func diffSet(actual, expected []string) []string {
+	a, e := slices.Sorted(slices.Values(actual)), slices.Sorted(slices.Values(expected))
+	if slices.Equal(a, e) {
+		return nil
+	}
+	if a == nil {
+		return []string{}
+	}
+	return a
+}
+
+func (d FirewallDiff) Empty() bool {
+	return len(d.AddedPorts) == 0 && len(d.RemovedPorts) == 0 && d.Protocols == nil &&
+		d.SourceRanges == nil && d.SourceTags == nil && d.DestinationRanges == nil && d.Priority == nil && !d.Disabled
+}
+
+func (d FirewallDiff) String() string {
+	var changes []string
+	if len(d.AddedPorts) > 0 {
+		changes = append(changes, "ports added: "+strings.Join(d.AddedPorts, ", "))
+	}
+	if len(d.RemovedPorts) > 0 {
+		changes = append(changes, "ports removed: "+strings.Join(d.RemovedPorts, ", "))
+	}
+	if d.Protocols != nil {
+		changes = append(changes, fmt.Sprintf("protocols changed to %q", d.Protocols))
+	}
+	if d.SourceRanges != nil {
+		changes = append(changes, fmt.Sprintf("source ranges changed to %q", d.SourceRanges))
+	}
+	if d.SourceTags != nil {
+		changes = append(changes, fmt.Sprintf("source tags changed to %q", d.SourceTags))
+	}
+	if d.DestinationRanges != nil {
+		changes = append(changes, fmt.Sprintf("destination ranges changed to %q", d.DestinationRanges))
+	}
+	if d.Priority != nil {
+		changes = append(changes, fmt.Sprintf("priority changed to %d", *d.Priority))
+	}
+	if d.Disabled {
+		changes = append(changes, "disabled")
+	}
+	return strings.Join(changes, "; ")
 }
 
 func NetworkFQN(project, name string) string {
 	return fqnBase(project) + "/global/networks/" + name
 }
 
+func FirewallFQN(project, name string) string {
+	return fqnBase(project) + "/global/firewalls/" + name
+}
+
 func SubnetFQN(project, region, name string) string {
 	return regionFQNBase(project, region) + "/subnetworks/" + name
 }
@@ -60,6 +236,43 @@ func ServiceAttachmentFQN(project, region, name string) string {
 	return regionFQNBase(project, region) + "/serviceAttachments/" + name
 }
 
+func InstanceFQN(project, zone, name string) string {
+	return fqnBase(project) + "/zones/" + zone + "/instances/" + name
+}
+
+var subnetFQNRegexp = regexp.MustCompile(`^projects/([^/]+)/regions/([^/]+)/subnetworks/([^/]+)$`)
+
+// parseSubnetFQN returns the project, region and name in a subnet's FQN or URL.
+func parseSubnetFQN(fqn string) (project, region, name string, err error) {
+	matches := subnetFQNRegexp.FindStringSubmatch(RelativeName(fqn))
+	if len(matches) != 4 {
+		return "", "", "", fmt.Errorf("invalid subnet FQN format, expected 'projects/<project-id>/regions/<region>/subnetworks/<name>', got: %s", fqn)
+	}
+	return matches[1], matches[2], matches[3], nil
+}
+
+var providerIDRegexp = regexp.MustCompile(`^gce://([^/]+)/([^/]+)/([^/]+)$`)
+
+// ParseProviderID returns the project, zone and instance name in a node's provider ID, which
+// looks like gce://<project-id>/<zone>/<instance-name>.
+func ParseProviderID(providerID string) (project, zone, instance string, err error) {
+	matches := providerIDRegexp.FindStringSubmatch(providerID)
+	if len(matches) != 4 {
+		return "", "", "", fmt.Errorf("invalid provider ID format, expected 'gce://<project-id>/<zone>/<instance-name>', got: %s", providerID)
+	}
+	// matches[0] is the full string, matches[1:] are the capture groups
+	return matches[1], matches[2], matches[3], nil
+}
+
+// regionOf returns the region a zone is in, e.g. us-east1 for us-east1-b.
+func regionOf(zone string) string {
+	i := strings.LastIndex(zone, "-")
+	if i < 0 {
+		return zone
+	}
+	return zone[:i]
+}
+
 func regionFQNBase(project, region string) string {
 	return fqnBase(project) + "/regions/" + region
 }
@@ -68,6 +281,16 @@ func fqnBase(project string) string {
 	return "projects/" + project
 }
 
+// RelativeName returns the FQN of a resource given its URL, as the API returns references to
+// other resources, e.g. https://www.googleapis.com/compute/v1/projects/p/global/networks/n.
+// FQNs are returned as is.
+func RelativeName(url string) string {
+	if i := strings.Index(url, "projects/"); i >= 0 {
+		return url[i:]
+	}
+	return url
+}
+
 func isFQN(s string) bool {
 	return strings.HasPrefix(s, "projects/")
 }
@@ -76,14 +76,190 @@ func TestFirewallNeedsUpdate(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			update := FirewallNeedsUpdate(tt.fw(), tt.expectedPorts)
+			update := FirewallNeedsUpdate(tt.fw(), FirewallRule{Ports: tt.expectedPorts})
 			assert.Equal(t, tt.expected, update)
 		})
 	}
 }
 
+func TestDiffFirewall(t *testing.T) {
+	tests := []struct {
+		name          string
+		fw            func() *computepb.Firewall
+		expectedPorts map[int32]struct{}
+		icmp          bool
+		expected      FirewallDiff
+		expectedStr   string
+	}{{
+		name:          "No changes",
+		fw:            Firewall,
+		expectedPorts: map[int32]struct{}{80: {}},
+	}, {
+		name: "Ports added and removed",
+		fw: func() *computepb.Firewall {
+			fw := Firewall()
+			fw.Allowed[0].Ports = []string{"22", "443", "80"}
+			return fw
+		},
+		expectedPorts: map[int32]struct{}{80: {}, 8080: {}},
+		expected:      FirewallDiff{AddedPorts: []string{"22", "443"}, RemovedPorts: []string{"8080"}},
+		expectedStr:   "ports added: 22, 443; ports removed: 8080",
+	}, {
+		name: "All ports allowed",
+		fw: func() *computepb.Firewall {
+			fw := Firewall()
+			fw.Allowed[0].Ports = nil
+			return fw
+		},
+		expectedPorts: map[int32]struct{}{80: {}},
+		expected:      FirewallDiff{AddedPorts: []string{"all"}, RemovedPorts: []string{"80"}},
+		expectedStr:   "ports added: all; ports removed: 80",
+	}, {
+		name: "Protocol changed",
+		fw: func() *computepb.Firewall {
+			fw := Firewall()
+			fw.Allowed[0].IPProtocol = stringPtr("udp")
+			return fw
+		},
+		expectedPorts: map[int32]struct{}{80: {}},
+		expected:      FirewallDiff{RemovedPorts: []string{"80"}, Protocols: []string{"udp"}},
+		expectedStr:   `ports removed: 80; protocols changed to ["udp"]`,
+	}, {
+		name: "Protocol added",
+		fw: func() *computepb.Firewall {
+			fw := Firewall()
+			fw.Allowed = append(fw.Allowed, &computepb.Allowed{IPProtocol: stringPtr("icmp")})
+			return fw
+		},
+		expectedPorts: map[int32]struct{}{80: {}},
+		expected:      FirewallDiff{Protocols: []string{"tcp", "icmp"}},
+		expectedStr:   `protocols changed to ["tcp" "icmp"]`,
+	}, {
+		name: "Default source range reported",
+		fw: func() *computepb.Firewall {
+			fw := Firewall()
+			fw.SourceRanges = []string{"0.0.0.0/0"}
+			return fw
+		},
+		expectedPorts: map[int32]struct{}{80: {}},
+	}, {
+		name: "Sources and destinations changed",
+		fw: func() *computepb.Firewall {
+			fw := Firewall()
+			fw.SourceRanges = []string{"10.0.0.0/8"}
+			fw.SourceTags = []string{"bastion"}
+			fw.DestinationRanges = []string{"10.1.0.0/16"}
+			return fw
+		},
+		expectedPorts: map[int32]struct{}{80: {}},
+		expected: FirewallDiff{
+			SourceRanges:      []string{"10.0.0.0/8"},
+			SourceTags:        []string{"bastion"},
+			DestinationRanges: []string{"10.1.0.0/16"},
+		},
+		expectedStr: `source ranges changed to ["10.0.0.0/8"]; source tags changed to ["bastion"]; destination ranges changed to ["10.1.0.0/16"]`,
+	}, {
+		name: "Priority changed",
+		fw: func() *computepb.Firewall {
+			fw := Firewall()
+			fw.Priority = toPtr(int32(100))
+			return fw
+		},
+		expectedPorts: map[int32]struct{}{80: {}},
+		expected:      FirewallDiff{Priority: toPtr(int32(100))},
+		expectedStr:   "priority changed to 100",
+	}, {
+		name: "ICMP rule",
+		fw: func() *computepb.Firewall {
+			fw := Firewall()
+			fw.Allowed = []*computepb.Allowed{{IPProtocol: stringPtr("icmp")}}
+			return fw
+		},
+		icmp: true,
+	}, {
+		name: "Disabled",
+		fw: func() *computepb.Firewall {
+			fw := Firewall()
+			fw.Disabled = toPtr(true)
+			return fw
+		},
+		expectedPorts: map[int32]struct{}{80: {}},
+		expected:      FirewallDiff{Disabled: true},
+		expectedStr:   "disabled",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff := DiffFirewall(tt.fw(), FirewallRule{Ports: tt.expectedPorts, ICMP: tt.icmp})
+			assert.Equal(t, tt.expected, diff)
+			assert.Equal(t, tt.expectedStr, diff.String())
+		})
+	}
+}
+
+func TestFirewallRuleOf(t *testing.T) {
+	tests := []struct {
+		name        string
+		fw          func() *computepb.Firewall
+		expected    FirewallRule
+		expectedErr string
+	}{{
+		name: "TCP ports",
+		fw: func() *computepb.Firewall {
+			fw := Firewall()
+			fw.Allowed[0].Ports = []string{"30000", "30001"}
+			fw.SourceRanges = []string{"10.0.0.0/8"}
+			return fw
+		},
+		expected: FirewallRule{
+			Ports:        map[int32]struct{}{30000: {}, 30001: {}},
+			SourceRanges: []string{"10.0.0.0/8"},
+			Priority:     toPtr(DefaultFirewallPriority),
+		},
+	}, {
+		name: "ICMP",
+		fw: func() *computepb.Firewall {
+			fw := Firewall()
+			fw.Allowed = []*computepb.Allowed{{IPProtocol: stringPtr("icmp")}}
+			return fw
+		},
+		expected: FirewallRule{Ports: map[int32]struct{}{}, Priority: toPtr(DefaultFirewallPriority), ICMP: true},
+	}, {
+		name: "Port range",
+		fw: func() *computepb.Firewall {
+			fw := Firewall()
+			fw.Name = stringPtr("fw")
+			fw.Allowed[0].Ports = []string{"30000-30002"}
+			return fw
+		},
+		expectedErr: `firewall fw allows port "30000-30002", which isn't a single port`,
+	}, {
+		name: "Other protocol",
+		fw: func() *computepb.Firewall {
+			fw := Firewall()
+			fw.Name = stringPtr("fw")
+			fw.Allowed = append(fw.Allowed, &computepb.Allowed{IPProtocol: stringPtr("udp")})
+			return fw
+		},
+		expectedErr: `firewall fw allows protocol "udp"`,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := FirewallRuleOf(tt.fw())
+			if tt.expectedErr != "" {
+				assert.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, rule)
+		})
+	}
+}
+
 func Firewall() *computepb.Firewall {
 	return &computepb.Firewall{
+		Priority: toPtr(DefaultFirewallPriority),
 		Allowed: []*computepb.Allowed{{
 			IPProtocol: stringPtr("tcp"),
 			Ports:      []string{"80"},
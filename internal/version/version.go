@@ -0,0 +1,37 @@
+// Package version holds the controller's build info. Version and Commit are set at build
+// time, see .ko.yaml.
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+var (
+	Version = "dev"
+	Commit  = ""
+)
+
+// Info describes the running controller's build.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the build info. If the commit wasn't set at build time, it's read from the VCS
+// info the Go toolchain embeds, if any.
+func Get() Info {
+	commit := Commit
+	if commit == "" {
+		commit = "unknown"
+		if bi, ok := debug.ReadBuildInfo(); ok {
+			for _, s := range bi.Settings {
+				if s.Key == "vcs.revision" {
+					commit = s.Value
+				}
+			}
+		}
+	}
+	return Info{Version: Version, Commit: commit, GoVersion: runtime.Version()}
+}
@@ -19,28 +19,51 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
+	"cloud.google.com/go/compute/metadata"
+
+	"github.com/0x5d/psc-portmapper/internal/api"
 	"github.com/0x5d/psc-portmapper/internal/config"
 	"github.com/0x5d/psc-portmapper/internal/controller"
+	"github.com/0x5d/psc-portmapper/internal/debug"
 	"github.com/0x5d/psc-portmapper/internal/gcp"
+	"github.com/0x5d/psc-portmapper/internal/gcp/fake"
+	"github.com/0x5d/psc-portmapper/internal/version"
+	"github.com/go-logr/logr"
 	"github.com/sethvargo/go-envconfig"
+	"go.uber.org/multierr"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
 	ctrlruntime "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrlconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/filters"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 )
 
+// gcpCheckTimeout bounds how long the GCP ready check waits for the API.
+const gcpCheckTimeout = 5 * time.Second
+
 var (
 	scheme = runtime.NewScheme()
 )
@@ -49,30 +72,81 @@ func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 }
 
-func main() {
-	var metricsAddr string
-	var enableLeaderElection bool
-	var probeAddr string
-	var secureMetrics bool
-	var namespace string
-	flag.StringVar(&metricsAddr, "metrics-bind-address", "0", "The address the metrics endpoint binds to. "+
+// flags are the command line flags.
+type flags struct {
+	metricsAddr          string
+	enableLeaderElection bool
+	probeAddr            string
+	secureMetrics        bool
+	fakeGCP              bool
+	debugAddr            string
+	apiAddr              string
+	apiCertDir           string
+	kubeContext          string
+	once                 string
+	restoreSnapshot      string
+	zap                  zap.Options
+}
+
+func parseFlags() flags {
+	f := flags{zap: zap.Options{Development: true}}
+	flag.StringVar(&f.metricsAddr, "metrics-bind-address", "0", "The address the metrics endpoint binds to. "+
 		"Use :8443 for HTTPS or :8080 for HTTP, or leave as 0 to disable the metrics service.")
-	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
-	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
+	flag.StringVar(&f.probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	flag.BoolVar(&f.enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
-	flag.BoolVar(&secureMetrics, "metrics-secure", true,
+	flag.BoolVar(&f.secureMetrics, "metrics-secure", true,
 		"If set, the metrics endpoint is served securely via HTTPS. Use --metrics-secure=false to use HTTP instead.")
-	flag.StringVar(&namespace, "namespace", "default",
-		"The namespace to watch stateful sets in.")
-	opts := zap.Options{
-		Development: true,
-	}
-	opts.BindFlags(flag.CommandLine)
+	// Deprecated: kept so that existing deployments passing it don't fail to start.
+	flag.String("namespace", "", "Deprecated and ignored, use the WATCH_NAMESPACES environment variable instead.")
+	flag.BoolVar(&f.fakeGCP, "fake-gcp", false,
+		"If set, GCP resources are simulated in memory instead of being created. Meant for local development.")
+	flag.StringVar(&f.debugAddr, "debug-bind-address", "",
+		"If set, the address an unauthenticated server exposing pprof and runtime diagnostics binds to, "+
+			"e.g. localhost:6060. Disabled by default.")
+	flag.StringVar(&f.apiAddr, "api-bind-address", "",
+		"If set, the address the read-only HTTPS API serving the StatefulSets' state binds to, e.g. :8444. "+
+			"Requests are authenticated and authorized like the metrics endpoint's. Disabled by default.")
+	flag.StringVar(&f.apiCertDir, "api-cert-dir", "",
+		"The directory with the API's serving certificate, tls.crt and tls.key. Defaults to a self-signed certificate.")
+	flag.StringVar(&f.kubeContext, "kube-context", "",
+		"The kubeconfig context to use. Defaults to the current context. "+
+			"Meant for running out of cluster, with --kubeconfig.")
+	flag.StringVar(&f.once, "once", "",
+		"If set to <namespace>/<name>, reconciles that StatefulSet once and exits instead of starting the controller. "+
+			"Meant for debugging specs from outside of the cluster.")
+	flag.StringVar(&f.restoreSnapshot, "restore-snapshot", "",
+		"If set to <namespace>/<name>, recreates the GCP resources of that StatefulSet missing from its last "+
+			"exported snapshot and exits instead of starting the controller.")
+	f.zap.BindFlags(flag.CommandLine)
 	flag.Parse()
+	return f
+}
 
-	ctrlruntime.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+func main() {
+	f := parseFlags()
+
+	// The config is loaded before the logger is set up because it configures it.
+	var cfg config.Config
+	cfgErr := envconfig.Process(context.Background(), &cfg)
+	logOpts := []zap.Opts{zap.UseFlagOptions(&f.zap)}
+	if cfgErr == nil {
+		var extra []zap.Opts
+		extra, cfgErr = cfg.Log.ZapOpts()
+		logOpts = append(logOpts, extra...)
+	}
+	ctrlruntime.SetLogger(zap.New(logOpts...))
 	log := ctrlruntime.Log.WithName("setup")
+	if cfgErr != nil {
+		log.Error(cfgErr, "unable to load config from environment")
+		os.Exit(1)
+	}
+	if err := validateConfig(cfg); err != nil {
+		log.Error(err, "invalid config")
+		os.Exit(1)
+	}
+	shard := controller.Shard{Index: cfg.Controller.ShardIndex, Count: cfg.Controller.ShardCount}
 
 	webhookServer := webhook.NewServer(webhook.Options{})
 
@@ -81,11 +155,11 @@ func main() {
 	// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.19.1/pkg/metrics/server
 	// - https://book.kubebuilder.io/reference/metrics.html
 	metricsServerOptions := metricsserver.Options{
-		BindAddress:   metricsAddr,
-		SecureServing: secureMetrics,
+		BindAddress:   f.metricsAddr,
+		SecureServing: f.secureMetrics,
 	}
 
-	if secureMetrics {
+	if f.secureMetrics {
 		// FilterProvider is used to protect the metrics endpoint with authn/authz.
 		// These configurations ensure that only authorized users and service accounts
 		// can access the metrics endpoint. The RBAC are configured in 'config/rbac/kustomization.yaml'. More info:
@@ -97,54 +171,475 @@ func main() {
 		// this setup is not recommended for production.
 	}
 
-	mgr, err := ctrlruntime.NewManager(ctrlruntime.GetConfigOrDie(), ctrlruntime.Options{
+	v := version.Get()
+	log.Info("build info", "version", v.Version, "commit", v.Commit, "goVersion", v.GoVersion)
+
+	cacheOpts, err := controller.CacheOptions(cfg.WatchNamespaces, cfg.WatchLabelSelector)
+	if err != nil {
+		log.Error(err, "invalid watch scope")
+		os.Exit(1)
+	}
+	log.Info("watch scope", "namespaces", cfg.WatchNamespaces, "labelSelector", cfg.WatchLabelSelector,
+		"shardIndex", shard.Index, "shardCount", shard.Count)
+
+	restCfg, err := ctrlconfig.GetConfigWithContext(f.kubeContext)
+	if err != nil {
+		log.Error(err, "unable to load the kubeconfig")
+		os.Exit(1)
+	}
+
+	mgr, err := ctrlruntime.NewManager(restCfg, ctrlruntime.Options{
 		Scheme:                 scheme,
 		Metrics:                metricsServerOptions,
 		WebhookServer:          webhookServer,
-		HealthProbeBindAddress: probeAddr,
-		LeaderElection:         enableLeaderElection,
-		LeaderElectionID:       "0f70e84f.0x5d.org",
+		HealthProbeBindAddress: f.probeAddr,
+		Cache:                  cacheOpts,
+		LeaderElection:         f.enableLeaderElection,
+		// Each shard elects its own leader.
+		LeaderElectionID: shard.LeaderElectionID(cfg.LeaderElectionID),
 	})
 	if err != nil {
 		log.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
-	var cfg config.Config
-	err = envconfig.Process(context.Background(), &cfg)
+	// TODO: Print config.
+
+	settings, err := loadSettings(cfg)
 	if err != nil {
-		log.Error(err, "unable to load config from environment")
+		log.Error(err, "invalid controller settings")
 		os.Exit(1)
 	}
 
-	log.Info("namespace", "namespace", namespace)
-	// TODO: Print config.
-
-	gcpClient, err := gcp.NewClient(context.Background(), *cfg.GCP)
+	g, err := setupGCP(log, mgr, cfg, f.fakeGCP)
 	if err != nil {
-		log.Error(err, "unable to initialize GCP client")
+		log.Error(err, "unable to set up GCP")
 		os.Exit(1)
 	}
+	reconcilerOpts := []controller.Option{
+		controller.WithAPIReader(mgr.GetAPIReader()),
+		controller.WithSettings(settings),
+		controller.WithClass(cfg.Controller.Class),
+		controller.WithEventRecorder(mgr.GetEventRecorderFor("psc-portmapper")),
+	}
+	if g.provider != nil {
+		reconcilerOpts = append(reconcilerOpts, controller.WithClientProvider(g.provider))
+	}
+	if g.states != nil {
+		reconcilerOpts = append(reconcilerOpts, controller.WithStateStore(g.states))
+	}
+
+	if f.restoreSnapshot != "" {
+		ctx := ctrlruntime.SetupSignalHandler()
+		err = restoreFromSnapshot(ctx, restCfg, g.client, reconcilerOpts, g.snapshots, f.restoreSnapshot)
+		if closeErr := g.close(); closeErr != nil {
+			log.Error(closeErr, "problem closing the GCP clients")
+		}
+		if err != nil {
+			log.Error(err, "failed to restore the snapshot", "statefulset", f.restoreSnapshot)
+			os.Exit(1)
+		}
+		return
+	}
+	if f.once != "" {
+		err = reconcileOnce(ctrlruntime.SetupSignalHandler(), restCfg, g.client, reconcilerOpts, f.once)
+		if closeErr := g.close(); closeErr != nil {
+			log.Error(closeErr, "problem closing the GCP clients")
+		}
+		if err != nil {
+			log.Error(err, "failed to reconcile", "statefulset", f.once)
+			os.Exit(1)
+		}
+		return
+	}
 
-	portmapper := controller.New(mgr.GetClient(), gcpClient)
+	// The shard only applies to the manager's reconciler, so that --once reconciles any StatefulSet.
+	reconcilerOpts = append(reconcilerOpts, controller.WithShard(shard))
+	portmapper := controller.New(mgr.GetClient(), g.client, reconcilerOpts...)
 	err = portmapper.SetupWithManager(mgr)
 	if err != nil {
 		log.Error(err, "unable to setup controller")
 		os.Exit(1)
 	}
-
-	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
-		log.Error(err, "unable to set up health check")
+	registerWebhooks(log, mgr, *cfg.Controller, portmapper)
+	err = addRunnables(log, mgr, cfg, f, g, portmapper)
+	if err != nil {
+		log.Error(err, "unable to set up the manager")
 		os.Exit(1)
 	}
-	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
-		log.Error(err, "unable to set up ready check")
+	err = addHealthChecks(mgr, *cfg.Controller, portmapper, g.check)
+	if err != nil {
+		log.Error(err, "unable to set up the health checks")
 		os.Exit(1)
 	}
 
 	log.Info("starting manager")
-	if err := mgr.Start(ctrlruntime.SetupSignalHandler()); err != nil {
+	err = mgr.Start(ctrlruntime.SetupSignalHandler())
+	// Start only returns once all the controllers have stopped, so no reconcile is using the
+	// GCP clients anymore.
+	if closeErr := g.close(); closeErr != nil {
+		log.Error(closeErr, "problem closing the GCP clients")
+	}
+	if err != nil {
 		log.Error(err, "problem running manager")
 		os.Exit(1)
 	}
 }
+
+// validateConfig returns an error if the controller's config is invalid, naming the
+// environment variable that's wrong.
+func validateConfig(cfg config.Config) error {
+	c := cfg.Controller
+	if err := controller.InvalidSpecMode(c.InvalidSpecs).Validate(); err != nil {
+		return fmt.Errorf("invalid CONTROLLER_INVALID_SPECS: %w", err)
+	}
+	if err := controller.ValidateCanarySubnet(c.CanarySubnet); err != nil {
+		return fmt.Errorf("invalid CONTROLLER_CANARY_SUBNET: %w", err)
+	}
+	if err := controller.ValidateAdoptionReportConfigMap(c.AdoptionReportConfigMap); err != nil {
+		return fmt.Errorf("invalid CONTROLLER_ADOPTION_REPORT_CONFIG_MAP: %w", err)
+	}
+	if err := controller.ValidateReleasedNodePorts(c.NodePortCooldown, c.ReleasedNodePortsConfigMap); err != nil {
+		return fmt.Errorf("invalid CONTROLLER_RELEASED_NODE_PORTS_CONFIG_MAP: %w", err)
+	}
+	if _, err := controller.ParseInstanceSources(c.InstanceSources); err != nil {
+		return fmt.Errorf("invalid CONTROLLER_INSTANCE_SOURCES: %w", err)
+	}
+	shard := controller.Shard{Index: c.ShardIndex, Count: c.ShardCount}
+	if err := shard.Validate(); err != nil {
+		return fmt.Errorf("invalid CONTROLLER_SHARD_INDEX or CONTROLLER_SHARD_COUNT: %w", err)
+	}
+	return nil
+}
+
+// loadSettings returns the reconciler settings for the environment's config, and the config
+// file's if it's set.
+func loadSettings(cfg config.Config) (controller.Settings, error) {
+	if cfg.ConfigFile == "" {
+		return settingsFor(*cfg.Controller, &config.FileConfig{})
+	}
+	file, err := config.LoadFile(cfg.ConfigFile)
+	if err != nil {
+		return controller.Settings{}, fmt.Errorf("unable to load the config file %s: %w", cfg.ConfigFile, err)
+	}
+	return settingsFor(file.Apply(*cfg.Controller), file)
+}
+
+// gcpSetup is what the controller manages the GCP resources with.
+type gcpSetup struct {
+	client gcp.Client
+	// The provider of the clients for per-spec credentials. Nil with a fake GCP client.
+	provider *gcp.CachingClientProvider
+	// The stores of the snapshots and of the applied state, if they're set. They stay nil
+	// with a fake GCP client, so that snapshots are written to ConfigMaps.
+	snapshots gcp.ObjectStore
+	states    gcp.ObjectStore
+	// close closes the clients, and check checks that the GCP API can be reached.
+	close func() error
+	check healthz.Checker
+}
+
+// setupGCP builds the GCP clients, or an in-memory fake one if fakeGCP is set.
+func setupGCP(log logr.Logger, mgr ctrlruntime.Manager, cfg config.Config, fakeGCP bool) (*gcpSetup, error) {
+	if fakeGCP {
+		log.Info("using an in-memory fake GCP client, no actual GCP resources will be managed")
+		return &gcpSetup{
+			client: fake.New(cfg.GCP.Project, cfg.GCP.Region),
+			close:  func() error { return nil },
+			check:  healthz.Ping,
+		}, nil
+	}
+	ctx := context.Background()
+	err := detectGCPConfig(ctx, mgr.GetAPIReader(), cfg.GCP)
+	if err != nil {
+		return nil, fmt.Errorf("unable to detect the GCP config: %w", err)
+	}
+	log.Info("GCP config", "project", cfg.GCP.Project, "region", cfg.GCP.Region, "network", cfg.GCP.Network)
+	c, err := gcp.NewClient(ctx, *cfg.GCP)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize GCP client: %w", err)
+	}
+	p, err := gcp.NewClientProvider(ctx, *cfg.GCP)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize GCP client provider: %w", err)
+	}
+	g := &gcpSetup{
+		client:   c,
+		provider: p,
+		close:    func() error { return multierr.Combine(c.Close(), p.Close()) },
+		check: func(req *http.Request) error {
+			ctx, cancel := context.WithTimeout(req.Context(), gcpCheckTimeout)
+			defer cancel()
+			return c.Check(ctx)
+		},
+	}
+	if cfg.GCP.SnapshotBucket != "" {
+		g.snapshots, err = gcp.NewGCSObjects(ctx, *cfg.GCP, cfg.GCP.SnapshotBucket)
+		if err != nil {
+			return nil, fmt.Errorf("unable to initialize the snapshot store: %w", err)
+		}
+	}
+	if cfg.GCP.StateBucket != "" {
+		g.states, err = gcp.NewGCSObjects(ctx, *cfg.GCP, cfg.GCP.StateBucket)
+		if err != nil {
+			return nil, fmt.Errorf("unable to initialize the state store: %w", err)
+		}
+	}
+	return g, nil
+}
+
+// registerWebhooks registers the webhooks enabled in c. The webhook server is only started
+// once a webhook is registered.
+func registerWebhooks(
+	log logr.Logger,
+	mgr ctrlruntime.Manager,
+	c config.ControllerConfig,
+	r *controller.PortmapReconciler,
+) {
+	hooks := []struct {
+		enabled bool
+		name    string
+		path    string
+		handler admission.Handler
+	}{
+		{c.AdvertiseWebhook, "advertise", controller.AdvertisePath, r.AdvertiseHandler()},
+		{c.DefaultingWebhook, "defaulting", controller.DefaultingPath, r.DefaultingHandler()},
+		{c.ValidationWebhook, "validation", controller.ValidationPath, r.ValidationHandler()},
+		{c.DeletionGuardWebhook, "deletion guard", controller.DeletionGuardPath, r.DeletionGuardHandler()},
+	}
+	for _, h := range hooks {
+		if !h.enabled {
+			continue
+		}
+		mgr.GetWebhookServer().Register(h.path, &webhook.Admission{Handler: h.handler})
+		log.Info(fmt.Sprintf("serving the %s webhook", h.name), "path", h.path)
+	}
+}
+
+// addRunnables adds the optional runnables enabled by the config and the flags to the manager.
+func addRunnables(
+	log logr.Logger,
+	mgr ctrlruntime.Manager,
+	cfg config.Config,
+	f flags,
+	g *gcpSetup,
+	r *controller.PortmapReconciler,
+) error {
+	// The asset feed needs actual GCP resources.
+	if g.provider != nil && cfg.GCP.AssetFeedSubscription != "" {
+		feedLog := ctrlruntime.Log.WithName("assetfeed")
+		feed, err := gcp.NewAssetFeed(context.Background(), feedLog, *cfg.GCP, r.ResourceChanged)
+		if err != nil {
+			return fmt.Errorf("unable to initialize the asset feed: %w", err)
+		}
+		if err := mgr.Add(feed); err != nil {
+			return fmt.Errorf("unable to add the asset feed: %w", err)
+		}
+	}
+	if cfg.Controller.SnapshotInterval > 0 {
+		exporterLog := ctrlruntime.Log.WithName("snapshots")
+		if err := mgr.Add(r.SnapshotExporter(exporterLog, cfg.Controller.SnapshotInterval, g.snapshots)); err != nil {
+			return fmt.Errorf("unable to add the snapshot exporter: %w", err)
+		}
+	}
+	if f.debugAddr != "" {
+		if err := mgr.Add(debug.NewServer(f.debugAddr, debugSources(g, r))); err != nil {
+			return fmt.Errorf("unable to add the debug server: %w", err)
+		}
+		log.Info("serving diagnostics", "address", f.debugAddr)
+	}
+	if f.apiAddr != "" {
+		filter, err := filters.WithAuthenticationAndAuthorization(mgr.GetConfig(), mgr.GetHTTPClient())
+		if err != nil {
+			return fmt.Errorf("unable to set up the API's authentication: %w", err)
+		}
+		if err := mgr.Add(api.NewServer(ctrlruntime.Log.WithName("api"), f.apiAddr, f.apiCertDir, filter, r)); err != nil {
+			return fmt.Errorf("unable to add the API server: %w", err)
+		}
+	}
+	if cfg.ConfigFile != "" {
+		w, err := config.WatchFile(log.WithName("config"), cfg.ConfigFile, func(f *config.FileConfig) error {
+			settings, err := settingsFor(f.Apply(*cfg.Controller), f)
+			if err != nil {
+				return err
+			}
+			r.SetSettings(settings)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("unable to watch the config file %s: %w", cfg.ConfigFile, err)
+		}
+		if err := mgr.Add(w); err != nil {
+			return fmt.Errorf("unable to add the config file watcher: %w", err)
+		}
+	}
+	return nil
+}
+
+// debugSources returns the diagnostics the debug server exposes.
+func debugSources(g *gcpSetup, r *controller.PortmapReconciler) debug.Sources {
+	sources := debug.Sources{
+		Metrics:    ctrlmetrics.Registry,
+		Reconciles: func() any { return r.LastResults() },
+		Bulk: func() any {
+			p, err := r.BulkProgress(context.Background())
+			if err != nil {
+				return map[string]string{"error": err.Error()}
+			}
+			return p
+		},
+	}
+	if g.provider != nil {
+		sources.GCPClients = func() any { return g.provider.Cached() }
+	}
+	return sources
+}
+
+// addHealthChecks adds the liveness and readiness checks, check being the GCP API's.
+func addHealthChecks(
+	mgr ctrlruntime.Manager,
+	c config.ControllerConfig,
+	r *controller.PortmapReconciler,
+	check healthz.Checker,
+) error {
+	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
+		return fmt.Errorf("unable to set up health check: %w", err)
+	}
+	if c.StuckThreshold > 0 {
+		if err := mgr.AddHealthzCheck("reconciles", r.StuckCheck(c.StuckThreshold)); err != nil {
+			return fmt.Errorf("unable to set up the reconciles health check: %w", err)
+		}
+	}
+	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
+		return fmt.Errorf("unable to set up ready check: %w", err)
+	}
+	if err := mgr.AddReadyzCheck("gcp", check); err != nil {
+		return fmt.Errorf("unable to set up the GCP ready check: %w", err)
+	}
+	return nil
+}
+
+// detectGCPConfig fills in the GCP project, region and network if they're unset, using the
+// metadata server when running on GCE, and the nodes' provider IDs otherwise.
+func detectGCPConfig(ctx context.Context, reader client.Reader, cfg *gcp.ClientConfig) error {
+	if cfg.Project != "" && cfg.Region != "" && cfg.Network != "" {
+		return nil
+	}
+	var md gcp.Metadata
+	if metadata.OnGCE() {
+		md = metadata.NewClient(nil)
+	}
+	nodes := &corev1.NodeList{}
+	// Nodes of the same cluster are in the same project and region, so any will do.
+	err := reader.List(ctx, nodes, client.Limit(10))
+	if err != nil {
+		return fmt.Errorf("failed to list nodes: %w", err)
+	}
+	providerIDs := make([]string, 0, len(nodes.Items))
+	for _, n := range nodes.Items {
+		providerIDs = append(providerIDs, n.Spec.ProviderID)
+	}
+	return gcp.Detect(ctx, cfg, md, providerIDs)
+}
+
+// reconcileOnce reconciles the StatefulSet named "<namespace>/<name>" once. The manager isn't
+// started, so it reads from the API server directly instead of from the cache.
+func reconcileOnce(
+	ctx context.Context,
+	restCfg *rest.Config,
+	gcpClient gcp.Client,
+	opts []controller.Option,
+	name string,
+) error {
+	namespace, n, ok := strings.Cut(name, "/")
+	if !ok || namespace == "" || n == "" {
+		return fmt.Errorf("invalid StatefulSet %q, it must be <namespace>/<name>", name)
+	}
+	c, err := client.New(restCfg, client.Options{Scheme: scheme})
+	if err != nil {
+		return fmt.Errorf("failed to create the Kubernetes client: %w", err)
+	}
+	r := controller.New(c, gcpClient, append(opts, controller.WithAPIReader(c))...)
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: namespace, Name: n}}
+	res, err := r.Reconcile(ctx, req)
+	if err != nil {
+		return err
+	}
+	ctrlruntime.Log.WithName("setup").Info("reconciled", "statefulset", name, "requeueAfter", res.RequeueAfter)
+	return nil
+}
+
+// restoreFromSnapshot recreates the resources missing from the last snapshot of the StatefulSet
+// named "<namespace>/<name>". Like reconcileOnce, it reads from the API server directly.
+func restoreFromSnapshot(
+	ctx context.Context,
+	restCfg *rest.Config,
+	gcpClient gcp.Client,
+	opts []controller.Option,
+	store gcp.ObjectStore,
+	name string,
+) error {
+	namespace, n, ok := strings.Cut(name, "/")
+	if !ok || namespace == "" || n == "" {
+		return fmt.Errorf("invalid StatefulSet %q, it must be <namespace>/<name>", name)
+	}
+	c, err := client.New(restCfg, client.Options{Scheme: scheme})
+	if err != nil {
+		return fmt.Errorf("failed to create the Kubernetes client: %w", err)
+	}
+	r := controller.New(c, gcpClient, append(opts, controller.WithAPIReader(c))...)
+	snapshot, err := r.ReadSnapshot(ctx, types.NamespacedName{Namespace: namespace, Name: n}, store)
+	if err != nil {
+		return err
+	}
+	log := ctrlruntime.Log.WithName("restore").WithValues("statefulset", name)
+	log.Info("restoring", "takenAt", snapshot.TakenAt, "controllerVersion", snapshot.ControllerVersion)
+	restored, err := r.RestoreSnapshot(ctx, log, snapshot)
+	log.Info("restored", "resources", restored)
+	return err
+}
+
+// settingsFor returns the reconciler settings for c and the spec defaults and policy in f, or
+// an error if the latter are invalid.
+func settingsFor(c config.ControllerConfig, f *config.FileConfig) (controller.Settings, error) {
+	// They're validated at startup.
+	instanceSources, _ := controller.ParseInstanceSources(c.InstanceSources)
+	defaults, err := controller.ParseSpecDefaults(f.SpecDefaults)
+	if err != nil {
+		return controller.Settings{}, err
+	}
+	policy, err := controller.ParsePolicy(f.Policy)
+	if err != nil {
+		return controller.Settings{}, err
+	}
+	return controller.Settings{
+		RequeueDelay:                c.RequeueDelay,
+		DriftCheckInterval:          c.DriftCheckInterval,
+		StuckAfterFailures:          c.StuckAfterFailures,
+		InvalidSpecs:                controller.InvalidSpecMode(c.InvalidSpecs),
+		DrainTimeout:                c.DrainTimeout,
+		ConnectionLimitAlertPercent: c.ConnectionLimitAlertPercent,
+		NatSubnetAlertPercent:       c.NatSubnetAlertPercent,
+		NEGEndpointLimit:            c.NEGEndpointLimit,
+		ProbeTimeout:                c.ProbeTimeout,
+		StepTimeout:                 c.StepTimeout,
+		CanarySubnet:                c.CanarySubnet,
+		StatusWriteInterval:         c.StatusWriteInterval,
+		InstanceSources:             instanceSources,
+		AdoptionReportConfigMap:     c.AdoptionReportConfigMap,
+		ExternalState:               c.ExternalState,
+		BulkOperationsPerMinute:     c.BulkOperationsPerMinute,
+		NodePortCooldown:            c.NodePortCooldown,
+		ReleasedNodePortsConfigMap:  c.ReleasedNodePortsConfigMap,
+		RateLimit: controller.RateLimit{
+			BaseDelay:      c.RateLimit.BaseDelay,
+			MaxDelay:       c.RateLimit.MaxDelay,
+			QPS:            c.RateLimit.QPS,
+			Burst:          c.RateLimit.Burst,
+			NamespaceQPS:   c.RateLimit.NamespaceQPS,
+			NamespaceBurst: c.RateLimit.NamespaceBurst,
+		},
+		SpecDefaults: defaults.WithGlobalAccess(c.GlobalAccessDefault),
+		Policy:       policy,
+	}, nil
+}
@@ -0,0 +1,279 @@
+// Package plan computes the GCP resources and port mappings the controller would create for a
+// StatefulSet, without calling GCP or the API server, so that tools like CLIs, admission
+// webhooks or CI checks can preview them. Its types are meant to be serialized, e.g. to JSON.
+package plan
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/0x5d/psc-portmapper/internal/controller"
+	"github.com/0x5d/psc-portmapper/internal/gcp"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/ptr"
+)
+
+// Plan is what reconciling a StatefulSet's spec would create.
+type Plan struct {
+	// The StatefulSet's namespace/name.
+	StatefulSet string `json:"stateful_set"`
+	Prefix      string `json:"prefix"`
+	// The Kubernetes objects created in the StatefulSet's namespace. PortsConfigMap is empty
+	// unless the spec sets ports_config_map.
+	NodePortService string `json:"node_port_service"`
+	PortsConfigMap  string `json:"ports_config_map,omitempty"`
+
+	Firewalls      []Firewall     `json:"firewalls"`
+	NEG            NEG            `json:"neg"`
+	BackendService BackendService `json:"backend_service"`
+	// The original forwarding rule and service attachment first, then the migration's. There
+	// are none while the StatefulSet is torn down as per scale_to_zero.
+	ForwardingRules    []ForwardingRule    `json:"forwarding_rules,omitempty"`
+	ServiceAttachments []ServiceAttachment `json:"service_attachments,omitempty"`
+	// The name of the canary consumer endpoint, if the spec enables it and a canary subnet is
+	// set, see WithCanarySubnet.
+	Canary string `json:"canary,omitempty"`
+
+	// PortMappings are sorted by port.
+	PortMappings []PortMapping `json:"port_mappings"`
+	UnmappedPods []UnmappedPod `json:"unmapped_pods,omitempty"`
+}
+
+// Firewall is a firewall rule allowing traffic to the nodes.
+type Firewall struct {
+	Name string `json:"name"`
+	FQN  string `json:"fqn"`
+	// The TCP ports allowed, sorted. Empty if the rule allows ICMP.
+	Ports []int32 `json:"ports,omitempty"`
+	ICMP  bool    `json:"icmp,omitempty"`
+	// If neither is set, all sources are allowed. The ICMP rule's sources are the NAT subnets'
+	// ranges, which are only known to GCP, so they're never set for it.
+	SourceRanges      []string `json:"source_ranges,omitempty"`
+	SourceTags        []string `json:"source_tags,omitempty"`
+	DestinationRanges []string `json:"destination_ranges,omitempty"`
+	Priority          int32    `json:"priority"`
+}
+
+// NEG is the network endpoint group holding the port mappings.
+type NEG struct {
+	Name string `json:"name"`
+	FQN  string `json:"fqn"`
+	// Empty if it's the controller's subnet.
+	Subnetwork  string `json:"subnetwork,omitempty"`
+	DefaultPort *int32 `json:"default_port,omitempty"`
+}
+
+type BackendService struct {
+	Name string `json:"name"`
+	FQN  string `json:"fqn"`
+	NEG  string `json:"neg"`
+}
+
+type ForwardingRule struct {
+	Name           string `json:"name"`
+	FQN            string `json:"fqn"`
+	BackendService string `json:"backend_service"`
+	// Empty if it's the controller's subnet.
+	Subnetwork string `json:"subnetwork,omitempty"`
+	// Empty if it's allocated by GCP.
+	IP           string `json:"ip,omitempty"`
+	GlobalAccess bool   `json:"global_access,omitempty"`
+	Migration    bool   `json:"migration,omitempty"`
+}
+
+type ServiceAttachment struct {
+	Name           string   `json:"name"`
+	FQN            string   `json:"fqn"`
+	ForwardingRule string   `json:"forwarding_rule"`
+	NatSubnets     []string `json:"nat_subnets"`
+	// The consumers of the spec's consumer_accept_list, with the default connection limit
+	// applied. The ones referenced with consumer_accept_list_from aren't included.
+	Consumers []Consumer `json:"consumers,omitempty"`
+	Migration bool       `json:"migration,omitempty"`
+}
+
+// Consumer is accepted by the service attachments. Either Network or Project is set.
+type Consumer struct {
+	Network         string `json:"network,omitempty"`
+	Project         string `json:"project,omitempty"`
+	ConnectionLimit uint32 `json:"connection_limit"`
+}
+
+// PortMapping maps the port consumers connect to to a node port of the instance a pod runs on.
+type PortMapping struct {
+	Pod string `json:"pod"`
+	// The name of the node port, as in the spec's node_ports.
+	NodePortName string `json:"node_port_name"`
+	Port         int32  `json:"port"`
+	Instance     string `json:"instance"`
+	InstancePort int32  `json:"instance_port"`
+}
+
+// UnmappedPod is a pod whose ports aren't mapped, and why, e.g. because it isn't scheduled yet.
+type UnmappedPod struct {
+	Pod    string `json:"pod"`
+	Reason string `json:"reason"`
+}
+
+type options struct {
+	settings controller.Settings
+	err      error
+}
+
+type Option func(*options)
+
+// WithInstanceSources sets where the nodes' instances are read from, in the format of the
+// controller's INSTANCE_SOURCES, e.g. provider-id or label:kubernetes.io/hostname.
+func WithInstanceSources(sources ...string) Option {
+	return func(o *options) {
+		o.settings.InstanceSources, o.err = controller.ParseInstanceSources(sources)
+	}
+}
+
+// WithNEGEndpointLimit sets the NEG's endpoint limit, which caps how many pods are mapped. It
+// defaults to the controller's default.
+func WithNEGEndpointLimit(limit int) Option {
+	return func(o *options) {
+		o.settings.NEGEndpointLimit = limit
+	}
+}
+
+// WithCanarySubnet sets the controller's canary subnet, which the canary is created in if the
+// spec enables it.
+func WithCanarySubnet(fqn string) Option {
+	return func(o *options) {
+		o.settings.CanarySubnet = fqn
+	}
+}
+
+// Compute returns the plan for the StatefulSet's spec, which is read from its annotation (see
+// api.SpecAnnotation), given its pods and the nodes they're scheduled on.
+// project and region are those the controller runs in.
+func Compute(
+	project, region string,
+	sts *appsv1.StatefulSet,
+	pods []corev1.Pod,
+	nodes []corev1.Node,
+	opts ...Option,
+) (*Plan, error) {
+	o := options{settings: controller.DefaultSettings()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.err != nil {
+		return nil, o.err
+	}
+	state, err := controller.Plan(sts, pods, nodes, project, o.settings)
+	if err != nil {
+		return nil, err
+	}
+	spec := state.Spec
+	p := &Plan{
+		StatefulSet:     fmt.Sprintf("%s/%s", sts.Namespace, sts.Name),
+		Prefix:          spec.Prefix,
+		NodePortService: state.NodePortService,
+		PortsConfigMap:  state.PortsConfigMap,
+		NEG: NEG{
+			Name:        state.NEG,
+			FQN:         gcp.NEGFQN(project, region, state.NEG),
+			Subnetwork:  cmp.Or(spec.NEGSubnetFQN, spec.Subnetwork),
+			DefaultPort: spec.NEGDefaultPort,
+		},
+		BackendService: BackendService{
+			Name: state.BackendService,
+			FQN:  gcp.BackendServiceFQN(project, region, state.BackendService),
+			NEG:  gcp.NEGFQN(project, region, state.NEG),
+		},
+		Canary:       state.Canary,
+		PortMappings: []PortMapping{},
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(state.Firewalls)) {
+		p.Firewalls = append(p.Firewalls, firewall(project, name, state.Firewalls[name]))
+	}
+	if state.ICMPFirewall != "" {
+		p.Firewalls = append(p.Firewalls, firewall(project, state.ICMPFirewall, gcp.FirewallRule{
+			ICMP:              true,
+			DestinationRanges: spec.DestinationRanges,
+			Priority:          spec.FirewallPriority,
+		}))
+	}
+
+	var consumers []Consumer
+	for _, c := range spec.ConsumerAcceptList {
+		consumers = append(consumers, Consumer{
+			Network:         ptr.Deref(c.NetworkFQN, ""),
+			Project:         ptr.Deref(c.ProjectIdOrNum, ""),
+			ConnectionLimit: c.ConnectionLimit,
+		})
+	}
+	for _, a := range state.Attachments {
+		fwdRule := ForwardingRule{
+			Name:           a.ForwardingRule,
+			FQN:            gcp.ForwardingRuleFQN(project, region, a.ForwardingRule),
+			BackendService: p.BackendService.FQN,
+			Subnetwork:     spec.Subnetwork,
+			IP:             ptr.Deref(spec.IP, ""),
+			GlobalAccess:   ptr.Deref(spec.GlobalAccess, false),
+		}
+		svcAtt := ServiceAttachment{
+			Name:           a.ServiceAttachment,
+			FQN:            gcp.ServiceAttachmentFQN(project, region, a.ServiceAttachment),
+			ForwardingRule: fwdRule.FQN,
+			NatSubnets:     spec.NatSubnetFQNs,
+			Consumers:      consumers,
+		}
+		if a.Migration {
+			fwdRule.Subnetwork, fwdRule.IP, fwdRule.Migration = spec.Migration.SubnetFQN, ptr.Deref(spec.Migration.IP, ""), true
+			svcAtt.NatSubnets, svcAtt.Migration = spec.Migration.NatSubnetFQNs, true
+		}
+		p.ForwardingRules = append(p.ForwardingRules, fwdRule)
+		p.ServiceAttachments = append(p.ServiceAttachments, svcAtt)
+	}
+
+	// The pods' ordinals and port names are recovered from the ports, which are offset from
+	// each node port's starting port by the pod's index.
+	var start int32
+	if sts.Spec.Ordinals != nil {
+		start = sts.Spec.Ordinals.Start
+	}
+	for _, m := range state.Mappings {
+		for name, pc := range spec.NodePorts {
+			if pc.NodePort != m.InstancePort {
+				continue
+			}
+			p.PortMappings = append(p.PortMappings, PortMapping{
+				Pod:          fmt.Sprintf("%s-%d", sts.Name, start+m.Port-pc.StartingPort),
+				NodePortName: name,
+				Port:         m.Port,
+				Instance:     m.Instance,
+				InstancePort: m.InstancePort,
+			})
+			break
+		}
+	}
+	for _, u := range state.Unmapped {
+		p.UnmappedPods = append(p.UnmappedPods, UnmappedPod{Pod: u.Pod.Name, Reason: u.Reason})
+	}
+	return p, nil
+}
+
+func firewall(project, name string, r gcp.FirewallRule) Firewall {
+	fw := Firewall{
+		Name:              name,
+		FQN:               gcp.FirewallFQN(project, name),
+		Ports:             slices.Sorted(maps.Keys(r.Ports)),
+		ICMP:              r.ICMP,
+		SourceRanges:      r.SourceRanges,
+		SourceTags:        r.SourceTags,
+		DestinationRanges: r.DestinationRanges,
+		Priority:          gcp.DefaultFirewallPriority,
+	}
+	if r.Priority != nil {
+		fw.Priority = *r.Priority
+	}
+	return fw
+}
@@ -0,0 +1,196 @@
+package plan
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/0x5d/psc-portmapper/api"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	project = "my-project"
+	region  = "us-east1"
+	subnet  = "projects/my-project/regions/us-east1/subnetworks/my-subnet"
+)
+
+func statefulSet(spec string) *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "sts",
+			Annotations: map[string]string{api.SpecAnnotation: spec},
+		},
+		Spec: appsv1.StatefulSetSpec{Replicas: ptr.To(int32(3))},
+	}
+}
+
+func pod(name, node string) corev1.Pod {
+	return corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec:       corev1.PodSpec{NodeName: node},
+	}
+}
+
+func TestCompute(t *testing.T) {
+	nodes := []corev1.Node{{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-0"},
+		Spec:       corev1.NodeSpec{ProviderID: "gce://my-project/us-east1-a/node-0"},
+	}}
+	pods := []corev1.Pod{pod("sts-0", "node-0"), pod("sts-1", "node-0"), pod("sts-2", "")}
+	instance := "projects/my-project/zones/us-east1-a/instances/node-0"
+
+	tests := []struct {
+		name     string
+		spec     string
+		opts     []Option
+		expected *Plan
+		err      string
+	}{{
+		name: "Maps the scheduled pods' ports",
+		spec: `{
+			"prefix": "p-",
+			"nat_subnet_fqns": ["` + subnet + `"],
+			"consumer_accept_list": [{"project_id_or_num": "consumer"}],
+			"default_connection_limit": 10,
+			"source_ranges": ["10.0.0.0/8"],
+			"node_ports": {
+				"app": {"node_port": 30000, "container_port": 8080, "starting_port": 40000},
+				"admin": {"node_port": 30001, "container_port": 9090, "starting_port": 50000}
+			}
+		}`,
+		expected: &Plan{
+			StatefulSet:     "default/sts",
+			Prefix:          "p-",
+			NodePortService: "p-psc-portmapper",
+			Firewalls: []Firewall{{
+				Name:         "p-psc-portmapper-firewall",
+				FQN:          "projects/my-project/global/firewalls/p-psc-portmapper-firewall",
+				Ports:        []int32{30000, 30001},
+				SourceRanges: []string{"10.0.0.0/8"},
+				Priority:     1000,
+			}},
+			NEG: NEG{
+				Name: "p-psc-portmapper-neg",
+				FQN:  "projects/my-project/regions/us-east1/networkEndpointGroups/p-psc-portmapper-neg",
+			},
+			BackendService: BackendService{
+				Name: "p-psc-portmapper-backend",
+				FQN:  "projects/my-project/regions/us-east1/backendServices/p-psc-portmapper-backend",
+				NEG:  "projects/my-project/regions/us-east1/networkEndpointGroups/p-psc-portmapper-neg",
+			},
+			ForwardingRules: []ForwardingRule{{
+				Name:           "p-psc-portmapper-fwdrule",
+				FQN:            "projects/my-project/regions/us-east1/forwardingRules/p-psc-portmapper-fwdrule",
+				BackendService: "projects/my-project/regions/us-east1/backendServices/p-psc-portmapper-backend",
+			}},
+			ServiceAttachments: []ServiceAttachment{{
+				Name:           "p-psc-portmapper-svcatt",
+				FQN:            "projects/my-project/regions/us-east1/serviceAttachments/p-psc-portmapper-svcatt",
+				ForwardingRule: "projects/my-project/regions/us-east1/forwardingRules/p-psc-portmapper-fwdrule",
+				NatSubnets:     []string{subnet},
+				Consumers:      []Consumer{{Project: "consumer", ConnectionLimit: 10}},
+			}},
+			PortMappings: []PortMapping{
+				{Pod: "sts-0", NodePortName: "app", Port: 40000, Instance: instance, InstancePort: 30000},
+				{Pod: "sts-1", NodePortName: "app", Port: 40001, Instance: instance, InstancePort: 30000},
+				{Pod: "sts-0", NodePortName: "admin", Port: 50000, Instance: instance, InstancePort: 30001},
+				{Pod: "sts-1", NodePortName: "admin", Port: 50001, Instance: instance, InstancePort: 30001},
+			},
+			UnmappedPods: []UnmappedPod{{Pod: "sts-2", Reason: "it isn't scheduled"}},
+		},
+	}, {
+		name: "Plans the migration's attachment and the ICMP firewall",
+		spec: `{
+			"prefix": "p-",
+			"nat_subnet_fqns": ["` + subnet + `"],
+			"allow_icmp": true,
+			"migration": {"subnet_fqn": "` + subnet + `-2", "ip": "10.0.0.2", "nat_subnet_fqns": ["` + subnet + `-3"]},
+			"node_ports": {"app": {"node_port": 30000, "container_port": 8080, "starting_port": 40000}}
+		}`,
+		opts: []Option{WithNEGEndpointLimit(1)},
+		expected: &Plan{
+			StatefulSet:     "default/sts",
+			Prefix:          "p-",
+			NodePortService: "p-psc-portmapper",
+			Firewalls: []Firewall{{
+				Name:     "p-psc-portmapper-firewall",
+				FQN:      "projects/my-project/global/firewalls/p-psc-portmapper-firewall",
+				Ports:    []int32{30000},
+				Priority: 1000,
+			}, {
+				Name:     "p-psc-portmapper-firewall-icmp",
+				FQN:      "projects/my-project/global/firewalls/p-psc-portmapper-firewall-icmp",
+				ICMP:     true,
+				Priority: 1000,
+			}},
+			NEG: NEG{
+				Name: "p-psc-portmapper-neg",
+				FQN:  "projects/my-project/regions/us-east1/networkEndpointGroups/p-psc-portmapper-neg",
+			},
+			BackendService: BackendService{
+				Name: "p-psc-portmapper-backend",
+				FQN:  "projects/my-project/regions/us-east1/backendServices/p-psc-portmapper-backend",
+				NEG:  "projects/my-project/regions/us-east1/networkEndpointGroups/p-psc-portmapper-neg",
+			},
+			ForwardingRules: []ForwardingRule{{
+				Name:           "p-psc-portmapper-fwdrule",
+				FQN:            "projects/my-project/regions/us-east1/forwardingRules/p-psc-portmapper-fwdrule",
+				BackendService: "projects/my-project/regions/us-east1/backendServices/p-psc-portmapper-backend",
+			}, {
+				Name:           "p-psc-portmapper-migration-fwdrule",
+				FQN:            "projects/my-project/regions/us-east1/forwardingRules/p-psc-portmapper-migration-fwdrule",
+				BackendService: "projects/my-project/regions/us-east1/backendServices/p-psc-portmapper-backend",
+				Subnetwork:     subnet + "-2",
+				IP:             "10.0.0.2",
+				Migration:      true,
+			}},
+			ServiceAttachments: []ServiceAttachment{{
+				Name:           "p-psc-portmapper-svcatt",
+				FQN:            "projects/my-project/regions/us-east1/serviceAttachments/p-psc-portmapper-svcatt",
+				ForwardingRule: "projects/my-project/regions/us-east1/forwardingRules/p-psc-portmapper-fwdrule",
+				NatSubnets:     []string{subnet},
+			}, {
+				Name:           "p-psc-portmapper-migration-svcatt",
+				FQN:            "projects/my-project/regions/us-east1/serviceAttachments/p-psc-portmapper-migration-svcatt",
+				ForwardingRule: "projects/my-project/regions/us-east1/forwardingRules/p-psc-portmapper-migration-fwdrule",
+				NatSubnets:     []string{subnet + "-3"},
+				Migration:      true,
+			}},
+			PortMappings: []PortMapping{
+				{Pod: "sts-0", NodePortName: "app", Port: 40000, Instance: instance, InstancePort: 30000},
+			},
+			UnmappedPods: []UnmappedPod{
+				{Pod: "sts-1", Reason: "it's beyond the spec's capacity"},
+				{Pod: "sts-2", Reason: "it's beyond the spec's capacity"},
+			},
+		},
+	}, {
+		name: "Invalid spec",
+		spec: `{"prefix": "p-", "node_ports": {}}`,
+		err:  "invalid spec: nat_subnet_fqns is empty",
+	}, {
+		name: "Invalid instance sources",
+		spec: `{}`,
+		opts: []Option{WithInstanceSources("nope")},
+		err:  `invalid instance source "nope"`,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := Compute(project, region, statefulSet(tt.spec), pods, nodes, tt.opts...)
+			if tt.err != "" {
+				require.ErrorContains(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, p)
+			_, err = json.Marshal(p)
+			require.NoError(t, err)
+		})
+	}
+}
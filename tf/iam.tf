@@ -75,6 +75,7 @@ resource "google_project_iam_custom_role" "psc_portmapper_role" {
     "compute.serviceAttachments.list",
     "compute.serviceAttachments.update",
     "compute.serviceAttachments.use",
+    "compute.subnetworks.get",
     "compute.subnetworks.use",
   ]
 }